@@ -139,25 +139,14 @@ func New(cfg *Config) (*Alertmanager, error) {
 	return am, nil
 }
 
-// ApplyConfig applies a new configuration to an Alertmanager.
-func (am *Alertmanager) ApplyConfig(conf *config.Config) error {
-	var (
-		tmpl     *template.Template
-		pipeline notify.Stage
-	)
-
-	// TODO(cortex): How to support template files?
-	if len(conf.Templates) != 0 {
-		return fmt.Errorf("template files are not yet supported")
-	}
+// ApplyConfig applies a new configuration to an Alertmanager, with the
+// templates it refers to.
+func (am *Alertmanager) ApplyConfig(conf *config.Config, tmpl *template.Template) error {
+	var pipeline notify.Stage
 
-	tmpl, err := template.FromGlobs()
-	if err != nil {
-		return err
-	}
 	tmpl.ExternalURL = am.cfg.ExternalURL
 
-	err = am.api.Update(conf.String(), time.Duration(conf.Global.ResolveTimeout))
+	err := am.api.Update(conf.String(), time.Duration(conf.Global.ResolveTimeout))
 	if err != nil {
 		return err
 	}
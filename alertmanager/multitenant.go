@@ -1,17 +1,21 @@
 package alertmanager
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"net"
 	"net/http"
 	"os"
+	"reflect"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"golang.org/x/net/context"
 
+	"github.com/prometheus/alertmanager/config"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/log"
 
@@ -56,6 +60,9 @@ type MultitenantAlertmanagerConfig struct {
 	PollInterval  time.Duration
 	ClientTimeout time.Duration
 
+	// The org whose template files are shared with all orgs.
+	SharedTemplatesOrg string
+
 	MeshListenAddr string
 	MeshHWAddr     string
 	MeshNickname   string
@@ -73,6 +80,7 @@ func (cfg *MultitenantAlertmanagerConfig) RegisterFlags(f *flag.FlagSet) {
 	flag.Var(&cfg.ConfigsAPIURL, "alertmanager.configs.url", "URL of configs API server.")
 	flag.DurationVar(&cfg.PollInterval, "alertmanager.configs.poll-interval", 15*time.Second, "How frequently to poll Cortex configs")
 	flag.DurationVar(&cfg.ClientTimeout, "alertmanager.configs.client-timeout", 5*time.Second, "Timeout for requests to Weave Cloud configs service.")
+	flag.StringVar(&cfg.SharedTemplatesOrg, "alertmanager.configs.shared-templates-org", "", "ID of the org whose config's template files are shared with all orgs, which refer to them as shared/<filename> in their Alertmanager configs. The org gets no Alertmanager of its own. If empty, no templates are shared.")
 
 	flag.StringVar(&cfg.MeshListenAddr, "alertmanager.mesh.listen-address", net.JoinHostPort("0.0.0.0", strconv.Itoa(mesh.Port)), "Mesh listen address")
 	flag.StringVar(&cfg.MeshHWAddr, "alertmanager.mesh.hardware-address", mustHardwareAddr(), "MAC address, i.e. Mesh peer ID")
@@ -91,6 +99,10 @@ type MultitenantAlertmanager struct {
 	// All the organization configurations that we have. Only used for instrumentation.
 	cfgs map[string]configs.CortexConfig
 
+	// The template files of the SharedTemplatesOrg.
+	sharedTemplatesMtx sync.RWMutex
+	sharedTemplates    map[string]string
+
 	alertmanagersMtx sync.Mutex
 	alertmanagers    map[string]*Alertmanager
 
@@ -214,7 +226,25 @@ func (am *MultitenantAlertmanager) poll() (map[string]configs.CortexConfigView,
 func (am *MultitenantAlertmanager) addNewConfigs(cfgs map[string]configs.CortexConfigView) {
 	// TODO: instrument how many configs we have, both valid & invalid.
 	log.Debugf("Adding %d configurations", len(cfgs))
+
+	// Update the shared templates first, so the orgs' new configs are applied
+	// with them.
+	sharedChanged := false
+	if config, ok := cfgs[am.cfg.SharedTemplatesOrg]; ok && am.cfg.SharedTemplatesOrg != "" {
+		am.sharedTemplatesMtx.Lock()
+		if !reflect.DeepEqual(am.sharedTemplates, config.Config.TemplateFiles) {
+			am.sharedTemplates = config.Config.TemplateFiles
+			sharedChanged = true
+		}
+		am.sharedTemplatesMtx.Unlock()
+	}
+
+	applied := map[string]bool{}
 	for userID, config := range cfgs {
+		if userID == am.cfg.SharedTemplatesOrg {
+			continue
+		}
+
 		amConfig, err := config.Config.GetAlertmanagerConfig()
 		if err != nil {
 			// XXX: This means that if a user has a working configuration and
@@ -246,25 +276,96 @@ func (am *MultitenantAlertmanager) addNewConfigs(cfgs map[string]configs.CortexC
 		}
 
 		// If the config changed, apply the new one.
-		if am.cfgs[userID].AlertmanagerConfig != config.Config.AlertmanagerConfig {
+		if am.cfgs[userID].AlertmanagerConfig != config.Config.AlertmanagerConfig ||
+			!reflect.DeepEqual(am.cfgs[userID].TemplateFiles, config.Config.TemplateFiles) {
 			am.cfgs[userID] = config.Config
-			err := am.alertmanagers[userID].ApplyConfig(amConfig)
-			if err != nil {
-				log.Warnf("MultitenantAlertmanager: unable to apply Alertmanager config for %v: %v", userID, err)
-			}
+			am.applyConfig(userID, amConfig, config.Config.TemplateFiles)
+			applied[userID] = true
 		}
+	}
 
+	// Orgs may refer to the changed shared templates.
+	if sharedChanged {
+		for userID, config := range am.cfgs {
+			if applied[userID] {
+				continue
+			}
+			amConfig, err := config.GetAlertmanagerConfig()
+			if err != nil || len(amConfig.Templates) == 0 {
+				continue
+			}
+			am.applyConfig(userID, amConfig, config.TemplateFiles)
+		}
 	}
 	totalConfigs.Set(float64(len(am.cfgs)))
 }
 
-// ServeHTTP serves the Alertmanager's web UI and API.
+// applyConfig applies an org's Alertmanager config to its Alertmanager, with
+// the templates it refers to.
+func (am *MultitenantAlertmanager) applyConfig(userID string, amConfig *config.Config, templateFiles map[string]string) {
+	am.sharedTemplatesMtx.RLock()
+	tmpl, err := loadTemplates(am.cfg.DataDir, amConfig.Templates, templateFiles, am.sharedTemplates)
+	am.sharedTemplatesMtx.RUnlock()
+	if err != nil {
+		log.Warnf("MultitenantAlertmanager: unable to load templates for %v: %v", userID, err)
+		return
+	}
+	if err := am.alertmanagers[userID].ApplyConfig(amConfig, tmpl); err != nil {
+		log.Warnf("MultitenantAlertmanager: unable to apply Alertmanager config for %v: %v", userID, err)
+	}
+}
+
+// ValidateConfigHandler checks the Alertmanager config and template files of
+// a Cortex config, posted as JSON, before it is uploaded to the configs
+// service. The templates are checked along with the shared ones.
+func (am *MultitenantAlertmanager) ValidateConfigHandler(w http.ResponseWriter, req *http.Request) {
+	var cfg configs.CortexConfig
+	err := json.NewDecoder(req.Body).Decode(&cfg)
+	if err == nil {
+		am.sharedTemplatesMtx.RLock()
+		err = validateTemplates(am.cfg.DataDir, cfg, am.sharedTemplates, am.cfg.ExternalURL.URL)
+		am.sharedTemplatesMtx.RUnlock()
+	}
+
+	// We mimic the response format of the Prometheus API, as the
+	// distributor's validate_expr endpoint does.
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{
+			"status":    "error",
+			"errorType": "bad_data",
+			"error":     err.Error(),
+		})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{
+		"status": "success",
+	})
+}
+
+// ServeHTTP serves each user's Alertmanager's web UI and API to them: their
+// alerts, and their silences to create, update, get and expire. Only paths
+// which are the user's own are served, not eg. the /metrics and /debug/ ones
+// of the whole process, nor are responses cached or readable cross-origin.
 func (am *MultitenantAlertmanager) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if len(req.Header[http.CanonicalHeaderKey(orgIDHeaderName)]) > 1 {
+		http.Error(w, "more than one user ID", http.StatusBadRequest)
+		return
+	}
 	userID, _, err := user.ExtractFromHTTPRequest(req)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusUnauthorized)
 		return
 	}
+	var prefix string
+	if am.cfg.ExternalURL.URL != nil {
+		prefix = am.cfg.ExternalURL.URL.Path
+	}
+	if !isUserPath(strings.TrimSuffix(prefix, "/"), req.URL.Path) {
+		http.NotFound(w, req)
+		return
+	}
 	am.alertmanagersMtx.Lock()
 	userAM, ok := am.alertmanagers[userID]
 	am.alertmanagersMtx.Unlock()
@@ -272,5 +373,53 @@ func (am *MultitenantAlertmanager) ServeHTTP(w http.ResponseWriter, req *http.Re
 		http.Error(w, fmt.Sprintf("no Alertmanager for this user ID"), http.StatusNotFound)
 		return
 	}
-	userAM.router.ServeHTTP(w, req)
+	userAM.router.ServeHTTP(&userResponseWriter{ResponseWriter: w}, req)
+}
+
+const orgIDHeaderName = "X-Scope-OrgID"
+
+// isUserPath is whether a path, under the external URL's path, is of the
+// user's Alertmanager: its API, or the pages and assets of its UI.
+func isUserPath(prefix, path string) bool {
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+	path = strings.TrimPrefix(path, prefix)
+	switch {
+	case path == "" || path == "/":
+	case path == "/api/alerts" || strings.HasPrefix(path, "/api/v1/"):
+	case strings.HasPrefix(path, "/app/") || strings.HasPrefix(path, "/lib/"):
+	default:
+		return false
+	}
+	return true
+}
+
+// userResponseWriter removes the CORS headers the Alertmanager API sets,
+// which allow any site to read responses, and stops them being cached, as
+// which user they are for depends on the request's headers.
+type userResponseWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+func (w *userResponseWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		header := w.Header()
+		for name := range header {
+			if strings.HasPrefix(name, "Access-Control-") {
+				header.Del(name)
+			}
+		}
+		header.Set("Cache-Control", "no-store")
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *userResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
 }
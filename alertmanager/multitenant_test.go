@@ -0,0 +1,88 @@
+package alertmanager
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/common/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/weaveworks/cortex/util"
+)
+
+func TestMultitenantAlertmanagerIsolation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "alertmanager")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	externalURL, err := url.Parse("http://alertmanager/api/prom")
+	require.NoError(t, err)
+	router := initMesh("127.0.0.1:0", "00:00:00:00:00:01", "test", "")
+	multiAM := &MultitenantAlertmanager{
+		cfg:           &MultitenantAlertmanagerConfig{ExternalURL: util.URLValue{URL: externalURL}},
+		alertmanagers: map[string]*Alertmanager{},
+	}
+	for _, userID := range []string{"user1", "user2"} {
+		am, err := New(&Config{
+			UserID:      userID,
+			DataDir:     dir,
+			Logger:      log.NewNopLogger(),
+			MeshRouter:  router,
+			ExternalURL: externalURL,
+		})
+		require.NoError(t, err)
+		defer am.Stop()
+		multiAM.alertmanagers[userID] = am
+	}
+
+	do := func(method, path, body string, userIDs ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		for _, userID := range userIDs {
+			req.Header.Add(orgIDHeaderName, userID)
+		}
+		rec := httptest.NewRecorder()
+		multiAM.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := do("POST", "/api/prom/api/v1/silences", `{
+		"matchers": [{"name": "job", "value": "foo"}],
+		"startsAt": "2017-01-01T00:00:00Z",
+		"endsAt": "2099-01-01T00:00:00Z",
+		"createdBy": "test",
+		"comment": "test"
+	}`, "user1")
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Equal(t, "no-store", rec.Header().Get("Cache-Control"))
+	assert.Empty(t, rec.Header().Get("Access-Control-Allow-Origin"))
+	id := strings.Split(rec.Body.String(), `"silenceId":"`)[1]
+	id = id[:strings.Index(id, `"`)]
+
+	// The silence is only the user's.
+	assert.Equal(t, http.StatusOK, do("GET", "/api/prom/api/v1/silence/"+id, "", "user1").Code)
+	assert.Equal(t, http.StatusNotFound, do("GET", "/api/prom/api/v1/silence/"+id, "", "user2").Code)
+	assert.Contains(t, do("GET", "/api/prom/api/v1/silences", "", "user1").Body.String(), id)
+	assert.NotContains(t, do("GET", "/api/prom/api/v1/silences", "", "user2").Body.String(), id)
+
+	for _, tc := range []struct {
+		method, path string
+		userIDs      []string
+		status       int
+	}{
+		{"GET", "/api/prom/api/v1/silences", nil, http.StatusUnauthorized},
+		{"GET", "/api/prom/api/v1/silences", []string{"user1", "user2"}, http.StatusBadRequest},
+		{"GET", "/api/prom/api/v1/silences", []string{"user3"}, http.StatusNotFound},
+		{"GET", "/api/prom/metrics", []string{"user1"}, http.StatusNotFound},
+		{"GET", "/api/prom/debug/pprof/", []string{"user1"}, http.StatusNotFound},
+		{"POST", "/api/prom/-/reload", []string{"user1"}, http.StatusNotFound},
+		{"GET", "/api/v1/silences", []string{"user1"}, http.StatusNotFound},
+	} {
+		assert.Equal(t, tc.status, do(tc.method, tc.path, "", tc.userIDs...).Code, "%s %s %v", tc.method, tc.path, tc.userIDs)
+	}
+}
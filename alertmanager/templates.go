@@ -0,0 +1,137 @@
+package alertmanager
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	tmpltext "text/template"
+	"time"
+
+	"github.com/prometheus/alertmanager/template"
+	"github.com/prometheus/alertmanager/types"
+	"github.com/prometheus/common/model"
+
+	"github.com/weaveworks/cortex/configs"
+)
+
+// The directory the shared template files are referred to under in the
+// templates of Alertmanager configs, eg. "shared/*.tmpl".
+const sharedTemplatesDir = "shared"
+
+// loadTemplates parses the templates matching the globs of an Alertmanager
+// config, along with the default ones. The globs are matched against the
+// org's template files, and the shared ones under shared/.
+func loadTemplates(tmpDir string, globs []string, files, shared map[string]string) (*template.Template, error) {
+	// The templates can only be parsed from files.
+	dir, err := ioutil.TempDir(tmpDir, "templates")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	if err := writeTemplateFiles(dir, files); err != nil {
+		return nil, err
+	}
+	if err := writeTemplateFiles(filepath.Join(dir, sharedTemplatesDir), shared); err != nil {
+		return nil, err
+	}
+
+	paths := make([]string, 0, len(globs))
+	for _, glob := range globs {
+		paths = append(paths, filepath.Join(dir, cleanGlob(glob)))
+	}
+	return template.FromGlobs(paths...)
+}
+
+// cleanGlob cleans a template glob as an absolute path, so it can't match
+// files outside the directory it is joined to.
+func cleanGlob(glob string) string {
+	return filepath.Clean("/" + glob)
+}
+
+func writeTemplateFiles(dir string, files map[string]string) error {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return err
+	}
+	for name, content := range files {
+		if filepath.Base(name) != name || name == "." || name == ".." || name == sharedTemplatesDir {
+			return fmt.Errorf("invalid template filename %q", name)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0666); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateTemplates checks the templates of an org's config can be parsed,
+// along with the shared ones it refers to, and that the templates defined in
+// the org's own files render with example data. This stops orgs uploading
+// templates which would break their notifications.
+func validateTemplates(tmpDir string, cfg configs.CortexConfig, shared map[string]string, externalURL *url.URL) error {
+	amConfig, err := cfg.GetAlertmanagerConfig()
+	if err != nil {
+		return err
+	}
+	tmpl, err := loadTemplates(tmpDir, amConfig.Templates, cfg.TemplateFiles, shared)
+	if err != nil {
+		return err
+	}
+	tmpl.ExternalURL = externalURL
+	if tmpl.ExternalURL == nil {
+		tmpl.ExternalURL = &url.URL{}
+	}
+
+	names, err := definedTemplates(amConfig.Templates, cfg.TemplateFiles)
+	if err != nil {
+		return err
+	}
+	labels := model.LabelSet{model.AlertNameLabel: "Example", "severity": "critical"}
+	data := tmpl.Data("example", labels, &types.Alert{
+		Alert: model.Alert{
+			Labels:      labels,
+			Annotations: model.LabelSet{"summary": "An example alert."},
+			StartsAt:    time.Now(),
+		},
+	})
+	for _, name := range names {
+		if _, err := tmpl.ExecuteTextString(fmt.Sprintf("{{ template %q . }}", name), data); err != nil {
+			return fmt.Errorf("error rendering template %q: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// definedTemplates returns the names of the templates defined in the org's
+// template files matching the globs.
+func definedTemplates(globs []string, files map[string]string) ([]string, error) {
+	var names []string
+	for filename, content := range files {
+		matched := false
+		for _, glob := range globs {
+			if ok, err := filepath.Match(cleanGlob(glob), cleanGlob(filename)); err != nil {
+				return nil, err
+			} else if ok {
+				matched = true
+			}
+		}
+		if !matched {
+			continue
+		}
+
+		t, err := tmpltext.New(filename).Funcs(tmpltext.FuncMap(template.DefaultFuncs)).Parse(content)
+		if err != nil {
+			return nil, err
+		}
+		for _, defined := range t.Templates() {
+			if defined.Name() != filename {
+				names = append(names, defined.Name())
+			}
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
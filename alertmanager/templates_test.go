@@ -0,0 +1,81 @@
+package alertmanager
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/weaveworks/cortex/configs"
+)
+
+const testAlertmanagerConfig = `
+route:
+  receiver: noop
+receivers:
+- name: noop
+templates:
+- '*.tmpl'
+- 'shared/*.tmpl'
+`
+
+func TestLoadTemplates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "alertmanager")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	tmpl, err := loadTemplates(dir, []string{"*.tmpl", "shared/*.tmpl", "../*.tmpl"}, map[string]string{
+		"org.tmpl": `{{ define "org" }}org {{ template "shared" }}{{ end }}`,
+	}, map[string]string{
+		"shared.tmpl": `{{ define "shared" }}shared{{ end }}`,
+	})
+	require.NoError(t, err)
+	out, err := tmpl.ExecuteTextString(`{{ template "org" . }}`, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "org shared", out)
+
+	for _, name := range []string{"../org.tmpl", "sub/org.tmpl", "..", sharedTemplatesDir} {
+		_, err := loadTemplates(dir, nil, map[string]string{name: ""}, nil)
+		assert.Error(t, err, name)
+	}
+}
+
+func TestValidateTemplates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "alertmanager")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	shared := map[string]string{
+		"shared.tmpl": `{{ define "shared" }}{{ .CommonLabels.alertname }}{{ end }}`,
+	}
+	for _, tc := range []struct {
+		files map[string]string
+		valid bool
+	}{
+		{
+			files: map[string]string{"org.tmpl": `{{ define "org" }}{{ template "shared" . }}: {{ .CommonAnnotations.summary }}{{ end }}`},
+			valid: true,
+		},
+		{
+			files: map[string]string{"org.tmpl": `{{ define "org" }}{{ .CommonLabels.alertname }{{ end }}`},
+		},
+		{
+			files: map[string]string{"org.tmpl": `{{ define "org" }}{{ template "missing" . }}{{ end }}`},
+		},
+		{
+			files: map[string]string{"org.tmpl": `{{ define "org" }}{{ .NoSuchField }}{{ end }}`},
+		},
+	} {
+		err := validateTemplates(dir, configs.CortexConfig{
+			AlertmanagerConfig: testAlertmanagerConfig,
+			TemplateFiles:      tc.files,
+		}, shared, nil)
+		if tc.valid {
+			assert.NoError(t, err, tc.files["org.tmpl"])
+		} else {
+			assert.Error(t, err, tc.files["org.tmpl"])
+		}
+	}
+}
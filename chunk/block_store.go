@@ -0,0 +1,536 @@
+package chunk
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/model"
+	prom_chunk "github.com/prometheus/prometheus/storage/local/chunk"
+	"github.com/prometheus/prometheus/storage/metric"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/instrument"
+	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex/util"
+)
+
+const (
+	blocksPrefix    = "blocks/"
+	blockIndexName  = "index"
+	blockChunksName = "chunks"
+)
+
+var (
+	blocksShipped = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "cortex",
+		Name:      "block_store_blocks_shipped_total",
+		Help:      "Total number of blocks written to object storage.",
+	})
+	blockShipFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "cortex",
+		Name:      "block_store_ship_failures_total",
+		Help:      "Total number of failures writing blocks to object storage.",
+	})
+	blocksQueried = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "cortex",
+		Name:      "block_store_blocks_queried",
+		Help:      "Number of blocks whose index was read per query.",
+		Buckets:   prometheus.ExponentialBuckets(1, 4, 6),
+	})
+)
+
+func init() {
+	prometheus.MustRegister(blocksShipped)
+	prometheus.MustRegister(blockShipFailures)
+	prometheus.MustRegister(blocksQueried)
+}
+
+// BlockStoreConfig configures a BlockStore.
+type BlockStoreConfig struct {
+	Enabled        bool
+	S3             util.URLValue
+	BlockRange     time.Duration
+	MaxBlockChunks int
+
+	BucketIndex               bool
+	BucketIndexUpdateInterval time.Duration
+
+	mockS3         S3Client
+	mockBucketName string
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet
+func (cfg *BlockStoreConfig) RegisterFlags(f *flag.FlagSet) {
+	f.BoolVar(&cfg.Enabled, "blocks.enabled", false, "Experimental: store chunks in per-tenant blocks in object storage, instead of in S3 and DynamoDB.")
+	f.Var(&cfg.S3, "blocks.s3.url", "S3 endpoint URL for blocks storage, with escaped Key and Secret encoded.")
+	f.DurationVar(&cfg.BlockRange, "blocks.block-range", 2*time.Hour, "How often each tenant's flushed chunks are written out as a block.")
+	f.IntVar(&cfg.MaxBlockChunks, "blocks.max-block-chunks", 100000, "Maximum number of chunks in a block; blocks are written out early if they reach this.")
+	f.BoolVar(&cfg.BucketIndex, "blocks.bucket-index.enabled", false, "Find each tenant's blocks by reading its bucket index, instead of listing the bucket on every query.")
+	f.DurationVar(&cfg.BucketIndexUpdateInterval, "blocks.bucket-index.update-interval", 5*time.Minute, "How often bucket indexes are written, and re-read by queriers.")
+}
+
+// BlockStore is an experimental alternative to Store which needs only object
+// storage. Chunks flushed by ingesters are accumulated per tenant and written
+// out periodically as a single block: an index object describing the chunks,
+// and a chunks object containing their data. Queries list a tenant's blocks,
+// read the index of those overlapping the query and fetch only the matching
+// chunks.
+//
+// Chunks are held in memory until their block is written, and are written out
+// when the store is stopped. Meanwhile the ingester which flushed them serves
+// them to queries, from PendingChunks; they will still be lost if the process
+// crashes before their block is written.
+type BlockStore struct {
+	blockBucket
+	cfg BlockStoreConfig
+
+	mtx      sync.Mutex
+	heads    map[string][]Chunk
+	shipping map[string]bool
+
+	indexMtx sync.Mutex
+	indexes  map[string]cachedBucketIndex
+
+	quit chan struct{}
+	done chan struct{}
+}
+
+// blockIndex is the index object of a block.
+type blockIndex struct {
+	MinTime model.Time      `json:"minTime"`
+	MaxTime model.Time      `json:"maxTime"`
+	Chunks  []blockChunkRef `json:"chunks"`
+}
+
+// blockChunkRef describes a chunk in a block and where its data is.
+type blockChunkRef struct {
+	ID       string              `json:"id"`
+	Metric   model.Metric        `json:"metric"`
+	From     model.Time          `json:"from"`
+	Through  model.Time          `json:"through"`
+	Encoding prom_chunk.Encoding `json:"encoding"`
+	Offset   int64               `json:"offset"`
+	Length   int64               `json:"length"`
+}
+
+// blockBucket is the object storage holding blocks.
+type blockBucket struct {
+	s3         S3Client
+	bucketName string
+}
+
+func newBlockBucket(cfg BlockStoreConfig) (blockBucket, error) {
+	if cfg.mockS3 != nil {
+		return blockBucket{cfg.mockS3, cfg.mockBucketName}, nil
+	}
+	s3Client, bucketName, err := NewS3Client(cfg.S3.String())
+	if err != nil {
+		return blockBucket{}, err
+	}
+	return blockBucket{s3Client, bucketName}, nil
+}
+
+// NewBlockStore makes a new BlockStore.
+func NewBlockStore(cfg BlockStoreConfig) (*BlockStore, error) {
+	if cfg.BlockRange <= 0 {
+		return nil, fmt.Errorf("block range must be positive, got %v", cfg.BlockRange)
+	}
+	bucket, err := newBlockBucket(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &BlockStore{
+		blockBucket: bucket,
+		cfg:         cfg,
+		heads:       map[string][]Chunk{},
+		shipping:    map[string]bool{},
+		indexes:     map[string]cachedBucketIndex{},
+		quit:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	go s.loop()
+	return s, nil
+}
+
+// Stop writes out all pending blocks and stops the BlockStore.
+func (s *BlockStore) Stop() {
+	close(s.quit)
+	<-s.done
+}
+
+func (s *BlockStore) loop() {
+	defer close(s.done)
+	ticker := time.NewTicker(s.cfg.BlockRange)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.shipAll(context.Background())
+		case <-s.quit:
+			s.shipAll(context.Background())
+			return
+		}
+	}
+}
+
+// Put implements ingester.ChunkStore.
+func (s *BlockStore) Put(ctx context.Context, chunks []Chunk) error {
+	userID, err := user.Extract(ctx)
+	if err != nil {
+		return err
+	}
+
+	s.mtx.Lock()
+	s.heads[userID] = append(s.heads[userID], chunks...)
+	full := s.cfg.MaxBlockChunks > 0 && len(s.heads[userID]) >= s.cfg.MaxBlockChunks
+	s.mtx.Unlock()
+
+	if full {
+		return s.ship(ctx, userID)
+	}
+	return nil
+}
+
+func (s *BlockStore) shipAll(ctx context.Context) {
+	s.mtx.Lock()
+	userIDs := make([]string, 0, len(s.heads))
+	for userID := range s.heads {
+		userIDs = append(userIDs, userID)
+	}
+	s.mtx.Unlock()
+
+	for _, userID := range userIDs {
+		if err := s.ship(user.Inject(ctx, userID), userID); err != nil {
+			log.Errorf("Error writing block for user %s: %v", userID, err)
+		}
+	}
+}
+
+// ship writes out the pending chunks for a user as a block. The chunks stay
+// pending, and so queryable, until the block is written; on failure, they are
+// retried with the next block.
+func (s *BlockStore) ship(ctx context.Context, userID string) error {
+	s.mtx.Lock()
+	chunks := s.heads[userID]
+	if len(chunks) == 0 || s.shipping[userID] {
+		s.mtx.Unlock()
+		return nil
+	}
+	s.shipping[userID] = true
+	s.mtx.Unlock()
+
+	err := s.writeBlock(ctx, userID, chunks)
+
+	s.mtx.Lock()
+	delete(s.shipping, userID)
+	if err == nil {
+		// Chunks put meanwhile are appended after those written.
+		rest := s.heads[userID][len(chunks):]
+		if len(rest) == 0 {
+			delete(s.heads, userID)
+		} else {
+			s.heads[userID] = append([]Chunk(nil), rest...)
+		}
+	}
+	s.mtx.Unlock()
+
+	if err != nil {
+		blockShipFailures.Inc()
+		return err
+	}
+	blocksShipped.Inc()
+	return nil
+}
+
+// PendingChunks returns the chunks matching the matchers which have been put
+// but whose block hasn't been written yet.
+func (s *BlockStore) PendingChunks(ctx context.Context, from, through model.Time, matchers ...*metric.LabelMatcher) ([]Chunk, error) {
+	userID, err := user.Extract(ctx)
+	if err != nil {
+		return nil, err
+	}
+	s.mtx.Lock()
+	heads := s.heads[userID]
+	s.mtx.Unlock()
+	return FilterChunks(heads, from, through, matchers...)
+}
+
+// FilterChunks returns the chunks overlapping the time range and matching the
+// matchers, including any query shard matcher.
+func FilterChunks(chunks []Chunk, from, through model.Time, matchers ...*metric.LabelMatcher) ([]Chunk, error) {
+	shard, matchers, err := util.ExtractQueryShard(matchers)
+	if err != nil {
+		return nil, err
+	}
+	var result []Chunk
+	for _, c := range chunks {
+		ok, err := chunkMatches(c.ID, c.Metric, c.From, c.Through, from, through, matchers, shard)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			result = append(result, c)
+		}
+	}
+	return result, nil
+}
+
+// chunkMatches returns whether a chunk overlaps the time range and matches
+// the matchers and query shard.
+func chunkMatches(id string, m model.Metric, chunkFrom, chunkThrough, from, through model.Time, matchers []*metric.LabelMatcher, shard *util.QueryShard) (bool, error) {
+	if chunkThrough < from || through < chunkFrom {
+		return false, nil
+	}
+	if !util.MatchesFilters(m, matchers) {
+		return false, nil
+	}
+	if shard != nil {
+		fp, _, _, err := parseChunkID(id)
+		if err != nil {
+			return false, err
+		}
+		return shard.Contains(fp), nil
+	}
+	return true, nil
+}
+
+func (s *BlockStore) writeBlock(ctx context.Context, userID string, chunks []Chunk) error {
+	index := blockIndex{
+		MinTime: model.Latest,
+		MaxTime: model.Earliest,
+		Chunks:  make([]blockChunkRef, 0, len(chunks)),
+	}
+	var data bytes.Buffer
+	buf := make([]byte, prom_chunk.ChunkLen)
+	for _, c := range chunks {
+		if err := c.Data.MarshalToBuf(buf); err != nil {
+			return err
+		}
+		index.Chunks = append(index.Chunks, blockChunkRef{
+			ID:       c.ID,
+			Metric:   c.Metric,
+			From:     c.From,
+			Through:  c.Through,
+			Encoding: c.Encoding,
+			Offset:   int64(data.Len()),
+			Length:   int64(len(buf)),
+		})
+		data.Write(buf)
+		if c.From < index.MinTime {
+			index.MinTime = c.From
+		}
+		if c.Through > index.MaxTime {
+			index.MaxTime = c.Through
+		}
+	}
+
+	var indexBuf bytes.Buffer
+	if err := json.NewEncoder(snappy.NewWriter(&indexBuf)).Encode(index); err != nil {
+		return err
+	}
+
+	// The chunks object is written first, so that any block with an index is
+	// complete.
+	prefix := blockPrefix(userID, newBlockID(index.MinTime, index.MaxTime))
+	if err := s.putObject(ctx, prefix+blockChunksName, data.Bytes()); err != nil {
+		return err
+	}
+	return s.putObject(ctx, prefix+blockIndexName, indexBuf.Bytes())
+}
+
+func (b blockBucket) putObject(ctx context.Context, key string, buf []byte) error {
+	return instrument.TimeRequestHistogram(ctx, "S3.PutObject", s3RequestDuration, func(_ context.Context) error {
+		_, err := b.s3.PutObject(&s3.PutObjectInput{
+			Body:   bytes.NewReader(buf),
+			Bucket: aws.String(b.bucketName),
+			Key:    aws.String(key),
+		})
+		return err
+	})
+}
+
+func (b blockBucket) getObject(ctx context.Context, key string, byteRange *string) ([]byte, error) {
+	var buf []byte
+	err := instrument.TimeRequestHistogram(ctx, "S3.GetObject", s3RequestDuration, func(_ context.Context) error {
+		resp, err := b.s3.GetObject(&s3.GetObjectInput{
+			Bucket: aws.String(b.bucketName),
+			Key:    aws.String(key),
+			Range:  byteRange,
+		})
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		buf, err = ioutil.ReadAll(resp.Body)
+		return err
+	})
+	return buf, err
+}
+
+// Get implements querier.ChunkStore.
+func (s *BlockStore) Get(ctx context.Context, from, through model.Time, matchers ...*metric.LabelMatcher) ([]Chunk, error) {
+	userID, err := user.Extract(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	shard, matchers, err := util.ExtractQueryShard(matchers)
+	if err != nil {
+		return nil, err
+	}
+
+	blockIDs, err := s.blockIDs(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []Chunk
+	queried := 0
+	for _, blockID := range blockIDs {
+		minTime, maxTime, err := parseBlockID(blockID)
+		if err != nil {
+			log.Warnf("Ignoring block %s for user %s: %v", blockID, userID, err)
+			continue
+		}
+		if maxTime < from || through < minTime {
+			continue
+		}
+		queried++
+
+		chunks, err := s.getBlockChunks(ctx, userID, blockID, from, through, matchers, shard)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, chunks...)
+	}
+	blocksQueried.Observe(float64(queried))
+
+	// Replicas of a chunk may have been written to several blocks.
+	sort.Sort(ByID(result))
+	return unique(result), nil
+}
+
+// listBlocks returns the IDs of all the blocks for a user.
+func (b blockBucket) listBlocks(ctx context.Context, userID string) ([]string, error) {
+	return b.listPrefixes(ctx, blocksPrefix+userID+"/")
+}
+
+// listUsers returns the IDs of all the users with blocks.
+func (b blockBucket) listUsers(ctx context.Context) ([]string, error) {
+	return b.listPrefixes(ctx, blocksPrefix)
+}
+
+// listPrefixes returns the names of the "directories" directly under prefix.
+func (b blockBucket) listPrefixes(ctx context.Context, prefix string) ([]string, error) {
+	var names []string
+	var token *string
+	for {
+		var resp *s3.ListObjectsV2Output
+		err := instrument.TimeRequestHistogram(ctx, "S3.ListObjects", s3RequestDuration, func(_ context.Context) error {
+			var err error
+			resp, err = b.s3.ListObjectsV2(&s3.ListObjectsV2Input{
+				Bucket:            aws.String(b.bucketName),
+				Prefix:            aws.String(prefix),
+				Delimiter:         aws.String("/"),
+				ContinuationToken: token,
+			})
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range resp.CommonPrefixes {
+			names = append(names, strings.TrimSuffix(strings.TrimPrefix(aws.StringValue(p.Prefix), prefix), "/"))
+		}
+		if !aws.BoolValue(resp.IsTruncated) {
+			return names, nil
+		}
+		token = resp.NextContinuationToken
+	}
+}
+
+func (s *BlockStore) getBlockChunks(ctx context.Context, userID, blockID string, from, through model.Time, matchers []*metric.LabelMatcher, shard *util.QueryShard) ([]Chunk, error) {
+	prefix := blockPrefix(userID, blockID)
+	buf, err := s.getObject(ctx, prefix+blockIndexName, nil)
+	if err != nil {
+		return nil, err
+	}
+	var index blockIndex
+	if err := json.NewDecoder(snappy.NewReader(bytes.NewReader(buf))).Decode(&index); err != nil {
+		return nil, err
+	}
+
+	var result []Chunk
+	for _, ref := range index.Chunks {
+		ok, err := chunkMatches(ref.ID, ref.Metric, ref.From, ref.Through, from, through, matchers, shard)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+
+		data, err := s.getObject(ctx, prefix+blockChunksName, aws.String(fmt.Sprintf("bytes=%d-%d", ref.Offset, ref.Offset+ref.Length-1)))
+		if err != nil {
+			return nil, err
+		}
+		c, err := prom_chunk.NewForEncoding(ref.Encoding)
+		if err != nil {
+			return nil, err
+		}
+		if err := c.Unmarshal(bytes.NewReader(data)); err != nil {
+			return nil, err
+		}
+		result = append(result, Chunk{
+			ID:       ref.ID,
+			From:     ref.From,
+			Through:  ref.Through,
+			Metric:   ref.Metric,
+			Encoding: ref.Encoding,
+			Data:     c,
+		})
+	}
+	return result, nil
+}
+
+func blockPrefix(userID, blockID string) string {
+	return fmt.Sprintf("%s%s/%s/", blocksPrefix, userID, blockID)
+}
+
+// Block IDs are <min time>-<max time>-<random>, so queries can skip blocks
+// without reading their index. The random part avoids collisions between the
+// replicas of an ingester writing blocks for the same time range.
+func newBlockID(minTime, maxTime model.Time) string {
+	return fmt.Sprintf("%d-%d-%016x", minTime, maxTime, rand.Int63())
+}
+
+func parseBlockID(id string) (model.Time, model.Time, error) {
+	parts := strings.Split(id, "-")
+	if len(parts) != 3 {
+		return 0, 0, fmt.Errorf("invalid block ID: '%s'", id)
+	}
+	minTime, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	maxTime, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	return model.Time(minTime), model.Time(maxTime), nil
+}
@@ -0,0 +1,167 @@
+package chunk
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/local/chunk"
+	"github.com/prometheus/prometheus/storage/metric"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/test"
+	"github.com/weaveworks/common/user"
+)
+
+func TestBlockStore(t *testing.T) {
+	ctx := user.Inject(context.Background(), "0")
+	now := model.Now()
+	chunks, _ := chunk.New().Add(model.SamplePair{Timestamp: now, Value: 0})
+	chunk1 := NewChunk(
+		model.Fingerprint(1),
+		model.Metric{
+			model.MetricNameLabel: "foo",
+			"bar":                 "baz",
+		},
+		chunks[0],
+		now.Add(-time.Hour),
+		now,
+	)
+	chunk2 := NewChunk(
+		model.Fingerprint(2),
+		model.Metric{
+			model.MetricNameLabel: "foo",
+			"bar":                 "beep",
+		},
+		chunks[0],
+		now.Add(-time.Hour),
+		now,
+	)
+	chunk3 := NewChunk(
+		model.Fingerprint(1),
+		model.Metric{
+			model.MetricNameLabel: "foo",
+			"bar":                 "baz",
+		},
+		chunks[0],
+		now.Add(-3*time.Hour),
+		now.Add(-2*time.Hour),
+	)
+
+	s3 := NewMockS3()
+	store, err := NewBlockStore(BlockStoreConfig{
+		BlockRange:     time.Hour,
+		MaxBlockChunks: 2,
+		mockS3:         s3,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The first two chunks fill a block, so are written out immediately; the
+	// third is pending, and queryable as such, until the store is stopped.
+	if err := store.Put(ctx, []Chunk{chunk1, chunk2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Put(ctx, []Chunk{chunk3}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Put(user.Inject(context.Background(), "1"), []Chunk{chunk1}); err != nil {
+		t.Fatal(err)
+	}
+	blockIDs, err := store.listBlocks(ctx, "0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blockIDs) != 1 {
+		t.Fatalf("expected 1 block, got %v", blockIDs)
+	}
+	pending, err := store.PendingChunks(ctx, now.Add(-4*time.Hour), now, mustNewLabelMatcher(metric.Equal, "bar", "baz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual([]Chunk{chunk3}, pending) {
+		t.Fatalf("wrong pending chunks - %s", test.Diff([]Chunk{chunk3}, pending))
+	}
+	if pending, err := store.PendingChunks(ctx, now.Add(-time.Hour), now); err != nil || len(pending) != 0 {
+		t.Fatalf("expected no pending chunks in range, got %v, %v", pending, err)
+	}
+
+	store.Stop()
+	for userID, expected := range map[string]int{"0": 2, "1": 1} {
+		blockIDs, err = store.listBlocks(ctx, userID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(blockIDs) != expected {
+			t.Fatalf("expected %d blocks for user %s, got %v", expected, userID, blockIDs)
+		}
+	}
+	if pending, err := store.PendingChunks(ctx, now.Add(-4*time.Hour), now); err != nil || len(pending) != 0 {
+		t.Fatalf("expected no pending chunks after stopping, got %v, %v", pending, err)
+	}
+
+	nameMatcher := mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo")
+	for _, tc := range []struct {
+		name     string
+		from     model.Time
+		expect   []Chunk
+		matchers []*metric.LabelMatcher
+	}{
+		{
+			"Just name label",
+			now.Add(-30 * time.Minute),
+			[]Chunk{chunk1, chunk2},
+			[]*metric.LabelMatcher{nameMatcher},
+		},
+		{
+			"Equal bar=baz",
+			now.Add(-30 * time.Minute),
+			[]Chunk{chunk1},
+			[]*metric.LabelMatcher{nameMatcher, mustNewLabelMatcher(metric.Equal, "bar", "baz")},
+		},
+		{
+			"Regex match",
+			now.Add(-30 * time.Minute),
+			[]Chunk{chunk1, chunk2},
+			[]*metric.LabelMatcher{nameMatcher, mustNewLabelMatcher(metric.RegexMatch, "bar", "beep|baz")},
+		},
+		{
+			"No match",
+			now.Add(-30 * time.Minute),
+			nil,
+			[]*metric.LabelMatcher{nameMatcher, mustNewLabelMatcher(metric.Equal, "bar", "bop")},
+		},
+		{
+			"Multiple blocks",
+			now.Add(-4 * time.Hour),
+			[]Chunk{chunk3, chunk1},
+			[]*metric.LabelMatcher{nameMatcher, mustNewLabelMatcher(metric.Equal, "bar", "baz")},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			chunks, err := store.Get(ctx, tc.from, now, tc.matchers...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(tc.expect, chunks) {
+				t.Fatalf("%s: wrong chunks - %s", tc.name, test.Diff(tc.expect, chunks))
+			}
+		})
+	}
+}
+
+func TestParseBlockID(t *testing.T) {
+	id := newBlockID(1000, 2000)
+	minTime, maxTime, err := parseBlockID(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if minTime != 1000 || maxTime != 2000 {
+		t.Fatalf("wrong times from %s: %v, %v", id, minTime, maxTime)
+	}
+	if _, _, err := parseBlockID("foo"); err == nil {
+		t.Fatal("expected error")
+	}
+}
@@ -0,0 +1,192 @@
+package chunk
+
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/model"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/instrument"
+	"github.com/weaveworks/common/user"
+)
+
+const bucketIndexName = "bucket-index"
+
+var (
+	bucketIndexUpdateDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "cortex",
+		Name:      "bucket_index_update_duration_seconds",
+		Help:      "Time spent writing bucket indexes.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"operation", "status_code"})
+	bucketIndexMisses = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "cortex",
+		Name:      "bucket_index_misses_total",
+		Help:      "Total number of queries which listed the bucket because there was no bucket index.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(bucketIndexUpdateDuration)
+	prometheus.MustRegister(bucketIndexMisses)
+}
+
+// bucketIndex lists all of a user's blocks, so that queriers don't have to
+// list the bucket to find them.
+type bucketIndex struct {
+	UpdatedAt model.Time `json:"updatedAt"`
+	Blocks    []string   `json:"blocks"`
+}
+
+type cachedBucketIndex struct {
+	blockIDs []string
+	fetched  time.Time
+}
+
+func bucketIndexKey(userID string) string {
+	return blocksPrefix + userID + "/" + bucketIndexName
+}
+
+func (b blockBucket) writeBucketIndex(ctx context.Context, userID string) error {
+	blockIDs, err := b.listBlocks(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	if err := json.NewEncoder(snappy.NewWriter(&buf)).Encode(bucketIndex{
+		UpdatedAt: model.Now(),
+		Blocks:    blockIDs,
+	}); err != nil {
+		return err
+	}
+	return b.putObject(ctx, bucketIndexKey(userID), buf.Bytes())
+}
+
+// readBucketIndex returns nil if the user has no bucket index.
+func (b blockBucket) readBucketIndex(ctx context.Context, userID string) (*bucketIndex, error) {
+	buf, err := b.getObject(ctx, bucketIndexKey(userID), nil)
+	if err != nil {
+		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == "NoSuchKey" {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var index bucketIndex
+	if err := json.NewDecoder(snappy.NewReader(bytes.NewReader(buf))).Decode(&index); err != nil {
+		return nil, err
+	}
+	return &index, nil
+}
+
+// blockIDs returns the IDs of a user's blocks, from its bucket index if
+// enabled. Bucket indexes are cached for the update interval, so blocks may
+// take up to twice that to become visible to queries.
+func (s *BlockStore) blockIDs(ctx context.Context, userID string) ([]string, error) {
+	if !s.cfg.BucketIndex {
+		return s.listBlocks(ctx, userID)
+	}
+
+	s.indexMtx.Lock()
+	cached, ok := s.indexes[userID]
+	s.indexMtx.Unlock()
+	if ok && time.Since(cached.fetched) < s.cfg.BucketIndexUpdateInterval {
+		return cached.blockIDs, nil
+	}
+
+	index, err := s.readBucketIndex(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	// Users without an index yet are new, so won't have many blocks to list.
+	if index == nil {
+		bucketIndexMisses.Inc()
+		return s.listBlocks(ctx, userID)
+	}
+
+	s.indexMtx.Lock()
+	s.indexes[userID] = cachedBucketIndex{
+		blockIDs: index.Blocks,
+		fetched:  time.Now(),
+	}
+	s.indexMtx.Unlock()
+	return index.Blocks, nil
+}
+
+// BucketIndexUpdater periodically writes the bucket index of every user with
+// blocks. Only one should be run per bucket.
+type BucketIndexUpdater struct {
+	blockBucket
+	cfg  BlockStoreConfig
+	done chan struct{}
+	wait chan struct{}
+}
+
+// NewBucketIndexUpdater makes a new BucketIndexUpdater.
+func NewBucketIndexUpdater(cfg BlockStoreConfig) (*BucketIndexUpdater, error) {
+	bucket, err := newBlockBucket(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &BucketIndexUpdater{
+		blockBucket: bucket,
+		cfg:         cfg,
+		done:        make(chan struct{}),
+		wait:        make(chan struct{}),
+	}, nil
+}
+
+// Start the BucketIndexUpdater.
+func (u *BucketIndexUpdater) Start() {
+	go u.loop()
+}
+
+// Stop the BucketIndexUpdater.
+func (u *BucketIndexUpdater) Stop() {
+	close(u.done)
+	<-u.wait
+}
+
+func (u *BucketIndexUpdater) loop() {
+	defer close(u.wait)
+
+	ticker := time.NewTicker(u.cfg.BucketIndexUpdateInterval)
+	defer ticker.Stop()
+
+	u.updateAll(context.Background())
+	for {
+		select {
+		case <-ticker.C:
+			u.updateAll(context.Background())
+		case <-u.done:
+			return
+		}
+	}
+}
+
+func (u *BucketIndexUpdater) updateAll(ctx context.Context) {
+	var userIDs []string
+	if err := instrument.TimeRequestHistogram(ctx, "BucketIndexUpdater.listUsers", bucketIndexUpdateDuration, func(ctx context.Context) error {
+		var err error
+		userIDs, err = u.listUsers(ctx)
+		return err
+	}); err != nil {
+		log.Errorf("Error listing users for bucket indexes: %v", err)
+		return
+	}
+
+	for _, userID := range userIDs {
+		if err := instrument.TimeRequestHistogram(ctx, "BucketIndexUpdater.writeBucketIndex", bucketIndexUpdateDuration, func(ctx context.Context) error {
+			return u.writeBucketIndex(user.Inject(ctx, userID), userID)
+		}); err != nil {
+			log.Errorf("Error writing bucket index for user %s: %v", userID, err)
+		}
+	}
+}
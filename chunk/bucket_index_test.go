@@ -0,0 +1,88 @@
+package chunk
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/local/chunk"
+	"github.com/prometheus/prometheus/storage/metric"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/test"
+	"github.com/weaveworks/common/user"
+)
+
+func TestBucketIndex(t *testing.T) {
+	ctx := user.Inject(context.Background(), "0")
+	now := model.Now()
+	chunks, _ := chunk.New().Add(model.SamplePair{Timestamp: now, Value: 0})
+	chunk1 := NewChunk(
+		model.Fingerprint(1),
+		model.Metric{model.MetricNameLabel: "foo"},
+		chunks[0],
+		now.Add(-time.Hour),
+		now,
+	)
+	chunk2 := NewChunk(
+		model.Fingerprint(2),
+		model.Metric{model.MetricNameLabel: "foo"},
+		chunks[0],
+		now.Add(-time.Hour),
+		now,
+	)
+
+	cfg := BlockStoreConfig{
+		BlockRange:  time.Hour,
+		BucketIndex: true,
+		mockS3:      NewMockS3(),
+	}
+	writeBlock := func(c Chunk) {
+		store, err := NewBlockStore(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := store.Put(ctx, []Chunk{c}); err != nil {
+			t.Fatal(err)
+		}
+		store.Stop()
+	}
+	store, err := NewBlockStore(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Stop()
+	updater, err := NewBucketIndexUpdater(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	matcher := mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo")
+	expectChunks := func(expect []Chunk) {
+		chunks, err := store.Get(ctx, now.Add(-time.Hour), now, matcher)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(expect, chunks) {
+			t.Fatalf("wrong chunks - %s", test.Diff(expect, chunks))
+		}
+	}
+
+	// Without an index, the bucket is listed.
+	writeBlock(chunk1)
+	index, err := store.readBucketIndex(ctx, "0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if index != nil {
+		t.Fatalf("expected no bucket index, got %v", index)
+	}
+	expectChunks([]Chunk{chunk1})
+
+	// Once there is an index, blocks are only found after it is updated.
+	updater.updateAll(context.Background())
+	writeBlock(chunk2)
+	expectChunks([]Chunk{chunk1})
+	updater.updateAll(context.Background())
+	expectChunks([]Chunk{chunk1, chunk2})
+}
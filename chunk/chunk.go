@@ -4,8 +4,11 @@ import (
 	"bytes"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
+	"io/ioutil"
 	"strconv"
 	"strings"
 
@@ -17,6 +20,12 @@ import (
 	"github.com/weaveworks/cortex/util"
 )
 
+// ErrInvalidChecksum is returned when decoding a chunk whose data doesn't match
+// its checksum, eg. as it was corrupted in the object store.
+var ErrInvalidChecksum = errors.New("invalid chunk checksum")
+
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
 // Chunk contains encoded timeseries data
 type Chunk struct {
 	ID      string       `json:"-"`
@@ -30,6 +39,10 @@ type Chunk struct {
 	Data     prom_chunk.Chunk    `json:"-"`
 
 	metadataInIndex bool
+
+	// Set on the series found in the index of schemas indexing series, whose
+	// ID is that of the series, until their chunks are looked up.
+	series bool
 }
 
 // NewChunk creates a new chunk
@@ -44,6 +57,13 @@ func NewChunk(fp model.Fingerprint, metric model.Metric, c prom_chunk.Chunk, fir
 	}
 }
 
+// Fingerprint returns the fingerprint of the chunk's series, from its ID, so
+// is known before the chunk is fetched.
+func (c *Chunk) Fingerprint() (model.Fingerprint, error) {
+	fp, _, _, err := parseChunkID(c.ID)
+	return fp, err
+}
+
 func parseChunkID(id string) (model.Fingerprint, model.Time, model.Time, error) {
 	parts := strings.Split(id, ":")
 	if len(parts) != 3 {
@@ -64,22 +84,32 @@ func parseChunkID(id string) (model.Fingerprint, model.Time, model.Time, error)
 	return model.Fingerprint(fingerprint), model.Time(firstTime), model.Time(lastTime), nil
 }
 
+// chunkMetadata is the header of encoded chunks: the chunk's metadata, and
+// the CRC32 of its data. Chunks written before checksums were added have none.
+type chunkMetadata struct {
+	*Chunk
+	Checksum uint32 `json:"checksum,omitempty"`
+}
+
 func (c *Chunk) reader() (io.ReadSeeker, error) {
+	// TODO consider adding a .Reader() to upstream to remove copy
+	data := make([]byte, prom_chunk.ChunkLen)
+	if err := c.Data.MarshalToBuf(data); err != nil {
+		return nil, err
+	}
+
 	// Encode chunk metadata into snappy-compressed buffer
 	var metadata bytes.Buffer
-	if err := json.NewEncoder(snappy.NewWriter(&metadata)).Encode(c); err != nil {
+	if err := json.NewEncoder(snappy.NewWriter(&metadata)).Encode(chunkMetadata{
+		Chunk:    c,
+		Checksum: crc32.Checksum(data, castagnoliTable),
+	}); err != nil {
 		return nil, err
 	}
 
 	metadataLenBytes := [4]byte{}
 	binary.BigEndian.PutUint32(metadataLenBytes[:], uint32(metadata.Len()))
 
-	// TODO consider adding a .Reader() to upstream to remove copy
-	data := make([]byte, prom_chunk.ChunkLen)
-	if err := c.Data.MarshalToBuf(data); err != nil {
-		return nil, err
-	}
-
 	dataLenBytes := [4]byte{}
 	binary.BigEndian.PutUint32(dataLenBytes[:], uint32(len(data)))
 
@@ -92,6 +122,21 @@ func (c *Chunk) reader() (io.ReadSeeker, error) {
 	), nil
 }
 
+// Encode returns the chunk in the format in which it is stored.
+func (c *Chunk) Encode() ([]byte, error) {
+	r, err := c.reader()
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
+
+// Decode reads a chunk written by Encode into c; the ID is not included, so
+// must be set separately.
+func (c *Chunk) Decode(buf []byte) error {
+	return c.decode(bytes.NewReader(buf))
+}
+
 func (c *Chunk) decode(r io.Reader) error {
 	// Legacy chunks were written with metadata in the index.
 	if c.metadataInIndex {
@@ -108,10 +153,11 @@ func (c *Chunk) decode(r io.Reader) error {
 		return err
 	}
 
+	metadata := chunkMetadata{Chunk: c}
 	err := json.NewDecoder(snappy.NewReader(&io.LimitedReader{
 		N: int64(metadataLen),
 		R: r,
-	})).Decode(c)
+	})).Decode(&metadata)
 	if err != nil {
 		return err
 	}
@@ -133,10 +179,17 @@ func (c *Chunk) decode(r io.Reader) error {
 		return err
 	}
 
-	return c.Data.Unmarshal(&io.LimitedReader{
+	data, err := ioutil.ReadAll(&io.LimitedReader{
 		N: int64(dataLen),
 		R: r,
 	})
+	if err != nil {
+		return err
+	}
+	if metadata.Checksum != 0 && crc32.Checksum(data, castagnoliTable) != metadata.Checksum {
+		return ErrInvalidChecksum
+	}
+	return c.Data.Unmarshal(bytes.NewReader(data))
 }
 
 // ChunksToMatrix converts a slice of chunks into a model.Matrix.
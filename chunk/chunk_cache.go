@@ -2,6 +2,9 @@ package chunk
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io/ioutil"
@@ -34,12 +37,26 @@ var (
 		// Memecache requests are very quick: smallest bucket is 16us, biggest is 1s
 		Buckets: prometheus.ExponentialBuckets(0.000016, 4, 8),
 	}, []string{"method", "status_code"})
+
+	indexCacheRequests = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "cortex",
+		Name:      "index_cache_requests_total",
+		Help:      "Total count of index entries requested from memcache.",
+	})
+
+	indexCacheHits = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "cortex",
+		Name:      "index_cache_hits_total",
+		Help:      "Total count of index entries found in memcache.",
+	})
 )
 
 func init() {
 	prometheus.MustRegister(memcacheRequests)
 	prometheus.MustRegister(memcacheHits)
 	prometheus.MustRegister(memcacheRequestDuration)
+	prometheus.MustRegister(indexCacheRequests)
+	prometheus.MustRegister(indexCacheHits)
 }
 
 // Memcache caches things
@@ -52,12 +69,16 @@ type Memcache interface {
 type CacheConfig struct {
 	Expiration     time.Duration
 	memcacheConfig MemcacheConfig
+	redisConfig    RedisConfig
+	fifoConfig     FifoCacheConfig
 }
 
 // RegisterFlags adds the flags required to config this to the given FlagSet
 func (cfg *CacheConfig) RegisterFlags(f *flag.FlagSet) {
 	f.DurationVar(&cfg.Expiration, "memcached.expiration", 0, "How long chunks stay in the memcache.")
 	cfg.memcacheConfig.RegisterFlags(f)
+	cfg.redisConfig.RegisterFlags(f)
+	cfg.fifoConfig.RegisterFlags(f)
 }
 
 // Cache type caches chunks
@@ -66,16 +87,34 @@ type Cache struct {
 	memcache Memcache
 }
 
-// NewCache makes a new Cache
-func NewCache(cfg CacheConfig) *Cache {
+// NewCache makes a new Cache, in Redis if it is configured, or else in
+// memcached, and in process in front of either if the FIFO cache is enabled.
+func NewCache(cfg CacheConfig) (*Cache, error) {
+	var tiers []cacheTier
+	if cfg.fifoConfig.Size > 0 {
+		tiers = append(tiers, cacheTier{"fifo", NewFifoCache(cfg.fifoConfig)})
+	}
+	if cfg.redisConfig.Endpoint != "" {
+		client, err := NewRedisClient(cfg.redisConfig)
+		if err != nil {
+			return nil, err
+		}
+		tiers = append(tiers, cacheTier{"redis", client})
+	} else if cfg.memcacheConfig.Host != "" || cfg.memcacheConfig.Addresses != "" {
+		tiers = append(tiers, cacheTier{"memcached", NewMemcacheClient(cfg.memcacheConfig)})
+	}
+
 	var memcache Memcache
-	if cfg.memcacheConfig.Host != "" {
-		memcache = NewMemcacheClient(cfg.memcacheConfig)
+	if len(tiers) > 0 {
+		memcache = &tieredCache{
+			tiers:      tiers,
+			expiration: int32(cfg.Expiration.Seconds()),
+		}
 	}
 	return &Cache{
 		cfg:      cfg,
 		memcache: memcache,
-	}
+	}, nil
 }
 
 func memcacheStatusCode(err error) string {
@@ -127,6 +166,9 @@ func (c *Cache) FetchChunkData(ctx context.Context, userID string, chunks []Chun
 		}
 
 		if err := chunk.decode(bytes.NewReader(item.Value)); err != nil {
+			if err == ErrInvalidChecksum {
+				corruptChunks.WithLabelValues("cache").Inc()
+			}
 			log.Errorf("Failed to decode chunk from cache: %v", err)
 			missing = append(missing, chunk)
 			continue
@@ -180,3 +222,161 @@ func (c *Cache) StoreChunks(ctx context.Context, userID string, chunks []Chunk)
 	}
 	return errOut
 }
+
+// writtenChunkKey identifies a chunk by its content as well as its ID, as
+// replicas of an ingester can flush different chunks with the same ID.
+func writtenChunkKey(userID string, chunk *Chunk) (string, error) {
+	buf, err := chunk.Encode()
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	h.Write([]byte(userID))
+	h.Write([]byte{0})
+	h.Write([]byte(chunk.ID))
+	h.Write([]byte{0})
+	h.Write(buf)
+	return "written/" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// UnwrittenChunks returns the chunks which haven't already been written to
+// the store, eg. by another replica, as recorded by StoreWrittenChunks.
+func (c *Cache) UnwrittenChunks(ctx context.Context, userID string, chunks []Chunk) ([]Chunk, error) {
+	if c.memcache == nil {
+		return chunks, nil
+	}
+
+	keys := make([]string, 0, len(chunks))
+	for i := range chunks {
+		key, err := writtenChunkKey(userID, &chunks[i])
+		if err != nil {
+			return chunks, err
+		}
+		keys = append(keys, key)
+	}
+
+	var items map[string]*memcache.Item
+	err := instrument.TimeRequestHistogramStatus(ctx, "Memcache.Get", memcacheRequestDuration, memcacheStatusCode, func(_ context.Context) error {
+		var err error
+		items, err = c.memcache.GetMulti(keys)
+		return err
+	})
+	if err != nil {
+		return chunks, err
+	}
+
+	unwritten := make([]Chunk, 0, len(chunks))
+	for i, key := range keys {
+		if _, ok := items[key]; !ok {
+			unwritten = append(unwritten, chunks[i])
+		}
+	}
+	return unwritten, nil
+}
+
+// StoreWrittenChunks records that chunks have been written to the store.
+func (c *Cache) StoreWrittenChunks(ctx context.Context, userID string, chunks []Chunk) error {
+	if c.memcache == nil {
+		return nil
+	}
+
+	for i := range chunks {
+		key, err := writtenChunkKey(userID, &chunks[i])
+		if err != nil {
+			return err
+		}
+		err = instrument.TimeRequestHistogramStatus(ctx, "Memcache.Put", memcacheRequestDuration, memcacheStatusCode, func(_ context.Context) error {
+			item := memcache.Item{
+				Key:        key,
+				Value:      []byte{1},
+				Expiration: int32(c.cfg.Expiration.Seconds()),
+			}
+			return c.memcache.Set(&item)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cachedReadBatch is the result of reading an index entry, as stored in the
+// cache.
+type cachedReadBatch []cachedRow
+
+type cachedRow struct {
+	RangeValue []byte `json:"r"`
+	Value      []byte `json:"v,omitempty"`
+}
+
+func (b cachedReadBatch) Len() int                    { return len(b) }
+func (b cachedReadBatch) RangeValue(index int) []byte { return b[index].RangeValue }
+func (b cachedReadBatch) Value(index int) []byte      { return b[index].Value }
+
+// indexCacheKey hashes the entry, as memcache keys are limited to 250 bytes.
+func indexCacheKey(entry IndexEntry) string {
+	h := sha256.New()
+	for _, part := range [][]byte{
+		[]byte(entry.TableName),
+		[]byte(entry.HashValue),
+		entry.RangeValuePrefix,
+		entry.RangeValueStart,
+	} {
+		h.Write(part)
+		h.Write([]byte{0})
+	}
+	return "index/" + hex.EncodeToString(h.Sum(nil))
+}
+
+// FetchIndexEntries gets the result of reading an index entry from the cache.
+func (c *Cache) FetchIndexEntries(ctx context.Context, entry IndexEntry) (ReadBatch, bool, error) {
+	if c.memcache == nil {
+		return nil, false, nil
+	}
+
+	indexCacheRequests.Inc()
+
+	key := indexCacheKey(entry)
+	var items map[string]*memcache.Item
+	err := instrument.TimeRequestHistogramStatus(ctx, "Memcache.Get", memcacheRequestDuration, memcacheStatusCode, func(_ context.Context) error {
+		var err error
+		items, err = c.memcache.GetMulti([]string{key})
+		return err
+	})
+	if err != nil {
+		return nil, false, err
+	}
+
+	item, ok := items[key]
+	if !ok {
+		return nil, false, nil
+	}
+	var batch cachedReadBatch
+	if err := json.Unmarshal(item.Value, &batch); err != nil {
+		return nil, false, err
+	}
+
+	indexCacheHits.Inc()
+	return batch, true, nil
+}
+
+// StoreIndexEntries stores the result of reading an index entry in the cache.
+func (c *Cache) StoreIndexEntries(ctx context.Context, entry IndexEntry, batch cachedReadBatch) error {
+	if c.memcache == nil {
+		return nil
+	}
+
+	buf, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+
+	return instrument.TimeRequestHistogramStatus(ctx, "Memcache.Put", memcacheRequestDuration, memcacheStatusCode, func(_ context.Context) error {
+		item := memcache.Item{
+			Key:        indexCacheKey(entry),
+			Value:      buf,
+			Expiration: int32(c.cfg.Expiration.Seconds()),
+		}
+		return c.memcache.Set(&item)
+	})
+}
@@ -0,0 +1,181 @@
+package chunk
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/local/chunk"
+	"github.com/prometheus/prometheus/storage/metric"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/user"
+)
+
+type mockMemcache struct {
+	mtx      sync.Mutex
+	contents map[string][]byte
+}
+
+func newMockMemcache() *mockMemcache {
+	return &mockMemcache{
+		contents: map[string][]byte{},
+	}
+}
+
+func (m *mockMemcache) GetMulti(keys []string) (map[string]*memcache.Item, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	result := map[string]*memcache.Item{}
+	for _, k := range keys {
+		if c, ok := m.contents[k]; ok {
+			result[k] = &memcache.Item{
+				Value: c,
+			}
+		}
+	}
+	return result, nil
+}
+
+func (m *mockMemcache) Set(item *memcache.Item) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.contents[item.Key] = item.Value
+	return nil
+}
+
+type countingStorage struct {
+	StorageClient
+	queries int32
+}
+
+func (s *countingStorage) QueryPages(ctx context.Context, queries []IndexEntry, callback func(IndexEntry, ReadBatch) (shouldContinue bool)) error {
+	atomic.AddInt32(&s.queries, int32(len(queries)))
+	return s.StorageClient.QueryPages(ctx, queries, callback)
+}
+
+func TestIndexCache(t *testing.T) {
+	ctx := user.Inject(context.Background(), "0")
+	now := model.Now()
+	chunks, _ := chunk.New().Add(model.SamplePair{Timestamp: now, Value: 0})
+	oldChunk := NewChunk(
+		model.Fingerprint(1),
+		model.Metric{model.MetricNameLabel: "foo", "bar": "baz"},
+		chunks[0],
+		now.Add(-72*time.Hour),
+		now.Add(-71*time.Hour),
+	)
+	recentChunk := NewChunk(
+		model.Fingerprint(1),
+		model.Metric{model.MetricNameLabel: "foo", "bar": "baz"},
+		chunks[0],
+		now.Add(-time.Hour),
+		now,
+	)
+
+	for i, tc := range []struct {
+		from, through model.Time
+		expect        []Chunk
+		cached        bool
+		partlyCached  bool
+	}{
+		{now.Add(-72 * time.Hour), now.Add(-71 * time.Hour), []Chunk{oldChunk}, true, false},
+		{now.Add(-time.Hour), now, []Chunk{recentChunk}, false, false},
+		{now.Add(-72 * time.Hour), now, []Chunk{oldChunk, recentChunk}, false, true},
+	} {
+		for _, matchers := range [][]*metric.LabelMatcher{
+			{mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo")},
+			{mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo"), mustNewLabelMatcher(metric.Equal, "bar", "baz")},
+			{mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo"), mustNewLabelMatcher(metric.RegexMatch, "bar", "b.*")},
+		} {
+			dynamoDB := NewMockStorage()
+			setupDynamodb(t, dynamoDB)
+			storage := &countingStorage{StorageClient: dynamoDB}
+			store, err := NewStore(StoreConfig{
+				CacheIndexOlderThan: 24 * time.Hour,
+				mockDynamoDB:        storage,
+				mockS3:              NewMockS3(),
+				schemaFactory:       v5Schema,
+			})
+			require.NoError(t, err)
+			memcache := newMockMemcache()
+			store.cache = &Cache{memcache: memcache}
+			require.NoError(t, store.Put(ctx, []Chunk{oldChunk, recentChunk}))
+
+			result, err := store.Get(ctx, tc.from, tc.through, matchers...)
+			require.NoError(t, err)
+			assert.Equal(t, len(tc.expect), len(result), "%d", i)
+			uncached := atomic.SwapInt32(&storage.queries, 0)
+			assert.True(t, uncached > 0)
+
+			// Chunks are now in the chunk cache too, so only check the IDs.
+			result, err = store.Get(ctx, tc.from, tc.through, matchers...)
+			require.NoError(t, err)
+			assert.Equal(t, len(tc.expect), len(result), "%d", i)
+			for j := range tc.expect {
+				assert.Equal(t, tc.expect[j].ID, result[j].ID)
+			}
+			queries := atomic.LoadInt32(&storage.queries)
+			switch {
+			case tc.cached:
+				assert.Equal(t, int32(0), queries, "%d", i)
+			case tc.partlyCached:
+				assert.True(t, queries > 0 && queries < uncached, "%d: %d, %d", i, queries, uncached)
+			default:
+				assert.Equal(t, uncached, queries, "%d", i)
+			}
+		}
+	}
+}
+
+type countingS3 struct {
+	S3Client
+	puts int32
+}
+
+func (s *countingS3) PutObject(input *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+	atomic.AddInt32(&s.puts, 1)
+	return s.S3Client.PutObject(input)
+}
+
+func TestDedupeWrites(t *testing.T) {
+	ctx := user.Inject(context.Background(), "0")
+	now := model.Now()
+	metric := model.Metric{model.MetricNameLabel: "foo", "bar": "baz"}
+	chunks, _ := chunk.New().Add(model.SamplePair{Timestamp: now, Value: 0})
+	c := NewChunk(model.Fingerprint(1), metric, chunks[0], now, now)
+	// A replica which got a different value for the same sample.
+	otherChunks, _ := chunk.New().Add(model.SamplePair{Timestamp: now, Value: 1})
+	other := NewChunk(model.Fingerprint(1), metric, otherChunks[0], now, now)
+
+	dynamoDB := NewMockStorage()
+	setupDynamodb(t, dynamoDB)
+	s3 := &countingS3{S3Client: NewMockS3()}
+	memcache := newMockMemcache()
+	newReplica := func() *Store {
+		store, err := NewStore(StoreConfig{
+			DedupeWrites:  true,
+			mockDynamoDB:  dynamoDB,
+			mockS3:        s3,
+			schemaFactory: v5Schema,
+		})
+		require.NoError(t, err)
+		store.cache = &Cache{memcache: memcache}
+		return store
+	}
+
+	for i := 0; i < 3; i++ {
+		require.NoError(t, newReplica().Put(ctx, []Chunk{c}))
+		assert.Equal(t, int32(1), atomic.LoadInt32(&s3.puts))
+	}
+
+	unwritten, err := newReplica().cache.UnwrittenChunks(ctx, "0", []Chunk{c, other})
+	require.NoError(t, err)
+	assert.Equal(t, []Chunk{other}, unwritten)
+}
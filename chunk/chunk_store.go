@@ -1,13 +1,20 @@
 package chunk
 
 import (
+	"bytes"
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"sort"
+	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/log"
 	"github.com/prometheus/common/model"
@@ -41,20 +48,62 @@ var (
 		},
 		HashBuckets: 1024,
 	})
+	dedupedChunks = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "cortex",
+		Name:      "chunk_store_deduped_chunks_total",
+		Help:      "Total count of chunks not written as they already had been, eg. by another replica.",
+	})
+	corruptChunks = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cortex",
+		Name:      "chunk_store_corrupt_chunks_total",
+		Help:      "Total count of chunks read whose data didn't match their checksum, by where they were read from.",
+	}, []string{"source"})
+	storedChunks = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cortex",
+		Name:      "chunk_store_stored_chunks_total",
+		Help:      "Total count of chunks stored, by user.",
+	}, []string{"user"})
+	storedChunkBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cortex",
+		Name:      "chunk_store_stored_chunk_bytes_total",
+		Help:      "Total bytes of chunks stored, after any encryption, by user.",
+	}, []string{"user"})
+	indexEntriesWritten = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cortex",
+		Name:      "chunk_store_index_entries_written_total",
+		Help:      "Total count of index entries written, by user.",
+	}, []string{"user"})
 )
 
 func init() {
 	prometheus.MustRegister(indexEntriesPerChunk)
 	prometheus.MustRegister(s3RequestDuration)
 	prometheus.MustRegister(rowWrites)
+	prometheus.MustRegister(dedupedChunks)
+	prometheus.MustRegister(corruptChunks)
+	prometheus.MustRegister(storedChunks)
+	prometheus.MustRegister(storedChunkBytes)
+	prometheus.MustRegister(indexEntriesWritten)
 }
 
 // StoreConfig specifies config for a ChunkStore
 type StoreConfig struct {
 	SchemaConfig
 	CacheConfig
+	EncryptionConfig
 	S3       util.URLValue
 	DynamoDB util.URLValue
+	Swift    SwiftConfig
+
+	// Index entries for time buckets older than this are cached.
+	CacheIndexOlderThan time.Duration
+
+	// Skip writing chunks which the chunk cache records have been written.
+	DedupeWrites bool
+
+	// Drop chunks which fail their checksum from queries, rather than failing
+	// the queries.
+	SkipCorruptChunks bool
 
 	mockS3         S3Client
 	mockBucketName string
@@ -69,11 +118,18 @@ type StoreConfig struct {
 func (cfg *StoreConfig) RegisterFlags(f *flag.FlagSet) {
 	cfg.SchemaConfig.RegisterFlags(f)
 	cfg.CacheConfig.RegisterFlags(f)
+	cfg.EncryptionConfig.RegisterFlags(f)
+	cfg.Swift.RegisterFlags(f)
 
 	f.Var(&cfg.S3, "s3.url", "S3 endpoint URL with escaped Key and Secret encoded. "+
 		"If only region is specified as a host, proper endpoint will be deducted.")
 	f.Var(&cfg.DynamoDB, "dynamodb.url", "DynamoDB endpoint URL with escaped Key and Secret encoded. "+
 		"If only region is specified as a host, proper endpoint will be deducted.")
+	f.DurationVar(&cfg.CacheIndexOlderThan, "store.cache-index-older-than", 0, "Cache index entries for time buckets that ended longer ago than this, in memcache. "+
+		"Must be longer than chunks take to be flushed, see -ingester.max-chunk-age. 0 to disable.")
+	f.BoolVar(&cfg.DedupeWrites, "store.dedupe-writes", false, "Skip writing chunks identical to ones already written, eg. by the other replicas of an ingester, "+
+		"as recorded in memcache. Cuts the writes of flushes by up to the replication factor.")
+	f.BoolVar(&cfg.SkipCorruptChunks, "store.skip-corrupt-chunks", false, "Log and drop chunks whose data doesn't match their checksum from queries, rather than failing the queries.")
 }
 
 // Store implements Store
@@ -86,6 +142,7 @@ type Store struct {
 	bucketName string
 	cache      *Cache
 	schema     Schema
+	encrypter  *encrypter
 }
 
 // NewStore makes a new ChunkStore
@@ -102,7 +159,11 @@ func NewStore(cfg StoreConfig) (*Store, error) {
 	s3Client, bucketName := cfg.mockS3, cfg.mockBucketName
 	if s3Client == nil {
 		var err error
-		s3Client, bucketName, err = NewS3Client(cfg.S3.String())
+		if cfg.Swift.AuthURL != "" {
+			s3Client, bucketName, err = NewSwiftClient(cfg.Swift)
+		} else {
+			s3Client, bucketName, err = NewS3Client(cfg.S3.String())
+		}
 		if err != nil {
 			return nil, err
 		}
@@ -120,6 +181,16 @@ func NewStore(cfg StoreConfig) (*Store, error) {
 		return nil, err
 	}
 
+	encrypter, err := newEncrypter(cfg.EncryptionConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	cache, err := NewCache(cfg.CacheConfig)
+	if err != nil {
+		return nil, err
+	}
+
 	return &Store{
 		cfg:        cfg,
 		storage:    dynamoDBClient,
@@ -127,7 +198,8 @@ func NewStore(cfg StoreConfig) (*Store, error) {
 		s3:         s3Client,
 		bucketName: bucketName,
 		schema:     schema,
-		cache:      NewCache(cfg.CacheConfig),
+		cache:      cache,
+		encrypter:  encrypter,
 	}, nil
 }
 
@@ -142,12 +214,33 @@ func (c *Store) Put(ctx context.Context, chunks []Chunk) error {
 		return err
 	}
 
+	if c.cfg.DedupeWrites {
+		unwritten, err := c.cache.UnwrittenChunks(ctx, userID, chunks)
+		if err != nil {
+			util.WithRequestID(ctx).Warnf("Could not check whether chunks have been written: %v", err)
+		}
+		dedupedChunks.Add(float64(len(chunks) - len(unwritten)))
+		chunks = unwritten
+		if len(chunks) == 0 {
+			return nil
+		}
+	}
+
 	err = c.putChunks(ctx, userID, chunks)
 	if err != nil {
 		return err
 	}
 
-	return c.updateIndex(ctx, userID, chunks)
+	if err := c.updateIndex(ctx, userID, chunks); err != nil {
+		return err
+	}
+
+	if c.cfg.DedupeWrites {
+		if err := c.cache.StoreWrittenChunks(ctx, userID, chunks); err != nil {
+			util.WithRequestID(ctx).Warnf("Could not record chunks as written: %v", err)
+		}
+	}
+	return nil
 }
 
 // putChunks writes a collection of chunks to S3 in parallel.
@@ -176,47 +269,74 @@ func (c *Store) putChunk(ctx context.Context, userID string, chunk *Chunk) error
 		return err
 	}
 
+	name := chunkName(userID, chunk.ID)
+	if c.encrypter.enabled(userID) {
+		buf, err := ioutil.ReadAll(body)
+		if err != nil {
+			return err
+		}
+		buf, err = c.encrypter.encrypt(userID, name, buf)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(buf)
+	}
+	size, err := body.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if _, err := body.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
 	err = instrument.TimeRequestHistogram(ctx, "S3.PutObject", s3RequestDuration, func(_ context.Context) error {
 		var err error
 		_, err = c.s3.PutObject(&s3.PutObjectInput{
 			Body:   body,
 			Bucket: aws.String(c.bucketName),
-			Key:    aws.String(chunkName(userID, chunk.ID)),
+			Key:    aws.String(name),
 		})
 		return err
 	})
 	if err != nil {
 		return err
 	}
+	storedChunks.WithLabelValues(userID).Inc()
+	storedChunkBytes.WithLabelValues(userID).Add(float64(size))
 
 	if err = c.cache.StoreChunkData(ctx, userID, chunk); err != nil {
-		log.Warnf("Could not store %v in chunk cache: %v", chunk.ID, err)
+		util.WithRequestID(ctx).Warnf("Could not store %v in chunk cache: %v", chunk.ID, err)
 	}
 	return nil
 }
 
 func (c *Store) updateIndex(ctx context.Context, userID string, chunks []Chunk) error {
-	writeReqs, err := c.calculateDynamoWrites(userID, chunks)
+	writeReqs, entries, err := c.calculateDynamoWrites(userID, chunks)
 	if err != nil {
 		return err
 	}
 
-	return c.storage.BatchWrite(ctx, writeReqs)
+	if err := c.storage.BatchWrite(ctx, writeReqs); err != nil {
+		return err
+	}
+	indexEntriesWritten.WithLabelValues(userID).Add(float64(entries))
+	return nil
 }
 
 // calculateDynamoWrites creates a set of batched WriteRequests to dynamo for all
-// the chunks it is given.
-func (c *Store) calculateDynamoWrites(userID string, chunks []Chunk) (WriteBatch, error) {
+// the chunks it is given, and returns how many there are.
+func (c *Store) calculateDynamoWrites(userID string, chunks []Chunk) (WriteBatch, int, error) {
 	writeReqs := c.storage.NewWriteBatch()
+	count := 0
 	for _, chunk := range chunks {
 		metricName, err := util.ExtractMetricNameFromMetric(chunk.Metric)
 		if err != nil {
-			return nil, err
+			return nil, 0, err
 		}
 
 		entries, err := c.schema.GetWriteEntries(chunk.From, chunk.Through, userID, metricName, chunk.Metric, chunk.ID)
 		if err != nil {
-			return nil, err
+			return nil, 0, err
 		}
 		indexEntriesPerChunk.Observe(float64(len(entries)))
 
@@ -224,8 +344,9 @@ func (c *Store) calculateDynamoWrites(userID string, chunks []Chunk) (WriteBatch
 			rowWrites.Observe(entry.HashValue, 1)
 			writeReqs.Add(entry.TableName, entry.HashValue, entry.RangeValue)
 		}
+		count += len(entries)
 	}
-	return writeReqs, nil
+	return writeReqs, count, nil
 }
 
 // Get implements ChunkStore
@@ -234,32 +355,183 @@ func (c *Store) Get(ctx context.Context, from, through model.Time, allMatchers .
 	if err != nil {
 		return nil, err
 	}
+	sp, ctx := util.StartSpanFromContext(ctx, "ChunkStore.Get")
+	defer sp.Finish()
+
+	shard, allMatchers, err := util.ExtractQueryShard(allMatchers)
+	if err != nil {
+		return nil, err
+	}
+	filters, matchers := util.SplitFiltersAndMatchers(allMatchers)
+
+	chunks, err := c.lookupChunks(ctx, userID, from, through, matchers, shard)
+	if err != nil {
+		return nil, err
+	}
+
+	sp.SetTag("chunks", len(chunks))
+
+	allChunks, err := c.fetchChunks(ctx, userID, chunks)
+	if err != nil {
+		ext.Error.Set(sp, true)
+		return nil, err
+	}
+
+	// TODO instead of doing this sort, propagate an index and assign chunks
+	// into the result based on that index.
+	sort.Sort(ByID(allChunks))
+
+	// Filter out chunks
+	filteredChunks := make([]Chunk, 0, len(allChunks))
+	for _, chunk := range allChunks {
+		if util.MatchesFilters(chunk.Metric, filters) {
+			filteredChunks = append(filteredChunks, chunk)
+		}
+	}
+
+	return filteredChunks, nil
+}
+
+// GetSeries returns the metrics of the series with chunks in the given time
+// range matching the matchers. Only one chunk per series is fetched, or none
+// if the series' metric is stored in the index.
+func (c *Store) GetSeries(ctx context.Context, from, through model.Time, allMatchers ...*metric.LabelMatcher) ([]model.Metric, error) {
+	userID, err := user.Extract(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sp, ctx := util.StartSpanFromContext(ctx, "ChunkStore.GetSeries")
+	defer sp.Finish()
 
+	shard, allMatchers, err := util.ExtractQueryShard(allMatchers)
+	if err != nil {
+		return nil, err
+	}
 	filters, matchers := util.SplitFiltersAndMatchers(allMatchers)
 
-	// Fetch chunk descriptors (just ID really) from storage
+	chunks, err := c.lookupChunks(ctx, userID, from, through, matchers, shard)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		seen    = map[model.Fingerprint]struct{}{}
+		metrics []model.Metric
+		fetch   []Chunk
+	)
+	for _, chunk := range chunks {
+		fp, _, _, err := parseChunkID(chunk.ID)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := seen[fp]; ok {
+			continue
+		}
+		seen[fp] = struct{}{}
+		if chunk.metadataInIndex {
+			metrics = append(metrics, chunk.Metric)
+		} else {
+			fetch = append(fetch, chunk)
+		}
+	}
+	sp.SetTag("series", len(seen))
+
+	fetched, err := c.fetchChunks(ctx, userID, fetch)
+	if err != nil {
+		ext.Error.Set(sp, true)
+		return nil, err
+	}
+	for _, chunk := range fetched {
+		metrics = append(metrics, chunk.Metric)
+	}
+
+	filtered := make([]model.Metric, 0, len(metrics))
+	for _, m := range metrics {
+		if util.MatchesFilters(m, filters) {
+			filtered = append(filtered, m)
+		}
+	}
+	return filtered, nil
+}
+
+// LookupChunks returns the chunks in the time range matching the matchers,
+// without their data, for FetchChunks to fetch later. Unlike Get, it doesn't
+// apply the filters, as they need the chunks' metrics.
+func (c *Store) LookupChunks(ctx context.Context, from, through model.Time, allMatchers ...*metric.LabelMatcher) ([]Chunk, error) {
+	userID, err := user.Extract(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sp, ctx := util.StartSpanFromContext(ctx, "ChunkStore.LookupChunks")
+	defer sp.Finish()
+
+	shard, allMatchers, err := util.ExtractQueryShard(allMatchers)
+	if err != nil {
+		return nil, err
+	}
+	_, matchers := util.SplitFiltersAndMatchers(allMatchers)
+
+	chunks, err := c.lookupChunks(ctx, userID, from, through, matchers, shard)
+	if err != nil {
+		return nil, err
+	}
+	sp.SetTag("chunks", len(chunks))
+	return chunks, nil
+}
+
+// FetchChunks fetches the data of chunks looked up by LookupChunks.
+func (c *Store) FetchChunks(ctx context.Context, chunks []Chunk) ([]Chunk, error) {
+	userID, err := user.Extract(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sp, ctx := util.StartSpanFromContext(ctx, "ChunkStore.FetchChunks")
+	defer sp.Finish()
+	sp.SetTag("chunks", len(chunks))
+
+	fetched, err := c.fetchChunks(ctx, userID, chunks)
+	if err != nil {
+		ext.Error.Set(sp, true)
+		return nil, err
+	}
+	return fetched, nil
+}
+
+// lookupChunks returns the descriptors (just ID really) of the chunks in the
+// time range matching the matchers, and in the query shard if not nil.
+func (c *Store) lookupChunks(ctx context.Context, userID string, from, through model.Time, matchers []*metric.LabelMatcher, shard *util.QueryShard) ([]Chunk, error) {
 	chunks, err := c.lookupMatchers(ctx, userID, from, through, matchers)
 	if err != nil {
 		return nil, err
 	}
 
-	// Filter out chunks that are not in the selected time range.
+	// Filter out chunks that are not in the selected time range or shard.
 	filtered := make([]Chunk, 0, len(chunks))
 	for _, chunk := range chunks {
-		_, chunkFrom, chunkThrough, err := parseChunkID(chunk.ID)
+		fp, chunkFrom, chunkThrough, err := parseChunkID(chunk.ID)
 		if err != nil {
 			return nil, err
 		}
 		if chunkThrough < from || through < chunkFrom {
 			continue
 		}
+		if shard != nil && !shard.Contains(fp) {
+			continue
+		}
 		filtered = append(filtered, chunk)
 	}
+	return filtered, nil
+}
 
-	// Now fetch the actual chunk data from Memcache / S3
-	fromCache, missing, err := c.cache.FetchChunkData(ctx, userID, filtered)
+// fetchChunks fetches the chunks' data from Memcache / S3.
+func (c *Store) fetchChunks(ctx context.Context, userID string, chunks []Chunk) ([]Chunk, error) {
+	fromCache, missing, err := c.cache.FetchChunkData(ctx, userID, chunks)
 	if err != nil {
-		log.Warnf("Error fetching from cache: %v", err)
+		util.WithRequestID(ctx).Warnf("Error fetching from cache: %v", err)
+	}
+
+	if sp := opentracing.SpanFromContext(ctx); sp != nil {
+		sp.SetTag("cache_hits", len(fromCache))
 	}
 
 	fromS3, err := c.fetchChunkData(ctx, userID, missing)
@@ -268,28 +540,10 @@ func (c *Store) Get(ctx context.Context, from, through model.Time, allMatchers .
 	}
 
 	if err = c.cache.StoreChunks(ctx, userID, fromS3); err != nil {
-		log.Warnf("Could not store chunks in chunk cache: %v", err)
+		util.WithRequestID(ctx).Warnf("Could not store chunks in chunk cache: %v", err)
 	}
 
-	// TODO instead of doing this sort, propagate an index and assign chunks
-	// into the result based on that index.
-	allChunks := append(fromCache, fromS3...)
-	sort.Sort(ByID(allChunks))
-
-	// Filter out chunks
-	filteredChunks := make([]Chunk, 0, len(allChunks))
-outer:
-	for _, chunk := range allChunks {
-		for _, filter := range filters {
-			if !filter.Match(chunk.Metric[filter.Name]) {
-				continue outer
-			}
-		}
-
-		filteredChunks = append(filteredChunks, chunk)
-	}
-
-	return filteredChunks, nil
+	return append(fromCache, fromS3...), nil
 }
 
 func (c *Store) lookupMatchers(ctx context.Context, userID string, from, through model.Time, matchers []*metric.LabelMatcher) ([]Chunk, error) {
@@ -299,29 +553,34 @@ func (c *Store) lookupMatchers(ctx context.Context, userID string, from, through
 	}
 
 	if len(matchers) == 0 {
-		entries, err := c.schema.GetReadEntriesForMetric(from, through, userID, metricName)
+		entries, recent, err := c.readEntries(from, through, func(from, through model.Time) ([]IndexEntry, error) {
+			return c.schema.GetReadEntriesForMetric(from, through, userID, metricName)
+		})
+		if err != nil {
+			return nil, err
+		}
+		chunks, err := c.lookupEntries(ctx, entries, recent, nil)
 		if err != nil {
 			return nil, err
 		}
-		return c.lookupEntries(ctx, entries, nil)
+		return c.lookupSeriesChunks(ctx, userID, from, through, chunks)
 	}
 
 	incomingChunkSets := make(chan ByID)
 	incomingErrors := make(chan error)
 	for _, matcher := range matchers {
 		go func(matcher *metric.LabelMatcher) {
-			var entries []IndexEntry
-			var err error
-			if matcher.Type != metric.Equal {
-				entries, err = c.schema.GetReadEntriesForMetricLabel(from, through, userID, metricName, matcher.Name)
-			} else {
-				entries, err = c.schema.GetReadEntriesForMetricLabelValue(from, through, userID, metricName, matcher.Name, matcher.Value)
-			}
+			entries, recent, err := c.readEntries(from, through, func(from, through model.Time) ([]IndexEntry, error) {
+				if matcher.Type != metric.Equal {
+					return c.schema.GetReadEntriesForMetricLabel(from, through, userID, metricName, matcher.Name)
+				}
+				return c.schema.GetReadEntriesForMetricLabelValue(from, through, userID, metricName, matcher.Name, matcher.Value)
+			})
 			if err != nil {
 				incomingErrors <- err
 				return
 			}
-			incoming, err := c.lookupEntries(ctx, entries, matcher)
+			incoming, err := c.lookupEntries(ctx, entries, recent, matcher)
 			if err != nil {
 				incomingErrors <- err
 			} else {
@@ -341,26 +600,50 @@ func (c *Store) lookupMatchers(ctx context.Context, userID string, from, through
 		}
 	}
 
-	return nWayIntersect(chunkSets), lastErr
+	if lastErr != nil {
+		return nil, lastErr
+	}
+	return c.lookupSeriesChunks(ctx, userID, from, through, nWayIntersect(chunkSets))
 }
 
-func (c *Store) lookupEntries(ctx context.Context, entries []IndexEntry, matcher *metric.LabelMatcher) (ByID, error) {
+// lookupSeriesChunks replaces the series found in the index of schemas
+// indexing series, which are only looked up once they match all the
+// matchers, with their chunks.
+func (c *Store) lookupSeriesChunks(ctx context.Context, userID string, from, through model.Time, found ByID) (ByID, error) {
+	var chunks, series ByID
+	for _, chunk := range found {
+		if chunk.series {
+			series = append(series, chunk)
+		} else {
+			chunks = append(chunks, chunk)
+		}
+	}
+	if len(series) == 0 {
+		return chunks, nil
+	}
+
 	incomingChunkSets := make(chan ByID)
 	incomingErrors := make(chan error)
-	for _, entry := range entries {
-		go func(entry IndexEntry) {
-			incoming, err := c.lookupEntry(ctx, entry, matcher)
+	for _, s := range series {
+		go func(seriesID string) {
+			entries, recent, err := c.readEntries(from, through, func(from, through model.Time) ([]IndexEntry, error) {
+				return c.schema.GetChunksForSeries(from, through, userID, seriesID)
+			})
+			if err != nil {
+				incomingErrors <- err
+				return
+			}
+			incoming, err := c.lookupEntries(ctx, entries, recent, nil)
 			if err != nil {
 				incomingErrors <- err
 			} else {
 				incomingChunkSets <- incoming
 			}
-		}(entry)
+		}(s.ID)
 	}
 
-	var chunks ByID
 	var lastErr error
-	for i := 0; i < len(entries); i++ {
+	for range series {
 		select {
 		case incoming := <-incomingChunkSets:
 			chunks = merge(chunks, incoming)
@@ -368,26 +651,116 @@ func (c *Store) lookupEntries(ctx context.Context, entries []IndexEntry, matcher
 			lastErr = err
 		}
 	}
-
 	return chunks, lastErr
 }
 
-func (c *Store) lookupEntry(ctx context.Context, entry IndexEntry, matcher *metric.LabelMatcher) (ByID, error) {
+// readEntries returns the index entries to read for a query, and the cache keys
+// of those for recent time buckets, which may still be written to so mustn't
+// be cached.
+func (c *Store) readEntries(from, through model.Time, getEntries func(from, through model.Time) ([]IndexEntry, error)) ([]IndexEntry, map[string]struct{}, error) {
+	entries, err := getEntries(from, through)
+	if err != nil || c.cfg.CacheIndexOlderThan <= 0 {
+		return entries, nil, err
+	}
+
+	cutoff := model.Now().Add(-c.cfg.CacheIndexOlderThan)
+	if through < cutoff {
+		return entries, map[string]struct{}{}, nil
+	}
+	if from < cutoff {
+		from = cutoff
+	}
+	recentEntries, err := getEntries(from, through)
+	if err != nil {
+		return nil, nil, err
+	}
+	recent := make(map[string]struct{}, len(recentEntries))
+	for _, entry := range recentEntries {
+		recent[indexCacheKey(entry)] = struct{}{}
+	}
+	return entries, recent, nil
+}
+
+func (c *Store) lookupEntries(ctx context.Context, entries []IndexEntry, recent map[string]struct{}, matcher *metric.LabelMatcher) (ByID, error) {
 	var chunkSet ByID
+	queries := make([]IndexEntry, 0, len(entries))
+	cacheable := map[string]bool{}
+	type cached struct {
+		entry IndexEntry
+		batch ReadBatch
+		ok    bool
+	}
+	incoming := make(chan cached)
+	fetching := 0
+	for _, entry := range entries {
+		if recent != nil {
+			if _, isRecent := recent[indexCacheKey(entry)]; !isRecent {
+				cacheable[indexCacheKey(entry)] = true
+				fetching++
+				go func(entry IndexEntry) {
+					batch, ok, err := c.cache.FetchIndexEntries(ctx, entry)
+					if err != nil {
+						util.WithRequestID(ctx).Warnf("Error fetching index entries from cache: %v", err)
+					}
+					incoming <- cached{entry, batch, ok}
+				}(entry)
+				continue
+			}
+		}
+		queries = append(queries, entry)
+	}
 	var processingError error
-	if err := c.storage.QueryPages(ctx, entry, func(resp ReadBatch, lastPage bool) (shouldContinue bool) {
-		processingError = processResponse(resp, &chunkSet, matcher)
-		return processingError != nil && !lastPage
+	for i := 0; i < fetching; i++ {
+		result := <-incoming
+		if !result.ok {
+			queries = append(queries, result.entry)
+		} else if err := processResponse(result.batch, &chunkSet, matcher); err != nil {
+			processingError = err
+		}
+	}
+	if processingError != nil {
+		return nil, processingError
+	}
+
+	// Pages of different queries arrive concurrently, and are processed as
+	// they do, keeping only the rows to cache.
+	var mtx sync.Mutex
+	rows := map[string]cachedReadBatch{}
+	if err := c.storage.QueryPages(ctx, queries, func(query IndexEntry, resp ReadBatch) (shouldContinue bool) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		if processingError != nil {
+			return false
+		}
+		if processingError = processResponse(resp, &chunkSet, matcher); processingError != nil {
+			return false
+		}
+		if key := indexCacheKey(query); cacheable[key] {
+			for i := 0; i < resp.Len(); i++ {
+				rows[key] = append(rows[key], cachedRow{RangeValue: resp.RangeValue(i), Value: resp.Value(i)})
+			}
+		}
+		return true
 	}); err != nil {
-		log.Errorf("Error querying storage: %v", err)
+		util.WithRequestID(ctx).Errorf("Error querying storage: %v", err)
 		return nil, err
 	} else if processingError != nil {
-		log.Errorf("Error processing storage response: %v", processingError)
+		util.WithRequestID(ctx).Errorf("Error processing storage response: %v", processingError)
 		return nil, processingError
 	}
+
+	for _, entry := range queries {
+		key := indexCacheKey(entry)
+		if !cacheable[key] {
+			continue
+		}
+		if err := c.cache.StoreIndexEntries(ctx, entry, rows[key]); err != nil {
+			util.WithRequestID(ctx).Warnf("Could not store index entries in cache: %v", err)
+		}
+	}
+
 	sort.Sort(ByID(chunkSet))
-	chunkSet = unique(chunkSet)
-	return chunkSet, nil
+	return unique(chunkSet), nil
 }
 
 func processResponse(resp ReadBatch, chunkSet *ByID, matcher *metric.LabelMatcher) error {
@@ -396,13 +769,14 @@ func processResponse(resp ReadBatch, chunkSet *ByID, matcher *metric.LabelMatche
 		if rangeValue == nil {
 			return fmt.Errorf("invalid item: %d", i)
 		}
-		value, chunkID, err := parseRangeValue(rangeValue)
+		value, id, series, err := parseRangeValue(rangeValue)
 		if err != nil {
 			return err
 		}
 
 		chunk := Chunk{
-			ID: chunkID,
+			ID:     id,
+			series: series,
 		}
 
 		if value := resp.Value(i); value != nil {
@@ -422,6 +796,10 @@ func processResponse(resp ReadBatch, chunkSet *ByID, matcher *metric.LabelMatche
 }
 
 func (c *Store) fetchChunkData(ctx context.Context, userID string, chunkSet []Chunk) ([]Chunk, error) {
+	sp, ctx := util.StartSpanFromContext(ctx, "ChunkStore.fetchChunkData")
+	defer sp.Finish()
+	sp.SetTag("chunks", len(chunkSet))
+
 	incomingChunks := make(chan Chunk)
 	incomingErrors := make(chan error)
 	for _, chunk := range chunkSet {
@@ -440,7 +818,29 @@ func (c *Store) fetchChunkData(ctx context.Context, userID string, chunkSet []Ch
 				return
 			}
 			defer resp.Body.Close()
-			if err := chunk.decode(resp.Body); err != nil {
+			buf, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				incomingErrors <- err
+				return
+			}
+			// Whether a chunk is encrypted depends on the config when it was
+			// written, not now.
+			if !chunk.metadataInIndex && isEncrypted(buf) {
+				if c.encrypter == nil {
+					incomingErrors <- fmt.Errorf("chunk %s is encrypted, but encryption is not configured", chunk.ID)
+					return
+				}
+				buf, err = c.encrypter.decrypt(userID, chunkName(userID, chunk.ID), buf)
+				if err != nil {
+					incomingErrors <- err
+					return
+				}
+			}
+			if err := chunk.decode(bytes.NewReader(buf)); err != nil {
+				if err == ErrInvalidChecksum {
+					corruptChunks.WithLabelValues("store").Inc()
+					log.Errorf("Chunk %s of user %s is corrupt: %v", chunk.ID, userID, err)
+				}
 				incomingErrors <- err
 				return
 			}
@@ -455,6 +855,9 @@ func (c *Store) fetchChunkData(ctx context.Context, userID string, chunkSet []Ch
 		case chunk := <-incomingChunks:
 			chunks = append(chunks, chunk)
 		case err := <-incomingErrors:
+			if err == ErrInvalidChecksum && c.cfg.SkipCorruptChunks {
+				continue
+			}
 			errors = append(errors, err)
 		}
 	}
@@ -6,6 +6,8 @@ import (
 	"testing"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/prometheus/common/log"
 	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/storage/local/chunk"
@@ -14,6 +16,7 @@ import (
 
 	"github.com/weaveworks/common/test"
 	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex/util"
 )
 
 func setupDynamodb(t *testing.T, dynamoDB StorageClient) {
@@ -65,6 +68,7 @@ func TestChunkStore(t *testing.T) {
 		{"v3 schema", v3Schema},
 		{"v4 schema", v4Schema},
 		{"v5 schema", v5Schema},
+		{"v6 schema", v6Schema},
 	}
 
 	nameMatcher := mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo")
@@ -118,6 +122,16 @@ func TestChunkStore(t *testing.T) {
 			"Multiple matchers II",
 			[]Chunk{chunk1}, []*metric.LabelMatcher{nameMatcher, mustNewLabelMatcher(metric.Equal, "toms", "code"), mustNewLabelMatcher(metric.Equal, "bar", "baz")},
 		},
+		{
+			"Query shard 0_of_2",
+			[]Chunk{chunk2},
+			[]*metric.LabelMatcher{nameMatcher, util.QueryShard{Index: 0, Count: 2}.Matcher()},
+		},
+		{
+			"Query shard 1_of_2",
+			[]Chunk{chunk1},
+			[]*metric.LabelMatcher{nameMatcher, util.QueryShard{Index: 1, Count: 2}.Matcher()},
+		},
 	} {
 		for _, schema := range schemas {
 			t.Run(fmt.Sprintf("%s/%s", tc.name, schema.name), func(t *testing.T) {
@@ -145,6 +159,21 @@ func TestChunkStore(t *testing.T) {
 				if !reflect.DeepEqual(tc.expect, chunks) {
 					t.Fatalf("%s: wrong chunks - %s", tc.name, test.Diff(tc.expect, chunks))
 				}
+
+				metrics, err := store.GetSeries(ctx, now.Add(-time.Hour), now, tc.matchers...)
+				if err != nil {
+					t.Fatal(err)
+				}
+				expectedSeries, series := map[model.Fingerprint]model.Metric{}, map[model.Fingerprint]model.Metric{}
+				for _, c := range tc.expect {
+					expectedSeries[c.Metric.Fingerprint()] = c.Metric
+				}
+				for _, m := range metrics {
+					series[m.Fingerprint()] = m
+				}
+				if len(metrics) != len(series) || !reflect.DeepEqual(expectedSeries, series) {
+					t.Fatalf("%s: wrong series - %s", tc.name, test.Diff(expectedSeries, series))
+				}
 			})
 		}
 	}
@@ -157,3 +186,96 @@ func mustNewLabelMatcher(matchType metric.MatchType, name model.LabelName, value
 	}
 	return matcher
 }
+
+func TestChunkStoreCorruptChunks(t *testing.T) {
+	ctx := user.Inject(context.Background(), "0")
+	now := model.Now()
+	chunks, _ := chunk.New().Add(model.SamplePair{Timestamp: now, Value: 0})
+	c := NewChunk(model.Fingerprint(1), model.Metric{model.MetricNameLabel: "foo"}, chunks[0], now.Add(-time.Hour), now)
+	matcher := mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo")
+
+	dynamoDB := NewMockStorage()
+	setupDynamodb(t, dynamoDB)
+	s3Client := NewMockS3()
+	newStore := func(skip bool) *Store {
+		store, err := NewStore(StoreConfig{
+			SkipCorruptChunks: skip,
+			mockDynamoDB:      dynamoDB,
+			mockS3:            s3Client,
+			schemaFactory:     v5Schema,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return store
+	}
+	if err := newStore(false).Put(ctx, []Chunk{c}); err != nil {
+		t.Fatal(err)
+	}
+	for _, bucket := range s3Client.buckets {
+		for _, buf := range bucket.objects {
+			buf[len(buf)-1] ^= 1
+		}
+	}
+
+	if _, err := newStore(false).Get(ctx, now.Add(-time.Hour), now, matcher); err != ErrInvalidChecksum {
+		t.Fatalf("expected %v, got %v", ErrInvalidChecksum, err)
+	}
+	result, err := newStore(true).Get(ctx, now.Add(-time.Hour), now, matcher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result) != 0 {
+		t.Fatalf("expected the corrupt chunk to be dropped, got %v", result)
+	}
+}
+
+func TestChunkStorePerUserMetrics(t *testing.T) {
+	ctx := user.Inject(context.Background(), "metrics-user")
+	now := model.Now()
+	chunks, _ := chunk.New().Add(model.SamplePair{Timestamp: now, Value: 0})
+	c := NewChunk(model.Fingerprint(1), model.Metric{model.MetricNameLabel: "foo", "bar": "baz"}, chunks[0], now.Add(-time.Hour), now)
+
+	dynamoDB := NewMockStorage()
+	setupDynamodb(t, dynamoDB)
+	s3Client := NewMockS3()
+	store, err := NewStore(StoreConfig{
+		mockDynamoDB:  dynamoDB,
+		mockS3:        s3Client,
+		schemaFactory: v5Schema,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Put(ctx, []Chunk{c}); err != nil {
+		t.Fatal(err)
+	}
+
+	var size int
+	for _, bucket := range s3Client.buckets {
+		for _, buf := range bucket.objects {
+			size += len(buf)
+		}
+	}
+	entries, err := store.schema.GetWriteEntries(c.From, c.Through, "metrics-user", "foo", c.Metric, c.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		counter  *prometheus.CounterVec
+		expected float64
+	}{
+		{storedChunks, 1},
+		{storedChunkBytes, float64(size)},
+		{indexEntriesWritten, float64(len(entries))},
+	} {
+		var m dto.Metric
+		if err := tc.counter.WithLabelValues("metrics-user").Write(&m); err != nil {
+			t.Fatal(err)
+		}
+		if value := m.GetCounter().GetValue(); value != tc.expected {
+			t.Fatalf("expected %v, got %v", tc.expected, value)
+		}
+	}
+}
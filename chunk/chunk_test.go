@@ -43,3 +43,23 @@ func TestChunkCodec(t *testing.T) {
 		t.Fatalf("wrong chunks - " + test.Diff(want, have))
 	}
 }
+
+func TestChunkChecksum(t *testing.T) {
+	now := model.Now()
+	cs, _ := chunk.New().Add(model.SamplePair{Timestamp: now, Value: 0})
+	c := NewChunk(model.Fingerprint(1), model.Metric{model.MetricNameLabel: "foo"}, cs[0], now, now)
+	buf, err := c.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := (&Chunk{}).Decode(buf); err != nil {
+		t.Fatalf("Decode() error: %v", err)
+	}
+
+	// Flip a bit of the data, at the end of the encoded chunk.
+	buf[len(buf)-1] ^= 1
+	if err := (&Chunk{}).Decode(buf); err != ErrInvalidChecksum {
+		t.Fatalf("expected %v, got %v", ErrInvalidChecksum, err)
+	}
+}
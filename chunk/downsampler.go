@@ -0,0 +1,342 @@
+package chunk
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/model"
+	prom_chunk "github.com/prometheus/prometheus/storage/local/chunk"
+	"github.com/prometheus/prometheus/storage/metric"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex/util"
+)
+
+// AggregateLabel is the label of downsampled series naming the aggregation of
+// the raw samples in each interval they hold: avg, min, max, count or sum.
+const AggregateLabel = "__aggregate__"
+
+// The aggregations downsampled series are made of.
+const (
+	AggregateAvg   = "avg"
+	AggregateMin   = "min"
+	AggregateMax   = "max"
+	AggregateCount = "count"
+	AggregateSum   = "sum"
+)
+
+var aggregates = []string{AggregateAvg, AggregateMin, AggregateMax, AggregateCount, AggregateSum}
+
+// DownsampleResolutions are the resolutions series are downsampled to.
+var DownsampleResolutions = []time.Duration{5 * time.Minute, time.Hour}
+
+var downsampledChunks = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "cortex",
+	Name:      "downsampler_chunks_total",
+	Help:      "The total number of downsampled chunks written to the store.",
+}, []string{"resolution"})
+
+func init() {
+	prometheus.MustRegister(downsampledChunks)
+}
+
+// DownsampledUserID is the ID the downsampled series of a tenant are stored
+// under, keeping them apart from the tenant's raw series.
+func DownsampledUserID(userID string, resolution time.Duration) string {
+	return fmt.Sprintf("%s:downsampled-%s", userID, model.Duration(resolution))
+}
+
+// DownsamplerConfig configures downsampling the chunks of tenants' metrics
+// older than a threshold, a day at a time.
+type DownsamplerConfig struct {
+	Tenants     string
+	MetricNames string
+	From        util.DayValue
+	After       time.Duration
+
+	Interval       time.Duration
+	Concurrency    int
+	CheckpointFile string
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet
+func (cfg *DownsamplerConfig) RegisterFlags(f *flag.FlagSet) {
+	f.StringVar(&cfg.Tenants, "downsampler.tenants", "", "Comma-separated list of tenants whose metrics are downsampled.")
+	f.StringVar(&cfg.MetricNames, "downsampler.metric-names", "", "Comma-separated list of the metric names which are downsampled.")
+	f.Var(&cfg.From, "downsampler.from", "The first day (YYYY-MM-DD) to downsample.")
+	f.DurationVar(&cfg.After, "downsampler.after", 48*time.Hour, "How old the samples of a day must all be before it is downsampled. Should match -querier.downsampled-after.")
+	f.DurationVar(&cfg.Interval, "downsampler.interval", time.Hour, "Period with which to look for days to downsample.")
+	f.IntVar(&cfg.Concurrency, "downsampler.concurrency", 10, "Number of tenant, metric name and day combinations downsampled concurrently.")
+	f.StringVar(&cfg.CheckpointFile, "downsampler.checkpoint-file", "", "File recording the tenant, metric name and day combinations already downsampled, so they aren't downsampled again after a restart.")
+}
+
+// DownsamplerStore is the store raw chunks are read from, and downsampled
+// chunks written to.
+type DownsamplerStore interface {
+	Get(ctx context.Context, from, through model.Time, matchers ...*metric.LabelMatcher) ([]Chunk, error)
+	Put(ctx context.Context, chunks []Chunk) error
+}
+
+// Downsampler periodically writes chunks of the avg, min, max, count and sum
+// of the samples of series in each interval of the DownsampleResolutions,
+// for days older than the threshold, a day of a tenant's metric at a time.
+type Downsampler struct {
+	cfg   DownsamplerConfig
+	store DownsamplerStore
+	quit  chan struct{}
+	wait  sync.WaitGroup
+
+	mtx       sync.Mutex
+	completed map[string]struct{}
+}
+
+// NewDownsampler makes a new Downsampler, reading the checkpoint file if it
+// exists.
+func NewDownsampler(cfg DownsamplerConfig, store DownsamplerStore) (*Downsampler, error) {
+	if !cfg.From.IsSet() {
+		return nil, fmt.Errorf("the day to downsample from must be set")
+	}
+	if cfg.Concurrency < 1 {
+		cfg.Concurrency = 1
+	}
+	d := &Downsampler{
+		cfg:       cfg,
+		store:     store,
+		quit:      make(chan struct{}),
+		completed: map[string]struct{}{},
+	}
+	if cfg.CheckpointFile != "" {
+		completed, err := readCheckpointFile(cfg.CheckpointFile)
+		if err != nil {
+			return nil, err
+		}
+		d.completed = completed
+	}
+	return d, nil
+}
+
+// Start the Downsampler.
+func (d *Downsampler) Start() {
+	d.wait.Add(1)
+	go d.loop()
+}
+
+// Stop the Downsampler, waiting for the units being downsampled to finish.
+func (d *Downsampler) Stop() {
+	close(d.quit)
+	d.wait.Wait()
+}
+
+func (d *Downsampler) loop() {
+	defer d.wait.Done()
+
+	ticker := time.NewTicker(d.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		d.run()
+		select {
+		case <-ticker.C:
+		case <-d.quit:
+			return
+		}
+	}
+}
+
+// units returns the units of the days whose samples are all older than the
+// threshold, which haven't been downsampled yet.
+func (d *Downsampler) units() []migrationUnit {
+	through := model.Now().Add(-d.cfg.After)
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	var units []migrationUnit
+	for _, userID := range splitList(d.cfg.Tenants) {
+		for _, metricName := range splitList(d.cfg.MetricNames) {
+			for from := d.cfg.From.Time; !from.Add(24 * time.Hour).After(through); from = from.Add(24 * time.Hour) {
+				unit := migrationUnit{
+					userID:     userID,
+					metricName: metricName,
+					from:       from,
+					through:    from.Add(24 * time.Hour),
+				}
+				if _, ok := d.completed[unit.key()]; !ok {
+					units = append(units, unit)
+				}
+			}
+		}
+	}
+	return units
+}
+
+// run downsamples the units which are due, recording those which succeed in
+// the checkpoint file. Those which fail are retried on the next run.
+func (d *Downsampler) run() {
+	work := make(chan migrationUnit)
+	var workers sync.WaitGroup
+	for i := 0; i < d.cfg.Concurrency; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for unit := range work {
+				if err := d.downsample(unit); err != nil {
+					log.Errorf("Error downsampling chunks for %s: %v", unit.key(), err)
+					continue
+				}
+
+				d.mtx.Lock()
+				d.completed[unit.key()] = struct{}{}
+				if d.cfg.CheckpointFile != "" {
+					if err := writeCheckpointFile(d.cfg.CheckpointFile, d.completed); err != nil {
+						log.Errorf("Error writing downsampling checkpoint: %v", err)
+					}
+				}
+				d.mtx.Unlock()
+			}
+		}()
+	}
+
+loop:
+	for _, unit := range d.units() {
+		select {
+		case work <- unit:
+		case <-d.quit:
+			break loop
+		}
+	}
+	close(work)
+	workers.Wait()
+}
+
+// downsample writes the downsampled chunks of one unit.
+func (d *Downsampler) downsample(unit migrationUnit) error {
+	matcher, err := metric.NewLabelMatcher(metric.Equal, model.MetricNameLabel, model.LabelValue(unit.metricName))
+	if err != nil {
+		return err
+	}
+	chunks, err := d.store.Get(user.Inject(context.Background(), unit.userID), unit.from, unit.through-1, matcher)
+	if err != nil {
+		return err
+	}
+	matrix, err := ChunksToMatrix(chunks)
+	if err != nil {
+		return err
+	}
+
+	for _, resolution := range DownsampleResolutions {
+		var downsampled []Chunk
+		for _, ss := range matrix {
+			cs, err := downsampleSeries(ss, unit.from, unit.through, resolution)
+			if err != nil {
+				return err
+			}
+			downsampled = append(downsampled, cs...)
+		}
+
+		ctx := user.Inject(context.Background(), DownsampledUserID(unit.userID, resolution))
+		for len(downsampled) > 0 {
+			batch := downsampled
+			if len(batch) > migrationBatchSize {
+				batch = batch[:migrationBatchSize]
+			}
+			if err := d.store.Put(ctx, batch); err != nil {
+				return err
+			}
+			downsampledChunks.WithLabelValues(model.Duration(resolution).String()).Add(float64(len(batch)))
+			downsampled = downsampled[len(batch):]
+		}
+	}
+	return nil
+}
+
+// downsampleSeries returns the chunks of the series of each aggregation of the
+// samples in [from, through) in each interval of the resolution. The
+// aggregated samples are timestamped with the end of their interval, less a
+// millisecond, so they fall within it.
+func downsampleSeries(ss *model.SampleStream, from, through model.Time, resolution time.Duration) ([]Chunk, error) {
+	step := model.Time(resolution / time.Millisecond)
+	series := make(map[string][]model.SamplePair, len(aggregates))
+
+	var (
+		intervalEnd         model.Time
+		count               int
+		sum, minVal, maxVal float64
+	)
+	flush := func() {
+		if count == 0 {
+			return
+		}
+		ts := intervalEnd - 1
+		for aggr, value := range map[string]float64{
+			AggregateAvg:   sum / float64(count),
+			AggregateMin:   minVal,
+			AggregateMax:   maxVal,
+			AggregateCount: float64(count),
+			AggregateSum:   sum,
+		} {
+			series[aggr] = append(series[aggr], model.SamplePair{Timestamp: ts, Value: model.SampleValue(value)})
+		}
+		count, sum = 0, 0
+	}
+	for _, s := range ss.Values {
+		if s.Timestamp.Before(from) || !s.Timestamp.Before(through) || util.IsStaleNaN(s.Value) {
+			continue
+		}
+		if end := s.Timestamp - s.Timestamp%step + step; end != intervalEnd {
+			flush()
+			intervalEnd = end
+		}
+		v := float64(s.Value)
+		if count == 0 {
+			minVal, maxVal = v, v
+		}
+		minVal, maxVal = math.Min(minVal, v), math.Max(maxVal, v)
+		sum += v
+		count++
+	}
+	flush()
+
+	var chunks []Chunk
+	for _, aggr := range aggregates {
+		m := ss.Metric.Clone()
+		m[AggregateLabel] = model.LabelValue(aggr)
+		cs, err := samplesToChunks(m, series[aggr])
+		if err != nil {
+			return nil, err
+		}
+		chunks = append(chunks, cs...)
+	}
+	return chunks, nil
+}
+
+// samplesToChunks encodes the samples of a series into as many chunks as they
+// need.
+func samplesToChunks(m model.Metric, samples []model.SamplePair) ([]Chunk, error) {
+	if len(samples) == 0 {
+		return nil, nil
+	}
+
+	var (
+		fp     = m.Fingerprint()
+		chunks []Chunk
+		head   = prom_chunk.New()
+		first  = samples[0].Timestamp
+		last   model.Time
+	)
+	for _, s := range samples {
+		cs, err := head.Add(s)
+		if err != nil {
+			return nil, err
+		}
+		if len(cs) > 1 {
+			chunks = append(chunks, NewChunk(fp, m, cs[0], first, last))
+			first = s.Timestamp
+		}
+		head, last = cs[len(cs)-1], s.Timestamp
+	}
+	return append(chunks, NewChunk(fp, m, head, first, last)), nil
+}
@@ -0,0 +1,127 @@
+package chunk
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex/util"
+)
+
+func TestDownsampleSeries(t *testing.T) {
+	m := model.Metric{model.MetricNameLabel: "foo"}
+	ss := &model.SampleStream{
+		Metric: m,
+		Values: []model.SamplePair{
+			{Timestamp: 0, Value: 1},
+			{Timestamp: 60 * 1000, Value: 3},
+			{Timestamp: 120 * 1000, Value: util.StaleNaN},
+			{Timestamp: 300 * 1000, Value: 4},
+			// Outside the range downsampled.
+			{Timestamp: 600 * 1000, Value: 100},
+		},
+	}
+	chunks, err := downsampleSeries(ss, 0, 600*1000, 5*time.Minute)
+	require.NoError(t, err)
+	matrix, err := ChunksToMatrix(chunks)
+	require.NoError(t, err)
+
+	expected := map[string][]model.SampleValue{
+		AggregateAvg:   {2, 4},
+		AggregateMin:   {1, 4},
+		AggregateMax:   {3, 4},
+		AggregateCount: {2, 1},
+		AggregateSum:   {4, 4},
+	}
+	require.Len(t, matrix, len(expected))
+	for _, ss := range matrix {
+		aggr := string(ss.Metric[AggregateLabel])
+		assert.Equal(t, model.LabelValue("foo"), ss.Metric[model.MetricNameLabel])
+		require.Len(t, ss.Values, 2, aggr)
+		assert.Equal(t, model.Time(300*1000-1), ss.Values[0].Timestamp, aggr)
+		assert.Equal(t, model.Time(600*1000-1), ss.Values[1].Timestamp, aggr)
+		assert.Equal(t, expected[aggr], []model.SampleValue{ss.Values[0].Value, ss.Values[1].Value}, aggr)
+	}
+}
+
+// downsamplingStore returns a series with a sample a minute, and records the
+// chunks put to it by user.
+type downsamplingStore struct {
+	mtx  sync.Mutex
+	puts map[string][]Chunk
+}
+
+func (s *downsamplingStore) Get(ctx context.Context, from, through model.Time, matchers ...*metric.LabelMatcher) ([]Chunk, error) {
+	var samples []model.SamplePair
+	for ts := from; !ts.After(through); ts = ts.Add(time.Minute) {
+		samples = append(samples, model.SamplePair{Timestamp: ts, Value: 1})
+	}
+	return samplesToChunks(model.Metric{model.MetricNameLabel: model.LabelValue(matchers[0].Value)}, samples)
+}
+
+func (s *downsamplingStore) Put(ctx context.Context, chunks []Chunk) error {
+	userID, err := user.Extract(ctx)
+	if err != nil {
+		return err
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.puts[userID] = append(s.puts[userID], chunks...)
+	return nil
+}
+
+func TestDownsampler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "downsampler")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// Only the first day is old enough to be downsampled.
+	cfg := DownsamplerConfig{
+		Tenants:        "1",
+		MetricNames:    "foo",
+		From:           util.NewDayValue(model.Now().Add(-3 * 24 * time.Hour)),
+		After:          48 * time.Hour,
+		Concurrency:    2,
+		CheckpointFile: filepath.Join(dir, "checkpoint"),
+	}
+	store := &downsamplingStore{puts: map[string][]Chunk{}}
+	d, err := NewDownsampler(cfg, store)
+	require.NoError(t, err)
+	d.run()
+
+	for _, tc := range []struct {
+		resolution time.Duration
+		samples    int
+	}{
+		{5 * time.Minute, 24 * 12},
+		{time.Hour, 24},
+	} {
+		chunks := store.puts[DownsampledUserID("1", tc.resolution)]
+		matrix, err := ChunksToMatrix(chunks)
+		require.NoError(t, err)
+		require.Len(t, matrix, len(aggregates), tc.resolution.String())
+		for _, ss := range matrix {
+			assert.Len(t, ss.Values, tc.samples, tc.resolution.String())
+			if ss.Metric[AggregateLabel] == AggregateCount {
+				assert.Equal(t, model.SampleValue(tc.resolution/time.Minute), ss.Values[0].Value)
+			}
+		}
+	}
+
+	// The checkpoint file means the day isn't downsampled again.
+	store.puts = map[string][]Chunk{}
+	d, err = NewDownsampler(cfg, store)
+	require.NoError(t, err)
+	d.run()
+	assert.Empty(t, store.puts)
+}
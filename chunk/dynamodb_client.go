@@ -54,23 +54,29 @@ var (
 	dynamoConsumedCapacity = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Namespace: "cortex",
 		Name:      "dynamo_consumed_capacity_total",
-		Help:      "The capacity units consumed by operation.",
-	}, []string{"operation"})
+		Help:      "The capacity units consumed by operation and table.",
+	}, []string{"operation", tableNameLabel})
+	dynamoThrottled = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cortex",
+		Name:      "dynamo_throttled_total",
+		Help:      "The total number of requests DynamoDB throttled for exceeding a table's provisioned throughput, by operation and table.",
+	}, []string{"operation", tableNameLabel})
 	dynamoFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Namespace: "cortex",
 		Name:      "dynamo_failures_total",
 		Help:      "The total number of errors while storing chunks to the chunk store.",
 	}, []string{tableNameLabel, errorReasonLabel})
-	dynamoUnprocessedItems = prometheus.NewCounter(prometheus.CounterOpts{
+	dynamoUnprocessedItems = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Namespace: "cortex",
 		Name:      "dynamo_unprocessed_items_total",
-		Help:      "Unprocessed items",
-	})
+		Help:      "The total number of items of batch writes DynamoDB left unprocessed, and were retried, by table.",
+	}, []string{tableNameLabel})
 )
 
 func init() {
 	prometheus.MustRegister(dynamoRequestDuration)
 	prometheus.MustRegister(dynamoConsumedCapacity)
+	prometheus.MustRegister(dynamoThrottled)
 	prometheus.MustRegister(dynamoFailures)
 	prometheus.MustRegister(dynamoUnprocessedItems)
 }
@@ -100,7 +106,9 @@ func (d dynamoClientAdapter) NewWriteBatch() WriteBatch {
 	return dynamoDBWriteBatch(map[string][]*dynamodb.WriteRequest{})
 }
 
-// batchWrite writes requests to the underlying storage, handling retires and backoff.
+// BatchWrite writes requests to the underlying storage in batches of at most
+// dynamoMaxBatchSize items, retrying those DynamoDB doesn't process with
+// backoff.
 func (d dynamoClientAdapter) BatchWrite(ctx context.Context, input WriteBatch) error {
 	outstanding := input.(dynamoDBWriteBatch)
 	unprocessed := map[string][]*dynamodb.WriteRequest{}
@@ -119,9 +127,11 @@ func (d dynamoClientAdapter) BatchWrite(ctx context.Context, input WriteBatch) e
 			})
 			return err
 		})
-		for _, cc := range resp.ConsumedCapacity {
-			dynamoConsumedCapacity.WithLabelValues("DynamoDB.BatchWriteItem").
-				Add(float64(*cc.CapacityUnits))
+		if resp != nil {
+			for _, cc := range resp.ConsumedCapacity {
+				dynamoConsumedCapacity.WithLabelValues("DynamoDB.BatchWriteItem", aws.StringValue(cc.TableName)).
+					Add(aws.Float64Value(cc.CapacityUnits))
+			}
 		}
 
 		if err != nil {
@@ -130,17 +140,12 @@ func (d dynamoClientAdapter) BatchWrite(ctx context.Context, input WriteBatch) e
 			}
 		}
 
-		// If there are unprocessed items, backoff and retry those items.
-		if unprocessedItems := resp.UnprocessedItems; unprocessedItems != nil && dictLen(unprocessedItems) > 0 {
-			takeReqs(unprocessedItems, unprocessed, -1)
-			time.Sleep(backoff)
-			backoff = nextBackoff(backoff)
-			continue
-		}
-
 		// If we get provisionedThroughputExceededException, then no items were processed,
 		// so back off and retry all.
 		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == provisionedThroughputExceededException {
+			for tableName := range reqs {
+				dynamoThrottled.WithLabelValues("DynamoDB.BatchWriteItem", tableName).Inc()
+			}
 			takeReqs(reqs, unprocessed, -1)
 			time.Sleep(backoff)
 			backoff = nextBackoff(backoff)
@@ -153,6 +158,25 @@ func (d dynamoClientAdapter) BatchWrite(ctx context.Context, input WriteBatch) e
 			return err
 		}
 
+		// DynamoDB leaves items unprocessed when it throttles some of the batch's
+		// tables or partitions, so retry just those. While some of each batch is
+		// processed the backoff is kept as it is; when none is, it grows.
+		if unprocessedItems := resp.UnprocessedItems; dictLen(unprocessedItems) > 0 {
+			numUnprocessed := dictLen(unprocessedItems)
+			for tableName, items := range unprocessedItems {
+				dynamoUnprocessedItems.WithLabelValues(tableName).Add(float64(len(items)))
+			}
+			takeReqs(unprocessedItems, unprocessed, -1)
+			time.Sleep(backoff)
+			if numUnprocessed < dictLen(reqs) {
+				numRetries = 0
+			} else {
+				backoff = nextBackoff(backoff)
+				numRetries++
+			}
+			continue
+		}
+
 		backoff = minBackoff
 		numRetries = 0
 	}
@@ -163,7 +187,11 @@ func (d dynamoClientAdapter) BatchWrite(ctx context.Context, input WriteBatch) e
 	return nil
 }
 
-func (d dynamoClientAdapter) QueryPages(ctx context.Context, entry IndexEntry, callback func(result ReadBatch, lastPage bool) (shouldContinue bool)) error {
+func (d dynamoClientAdapter) QueryPages(ctx context.Context, queries []IndexEntry, callback func(IndexEntry, ReadBatch) (shouldContinue bool)) error {
+	return queryPagesParallel(ctx, queries, callback, d.queryPages)
+}
+
+func (d dynamoClientAdapter) queryPages(ctx context.Context, entry IndexEntry, callback func(ReadBatch) (shouldContinue bool)) error {
 	input := &dynamodb.QueryInput{
 		TableName: aws.String(entry.TableName),
 		KeyConditions: map[string]*dynamodb.Condition{
@@ -201,14 +229,15 @@ func (d dynamoClientAdapter) QueryPages(ctx context.Context, entry IndexEntry, c
 		})
 
 		if cc := page.Data.(*dynamodb.QueryOutput).ConsumedCapacity; cc != nil {
-			dynamoConsumedCapacity.WithLabelValues("DynamoDB.QueryPages").
-				Add(float64(*cc.CapacityUnits))
+			dynamoConsumedCapacity.WithLabelValues("DynamoDB.QueryPages", entry.TableName).
+				Add(aws.Float64Value(cc.CapacityUnits))
 		}
 
 		if err != nil {
 			recordDynamoError(*input.TableName, err)
 
 			if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == provisionedThroughputExceededException {
+				dynamoThrottled.WithLabelValues("DynamoDB.QueryPages", entry.TableName).Inc()
 				time.Sleep(backoff)
 				backoff = nextBackoff(backoff)
 				continue
@@ -218,7 +247,7 @@ func (d dynamoClientAdapter) QueryPages(ctx context.Context, entry IndexEntry, c
 		}
 
 		queryOutput := page.Data.(*dynamodb.QueryOutput)
-		if getNextPage := callback(dynamoDBReadBatch(queryOutput.Items), !page.HasNextPage()); !getNextPage {
+		if getNextPage := callback(dynamoDBReadBatch(queryOutput.Items)); !getNextPage {
 			return page.Error
 		}
 
@@ -241,60 +270,6 @@ func (d dynamoClientAdapter) ListTables() ([]string, error) {
 	return table, nil
 }
 
-func (d dynamoClientAdapter) CreateTable(name string, readCapacity, writeCapacity int64) error {
-	input := &dynamodb.CreateTableInput{
-		TableName: aws.String(name),
-		AttributeDefinitions: []*dynamodb.AttributeDefinition{
-			{
-				AttributeName: aws.String(hashKey),
-				AttributeType: aws.String(dynamodb.ScalarAttributeTypeS),
-			},
-			{
-				AttributeName: aws.String(rangeKey),
-				AttributeType: aws.String(dynamodb.ScalarAttributeTypeB),
-			},
-		},
-		KeySchema: []*dynamodb.KeySchemaElement{
-			{
-				AttributeName: aws.String(hashKey),
-				KeyType:       aws.String(dynamodb.KeyTypeHash),
-			},
-			{
-				AttributeName: aws.String(rangeKey),
-				KeyType:       aws.String(dynamodb.KeyTypeRange),
-			},
-		},
-		ProvisionedThroughput: &dynamodb.ProvisionedThroughput{
-			ReadCapacityUnits:  aws.Int64(readCapacity),
-			WriteCapacityUnits: aws.Int64(writeCapacity),
-		},
-	}
-	_, err := d.DynamoDB.CreateTable(input)
-	return err
-}
-
-func (d dynamoClientAdapter) DescribeTable(name string) (readCapacity, writeCapacity int64, status string, err error) {
-	out, err := d.DynamoDB.DescribeTable(&dynamodb.DescribeTableInput{
-		TableName: aws.String(name),
-	})
-	if err != nil {
-		return 0, 0, "", err
-	}
-
-	return *out.Table.ProvisionedThroughput.ReadCapacityUnits, *out.Table.ProvisionedThroughput.WriteCapacityUnits, *out.Table.TableStatus, nil
-}
-
-func (d dynamoClientAdapter) UpdateTable(name string, readCapacity, writeCapacity int64) error {
-	_, err := d.DynamoDB.UpdateTable(&dynamodb.UpdateTableInput{
-		TableName: aws.String(name),
-		ProvisionedThroughput: &dynamodb.ProvisionedThroughput{
-			ReadCapacityUnits:  aws.Int64(readCapacity),
-			WriteCapacityUnits: aws.Int64(writeCapacity),
-		},
-	})
-	return err
-}
-
 type dynamoDBWriteBatch map[string][]*dynamodb.WriteRequest
 
 func (b dynamoDBWriteBatch) Add(tableName, hashValue string, rangeValue []byte) {
@@ -110,3 +110,35 @@ func TestDynamoDBClient(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestDynamoDBClientRetries(t *testing.T) {
+	for _, tc := range []struct {
+		unprocessed, provisionedErr int
+	}{
+		{unprocessed: 10},
+		{unprocessed: 60},
+		{provisionedErr: 2},
+		{unprocessed: 5, provisionedErr: 1},
+	} {
+		dynamoDB := newMockDynamoDB(tc.unprocessed, tc.provisionedErr)
+		client := dynamoClientAdapter{
+			DynamoDB: dynamoDB,
+		}
+		dynamoDB.createTable("table")
+		dynamoDB.createTable("other")
+		batch := client.NewWriteBatch()
+		for i := 0; i < 30; i++ {
+			batch.Add("table", fmt.Sprintf("hash%d", i), []byte(fmt.Sprintf("range%d", i)))
+			batch.Add("other", fmt.Sprintf("hash%d", i), []byte(fmt.Sprintf("range%d", i)))
+		}
+
+		if err := client.BatchWrite(context.Background(), batch); err != nil {
+			t.Fatalf("%+v: %v", tc, err)
+		}
+		for _, name := range []string{"table", "other"} {
+			if n := len(dynamoDB.tables[name].items); n != 30 {
+				t.Errorf("%+v: expected 30 items in %s, got %d", tc, name, n)
+			}
+		}
+	}
+}
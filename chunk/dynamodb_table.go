@@ -0,0 +1,275 @@
+package chunk
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+const (
+	billingModeProvisioned   = "PROVISIONED"
+	billingModePayPerRequest = "PAY_PER_REQUEST"
+	ttlStatusEnabled         = "ENABLED"
+	ttlStatusEnabling        = "ENABLING"
+)
+
+// The vendored SDK predates on-demand billing, tagging and TTL, so table
+// management uses its own inputs and outputs, which the SDK's JSON RPC
+// protocol marshals by their fields' names and tags.
+
+type dynamoTag struct {
+	Key   *string `type:"string"`
+	Value *string `type:"string"`
+}
+
+type createTableInput struct {
+	AttributeDefinitions  []*dynamodb.AttributeDefinition `type:"list"`
+	BillingMode           *string                         `type:"string"`
+	KeySchema             []*dynamodb.KeySchemaElement    `type:"list"`
+	ProvisionedThroughput *dynamodb.ProvisionedThroughput `type:"structure"`
+	TableName             *string                         `type:"string"`
+	Tags                  []*dynamoTag                    `type:"list"`
+}
+
+type updateTableInput struct {
+	BillingMode           *string                         `type:"string"`
+	ProvisionedThroughput *dynamodb.ProvisionedThroughput `type:"structure"`
+	TableName             *string                         `type:"string"`
+}
+
+type describeTableOutput struct {
+	Table *struct {
+		BillingModeSummary *struct {
+			BillingMode *string `type:"string"`
+		} `type:"structure"`
+		ProvisionedThroughput *struct {
+			ReadCapacityUnits  *int64 `type:"long"`
+			WriteCapacityUnits *int64 `type:"long"`
+		} `type:"structure"`
+		TableArn    *string `type:"string"`
+		TableStatus *string `type:"string"`
+	} `type:"structure"`
+}
+
+type listTagsOfResourceInput struct {
+	NextToken   *string `type:"string"`
+	ResourceArn *string `type:"string"`
+}
+
+type listTagsOfResourceOutput struct {
+	NextToken *string      `type:"string"`
+	Tags      []*dynamoTag `type:"list"`
+}
+
+type tagResourceInput struct {
+	ResourceArn *string      `type:"string"`
+	Tags        []*dynamoTag `type:"list"`
+}
+
+type untagResourceInput struct {
+	ResourceArn *string   `type:"string"`
+	TagKeys     []*string `type:"list"`
+}
+
+type timeToLiveSpecification struct {
+	AttributeName *string `type:"string"`
+	Enabled       *bool   `type:"boolean"`
+}
+
+type updateTimeToLiveInput struct {
+	TableName               *string                  `type:"string"`
+	TimeToLiveSpecification *timeToLiveSpecification `type:"structure"`
+}
+
+type describeTimeToLiveOutput struct {
+	TimeToLiveDescription *struct {
+		AttributeName    *string `type:"string"`
+		TimeToLiveStatus *string `type:"string"`
+	} `type:"structure"`
+}
+
+// send makes a DynamoDB request the SDK has no method for.
+func (d dynamoClientAdapter) send(operation string, input, output interface{}) error {
+	client, ok := d.DynamoDB.(*dynamodb.DynamoDB)
+	if !ok {
+		return fmt.Errorf("DynamoDB client doesn't support %s", operation)
+	}
+	return client.NewRequest(&request.Operation{
+		Name:       operation,
+		HTTPMethod: "POST",
+		HTTPPath:   "/",
+	}, input, output).Send()
+}
+
+func (d dynamoClientAdapter) CreateTable(desc TableDesc) error {
+	input := &createTableInput{
+		TableName: aws.String(desc.Name),
+		AttributeDefinitions: []*dynamodb.AttributeDefinition{
+			{
+				AttributeName: aws.String(hashKey),
+				AttributeType: aws.String(dynamodb.ScalarAttributeTypeS),
+			},
+			{
+				AttributeName: aws.String(rangeKey),
+				AttributeType: aws.String(dynamodb.ScalarAttributeTypeB),
+			},
+		},
+		KeySchema: []*dynamodb.KeySchemaElement{
+			{
+				AttributeName: aws.String(hashKey),
+				KeyType:       aws.String(dynamodb.KeyTypeHash),
+			},
+			{
+				AttributeName: aws.String(rangeKey),
+				KeyType:       aws.String(dynamodb.KeyTypeRange),
+			},
+		},
+		Tags: dynamoTags(desc.Tags),
+	}
+	if desc.OnDemand {
+		input.BillingMode = aws.String(billingModePayPerRequest)
+	} else {
+		input.ProvisionedThroughput = &dynamodb.ProvisionedThroughput{
+			ReadCapacityUnits:  aws.Int64(desc.ProvisionedRead),
+			WriteCapacityUnits: aws.Int64(desc.ProvisionedWrite),
+		}
+	}
+	// TTL can only be enabled once the table is active, so is left to the
+	// next update.
+	return d.send("CreateTable", input, &struct{}{})
+}
+
+func (d dynamoClientAdapter) DescribeTable(name string) (desc TableDesc, status string, err error) {
+	var out describeTableOutput
+	if err := d.send("DescribeTable", &dynamodb.DescribeTableInput{TableName: aws.String(name)}, &out); err != nil {
+		return TableDesc{}, "", err
+	}
+	if out.Table == nil {
+		return TableDesc{}, "", fmt.Errorf("no description of table %s", name)
+	}
+
+	desc.Name = name
+	status = aws.StringValue(out.Table.TableStatus)
+	if summary := out.Table.BillingModeSummary; summary != nil {
+		desc.OnDemand = aws.StringValue(summary.BillingMode) == billingModePayPerRequest
+	}
+	if throughput := out.Table.ProvisionedThroughput; throughput != nil {
+		desc.ProvisionedRead = aws.Int64Value(throughput.ReadCapacityUnits)
+		desc.ProvisionedWrite = aws.Int64Value(throughput.WriteCapacityUnits)
+	}
+
+	if desc.Tags, err = d.listTags(aws.StringValue(out.Table.TableArn)); err != nil {
+		return TableDesc{}, "", err
+	}
+
+	var ttl describeTimeToLiveOutput
+	if err := d.send("DescribeTimeToLive", &dynamodb.DescribeTableInput{TableName: aws.String(name)}, &ttl); err != nil {
+		return TableDesc{}, "", err
+	}
+	if description := ttl.TimeToLiveDescription; description != nil {
+		switch aws.StringValue(description.TimeToLiveStatus) {
+		case ttlStatusEnabled, ttlStatusEnabling:
+			desc.TTLAttribute = aws.StringValue(description.AttributeName)
+		}
+	}
+	return desc, status, nil
+}
+
+func (d dynamoClientAdapter) listTags(arn string) (Tags, error) {
+	var tags Tags
+	input := &listTagsOfResourceInput{ResourceArn: aws.String(arn)}
+	for {
+		var out listTagsOfResourceOutput
+		if err := d.send("ListTagsOfResource", input, &out); err != nil {
+			return nil, err
+		}
+		for _, tag := range out.Tags {
+			if tags == nil {
+				tags = Tags{}
+			}
+			tags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+		}
+		if out.NextToken == nil {
+			return tags, nil
+		}
+		input.NextToken = out.NextToken
+	}
+}
+
+func (d dynamoClientAdapter) UpdateTable(current, expected TableDesc) error {
+	name := aws.String(expected.Name)
+
+	if current.OnDemand != expected.OnDemand || (!expected.OnDemand &&
+		(current.ProvisionedRead != expected.ProvisionedRead || current.ProvisionedWrite != expected.ProvisionedWrite)) {
+		input := &updateTableInput{TableName: name}
+		if current.OnDemand != expected.OnDemand {
+			input.BillingMode = aws.String(billingModeProvisioned)
+			if expected.OnDemand {
+				input.BillingMode = aws.String(billingModePayPerRequest)
+			}
+		}
+		if !expected.OnDemand {
+			input.ProvisionedThroughput = &dynamodb.ProvisionedThroughput{
+				ReadCapacityUnits:  aws.Int64(expected.ProvisionedRead),
+				WriteCapacityUnits: aws.Int64(expected.ProvisionedWrite),
+			}
+		}
+		if err := d.send("UpdateTable", input, &struct{}{}); err != nil {
+			return err
+		}
+	}
+
+	if !current.Tags.Equals(expected.Tags) {
+		var out describeTableOutput
+		if err := d.send("DescribeTable", &dynamodb.DescribeTableInput{TableName: name}, &out); err != nil {
+			return err
+		}
+		if out.Table == nil {
+			return fmt.Errorf("no description of table %s", expected.Name)
+		}
+		arn := out.Table.TableArn
+
+		var removed []*string
+		for key := range current.Tags {
+			if _, ok := expected.Tags[key]; !ok {
+				removed = append(removed, aws.String(key))
+			}
+		}
+		if len(removed) > 0 {
+			if err := d.send("UntagResource", &untagResourceInput{ResourceArn: arn, TagKeys: removed}, &struct{}{}); err != nil {
+				return err
+			}
+		}
+		if len(expected.Tags) > 0 {
+			if err := d.send("TagResource", &tagResourceInput{ResourceArn: arn, Tags: dynamoTags(expected.Tags)}, &struct{}{}); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Only one attribute can have TTL enabled, so the current one must be
+	// disabled before enabling another.
+	if current.TTLAttribute != expected.TTLAttribute && current.TTLAttribute != "" {
+		spec := &timeToLiveSpecification{AttributeName: aws.String(current.TTLAttribute), Enabled: aws.Bool(false)}
+		if err := d.send("UpdateTimeToLive", &updateTimeToLiveInput{TableName: name, TimeToLiveSpecification: spec}, &struct{}{}); err != nil {
+			return err
+		}
+	}
+	if current.TTLAttribute != expected.TTLAttribute && expected.TTLAttribute != "" {
+		spec := &timeToLiveSpecification{AttributeName: aws.String(expected.TTLAttribute), Enabled: aws.Bool(true)}
+		if err := d.send("UpdateTimeToLive", &updateTimeToLiveInput{TableName: name, TimeToLiveSpecification: spec}, &struct{}{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func dynamoTags(tags Tags) []*dynamoTag {
+	var result []*dynamoTag
+	for key, value := range tags {
+		result = append(result, &dynamoTag{Key: aws.String(key), Value: aws.String(value)})
+	}
+	return result
+}
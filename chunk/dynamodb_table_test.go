@@ -0,0 +1,94 @@
+package chunk
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeDynamoDB records the operations and inputs of requests, and replies
+// with canned responses.
+type fakeDynamoDB struct {
+	*httptest.Server
+	operations []string
+	inputs     []map[string]interface{}
+	responses  map[string][]string
+}
+
+func newFakeDynamoDB() *fakeDynamoDB {
+	f := &fakeDynamoDB{responses: map[string][]string{}}
+	f.Server = httptest.NewServer(f)
+	return f
+}
+
+func (f *fakeDynamoDB) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	operation := strings.TrimPrefix(r.Header.Get("X-Amz-Target"), "DynamoDB_20120810.")
+	var input map[string]interface{}
+	json.NewDecoder(r.Body).Decode(&input)
+	f.operations = append(f.operations, operation)
+	f.inputs = append(f.inputs, input)
+
+	response := "{}"
+	if responses := f.responses[operation]; len(responses) > 0 {
+		response, f.responses[operation] = responses[0], responses[1:]
+	}
+	w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+	w.Write([]byte(response))
+}
+
+func TestDynamoDBTables(t *testing.T) {
+	f := newFakeDynamoDB()
+	defer f.Close()
+	client, _, err := NewDynamoDBClient("dynamodb://user:pass@" + strings.TrimPrefix(f.URL, "http://") + "/table")
+	require.NoError(t, err)
+
+	// On-demand tables have no throughput.
+	require.NoError(t, client.CreateTable(TableDesc{Name: "table", OnDemand: true, Tags: Tags{"team": "cortex"}}))
+	assert.Equal(t, []string{"CreateTable"}, f.operations)
+	assert.Equal(t, "PAY_PER_REQUEST", f.inputs[0]["BillingMode"])
+	assert.NotContains(t, f.inputs[0], "ProvisionedThroughput")
+	assert.Equal(t, []interface{}{map[string]interface{}{"Key": "team", "Value": "cortex"}}, f.inputs[0]["Tags"])
+
+	f.operations, f.inputs = nil, nil
+	f.responses["DescribeTable"] = []string{`{"Table": {
+		"BillingModeSummary": {"BillingMode": "PROVISIONED"},
+		"ProvisionedThroughput": {"ReadCapacityUnits": 10, "WriteCapacityUnits": 20},
+		"TableArn": "arn:table", "TableStatus": "ACTIVE"}}`}
+	f.responses["ListTagsOfResource"] = []string{
+		`{"Tags": [{"Key": "team", "Value": "cortex"}], "NextToken": "next"}`,
+		`{"Tags": [{"Key": "env", "Value": "prod"}]}`,
+	}
+	f.responses["DescribeTimeToLive"] = []string{`{"TimeToLiveDescription": {"AttributeName": "expires", "TimeToLiveStatus": "ENABLED"}}`}
+	current, status, err := client.DescribeTable("table")
+	require.NoError(t, err)
+	assert.Equal(t, "ACTIVE", status)
+	assert.Equal(t, TableDesc{
+		Name:             "table",
+		ProvisionedRead:  10,
+		ProvisionedWrite: 20,
+		Tags:             Tags{"team": "cortex", "env": "prod"},
+		TTLAttribute:     "expires",
+	}, current)
+	assert.Equal(t, "next", f.inputs[2]["NextToken"])
+
+	f.operations, f.inputs = nil, nil
+	f.responses["DescribeTable"] = []string{`{"Table": {"TableArn": "arn:table", "TableStatus": "ACTIVE"}}`}
+	require.NoError(t, client.UpdateTable(current, TableDesc{
+		Name:         "table",
+		OnDemand:     true,
+		Tags:         Tags{"team": "cortex", "cost-centre": "metrics"},
+		TTLAttribute: "ttl",
+	}))
+	assert.Equal(t, []string{"UpdateTable", "DescribeTable", "UntagResource", "TagResource", "UpdateTimeToLive", "UpdateTimeToLive"}, f.operations)
+	assert.Equal(t, "PAY_PER_REQUEST", f.inputs[0]["BillingMode"])
+	assert.NotContains(t, f.inputs[0], "ProvisionedThroughput")
+	assert.Equal(t, []interface{}{"env"}, f.inputs[2]["TagKeys"])
+	assert.Equal(t, "arn:table", f.inputs[3]["ResourceArn"])
+	assert.Equal(t, map[string]interface{}{"AttributeName": "expires", "Enabled": false}, f.inputs[4]["TimeToLiveSpecification"])
+	assert.Equal(t, map[string]interface{}{"AttributeName": "ttl", "Enabled": true}, f.inputs[5]["TimeToLiveSpecification"])
+}
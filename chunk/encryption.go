@@ -0,0 +1,325 @@
+package chunk
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kms"
+
+	"github.com/weaveworks/cortex/util"
+)
+
+const (
+	// Encrypted chunks start with this, which can't be the start of an
+	// unencrypted chunk as its metadata would have to be >4MB.
+	encryptedChunkMagic = "\x00CXE1"
+
+	// dataKeyLifetime is how long a data key is used to encrypt a tenant's
+	// chunks before a new one is generated.
+	dataKeyLifetime = time.Hour
+
+	// maxCachedDataKeys bounds the number of decrypted data keys kept in memory.
+	maxCachedDataKeys = 10000
+)
+
+// EncryptionConfig configures encryption of chunks at rest.
+type EncryptionConfig struct {
+	Tenants  string
+	KeyFile  string
+	KMS      util.URLValue
+	KMSKeyID string
+
+	mockKMS KMSClient
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet
+func (cfg *EncryptionConfig) RegisterFlags(f *flag.FlagSet) {
+	f.StringVar(&cfg.Tenants, "chunk.encryption.tenants", "", "Comma-separated list of tenants whose chunks are encrypted in S3, or * for all tenants.")
+	f.StringVar(&cfg.KeyFile, "chunk.encryption.key-file", "", "File containing the hex-encoded 256-bit master key used to encrypt tenants' data keys.")
+	f.Var(&cfg.KMS, "chunk.encryption.kms.url", "KMS endpoint URL with escaped Key and Secret encoded, used to generate tenants' data keys instead of a key file.")
+	f.StringVar(&cfg.KMSKeyID, "chunk.encryption.kms.key-id", "", "ID of the KMS master key used to generate tenants' data keys.")
+}
+
+// KMSClient is a client for KMS
+type KMSClient interface {
+	GenerateDataKey(*kms.GenerateDataKeyInput) (*kms.GenerateDataKeyOutput, error)
+	Decrypt(*kms.DecryptInput) (*kms.DecryptOutput, error)
+}
+
+// keyProvider generates and decrypts per-tenant data keys.
+type keyProvider interface {
+	// generateDataKey returns a new data key for the user, and that key
+	// encrypted for storage alongside the data it encrypts.
+	generateDataKey(userID string) (key, encryptedKey []byte, err error)
+	decryptDataKey(userID string, encryptedKey []byte) ([]byte, error)
+}
+
+// encrypter does envelope encryption of chunks: each chunk is encrypted with
+// AES-GCM using a data key specific to its tenant, and stored along with the
+// data key encrypted by a master key.
+type encrypter struct {
+	all     bool
+	tenants map[string]struct{}
+	keys    keyProvider
+
+	mtx       sync.Mutex
+	dataKeys  map[string]dataKey
+	decrypted map[string][]byte
+}
+
+type dataKey struct {
+	key, encryptedKey []byte
+	created           time.Time
+}
+
+// newEncrypter returns nil if no tenants' chunks are to be encrypted.
+func newEncrypter(cfg EncryptionConfig) (*encrypter, error) {
+	if cfg.Tenants == "" {
+		return nil, nil
+	}
+
+	var keys keyProvider
+	switch {
+	case cfg.mockKMS != nil:
+		keys = &kmsKeyProvider{kms: cfg.mockKMS, keyID: cfg.KMSKeyID}
+	case cfg.KMS.URL != nil:
+		kmsConfig, err := awsConfigFromURL(cfg.KMS.URL)
+		if err != nil {
+			return nil, err
+		}
+		keys = &kmsKeyProvider{kms: kms.New(session.New(kmsConfig)), keyID: cfg.KMSKeyID}
+	case cfg.KeyFile != "":
+		buf, err := ioutil.ReadFile(cfg.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		masterKey, err := hex.DecodeString(strings.TrimSpace(string(buf)))
+		if err != nil {
+			return nil, fmt.Errorf("error decoding master key: %v", err)
+		}
+		keys, err = newFileKeyProvider(masterKey)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("chunk encryption requires a key file or KMS")
+	}
+
+	e := &encrypter{
+		tenants:   map[string]struct{}{},
+		keys:      keys,
+		dataKeys:  map[string]dataKey{},
+		decrypted: map[string][]byte{},
+	}
+	for _, tenant := range strings.Split(cfg.Tenants, ",") {
+		if tenant = strings.TrimSpace(tenant); tenant == "*" {
+			e.all = true
+		} else if tenant != "" {
+			e.tenants[tenant] = struct{}{}
+		}
+	}
+	return e, nil
+}
+
+// enabled returns true if the user's chunks should be encrypted. A nil
+// encrypter encrypts nothing.
+func (e *encrypter) enabled(userID string) bool {
+	if e == nil {
+		return false
+	}
+	_, ok := e.tenants[userID]
+	return ok || e.all
+}
+
+func isEncrypted(buf []byte) bool {
+	return bytes.HasPrefix(buf, []byte(encryptedChunkMagic))
+}
+
+// encrypt encrypts buf for the user; name is authenticated but not encrypted,
+// so that the result can't be substituted for any other object.
+func (e *encrypter) encrypt(userID, name string, buf []byte) ([]byte, error) {
+	key, err := e.currentDataKey(userID)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(key.key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	var out bytes.Buffer
+	out.WriteString(encryptedChunkMagic)
+	binary.Write(&out, binary.BigEndian, uint32(len(key.encryptedKey)))
+	out.Write(key.encryptedKey)
+	out.Write(nonce)
+	out.Write(aead.Seal(nil, nonce, buf, []byte(name)))
+	return out.Bytes(), nil
+}
+
+func (e *encrypter) decrypt(userID, name string, buf []byte) ([]byte, error) {
+	if !isEncrypted(buf) {
+		return nil, fmt.Errorf("chunk is not encrypted")
+	}
+	buf = buf[len(encryptedChunkMagic):]
+	if len(buf) < 4 {
+		return nil, fmt.Errorf("encrypted chunk too short")
+	}
+	keyLen := binary.BigEndian.Uint32(buf)
+	buf = buf[4:]
+	if uint32(len(buf)) < keyLen {
+		return nil, fmt.Errorf("encrypted chunk too short")
+	}
+	encryptedKey, buf := buf[:keyLen], buf[keyLen:]
+
+	key, err := e.dataKey(userID, encryptedKey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) < aead.NonceSize() {
+		return nil, fmt.Errorf("encrypted chunk too short")
+	}
+	return aead.Open(nil, buf[:aead.NonceSize()], buf[aead.NonceSize():], []byte(name))
+}
+
+func (e *encrypter) currentDataKey(userID string) (dataKey, error) {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+
+	if key, ok := e.dataKeys[userID]; ok && time.Since(key.created) < dataKeyLifetime {
+		return key, nil
+	}
+	plaintext, encryptedKey, err := e.keys.generateDataKey(userID)
+	if err != nil {
+		return dataKey{}, err
+	}
+	key := dataKey{
+		key:          plaintext,
+		encryptedKey: encryptedKey,
+		created:      time.Now(),
+	}
+	e.dataKeys[userID] = key
+	return key, nil
+}
+
+func (e *encrypter) dataKey(userID string, encryptedKey []byte) ([]byte, error) {
+	cacheKey := userID + "/" + string(encryptedKey)
+	e.mtx.Lock()
+	key, ok := e.decrypted[cacheKey]
+	e.mtx.Unlock()
+	if ok {
+		return key, nil
+	}
+
+	key, err := e.keys.decryptDataKey(userID, encryptedKey)
+	if err != nil {
+		return nil, err
+	}
+
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	if len(e.decrypted) >= maxCachedDataKeys {
+		e.decrypted = map[string][]byte{}
+	}
+	e.decrypted[cacheKey] = key
+	return key, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// kmsKeyProvider generates data keys with KMS. Each is bound to its tenant
+// using the encryption context, so can only be decrypted for that tenant.
+type kmsKeyProvider struct {
+	kms   KMSClient
+	keyID string
+}
+
+func kmsEncryptionContext(userID string) map[string]*string {
+	return map[string]*string{"tenant": aws.String(userID)}
+}
+
+func (p *kmsKeyProvider) generateDataKey(userID string) ([]byte, []byte, error) {
+	resp, err := p.kms.GenerateDataKey(&kms.GenerateDataKeyInput{
+		KeyId:             aws.String(p.keyID),
+		KeySpec:           aws.String("AES_256"),
+		EncryptionContext: kmsEncryptionContext(userID),
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return resp.Plaintext, resp.CiphertextBlob, nil
+}
+
+func (p *kmsKeyProvider) decryptDataKey(userID string, encryptedKey []byte) ([]byte, error) {
+	resp, err := p.kms.Decrypt(&kms.DecryptInput{
+		CiphertextBlob:    encryptedKey,
+		EncryptionContext: kmsEncryptionContext(userID),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Plaintext, nil
+}
+
+// fileKeyProvider generates random data keys, encrypted by a master key with
+// the tenant as additional data.
+type fileKeyProvider struct {
+	master cipher.AEAD
+}
+
+func newFileKeyProvider(masterKey []byte) (*fileKeyProvider, error) {
+	if len(masterKey) != 32 {
+		return nil, fmt.Errorf("master key must be 256 bits, got %d", len(masterKey)*8)
+	}
+	master, err := newAEAD(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	return &fileKeyProvider{master: master}, nil
+}
+
+func (p *fileKeyProvider) generateDataKey(userID string) ([]byte, []byte, error) {
+	key := make([]byte, 32)
+	nonce := make([]byte, p.master.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, nil, err
+	}
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, nil, err
+	}
+	return key, p.master.Seal(nonce, nonce, key, []byte(userID)), nil
+}
+
+func (p *fileKeyProvider) decryptDataKey(userID string, encryptedKey []byte) ([]byte, error) {
+	if len(encryptedKey) < p.master.NonceSize() {
+		return nil, fmt.Errorf("encrypted data key too short")
+	}
+	nonceSize := p.master.NonceSize()
+	return p.master.Open(nil, encryptedKey[:nonceSize], encryptedKey[nonceSize:], []byte(userID))
+}
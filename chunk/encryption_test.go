@@ -0,0 +1,178 @@
+package chunk
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/local/chunk"
+	"github.com/prometheus/prometheus/storage/metric"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/test"
+	"github.com/weaveworks/common/user"
+)
+
+type mockKMS struct {
+	mtx  sync.Mutex
+	keys map[string]mockKMSKey
+}
+
+type mockKMSKey struct {
+	key    []byte
+	tenant string
+}
+
+func newMockKMS() *mockKMS {
+	return &mockKMS{keys: map[string]mockKMSKey{}}
+}
+
+func (m *mockKMS) GenerateDataKey(input *kms.GenerateDataKeyInput) (*kms.GenerateDataKeyOutput, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	ciphertext := fmt.Sprintf("%s/%d", aws.StringValue(input.KeyId), len(m.keys))
+	m.keys[ciphertext] = mockKMSKey{key, aws.StringValue(input.EncryptionContext["tenant"])}
+	return &kms.GenerateDataKeyOutput{
+		Plaintext:      key,
+		CiphertextBlob: []byte(ciphertext),
+	}, nil
+}
+
+func (m *mockKMS) Decrypt(input *kms.DecryptInput) (*kms.DecryptOutput, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	key, ok := m.keys[string(input.CiphertextBlob)]
+	if !ok || key.tenant != aws.StringValue(input.EncryptionContext["tenant"]) {
+		return nil, fmt.Errorf("invalid ciphertext")
+	}
+	return &kms.DecryptOutput{Plaintext: key.key}, nil
+}
+
+func TestEncrypter(t *testing.T) {
+	masterKey := make([]byte, 32)
+	_, err := rand.Read(masterKey)
+	require.NoError(t, err)
+	fileKeys, err := newFileKeyProvider(masterKey)
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		name string
+		keys keyProvider
+	}{
+		{"file", fileKeys},
+		{"kms", &kmsKeyProvider{kms: newMockKMS(), keyID: "key"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			e := &encrypter{
+				keys:      tc.keys,
+				dataKeys:  map[string]dataKey{},
+				decrypted: map[string][]byte{},
+			}
+			plaintext := []byte("hello world")
+
+			ciphertext, err := e.encrypt("user", "user/chunk", plaintext)
+			require.NoError(t, err)
+			assert.True(t, isEncrypted(ciphertext))
+			assert.False(t, isEncrypted(plaintext))
+
+			result, err := e.decrypt("user", "user/chunk", ciphertext)
+			require.NoError(t, err)
+			assert.Equal(t, plaintext, result)
+
+			// Ciphertexts can't be moved to other chunks or other users.
+			_, err = e.decrypt("user", "user/other", ciphertext)
+			assert.Error(t, err)
+			_, err = e.decrypt("other", "user/chunk", ciphertext)
+			assert.Error(t, err)
+
+			// Data keys are reused until they expire.
+			key1, err := e.currentDataKey("user")
+			require.NoError(t, err)
+			key2, err := e.currentDataKey("user")
+			require.NoError(t, err)
+			assert.Equal(t, key1, key2)
+			e.dataKeys["user"] = dataKey{created: time.Now().Add(-2 * dataKeyLifetime)}
+			key3, err := e.currentDataKey("user")
+			require.NoError(t, err)
+			assert.NotEqual(t, key1.key, key3.key)
+		})
+	}
+}
+
+func TestChunkStoreEncryption(t *testing.T) {
+	now := model.Now()
+	chunks, _ := chunk.New().Add(model.SamplePair{Timestamp: now, Value: 0})
+	c := NewChunk(
+		model.Fingerprint(1),
+		model.Metric{model.MetricNameLabel: "foo"},
+		chunks[0],
+		now.Add(-time.Hour),
+		now,
+	)
+	matcher := mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo")
+
+	dynamoDB := NewMockStorage()
+	setupDynamodb(t, dynamoDB)
+	s3Client := NewMockS3()
+	newStore := func(cfg EncryptionConfig) *Store {
+		store, err := NewStore(StoreConfig{
+			EncryptionConfig: cfg,
+			mockDynamoDB:     dynamoDB,
+			mockS3:           s3Client,
+			schemaFactory:    v5Schema,
+		})
+		require.NoError(t, err)
+		return store
+	}
+	store := newStore(EncryptionConfig{
+		Tenants: "encrypted",
+		mockKMS: newMockKMS(),
+	})
+
+	for _, tc := range []struct {
+		userID    string
+		encrypted bool
+	}{
+		{"encrypted", true},
+		{"plain", false},
+	} {
+		t.Run(tc.userID, func(t *testing.T) {
+			ctx := user.Inject(context.Background(), tc.userID)
+			require.NoError(t, store.Put(ctx, []Chunk{c}))
+
+			resp, err := s3Client.GetObject(&s3.GetObjectInput{
+				Bucket: aws.String(""),
+				Key:    aws.String(chunkName(tc.userID, c.ID)),
+			})
+			require.NoError(t, err)
+			buf, err := ioutil.ReadAll(resp.Body)
+			require.NoError(t, err)
+			assert.Equal(t, tc.encrypted, isEncrypted(buf))
+
+			result, err := store.Get(ctx, now.Add(-time.Hour), now, matcher)
+			require.NoError(t, err)
+			if !reflect.DeepEqual([]Chunk{c}, result) {
+				t.Fatalf("wrong chunks - %s", test.Diff([]Chunk{c}, result))
+			}
+
+			// Stores without encryption configured can't read encrypted chunks.
+			_, err = newStore(EncryptionConfig{}).Get(ctx, now.Add(-time.Hour), now, matcher)
+			assert.Equal(t, tc.encrypted, err != nil)
+		})
+	}
+}
@@ -0,0 +1,165 @@
+package chunk
+
+import (
+	"container/list"
+	"flag"
+	"sync"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	cacheTierRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cortex",
+		Name:      "cache_tier_requests_total",
+		Help:      "Total count of keys requested from each tier of the cache.",
+	}, []string{"tier"})
+
+	cacheTierHits = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cortex",
+		Name:      "cache_tier_hits_total",
+		Help:      "Total count of keys found in each tier of the cache.",
+	}, []string{"tier"})
+)
+
+func init() {
+	prometheus.MustRegister(cacheTierRequests)
+	prometheus.MustRegister(cacheTierHits)
+}
+
+// FifoCacheConfig defines how a FifoCache should be constructed.
+type FifoCacheConfig struct {
+	Size     int
+	Validity time.Duration
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet
+func (cfg *FifoCacheConfig) RegisterFlags(f *flag.FlagSet) {
+	f.IntVar(&cfg.Size, "fifocache.size", 0, "Number of chunks and index entries to cache in process, in front of memcached or Redis. 0 to disable.")
+	f.DurationVar(&cfg.Validity, "fifocache.duration", time.Minute, "How long entries stay in the in-process cache.")
+}
+
+// FifoCache is a Memcache in process, holding a fixed number of keys and
+// evicting the one set longest ago.
+type FifoCache struct {
+	cfg FifoCacheConfig
+
+	mtx     sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List // Of *fifoEntry, oldest first.
+}
+
+type fifoEntry struct {
+	key     string
+	value   []byte
+	expires time.Time
+}
+
+// NewFifoCache makes a new FifoCache.
+func NewFifoCache(cfg FifoCacheConfig) *FifoCache {
+	return &FifoCache{
+		cfg:     cfg,
+		entries: map[string]*list.Element{},
+		order:   list.New(),
+	}
+}
+
+// GetMulti implements Memcache.
+func (c *FifoCache) GetMulti(keys []string) (map[string]*memcache.Item, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	now := time.Now()
+	items := make(map[string]*memcache.Item, len(keys))
+	for _, key := range keys {
+		element, ok := c.entries[key]
+		if !ok {
+			continue
+		}
+		entry := element.Value.(*fifoEntry)
+		if now.After(entry.expires) {
+			c.order.Remove(element)
+			delete(c.entries, key)
+			continue
+		}
+		items[key] = &memcache.Item{Key: key, Value: entry.value}
+	}
+	return items, nil
+}
+
+// Set implements Memcache. Entries live for the configured validity,
+// regardless of the item's expiration.
+func (c *FifoCache) Set(item *memcache.Item) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if element, ok := c.entries[item.Key]; ok {
+		c.order.Remove(element)
+	}
+	c.entries[item.Key] = c.order.PushBack(&fifoEntry{
+		key:     item.Key,
+		value:   item.Value,
+		expires: time.Now().Add(c.cfg.Validity),
+	})
+	for c.order.Len() > c.cfg.Size {
+		oldest := c.order.Remove(c.order.Front()).(*fifoEntry)
+		delete(c.entries, oldest.key)
+	}
+	return nil
+}
+
+// cacheTier is a named Memcache in a tieredCache.
+type cacheTier struct {
+	name     string
+	memcache Memcache
+}
+
+// tieredCache is a Memcache looking keys up in each tier in turn, fastest
+// first, and copying those found into the tiers which missed them.
+type tieredCache struct {
+	tiers      []cacheTier
+	expiration int32
+}
+
+func (c *tieredCache) GetMulti(keys []string) (map[string]*memcache.Item, error) {
+	found := make(map[string]*memcache.Item, len(keys))
+	for i, tier := range c.tiers {
+		cacheTierRequests.WithLabelValues(tier.name).Add(float64(len(keys)))
+		items, err := tier.memcache.GetMulti(keys)
+		if err != nil {
+			return found, err
+		}
+		cacheTierHits.WithLabelValues(tier.name).Add(float64(len(items)))
+
+		missing := keys[:0:0]
+		for _, key := range keys {
+			item, ok := items[key]
+			if !ok {
+				missing = append(missing, key)
+				continue
+			}
+			found[key] = item
+			for _, upper := range c.tiers[:i] {
+				if err := upper.memcache.Set(&memcache.Item{Key: key, Value: item.Value, Expiration: c.expiration}); err != nil {
+					return found, err
+				}
+			}
+		}
+		if len(missing) == 0 {
+			break
+		}
+		keys = missing
+	}
+	return found, nil
+}
+
+func (c *tieredCache) Set(item *memcache.Item) error {
+	for _, tier := range c.tiers {
+		if err := tier.memcache.Set(item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
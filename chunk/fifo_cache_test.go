@@ -0,0 +1,62 @@
+package chunk
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFifoCache(t *testing.T) {
+	c := NewFifoCache(FifoCacheConfig{Size: 3, Validity: time.Minute})
+	for i := 0; i < 4; i++ {
+		require.NoError(t, c.Set(&memcache.Item{Key: fmt.Sprintf("key%d", i), Value: []byte{byte(i)}}))
+	}
+
+	// The first key set was evicted.
+	items, err := c.GetMulti([]string{"key0", "key1", "key3"})
+	require.NoError(t, err)
+	assert.Len(t, items, 2)
+	assert.Equal(t, []byte{3}, items["key3"].Value)
+
+	// Setting a key again makes it the newest.
+	require.NoError(t, c.Set(&memcache.Item{Key: "key1", Value: []byte{1}}))
+	require.NoError(t, c.Set(&memcache.Item{Key: "key4", Value: []byte{4}}))
+	items, err = c.GetMulti([]string{"key1", "key2"})
+	require.NoError(t, err)
+	assert.Len(t, items, 1)
+	assert.Contains(t, items, "key1")
+
+	// Expired entries are misses.
+	c = NewFifoCache(FifoCacheConfig{Size: 3, Validity: -time.Second})
+	require.NoError(t, c.Set(&memcache.Item{Key: "key", Value: []byte{1}}))
+	items, err = c.GetMulti([]string{"key"})
+	require.NoError(t, err)
+	assert.Empty(t, items)
+	assert.Empty(t, c.entries)
+}
+
+func TestTieredCache(t *testing.T) {
+	fifo := NewFifoCache(FifoCacheConfig{Size: 10, Validity: time.Minute})
+	remote := newMockMemcache()
+	c := &tieredCache{tiers: []cacheTier{{"fifo", fifo}, {"remote", remote}}}
+
+	require.NoError(t, c.Set(&memcache.Item{Key: "both", Value: []byte("both")}))
+	assert.Equal(t, []byte("both"), remote.contents["both"])
+	remote.contents["remote"] = []byte("remote")
+
+	items, err := c.GetMulti([]string{"both", "remote", "missing"})
+	require.NoError(t, err)
+	require.Len(t, items, 2)
+	assert.Equal(t, "both", string(items["both"].Value))
+	assert.Equal(t, "remote", string(items["remote"].Value))
+
+	// Keys found in the remote tier are copied to the FIFO tier.
+	delete(remote.contents, "remote")
+	items, err = c.GetMulti([]string{"remote"})
+	require.NoError(t, err)
+	assert.Equal(t, "remote", string(items["remote"].Value))
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net"
 	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -13,12 +14,15 @@ import (
 )
 
 // MemcacheClient is a memcache client that gets its server list from SRV
-// records, and periodically updates that ServerList.
+// records, or by resolving a list of addresses, and periodically updates that
+// ServerList.
 type MemcacheClient struct {
 	*memcache.Client
-	serverList *memcache.ServerList
+	serverList memcacheServerList
 	hostname   string
 	service    string
+	addresses  []string
+	servers    []string
 
 	quit chan struct{}
 	wait sync.WaitGroup
@@ -28,32 +32,50 @@ type MemcacheClient struct {
 type MemcacheConfig struct {
 	Host           string
 	Service        string
+	Addresses      string
+	ConsistentHash bool
 	Timeout        time.Duration
 	UpdateInterval time.Duration
 }
 
+// memcacheServerList is a memcache.ServerSelector whose servers can be
+// changed.
+type memcacheServerList interface {
+	memcache.ServerSelector
+	SetServers(servers ...string) error
+}
+
 // RegisterFlags adds the flags required to config this to the given FlagSet
 func (cfg *MemcacheConfig) RegisterFlags(f *flag.FlagSet) {
 	f.StringVar(&cfg.Host, "memcached.hostname", "", "Hostname for memcached service to use when caching chunks. If empty, no memcached will be used.")
 	f.StringVar(&cfg.Service, "memcached.service", "memcached", "SRV service used to discover memcache servers.")
+	f.StringVar(&cfg.Addresses, "memcached.addresses", "", "Comma separated host:port addresses of memcached servers to use instead of SRV records. Each host is resolved to all its addresses in DNS.")
+	f.BoolVar(&cfg.ConsistentHash, "memcached.consistent-hash", true, "Spread keys over memcached servers by consistent hashing, so changing the servers only moves the keys of those added or removed.")
 	f.DurationVar(&cfg.Timeout, "memcached.timeout", 100*time.Millisecond, "Maximum time to wait before giving up on memcached requests.")
 	f.DurationVar(&cfg.UpdateInterval, "memcached.update-interval", 1*time.Minute, "Period with which to poll DNS for memcache servers.")
 }
 
 // NewMemcacheClient creates a new MemcacheClient that gets its server list
-// from SRV and updates the server list on a regular basis.
+// from SRV or the configured addresses, and updates the server list on a
+// regular basis.
 func NewMemcacheClient(cfg MemcacheConfig) *MemcacheClient {
-	var servers memcache.ServerList
-	client := memcache.NewFromSelector(&servers)
+	var servers memcacheServerList = &memcache.ServerList{}
+	if cfg.ConsistentHash {
+		servers = &memcacheRing{}
+	}
+	client := memcache.NewFromSelector(servers)
 	client.Timeout = cfg.Timeout
 
 	newClient := &MemcacheClient{
 		Client:     client,
-		serverList: &servers,
+		serverList: servers,
 		hostname:   cfg.Host,
 		service:    cfg.Service,
 		quit:       make(chan struct{}),
 	}
+	if cfg.Addresses != "" {
+		newClient.addresses = strings.Split(cfg.Addresses, ",")
+	}
 	err := newClient.updateMemcacheServers()
 	if err != nil {
 		log.Errorf("Error setting memcache servers to '%v': %v", cfg.Host, err)
@@ -83,24 +105,63 @@ func (c *MemcacheClient) updateLoop(updateInterval time.Duration) error {
 			}
 		case <-c.quit:
 			ticker.Stop()
+			return nil
 		}
 	}
 }
 
-// updateMemcacheServers sets a memcache server list from SRV records. SRV
-// priority & weight are ignored.
+// updateMemcacheServers sets a memcache server list from SRV records, or by
+// resolving the configured addresses. SRV priority & weight are ignored.
 func (c *MemcacheClient) updateMemcacheServers() error {
-	_, addrs, err := net.LookupSRV(c.service, "tcp", c.hostname)
-	if err != nil {
-		return err
-	}
 	var servers []string
-	for _, srv := range addrs {
-		servers = append(servers, fmt.Sprintf("%s:%d", srv.Target, srv.Port))
+	if len(c.addresses) > 0 {
+		for _, address := range c.addresses {
+			host, port, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ips, err := net.LookupHost(host)
+			if err != nil {
+				return err
+			}
+			for _, ip := range ips {
+				servers = append(servers, net.JoinHostPort(ip, port))
+			}
+		}
+	} else {
+		_, addrs, err := net.LookupSRV(c.service, "tcp", c.hostname)
+		if err != nil {
+			return err
+		}
+		for _, srv := range addrs {
+			servers = append(servers, fmt.Sprintf("%s:%d", srv.Target, srv.Port))
+		}
 	}
 	// ServerList deterministically maps keys to _index_ of the server list.
 	// Since DNS returns records in different order each time, we sort to
 	// guarantee best possible match between nodes.
 	sort.Strings(servers)
-	return c.serverList.SetServers(servers...)
+	if stringSlicesEqual(servers, c.servers) {
+		return nil
+	}
+	if err := c.serverList.SetServers(servers...); err != nil {
+		return err
+	}
+	if c.servers != nil {
+		log.Infof("Memcache servers changed from %v to %v", c.servers, servers)
+	}
+	c.servers = servers
+	return nil
+}
+
+func stringSlicesEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
 }
@@ -0,0 +1,97 @@
+package chunk
+
+import (
+	"hash/crc32"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+// The number of points each server has on the ring, to spread keys evenly.
+const memcacheRingPoints = 160
+
+// memcacheRing is a memcache.ServerSelector placing servers at many points on
+// a hash ring, and picking the server at the first point after a key's hash.
+// Unlike memcache.ServerList, changing the servers only moves the keys of the
+// servers added or removed.
+type memcacheRing struct {
+	mtx    sync.RWMutex
+	addrs  []net.Addr
+	points []uint32
+	owners map[uint32]net.Addr
+}
+
+// SetServers changes the servers on the ring. If any fail to resolve, the
+// ring is left unchanged.
+func (r *memcacheRing) SetServers(servers ...string) error {
+	addrs := make([]net.Addr, 0, len(servers))
+	for _, server := range servers {
+		var addr net.Addr
+		var err error
+		if strings.Contains(server, "/") {
+			addr, err = net.ResolveUnixAddr("unix", server)
+		} else {
+			addr, err = net.ResolveTCPAddr("tcp", server)
+		}
+		if err != nil {
+			return err
+		}
+		addrs = append(addrs, addr)
+	}
+
+	points := make([]uint32, 0, len(servers)*memcacheRingPoints)
+	owners := make(map[uint32]net.Addr, len(servers)*memcacheRingPoints)
+	for i, server := range servers {
+		for j := 0; j < memcacheRingPoints; j++ {
+			point := crc32.ChecksumIEEE([]byte(server + "-" + strconv.Itoa(j)))
+			if _, ok := owners[point]; ok {
+				continue
+			}
+			owners[point] = addrs[i]
+			points = append(points, point)
+		}
+	}
+	sort.Sort(uint32s(points))
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.addrs, r.points, r.owners = addrs, points, owners
+	return nil
+}
+
+// PickServer implements memcache.ServerSelector.
+func (r *memcacheRing) PickServer(key string) (net.Addr, error) {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	if len(r.points) == 0 {
+		return nil, memcache.ErrNoServers
+	}
+	hash := crc32.ChecksumIEEE([]byte(key))
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= hash })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.owners[r.points[i]], nil
+}
+
+// Each implements memcache.ServerSelector.
+func (r *memcacheRing) Each(f func(net.Addr) error) error {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	for _, addr := range r.addrs {
+		if err := f(addr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type uint32s []uint32
+
+func (x uint32s) Len() int           { return len(x) }
+func (x uint32s) Less(i, j int) bool { return x[i] < x[j] }
+func (x uint32s) Swap(i, j int)      { x[i], x[j] = x[j], x[i] }
@@ -0,0 +1,77 @@
+package chunk
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func pickServers(t *testing.T, selector memcache.ServerSelector, keys []string) map[string]net.Addr {
+	picked := map[string]net.Addr{}
+	for _, key := range keys {
+		addr, err := selector.PickServer(key)
+		require.NoError(t, err)
+		picked[key] = addr
+	}
+	return picked
+}
+
+func TestMemcacheRing(t *testing.T) {
+	var ring memcacheRing
+	_, err := ring.PickServer("key")
+	assert.Equal(t, memcache.ErrNoServers, err)
+
+	var keys []string
+	for i := 0; i < 10000; i++ {
+		keys = append(keys, fmt.Sprintf("key%d", i))
+	}
+	servers := []string{"10.0.0.1:11211", "10.0.0.2:11211", "10.0.0.3:11211", "10.0.0.4:11211"}
+	require.NoError(t, ring.SetServers(servers...))
+	before := pickServers(t, &ring, keys)
+
+	// Keys are spread fairly evenly.
+	counts := map[string]int{}
+	for _, addr := range before {
+		counts[addr.String()]++
+	}
+	require.Len(t, counts, len(servers))
+	for server, count := range counts {
+		assert.InDelta(t, len(keys)/len(servers), count, float64(len(keys))/10, server)
+	}
+
+	// Adding a server only moves keys to it.
+	require.NoError(t, ring.SetServers(append(servers, "10.0.0.5:11211")...))
+	after := pickServers(t, &ring, keys)
+	moved := 0
+	for _, key := range keys {
+		if before[key].String() != after[key].String() {
+			assert.Equal(t, "10.0.0.5:11211", after[key].String())
+			moved++
+		}
+	}
+	assert.InDelta(t, len(keys)/5, moved, float64(len(keys))/10)
+
+	// Servers which don't resolve leave the ring unchanged.
+	assert.Error(t, ring.SetServers("10.0.0.1:11211", "nonsense"))
+	var each []string
+	require.NoError(t, ring.Each(func(addr net.Addr) error {
+		each = append(each, addr.String())
+		return nil
+	}))
+	assert.Len(t, each, 5)
+}
+
+func TestMemcacheClientAddresses(t *testing.T) {
+	client := NewMemcacheClient(MemcacheConfig{
+		Addresses:      "127.0.0.1:11211,127.0.0.2:11212",
+		ConsistentHash: true,
+		UpdateInterval: time.Hour,
+	})
+	defer client.Stop()
+	assert.Equal(t, []string{"127.0.0.1:11211", "127.0.0.2:11212"}, client.servers)
+}
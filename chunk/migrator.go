@@ -0,0 +1,359 @@
+package chunk
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex/util"
+)
+
+// The maximum number of chunks written to the destination store at once.
+const migrationBatchSize = 100
+
+var migratedChunks = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: "cortex",
+	Name:      "migrator_chunks_total",
+	Help:      "The total number of chunks copied to the destination store.",
+})
+
+func init() {
+	prometheus.MustRegister(migratedChunks)
+}
+
+// MigratorConfig configures copying chunks, and their index entries, from one
+// chunk store to another. The destination store uses the same schema, caching
+// and encryption as the source.
+type MigratorConfig struct {
+	S3       util.URLValue
+	DynamoDB util.URLValue
+
+	Tenants     string
+	MetricNames string
+	From        util.DayValue
+	Through     util.DayValue
+
+	Concurrency    int
+	CheckpointFile string
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet
+func (cfg *MigratorConfig) RegisterFlags(f *flag.FlagSet) {
+	f.Var(&cfg.S3, "migrator.s3.url", "S3 endpoint URL of the chunk store to copy chunks to.")
+	f.Var(&cfg.DynamoDB, "migrator.dynamodb.url", "DynamoDB endpoint URL of the chunk store to copy chunks to.")
+	f.StringVar(&cfg.Tenants, "migrator.tenants", "", "Comma-separated list of tenants whose chunks are copied.")
+	f.StringVar(&cfg.MetricNames, "migrator.metric-names", "", "Comma-separated list of the metric names whose chunks are copied.")
+	f.Var(&cfg.From, "migrator.from", "The first day (YYYY-MM-DD) to copy chunks from.")
+	f.Var(&cfg.Through, "migrator.through", "The day (YYYY-MM-DD) to copy chunks up to, exclusive. Defaults to now.")
+	f.IntVar(&cfg.Concurrency, "migrator.concurrency", 10, "Number of tenant, metric name and day combinations copied concurrently.")
+	f.StringVar(&cfg.CheckpointFile, "migrator.checkpoint-file", "", "File recording the tenant, metric name and day combinations already copied, so a restarted migration skips them.")
+}
+
+// DestinationStoreConfig returns the config for the store chunks are copied
+// to, based on that of the store they're copied from.
+func (cfg *MigratorConfig) DestinationStoreConfig(source StoreConfig) StoreConfig {
+	destination := source
+	destination.S3 = cfg.S3
+	destination.DynamoDB = cfg.DynamoDB
+	return destination
+}
+
+// MigrationSource is the store chunks are copied from.
+type MigrationSource interface {
+	Get(ctx context.Context, from, through model.Time, matchers ...*metric.LabelMatcher) ([]Chunk, error)
+}
+
+// MigrationDestination is the store chunks are copied to.
+type MigrationDestination interface {
+	Put(ctx context.Context, chunks []Chunk) error
+}
+
+// MigrationProgress is how far through its work a Migrator is.
+type MigrationProgress struct {
+	Units          int  `json:"units"`
+	CompletedUnits int  `json:"completedUnits"`
+	SkippedUnits   int  `json:"skippedUnits"`
+	FailedUnits    int  `json:"failedUnits"`
+	Chunks         int  `json:"chunks"`
+	Done           bool `json:"done"`
+}
+
+// migrationUnit is the chunks of one metric of a tenant, for one day.
+type migrationUnit struct {
+	userID     string
+	metricName string
+	from       model.Time
+	through    model.Time
+}
+
+func (u migrationUnit) key() string {
+	return fmt.Sprintf("%s/%s/%d", u.userID, u.metricName, u.from.Unix())
+}
+
+// Migrator copies chunks from one store to another, a day of a tenant's metric
+// at a time, recording those it has finished in a checkpoint file.
+type Migrator struct {
+	cfg         MigratorConfig
+	source      MigrationSource
+	destination MigrationDestination
+	quit        chan struct{}
+	wait        sync.WaitGroup
+
+	mtx       sync.Mutex
+	completed map[string]struct{}
+	progress  MigrationProgress
+}
+
+// NewMigrator makes a new Migrator, reading the checkpoint file if it exists.
+func NewMigrator(cfg MigratorConfig, source MigrationSource, destination MigrationDestination) (*Migrator, error) {
+	if !cfg.From.IsSet() {
+		return nil, fmt.Errorf("the day to migrate from must be set")
+	}
+	if cfg.Concurrency < 1 {
+		cfg.Concurrency = 1
+	}
+	m := &Migrator{
+		cfg:         cfg,
+		source:      source,
+		destination: destination,
+		quit:        make(chan struct{}),
+		completed:   map[string]struct{}{},
+	}
+	if cfg.CheckpointFile != "" {
+		completed, err := readCheckpointFile(cfg.CheckpointFile)
+		if err != nil {
+			return nil, err
+		}
+		m.completed = completed
+	}
+	return m, nil
+}
+
+// Start the Migrator.
+func (m *Migrator) Start() {
+	m.wait.Add(1)
+	go m.run()
+}
+
+// Stop the Migrator, waiting for the units being copied to finish.
+func (m *Migrator) Stop() {
+	close(m.quit)
+	m.wait.Wait()
+}
+
+// Progress returns how far through the migration the Migrator is.
+func (m *Migrator) Progress() MigrationProgress {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	return m.progress
+}
+
+// ServeHTTP serves the Migrator's progress as JSON.
+func (m *Migrator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(m.Progress()); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (m *Migrator) units() []migrationUnit {
+	through := m.cfg.Through.Time
+	if !m.cfg.Through.IsSet() {
+		through = model.Now()
+	}
+	var units []migrationUnit
+	for _, userID := range splitList(m.cfg.Tenants) {
+		for _, metricName := range splitList(m.cfg.MetricNames) {
+			for from := m.cfg.From.Time; from.Before(through); from = from.Add(24 * time.Hour) {
+				units = append(units, migrationUnit{
+					userID:     userID,
+					metricName: metricName,
+					from:       from,
+					through:    from.Add(24 * time.Hour),
+				})
+			}
+		}
+	}
+	return units
+}
+
+func splitList(s string) []string {
+	var result []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+func (m *Migrator) run() {
+	defer m.wait.Done()
+
+	units := m.units()
+	m.mtx.Lock()
+	m.progress.Units = len(units)
+	m.mtx.Unlock()
+
+	stopped := false
+	work := make(chan migrationUnit)
+	var workers sync.WaitGroup
+	for i := 0; i < m.cfg.Concurrency; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for unit := range work {
+				m.migrate(unit)
+			}
+		}()
+	}
+
+loop:
+	for _, unit := range units {
+		m.mtx.Lock()
+		_, ok := m.completed[unit.key()]
+		if ok {
+			m.progress.SkippedUnits++
+		}
+		m.mtx.Unlock()
+		if ok {
+			continue
+		}
+
+		select {
+		case work <- unit:
+		case <-m.quit:
+			stopped = true
+			break loop
+		}
+	}
+	close(work)
+	workers.Wait()
+
+	if stopped {
+		return
+	}
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.progress.Done = true
+	log.Infof("Migration finished: %+v", m.progress)
+}
+
+// migrate copies the chunks of one unit, recording it in the checkpoint file
+// if successful.
+func (m *Migrator) migrate(unit migrationUnit) {
+	chunks, err := m.copy(unit)
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.progress.Chunks += chunks
+	if err != nil {
+		log.Errorf("Error migrating chunks for %s: %v", unit.key(), err)
+		m.progress.FailedUnits++
+		return
+	}
+	m.progress.CompletedUnits++
+	m.completed[unit.key()] = struct{}{}
+	if err := m.writeCheckpoint(); err != nil {
+		log.Errorf("Error writing migration checkpoint: %v", err)
+	}
+}
+
+// copy returns the number of chunks copied.
+func (m *Migrator) copy(unit migrationUnit) (int, error) {
+	ctx := user.Inject(context.Background(), unit.userID)
+	matcher, err := metric.NewLabelMatcher(metric.Equal, model.MetricNameLabel, model.LabelValue(unit.metricName))
+	if err != nil {
+		return 0, err
+	}
+	chunks, err := m.source.Get(ctx, unit.from, unit.through-1, matcher)
+	if err != nil {
+		return 0, err
+	}
+
+	// Chunks spanning several days are found for each of them, so are only
+	// copied with the day they start in, or the first day.
+	filtered := make([]Chunk, 0, len(chunks))
+	for _, chunk := range chunks {
+		if chunk.From >= unit.from || unit.from == m.cfg.From.Time {
+			filtered = append(filtered, chunk)
+		}
+	}
+
+	copied := 0
+	for len(filtered) > 0 {
+		batch := filtered
+		if len(batch) > migrationBatchSize {
+			batch = batch[:migrationBatchSize]
+		}
+		if err := m.destination.Put(ctx, batch); err != nil {
+			return copied, err
+		}
+		migratedChunks.Add(float64(len(batch)))
+		copied += len(batch)
+		filtered = filtered[len(batch):]
+	}
+	return copied, nil
+}
+
+// writeCheckpoint atomically replaces the checkpoint file. The caller must
+// hold m.mtx.
+func (m *Migrator) writeCheckpoint() error {
+	if m.cfg.CheckpointFile == "" {
+		return nil
+	}
+	return writeCheckpointFile(m.cfg.CheckpointFile, m.completed)
+}
+
+// readCheckpointFile returns the keys of the units of work recorded as
+// completed in a checkpoint file, if it exists.
+func readCheckpointFile(filename string) (map[string]struct{}, error) {
+	completed := map[string]struct{}{}
+	buf, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return completed, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var keys []string
+	if err := json.Unmarshal(buf, &keys); err != nil {
+		return nil, fmt.Errorf("error parsing checkpoint file %s: %v", filename, err)
+	}
+	for _, key := range keys {
+		completed[key] = struct{}{}
+	}
+	return completed, nil
+}
+
+// writeCheckpointFile atomically replaces a checkpoint file with the keys of
+// the completed units of work.
+func writeCheckpointFile(filename string, completed map[string]struct{}) error {
+	keys := make([]string, 0, len(completed))
+	for key := range completed {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	buf, err := json.Marshal(keys)
+	if err != nil {
+		return err
+	}
+	tmp := filename + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
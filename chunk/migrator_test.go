@@ -0,0 +1,113 @@
+package chunk
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex/util"
+)
+
+// migrationStore has one chunk per user, metric and hour, and records the
+// chunks put to it.
+type migrationStore struct {
+	mtx  sync.Mutex
+	puts map[string]int
+	fail bool
+}
+
+func (s *migrationStore) Get(ctx context.Context, from, through model.Time, matchers ...*metric.LabelMatcher) ([]Chunk, error) {
+	userID, err := user.Extract(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var chunks []Chunk
+	for t := from.Add(-time.Hour); t <= through; t = t.Add(time.Hour) {
+		chunks = append(chunks, Chunk{
+			ID:      fmt.Sprintf("%s/%s/%d", userID, matchers[0].Value, t.Unix()),
+			From:    t,
+			Through: t.Add(time.Hour),
+		})
+	}
+	return chunks, nil
+}
+
+func (s *migrationStore) Put(ctx context.Context, chunks []Chunk) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.fail {
+		return fmt.Errorf("fail")
+	}
+	for _, chunk := range chunks {
+		s.puts[chunk.ID]++
+	}
+	return nil
+}
+
+func waitForMigration(t *testing.T, m *Migrator) MigrationProgress {
+	for i := 0; i < 100; i++ {
+		if progress := m.Progress(); progress.Done {
+			return progress
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("migration didn't finish")
+	return MigrationProgress{}
+}
+
+func TestMigrator(t *testing.T) {
+	dir, err := ioutil.TempDir("", "migrator")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	cfg := MigratorConfig{
+		Tenants:        "1, 2",
+		MetricNames:    "foo",
+		From:           util.NewDayValue(model.TimeFromUnix(0)),
+		Through:        util.NewDayValue(model.TimeFromUnix(2 * 24 * 60 * 60)),
+		Concurrency:    2,
+		CheckpointFile: filepath.Join(dir, "checkpoint"),
+	}
+	source := &migrationStore{}
+
+	// All the units fail to be copied...
+	destination := &migrationStore{puts: map[string]int{}, fail: true}
+	m, err := NewMigrator(cfg, source, destination)
+	require.NoError(t, err)
+	m.Start()
+	progress := waitForMigration(t, m)
+	m.Stop()
+	assert.Equal(t, MigrationProgress{Units: 4, FailedUnits: 4, Done: true}, progress)
+
+	// ...until they're retried, and each chunk is copied once, even those
+	// spanning days.
+	destination.fail = false
+	m, err = NewMigrator(cfg, source, destination)
+	require.NoError(t, err)
+	m.Start()
+	progress = waitForMigration(t, m)
+	m.Stop()
+	assert.Equal(t, MigrationProgress{Units: 4, CompletedUnits: 4, Chunks: 2 * 49, Done: true}, progress)
+	for id, puts := range destination.puts {
+		assert.Equal(t, 1, puts, id)
+	}
+
+	// The checkpoint file means they're skipped when the migration restarts.
+	m, err = NewMigrator(cfg, source, destination)
+	require.NoError(t, err)
+	m.Start()
+	progress = waitForMigration(t, m)
+	m.Stop()
+	assert.Equal(t, MigrationProgress{Units: 4, SkippedUnits: 4, Done: true}, progress)
+}
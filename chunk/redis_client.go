@@ -0,0 +1,490 @@
+package chunk
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/prometheus/common/log"
+)
+
+// The number of hash slots keys are sharded over by a Redis cluster.
+const redisClusterSlots = 16384
+
+// RedisConfig defines how a RedisClient should be constructed.
+type RedisConfig struct {
+	Endpoint              string
+	Cluster               bool
+	Password              string
+	DB                    int
+	TLS                   bool
+	TLSInsecureSkipVerify bool
+	Timeout               time.Duration
+	MaxIdleConns          int
+	ExpirationJitter      float64
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet
+func (cfg *RedisConfig) RegisterFlags(f *flag.FlagSet) {
+	f.StringVar(&cfg.Endpoint, "redis.endpoint", "", "Comma separated host:port addresses of Redis to cache chunks and index entries in instead of memcached. With -redis.cluster, any nodes of the cluster. If empty, Redis isn't used.")
+	f.BoolVar(&cfg.Cluster, "redis.cluster", false, "Shard keys over the nodes of a Redis cluster, discovered from the endpoint.")
+	f.StringVar(&cfg.Password, "redis.password", "", "Password to authenticate with Redis.")
+	f.IntVar(&cfg.DB, "redis.db", 0, "Redis database to use. Must be 0 with -redis.cluster.")
+	f.BoolVar(&cfg.TLS, "redis.tls", false, "Connect to Redis with TLS.")
+	f.BoolVar(&cfg.TLSInsecureSkipVerify, "redis.tls-insecure-skip-verify", false, "Don't verify the certificates of Redis servers.")
+	f.DurationVar(&cfg.Timeout, "redis.timeout", 100*time.Millisecond, "Maximum time to wait before giving up on Redis requests.")
+	f.IntVar(&cfg.MaxIdleConns, "redis.max-idle-conns", 16, "Maximum number of idle connections kept open to each Redis server.")
+	f.Float64Var(&cfg.ExpirationJitter, "redis.expiration-jitter", 0.1, "Extend the expiration of each key by up to this fraction at random, so keys written together don't all expire at once.")
+}
+
+// RedisClient is a Memcache using Redis, pipelining the commands for many
+// keys, and optionally sharding keys over the nodes of a Redis cluster.
+type RedisClient struct {
+	cfg       RedisConfig
+	tlsConfig *tls.Config
+	endpoints []string
+
+	mtx   sync.RWMutex
+	pools map[string]*redisPool
+	slots []string // The node serving each slot, in cluster mode.
+}
+
+// NewRedisClient creates a new RedisClient. In cluster mode, it fetches the
+// cluster's slots from the first endpoint which responds.
+func NewRedisClient(cfg RedisConfig) (*RedisClient, error) {
+	if cfg.Cluster && cfg.DB != 0 {
+		return nil, fmt.Errorf("Redis clusters only have database 0")
+	}
+	c := &RedisClient{
+		cfg:       cfg,
+		endpoints: strings.Split(cfg.Endpoint, ","),
+		pools:     map[string]*redisPool{},
+	}
+	if cfg.TLS {
+		c.tlsConfig = &tls.Config{InsecureSkipVerify: cfg.TLSInsecureSkipVerify}
+	}
+	if cfg.Cluster {
+		if err := c.updateSlots(); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// GetMulti implements Memcache. The GETs for all the keys on a server are
+// sent before any replies are read.
+func (c *RedisClient) GetMulti(keys []string) (map[string]*memcache.Item, error) {
+	byAddr := map[string][]string{}
+	for _, key := range keys {
+		addr := c.addrFor(key)
+		byAddr[addr] = append(byAddr[addr], key)
+	}
+
+	type result struct {
+		items map[string]*memcache.Item
+		err   error
+	}
+	results := make(chan result)
+	for addr, keys := range byAddr {
+		go func(addr string, keys []string) {
+			items, err := c.getMulti(addr, keys)
+			results <- result{items, err}
+		}(addr, keys)
+	}
+
+	items := make(map[string]*memcache.Item, len(keys))
+	var lastErr error
+	for range byAddr {
+		result := <-results
+		if result.err != nil {
+			lastErr = result.err
+			continue
+		}
+		for key, item := range result.items {
+			items[key] = item
+		}
+	}
+	return items, lastErr
+}
+
+func (c *RedisClient) getMulti(addr string, keys []string) (map[string]*memcache.Item, error) {
+	cmds := make([][]string, 0, len(keys))
+	for _, key := range keys {
+		cmds = append(cmds, []string{"GET", key})
+	}
+	replies, err := c.pipeline(addr, cmds)
+	if err != nil {
+		return nil, err
+	}
+
+	items := make(map[string]*memcache.Item, len(keys))
+	moved := false
+	for i, reply := range replies {
+		switch reply := reply.(type) {
+		case []byte:
+			items[keys[i]] = &memcache.Item{Key: keys[i], Value: reply}
+		case redisError:
+			// Keys on slots which have moved are misses until we know where
+			// they are.
+			if !strings.HasPrefix(string(reply), "MOVED ") {
+				return nil, reply
+			}
+			moved = true
+		}
+	}
+	if moved {
+		c.refreshSlots()
+	}
+	return items, nil
+}
+
+// Set implements Memcache, jittering the expiration.
+func (c *RedisClient) Set(item *memcache.Item) error {
+	cmd := []string{"SET", item.Key, string(item.Value)}
+	if item.Expiration > 0 {
+		seconds := float64(item.Expiration) * (1 + c.cfg.ExpirationJitter*rand.Float64())
+		cmd = append(cmd, "EX", strconv.Itoa(int(seconds)))
+	}
+	replies, err := c.pipeline(c.addrFor(item.Key), [][]string{cmd})
+	if err != nil {
+		return err
+	}
+	if err, ok := replies[0].(redisError); ok {
+		if strings.HasPrefix(string(err), "MOVED ") {
+			c.refreshSlots()
+		}
+		return err
+	}
+	return nil
+}
+
+// Stop closes the client's idle connections.
+func (c *RedisClient) Stop() {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for _, pool := range c.pools {
+		pool.close()
+	}
+	c.pools = map[string]*redisPool{}
+}
+
+// addrFor returns the address of the server for a key.
+func (c *RedisClient) addrFor(key string) string {
+	if !c.cfg.Cluster {
+		return c.endpoints[0]
+	}
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	if addr := c.slots[redisSlot(key)]; addr != "" {
+		return addr
+	}
+	return c.endpoints[0]
+}
+
+// redisSlot is the cluster hash slot of a key: the CRC16 of its hash tag, the
+// part in the first {}s, if any, or else the whole key.
+func redisSlot(key string) int {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	var crc uint16
+	for i := 0; i < len(key); i++ {
+		crc ^= uint16(key[i]) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return int(crc) % redisClusterSlots
+}
+
+func (c *RedisClient) refreshSlots() {
+	if err := c.updateSlots(); err != nil {
+		log.Warnf("Error updating Redis cluster slots: %v", err)
+	}
+}
+
+// updateSlots asks the cluster which node serves each slot.
+func (c *RedisClient) updateSlots() error {
+	var lastErr error
+	for _, endpoint := range c.endpoints {
+		replies, err := c.pipeline(endpoint, [][]string{{"CLUSTER", "SLOTS"}})
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		slots, err := parseClusterSlots(replies[0])
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		c.mtx.Lock()
+		c.slots = slots
+		c.mtx.Unlock()
+		return nil
+	}
+	return fmt.Errorf("error getting Redis cluster slots: %v", lastErr)
+}
+
+// parseClusterSlots parses the reply to CLUSTER SLOTS: an array of slot
+// ranges, each the start, end, then the master's host and port, and any
+// replicas.
+func parseClusterSlots(reply interface{}) ([]string, error) {
+	if err, ok := reply.(redisError); ok {
+		return nil, err
+	}
+	ranges, ok := reply.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("unexpected CLUSTER SLOTS reply %v", reply)
+	}
+	slots := make([]string, redisClusterSlots)
+	for _, r := range ranges {
+		fields, ok := r.([]interface{})
+		if !ok || len(fields) < 3 {
+			return nil, fmt.Errorf("unexpected CLUSTER SLOTS range %v", r)
+		}
+		start, ok1 := fields[0].(int64)
+		end, ok2 := fields[1].(int64)
+		master, ok3 := fields[2].([]interface{})
+		if !ok1 || !ok2 || !ok3 || len(master) < 2 || start < 0 || end >= redisClusterSlots {
+			return nil, fmt.Errorf("unexpected CLUSTER SLOTS range %v", r)
+		}
+		host, ok1 := master[0].([]byte)
+		port, ok2 := master[1].(int64)
+		if !ok1 || !ok2 {
+			return nil, fmt.Errorf("unexpected CLUSTER SLOTS node %v", master)
+		}
+		addr := net.JoinHostPort(string(host), strconv.FormatInt(port, 10))
+		for slot := start; slot <= end; slot++ {
+			slots[slot] = addr
+		}
+	}
+	return slots, nil
+}
+
+// pipeline sends the commands to the server, then reads their replies.
+func (c *RedisClient) pipeline(addr string, cmds [][]string) ([]interface{}, error) {
+	pool := c.pool(addr)
+	conn, err := pool.get()
+	if err != nil {
+		return nil, err
+	}
+	replies, err := conn.pipeline(cmds)
+	if err != nil {
+		// The connection may be partway through a reply.
+		conn.Close()
+		return nil, err
+	}
+	pool.put(conn)
+	return replies, nil
+}
+
+func (c *RedisClient) pool(addr string) *redisPool {
+	c.mtx.RLock()
+	pool, ok := c.pools[addr]
+	c.mtx.RUnlock()
+	if ok {
+		return pool
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if pool, ok := c.pools[addr]; ok {
+		return pool
+	}
+	pool = &redisPool{
+		dial: func() (*redisConn, error) { return c.dial(addr) },
+		idle: make(chan *redisConn, c.cfg.MaxIdleConns),
+	}
+	c.pools[addr] = pool
+	return pool
+}
+
+func (c *RedisClient) dial(addr string) (*redisConn, error) {
+	dialer := &net.Dialer{Timeout: c.cfg.Timeout}
+	var conn net.Conn
+	var err error
+	if c.tlsConfig != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, c.tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rc := &redisConn{
+		Conn:    conn,
+		r:       bufio.NewReader(conn),
+		w:       bufio.NewWriter(conn),
+		timeout: c.cfg.Timeout,
+	}
+	var setup [][]string
+	if c.cfg.Password != "" {
+		setup = append(setup, []string{"AUTH", c.cfg.Password})
+	}
+	if c.cfg.DB != 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(c.cfg.DB)})
+	}
+	if len(setup) > 0 {
+		replies, err := rc.pipeline(setup)
+		if err == nil {
+			for _, reply := range replies {
+				if replyErr, ok := reply.(redisError); ok {
+					err = replyErr
+				}
+			}
+		}
+		if err != nil {
+			rc.Close()
+			return nil, err
+		}
+	}
+	return rc, nil
+}
+
+// redisPool keeps idle connections to a server for reuse.
+type redisPool struct {
+	dial func() (*redisConn, error)
+	idle chan *redisConn
+}
+
+func (p *redisPool) get() (*redisConn, error) {
+	select {
+	case conn := <-p.idle:
+		return conn, nil
+	default:
+		return p.dial()
+	}
+}
+
+func (p *redisPool) put(conn *redisConn) {
+	select {
+	case p.idle <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+func (p *redisPool) close() {
+	for {
+		select {
+		case conn := <-p.idle:
+			conn.Close()
+		default:
+			return
+		}
+	}
+}
+
+// redisError is an error reply from Redis.
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// redisConn speaks the Redis protocol, RESP, over a connection.
+type redisConn struct {
+	net.Conn
+	r       *bufio.Reader
+	w       *bufio.Writer
+	timeout time.Duration
+}
+
+// pipeline writes all the commands, then reads a reply to each: []byte, or
+// nil if missing, for bulk strings, string for simple strings, int64 for
+// integers, []interface{} for arrays, and redisError for errors.
+func (c *redisConn) pipeline(cmds [][]string) ([]interface{}, error) {
+	if c.timeout > 0 {
+		c.SetDeadline(time.Now().Add(c.timeout))
+	}
+	for _, cmd := range cmds {
+		fmt.Fprintf(c.w, "*%d\r\n", len(cmd))
+		for _, arg := range cmd {
+			fmt.Fprintf(c.w, "$%d\r\n%s\r\n", len(arg), arg)
+		}
+	}
+	if err := c.w.Flush(); err != nil {
+		return nil, err
+	}
+
+	replies := make([]interface{}, 0, len(cmds))
+	for range cmds {
+		reply, err := c.readReply()
+		if err != nil {
+			return nil, err
+		}
+		replies = append(replies, reply)
+	}
+	return replies, nil
+}
+
+var errRedisProtocol = errors.New("redis: protocol error")
+
+func (c *redisConn) readLine() (string, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if !strings.HasSuffix(line, "\r\n") || len(line) < 3 {
+		return "", errRedisProtocol
+	}
+	return line[:len(line)-2], nil
+}
+
+func (c *redisConn) readReply() (interface{}, error) {
+	line, err := c.readLine()
+	if err != nil {
+		return nil, err
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return redisError(line[1:]), nil
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		array := make([]interface{}, 0, n)
+		for i := 0; i < n; i++ {
+			reply, err := c.readReply()
+			if err != nil {
+				return nil, err
+			}
+			array = append(array, reply)
+		}
+		return array, nil
+	default:
+		return nil, errRedisProtocol
+	}
+}
@@ -0,0 +1,216 @@
+package chunk
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeRedis is a Redis server storing keys in memory. If it's part of a
+// cluster, it redirects commands for keys on others' slots.
+type fakeRedis struct {
+	listener net.Listener
+	password string
+
+	mtx      sync.Mutex
+	values   map[string]string
+	ttls     map[string]int
+	commands int
+	cluster  []*fakeRedis // Each node serving an equal share of the slots.
+}
+
+func newFakeRedis(t *testing.T, password string) *fakeRedis {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	f := &fakeRedis{
+		listener: listener,
+		password: password,
+		values:   map[string]string{},
+		ttls:     map[string]int{},
+	}
+	go f.serve()
+	return f
+}
+
+func (f *fakeRedis) addr() string {
+	return f.listener.Addr().String()
+}
+
+func (f *fakeRedis) serve() {
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			return
+		}
+		go f.handle(conn)
+	}
+}
+
+func (f *fakeRedis) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	authed := f.password == ""
+	for {
+		var n int
+		if _, err := fmt.Fscanf(r, "*%d\r\n", &n); err != nil {
+			return
+		}
+		cmd := make([]string, n)
+		for i := range cmd {
+			var size int
+			if _, err := fmt.Fscanf(r, "$%d\r\n", &size); err != nil {
+				return
+			}
+			buf := make([]byte, size+2)
+			if _, err := io.ReadFull(r, buf); err != nil {
+				return
+			}
+			cmd[i] = string(buf[:size])
+		}
+
+		switch {
+		case cmd[0] == "AUTH":
+			authed = cmd[1] == f.password
+			if !authed {
+				fmt.Fprintf(conn, "-ERR invalid password\r\n")
+				continue
+			}
+			fmt.Fprintf(conn, "+OK\r\n")
+		case !authed:
+			fmt.Fprintf(conn, "-NOAUTH Authentication required.\r\n")
+		case cmd[0] == "CLUSTER":
+			fmt.Fprintf(conn, "*%d\r\n", len(f.cluster))
+			for i, node := range f.cluster {
+				host, port, _ := net.SplitHostPort(node.addr())
+				fmt.Fprintf(conn, "*3\r\n:%d\r\n:%d\r\n*2\r\n$%d\r\n%s\r\n:%s\r\n",
+					i*redisClusterSlots/len(f.cluster), (i+1)*redisClusterSlots/len(f.cluster)-1, len(host), host, port)
+			}
+		default:
+			if owner := f.owner(cmd[1]); owner != f {
+				fmt.Fprintf(conn, "-MOVED %d %s\r\n", redisSlot(cmd[1]), owner.addr())
+				continue
+			}
+			f.mtx.Lock()
+			f.commands++
+			switch cmd[0] {
+			case "GET":
+				if value, ok := f.values[cmd[1]]; ok {
+					fmt.Fprintf(conn, "$%d\r\n%s\r\n", len(value), value)
+				} else {
+					fmt.Fprintf(conn, "$-1\r\n")
+				}
+			case "SET":
+				f.values[cmd[1]] = cmd[2]
+				if len(cmd) == 5 && cmd[3] == "EX" {
+					f.ttls[cmd[1]], _ = strconv.Atoi(cmd[4])
+				}
+				fmt.Fprintf(conn, "+OK\r\n")
+			}
+			f.mtx.Unlock()
+		}
+	}
+}
+
+func (f *fakeRedis) owner(key string) *fakeRedis {
+	if len(f.cluster) == 0 {
+		return f
+	}
+	return f.cluster[redisSlot(key)*len(f.cluster)/redisClusterSlots]
+}
+
+func TestRedisClient(t *testing.T) {
+	f := newFakeRedis(t, "secret")
+	defer f.listener.Close()
+
+	client, err := NewRedisClient(RedisConfig{
+		Endpoint:         f.addr(),
+		Password:         "secret",
+		MaxIdleConns:     1,
+		ExpirationJitter: 0.5,
+	})
+	require.NoError(t, err)
+	defer client.Stop()
+
+	for i := 0; i < 10; i++ {
+		require.NoError(t, client.Set(&memcache.Item{
+			Key:        fmt.Sprintf("key%d", i),
+			Value:      []byte(fmt.Sprintf("value%d", i)),
+			Expiration: 100,
+		}))
+	}
+	for key, ttl := range f.ttls {
+		assert.True(t, ttl >= 100 && ttl <= 150, "%s has TTL %d", key, ttl)
+	}
+
+	items, err := client.GetMulti([]string{"key1", "key5", "missing"})
+	require.NoError(t, err)
+	require.Len(t, items, 2)
+	assert.Equal(t, "value1", string(items["key1"].Value))
+	assert.Equal(t, "value5", string(items["key5"].Value))
+
+	// Connections which fail to authenticate are errors.
+	client, err = NewRedisClient(RedisConfig{Endpoint: f.addr(), Password: "wrong"})
+	require.NoError(t, err)
+	_, err = client.GetMulti([]string{"key1"})
+	assert.Error(t, err)
+}
+
+func TestRedisClientCluster(t *testing.T) {
+	nodes := []*fakeRedis{newFakeRedis(t, ""), newFakeRedis(t, ""), newFakeRedis(t, "")}
+	for _, node := range nodes {
+		node.cluster = nodes
+		defer node.listener.Close()
+	}
+
+	client, err := NewRedisClient(RedisConfig{Endpoint: nodes[1].addr(), Cluster: true})
+	require.NoError(t, err)
+	defer client.Stop()
+
+	var keys []string
+	for i := 0; i < 30; i++ {
+		key := fmt.Sprintf("key%d", i)
+		keys = append(keys, key)
+		require.NoError(t, client.Set(&memcache.Item{Key: key, Value: []byte(key)}))
+	}
+	items, err := client.GetMulti(keys)
+	require.NoError(t, err)
+	assert.Len(t, items, len(keys))
+
+	// Each key went straight to its node.
+	for _, node := range nodes {
+		assert.True(t, node.commands > 0)
+		for key := range node.values {
+			assert.Equal(t, node, node.owner(key))
+		}
+	}
+
+	// Moved slots are misses until the client learns where they've gone.
+	nodes[0].cluster = []*fakeRedis{nodes[1], nodes[2], nodes[0]}
+	nodes[1].cluster, nodes[2].cluster = nodes[0].cluster, nodes[0].cluster
+	items, err = client.GetMulti(keys)
+	require.NoError(t, err)
+	assert.True(t, len(items) < len(keys))
+	for _, key := range keys {
+		owner := nodes[0].owner(key)
+		owner.values[key] = key
+	}
+	items, err = client.GetMulti(keys)
+	require.NoError(t, err)
+	assert.Len(t, items, len(keys))
+}
+
+func TestRedisSlot(t *testing.T) {
+	// Examples from the Redis cluster specification.
+	assert.Equal(t, 12739, redisSlot("123456789"))
+	assert.Equal(t, redisSlot("user1000"), redisSlot("{user1000}.following"))
+	assert.Equal(t, redisSlot("user1000"), redisSlot("foo{user1000}{bar}"))
+	assert.NotEqual(t, redisSlot("bar"), redisSlot("foo{}{bar}"))
+}
@@ -15,6 +15,7 @@ import (
 type S3Client interface {
 	PutObject(*s3.PutObjectInput) (*s3.PutObjectOutput, error)
 	GetObject(*s3.GetObjectInput) (*s3.GetObjectOutput, error)
+	ListObjectsV2(*s3.ListObjectsV2Input) (*s3.ListObjectsV2Output, error)
 }
 
 // NewS3Client makes a new S3Client
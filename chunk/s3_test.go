@@ -4,8 +4,12 @@ import (
 	"bytes"
 	"fmt"
 	"io/ioutil"
+	"sort"
+	"strings"
 	"sync"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/s3"
 )
 
@@ -57,10 +61,66 @@ func (m *MockS3) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error
 
 	buf, ok := bucket.objects[*input.Key]
 	if !ok {
-		return nil, fmt.Errorf("not found")
+		return nil, awserr.New("NoSuchKey", "not found", nil)
+	}
+
+	if input.Range != nil {
+		var start, end int
+		if _, err := fmt.Sscanf(*input.Range, "bytes=%d-%d", &start, &end); err != nil {
+			return nil, err
+		}
+		if start < 0 || start > end || end >= len(buf) {
+			return nil, fmt.Errorf("invalid range")
+		}
+		buf = buf[start : end+1]
 	}
 
 	return &s3.GetObjectOutput{
 		Body: ioutil.NopCloser(bytes.NewBuffer(buf)),
 	}, nil
 }
+
+// ListObjectsV2 supports Prefix and Delimiter, and returns all the results in
+// one page.
+func (m *MockS3) ListObjectsV2(input *s3.ListObjectsV2Input) (*s3.ListObjectsV2Output, error) {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+
+	output := &s3.ListObjectsV2Output{
+		IsTruncated: aws.Bool(false),
+	}
+	bucket, ok := m.buckets[*input.Bucket]
+	if !ok {
+		return output, nil
+	}
+
+	prefix, delimiter := aws.StringValue(input.Prefix), aws.StringValue(input.Delimiter)
+	keys := []string{}
+	commonPrefixes := map[string]struct{}{}
+	for key := range bucket.objects {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		if delimiter != "" {
+			if i := strings.Index(key[len(prefix):], delimiter); i >= 0 {
+				commonPrefixes[key[:len(prefix)+i+len(delimiter)]] = struct{}{}
+				continue
+			}
+		}
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+	for _, key := range keys {
+		output.Contents = append(output.Contents, &s3.Object{Key: aws.String(key)})
+	}
+	prefixes := make([]string, 0, len(commonPrefixes))
+	for p := range commonPrefixes {
+		prefixes = append(prefixes, p)
+	}
+	sort.Strings(prefixes)
+	for _, p := range prefixes {
+		output.CommonPrefixes = append(output.CommonPrefixes, &s3.CommonPrefix{Prefix: aws.String(p)})
+	}
+	return output, nil
+}
@@ -2,6 +2,7 @@ package chunk
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"encoding/base64"
 	"encoding/binary"
 	"encoding/hex"
@@ -29,6 +30,8 @@ var (
 	rangeKeyV2 = []byte{'2'}
 	rangeKeyV3 = []byte{'3'}
 	rangeKeyV4 = []byte{'4'}
+	rangeKeyV5 = []byte{'5'}
+	rangeKeyV6 = []byte{'6'}
 )
 
 // Schema interface defines methods to calculate the hash and range keys needed
@@ -41,6 +44,10 @@ type Schema interface {
 	GetReadEntriesForMetric(from, through model.Time, userID string, metricName model.LabelValue) ([]IndexEntry, error)
 	GetReadEntriesForMetricLabel(from, through model.Time, userID string, metricName model.LabelValue, labelName model.LabelName) ([]IndexEntry, error)
 	GetReadEntriesForMetricLabelValue(from, through model.Time, userID string, metricName model.LabelValue, labelName model.LabelName, labelValue model.LabelValue) ([]IndexEntry, error)
+
+	// When the entries read point to series rather than chunks, use this
+	// method to return the entries for the chunks of a series.
+	GetChunksForSeries(from, through model.Time, userID string, seriesID string) ([]IndexEntry, error)
 }
 
 // IndexEntry describes an entry in the chunk index
@@ -76,6 +83,13 @@ type SchemaConfig struct {
 
 	// After this time, we will read and write v5 schemas.
 	V5SchemaFrom util.DayValue
+
+	// After this time, we will read and write v6 schemas.
+	V6SchemaFrom util.DayValue
+
+	// File declaring the schema versions to use and when, instead of the
+	// flags above.
+	SchemaConfigFile string
 }
 
 // RegisterFlags adds the flags required to config this to the given FlagSet
@@ -86,6 +100,8 @@ func (cfg *SchemaConfig) RegisterFlags(f *flag.FlagSet) {
 	f.Var(&cfg.Base64ValuesFrom, "dynamodb.base64-buckets-from", "The date (in the format YYYY-MM-DD) after which we will stop querying to non-base64 encoded values.")
 	f.Var(&cfg.V4SchemaFrom, "dynamodb.v4-schema-from", "The date (in the format YYYY-MM-DD) after which we enable v4 schema.")
 	f.Var(&cfg.V5SchemaFrom, "dynamodb.v5-schema-from", "The date (in the format YYYY-MM-DD) after which we enable v5 schema.")
+	f.Var(&cfg.V6SchemaFrom, "dynamodb.v6-schema-from", "The date (in the format YYYY-MM-DD) after which we enable v6 schema, indexing series rather than chunks by label.")
+	f.StringVar(&cfg.SchemaConfigFile, "schema-config-file", "", "YAML file declaring which schema version to use from which date, instead of the -dynamodb.*-from flags.")
 }
 
 func (cfg *SchemaConfig) tableForBucket(bucketStart int64) string {
@@ -154,6 +170,10 @@ func (a byStart) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
 func (a byStart) Less(i, j int) bool { return a[i].start < a[j].start }
 
 func newCompositeSchema(cfg SchemaConfig) (Schema, error) {
+	if cfg.SchemaConfigFile != "" {
+		return loadCompositeSchema(cfg)
+	}
+
 	schemas := []compositeSchemaEntry{
 		{0, v1Schema(cfg)},
 	}
@@ -174,6 +194,10 @@ func newCompositeSchema(cfg SchemaConfig) (Schema, error) {
 		schemas = append(schemas, compositeSchemaEntry{cfg.V5SchemaFrom.Time, v5Schema(cfg)})
 	}
 
+	if cfg.V6SchemaFrom.IsSet() {
+		schemas = append(schemas, compositeSchemaEntry{cfg.V6SchemaFrom.Time, v6Schema(cfg)})
+	}
+
 	if !sort.IsSorted(byStart(schemas)) {
 		return nil, fmt.Errorf("schemas not in time-sorted order")
 	}
@@ -261,6 +285,12 @@ func (c compositeSchema) GetReadEntriesForMetricLabelValue(from, through model.T
 	})
 }
 
+func (c compositeSchema) GetChunksForSeries(from, through model.Time, userID string, seriesID string) ([]IndexEntry, error) {
+	return c.forSchemas(from, through, func(from, through model.Time, schema Schema) ([]IndexEntry, error) {
+		return schema.GetChunksForSeries(from, through, userID, seriesID)
+	})
+}
+
 // v1Schema was:
 // - hash key: <userid>:<hour bucket>:<metric name>
 // - range key: <label name>\0<label value>\0<chunk name>
@@ -310,6 +340,22 @@ func v5Schema(cfg SchemaConfig) Schema {
 	}
 }
 
+// v6 schema indexes series rather than chunks by their labels, so the
+// series matching all of a query's matchers are found before any of their
+// chunks are looked up, and label rows have an entry per series per day
+// rather than per chunk:
+// 1) - hash key: <userid>:d<day bucket>:<metric name>
+//    - range key: \0\0<series id>\0<version 5>
+// 2) - hash key: <userid>:d<day bucket>:<metric name>:<label name>
+//    - range key: \0<base64(label value)>\0<series id>\0<version 6>
+// 3) - hash key: <userid>:d<day bucket>:<series id>
+//    - range key: <chunk end time>\0\0<chunk name>\0<version 3>
+func v6Schema(cfg SchemaConfig) Schema {
+	return seriesSchema{
+		cfg.dailyBuckets,
+	}
+}
+
 // schema implements Schema given a bucketing function and and set of range key callbacks
 type schema struct {
 	buckets func(from, through model.Time, userID string, metricName model.LabelValue, callback bucketCallback) ([]IndexEntry, error)
@@ -328,6 +374,10 @@ func (s schema) GetReadEntriesForMetric(from, through model.Time, userID string,
 	})
 }
 
+func (s schema) GetChunksForSeries(from, through model.Time, userID string, seriesID string) ([]IndexEntry, error) {
+	return nil, nil
+}
+
 func (s schema) GetReadEntriesForMetricLabel(from, through model.Time, userID string, metricName model.LabelValue, labelName model.LabelName) ([]IndexEntry, error) {
 	return s.buckets(from, through, userID, metricName, func(bucketFrom, bucketThrough uint32, tableName, hashKey string) ([]IndexEntry, error) {
 		return s.entries.GetReadMetricLabelEntries(bucketFrom, bucketThrough, tableName, hashKey, labelName)
@@ -570,6 +620,105 @@ func (v5Entries) GetReadMetricLabelValueEntries(from, _ uint32, tableName, hashK
 	}, nil
 }
 
+// seriesSchema implements Schema for schemas indexing series, given a
+// bucketing function.
+type seriesSchema struct {
+	buckets func(from, through model.Time, userID string, metricName model.LabelValue, callback bucketCallback) ([]IndexEntry, error)
+}
+
+// seriesID identifies a series in the index, by the hash of its labels.
+func seriesID(labels model.Metric) string {
+	hash := sha256.Sum256([]byte(labels.String()))
+	return base64.RawStdEncoding.EncodeToString(hash[:])
+}
+
+func (s seriesSchema) GetWriteEntries(from, through model.Time, userID string, metricName model.LabelValue, labels model.Metric, chunkID string) ([]IndexEntry, error) {
+	id := seriesID(labels)
+	seriesEntries, err := s.buckets(from, through, userID, metricName, func(_, _ uint32, tableName, hashKey string) ([]IndexEntry, error) {
+		entries := []IndexEntry{
+			{
+				TableName:  tableName,
+				HashValue:  hashKey,
+				RangeValue: buildRangeKey(nil, nil, []byte(id), rangeKeyV5),
+			},
+		}
+		for key, value := range labels {
+			if key == model.MetricNameLabel {
+				continue
+			}
+			entries = append(entries, IndexEntry{
+				TableName:  tableName,
+				HashValue:  hashKey + ":" + string(key),
+				RangeValue: buildRangeKey(nil, encodeBase64Value(value), []byte(id), rangeKeyV6),
+			})
+		}
+		return entries, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	chunkEntries, err := s.buckets(from, through, userID, model.LabelValue(id), func(_, bucketThrough uint32, tableName, hashKey string) ([]IndexEntry, error) {
+		return []IndexEntry{
+			{
+				TableName:  tableName,
+				HashValue:  hashKey,
+				RangeValue: buildRangeKey(encodeTime(bucketThrough), nil, []byte(chunkID), rangeKeyV3),
+			},
+		}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return append(seriesEntries, chunkEntries...), nil
+}
+
+func (s seriesSchema) GetReadEntriesForMetric(from, through model.Time, userID string, metricName model.LabelValue) ([]IndexEntry, error) {
+	return s.buckets(from, through, userID, metricName, func(_, _ uint32, tableName, hashKey string) ([]IndexEntry, error) {
+		return []IndexEntry{
+			{
+				TableName: tableName,
+				HashValue: hashKey,
+			},
+		}, nil
+	})
+}
+
+func (s seriesSchema) GetReadEntriesForMetricLabel(from, through model.Time, userID string, metricName model.LabelValue, labelName model.LabelName) ([]IndexEntry, error) {
+	return s.buckets(from, through, userID, metricName, func(_, _ uint32, tableName, hashKey string) ([]IndexEntry, error) {
+		return []IndexEntry{
+			{
+				TableName: tableName,
+				HashValue: hashKey + ":" + string(labelName),
+			},
+		}, nil
+	})
+}
+
+func (s seriesSchema) GetReadEntriesForMetricLabelValue(from, through model.Time, userID string, metricName model.LabelValue, labelName model.LabelName, labelValue model.LabelValue) ([]IndexEntry, error) {
+	return s.buckets(from, through, userID, metricName, func(_, _ uint32, tableName, hashKey string) ([]IndexEntry, error) {
+		return []IndexEntry{
+			{
+				TableName:        tableName,
+				HashValue:        hashKey + ":" + string(labelName),
+				RangeValuePrefix: buildRangeKey(nil, encodeBase64Value(labelValue)),
+			},
+		}, nil
+	})
+}
+
+func (s seriesSchema) GetChunksForSeries(from, through model.Time, userID string, seriesID string) ([]IndexEntry, error) {
+	return s.buckets(from, through, userID, model.LabelValue(seriesID), func(bucketFrom, _ uint32, tableName, hashKey string) ([]IndexEntry, error) {
+		return []IndexEntry{
+			{
+				TableName:       tableName,
+				HashValue:       hashKey,
+				RangeValueStart: buildRangeKey(encodeTime(bucketFrom)),
+			},
+		}, nil
+	})
+}
+
 func buildRangeKey(ss ...[]byte) []byte {
 	length := 0
 	for _, s := range ss {
@@ -599,7 +748,10 @@ func decodeBase64Value(bs []byte) (model.LabelValue, error) {
 	return model.LabelValue(decoded), nil
 }
 
-func parseRangeValue(v []byte) (model.LabelValue, string, error) {
+// parseRangeValue returns the label value and the chunk ID of a range value,
+// or the series ID, and whether it is one, of those of schemas indexing
+// series.
+func parseRangeValue(v []byte) (model.LabelValue, string, bool, error) {
 	components := make([][]byte, 0, 5)
 	i, j := 0, 0
 	for j < len(v) {
@@ -615,34 +767,43 @@ func parseRangeValue(v []byte) (model.LabelValue, string, error) {
 
 	switch {
 	case len(components) < 3:
-		return "", "", fmt.Errorf("invalid range value: %x", v)
+		return "", "", false, fmt.Errorf("invalid range value: %x", v)
 
 	// v1 & v2 schema had three components - label name, label value and chunk ID.
 	// No version number.
 	case len(components) == 3:
-		return model.LabelValue(components[1]), string(components[2]), nil
+		return model.LabelValue(components[1]), string(components[2]), false, nil
 
 	// v3 schema had four components - label name, label value, chunk ID and version.
 	// "version" is 1 and label value is base64 encoded.
 	case bytes.Equal(components[3], rangeKeyV1):
 		value, err := decodeBase64Value(components[1])
-		return value, string(components[2]), err
+		return value, string(components[2]), false, err
 
 	// v4 schema wrote v3 range keys and a new range key - version 2,
 	// with four components - <empty>, <empty>, chunk ID and version.
 	case bytes.Equal(components[3], rangeKeyV2):
-		return "", string(components[2]), nil
+		return "", string(components[2]), false, nil
 
 	// v5 schema version 3 range key is chunk end time, <empty>, chunk ID, version
 	case bytes.Equal(components[3], rangeKeyV3):
-		return "", string(components[2]), nil
+		return "", string(components[2]), false, nil
 
 	// v5 schema version 4 range key is chunk end time, label value, chunk ID, version
 	case bytes.Equal(components[3], rangeKeyV4):
 		value, err := decodeBase64Value(components[1])
-		return value, string(components[2]), err
+		return value, string(components[2]), false, err
+
+	// v6 schema version 5 range key is <empty>, <empty>, series ID, version
+	case bytes.Equal(components[3], rangeKeyV5):
+		return "", string(components[2]), true, nil
+
+	// v6 schema version 6 range key is <empty>, label value, series ID, version
+	case bytes.Equal(components[3], rangeKeyV6):
+		value, err := decodeBase64Value(components[1])
+		return value, string(components[2]), true, err
 
 	default:
-		return "", "", fmt.Errorf("unrecognised version: '%v'", string(components[3]))
+		return "", "", false, fmt.Errorf("unrecognised version: '%v'", string(components[3]))
 	}
 }
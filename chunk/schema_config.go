@@ -0,0 +1,82 @@
+package chunk
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/weaveworks/cortex/util"
+)
+
+// schemaVersions are the schemas which can be used in a schema config file.
+var schemaVersions = map[string]func(SchemaConfig) Schema{
+	"v1": v1Schema,
+	"v2": v2Schema,
+	"v3": v3Schema,
+	"v4": v4Schema,
+	"v5": v5Schema,
+	"v6": v6Schema,
+}
+
+// schemaConfigFile is the format of the schema config file, eg:
+//
+//	configs:
+//	- from: 2017-01-01
+//	  schema: v1
+//	- from: 2017-03-15
+//	  schema: v5
+//
+// Each schema is used from midnight on its day until the next one starts.
+// Chunks from before the first day use the first schema.
+type schemaConfigFile struct {
+	Configs []schemaPeriodConfig `yaml:"configs"`
+}
+
+type schemaPeriodConfig struct {
+	From   util.DayValue `yaml:"from"`
+	Schema string        `yaml:"schema"`
+}
+
+func loadCompositeSchema(cfg SchemaConfig) (Schema, error) {
+	if cfg.DailyBucketsFrom.IsSet() || cfg.Base64ValuesFrom.IsSet() || cfg.V4SchemaFrom.IsSet() || cfg.V5SchemaFrom.IsSet() || cfg.V6SchemaFrom.IsSet() {
+		return nil, fmt.Errorf("schema config file cannot be used with the -dynamodb.*-from flags")
+	}
+
+	buf, err := ioutil.ReadFile(cfg.SchemaConfigFile)
+	if err != nil {
+		return nil, err
+	}
+	var file schemaConfigFile
+	if err := yaml.Unmarshal(buf, &file); err != nil {
+		return nil, fmt.Errorf("error parsing schema config file %s: %v", cfg.SchemaConfigFile, err)
+	}
+	return newCompositeSchemaFromConfigs(cfg, file.Configs)
+}
+
+func newCompositeSchemaFromConfigs(cfg SchemaConfig, configs []schemaPeriodConfig) (Schema, error) {
+	if len(configs) == 0 {
+		return nil, fmt.Errorf("no schemas configured")
+	}
+
+	schemas := make([]compositeSchemaEntry, 0, len(configs))
+	for _, config := range configs {
+		if !config.From.IsSet() {
+			return nil, fmt.Errorf("schema %s has no start date", config.Schema)
+		}
+		schemaFn, ok := schemaVersions[config.Schema]
+		if !ok {
+			return nil, fmt.Errorf("unknown schema version %q", config.Schema)
+		}
+		schemas = append(schemas, compositeSchemaEntry{config.From.Time, schemaFn(cfg)})
+	}
+
+	if !sort.IsSorted(byStart(schemas)) {
+		return nil, fmt.Errorf("schemas not in time-sorted order")
+	}
+
+	// The first schema is used for all time before it, as with the flags.
+	schemas[0].start = 0
+	return compositeSchema{schemas}, nil
+}
@@ -0,0 +1,114 @@
+package chunk
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/weaveworks/common/test"
+)
+
+func TestSchemaConfigFile(t *testing.T) {
+	parseDate := func(s string) model.Time {
+		tm, err := time.Parse("2006-01-02", s)
+		require.NoError(t, err)
+		return model.TimeFromUnix(tm.Unix())
+	}
+	cfg := SchemaConfig{OriginalTableName: "table"}
+
+	// The equivalent of the config files below, made with flags.
+	flagsCfg := cfg
+	require.NoError(t, flagsCfg.Base64ValuesFrom.Set("2017-02-01"))
+	require.NoError(t, flagsCfg.V5SchemaFrom.Set("2017-03-01"))
+	want, err := newCompositeSchema(flagsCfg)
+	require.NoError(t, err)
+
+	for i, tc := range []struct {
+		config string
+		err    bool
+	}{
+		{config: `
+configs:
+- from: 2017-01-01
+  schema: v1
+- from: 2017-02-01
+  schema: v3
+- from: 2017-03-01
+  schema: v5
+`},
+		{config: `
+configs:
+- from: 2017-02-01
+  schema: v3
+- from: 2017-01-01
+  schema: v1
+`, err: true},
+		{config: `
+configs:
+- from: 2017-01-01
+  schema: v99
+`, err: true},
+		{config: `
+configs:
+- schema: v1
+`, err: true},
+		{config: `
+configs:
+- from: yesterday
+  schema: v1
+`, err: true},
+		{config: `configs: []`, err: true},
+	} {
+		t.Run(fmt.Sprintf("[%d]", i), func(t *testing.T) {
+			f, err := ioutil.TempFile("", "schema-config")
+			require.NoError(t, err)
+			defer os.Remove(f.Name())
+			_, err = f.WriteString(tc.config)
+			require.NoError(t, err)
+			require.NoError(t, f.Close())
+
+			fileCfg := cfg
+			fileCfg.SchemaConfigFile = f.Name()
+			have, err := newCompositeSchema(fileCfg)
+			if tc.err {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+			// Chunks spanning the schema changes must get the same index
+			// entries as with the flags.
+			from, through := parseDate("2017-01-31"), parseDate("2017-03-02")
+			metric := model.Metric{model.MetricNameLabel: "foo", "bar": "baz"}
+			wantEntries, err := want.GetWriteEntries(from, through, "user", "foo", metric, "chunk")
+			require.NoError(t, err)
+			haveEntries, err := have.GetWriteEntries(from, through, "user", "foo", metric, "chunk")
+			require.NoError(t, err)
+			if !reflect.DeepEqual(wantEntries, haveEntries) {
+				t.Fatalf("wrong write entries - %s", test.Diff(wantEntries, haveEntries))
+			}
+
+			wantEntries, err = want.GetReadEntriesForMetricLabelValue(from, through, "user", "foo", "bar", "baz")
+			require.NoError(t, err)
+			haveEntries, err = have.GetReadEntriesForMetricLabelValue(from, through, "user", "foo", "bar", "baz")
+			require.NoError(t, err)
+			if !reflect.DeepEqual(wantEntries, haveEntries) {
+				t.Fatalf("wrong read entries - %s", test.Diff(wantEntries, haveEntries))
+			}
+		})
+	}
+}
+
+func TestSchemaConfigFileWithFlags(t *testing.T) {
+	cfg := SchemaConfig{SchemaConfigFile: "schema.yaml"}
+	require.NoError(t, cfg.V5SchemaFrom.Set("2017-03-01"))
+	_, err := newCompositeSchema(cfg)
+	assert.Error(t, err)
+}
@@ -31,6 +31,9 @@ func (mockSchema) GetReadEntriesForMetricLabel(from, through model.Time, userID
 func (mockSchema) GetReadEntriesForMetricLabelValue(from, through model.Time, userID string, metricName model.LabelValue, labelName model.LabelName, labelValue model.LabelValue) ([]IndexEntry, error) {
 	return nil, nil
 }
+func (mockSchema) GetChunksForSeries(from, through model.Time, userID string, seriesID string) ([]IndexEntry, error) {
+	return nil, nil
+}
 
 func TestSchemaComposite(t *testing.T) {
 	type result struct {
@@ -391,6 +394,7 @@ func TestSchemaRangeKey(t *testing.T) {
 		base64Keys    = v3Schema(cfg)
 		labelBuckets  = v4Schema(cfg)
 		tsRangeKeys   = v5Schema(cfg)
+		seriesKeys    = v6Schema(cfg)
 		metric        = model.Metric{
 			model.MetricNameLabel: metricName,
 			"bar": "bary",
@@ -477,6 +481,31 @@ func TestSchemaRangeKey(t *testing.T) {
 				},
 			},
 		},
+		{
+			seriesKeys,
+			[]IndexEntry{
+				{
+					TableName:  table,
+					HashValue:  "userid:d0:foo",
+					RangeValue: []byte("\x00\x00" + seriesID(metric) + "\x005\x00"),
+				},
+				{
+					TableName:  table,
+					HashValue:  "userid:d0:foo:bar",
+					RangeValue: []byte("\x00YmFyeQ\x00" + seriesID(metric) + "\x006\x00"),
+				},
+				{
+					TableName:  table,
+					HashValue:  "userid:d0:foo:baz",
+					RangeValue: []byte("\x00YmF6eQ\x00" + seriesID(metric) + "\x006\x00"),
+				},
+				{
+					TableName:  table,
+					HashValue:  "userid:d0:" + seriesID(metric),
+					RangeValue: []byte("0036ee7f\x00\x00chunkID\x003\x00"),
+				},
+			},
+		},
 	} {
 		t.Run(fmt.Sprintf("TestSchameRangeKey[%d]", i), func(t *testing.T) {
 			have, err := tc.Schema.GetWriteEntries(
@@ -495,7 +524,7 @@ func TestSchemaRangeKey(t *testing.T) {
 
 			// Test we can parse the resulting range keys
 			for _, entry := range have {
-				_, _, err := parseRangeValue(entry.RangeValue)
+				_, _, _, err := parseRangeValue(entry.RangeValue)
 				if err != nil {
 					t.Fatal(err)
 				}
@@ -509,34 +538,44 @@ func TestParseRangeValue(t *testing.T) {
 	for _, c := range []struct {
 		encoded        []byte
 		value, chunkID string
+		series         bool
 	}{
-		{[]byte("1\x002\x003\x00"), "2", "3"},
+		{[]byte("1\x002\x003\x00"), "2", "3", false},
 
 		// version 1 range keys (v3 Schema) base64-encodes the label value
 		{[]byte("toms\x00Y29kZQ\x002:1484661279394:1484664879394\x001\x00"),
-			"code", "2:1484661279394:1484664879394"},
+			"code", "2:1484661279394:1484664879394", false},
 
 		// version 1 range keys (v4 Schema) doesn't have the label name in the range key
 		{[]byte("\x00Y29kZQ\x002:1484661279394:1484664879394\x001\x00"),
-			"code", "2:1484661279394:1484664879394"},
+			"code", "2:1484661279394:1484664879394", false},
 
 		// version 2 range keys (also v4 Schema) don't have the label name or value in the range key
 		{[]byte("\x00\x002:1484661279394:1484664879394\x002\x00"),
-			"", "2:1484661279394:1484664879394"},
+			"", "2:1484661279394:1484664879394", false},
 
 		// version 3 range keys (v5 Schema) have timestamp in first 'dimension'
 		{[]byte("a1b2c3d4\x00\x002:1484661279394:1484664879394\x003\x00"),
-			"", "2:1484661279394:1484664879394"},
+			"", "2:1484661279394:1484664879394", false},
 
 		// version 4 range keys (also v5 Schema) have timestamp in first 'dimension',
 		// base64 value in second
 		{[]byte("a1b2c3d4\x00Y29kZQ\x002:1484661279394:1484664879394\x004\x00"),
-			"code", "2:1484661279394:1484664879394"},
+			"code", "2:1484661279394:1484664879394", false},
+
+		// version 5 range keys (v6 Schema) have the series ID in place of the chunk ID
+		{[]byte("\x00\x00c2VyaWVz\x005\x00"),
+			"", "c2VyaWVz", true},
+
+		// version 6 range keys (also v6 Schema) have the base64 value too
+		{[]byte("\x00Y29kZQ\x00c2VyaWVz\x006\x00"),
+			"code", "c2VyaWVz", true},
 	} {
-		value, chunkID, err := parseRangeValue(c.encoded)
+		value, chunkID, series, err := parseRangeValue(c.encoded)
 		assert.Nil(t, err, "parseRangeValue error")
 		assert.Equal(t, model.LabelValue(c.value), value, "value")
 		assert.Equal(t, c.chunkID, chunkID, "chunkID")
+		assert.Equal(t, c.series, series, "series")
 	}
 }
 
@@ -1,23 +1,30 @@
 package chunk
 
 import (
+	"bytes"
+
 	"golang.org/x/net/context"
 )
 
+// The most index queries a QueryPages call runs at once.
+const maxQueryParallelism = 100
+
 // StorageClient is a client for DynamoDB
 type StorageClient interface {
 	// For the write path
 	NewWriteBatch() WriteBatch
 	BatchWrite(context.Context, WriteBatch) error
 
-	// For the read path
-	QueryPages(ctx context.Context, entry IndexEntry, callback func(result ReadBatch, lastPage bool) (shouldContinue bool)) error
+	// For the read path. QueryPages calls back with each page of the results
+	// of each query, in order for a query, but concurrently for different
+	// queries, until the callback returns false for that query.
+	QueryPages(ctx context.Context, queries []IndexEntry, callback func(query IndexEntry, result ReadBatch) (shouldContinue bool)) error
 
 	// For table management
 	ListTables() ([]string, error)
-	CreateTable(name string, readCapacity, writeCapacity int64) error
-	DescribeTable(name string) (readCapacity, writeCapacity int64, status string, err error)
-	UpdateTable(name string, readCapacity, writeCapacity int64) error
+	CreateTable(desc TableDesc) error
+	DescribeTable(name string) (desc TableDesc, status string, err error)
+	UpdateTable(current, expected TableDesc) error
 }
 
 // WriteBatch represents a batch of writes
@@ -34,3 +41,63 @@ type ReadBatch interface {
 	// metadata was written to the chunk index.
 	Value(index int) []byte
 }
+
+// queryPagesParallel implements QueryPages with a function querying the pages
+// of one entry, running identical queries once and the rest in parallel.
+func queryPagesParallel(ctx context.Context, queries []IndexEntry, callback func(IndexEntry, ReadBatch) bool,
+	queryPages func(context.Context, IndexEntry, func(ReadBatch) bool) error) error {
+	var distinct [][]IndexEntry
+	byKey := map[string]int{}
+	for _, query := range queries {
+		key := indexEntryKey(query)
+		if i, ok := byKey[key]; ok {
+			distinct[i] = append(distinct[i], query)
+			continue
+		}
+		byKey[key] = len(distinct)
+		distinct = append(distinct, []IndexEntry{query})
+	}
+
+	semaphore := make(chan struct{}, maxQueryParallelism)
+	errs := make(chan error)
+	for _, same := range distinct {
+		go func(same []IndexEntry) {
+			semaphore <- struct{}{}
+			defer func() { <-semaphore }()
+
+			stopped := make([]bool, len(same))
+			errs <- queryPages(ctx, same[0], func(result ReadBatch) bool {
+				shouldContinue := false
+				for i, query := range same {
+					if !stopped[i] {
+						stopped[i] = !callback(query, result)
+						shouldContinue = shouldContinue || !stopped[i]
+					}
+				}
+				return shouldContinue
+			})
+		}(same)
+	}
+
+	var lastErr error
+	for range distinct {
+		if err := <-errs; err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+func indexEntryKey(entry IndexEntry) string {
+	var buf bytes.Buffer
+	for _, part := range [][]byte{
+		[]byte(entry.TableName),
+		[]byte(entry.HashValue),
+		entry.RangeValuePrefix,
+		entry.RangeValueStart,
+	} {
+		buf.Write(part)
+		buf.WriteByte(0)
+	}
+	return buf.String()
+}
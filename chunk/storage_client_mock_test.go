@@ -17,8 +17,8 @@ type MockStorage struct {
 }
 
 type mockTable struct {
-	items       map[string][]mockItem
-	write, read int64
+	items map[string][]mockItem
+	desc  TableDesc
 }
 
 type mockItem []byte
@@ -42,46 +42,44 @@ func (m *MockStorage) ListTables() ([]string, error) {
 	return tableNames, nil
 }
 
-func (m *MockStorage) CreateTable(name string, read, write int64) error {
+func (m *MockStorage) CreateTable(desc TableDesc) error {
 	m.mtx.Lock()
 	defer m.mtx.Unlock()
 
-	if _, ok := m.tables[name]; ok {
+	if _, ok := m.tables[desc.Name]; ok {
 		return fmt.Errorf("table already exists")
 	}
 
-	m.tables[name] = &mockTable{
+	m.tables[desc.Name] = &mockTable{
 		items: map[string][]mockItem{},
-		write: write,
-		read:  read,
+		desc:  desc,
 	}
 
 	return nil
 }
 
-func (m *MockStorage) DescribeTable(name string) (readCapacity, writeCapacity int64, status string, err error) {
+func (m *MockStorage) DescribeTable(name string) (desc TableDesc, status string, err error) {
 	m.mtx.RLock()
 	defer m.mtx.RUnlock()
 
 	table, ok := m.tables[name]
 	if !ok {
-		return 0, 0, "", fmt.Errorf("not found")
+		return TableDesc{}, "", fmt.Errorf("not found")
 	}
 
-	return table.read, table.write, dynamodb.TableStatusActive, nil
+	return table.desc, dynamodb.TableStatusActive, nil
 }
 
-func (m *MockStorage) UpdateTable(name string, readCapacity, writeCapacity int64) error {
+func (m *MockStorage) UpdateTable(current, expected TableDesc) error {
 	m.mtx.Lock()
 	defer m.mtx.Unlock()
 
-	table, ok := m.tables[name]
+	table, ok := m.tables[expected.Name]
 	if !ok {
 		return fmt.Errorf("not found")
 	}
 
-	table.read = readCapacity
-	table.write = writeCapacity
+	table.desc = expected
 
 	return nil
 }
@@ -121,7 +119,11 @@ func (m *MockStorage) BatchWrite(ctx context.Context, batch WriteBatch) error {
 	return nil
 }
 
-func (m *MockStorage) QueryPages(ctx context.Context, entry IndexEntry, callback func(result ReadBatch, lastPage bool) (shouldContinue bool)) error {
+func (m *MockStorage) QueryPages(ctx context.Context, queries []IndexEntry, callback func(IndexEntry, ReadBatch) (shouldContinue bool)) error {
+	return queryPagesParallel(ctx, queries, callback, m.queryPages)
+}
+
+func (m *MockStorage) queryPages(ctx context.Context, entry IndexEntry, callback func(ReadBatch) (shouldContinue bool)) error {
 	m.mtx.RLock()
 	defer m.mtx.RUnlock()
 
@@ -181,7 +183,7 @@ func (m *MockStorage) QueryPages(ctx context.Context, entry IndexEntry, callback
 		result = append(result, item)
 	}
 
-	callback(result, true)
+	callback(result)
 	return nil
 }
 
@@ -0,0 +1,51 @@
+package chunk
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestQueryPagesParallel(t *testing.T) {
+	queries := []IndexEntry{
+		{TableName: "table", HashValue: "a"},
+		{TableName: "table", HashValue: "b"},
+		{TableName: "table", HashValue: "a"},
+		{TableName: "table", HashValue: "a", RangeValuePrefix: []byte("prefix")},
+	}
+
+	// Each query has three pages of one row.
+	var queried int32
+	queryPages := func(_ context.Context, entry IndexEntry, callback func(ReadBatch) bool) error {
+		atomic.AddInt32(&queried, 1)
+		for i := 0; i < 3; i++ {
+			if !callback(mockReadBatch{[]byte(entry.HashValue)}) {
+				return nil
+			}
+		}
+		return nil
+	}
+
+	var mtx sync.Mutex
+	pages := map[string]int{}
+	calls := 0
+	err := queryPagesParallel(context.Background(), queries, func(query IndexEntry, result ReadBatch) bool {
+		mtx.Lock()
+		defer mtx.Unlock()
+		calls++
+		key := query.HashValue + string(query.RangeValuePrefix)
+		pages[key]++
+		// Only want the first page of b.
+		return query.HashValue != "b"
+	}, queryPages)
+	require.NoError(t, err)
+
+	// Identical queries are only run once, but both get every page.
+	assert.Equal(t, int32(3), queried)
+	assert.Equal(t, map[string]int{"a": 6, "b": 1, "aprefix": 3}, pages)
+	assert.Equal(t, 10, calls)
+}
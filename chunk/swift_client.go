@@ -0,0 +1,419 @@
+package chunk
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// The most objects Swift is asked to list at once.
+const swiftListLimit = 1000
+
+// SwiftConfig configures an OpenStack Swift object store, used instead of S3
+// if the auth URL is set.
+type SwiftConfig struct {
+	AuthURL           string
+	AuthVersion       int
+	Username          string
+	UserDomainName    string
+	Password          string
+	ProjectName       string
+	ProjectDomainName string
+	RegionName        string
+	ContainerName     string
+	SegmentContainer  string
+	SegmentSize       int
+	RequestTimeout    time.Duration
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet
+func (cfg *SwiftConfig) RegisterFlags(f *flag.FlagSet) {
+	f.StringVar(&cfg.AuthURL, "swift.auth-url", "", "Keystone URL to authenticate with, eg. https://keystone.example.com:5000/v3. If set, chunks are stored in OpenStack Swift instead of S3.")
+	f.IntVar(&cfg.AuthVersion, "swift.auth-version", 0, "Keystone API version, 2 or 3. 0 to take it from the end of -swift.auth-url.")
+	f.StringVar(&cfg.Username, "swift.username", "", "OpenStack user to authenticate as.")
+	f.StringVar(&cfg.UserDomainName, "swift.user-domain-name", "Default", "Domain of the OpenStack user, for Keystone v3.")
+	f.StringVar(&cfg.Password, "swift.password", "", "Password of the OpenStack user.")
+	f.StringVar(&cfg.ProjectName, "swift.project-name", "", "OpenStack project, or tenant for Keystone v2, owning the container.")
+	f.StringVar(&cfg.ProjectDomainName, "swift.project-domain-name", "Default", "Domain of the OpenStack project, for Keystone v3.")
+	f.StringVar(&cfg.RegionName, "swift.region-name", "", "Region of the Swift endpoint to use, from the Keystone catalog. If empty, the first is used.")
+	f.StringVar(&cfg.ContainerName, "swift.container-name", "cortex", "Swift container to store chunks in.")
+	f.StringVar(&cfg.SegmentContainer, "swift.segment-container-name", "", "Swift container to store the segments of large objects in. Defaults to -swift.container-name with _segments appended.")
+	f.IntVar(&cfg.SegmentSize, "swift.segment-size", 1<<30, "Objects larger than this many bytes are uploaded in segments of this size, as static large objects. Must be less than Swift's maximum object size, 5GiB by default.")
+	f.DurationVar(&cfg.RequestTimeout, "swift.request-timeout", 30*time.Second, "Timeout of requests to Keystone and Swift.")
+}
+
+// swiftClient is an S3Client storing objects in an OpenStack Swift
+// container, authenticating with Keystone, and reauthenticating when its
+// token expires.
+type swiftClient struct {
+	cfg    SwiftConfig
+	client *http.Client
+
+	mtx        sync.Mutex
+	token      string
+	storageURL string
+}
+
+// NewSwiftClient makes a new S3Client using Swift, and returns the name of
+// the container to use as the bucket.
+func NewSwiftClient(cfg SwiftConfig) (S3Client, string, error) {
+	if cfg.AuthVersion == 0 {
+		switch {
+		case strings.HasSuffix(strings.TrimSuffix(cfg.AuthURL, "/"), "/v3"):
+			cfg.AuthVersion = 3
+		case strings.HasSuffix(strings.TrimSuffix(cfg.AuthURL, "/"), "/v2.0"):
+			cfg.AuthVersion = 2
+		default:
+			return nil, "", fmt.Errorf("cannot tell the Keystone version of %s; set -swift.auth-version", cfg.AuthURL)
+		}
+	}
+	if cfg.AuthVersion != 2 && cfg.AuthVersion != 3 {
+		return nil, "", fmt.Errorf("unsupported Keystone version %d", cfg.AuthVersion)
+	}
+	if cfg.SegmentContainer == "" {
+		cfg.SegmentContainer = cfg.ContainerName + "_segments"
+	}
+	if cfg.SegmentSize <= 0 {
+		return nil, "", fmt.Errorf("invalid segment size %d", cfg.SegmentSize)
+	}
+
+	c := &swiftClient{
+		cfg:    cfg,
+		client: &http.Client{Timeout: cfg.RequestTimeout},
+	}
+	// Creating a container which exists is harmless.
+	for _, container := range []string{cfg.ContainerName, cfg.SegmentContainer} {
+		resp, err := c.do("PUT", url.PathEscape(container), nil, nil, nil)
+		if err != nil {
+			return nil, "", err
+		}
+		resp.Body.Close()
+	}
+	return c, cfg.ContainerName, nil
+}
+
+// authenticate returns the token and storage URL to use, getting new ones
+// if there are none, or they are the expired token given.
+func (c *swiftClient) authenticate(expired string) (string, string, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.token != "" && c.token != expired {
+		return c.token, c.storageURL, nil
+	}
+
+	var err error
+	if c.cfg.AuthVersion == 2 {
+		c.token, c.storageURL, err = c.authenticateV2()
+	} else {
+		c.token, c.storageURL, err = c.authenticateV3()
+	}
+	if err != nil {
+		c.token, c.storageURL = "", ""
+		return "", "", fmt.Errorf("error authenticating with Keystone: %v", err)
+	}
+	return c.token, c.storageURL, nil
+}
+
+type keystoneEndpoint struct {
+	Region    string `json:"region"`
+	RegionID  string `json:"region_id"`
+	Interface string `json:"interface"`
+	URL       string `json:"url"`
+	PublicURL string `json:"publicURL"`
+}
+
+type keystoneService struct {
+	Type      string             `json:"type"`
+	Endpoints []keystoneEndpoint `json:"endpoints"`
+}
+
+// objectStoreURL finds the public Swift endpoint in the region in a Keystone
+// catalog.
+func (c *swiftClient) objectStoreURL(catalog []keystoneService) (string, error) {
+	for _, service := range catalog {
+		if service.Type != "object-store" {
+			continue
+		}
+		for _, endpoint := range service.Endpoints {
+			if c.cfg.RegionName != "" && endpoint.Region != c.cfg.RegionName && endpoint.RegionID != c.cfg.RegionName {
+				continue
+			}
+			if endpoint.PublicURL != "" {
+				return endpoint.PublicURL, nil
+			}
+			if endpoint.Interface == "public" {
+				return endpoint.URL, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("no public object-store endpoint in region %q in the catalog", c.cfg.RegionName)
+}
+
+func (c *swiftClient) authenticateV2() (string, string, error) {
+	var req struct {
+		Auth struct {
+			PasswordCredentials struct {
+				Username string `json:"username"`
+				Password string `json:"password"`
+			} `json:"passwordCredentials"`
+			TenantName string `json:"tenantName,omitempty"`
+		} `json:"auth"`
+	}
+	req.Auth.PasswordCredentials.Username = c.cfg.Username
+	req.Auth.PasswordCredentials.Password = c.cfg.Password
+	req.Auth.TenantName = c.cfg.ProjectName
+
+	var resp struct {
+		Access struct {
+			Token struct {
+				ID string `json:"id"`
+			} `json:"token"`
+			ServiceCatalog []keystoneService `json:"serviceCatalog"`
+		} `json:"access"`
+	}
+	if _, err := c.postJSON(strings.TrimSuffix(c.cfg.AuthURL, "/")+"/tokens", req, &resp); err != nil {
+		return "", "", err
+	}
+	storageURL, err := c.objectStoreURL(resp.Access.ServiceCatalog)
+	return resp.Access.Token.ID, storageURL, err
+}
+
+type keystoneDomain struct {
+	Name string `json:"name"`
+}
+
+type keystoneScope struct {
+	Project struct {
+		Name   string         `json:"name"`
+		Domain keystoneDomain `json:"domain"`
+	} `json:"project"`
+}
+
+func (c *swiftClient) authenticateV3() (string, string, error) {
+	var req struct {
+		Auth struct {
+			Identity struct {
+				Methods  []string `json:"methods"`
+				Password struct {
+					User struct {
+						Name     string         `json:"name"`
+						Domain   keystoneDomain `json:"domain"`
+						Password string         `json:"password"`
+					} `json:"user"`
+				} `json:"password"`
+			} `json:"identity"`
+			Scope *keystoneScope `json:"scope,omitempty"`
+		} `json:"auth"`
+	}
+	req.Auth.Identity.Methods = []string{"password"}
+	req.Auth.Identity.Password.User.Name = c.cfg.Username
+	req.Auth.Identity.Password.User.Domain.Name = c.cfg.UserDomainName
+	req.Auth.Identity.Password.User.Password = c.cfg.Password
+	if c.cfg.ProjectName != "" {
+		req.Auth.Scope = &keystoneScope{}
+		req.Auth.Scope.Project.Name = c.cfg.ProjectName
+		req.Auth.Scope.Project.Domain.Name = c.cfg.ProjectDomainName
+	}
+
+	var resp struct {
+		Token struct {
+			Catalog []keystoneService `json:"catalog"`
+		} `json:"token"`
+	}
+	header, err := c.postJSON(strings.TrimSuffix(c.cfg.AuthURL, "/")+"/auth/tokens", req, &resp)
+	if err != nil {
+		return "", "", err
+	}
+	storageURL, err := c.objectStoreURL(resp.Token.Catalog)
+	return header.Get("X-Subject-Token"), storageURL, err
+}
+
+func (c *swiftClient) postJSON(url string, req, resp interface{}) (http.Header, error) {
+	buf, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	httpResp, err := c.client.Post(url, "application/json", bytes.NewReader(buf))
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("%s: %s", url, httpResp.Status)
+	}
+	return httpResp.Header, json.NewDecoder(httpResp.Body).Decode(resp)
+}
+
+// do makes a request to Swift of the object or container path, retrying it
+// once if the token has expired.
+func (c *swiftClient) do(method, path string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	var expired string
+	for attempt := 0; ; attempt++ {
+		token, storageURL, err := c.authenticate(expired)
+		if err != nil {
+			return nil, err
+		}
+		u := strings.TrimSuffix(storageURL, "/") + "/" + path
+		if len(query) > 0 {
+			u += "?" + query.Encode()
+		}
+		req, err := http.NewRequest(method, u, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		req.Header.Set("X-Auth-Token", token)
+		resp, err := c.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusUnauthorized && attempt == 0 {
+			resp.Body.Close()
+			expired = token
+			continue
+		}
+		if resp.StatusCode == http.StatusNotFound && method == "GET" {
+			resp.Body.Close()
+			return nil, awserr.New("NoSuchKey", fmt.Sprintf("%s not found", path), nil)
+		}
+		if resp.StatusCode/100 != 2 {
+			resp.Body.Close()
+			return nil, fmt.Errorf("swift %s %s: %s", method, path, resp.Status)
+		}
+		return resp, nil
+	}
+}
+
+func objectPath(container, key string) string {
+	return url.PathEscape(container) + "/" + (&url.URL{Path: key}).EscapedPath()
+}
+
+// PutObject implements S3Client. Objects larger than the segment size are
+// uploaded as static large objects: their segments, then a manifest listing
+// them, which Swift serves as the whole object.
+func (c *swiftClient) PutObject(input *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+	buf, err := ioutil.ReadAll(input.Body)
+	if err != nil {
+		return nil, err
+	}
+	container, key := aws.StringValue(input.Bucket), aws.StringValue(input.Key)
+	if len(buf) <= c.cfg.SegmentSize {
+		resp, err := c.do("PUT", objectPath(container, key), nil, nil, buf)
+		if err != nil {
+			return nil, err
+		}
+		resp.Body.Close()
+		return &s3.PutObjectOutput{}, nil
+	}
+
+	type segment struct {
+		Path      string `json:"path"`
+		Etag      string `json:"etag"`
+		SizeBytes int    `json:"size_bytes"`
+	}
+	var manifest []segment
+	for i := 0; len(buf) > 0; i++ {
+		n := c.cfg.SegmentSize
+		if n > len(buf) {
+			n = len(buf)
+		}
+		name := fmt.Sprintf("%s/%08d", key, i)
+		resp, err := c.do("PUT", objectPath(c.cfg.SegmentContainer, name), nil, nil, buf[:n])
+		if err != nil {
+			return nil, err
+		}
+		resp.Body.Close()
+		sum := md5.Sum(buf[:n])
+		manifest = append(manifest, segment{
+			Path:      "/" + c.cfg.SegmentContainer + "/" + name,
+			Etag:      hex.EncodeToString(sum[:]),
+			SizeBytes: n,
+		})
+		buf = buf[n:]
+	}
+
+	manifestBuf, err := json.Marshal(manifest)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.do("PUT", objectPath(container, key), url.Values{"multipart-manifest": {"put"}}, nil, manifestBuf)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return &s3.PutObjectOutput{}, nil
+}
+
+// GetObject implements S3Client, supporting byte ranges. Missing objects
+// return the same error as S3.
+func (c *swiftClient) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	header := http.Header{}
+	if input.Range != nil {
+		header.Set("Range", *input.Range)
+	}
+	resp, err := c.do("GET", objectPath(aws.StringValue(input.Bucket), aws.StringValue(input.Key)), nil, header, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &s3.GetObjectOutput{Body: resp.Body}, nil
+}
+
+// ListObjectsV2 implements S3Client, supporting Prefix, Delimiter and
+// continuation.
+func (c *swiftClient) ListObjectsV2(input *s3.ListObjectsV2Input) (*s3.ListObjectsV2Output, error) {
+	query := url.Values{
+		"format": {"json"},
+		"limit":  {fmt.Sprint(swiftListLimit)},
+	}
+	if input.Prefix != nil {
+		query.Set("prefix", *input.Prefix)
+	}
+	if input.Delimiter != nil {
+		query.Set("delimiter", *input.Delimiter)
+	}
+	if input.ContinuationToken != nil {
+		query.Set("marker", *input.ContinuationToken)
+	}
+	resp, err := c.do("GET", url.PathEscape(aws.StringValue(input.Bucket)), query, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var entries []struct {
+		Name   string `json:"name"`
+		Subdir string `json:"subdir"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil && err != io.EOF {
+		return nil, err
+	}
+	output := &s3.ListObjectsV2Output{
+		IsTruncated: aws.Bool(len(entries) == swiftListLimit),
+	}
+	for _, entry := range entries {
+		if entry.Subdir != "" {
+			output.CommonPrefixes = append(output.CommonPrefixes, &s3.CommonPrefix{Prefix: aws.String(entry.Subdir)})
+			output.NextContinuationToken = aws.String(entry.Subdir)
+		} else {
+			output.Contents = append(output.Contents, &s3.Object{Key: aws.String(entry.Name)})
+			output.NextContinuationToken = aws.String(entry.Name)
+		}
+	}
+	return output, nil
+}
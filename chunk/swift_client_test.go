@@ -0,0 +1,264 @@
+package chunk
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeSwift is a Keystone and Swift server, storing objects in memory, and
+// serving static large objects.
+type fakeSwift struct {
+	*httptest.Server
+
+	mtx     sync.Mutex
+	tokens  int
+	expired map[string]bool
+	objects map[string][]byte
+	slos    map[string][]string
+}
+
+func newFakeSwift() *fakeSwift {
+	f := &fakeSwift{
+		expired: map[string]bool{},
+		objects: map[string][]byte{},
+		slos:    map[string][]string{},
+	}
+	f.Server = httptest.NewServer(f)
+	return f
+}
+
+func (f *fakeSwift) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	catalog := []keystoneService{{
+		Type: "object-store",
+		Endpoints: []keystoneEndpoint{
+			{Region: "elsewhere", Interface: "public", URL: "http://elsewhere.invalid"},
+			{Region: "here", Interface: "internal", URL: "http://internal.invalid"},
+			{Region: "here", Interface: "public", URL: f.URL + "/swift/v1"},
+		},
+	}}
+	switch {
+	case r.URL.Path == "/v3/auth/tokens":
+		f.tokens++
+		w.Header().Set("X-Subject-Token", fmt.Sprintf("token%d", f.tokens))
+		json.NewEncoder(w).Encode(map[string]interface{}{"token": map[string]interface{}{"catalog": catalog}})
+		return
+	case r.URL.Path == "/v2.0/tokens":
+		f.tokens++
+		// Keystone v2 endpoints have a URL per interface.
+		for i, endpoint := range catalog[0].Endpoints {
+			if endpoint.Interface == "public" {
+				catalog[0].Endpoints[i].PublicURL = endpoint.URL
+			}
+			catalog[0].Endpoints[i].Interface, catalog[0].Endpoints[i].URL = "", ""
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"access": map[string]interface{}{
+			"token":          map[string]string{"id": fmt.Sprintf("token%d", f.tokens)},
+			"serviceCatalog": catalog[:1],
+		}})
+		return
+	}
+
+	if token := r.Header.Get("X-Auth-Token"); token == "" || f.expired[token] {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/swift/v1/")
+	body, _ := ioutil.ReadAll(r.Body)
+	switch {
+	case r.Method == "PUT" && !strings.Contains(path, "/"):
+		w.WriteHeader(http.StatusAccepted)
+	case r.Method == "PUT" && r.URL.Query().Get("multipart-manifest") == "put":
+		var manifest []struct {
+			Path      string `json:"path"`
+			SizeBytes int    `json:"size_bytes"`
+		}
+		json.Unmarshal(body, &manifest)
+		var segments []string
+		for _, segment := range manifest {
+			segments = append(segments, strings.TrimPrefix(segment.Path, "/"))
+		}
+		f.slos[path] = segments
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == "PUT":
+		f.objects[path] = body
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == "GET" && !strings.Contains(path, "/"):
+		f.list(w, path, r.URL.Query().Get("prefix"), r.URL.Query().Get("delimiter"), r.URL.Query().Get("marker"))
+	case r.Method == "GET":
+		buf, ok := f.objects[path]
+		if segments, isSLO := f.slos[path]; isSLO {
+			buf, ok = nil, true
+			for _, segment := range segments {
+				buf = append(buf, f.objects[segment]...)
+			}
+		}
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if rng := r.Header.Get("Range"); rng != "" {
+			var start, end int
+			fmt.Sscanf(rng, "bytes=%d-%d", &start, &end)
+			buf = buf[start : end+1]
+		}
+		w.Write(buf)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (f *fakeSwift) list(w http.ResponseWriter, container, prefix, delimiter, marker string) {
+	type entry struct {
+		Name   string `json:"name,omitempty"`
+		Subdir string `json:"subdir,omitempty"`
+	}
+	seen := map[string]bool{}
+	var names, keys []string
+	for key := range f.objects {
+		keys = append(keys, key)
+	}
+	for key := range f.slos {
+		keys = append(keys, key)
+	}
+	for _, key := range keys {
+		if !strings.HasPrefix(key, container+"/") {
+			continue
+		}
+		name := strings.TrimPrefix(key, container+"/")
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		if i := strings.Index(name[len(prefix):], delimiter); delimiter != "" && i >= 0 {
+			name = name[:len(prefix)+i+len(delimiter)]
+		}
+		if !seen[name] && name > marker {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	entries := []entry{}
+	for _, name := range names {
+		if delimiter != "" && strings.HasSuffix(name, delimiter) {
+			entries = append(entries, entry{Subdir: name})
+		} else {
+			entries = append(entries, entry{Name: name})
+		}
+	}
+	json.NewEncoder(w).Encode(entries)
+}
+
+func TestSwiftClient(t *testing.T) {
+	for _, version := range []string{"v2.0", "v3"} {
+		t.Run(version, func(t *testing.T) {
+			f := newFakeSwift()
+			defer f.Close()
+
+			client, container, err := NewSwiftClient(SwiftConfig{
+				AuthURL:       f.URL + "/" + version,
+				RegionName:    "here",
+				ContainerName: "cortex",
+				SegmentSize:   4,
+			})
+			require.NoError(t, err)
+			assert.Equal(t, "cortex", container)
+
+			put := func(key, value string) {
+				_, err := client.PutObject(&s3.PutObjectInput{
+					Bucket: aws.String(container),
+					Key:    aws.String(key),
+					Body:   bytes.NewReader([]byte(value)),
+				})
+				require.NoError(t, err)
+			}
+			get := func(key string, byteRange *string) (string, error) {
+				resp, err := client.GetObject(&s3.GetObjectInput{
+					Bucket: aws.String(container),
+					Key:    aws.String(key),
+					Range:  byteRange,
+				})
+				if err != nil {
+					return "", err
+				}
+				defer resp.Body.Close()
+				buf, err := ioutil.ReadAll(resp.Body)
+				return string(buf), err
+			}
+
+			put("user1/small", "abc")
+			put("user1/large", "0123456789")
+			put("user2/small", "def")
+
+			value, err := get("user1/small", nil)
+			require.NoError(t, err)
+			assert.Equal(t, "abc", value)
+
+			// Large objects are uploaded in segments.
+			value, err = get("user1/large", nil)
+			require.NoError(t, err)
+			assert.Equal(t, "0123456789", value)
+			assert.Equal(t, "4567", string(f.objects["cortex_segments/user1/large/00000001"]))
+			value, err = get("user1/large", aws.String("bytes=3-5"))
+			require.NoError(t, err)
+			assert.Equal(t, "345", value)
+
+			// Missing objects are reported like S3 does.
+			_, err = get("user1/missing", nil)
+			require.Error(t, err)
+			awsErr, ok := err.(awserr.Error)
+			require.True(t, ok)
+			assert.Equal(t, "NoSuchKey", awsErr.Code())
+
+			// Expired tokens are replaced.
+			f.mtx.Lock()
+			f.expired[fmt.Sprintf("token%d", f.tokens)] = true
+			f.mtx.Unlock()
+			value, err = get("user2/small", nil)
+			require.NoError(t, err)
+			assert.Equal(t, "def", value)
+			assert.Equal(t, 2, f.tokens)
+
+			resp, err := client.ListObjectsV2(&s3.ListObjectsV2Input{
+				Bucket:    aws.String(container),
+				Delimiter: aws.String("/"),
+			})
+			require.NoError(t, err)
+			require.Len(t, resp.CommonPrefixes, 2)
+			assert.Equal(t, "user1/", aws.StringValue(resp.CommonPrefixes[0].Prefix))
+			assert.Equal(t, "user2/", aws.StringValue(resp.CommonPrefixes[1].Prefix))
+			assert.False(t, aws.BoolValue(resp.IsTruncated))
+
+			resp, err = client.ListObjectsV2(&s3.ListObjectsV2Input{
+				Bucket: aws.String(container),
+				Prefix: aws.String("user1/"),
+			})
+			require.NoError(t, err)
+			require.Len(t, resp.Contents, 2)
+			assert.Equal(t, "user1/large", aws.StringValue(resp.Contents[0].Key))
+		})
+	}
+}
+
+func TestSwiftClientAuthVersion(t *testing.T) {
+	_, _, err := NewSwiftClient(SwiftConfig{AuthURL: "http://keystone.invalid/", SegmentSize: 1})
+	assert.Error(t, err)
+	_, _, err = NewSwiftClient(SwiftConfig{AuthURL: "http://keystone.invalid/v3", AuthVersion: 1, SegmentSize: 1})
+	assert.Error(t, err)
+}
@@ -0,0 +1,104 @@
+package chunk
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/common/log"
+	"golang.org/x/net/context"
+	"golang.org/x/net/context/ctxhttp"
+
+	"github.com/weaveworks/common/mtime"
+)
+
+// InactiveReadScaleConfig configures scaling the read throughput of inactive
+// tables to the capacity queries of them consume.
+type InactiveReadScaleConfig struct {
+	MetricsURL        string
+	UsageWindow       time.Duration
+	TargetUtilisation float64
+	MaxThroughput     int64
+	ScaleDownDelay    time.Duration
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet
+func (cfg *InactiveReadScaleConfig) RegisterFlags(f *flag.FlagSet) {
+	f.StringVar(&cfg.MetricsURL, "dynamodb.periodic-table.inactive-read-scale.metrics-url", "", "URL of Prometheus, scraping the queriers, to learn the read capacity consumed by queries of inactive tables. If empty, their read throughput isn't scaled.")
+	f.DurationVar(&cfg.UsageWindow, "dynamodb.periodic-table.inactive-read-scale.usage-window", 15*time.Minute, "Period over which to average the read capacity consumed by queries.")
+	f.Float64Var(&cfg.TargetUtilisation, "dynamodb.periodic-table.inactive-read-scale.target-utilisation", 0.8, "Fraction of inactive tables' read throughput queries should consume.")
+	f.Int64Var(&cfg.MaxThroughput, "dynamodb.periodic-table.inactive-read-scale.max-read-throughput", 1000, "Most read throughput to scale inactive tables to.")
+	f.DurationVar(&cfg.ScaleDownDelay, "dynamodb.periodic-table.inactive-read-scale.scale-down-delay", time.Hour, "How long after it last changed to wait before lowering an inactive table's read throughput, as DynamoDB limits decreases per day.")
+}
+
+// readUsage returns the read capacity units per second consumed by queries of
+// each table, as recorded in Prometheus.
+func (m *DynamoTableManager) readUsage(ctx context.Context) (map[string]float64, error) {
+	query := fmt.Sprintf(`sum by (%s) (rate(cortex_dynamo_consumed_capacity_total{operation="DynamoDB.QueryPages"}[%ds]))`,
+		tableNameLabel, int64(m.cfg.InactiveReadScale.UsageWindow/time.Second))
+	resp, err := ctxhttp.Get(ctx, http.DefaultClient, m.cfg.InactiveReadScale.MetricsURL+"/api/v1/query?query="+url.QueryEscape(query))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error querying read usage: %s", resp.Status)
+	}
+
+	var result struct {
+		Data struct {
+			Result []struct {
+				Metric map[string]string `json:"metric"`
+				Value  [2]interface{}    `json:"value"`
+			} `json:"result"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	usage := map[string]float64{}
+	for _, sample := range result.Data.Result {
+		value, ok := sample.Value[1].(string)
+		if !ok {
+			return nil, fmt.Errorf("unexpected sample value %v", sample.Value[1])
+		}
+		if usage[sample.Metric[tableNameLabel]], err = strconv.ParseFloat(value, 64); err != nil {
+			return nil, err
+		}
+	}
+	return usage, nil
+}
+
+// scaleInactiveRead returns the read throughput an inactive table needs for
+// queries consuming the usage, between the inactive and maximum throughputs.
+// It is raised at once, but only lowered once it has been unchanged for the
+// scale down delay.
+func (m *DynamoTableManager) scaleInactiveRead(name string, current int64, usage float64) int64 {
+	cfg := m.cfg.InactiveReadScale
+	desired := int64(math.Ceil(usage / cfg.TargetUtilisation))
+	if desired < m.cfg.InactiveReadThroughput {
+		desired = m.cfg.InactiveReadThroughput
+	}
+	if desired > cfg.MaxThroughput {
+		desired = cfg.MaxThroughput
+	}
+
+	now := mtime.Now()
+	lastChanged, ok := m.readScaledAt[name]
+	if !ok {
+		// We don't know when it last changed, so assume it just did.
+		lastChanged = now
+		m.readScaledAt[name] = now
+	}
+	if desired == current || (desired < current && now.Sub(lastChanged) < cfg.ScaleDownDelay) {
+		return current
+	}
+	log.Infof("Scaling read throughput of inactive table %s from %d to %d for %.1f units/s consumed by queries", name, current, desired, usage)
+	m.readScaledAt[name] = now
+	return desired
+}
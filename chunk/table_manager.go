@@ -2,8 +2,10 @@ package chunk
 
 import (
 	"flag"
+	"fmt"
 	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -57,6 +59,11 @@ type TableManagerConfig struct {
 	ProvisionedReadThroughput  int64
 	InactiveWriteThroughput    int64
 	InactiveReadThroughput     int64
+	OnDemand                   bool
+	InactiveOnDemand           bool
+	Tags                       Tags
+	TTLAttribute               string
+	InactiveReadScale          InactiveReadScaleConfig
 }
 
 // RegisterFlags adds the flags required to config this to the given FlagSet
@@ -69,8 +76,13 @@ func (cfg *TableManagerConfig) RegisterFlags(f *flag.FlagSet) {
 	f.Int64Var(&cfg.ProvisionedReadThroughput, "dynamodb.periodic-table.read-throughput", 300, "DynamoDB periodic tables read throughput")
 	f.Int64Var(&cfg.InactiveWriteThroughput, "dynamodb.periodic-table.inactive-write-throughput", 1, "DynamoDB periodic tables write throughput for inactive tables.")
 	f.Int64Var(&cfg.InactiveReadThroughput, "dynamodb.periodic-table.inactive-read-throughput", 300, "DynamoDB periodic tables read throughput for inactive tables")
+	f.BoolVar(&cfg.OnDemand, "dynamodb.periodic-table.on-demand", false, "Bill DynamoDB tables being written to per request, instead of provisioning throughput.")
+	f.BoolVar(&cfg.InactiveOnDemand, "dynamodb.periodic-table.inactive-on-demand", false, "Bill inactive DynamoDB tables per request, instead of provisioning throughput.")
+	f.Var(&cfg.Tags, "dynamodb.table.tag", "Tag, as key=value, to put on DynamoDB tables, eg. to allocate their cost. May be repeated.")
+	f.StringVar(&cfg.TTLAttribute, "dynamodb.table.ttl-attribute", "", "Enable DynamoDB TTL on tables, expiring items at the time in this attribute. If empty, TTL is disabled.")
 
 	cfg.PeriodicTableConfig.RegisterFlags(f)
+	cfg.InactiveReadScale.RegisterFlags(f)
 }
 
 // PeriodicTableConfig for the use of periodic tables (ie, weekly talbes).  Can
@@ -98,6 +110,9 @@ type DynamoTableManager struct {
 	cfg       TableManagerConfig
 	done      chan struct{}
 	wait      sync.WaitGroup
+
+	// When the read throughput of each inactive table was last scaled.
+	readScaledAt map[string]time.Time
 }
 
 // NewDynamoTableManager makes a new DynamoTableManager
@@ -116,6 +131,8 @@ func NewDynamoTableManager(cfg TableManagerConfig) (*DynamoTableManager, error)
 		dynamoDB:  dynamoDBClient,
 		tableName: tableName,
 		done:      make(chan struct{}),
+
+		readScaledAt: map[string]time.Time{},
 	}
 	return m, nil
 }
@@ -174,30 +191,89 @@ func (m *DynamoTableManager) syncTables(ctx context.Context) error {
 	return m.updateTables(ctx, toCheckThroughput)
 }
 
-type tableDescription struct {
-	name             string
-	provisionedRead  int64
-	provisionedWrite int64
+// TableDesc describes a table.
+type TableDesc struct {
+	Name             string
+	ProvisionedRead  int64
+	ProvisionedWrite int64
+	// On-demand tables are billed per request, and have no provisioned
+	// throughput.
+	OnDemand     bool
+	Tags         Tags
+	TTLAttribute string
+
+	// Inactive tables are past their active period.
+	inactive bool
+}
+
+// Equals returns true if other matches desc, ignoring throughput for on-demand
+// tables.
+func (desc TableDesc) Equals(other TableDesc) bool {
+	if desc.OnDemand != other.OnDemand || desc.TTLAttribute != other.TTLAttribute || !desc.Tags.Equals(other.Tags) {
+		return false
+	}
+	return desc.OnDemand || (desc.ProvisionedRead == other.ProvisionedRead && desc.ProvisionedWrite == other.ProvisionedWrite)
+}
+
+// Tags are the key-value pairs tables are tagged with, to allocate their cost.
+// As a flag, each value is a key=value pair.
+type Tags map[string]string
+
+// String implements flag.Value
+func (ts Tags) String() string {
+	if ts == nil {
+		return ""
+	}
+	keys := make([]string, 0, len(ts))
+	for k := range ts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		pairs = append(pairs, k+"="+ts[k])
+	}
+	return strings.Join(pairs, ",")
+}
+
+// Set implements flag.Value
+func (ts *Tags) Set(s string) error {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return fmt.Errorf("tag must be of the form key=value, got %q", s)
+	}
+	if *ts == nil {
+		*ts = Tags{}
+	}
+	(*ts)[parts[0]] = parts[1]
+	return nil
+}
+
+// Equals returns true if ts has the same tags as other.
+func (ts Tags) Equals(other Tags) bool {
+	if len(ts) != len(other) {
+		return false
+	}
+	for k, v := range ts {
+		if other[k] != v {
+			return false
+		}
+	}
+	return true
 }
 
-type byName []tableDescription
+type byName []TableDesc
 
 func (a byName) Len() int           { return len(a) }
 func (a byName) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
-func (a byName) Less(i, j int) bool { return a[i].name < a[j].name }
+func (a byName) Less(i, j int) bool { return a[i].Name < a[j].Name }
 
-func (m *DynamoTableManager) calculateExpectedTables() []tableDescription {
+func (m *DynamoTableManager) calculateExpectedTables() []TableDesc {
 	if !m.cfg.UsePeriodicTables {
-		return []tableDescription{
-			{
-				name:             m.tableName,
-				provisionedRead:  m.cfg.ProvisionedReadThroughput,
-				provisionedWrite: m.cfg.ProvisionedWriteThroughput,
-			},
-		}
+		return []TableDesc{m.activeTable(m.tableName)}
 	}
 
-	result := []tableDescription{}
+	result := []TableDesc{}
 
 	var (
 		tablePeriodSecs = int64(m.cfg.TablePeriod / time.Second)
@@ -210,32 +286,23 @@ func (m *DynamoTableManager) calculateExpectedTables() []tableDescription {
 
 	// Add the legacy table
 	{
-		legacyTable := tableDescription{
-			name:             m.tableName,
-			provisionedRead:  m.cfg.InactiveReadThroughput,
-			provisionedWrite: m.cfg.InactiveWriteThroughput,
-		}
+		legacyTable := m.inactiveTable(m.tableName)
 
 		// if we are before the switch to periodic table, we need to give this table write throughput
 		if now < (firstTable*tablePeriodSecs)+gracePeriodSecs+maxChunkAgeSecs {
-			legacyTable.provisionedRead = m.cfg.ProvisionedReadThroughput
-			legacyTable.provisionedWrite = m.cfg.ProvisionedWriteThroughput
+			legacyTable = m.activeTable(m.tableName)
 		}
 		result = append(result, legacyTable)
 	}
 
 	for i := firstTable; i <= lastTable; i++ {
-		table := tableDescription{
-			// Name construction needs to be consistent with chunk_store.bigBuckets
-			name:             m.cfg.TablePrefix + strconv.Itoa(int(i)),
-			provisionedRead:  m.cfg.InactiveReadThroughput,
-			provisionedWrite: m.cfg.InactiveWriteThroughput,
-		}
+		// Name construction needs to be consistent with chunk_store.bigBuckets
+		name := m.cfg.TablePrefix + strconv.Itoa(int(i))
+		table := m.inactiveTable(name)
 
 		// if now is within table [start - grace, end + grace), then we need some write throughput
 		if (i*tablePeriodSecs)-gracePeriodSecs <= now && now < (i*tablePeriodSecs)+tablePeriodSecs+gracePeriodSecs+maxChunkAgeSecs {
-			table.provisionedRead = m.cfg.ProvisionedReadThroughput
-			table.provisionedWrite = m.cfg.ProvisionedWriteThroughput
+			table = m.activeTable(name)
 		}
 		result = append(result, table)
 	}
@@ -244,8 +311,39 @@ func (m *DynamoTableManager) calculateExpectedTables() []tableDescription {
 	return result
 }
 
+// activeTable describes a table being written to.
+func (m *DynamoTableManager) activeTable(name string) TableDesc {
+	table := TableDesc{
+		Name:         name,
+		OnDemand:     m.cfg.OnDemand,
+		Tags:         m.cfg.Tags,
+		TTLAttribute: m.cfg.TTLAttribute,
+	}
+	if !table.OnDemand {
+		table.ProvisionedRead = m.cfg.ProvisionedReadThroughput
+		table.ProvisionedWrite = m.cfg.ProvisionedWriteThroughput
+	}
+	return table
+}
+
+// inactiveTable describes a table only being read from.
+func (m *DynamoTableManager) inactiveTable(name string) TableDesc {
+	table := TableDesc{
+		Name:         name,
+		OnDemand:     m.cfg.InactiveOnDemand,
+		Tags:         m.cfg.Tags,
+		TTLAttribute: m.cfg.TTLAttribute,
+		inactive:     true,
+	}
+	if !table.OnDemand {
+		table.ProvisionedRead = m.cfg.InactiveReadThroughput
+		table.ProvisionedWrite = m.cfg.InactiveWriteThroughput
+	}
+	return table
+}
+
 // partitionTables works out tables that need to be created vs tables that need to be updated
-func (m *DynamoTableManager) partitionTables(ctx context.Context, descriptions []tableDescription) ([]tableDescription, []tableDescription, error) {
+func (m *DynamoTableManager) partitionTables(ctx context.Context, descriptions []TableDesc) ([]TableDesc, []TableDesc, error) {
 	var existingTables []string
 	if err := instrument.TimeRequestHistogram(ctx, "DynamoDB.ListTablesPages", dynamoRequestDuration, func(_ context.Context) error {
 		var err error
@@ -256,15 +354,15 @@ func (m *DynamoTableManager) partitionTables(ctx context.Context, descriptions [
 	}
 	sort.Strings(existingTables)
 
-	toCreate, toCheckThroughput := []tableDescription{}, []tableDescription{}
+	toCreate, toCheckThroughput := []TableDesc{}, []TableDesc{}
 	i, j := 0, 0
 	for i < len(descriptions) && j < len(existingTables) {
-		if descriptions[i].name < existingTables[j] {
+		if descriptions[i].Name < existingTables[j] {
 			// Table descriptions[i] doesn't exist
 			toCreate = append(toCreate, descriptions[i])
 			i++
-		} else if descriptions[i].name > existingTables[j] {
-			// existingTables[j].name isn't in descriptions, can ignore
+		} else if descriptions[i].Name > existingTables[j] {
+			// existingTables[j].Name isn't in descriptions, can ignore
 			j++
 		} else {
 			// Table exists, need to check it has correct throughput
@@ -280,11 +378,11 @@ func (m *DynamoTableManager) partitionTables(ctx context.Context, descriptions [
 	return toCreate, toCheckThroughput, nil
 }
 
-func (m *DynamoTableManager) createTables(ctx context.Context, descriptions []tableDescription) error {
+func (m *DynamoTableManager) createTables(ctx context.Context, descriptions []TableDesc) error {
 	for _, desc := range descriptions {
-		log.Infof("Creating table %s", desc.name)
+		log.Infof("Creating table %s", desc.Name)
 		if err := instrument.TimeRequestHistogram(ctx, "DynamoDB.CreateTable", dynamoRequestDuration, func(_ context.Context) error {
-			return m.dynamoDB.CreateTable(desc.name, desc.provisionedRead, desc.provisionedWrite)
+			return m.dynamoDB.CreateTable(desc)
 		}); err != nil {
 			return err
 		}
@@ -292,35 +390,52 @@ func (m *DynamoTableManager) createTables(ctx context.Context, descriptions []ta
 	return nil
 }
 
-func (m *DynamoTableManager) updateTables(ctx context.Context, descriptions []tableDescription) error {
-	for _, desc := range descriptions {
-		log.Infof("Checking provisioned throughput on table %s", desc.name)
-		var readCapacity, writeCapacity int64
+func (m *DynamoTableManager) updateTables(ctx context.Context, descriptions []TableDesc) error {
+	var readUsage map[string]float64
+	if m.cfg.InactiveReadScale.MetricsURL != "" {
+		var err error
+		if readUsage, err = m.readUsage(ctx); err != nil {
+			log.Warnf("Not scaling inactive tables' read throughput, error getting read usage: %v", err)
+		}
+	}
+
+	for _, expected := range descriptions {
+		log.Infof("Checking provisioned throughput on table %s", expected.Name)
+		var current TableDesc
 		var status string
 		if err := instrument.TimeRequestHistogram(ctx, "DynamoDB.DescribeTable", dynamoRequestDuration, func(_ context.Context) error {
 			var err error
-			readCapacity, writeCapacity, status, err = m.dynamoDB.DescribeTable(desc.name)
+			current, status, err = m.dynamoDB.DescribeTable(expected.Name)
 			return err
 		}); err != nil {
 			return err
 		}
 
 		if status != dynamodb.TableStatusActive {
-			log.Infof("Skipping update on  table %s, not yet ACTIVE (%s)", desc.name, status)
+			log.Infof("Skipping update on  table %s, not yet ACTIVE (%s)", expected.Name, status)
 			continue
 		}
 
-		tableCapacity.WithLabelValues(readLabel, desc.name).Set(float64(readCapacity))
-		tableCapacity.WithLabelValues(writeLabel, desc.name).Set(float64(writeCapacity))
+		if expected.inactive && !expected.OnDemand && m.cfg.InactiveReadScale.MetricsURL != "" {
+			if readUsage != nil {
+				expected.ProvisionedRead = m.scaleInactiveRead(expected.Name, current.ProvisionedRead, readUsage[expected.Name])
+			} else if !current.OnDemand {
+				expected.ProvisionedRead = current.ProvisionedRead
+			}
+		}
 
-		if readCapacity == desc.provisionedRead && writeCapacity == desc.provisionedWrite {
-			log.Infof("  Provisioned throughput: read = %d, write = %d, skipping.", readCapacity, writeCapacity)
+		tableCapacity.WithLabelValues(readLabel, expected.Name).Set(float64(current.ProvisionedRead))
+		tableCapacity.WithLabelValues(writeLabel, expected.Name).Set(float64(current.ProvisionedWrite))
+
+		if current.Equals(expected) {
+			log.Infof("  Provisioned throughput: read = %d, write = %d, on demand = %v, skipping.", current.ProvisionedRead, current.ProvisionedWrite, current.OnDemand)
 			continue
 		}
 
-		log.Infof("  Updating provisioned throughput on table %s to read = %d, write = %d", desc.name, desc.provisionedRead, desc.provisionedWrite)
-		if err := instrument.TimeRequestHistogram(ctx, "DynamoDB.DescribeTable", dynamoRequestDuration, func(_ context.Context) error {
-			return m.dynamoDB.UpdateTable(desc.name, desc.provisionedRead, desc.provisionedWrite)
+		log.Infof("  Updating table %s to read = %d, write = %d, on demand = %v, tags = %v, TTL attribute = %q",
+			expected.Name, expected.ProvisionedRead, expected.ProvisionedWrite, expected.OnDemand, expected.Tags, expected.TTLAttribute)
+		if err := instrument.TimeRequestHistogram(ctx, "DynamoDB.UpdateTable", dynamoRequestDuration, func(_ context.Context) error {
+			return m.dynamoDB.UpdateTable(current, expected)
 		}); err != nil {
 			return err
 		}
@@ -1,6 +1,9 @@
 package chunk
 
 import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"sort"
 	"testing"
 	"time"
@@ -50,7 +53,7 @@ func TestDynamoTableManager(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	test := func(name string, tm time.Time, expected []tableDescription) {
+	test := func(name string, tm time.Time, expected []TableDesc) {
 		t.Run(name, func(t *testing.T) {
 			mtime.NowForce(tm)
 			if err := tableManager.syncTables(context.Background()); err != nil {
@@ -64,9 +67,9 @@ func TestDynamoTableManager(t *testing.T) {
 	test(
 		"Initial test",
 		time.Unix(0, 0),
-		[]tableDescription{
-			{name: "", provisionedRead: read, provisionedWrite: write},
-			{name: tablePrefix + "0", provisionedRead: read, provisionedWrite: write},
+		[]TableDesc{
+			{Name: "", ProvisionedRead: read, ProvisionedWrite: write},
+			{Name: tablePrefix + "0", ProvisionedRead: read, ProvisionedWrite: write},
 		},
 	)
 
@@ -74,9 +77,9 @@ func TestDynamoTableManager(t *testing.T) {
 	test(
 		"Nothing changed",
 		time.Unix(0, 0),
-		[]tableDescription{
-			{name: "", provisionedRead: read, provisionedWrite: write},
-			{name: tablePrefix + "0", provisionedRead: read, provisionedWrite: write},
+		[]TableDesc{
+			{Name: "", ProvisionedRead: read, ProvisionedWrite: write},
+			{Name: tablePrefix + "0", ProvisionedRead: read, ProvisionedWrite: write},
 		},
 	)
 
@@ -84,9 +87,9 @@ func TestDynamoTableManager(t *testing.T) {
 	test(
 		"Move forward by grace period",
 		time.Unix(0, 0).Add(gracePeriod),
-		[]tableDescription{
-			{name: "", provisionedRead: read, provisionedWrite: write},
-			{name: tablePrefix + "0", provisionedRead: read, provisionedWrite: write},
+		[]TableDesc{
+			{Name: "", ProvisionedRead: read, ProvisionedWrite: write},
+			{Name: tablePrefix + "0", ProvisionedRead: read, ProvisionedWrite: write},
 		},
 	)
 
@@ -94,9 +97,9 @@ func TestDynamoTableManager(t *testing.T) {
 	test(
 		"Move forward by max chunk age + grace period",
 		time.Unix(0, 0).Add(maxChunkAge).Add(gracePeriod),
-		[]tableDescription{
-			{name: "", provisionedRead: inactiveRead, provisionedWrite: inactiveWrite},
-			{name: tablePrefix + "0", provisionedRead: read, provisionedWrite: write},
+		[]TableDesc{
+			{Name: "", ProvisionedRead: inactiveRead, ProvisionedWrite: inactiveWrite},
+			{Name: tablePrefix + "0", ProvisionedRead: read, ProvisionedWrite: write},
 		},
 	)
 
@@ -104,10 +107,10 @@ func TestDynamoTableManager(t *testing.T) {
 	test(
 		"Move forward by table period - grace period",
 		time.Unix(0, 0).Add(tablePeriod).Add(-gracePeriod),
-		[]tableDescription{
-			{name: "", provisionedRead: inactiveRead, provisionedWrite: inactiveWrite},
-			{name: tablePrefix + "0", provisionedRead: read, provisionedWrite: write},
-			{name: tablePrefix + "1", provisionedRead: read, provisionedWrite: write},
+		[]TableDesc{
+			{Name: "", ProvisionedRead: inactiveRead, ProvisionedWrite: inactiveWrite},
+			{Name: tablePrefix + "0", ProvisionedRead: read, ProvisionedWrite: write},
+			{Name: tablePrefix + "1", ProvisionedRead: read, ProvisionedWrite: write},
 		},
 	)
 
@@ -115,10 +118,10 @@ func TestDynamoTableManager(t *testing.T) {
 	test(
 		"Move forward by table period + grace period",
 		time.Unix(0, 0).Add(tablePeriod).Add(gracePeriod),
-		[]tableDescription{
-			{name: "", provisionedRead: inactiveRead, provisionedWrite: inactiveWrite},
-			{name: tablePrefix + "0", provisionedRead: read, provisionedWrite: write},
-			{name: tablePrefix + "1", provisionedRead: read, provisionedWrite: write},
+		[]TableDesc{
+			{Name: "", ProvisionedRead: inactiveRead, ProvisionedWrite: inactiveWrite},
+			{Name: tablePrefix + "0", ProvisionedRead: read, ProvisionedWrite: write},
+			{Name: tablePrefix + "1", ProvisionedRead: read, ProvisionedWrite: write},
 		},
 	)
 
@@ -126,10 +129,10 @@ func TestDynamoTableManager(t *testing.T) {
 	test(
 		"Move forward by table period + max chunk age + grace period",
 		time.Unix(0, 0).Add(tablePeriod).Add(maxChunkAge).Add(gracePeriod),
-		[]tableDescription{
-			{name: "", provisionedRead: inactiveRead, provisionedWrite: inactiveWrite},
-			{name: tablePrefix + "0", provisionedRead: inactiveRead, provisionedWrite: inactiveWrite},
-			{name: tablePrefix + "1", provisionedRead: read, provisionedWrite: write},
+		[]TableDesc{
+			{Name: "", ProvisionedRead: inactiveRead, ProvisionedWrite: inactiveWrite},
+			{Name: tablePrefix + "0", ProvisionedRead: inactiveRead, ProvisionedWrite: inactiveWrite},
+			{Name: tablePrefix + "1", ProvisionedRead: read, ProvisionedWrite: write},
 		},
 	)
 
@@ -137,15 +140,15 @@ func TestDynamoTableManager(t *testing.T) {
 	test(
 		"Nothing changed",
 		time.Unix(0, 0).Add(tablePeriod).Add(maxChunkAge).Add(gracePeriod),
-		[]tableDescription{
-			{name: "", provisionedRead: inactiveRead, provisionedWrite: inactiveWrite},
-			{name: tablePrefix + "0", provisionedRead: inactiveRead, provisionedWrite: inactiveWrite},
-			{name: tablePrefix + "1", provisionedRead: read, provisionedWrite: write},
+		[]TableDesc{
+			{Name: "", ProvisionedRead: inactiveRead, ProvisionedWrite: inactiveWrite},
+			{Name: tablePrefix + "0", ProvisionedRead: inactiveRead, ProvisionedWrite: inactiveWrite},
+			{Name: tablePrefix + "1", ProvisionedRead: read, ProvisionedWrite: write},
 		},
 	)
 }
 
-func expectTables(t *testing.T, dynamo StorageClient, expected []tableDescription) {
+func expectTables(t *testing.T, dynamo StorageClient, expected []TableDesc) {
 	tables, err := dynamo.ListTables()
 	if err != nil {
 		t.Fatal(err)
@@ -159,21 +162,139 @@ func expectTables(t *testing.T, dynamo StorageClient, expected []tableDescriptio
 	sort.Sort(byName(expected))
 
 	for i, desc := range expected {
-		if tables[i] != desc.name {
-			t.Fatalf("Expected '%s', found '%s'", desc.name, tables[i])
+		if tables[i] != desc.Name {
+			t.Fatalf("Expected '%s', found '%s'", desc.Name, tables[i])
 		}
 
-		read, write, _, err := dynamo.DescribeTable(desc.name)
+		actual, _, err := dynamo.DescribeTable(desc.Name)
 		if err != nil {
 			t.Fatal(err)
 		}
 
-		if read != desc.provisionedRead {
-			t.Fatalf("Expected '%d', found '%d' for table '%s'", desc.provisionedRead, read, desc.name)
+		if !actual.Equals(desc) {
+			t.Fatalf("Expected '%v', found '%v' for table '%s'", desc, actual, desc.Name)
 		}
+	}
+}
 
-		if write != desc.provisionedWrite {
-			t.Fatalf("Expected '%d', found '%d' for table '%s'", desc.provisionedWrite, write, desc.name)
-		}
+func TestDynamoTableManagerOnDemand(t *testing.T) {
+	dynamoDB := NewMockStorage()
+	tags := Tags{"team": "cortex"}
+
+	tableManager, err := NewDynamoTableManager(TableManagerConfig{
+		mockDynamoDB: dynamoDB,
+
+		PeriodicTableConfig: PeriodicTableConfig{
+			UsePeriodicTables: true,
+			TablePrefix:       tablePrefix,
+			TablePeriod:       tablePeriod,
+			PeriodicTableStartAt: util.DayValue{
+				Time: model.TimeFromUnix(0),
+			},
+		},
+
+		CreationGracePeriod:        gracePeriod,
+		MaxChunkAge:                maxChunkAge,
+		ProvisionedWriteThroughput: write,
+		ProvisionedReadThroughput:  read,
+		InactiveOnDemand:           true,
+		Tags:                       tags,
+		TTLAttribute:               "ttl",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mtime.NowForce(time.Unix(0, 0).Add(tablePeriod).Add(maxChunkAge).Add(gracePeriod))
+	defer mtime.NowReset()
+	if err := tableManager.syncTables(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	expectTables(t, dynamoDB, []TableDesc{
+		{Name: "", OnDemand: true, Tags: tags, TTLAttribute: "ttl"},
+		{Name: tablePrefix + "0", OnDemand: true, Tags: tags, TTLAttribute: "ttl"},
+		{Name: tablePrefix + "1", ProvisionedRead: read, ProvisionedWrite: write, Tags: tags, TTLAttribute: "ttl"},
+	})
+
+	// Changed tags and TTL are applied to existing tables.
+	tableManager.cfg.Tags = Tags{"team": "cortex", "env": "prod"}
+	tableManager.cfg.TTLAttribute = ""
+	if err := tableManager.syncTables(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	expectTables(t, dynamoDB, []TableDesc{
+		{Name: "", OnDemand: true, Tags: tableManager.cfg.Tags},
+		{Name: tablePrefix + "0", OnDemand: true, Tags: tableManager.cfg.Tags},
+		{Name: tablePrefix + "1", ProvisionedRead: read, ProvisionedWrite: write, Tags: tableManager.cfg.Tags},
+	})
+}
+
+func TestDynamoTableManagerInactiveReadScale(t *testing.T) {
+	usage := "0"
+	prometheus := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"status": "success", "data": {"resultType": "vector", "result": [
+			{"metric": {"table": "%s0"}, "value": [0, "%s"]}]}}`, tablePrefix, usage)
+	}))
+	defer prometheus.Close()
+
+	dynamoDB := NewMockStorage()
+	tableManager, err := NewDynamoTableManager(TableManagerConfig{
+		mockDynamoDB: dynamoDB,
+
+		PeriodicTableConfig: PeriodicTableConfig{
+			UsePeriodicTables: true,
+			TablePrefix:       tablePrefix,
+			TablePeriod:       tablePeriod,
+			PeriodicTableStartAt: util.DayValue{
+				Time: model.TimeFromUnix(0),
+			},
+		},
+
+		CreationGracePeriod:        gracePeriod,
+		MaxChunkAge:                maxChunkAge,
+		ProvisionedWriteThroughput: write,
+		ProvisionedReadThroughput:  read,
+		InactiveWriteThroughput:    inactiveWrite,
+		InactiveReadThroughput:     inactiveRead,
+		InactiveReadScale: InactiveReadScaleConfig{
+			MetricsURL:        prometheus.URL,
+			UsageWindow:       15 * time.Minute,
+			TargetUtilisation: 0.5,
+			MaxThroughput:     1000,
+			ScaleDownDelay:    time.Hour,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Unix(0, 0).Add(tablePeriod).Add(maxChunkAge).Add(gracePeriod)
+	defer mtime.NowReset()
+	test := func(name string, tm time.Time, read0 int64) {
+		t.Run(name, func(t *testing.T) {
+			mtime.NowForce(tm)
+			if err := tableManager.syncTables(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			expectTables(t, dynamoDB, []TableDesc{
+				{Name: "", ProvisionedRead: inactiveRead, ProvisionedWrite: inactiveWrite},
+				{Name: tablePrefix + "0", ProvisionedRead: read0, ProvisionedWrite: inactiveWrite},
+				{Name: tablePrefix + "1", ProvisionedRead: read, ProvisionedWrite: write},
+			})
+		})
 	}
+
+	// Tables are created with the inactive throughput.
+	test("Created", start, inactiveRead)
+
+	// Read throughput is raised at once to the usage at the target utilisation.
+	usage = "150.2"
+	test("Scaled up", start.Add(time.Minute), 301)
+	usage = "5000"
+	test("Scaled up to the maximum", start.Add(2*time.Minute), 1000)
+
+	// It's only lowered after the delay.
+	usage = "0"
+	test("Not yet scaled down", start.Add(time.Hour), 1000)
+	test("Scaled down", start.Add(2*time.Minute).Add(time.Hour), inactiveRead)
 }
@@ -14,14 +14,14 @@
 package main
 
 import (
-	"flag"
 	"log"
+	"net/http"
 
 	"google.golang.org/grpc"
 
 	"github.com/weaveworks/common/middleware"
-	"github.com/weaveworks/common/server"
 	"github.com/weaveworks/cortex/alertmanager"
+	"github.com/weaveworks/cortex/server"
 	"github.com/weaveworks/cortex/util"
 )
 
@@ -36,7 +36,7 @@ func main() {
 		alertmanagerConfig alertmanager.MultitenantAlertmanagerConfig
 	)
 	util.RegisterFlags(&serverConfig, &alertmanagerConfig)
-	flag.Parse()
+	util.ParseFlags()
 
 	multiAM, err := alertmanager.NewMultitenantAlertmanager(&alertmanagerConfig)
 	if err != nil {
@@ -51,6 +51,7 @@ func main() {
 	}
 	defer server.Shutdown()
 
+	server.HTTP.Path("/api/prom/validate_config").Handler(middleware.AuthenticateUser.Wrap(http.HandlerFunc(multiAM.ValidateConfigHandler)))
 	server.HTTP.PathPrefix("/api/prom").Handler(middleware.AuthenticateUser.Wrap(multiAM))
 	server.Run()
 }
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/route"
+	"github.com/prometheus/prometheus/retrieval"
+	"github.com/prometheus/prometheus/web/api/v1"
+
+	"github.com/weaveworks/common/middleware"
+	"github.com/weaveworks/cortex"
+	"github.com/weaveworks/cortex/chunk"
+	"github.com/weaveworks/cortex/distributor"
+	"github.com/weaveworks/cortex/ingester"
+	"github.com/weaveworks/cortex/querier"
+	"github.com/weaveworks/cortex/ring"
+	"github.com/weaveworks/cortex/ruler"
+	"github.com/weaveworks/cortex/scraper"
+	"github.com/weaveworks/cortex/server"
+	"github.com/weaveworks/cortex/util"
+)
+
+// The components which can be run in this process.
+const (
+	distributorTarget  = "distributor"
+	ingesterTarget     = "ingester"
+	querierTarget      = "querier"
+	rulerTarget        = "ruler"
+	tableManagerTarget = "table-manager"
+	migratorTarget     = "migrator"
+	downsamplerTarget  = "downsampler"
+	scraperTarget      = "scraper"
+	allTargetsName     = "all"
+)
+
+var allTargets = []string{distributorTarget, ingesterTarget, querierTarget, rulerTarget, tableManagerTarget}
+
+// knownTargets also includes those not run as part of all.
+var knownTargets = append(allTargets, migratorTarget, downsamplerTarget, scraperTarget)
+
+// targets is the set of components to run, as a flag.Value.
+type targets map[string]bool
+
+// String implements flag.Value
+func (t targets) String() string {
+	var names []string
+	for _, name := range knownTargets {
+		if t[name] {
+			names = append(names, name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// Set implements flag.Value
+func (t targets) Set(s string) error {
+	for name := range t {
+		delete(t, name)
+	}
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == allTargetsName {
+			for _, name := range allTargets {
+				t[name] = true
+			}
+			continue
+		}
+		known := false
+		for _, target := range knownTargets {
+			known = known || name == target
+		}
+		if !known {
+			return fmt.Errorf("unknown target %q", name)
+		}
+		t[name] = true
+	}
+	return nil
+}
+
+type dummyTargetRetriever struct{}
+
+func (r dummyTargetRetriever) Targets() []*retrieval.Target { return nil }
+
+type dummyAlertmanagerRetriever struct{}
+
+func (r dummyAlertmanagerRetriever) Alertmanagers() []string { return nil }
+
+// main runs any of the Cortex components together in one process, sharing a
+// server, ring and chunk store. With -consul.hostname=inmemory, and all
+// targets, it needs nothing but the chunk store.
+func main() {
+	var (
+		serverConfig = server.Config{
+			MetricsNamespace: "cortex",
+			GRPCMiddleware: []grpc.UnaryServerInterceptor{
+				middleware.ServerUserHeaderInterceptor,
+			},
+		}
+		ingesterRegistrationConfig ring.IngesterRegistrationConfig
+		distributorConfig          distributor.Config
+		haTrackerConfig            distributor.HATrackerConfig
+		ingesterConfig             ingester.Config
+		dualWriteConfig            ingester.DualWriteConfig
+		querierConfig              querier.Config
+		limitsConfig               querier.LimitsConfig
+		auditConfig                querier.AuditConfig
+		boundariesConfig           querier.BoundariesConfig
+		rulerConfig                ruler.Config
+		chunkStoreConfig           chunk.StoreConfig
+		blockStoreConfig           chunk.BlockStoreConfig
+		tableManagerConfig         chunk.TableManagerConfig
+		migratorConfig             chunk.MigratorConfig
+		downsamplerConfig          chunk.DownsamplerConfig
+		scraperConfig              scraper.Config
+
+		target = targets{}
+	)
+	target.Set(allTargetsName)
+	flag.Var(target, "target", "Comma-separated list of components to run: "+strings.Join(knownTargets, ", ")+", or all, which is all but the migrator, downsampler and scraper.")
+	// IngesterRegistrator needs to know our gRPC listen port
+	ingesterRegistrationConfig.ListenPort = &serverConfig.GRPCListenPort
+	ingesterRegistrationConfig.ListenSocket = &serverConfig.GRPCListenSocket
+	// Not read from until it has recovered its checkpoint.
+	ingesterRegistrationConfig.Joining = true
+	// The components' configs overlap, eg. they all have the ring flags, so
+	// share the flags between them.
+	util.RegisterSharedFlags(&serverConfig, &ingesterRegistrationConfig, &distributorConfig, &haTrackerConfig, &ingesterConfig,
+		&dualWriteConfig, &querierConfig, &limitsConfig, &auditConfig, &boundariesConfig, &rulerConfig, &chunkStoreConfig, &blockStoreConfig, &tableManagerConfig, &migratorConfig, &downsamplerConfig, &scraperConfig)
+	util.ParseFlags()
+
+	if target[scraperTarget] && scraperConfig.ConfigsDir == "" {
+		log.Fatalf("The scraper requires -scraper.configs-dir")
+	}
+	if target[rulerTarget] && blockStoreConfig.Enabled {
+		log.Fatalf("The ruler doesn't support the block store")
+	}
+
+	server, err := server.New(serverConfig)
+	if err != nil {
+		log.Fatalf("Error initializing server: %v", err)
+	}
+	defer server.Shutdown()
+
+	// Blocks storage needs no tables, just its bucket indexes updating.
+	if target[tableManagerTarget] {
+		if blockStoreConfig.Enabled {
+			if blockStoreConfig.BucketIndex {
+				updater, err := chunk.NewBucketIndexUpdater(blockStoreConfig)
+				if err != nil {
+					log.Fatalf("Error initializing bucket index updater: %v", err)
+				}
+				updater.Start()
+				defer updater.Stop()
+			}
+		} else {
+			tableManager, err := chunk.NewDynamoTableManager(tableManagerConfig)
+			if err != nil {
+				log.Fatalf("Error initializing DynamoDB table manager: %v", err)
+			}
+			tableManager.Start()
+			defer tableManager.Stop()
+		}
+	}
+
+	var (
+		store      *chunk.Store
+		blockStore *chunk.BlockStore
+	)
+	if target[ingesterTarget] || target[querierTarget] || target[migratorTarget] || target[downsamplerTarget] || (target[rulerTarget] && rulerConfig.FrontendURL.URL == nil) {
+		if blockStoreConfig.Enabled {
+			blockStore, err = chunk.NewBlockStore(blockStoreConfig)
+			if err != nil {
+				log.Fatal(err)
+			}
+			// Stopped after the ingester, to write out the chunks it flushes.
+			defer blockStore.Stop()
+		} else {
+			store, err = chunk.NewStore(chunkStoreConfig)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+
+	var (
+		r            *ring.Ring
+		registration *ring.IngesterRegistration
+		ing          *ingester.Ingester
+	)
+	if target[ingesterTarget] {
+		registration, err = ring.RegisterIngester(ingesterRegistrationConfig)
+		if err != nil {
+			log.Fatalf("Could not register ingester: %v", err)
+		}
+		r = registration.Ring
+
+		var chunkStore ingester.ChunkStore = store
+		if blockStore != nil {
+			chunkStore = blockStore
+		}
+		if dualWriteConfig.Enabled() {
+			secondary, err := chunk.NewStore(dualWriteConfig.SecondaryStoreConfig(chunkStoreConfig))
+			if err != nil {
+				log.Fatalf("Error initializing secondary chunk store: %v", err)
+			}
+			chunkStore = ingester.NewDualWriteStore(dualWriteConfig, chunkStore, secondary)
+		}
+		ing, err = ingester.New(ingesterConfig, chunkStore, r)
+		if err != nil {
+			log.Fatal(err)
+		}
+		registration.ChangeState(ring.ACTIVE)
+		prometheus.MustRegister(ing)
+
+		cortex.RegisterIngesterServer(server.GRPC, ing)
+		server.HTTP.Path("/ready").Handler(http.HandlerFunc(ing.ReadinessHandler))
+		server.HTTP.Path("/shutdown").Handler(ing.ShutdownHandler(server.Stop))
+		server.HTTP.Path("/mode").Handler(http.HandlerFunc(registration.ModeHandler))
+
+		// Our own ingester is called directly, not over gRPC.
+		distributorConfig.InProcessIngesters = map[string]cortex.IngesterServer{
+			registration.Addr(): ing,
+		}
+	} else if target[distributorTarget] || target[querierTarget] || target[rulerTarget] || target[scraperTarget] {
+		r, err = ring.New(ingesterRegistrationConfig.Config)
+		if err != nil {
+			log.Fatalf("Error initializing ring: %v", err)
+		}
+	}
+	if r != nil {
+		defer r.Stop()
+		server.HTTP.Handle("/ring", r)
+		server.HTTP.Handle("/ring/ownership", http.HandlerFunc(r.OwnershipHandler))
+		ring.RegisterRingObserverServer(server.GRPC, r)
+	}
+
+	var dist *distributor.Distributor
+	if target[distributorTarget] || target[querierTarget] || target[rulerTarget] || target[scraperTarget] {
+		if haTrackerConfig.Enabled {
+			tracker, err := distributor.NewHATracker(haTrackerConfig, ingesterRegistrationConfig.ConsulConfig)
+			if err != nil {
+				log.Fatalf("Error initializing HA tracker: %v", err)
+			}
+			defer tracker.Stop()
+			distributorConfig.PushMiddleware = append(distributorConfig.PushMiddleware, tracker)
+		}
+		dist, err = distributor.New(distributorConfig, r)
+		if err != nil {
+			log.Fatalf("Error initializing distributor: %v", err)
+		}
+		defer dist.Stop()
+		prometheus.MustRegister(dist)
+	}
+
+	if target[distributorTarget] {
+		server.HTTP.Handle("/api/prom/push", middleware.AuthenticateUser.Wrap(http.HandlerFunc(dist.PushHandler)))
+		server.HTTP.Handle("/api/prom/debug/samples", middleware.AuthenticateUser.Wrap(http.HandlerFunc(dist.SampleDebugHandler)))
+		server.HTTP.PathPrefix("/api/prom/pushgateway/").Handler(middleware.AuthenticateUser.Wrap(http.StripPrefix("/api/prom/pushgateway", http.HandlerFunc(dist.TextPushHandler))))
+	}
+
+	if target[querierTarget] {
+		var chunkStore querier.ChunkStore = store
+		if blockStore != nil {
+			chunkStore = blockStore
+		}
+		queryable, err := querier.NewAliasingQueryable(querier.NewQueryable(querierConfig, dist, chunkStore), boundariesConfig.OverridesFile)
+		if err != nil {
+			log.Fatalf("Error initializing query aliases: %v", err)
+		}
+		engine := querier.NewQueryableEngine(querierConfig, queryable)
+		api := v1.NewAPI(engine, querier.DummyStorage{Queryable: queryable}, dummyTargetRetriever{}, dummyAlertmanagerRetriever{})
+		promRouter := route.New(func(r *http.Request) (context.Context, error) {
+			return r.Context(), nil
+		}).WithPrefix("/api/prom/api/v1")
+		api.Register(promRouter)
+
+		subrouter := server.HTTP.PathPrefix("/api/prom").Subrouter()
+		audit, err := querier.NewAudit(auditConfig)
+		if err != nil {
+			log.Fatalf("Error initializing query audit log: %v", err)
+		}
+		boundaries, err := querier.NewBoundaries(boundariesConfig)
+		if err != nil {
+			log.Fatalf("Error initializing query boundaries: %v", err)
+		}
+		limits := querier.NewLimits(limitsConfig)
+		downsampling := querier.NewDownsampling(querierConfig.DownsampledAfter)
+		subqueries, err := querier.NewSubqueries(querierConfig, boundariesConfig.OverridesFile, engine)
+		if err != nil {
+			log.Fatalf("Error initializing subqueries: %v", err)
+		}
+		sharding := querier.NewQuerySharding(querierConfig.QueryShards, engine)
+		subrouter.Path("/api/v1/user_limits").Handler(middleware.AuthenticateUser.Wrap(http.HandlerFunc(dist.UserLimitsHandler)))
+		subrouter.Path("/api/v1/cardinality").Handler(middleware.AuthenticateUser.Wrap(http.HandlerFunc(dist.CardinalityHandler)))
+		subrouter.PathPrefix("/api/v1").Handler(middleware.Merge(middleware.AuthenticateUser, util.QueryWarnings{}, audit, boundaries, limits, downsampling, subqueries, sharding).Wrap(promRouter))
+		subrouter.Path("/validate_expr").Handler(middleware.AuthenticateUser.Wrap(http.HandlerFunc(dist.ValidateExprHandler)))
+		subrouter.Path("/user_stats").Handler(middleware.AuthenticateUser.Wrap(http.HandlerFunc(dist.UserStatsHandler)))
+
+		cortex.RegisterQuerierServer(server.GRPC, querier.NewServer(queryable.Q))
+	}
+
+	if target[rulerTarget] {
+		rlr, err := ruler.NewRuler(rulerConfig, dist, store)
+		if err != nil {
+			log.Fatalf("Error initializing ruler: %v", err)
+		}
+		defer rlr.Stop()
+
+		rulerServer, err := ruler.NewServer(rulerConfig, rlr)
+		if err != nil {
+			log.Fatalf("Error initializing ruler server: %v", err)
+		}
+		defer rulerServer.Stop()
+	}
+
+	// The scraper pushes the samples it scrapes for tenants straight to the
+	// distributor.
+	if target[scraperTarget] {
+		scr := scraper.New(scraperConfig, dist)
+		defer scr.Stop()
+		server.HTTP.Handle("/api/prom/scraper/targets", middleware.AuthenticateUser.Wrap(scr))
+	}
+
+	// The migrator copies chunks from the chunk store to another, serving its
+	// progress until stopped.
+	if target[migratorTarget] {
+		if store == nil {
+			log.Fatalf("The migrator doesn't support the block store")
+		}
+		destination, err := chunk.NewStore(migratorConfig.DestinationStoreConfig(chunkStoreConfig))
+		if err != nil {
+			log.Fatalf("Error initializing destination chunk store: %v", err)
+		}
+		migrator, err := chunk.NewMigrator(migratorConfig, store, destination)
+		if err != nil {
+			log.Fatalf("Error initializing migrator: %v", err)
+		}
+		migrator.Start()
+		defer migrator.Stop()
+		server.HTTP.Handle("/migration", migrator)
+	}
+
+	// The downsampler writes the aggregates of days of series older than
+	// -downsampler.after back to the chunk store.
+	if target[downsamplerTarget] {
+		if store == nil {
+			log.Fatalf("The downsampler doesn't support the block store")
+		}
+		downsampler, err := chunk.NewDownsampler(downsamplerConfig, store)
+		if err != nil {
+			log.Fatalf("Error initializing downsampler: %v", err)
+		}
+		downsampler.Start()
+		defer downsampler.Stop()
+	}
+
+	// After all the other gRPC services, so they are all listed.
+	healthServer := util.RegisterGRPCHealthAndReflection(server.GRPC)
+	server.Run()
+
+	// Shutdown order is important! The ingester leaves the ring and flushes
+	// before anything else stops, with the remaining components stopped by
+	// the defers above, in reverse order.
+	if ing != nil {
+		util.SetGRPCNotServing(server.GRPC, healthServer)
+		registration.ChangeState(ring.LEAVING)
+		ing.Stop()
+		registration.Unregister()
+	}
+}
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"flag"
 	"net/http"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -9,9 +8,9 @@ import (
 	"google.golang.org/grpc"
 
 	"github.com/weaveworks/common/middleware"
-	"github.com/weaveworks/common/server"
 	"github.com/weaveworks/cortex/distributor"
 	"github.com/weaveworks/cortex/ring"
+	"github.com/weaveworks/cortex/server"
 	"github.com/weaveworks/cortex/util"
 )
 
@@ -42,9 +41,11 @@ func main() {
 		}
 		ringConfig        ring.Config
 		distributorConfig distributor.Config
+		teeConfig         distributor.TeeConfig
+		haTrackerConfig   distributor.HATrackerConfig
 	)
-	util.RegisterFlags(&serverConfig, &ringConfig, &distributorConfig)
-	flag.Parse()
+	util.RegisterFlags(&serverConfig, &ringConfig, &distributorConfig, &teeConfig, &haTrackerConfig)
+	util.ParseFlags()
 
 	r, err := ring.New(ringConfig)
 	if err != nil {
@@ -52,6 +53,36 @@ func main() {
 	}
 	defer r.Stop()
 
+	// Shadow ingesters register in their own ring, and get a fraction of the
+	// pushes through a distributor of their own.
+	if teeConfig.Fraction > 0 {
+		shadowRingConfig := ringConfig
+		shadowRingConfig.Prefix = teeConfig.ConsulPrefix
+		shadowRing, err := ring.New(shadowRingConfig)
+		if err != nil {
+			log.Fatalf("Error initializing shadow ring: %v", err)
+		}
+		defer shadowRing.Stop()
+
+		shadowDist, err := distributor.New(distributorConfig, shadowRing)
+		if err != nil {
+			log.Fatalf("Error initializing shadow distributor: %v", err)
+		}
+		defer shadowDist.Stop()
+
+		distributorConfig.PushMiddleware = append(distributorConfig.PushMiddleware, distributor.NewTee(teeConfig, shadowDist))
+	}
+
+	if haTrackerConfig.Enabled {
+		tracker, err := distributor.NewHATracker(haTrackerConfig, ringConfig.ConsulConfig)
+		if err != nil {
+			log.Fatalf("Error initializing HA tracker: %v", err)
+		}
+		defer tracker.Stop()
+		// Drop the pushes of replicas which aren't elected before teeing them.
+		distributorConfig.PushMiddleware = append([]distributor.PushMiddleware{tracker}, distributorConfig.PushMiddleware...)
+	}
+
 	dist, err := distributor.New(distributorConfig, r)
 	if err != nil {
 		log.Fatalf("Error initializing distributor: %v", err)
@@ -66,6 +97,11 @@ func main() {
 	defer server.Shutdown()
 
 	server.HTTP.Handle("/ring", r)
+	server.HTTP.Handle("/ring/ownership", http.HandlerFunc(r.OwnershipHandler))
+	ring.RegisterRingObserverServer(server.GRPC, r)
+	util.RegisterGRPCHealthAndReflection(server.GRPC)
 	server.HTTP.Handle("/api/prom/push", middleware.AuthenticateUser.Wrap(http.HandlerFunc(dist.PushHandler)))
+	server.HTTP.Handle("/api/prom/debug/samples", middleware.AuthenticateUser.Wrap(http.HandlerFunc(dist.SampleDebugHandler)))
+	server.HTTP.PathPrefix("/api/prom/pushgateway/").Handler(middleware.AuthenticateUser.Wrap(http.StripPrefix("/api/prom/pushgateway", http.HandlerFunc(dist.TextPushHandler))))
 	server.Run()
 }
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"github.com/prometheus/common/log"
+
+	"github.com/weaveworks/cortex/gateway"
+	"github.com/weaveworks/cortex/server"
+	"github.com/weaveworks/cortex/util"
+)
+
+func main() {
+	var (
+		serverConfig = server.Config{
+			MetricsNamespace: "cortex",
+		}
+		gatewayConfig gateway.Config
+	)
+	util.RegisterFlags(&serverConfig, &gatewayConfig)
+	util.ParseFlags()
+
+	g, err := gateway.New(gatewayConfig)
+	if err != nil {
+		log.Fatalf("Error initializing gateway: %v", err)
+	}
+	defer g.Stop()
+
+	server, err := server.New(serverConfig)
+	if err != nil {
+		log.Fatalf("Error initializing server: %v", err)
+	}
+	defer server.Shutdown()
+
+	server.HTTP.PathPrefix("/api/prom").Handler(g)
+	server.Run()
+}
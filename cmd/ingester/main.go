@@ -1,7 +1,6 @@
 package main
 
 import (
-	"flag"
 	"net/http"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -9,11 +8,11 @@ import (
 	"google.golang.org/grpc"
 
 	"github.com/weaveworks/common/middleware"
-	"github.com/weaveworks/common/server"
 	"github.com/weaveworks/cortex"
 	"github.com/weaveworks/cortex/chunk"
 	"github.com/weaveworks/cortex/ingester"
 	"github.com/weaveworks/cortex/ring"
+	"github.com/weaveworks/cortex/server"
 	"github.com/weaveworks/cortex/util"
 )
 
@@ -27,12 +26,17 @@ func main() {
 		}
 		ingesterRegistrationConfig ring.IngesterRegistrationConfig
 		chunkStoreConfig           chunk.StoreConfig
+		blockStoreConfig           chunk.BlockStoreConfig
 		ingesterConfig             ingester.Config
+		dualWriteConfig            ingester.DualWriteConfig
 	)
 	// IngesterRegistrator needs to know our gRPC listen port
 	ingesterRegistrationConfig.ListenPort = &serverConfig.GRPCListenPort
-	util.RegisterFlags(&serverConfig, &ingesterRegistrationConfig, &chunkStoreConfig, &ingesterConfig)
-	flag.Parse()
+	ingesterRegistrationConfig.ListenSocket = &serverConfig.GRPCListenSocket
+	// Not read from until it has recovered its checkpoint.
+	ingesterRegistrationConfig.Joining = true
+	util.RegisterFlags(&serverConfig, &ingesterRegistrationConfig, &chunkStoreConfig, &blockStoreConfig, &ingesterConfig, &dualWriteConfig)
+	util.ParseFlags()
 
 	registration, err := ring.RegisterIngester(ingesterRegistrationConfig)
 	if err != nil {
@@ -40,15 +44,34 @@ func main() {
 	}
 	defer registration.Ring.Stop()
 
-	chunkStore, err := chunk.NewStore(chunkStoreConfig)
-	if err != nil {
-		log.Fatal(err)
+	var chunkStore ingester.ChunkStore
+	if blockStoreConfig.Enabled {
+		blockStore, err := chunk.NewBlockStore(blockStoreConfig)
+		if err != nil {
+			log.Fatal(err)
+		}
+		// Stopped after the ingester, to write out the chunks it flushes.
+		defer blockStore.Stop()
+		chunkStore = blockStore
+	} else {
+		chunkStore, err = chunk.NewStore(chunkStoreConfig)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if dualWriteConfig.Enabled() {
+		secondary, err := chunk.NewStore(dualWriteConfig.SecondaryStoreConfig(chunkStoreConfig))
+		if err != nil {
+			log.Fatalf("Error initializing secondary chunk store: %v", err)
+		}
+		chunkStore = ingester.NewDualWriteStore(dualWriteConfig, chunkStore, secondary)
 	}
 
 	ingester, err := ingester.New(ingesterConfig, chunkStore, registration.Ring)
 	if err != nil {
 		log.Fatal(err)
 	}
+	registration.ChangeState(ring.ACTIVE)
 	prometheus.MustRegister(ingester)
 
 	server, err := server.New(serverConfig)
@@ -56,11 +79,16 @@ func main() {
 		log.Fatalf("Error initializing server: %v", err)
 	}
 	cortex.RegisterIngesterServer(server.GRPC, ingester)
+	healthServer := util.RegisterGRPCHealthAndReflection(server.GRPC)
 	server.HTTP.Handle("/ring", registration.Ring)
+	server.HTTP.Handle("/ring/ownership", http.HandlerFunc(registration.Ring.OwnershipHandler))
+	server.HTTP.Path("/mode").Handler(http.HandlerFunc(registration.ModeHandler))
 	server.HTTP.Path("/ready").Handler(http.HandlerFunc(ingester.ReadinessHandler))
+	server.HTTP.Path("/shutdown").Handler(ingester.ShutdownHandler(server.Stop))
 	server.Run()
 
 	// Shutdown order is important!
+	util.SetGRPCNotServing(server.GRPC, healthServer)
 	registration.ChangeState(ring.LEAVING)
 	ingester.Stop()
 	registration.Unregister()
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"flag"
 	"net/http"
 
 	"golang.org/x/net/context"
@@ -10,16 +9,16 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/log"
 	"github.com/prometheus/common/route"
-	"github.com/prometheus/prometheus/promql"
 	"github.com/prometheus/prometheus/retrieval"
 	"github.com/prometheus/prometheus/web/api/v1"
 
 	"github.com/weaveworks/common/middleware"
-	"github.com/weaveworks/common/server"
+	"github.com/weaveworks/cortex"
 	"github.com/weaveworks/cortex/chunk"
 	"github.com/weaveworks/cortex/distributor"
 	"github.com/weaveworks/cortex/querier"
 	"github.com/weaveworks/cortex/ring"
+	"github.com/weaveworks/cortex/server"
 	"github.com/weaveworks/cortex/util"
 )
 
@@ -42,9 +41,14 @@ func main() {
 		ringConfig        ring.Config
 		distributorConfig distributor.Config
 		chunkStoreConfig  chunk.StoreConfig
+		blockStoreConfig  chunk.BlockStoreConfig
+		querierConfig     querier.Config
+		limitsConfig      querier.LimitsConfig
+		auditConfig       querier.AuditConfig
+		boundariesConfig  querier.BoundariesConfig
 	)
-	util.RegisterFlags(&serverConfig, &ringConfig, &distributorConfig, &chunkStoreConfig)
-	flag.Parse()
+	util.RegisterFlags(&serverConfig, &ringConfig, &distributorConfig, &chunkStoreConfig, &blockStoreConfig, &querierConfig, &limitsConfig, &auditConfig, &boundariesConfig)
+	util.ParseFlags()
 
 	r, err := ring.New(ringConfig)
 	if err != nil {
@@ -65,14 +69,28 @@ func main() {
 	}
 	defer server.Shutdown()
 	server.HTTP.Handle("/ring", r)
+	server.HTTP.Handle("/ring/ownership", http.HandlerFunc(r.OwnershipHandler))
 
-	chunkStore, err := chunk.NewStore(chunkStoreConfig)
-	if err != nil {
-		log.Fatal(err)
+	var chunkStore querier.ChunkStore
+	if blockStoreConfig.Enabled {
+		blockStore, err := chunk.NewBlockStore(blockStoreConfig)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer blockStore.Stop()
+		chunkStore = blockStore
+	} else {
+		chunkStore, err = chunk.NewStore(chunkStoreConfig)
+		if err != nil {
+			log.Fatal(err)
+		}
 	}
 
-	queryable := querier.NewQueryable(dist, chunkStore)
-	engine := promql.NewEngine(queryable, nil)
+	queryable, err := querier.NewAliasingQueryable(querier.NewQueryable(querierConfig, dist, chunkStore), boundariesConfig.OverridesFile)
+	if err != nil {
+		log.Fatalf("Error initializing query aliases: %v", err)
+	}
+	engine := querier.NewQueryableEngine(querierConfig, queryable)
 	api := v1.NewAPI(engine, querier.DummyStorage{Queryable: queryable}, dummyTargetRetriever{}, dummyAlertmanagerRetriever{})
 	promRouter := route.New(func(r *http.Request) (context.Context, error) {
 		return r.Context(), nil
@@ -80,9 +98,29 @@ func main() {
 	api.Register(promRouter)
 
 	subrouter := server.HTTP.PathPrefix("/api/prom").Subrouter()
-	subrouter.PathPrefix("/api/v1").Handler(middleware.AuthenticateUser.Wrap(promRouter))
+	audit, err := querier.NewAudit(auditConfig)
+	if err != nil {
+		log.Fatalf("Error initializing query audit log: %v", err)
+	}
+	boundaries, err := querier.NewBoundaries(boundariesConfig)
+	if err != nil {
+		log.Fatalf("Error initializing query boundaries: %v", err)
+	}
+	limits := querier.NewLimits(limitsConfig)
+	downsampling := querier.NewDownsampling(querierConfig.DownsampledAfter)
+	subqueries, err := querier.NewSubqueries(querierConfig, boundariesConfig.OverridesFile, engine)
+	if err != nil {
+		log.Fatalf("Error initializing subqueries: %v", err)
+	}
+	sharding := querier.NewQuerySharding(querierConfig.QueryShards, engine)
+	subrouter.Path("/api/v1/user_limits").Handler(middleware.AuthenticateUser.Wrap(http.HandlerFunc(dist.UserLimitsHandler)))
+	subrouter.Path("/api/v1/cardinality").Handler(middleware.AuthenticateUser.Wrap(http.HandlerFunc(dist.CardinalityHandler)))
+	subrouter.PathPrefix("/api/v1").Handler(middleware.Merge(middleware.AuthenticateUser, util.QueryWarnings{}, audit, boundaries, limits, downsampling, subqueries, sharding).Wrap(promRouter))
 	subrouter.Path("/validate_expr").Handler(middleware.AuthenticateUser.Wrap(http.HandlerFunc(dist.ValidateExprHandler)))
 	subrouter.Path("/user_stats").Handler(middleware.AuthenticateUser.Wrap(http.HandlerFunc(dist.UserStatsHandler)))
 
+	cortex.RegisterQuerierServer(server.GRPC, querier.NewServer(queryable.Q))
+	util.RegisterGRPCHealthAndReflection(server.GRPC)
+
 	server.Run()
 }
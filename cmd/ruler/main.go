@@ -1,18 +1,18 @@
 package main
 
 import (
-	"flag"
+	"net/http"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/log"
 	"google.golang.org/grpc"
 
 	"github.com/weaveworks/common/middleware"
-	"github.com/weaveworks/common/server"
 	"github.com/weaveworks/cortex/chunk"
 	"github.com/weaveworks/cortex/distributor"
 	"github.com/weaveworks/cortex/ring"
 	"github.com/weaveworks/cortex/ruler"
+	"github.com/weaveworks/cortex/server"
 	"github.com/weaveworks/cortex/util"
 )
 
@@ -30,11 +30,16 @@ func main() {
 		chunkStoreConfig  chunk.StoreConfig
 	)
 	util.RegisterFlags(&serverConfig, &ringConfig, &distributorConfig, &rulerConfig, &chunkStoreConfig)
-	flag.Parse()
+	util.ParseFlags()
 
-	chunkStore, err := chunk.NewStore(chunkStoreConfig)
-	if err != nil {
-		log.Fatal(err)
+	// The chunk store is only needed if we're evaluating rules ourselves.
+	var chunkStore *chunk.Store
+	if rulerConfig.FrontendURL.URL == nil {
+		var err error
+		chunkStore, err = chunk.NewStore(chunkStoreConfig)
+		if err != nil {
+			log.Fatal(err)
+		}
 	}
 
 	r, err := ring.New(ringConfig)
@@ -69,5 +74,6 @@ func main() {
 	defer server.Shutdown()
 
 	server.HTTP.Handle("/ring", r)
+	server.HTTP.Handle("/ring/ownership", http.HandlerFunc(r.OwnershipHandler))
 	server.Run()
 }
@@ -1,14 +1,12 @@
 package main
 
 import (
-	"flag"
-
 	"github.com/prometheus/common/log"
 	"google.golang.org/grpc"
 
 	"github.com/weaveworks/common/middleware"
-	"github.com/weaveworks/common/server"
 	"github.com/weaveworks/cortex/chunk"
+	"github.com/weaveworks/cortex/server"
 	"github.com/weaveworks/cortex/util"
 )
 
@@ -21,16 +19,29 @@ func main() {
 			},
 		}
 		tableManagerConfig = chunk.TableManagerConfig{}
+		blockStoreConfig   chunk.BlockStoreConfig
 	)
-	util.RegisterFlags(&serverConfig, &tableManagerConfig)
-	flag.Parse()
+	util.RegisterFlags(&serverConfig, &tableManagerConfig, &blockStoreConfig)
+	util.ParseFlags()
 
-	tableManager, err := chunk.NewDynamoTableManager(tableManagerConfig)
-	if err != nil {
-		log.Fatalf("Error initializing DynamoDB table manager: %v", err)
+	// Blocks storage needs no tables, just its bucket indexes updating.
+	if blockStoreConfig.Enabled {
+		if blockStoreConfig.BucketIndex {
+			updater, err := chunk.NewBucketIndexUpdater(blockStoreConfig)
+			if err != nil {
+				log.Fatalf("Error initializing bucket index updater: %v", err)
+			}
+			updater.Start()
+			defer updater.Stop()
+		}
+	} else {
+		tableManager, err := chunk.NewDynamoTableManager(tableManagerConfig)
+		if err != nil {
+			log.Fatalf("Error initializing DynamoDB table manager: %v", err)
+		}
+		tableManager.Start()
+		defer tableManager.Stop()
 	}
-	tableManager.Start()
-	defer tableManager.Stop()
 
 	server, err := server.New(serverConfig)
 	if err != nil {
@@ -24,6 +24,22 @@ type CortexConfig struct {
 	// RulesFiles maps from a rules filename to file contents.
 	RulesFiles         map[string]string `json:"rules_files"`
 	AlertmanagerConfig string            `json:"alertmanager_config"`
+
+	// TemplateFiles maps from a notification template filename to file
+	// contents, referred to by filename in the Alertmanager config.
+	TemplateFiles map[string]string `json:"template_files,omitempty"`
+
+	// APITokens are the tokens the gateway accepts for the organization.
+	APITokens []APIToken `json:"api_tokens,omitempty"`
+}
+
+// An APIToken is a bearer token an organization's clients authenticate with.
+// Only the SHA-256 of the token is kept, hex encoded, so configs don't hold
+// usable tokens. Tokens can be limited to writing or reading, and can expire.
+type APIToken struct {
+	SHA256  string    `json:"sha256" yaml:"sha256"`
+	Scope   string    `json:"scope,omitempty" yaml:"scope,omitempty"`
+	Expires time.Time `json:"expires" yaml:"expires"`
 }
 
 // CortexConfigView is what's returned from the Weave Cloud configs service
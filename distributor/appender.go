@@ -0,0 +1,73 @@
+package distributor
+
+import (
+	"sync"
+
+	"github.com/prometheus/common/model"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex"
+	"github.com/weaveworks/cortex/util"
+)
+
+// Appender is a storage.SampleAppender for programs embedding the Distributor,
+// eg. agents and sidecars, to write to it without serializing remote write
+// requests. Appended samples are batched until Commit pushes them all at once,
+// or Rollback drops them; the Appender can be used again after either.
+type Appender struct {
+	d      *Distributor
+	ctx    context.Context
+	source cortex.SampleSource
+
+	mtx     sync.Mutex
+	samples []model.Sample
+}
+
+// Appender returns an Appender pushing samples with the context, which must
+// have the user ID the samples are for.
+func (d *Distributor) Appender(ctx context.Context, source cortex.SampleSource) *Appender {
+	return &Appender{
+		d:      d,
+		ctx:    ctx,
+		source: source,
+	}
+}
+
+// Append implements storage.SampleAppender, adding the sample to the batch.
+func (a *Appender) Append(sample *model.Sample) error {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	a.samples = append(a.samples, *sample)
+	return nil
+}
+
+// NeedsThrottling implements storage.SampleAppender. Pushes are rate limited
+// per user instead, failing the Commit.
+func (a *Appender) NeedsThrottling() bool {
+	return false
+}
+
+// Commit pushes the samples appended since the last Commit or Rollback in one
+// request.
+func (a *Appender) Commit() error {
+	a.mtx.Lock()
+	samples := a.samples
+	a.samples = nil
+	a.mtx.Unlock()
+
+	if len(samples) == 0 {
+		return nil
+	}
+	req := util.ToWriteRequest(samples)
+	req.Source = a.source
+	_, err := a.d.Push(a.ctx, req)
+	return err
+}
+
+// Rollback drops the samples appended since the last Commit or Rollback.
+func (a *Appender) Rollback() error {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	a.samples = nil
+	return nil
+}
@@ -0,0 +1,45 @@
+package distributor
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex"
+)
+
+func TestAppender(t *testing.T) {
+	d := newTestDistributor(t, Config{
+		IngestionRateLimit: 10000,
+		IngestionBurstSize: 10000,
+	})
+	defer d.Stop()
+
+	a := d.Appender(user.Inject(context.Background(), "user"), cortex.API)
+	appendSamples := func(n int) {
+		for i := 0; i < n; i++ {
+			require.NoError(t, a.Append(&model.Sample{
+				Metric:    model.Metric{model.MetricNameLabel: "foo", "i": model.LabelValue(fmt.Sprint(i))},
+				Value:     1,
+				Timestamp: model.Time(i),
+			}))
+		}
+	}
+
+	// Nothing is pushed until the samples are committed.
+	appendSamples(3)
+	assert.Equal(t, 0.0, counterValue(t, d.receivedSamples))
+	require.NoError(t, a.Commit())
+	assert.Equal(t, 3.0, counterValue(t, d.receivedSamples))
+
+	// Rolled back samples are never pushed.
+	appendSamples(2)
+	require.NoError(t, a.Rollback())
+	require.NoError(t, a.Commit())
+	assert.Equal(t, 3.0, counterValue(t, d.receivedSamples))
+}
@@ -0,0 +1,124 @@
+package distributor
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex"
+)
+
+const defaultCardinalityLimit = 10
+
+// Cardinality models the label names with the most values, and the metric
+// names with the most series, for one user.
+type Cardinality struct {
+	LabelNames  []LabelNameCardinality  `json:"labelNames"`
+	MetricNames []MetricNameCardinality `json:"metricNames"`
+}
+
+// LabelNameCardinality is the number of values of a label name.
+type LabelNameCardinality struct {
+	Name       string `json:"name"`
+	ValueCount uint64 `json:"valueCount"`
+}
+
+// MetricNameCardinality is the number of series of a metric name.
+type MetricNameCardinality struct {
+	Name        string `json:"name"`
+	SeriesCount uint64 `json:"seriesCount"`
+}
+
+// Cardinality returns the limit label names with the most values and the limit
+// metric names with the most series for the current user, from the ingesters.
+//
+// Every series of a metric is sent to the same ingesters, so series counts are
+// summed and divided by the replication factor. Values of a label are spread
+// over all the ingesters, so the value count is the most seen by any one
+// ingester; this is a lower bound.
+func (d *Distributor) Cardinality(ctx context.Context, limit int) (*Cardinality, error) {
+	req := &cortex.CardinalityRequest{}
+	resps, err := d.forAllIngesters(ctx, func(client cortex.IngesterClient) (interface{}, error) {
+		return client.Cardinality(ctx, req)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	labelNames, metricNames := map[string]uint64{}, map[string]uint64{}
+	for _, resp := range resps {
+		for _, e := range resp.(*cortex.CardinalityResponse).LabelNames {
+			if e.Count > labelNames[e.Name] {
+				labelNames[e.Name] = e.Count
+			}
+		}
+		for _, e := range resp.(*cortex.CardinalityResponse).MetricNames {
+			metricNames[e.Name] += e.Count
+		}
+	}
+	replicationFactor := uint64(d.replicationFactorFor(ctx))
+	for name := range metricNames {
+		metricNames[name] /= replicationFactor
+	}
+
+	result := &Cardinality{
+		LabelNames:  []LabelNameCardinality{},
+		MetricNames: []MetricNameCardinality{},
+	}
+	for _, e := range topK(labelNames, limit) {
+		result.LabelNames = append(result.LabelNames, LabelNameCardinality{Name: e.Name, ValueCount: e.Count})
+	}
+	for _, e := range topK(metricNames, limit) {
+		result.MetricNames = append(result.MetricNames, MetricNameCardinality{Name: e.Name, SeriesCount: e.Count})
+	}
+	return result, nil
+}
+
+// topK returns the limit entries with the highest counts, highest first.
+func topK(counts map[string]uint64, limit int) []cortex.CardinalityEntry {
+	entries := make(byCount, 0, len(counts))
+	for name, count := range counts {
+		entries = append(entries, cortex.CardinalityEntry{Name: name, Count: count})
+	}
+	sort.Sort(entries)
+	if len(entries) > limit {
+		entries = entries[:limit]
+	}
+	return entries
+}
+
+type byCount []cortex.CardinalityEntry
+
+func (b byCount) Len() int      { return len(b) }
+func (b byCount) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+func (b byCount) Less(i, j int) bool {
+	if b[i].Count != b[j].Count {
+		return b[i].Count > b[j].Count
+	}
+	return b[i].Name < b[j].Name
+}
+
+// CardinalityHandler returns the label names with the most values and the
+// metric names with the most series for the user, up to the limit parameter.
+func (d *Distributor) CardinalityHandler(w http.ResponseWriter, r *http.Request) {
+	limit := defaultCardinalityLimit
+	if s := r.FormValue("limit"); s != "" {
+		var err error
+		limit, err = strconv.Atoi(s)
+		if err != nil || limit <= 0 {
+			http.Error(w, fmt.Sprintf("invalid limit %q", s), http.StatusBadRequest)
+			return
+		}
+	}
+
+	cardinality, err := d.Cardinality(r.Context(), limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	WriteJSONResponse(w, cardinality)
+}
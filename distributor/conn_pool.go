@@ -0,0 +1,144 @@
+package distributor
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/grpc-ecosystem/grpc-opentracing/go/otgrpc"
+	"github.com/mwitkow/go-grpc-middleware"
+	"github.com/opentracing/opentracing-go"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+
+	"github.com/weaveworks/common/middleware"
+	"github.com/weaveworks/cortex"
+	"github.com/weaveworks/cortex/util"
+)
+
+// unixScheme prefixes the addresses of ingesters listening on a unix socket.
+const unixScheme = "unix://"
+
+// dialIngester opens the connections to an ingester, returning a client which
+// spreads requests over them.
+func (d *Distributor) dialIngester(addr string) (ingesterClient, error) {
+	n := d.cfg.IngesterConnections
+	if n < 1 {
+		n = 1
+	}
+
+	target, opts := dialTarget(addr)
+	conns := make([]*grpc.ClientConn, 0, n)
+	clients := make([]cortex.IngesterClient, 0, n)
+	for i := 0; i < n; i++ {
+		conn, err := grpc.Dial(
+			target,
+			append(opts,
+				grpc.WithTimeout(d.cfg.RemoteTimeout),
+				grpc.WithInsecure(),
+				grpc.WithUnaryInterceptor(grpc_middleware.ChainUnaryClient(
+					otgrpc.OpenTracingClientInterceptor(opentracing.GlobalTracer()),
+					middleware.ClientUserHeaderInterceptor,
+					util.ClientRequestIDInterceptor,
+					d.instrumentConnection(addr, strconv.Itoa(i)),
+				)),
+			)...,
+		)
+		if err != nil {
+			for _, conn := range conns {
+				conn.Close()
+			}
+			return ingesterClient{}, err
+		}
+		conns = append(conns, conn)
+		clients = append(clients, cortex.NewIngesterClient(conn))
+	}
+
+	if n == 1 {
+		return ingesterClient{IngesterClient: clients[0], conns: conns}, nil
+	}
+	return ingesterClient{IngesterClient: &roundRobinClient{clients: clients}, conns: conns}, nil
+}
+
+// dialTarget returns the gRPC target and dial options for an ingester's
+// address in the ring: host:port, where the host is an IPv4 address, an IPv6
+// address in brackets or a DNS name, or unix:///path/to/socket for an ingester
+// on the same host.
+func dialTarget(addr string) (string, []grpc.DialOption) {
+	if !strings.HasPrefix(addr, unixScheme) {
+		return addr, []grpc.DialOption{grpc.WithDialer(dialTCP)}
+	}
+	return strings.TrimPrefix(addr, unixScheme), []grpc.DialOption{
+		grpc.WithDialer(func(path string, timeout time.Duration) (net.Conn, error) {
+			return net.DialTimeout("unix", path, timeout)
+		}),
+	}
+}
+
+// dialTCP dials host:port, resolving a DNS name afresh each time, so when a
+// connection fails gRPC's reconnects follow the name to the ingester's new
+// address, and trying each of the addresses it resolves to, IPv6 and IPv4, as
+// on dual-stack clusters.
+func dialTCP(addr string, timeout time.Duration) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: timeout, DualStack: true}
+	return dialer.Dial("tcp", addr)
+}
+
+// instrumentConnection counts the requests in flight and sent on one of the
+// connections to an ingester.
+func (d *Distributor) instrumentConnection(addr, connection string) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		d.ingesterConnectionRequests.WithLabelValues(addr, connection).Inc()
+		inflight := d.ingesterConnectionInflight.WithLabelValues(addr, connection)
+		inflight.Inc()
+		defer inflight.Dec()
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+}
+
+// forgetConnections removes the metrics for an ingester's connections.
+func (d *Distributor) forgetConnections(addr string, n int) {
+	for i := 0; i < n; i++ {
+		d.ingesterConnectionRequests.DeleteLabelValues(addr, strconv.Itoa(i))
+		d.ingesterConnectionInflight.DeleteLabelValues(addr, strconv.Itoa(i))
+	}
+}
+
+// roundRobinClient is a cortex.IngesterClient which sends each request over
+// the next of several connections to the same ingester, so a busy ingester
+// isn't limited by the throughput of a single HTTP/2 connection.
+type roundRobinClient struct {
+	clients []cortex.IngesterClient
+	next    uint32
+}
+
+func (c *roundRobinClient) pick() cortex.IngesterClient {
+	i := atomic.AddUint32(&c.next, 1)
+	return c.clients[i%uint32(len(c.clients))]
+}
+
+func (c *roundRobinClient) Push(ctx context.Context, in *cortex.WriteRequest, opts ...grpc.CallOption) (*cortex.WriteResponse, error) {
+	return c.pick().Push(ctx, in, opts...)
+}
+
+func (c *roundRobinClient) Query(ctx context.Context, in *cortex.QueryRequest, opts ...grpc.CallOption) (*cortex.QueryResponse, error) {
+	return c.pick().Query(ctx, in, opts...)
+}
+
+func (c *roundRobinClient) LabelValues(ctx context.Context, in *cortex.LabelValuesRequest, opts ...grpc.CallOption) (*cortex.LabelValuesResponse, error) {
+	return c.pick().LabelValues(ctx, in, opts...)
+}
+
+func (c *roundRobinClient) UserStats(ctx context.Context, in *cortex.UserStatsRequest, opts ...grpc.CallOption) (*cortex.UserStatsResponse, error) {
+	return c.pick().UserStats(ctx, in, opts...)
+}
+
+func (c *roundRobinClient) MetricsForLabelMatchers(ctx context.Context, in *cortex.MetricsForLabelMatchersRequest, opts ...grpc.CallOption) (*cortex.MetricsForLabelMatchersResponse, error) {
+	return c.pick().MetricsForLabelMatchers(ctx, in, opts...)
+}
+
+func (c *roundRobinClient) Cardinality(ctx context.Context, in *cortex.CardinalityRequest, opts ...grpc.CallOption) (*cortex.CardinalityResponse, error) {
+	return c.pick().Cardinality(ctx, in, opts...)
+}
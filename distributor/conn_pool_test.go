@@ -0,0 +1,170 @@
+package distributor
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+
+	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex"
+	"github.com/weaveworks/cortex/ring"
+)
+
+type countingIngester struct {
+	mockIngester
+	pushes int
+}
+
+func (i *countingIngester) Push(ctx context.Context, in *cortex.WriteRequest, opts ...grpc.CallOption) (*cortex.WriteResponse, error) {
+	i.pushes++
+	return &cortex.WriteResponse{}, nil
+}
+
+func TestRoundRobinClient(t *testing.T) {
+	ingesters := []*countingIngester{{}, {}, {}}
+	client := &roundRobinClient{}
+	for _, ing := range ingesters {
+		client.clients = append(client.clients, ing)
+	}
+
+	for i := 0; i < 30; i++ {
+		_, err := client.Push(context.Background(), &cortex.WriteRequest{})
+		require.NoError(t, err)
+	}
+	for _, ing := range ingesters {
+		assert.Equal(t, 10, ing.pushes)
+	}
+}
+
+func TestDialIngester(t *testing.T) {
+	for _, tc := range []struct {
+		connections int
+		roundRobin  bool
+	}{
+		{0, false},
+		{1, false},
+		{4, true},
+	} {
+		d := newTestDistributor(t, Config{})
+		d.cfg.IngesterConnections = tc.connections
+
+		// Connections are made in the background, so this doesn't need an
+		// ingester to be listening.
+		client, err := d.dialIngester("localhost:1")
+		require.NoError(t, err)
+		_, ok := client.IngesterClient.(*roundRobinClient)
+		assert.Equal(t, tc.roundRobin, ok)
+		if tc.connections > 1 {
+			assert.Len(t, client.conns, tc.connections)
+		} else {
+			assert.Len(t, client.conns, 1)
+		}
+		for _, conn := range client.conns {
+			conn.Close()
+		}
+		d.Stop()
+	}
+}
+
+func TestDialIngesterUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cortex")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "ingester.sock")
+	listener, err := net.Listen("unix", path)
+	require.NoError(t, err)
+	server := grpc.NewServer()
+	go server.Serve(listener)
+	defer server.Stop()
+
+	d := newTestDistributor(t, Config{})
+	defer d.Stop()
+	client, err := d.dialIngester("unix://" + path)
+	require.NoError(t, err)
+	defer client.conns[0].Close()
+
+	// The server has no services, so reaching it is all that can succeed.
+	ctx := user.Inject(context.Background(), "user")
+	_, err = client.Push(ctx, &cortex.WriteRequest{})
+	assert.Equal(t, codes.Unimplemented, grpc.Code(err), "%v", err)
+}
+
+func TestRecycleIngesterClients(t *testing.T) {
+	for _, tc := range []struct {
+		maxAge, idleTimeout time.Duration
+		age, idle           time.Duration
+		recycled            bool
+	}{
+		{0, 0, time.Hour, time.Hour, false},
+		{time.Hour, 0, 30 * time.Minute, 0, false},
+		{time.Hour, 0, 2 * time.Hour, 0, true},
+		{0, time.Minute, time.Hour, 30 * time.Second, false},
+		{0, time.Minute, time.Hour, 2 * time.Minute, true},
+	} {
+		d := newTestDistributor(t, Config{
+			ClientMaxAge:      tc.maxAge,
+			ClientIdleTimeout: tc.idleTimeout,
+		})
+		desc := &ring.IngesterDesc{Addr: "0"}
+		_, err := d.getClientFor(desc)
+		require.NoError(t, err)
+
+		d.clientsMtx.Lock()
+		client := d.clients[desc.Addr]
+		client.expires = client.expires.Add(-tc.age)
+		atomic.StoreInt64(client.lastUsed, time.Now().Add(-tc.idle).UnixNano())
+		d.clients[desc.Addr] = client
+		d.clientsMtx.Unlock()
+
+		d.removeStaleIngesterClients()
+		d.clientsMtx.RLock()
+		_, ok := d.clients[desc.Addr]
+		d.clientsMtx.RUnlock()
+		assert.Equal(t, tc.recycled, !ok, "%+v", tc)
+		d.Stop()
+	}
+}
+
+func TestDialIngesterTCPAddresses(t *testing.T) {
+	for _, tc := range []struct {
+		listen, dial string
+	}{
+		{"127.0.0.1:0", "127.0.0.1"},
+		{"127.0.0.1:0", "localhost"},
+		{"[::1]:0", "::1"},
+	} {
+		listener, err := net.Listen("tcp", tc.listen)
+		if err != nil {
+			t.Logf("Skipping %s: %v", tc.listen, err)
+			continue
+		}
+		server := grpc.NewServer()
+		go server.Serve(listener)
+
+		_, port, err := net.SplitHostPort(listener.Addr().String())
+		require.NoError(t, err)
+		d := newTestDistributor(t, Config{})
+		client, err := d.dialIngester(net.JoinHostPort(tc.dial, port))
+		require.NoError(t, err)
+
+		// The server has no services, so reaching it is all that can succeed.
+		ctx := user.Inject(context.Background(), "user")
+		_, err = client.Push(ctx, &cortex.WriteRequest{})
+		assert.Equal(t, codes.Unimplemented, grpc.Code(err), "%s: %v", tc.dial, err)
+
+		client.conns[0].Close()
+		d.Stop()
+		server.Stop()
+	}
+}
@@ -4,25 +4,25 @@ import (
 	"errors"
 	"flag"
 	"fmt"
-	"hash/fnv"
+	"math/rand"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
-	"github.com/grpc-ecosystem/grpc-opentracing/go/otgrpc"
-	"github.com/mwitkow/go-grpc-middleware"
 	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
 	"golang.org/x/net/context"
-	"golang.org/x/time/rate"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/log"
 	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/local"
 	"github.com/prometheus/prometheus/storage/metric"
 
 	"github.com/weaveworks/common/instrument"
-	"github.com/weaveworks/common/middleware"
 	"github.com/weaveworks/common/user"
 	"github.com/weaveworks/cortex"
 	"github.com/weaveworks/cortex/ring"
@@ -50,31 +50,81 @@ type Distributor struct {
 	quit       chan struct{}
 	done       chan struct{}
 
-	// Per-user rate limiters.
-	ingestLimitersMtx sync.Mutex
-	ingestLimiters    map[string]*rate.Limiter
+	// The addresses of the ingesters which have said they accept symbolized
+	// requests, in their last response.
+	symbolizingMtx sync.RWMutex
+	symbolizing    map[string]bool
+
+	// If migrateTokenFor is set, series are also queried from the ingesters
+	// it picks, while migrating to tokenFor.
+	tokenFor        tokenHasher
+	migrateTokenFor tokenHasher
+
+	// The chain of PushMiddleware pushes go through.
+	pusher Pusher
+
+	// Tenants' sessions debugging the fates of their samples.
+	sampleDebugger *sampleDebugger
+
+	// Per-user settings, from the OverridesFile.
+	overrides map[string]util.Overrides
+
+	// Decides the per-user ingestion rate limits, which are applied by
+	// per-user rate limiters, with separate limiters for samples generated
+	// by the ruler.
+	limiter            util.RateLimiter
+	ingestLimitersMtx  sync.Mutex
+	ingestLimiters     map[string]userIngestLimiter
+	ruleIngestLimiters map[string]userIngestLimiter
+
+	// Limits the pushes in flight, shedding bulk pushes first.
+	inflight *util.InflightLimiter
+
+	// Runs the sends to ingesters, if configured; otherwise each has its own
+	// goroutine.
+	sendPool *sendPool
 
 	queryDuration          *prometheus.HistogramVec
 	receivedSamples        prometheus.Counter
+	receivedRuleSamples    *prometheus.CounterVec
+	rateLimitedSamples     *prometheus.CounterVec
+	shedPushes             *prometheus.CounterVec
+	discardedSamples       *prometheus.CounterVec
 	sendDuration           *prometheus.HistogramVec
+	pushStageDuration      *prometheus.HistogramVec
+	pushLiveReplicas       prometheus.Histogram
+	pushSpareReplicas      prometheus.Histogram
+	degradedQuorumPushes   prometheus.Counter
+	sendPoolWaits          prometheus.Counter
+	extendedSamples        *prometheus.CounterVec
 	ingesterAppends        *prometheus.CounterVec
 	ingesterAppendFailures *prometheus.CounterVec
 	ingesterQueries        *prometheus.CounterVec
 	ingesterQueryFailures  *prometheus.CounterVec
+
+	ingesterConnectionRequests *prometheus.CounterVec
+	ingesterConnectionInflight *prometheus.GaugeVec
+	recycledClients            *prometheus.CounterVec
 }
 
 type ingesterClient struct {
 	cortex.IngesterClient
-	conn *grpc.ClientConn
+	conns []*grpc.ClientConn
+
+	// When the client is due to be recycled, and when it was last used, in
+	// unix nanoseconds.
+	expires  time.Time
+	lastUsed *int64
 }
 
 // ReadRing represents the read inferface to the ring.
 type ReadRing interface {
 	prometheus.Collector
 
-	Get(key uint32, n int, op ring.Operation) ([]*ring.IngesterDesc, error)
-	BatchGet(keys []uint32, n int, op ring.Operation) ([][]*ring.IngesterDesc, error)
+	GetInPool(pool string, key uint32, n int, op ring.Operation) ([]*ring.IngesterDesc, error)
+	BatchGetInPool(pool string, keys []uint32, n int, op ring.Operation) ([][]*ring.IngesterDesc, error)
 	GetAll() []*ring.IngesterDesc
+	ZoneAwarenessEnabled() bool
 }
 
 // Config contains the configuration require to
@@ -87,6 +137,105 @@ type Config struct {
 	IngestionRateLimit  float64
 	IngestionBurstSize  int
 
+	// How long clients for ingesters are kept, and how long they may go
+	// unused, before they are closed and redialed; 0 to keep them for as
+	// long as the ingester is in the ring.
+	ClientMaxAge      time.Duration
+	ClientIdleTimeout time.Duration
+
+	// Limits for samples generated by the ruler; a zero limit means they are
+	// not rate limited at all.
+	RuleIngestionRateLimit float64
+	RuleIngestionBurstSize int
+
+	// How ingestion is rate limited: token-bucket, using the burst sizes, or
+	// sliding-window, allowing the rate limit averaged over the window.
+	IngestionRateStrategy string
+	IngestionRateWindow   time.Duration
+
+	// What to do with native histograms: convert them to classic histogram
+	// series, drop them, or reject pushes containing them.
+	NativeHistograms string
+
+	// Whether to ingest the created timestamps of series pushed with remote
+	// write 2.0 as zero samples.
+	IngestCreatedTimestamps bool
+
+	// The label naming series pushed without a metric name, as some
+	// OpenTelemetry pipelines produce; empty to reject them.
+	NamelessSeriesLabel string
+
+	// Middleware applied to pushes after validation and limits, before they
+	// are sent to the ingesters.
+	PushMiddleware []PushMiddleware
+
+	// The hash function used to pick the ingesters for a series, and that
+	// used previously, while migrating between them.
+	TokenHash            string
+	MigrateFromTokenHash string
+
+	// Ingesters running in this process, by address, which are called
+	// directly rather than over gRPC.
+	InProcessIngesters map[string]cortex.IngesterServer
+
+	// The number of gRPC connections to open to each ingester, which
+	// requests are sent over in turn.
+	IngesterConnections int
+
+	// Pushes to and queries of an ingester taking longer than this are
+	// logged; 0 to disable.
+	SlowIngesterRequestThreshold time.Duration
+
+	// Whether to ask ingesters to return query results in columnar form.
+	ColumnarQueryResponses bool
+
+	// Whether to send symbolized requests to ingesters which accept them.
+	SymbolizeRequests bool
+
+	// Limits on the labels of each series pushed, which can be overridden
+	// per user in the OverridesFile.
+	LabelLimits util.LabelLimits
+
+	// The fraction of successful pushes traced, which can be overridden per
+	// user in the OverridesFile. Failed pushes, and those slower than the
+	// threshold, are always traced.
+	PushTraceSampleRate    float64
+	PushTraceSlowThreshold time.Duration
+
+	// A YAML file of per-tenant util.Overrides.
+	OverridesFile string
+
+	// The longest a tenant can debug the fates of their samples for.
+	SampleDebugMaxDuration time.Duration
+
+	// The registered util.Limiter deciding the per-user ingestion rate
+	// limits.
+	Limiter string
+
+	// Whether to retry the samples a replica fails to take on the next
+	// ingester in the ring, rather than fail the push once too many have.
+	ExtendFailedReplicas bool
+
+	// Queries fail while at least this fraction of the ingesters in the
+	// tenant's pool are joining, rather than return partial data; 0 to never
+	// fail them.
+	QueryMaxJoiningFraction float64
+
+	// The most pushes in flight, of which bulk pushes may be the given
+	// fraction, so they are shed before realtime pushes; 0 to not limit.
+	MaxInflightPushes    int
+	BulkInflightFraction float64
+
+	// The number of workers sending pushes to ingesters, and the sends each
+	// queues before pushes wait; 0 workers to send each in its own goroutine.
+	PushWorkers         int
+	PushWorkerQueueSize int
+
+	// Whether pushes over HTTP of which only some series are rejected
+	// succeed, responding with how many samples were accepted and why the
+	// rest were rejected.
+	PartialSuccess bool
+
 	// for testing
 	ingesterClientFactory func(string) cortex.IngesterClient
 }
@@ -97,8 +246,39 @@ func (cfg *Config) RegisterFlags(f *flag.FlagSet) {
 	flag.DurationVar(&cfg.HeartbeatTimeout, "distributor.heartbeat-timeout", time.Minute, "The heartbeat timeout after which ingesters are skipped for reads/writes.")
 	flag.DurationVar(&cfg.RemoteTimeout, "distributor.remote-timeout", 2*time.Second, "Timeout for downstream ingesters.")
 	flag.DurationVar(&cfg.ClientCleanupPeriod, "distributor.client-cleanup-period", 15*time.Second, "How frequently to clean up clients for ingesters that have gone away.")
+	flag.DurationVar(&cfg.ClientMaxAge, "distributor.client-max-age", 0, "Close and redial the connections to an ingester after this long, with up to 10% jitter, eg. so they are rebalanced after a load balancer failover. Checked every -distributor.client-cleanup-period. 0 to disable.")
+	flag.DurationVar(&cfg.ClientIdleTimeout, "distributor.client-idle-timeout", 0, "Close the connections to an ingester after this long without requests. Checked every -distributor.client-cleanup-period. 0 to disable.")
 	flag.Float64Var(&cfg.IngestionRateLimit, "distributor.ingestion-rate-limit", 25000, "Per-user ingestion rate limit in samples per second.")
 	flag.IntVar(&cfg.IngestionBurstSize, "distributor.ingestion-burst-size", 50000, "Per-user allowed ingestion burst size (in number of samples).")
+	flag.Float64Var(&cfg.RuleIngestionRateLimit, "distributor.rule-ingestion-rate-limit", 0, "Per-user ingestion rate limit for samples generated by the ruler, in samples per second. 0 to disable.")
+	flag.IntVar(&cfg.RuleIngestionBurstSize, "distributor.rule-ingestion-burst-size", 50000, "Per-user allowed ingestion burst size for samples generated by the ruler (in number of samples).")
+	flag.StringVar(&cfg.IngestionRateStrategy, "distributor.ingestion-rate-strategy", tokenBucketRateStrategy, "How to apply the ingestion rate limits: token-bucket, allowing bursts up to the burst size, or sliding-window, allowing the rate limit averaged over -distributor.ingestion-rate-window, for clients sending large, infrequent batches.")
+	flag.DurationVar(&cfg.IngestionRateWindow, "distributor.ingestion-rate-window", time.Minute, "Window over which the sliding-window ingestion rate limit is averaged.")
+	flag.StringVar(&cfg.NativeHistograms, "distributor.native-histograms", convertNativeHistograms, "What to do with native histograms: convert them to classic _bucket, _count and _sum series, drop them, or reject pushes containing them.")
+	flag.BoolVar(&cfg.IngestCreatedTimestamps, "distributor.ingest-created-timestamps", false, "Ingest the created timestamps of counters, histograms and summaries pushed with remote write 2.0 as a zero sample before their first sample, so rates and increases include their start.")
+	flag.StringVar(&cfg.NamelessSeriesLabel, "distributor.nameless-series-label", "", "Label whose value, with characters invalid in metric names replaced by underscores, names series pushed without a metric name, eg. otel_metric_name, so they are routed to and stored by the ingesters rather than rejected. Empty to reject them.")
+	flag.StringVar(&cfg.TokenHash, "distributor.token-hash", tokenHashFNV32, "Hash function used to pick the ingesters for a series: fnv32, fnv32a or xxhash. Must be the same across the cluster.")
+	flag.StringVar(&cfg.MigrateFromTokenHash, "distributor.token-hash.migrate-from", "", "Hash function previously used to pick the ingesters for a series. If set, queries also go to the ingesters it picks, "+
+		"so series are still found while migrating to -distributor.token-hash. Remove once all ingesters have flushed the series written before the switch.")
+	flag.DurationVar(&cfg.SlowIngesterRequestThreshold, "distributor.slow-ingester-request-threshold", 0, "Log pushes to and queries of a single ingester taking longer than this, with the tenant and number of series. 0 to disable.")
+	flag.BoolVar(&cfg.ColumnarQueryResponses, "distributor.columnar-query-responses", false, "Experimental: ask ingesters to return query results with samples in packed arrays, which are cheaper to encode and decode.")
+	flag.BoolVar(&cfg.SymbolizeRequests, "distributor.symbolize-requests", false, "Experimental: send ingesters which accept them pushes with each distinct label name and value sent once, shrinking requests with many series sharing labels.")
+	flag.IntVar(&cfg.LabelLimits.MaxLabelNamesPerSeries, "distributor.max-label-names-per-series", 30, "Maximum number of labels a series may have. 0 to disable.")
+	flag.IntVar(&cfg.LabelLimits.MaxLabelNameLength, "distributor.max-label-name-length", 1024, "Maximum length of a label name, in bytes. 0 to disable.")
+	flag.IntVar(&cfg.LabelLimits.MaxLabelValueLength, "distributor.max-label-value-length", 2048, "Maximum length of a label value, in bytes. 0 to disable.")
+	flag.Float64Var(&cfg.PushTraceSampleRate, "distributor.push-trace-sample-rate", 1, "Fraction of pushes traced. Pushes which fail or are slower than -distributor.push-trace-slow-threshold are always traced.")
+	flag.DurationVar(&cfg.PushTraceSlowThreshold, "distributor.push-trace-slow-threshold", time.Second, "Pushes taking longer than this are always traced. 0 to disable.")
+	flag.StringVar(&cfg.OverridesFile, "distributor.overrides-file", "", "YAML file of per-tenant settings overriding the flags: replication_factor, the pool of ingesters to use, ingestion_rate and ingestion_burst_size, the label limits, push_trace_sample_rate, and metric_renames and label_renames.")
+	flag.DurationVar(&cfg.SampleDebugMaxDuration, "distributor.sample-debug-max-duration", 15*time.Minute, "The longest tenants can record the fates of the samples they push matching a selector for, with /api/prom/debug/samples. 0 to disable.")
+	flag.StringVar(&cfg.Limiter, "distributor.limiter", util.OverridesLimiter, "How per-user ingestion rate limits are decided: overrides, the flags overridden by ingestion_rate and ingestion_burst_size in -distributor.overrides-file, local, the flags alone, or one registered by an embedder.")
+	flag.BoolVar(&cfg.ExtendFailedReplicas, "distributor.extend-failed-replicas", false, "Retry the samples an ingester fails to take on the next ingester in the ring beyond their replicas, within -distributor.remote-timeout, so pushes survive more ingester failures than their quorum allows.")
+	flag.Float64Var(&cfg.QueryMaxJoiningFraction, "distributor.query-max-joining-fraction", 0, "Fail queries with a partial data error while at least this fraction of the ingesters in the tenant's pool are joining, eg. still recovering their checkpoints after a restart of the cluster. Otherwise the results of queries while any are joining carry a warning. 0 to only warn.")
+	flag.IntVar(&cfg.MaxInflightPushes, "distributor.max-inflight-pushes", 0, "Reject pushes with 429s while this many are in flight. 0 to disable.")
+	flag.Float64Var(&cfg.BulkInflightFraction, "distributor.bulk-inflight-fraction", 0.8, "Reject pushes with the bulk X-Cortex-Priority, eg. backfills, while this fraction of -distributor.max-inflight-pushes are in flight, keeping the rest for realtime pushes.")
+	flag.IntVar(&cfg.PushWorkers, "distributor.push-workers", 0, "Number of workers sending pushes to ingesters, reused rather than starting a goroutine per ingester per push. 0 to start a goroutine for each.")
+	flag.IntVar(&cfg.PushWorkerQueueSize, "distributor.push-worker-queue-size", 100, "Number of sends each push worker queues; once all are full, pushes wait for room.")
+	flag.BoolVar(&cfg.PartialSuccess, "distributor.partial-success", false, "Accept the rest of pushes of which some samples are rejected, for exceeding the label, series or ingestion rate limits or being out of order or too old, responding 200 with how many samples were accepted and, by reason, how many rejected, as OTLP partial success responses do, rather than failing the push.")
+	flag.IntVar(&cfg.IngesterConnections, "distributor.ingester-connections", 1, "Number of gRPC connections to open to each ingester. Requests are sent over them round-robin, for ingesters too busy for a single connection.")
 }
 
 // New constructs a new Distributor
@@ -106,13 +286,63 @@ func New(cfg Config, ring ReadRing) (*Distributor, error) {
 	if 0 > cfg.ReplicationFactor {
 		return nil, fmt.Errorf("ReplicationFactor must be greater than zero: %d", cfg.ReplicationFactor)
 	}
+	if cfg.TokenHash == "" {
+		cfg.TokenHash = tokenHashFNV32
+	}
+	tokenFor, err := newTokenHasher(cfg.TokenHash)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.IngestionRateStrategy == slidingWindowRateStrategy && cfg.IngestionRateWindow <= 0 {
+		return nil, fmt.Errorf("IngestionRateWindow must be greater than zero: %v", cfg.IngestionRateWindow)
+	}
+	if _, err := newIngestLimiter(cfg.IngestionRateStrategy, 0, 0, cfg.IngestionRateWindow); err != nil {
+		return nil, err
+	}
+	if err := validNativeHistogramsMode(cfg.NativeHistograms); err != nil {
+		return nil, err
+	}
+	var overrides map[string]util.Overrides
+	if cfg.OverridesFile != "" {
+		overrides, err = util.LoadOverrides(cfg.OverridesFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Limiter == "" {
+		cfg.Limiter = util.OverridesLimiter
+	}
+	limiter, err := util.NewLimiter(cfg.Limiter, util.LimitDefaults{
+		IngestionRate:          cfg.IngestionRateLimit,
+		IngestionBurstSize:     cfg.IngestionBurstSize,
+		RuleIngestionRate:      cfg.RuleIngestionRateLimit,
+		RuleIngestionBurstSize: cfg.RuleIngestionBurstSize,
+	}, cfg.OverridesFile)
+	if err != nil {
+		return nil, err
+	}
+	var migrateTokenFor tokenHasher
+	if cfg.MigrateFromTokenHash != "" && cfg.MigrateFromTokenHash != cfg.TokenHash {
+		migrateTokenFor, err = newTokenHasher(cfg.MigrateFromTokenHash)
+		if err != nil {
+			return nil, err
+		}
+	}
 	d := &Distributor{
-		cfg:            cfg,
-		ring:           ring,
-		clients:        map[string]ingesterClient{},
-		quit:           make(chan struct{}),
-		done:           make(chan struct{}),
-		ingestLimiters: map[string]*rate.Limiter{},
+		cfg:                cfg,
+		ring:               ring,
+		tokenFor:           tokenFor,
+		migrateTokenFor:    migrateTokenFor,
+		overrides:          overrides,
+		clients:            map[string]ingesterClient{},
+		symbolizing:        map[string]bool{},
+		quit:               make(chan struct{}),
+		done:               make(chan struct{}),
+		limiter:            limiter,
+		sampleDebugger:     newSampleDebugger(cfg.SampleDebugMaxDuration),
+		ingestLimiters:     map[string]userIngestLimiter{},
+		ruleIngestLimiters: map[string]userIngestLimiter{},
+		inflight:           util.NewInflightLimiter(cfg.MaxInflightPushes, cfg.BulkInflightFraction),
 		queryDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
 			Namespace: "cortex",
 			Name:      "distributor_query_duration_seconds",
@@ -124,12 +354,65 @@ func New(cfg Config, ring ReadRing) (*Distributor, error) {
 			Name:      "distributor_received_samples_total",
 			Help:      "The total number of received samples.",
 		}),
+		receivedRuleSamples: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "cortex",
+			Name:      "distributor_received_rule_samples_total",
+			Help:      "The total number of received samples generated by the ruler.",
+		}, []string{"user"}),
+		rateLimitedSamples: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "cortex",
+			Name:      "distributor_rate_limited_samples_total",
+			Help:      "The total number of samples rejected by the ingestion rate limiter.",
+		}, []string{"user", "source"}),
+		shedPushes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "cortex",
+			Name:      "distributor_shed_pushes_total",
+			Help:      "The total number of pushes rejected for too many in flight, by priority.",
+		}, []string{"priority"}),
+		discardedSamples: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "cortex",
+			Name:      "distributor_discarded_samples_total",
+			Help:      "The total number of samples discarded for failing validation, by the limit they exceeded.",
+		}, []string{"user", "reason"}),
 		sendDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
 			Namespace: "cortex",
 			Name:      "distributor_send_duration_seconds",
 			Help:      "Time spent sending a sample batch to multiple replicated ingesters.",
 			Buckets:   []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
 		}, []string{"method", "status_code"}),
+		pushStageDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "cortex",
+			Name:      "distributor_push_stage_duration_seconds",
+			Help:      "Time spent in each stage of a push: validation, ring_lookup, serialization and send, per ingester, and quorum_wait.",
+			Buckets:   prometheus.ExponentialBuckets(.0001, 4, 8),
+		}, []string{"stage"}),
+		pushLiveReplicas: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: "cortex",
+			Name:      "distributor_push_live_replicas",
+			Help:      "The fewest live ingesters any sample in a push was replicated to.",
+			Buckets:   prometheus.LinearBuckets(0, 1, 6),
+		}),
+		pushSpareReplicas: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: "cortex",
+			Name:      "distributor_push_spare_replicas",
+			Help:      "The fewest live ingesters beyond the quorum any sample in a push was replicated to, ie. how many more ingester failures the push would survive.",
+			Buckets:   prometheus.LinearBuckets(0, 1, 6),
+		}),
+		degradedQuorumPushes: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "cortex",
+			Name:      "distributor_degraded_quorum_pushes_total",
+			Help:      "The total number of pushes which succeeded with a sample written to no more ingesters than its quorum, out of more replicas.",
+		}),
+		sendPoolWaits: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "cortex",
+			Name:      "distributor_push_worker_waits_total",
+			Help:      "The total number of sends to ingesters which waited for room in the push workers' queues.",
+		}),
+		extendedSamples: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "cortex",
+			Name:      "distributor_extended_samples_total",
+			Help:      "The total number of samples an ingester failed to take which were retried on the next ingester in the ring, by whether that saved or failed the replica.",
+		}, []string{"outcome"}),
 		ingesterAppends: prometheus.NewCounterVec(prometheus.CounterOpts{
 			Namespace: "cortex",
 			Name:      "distributor_ingester_appends_total",
@@ -150,6 +433,32 @@ func New(cfg Config, ring ReadRing) (*Distributor, error) {
 			Name:      "distributor_ingester_query_failures_total",
 			Help:      "The total number of failed queries sent to ingesters.",
 		}, []string{"ingester"}),
+		ingesterConnectionRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "cortex",
+			Name:      "distributor_ingester_connection_requests_total",
+			Help:      "The total number of requests sent on each connection to ingesters.",
+		}, []string{"ingester", "connection"}),
+		ingesterConnectionInflight: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "cortex",
+			Name:      "distributor_ingester_connection_inflight_requests",
+			Help:      "The number of requests in flight on each connection to ingesters.",
+		}, []string{"ingester", "connection"}),
+		recycledClients: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "cortex",
+			Name:      "distributor_ingester_clients_recycled_total",
+			Help:      "The total number of clients for ingesters closed for reaching their max age, or being idle.",
+		}, []string{"reason"}),
+	}
+	d.pusher = MergePushMiddleware(
+		PushMiddlewareFunc(d.debugSamples),
+		PushMiddlewareFunc(d.nativeHistograms),
+		PushMiddlewareFunc(d.rename),
+		PushMiddlewareFunc(d.validate),
+		PushMiddlewareFunc(d.limit),
+		MergePushMiddleware(cfg.PushMiddleware...),
+	).WrapPush(PushFunc(d.send))
+	if cfg.PushWorkers > 0 {
+		d.sendPool = newSendPool(cfg.PushWorkers, cfg.PushWorkerQueueSize, d.sendPoolWaits)
 	}
 	go d.Run()
 	return d, nil
@@ -162,6 +471,7 @@ func (d *Distributor) Run() {
 		select {
 		case <-cleanupClients.C:
 			d.removeStaleIngesterClients()
+			d.sampleDebugger.expire(time.Now())
 		case <-d.quit:
 			close(d.done)
 			return
@@ -169,10 +479,13 @@ func (d *Distributor) Run() {
 	}
 }
 
-// Stop stops the distributor's maintenance loop.
+// Stop stops the distributor's maintenance loop, and its push workers.
 func (d *Distributor) Stop() {
 	close(d.quit)
 	<-d.done
+	if d.sendPool != nil {
+		d.sendPool.stop()
+	}
 }
 
 func (d *Distributor) removeStaleIngesterClients() {
@@ -184,20 +497,49 @@ func (d *Distributor) removeStaleIngesterClients() {
 		ingesters[ing.Addr] = struct{}{}
 	}
 
+	now := time.Now()
 	for addr, client := range d.clients {
-		if _, ok := ingesters[addr]; ok {
+		if _, ok := ingesters[addr]; !ok {
+			log.Info("Removing stale ingester client for ", addr)
+			d.removeClient(addr, client, 0)
 			continue
 		}
-		log.Info("Removing stale ingester client for ", addr)
-		delete(d.clients, addr)
 
-		// Do the gRPC closing in the background since it might take a while and
-		// we're holding a mutex.
-		go func(addr string, conn *grpc.ClientConn) {
-			if err := conn.Close(); err != nil {
-				log.Errorf("Error closing connection to ingester %q: %v", addr, err)
+		reason := ""
+		if d.cfg.ClientMaxAge > 0 && now.After(client.expires) {
+			reason = "max_age"
+		} else if d.cfg.ClientIdleTimeout > 0 && now.Sub(time.Unix(0, atomic.LoadInt64(client.lastUsed))) > d.cfg.ClientIdleTimeout {
+			reason = "idle"
+		}
+		if reason != "" {
+			log.Debugf("Recycling ingester client for %s: %s", addr, reason)
+			d.recycledClients.WithLabelValues(reason).Inc()
+			// Requests in flight on the old connections get as long as
+			// they're allowed to finish, while new ones dial afresh.
+			d.removeClient(addr, client, d.cfg.RemoteTimeout)
+		}
+	}
+}
+
+// removeClient removes the client for an ingester, closing its connections
+// after the delay. Must be called with clientsMtx held.
+func (d *Distributor) removeClient(addr string, client ingesterClient, delay time.Duration) {
+	delete(d.clients, addr)
+	d.symbolizingMtx.Lock()
+	delete(d.symbolizing, addr)
+	d.symbolizingMtx.Unlock()
+	d.forgetConnections(addr, len(client.conns))
+
+	// Do the gRPC closing in the background since it might take a while and
+	// we're holding a mutex.
+	for _, conn := range client.conns {
+		time.AfterFunc(delay, func(conn *grpc.ClientConn) func() {
+			return func() {
+				if err := conn.Close(); err != nil {
+					log.Errorf("Error closing connection to ingester %q: %v", addr, err)
+				}
 			}
-		}(addr, client.conn)
+		}(conn))
 	}
 }
 
@@ -206,6 +548,7 @@ func (d *Distributor) getClientFor(ingester *ring.IngesterDesc) (cortex.Ingester
 	client, ok := d.clients[ingester.Addr]
 	d.clientsMtx.RUnlock()
 	if ok {
+		atomic.StoreInt64(client.lastUsed, time.Now().UnixNano())
 		return client, nil
 	}
 
@@ -213,36 +556,36 @@ func (d *Distributor) getClientFor(ingester *ring.IngesterDesc) (cortex.Ingester
 	defer d.clientsMtx.Unlock()
 	client, ok = d.clients[ingester.Addr]
 	if ok {
+		atomic.StoreInt64(client.lastUsed, time.Now().UnixNano())
 		return client, nil
 	}
 
-	if d.cfg.ingesterClientFactory != nil {
+	if server, ok := d.cfg.InProcessIngesters[ingester.Addr]; ok {
+		client = ingesterClient{
+			IngesterClient: inProcessIngesterClient{server},
+		}
+	} else if d.cfg.ingesterClientFactory != nil {
 		client = ingesterClient{
 			IngesterClient: d.cfg.ingesterClientFactory(ingester.Addr),
 		}
 	} else {
-		conn, err := grpc.Dial(
-			ingester.Addr,
-			grpc.WithTimeout(d.cfg.RemoteTimeout),
-			grpc.WithInsecure(),
-			grpc.WithUnaryInterceptor(grpc_middleware.ChainUnaryClient(
-				otgrpc.OpenTracingClientInterceptor(opentracing.GlobalTracer()),
-				middleware.ClientUserHeaderInterceptor,
-			)),
-		)
+		var err error
+		client, err = d.dialIngester(ingester.Addr)
 		if err != nil {
 			return nil, err
 		}
-		client = ingesterClient{
-			IngesterClient: cortex.NewIngesterClient(conn),
-			conn:           conn,
-		}
 	}
+	now := time.Now()
+	lastUsed := now.UnixNano()
+	client.lastUsed = &lastUsed
+	// Jitter the max age so the connections dialed together, eg. on startup,
+	// aren't all redialed together.
+	client.expires = now.Add(d.cfg.ClientMaxAge - time.Duration(rand.Int63n(int64(d.cfg.ClientMaxAge)/10+1)))
 	d.clients[ingester.Addr] = client
 	return client, nil
 }
 
-func tokenForLabels(userID string, labels []cortex.LabelPair) (uint32, error) {
+func tokenForLabels(tokenFor tokenHasher, userID string, labels []cortex.LabelPair) (uint32, error) {
 	for _, label := range labels {
 		if label.Name.Equal(labelNameBytes) {
 			return tokenFor(userID, label.Value), nil
@@ -251,20 +594,16 @@ func tokenForLabels(userID string, labels []cortex.LabelPair) (uint32, error) {
 	return 0, fmt.Errorf("No metric name label")
 }
 
-func tokenFor(userID string, name []byte) uint32 {
-	h := fnv.New32()
-	h.Write([]byte(userID))
-	h.Write(name)
-	return h.Sum32()
-}
-
 type sampleTracker struct {
 	labels      []cortex.LabelPair
 	sample      cortex.Sample
+	key         uint32
+	replicas    []*ring.IngesterDesc
 	minSuccess  int
 	maxFailures int
 	succeeded   int32
 	failed      int32
+	extensions  int32
 }
 
 type pushTracker struct {
@@ -272,10 +611,182 @@ type pushTracker struct {
 	samplesFailed  int32
 	done           chan struct{}
 	err            chan error
+
+	// The samples rejected by too many of their ingesters to be written, by
+	// reason, and the last rejection's error.
+	rejectedMtx sync.Mutex
+	rejected    map[string]int
+	rejectedErr error
+
+	// The sends of the push yet to finish, including those after it
+	// returned; the last to finish checks whether the push was degraded.
+	sendsPending int32
 }
 
-// Push implements cortex.IngesterServer
+// Push implements cortex.IngesterServer. Pushes go through the validation and
+// limits, then any PushMiddleware from the Config, before being sent to the
+// ingesters. Bulk pushes are shed first when too many are in flight.
 func (d *Distributor) Push(ctx context.Context, req *cortex.WriteRequest) (*cortex.WriteResponse, error) {
+	sp, ctx := util.StartSpanFromContext(ctx, "Distributor.Push")
+	defer sp.Finish()
+	sp.SetTag("series", len(req.Timeseries))
+	sp.SetTag("samples", countSamples(req))
+	sp.SetTag("priority", req.Priority.String())
+
+	if err := d.inflight.Acquire(req.Priority); err != nil {
+		d.shedPushes.WithLabelValues(strings.ToLower(req.Priority.String())).Inc()
+		ext.Error.Set(sp, true)
+		return nil, err
+	}
+	defer d.inflight.Release()
+
+	resp, err := d.pusher.Push(ctx, req)
+	if err != nil {
+		ext.Error.Set(sp, true)
+	}
+	return resp, err
+}
+
+func countSamples(req *cortex.WriteRequest) int {
+	count := 0
+	for _, ts := range req.Timeseries {
+		count += len(ts.Samples)
+	}
+	return count
+}
+
+// validate rejects pushes of series without a metric name, and skips those
+// without any samples. Series exceeding the user's label limits are discarded,
+// the rest being pushed before the last limit exceeded is returned, or, for
+// pushes which may partially succeed, recorded first.
+func (d *Distributor) validate(next Pusher) Pusher {
+	return PushFunc(func(ctx context.Context, req *cortex.WriteRequest) (*cortex.WriteResponse, error) {
+		userID, err := user.Extract(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		begin := time.Now()
+		for _, ts := range req.Timeseries {
+			if _, err := tokenForLabels(d.tokenFor, userID, ts.Labels); err != nil {
+				return nil, err
+			}
+		}
+
+		numSamples := countSamples(req)
+		d.receivedSamples.Add(float64(numSamples))
+		if req.Source == cortex.RULE {
+			d.receivedRuleSamples.WithLabelValues(userID).Add(float64(numSamples))
+		}
+
+		var (
+			limits       = d.labelLimits(userID)
+			lastLimitErr *util.LimitError
+			validSeries  = req.Timeseries[:0]
+			validSamples = 0
+			rejected     = map[string]int{}
+		)
+		for _, ts := range req.Timeseries {
+			if err := util.ValidateLabels(limits, ts.Labels); err != nil {
+				lastLimitErr = err.(*util.LimitError)
+				rejected[lastLimitErr.Limit] += len(ts.Samples)
+				d.discardedSamples.WithLabelValues(userID, lastLimitErr.Limit).Add(float64(len(ts.Samples)))
+				recordFate(ctx, ts.Labels, fateRejected, lastLimitErr.Error())
+				continue
+			}
+			validSeries = append(validSeries, ts)
+			validSamples += len(ts.Samples)
+		}
+		req.Timeseries = validSeries
+		d.observePushStage(validationStage, begin)
+
+		if validSamples > 0 {
+			partial := lastLimitErr != nil && rejectSamples(ctx, rejected, lastLimitErr)
+			resp, err := next.Push(ctx, req)
+			if err != nil || lastLimitErr == nil {
+				return resp, err
+			}
+			// The limit error is returned for the discarded series, unless
+			// the push may partially succeed; the rest were pushed.
+			recordFates(ctx, req, fateAccepted, "")
+			if partial {
+				return resp, nil
+			}
+		}
+		if lastLimitErr != nil {
+			return nil, lastLimitErr
+		}
+		return &cortex.WriteResponse{}, nil
+	})
+}
+
+// limit applies the per-user ingestion rate limits. Pushes which may
+// partially succeed push as many of their samples as the limits allow.
+func (d *Distributor) limit(next Pusher) Pusher {
+	return PushFunc(func(ctx context.Context, req *cortex.WriteRequest) (*cortex.WriteResponse, error) {
+		userID, err := user.Extract(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		now, numSamples := time.Now(), countSamples(req)
+		if limiter, limit := d.getOrCreateIngestLimiter(userID, req.Source); limiter != nil && !limiter.AllowN(now, numSamples) {
+			limitErr := &util.LimitError{
+				Limit:      util.IngestionRateLimit,
+				Configured: limit,
+				Observed:   float64(numSamples),
+				RetryAfter: float64(numSamples) / limit,
+				Message:    errIngestionRateLimitExceeded.Error(),
+			}
+			allowed := 0
+			if mayPartiallySucceed(ctx) {
+				allowed = allowSome(limiter, now, numSamples)
+			}
+			d.rateLimitedSamples.WithLabelValues(userID, strings.ToLower(req.Source.String())).Add(float64(numSamples - allowed))
+			if allowed == 0 || !rejectSamples(ctx, map[string]int{util.IngestionRateLimit: numSamples - allowed}, limitErr) {
+				return nil, limitErr
+			}
+			truncateSamples(req, allowed)
+		}
+		return next.Push(ctx, req)
+	})
+}
+
+// allowSome takes as many of fewer than n samples as the limiter allows, by
+// asking for each power of two of them in turn, largest first, returning how
+// many it took.
+func allowSome(limiter ingestLimiter, now time.Time, n int) int {
+	chunk := 1
+	for chunk*2 < n {
+		chunk *= 2
+	}
+	allowed := 0
+	for ; chunk > 0; chunk /= 2 {
+		if allowed+chunk < n && limiter.AllowN(now, chunk) {
+			allowed += chunk
+		}
+	}
+	return allowed
+}
+
+// truncateSamples keeps the first n samples of the push, in order of series.
+func truncateSamples(req *cortex.WriteRequest, n int) {
+	for i, ts := range req.Timeseries {
+		if n == 0 {
+			req.Timeseries = req.Timeseries[:i]
+			return
+		}
+		if len(ts.Samples) >= n {
+			req.Timeseries[i].Samples = ts.Samples[:n]
+			req.Timeseries = req.Timeseries[:i+1]
+			return
+		}
+		n -= len(ts.Samples)
+	}
+}
+
+// send shards the samples across the ingesters, and sends them to each.
+func (d *Distributor) send(ctx context.Context, req *cortex.WriteRequest) (*cortex.WriteResponse, error) {
 	userID, err := user.Extract(ctx)
 	if err != nil {
 		return nil, err
@@ -287,7 +798,7 @@ func (d *Distributor) Push(ctx context.Context, req *cortex.WriteRequest) (*cort
 	samples := make([]sampleTracker, 0, len(req.Timeseries))
 	keys := make([]uint32, 0, len(req.Timeseries))
 	for _, ts := range req.Timeseries {
-		key, err := tokenForLabels(userID, ts.Labels)
+		key, err := tokenForLabels(d.tokenFor, userID, ts.Labels)
 		if err != nil {
 			return nil, err
 		}
@@ -296,24 +807,20 @@ func (d *Distributor) Push(ctx context.Context, req *cortex.WriteRequest) (*cort
 			samples = append(samples, sampleTracker{
 				labels: ts.Labels,
 				sample: s,
+				key:    key,
 			})
 		}
 	}
-	d.receivedSamples.Add(float64(len(samples)))
-
 	if len(samples) == 0 {
 		return &cortex.WriteResponse{}, nil
 	}
 
-	limiter := d.getOrCreateIngestLimiter(userID)
-	if !limiter.AllowN(time.Now(), len(samples)) {
-		return nil, errIngestionRateLimitExceeded
-	}
-
 	var ingesters [][]*ring.IngesterDesc
+	begin := time.Now()
 	if err := instrument.TimeRequestHistogram(ctx, "Distributor.Push[ring-lookup]", nil, func(ctx context.Context) error {
+		opentracing.SpanFromContext(ctx).SetTag("keys", len(keys))
 		var err error
-		ingesters, err = d.ring.BatchGet(keys, d.cfg.ReplicationFactor, ring.Write)
+		ingesters, err = d.ring.BatchGetInPool(d.pool(userID), keys, d.replicationFactor(userID), ring.Write)
 		if err != nil {
 			return err
 		}
@@ -321,13 +828,28 @@ func (d *Distributor) Push(ctx context.Context, req *cortex.WriteRequest) (*cort
 	}); err != nil {
 		return nil, err
 	}
+	d.observePushStage(ringLookupStage, begin)
+
+	// The fewest live replicas any sample has, and how many of those are spare
+	// beyond its quorum.
+	fewestLive, fewestSpare := -1, -1
+	defer func() {
+		d.pushLiveReplicas.Observe(float64(fewestLive))
+		if fewestSpare < 0 {
+			fewestSpare = 0
+		}
+		d.pushSpareReplicas.Observe(float64(fewestSpare))
+	}()
 
 	samplesByIngester := map[*ring.IngesterDesc][]*sampleTracker{}
 	for i := range samples {
-		// We need a response from a quorum of ingesters, which is n/2 + 1.
+		// We need a response from a quorum of ingesters, which is n/2 + 1. A
+		// zone-aware ring writes to one ingester per zone, so this is a quorum
+		// of zones too.
 		minSuccess := (len(ingesters[i]) / 2) + 1
 		samples[i].minSuccess = minSuccess
 		samples[i].maxFailures = len(ingesters[i]) - minSuccess
+		samples[i].replicas = ingesters[i]
 
 		// Skip those that have not heartbeated in a while. NB these are still
 		// included in the calculation of minSuccess, so if too many failed ingesters
@@ -339,6 +861,13 @@ func (d *Distributor) Push(ctx context.Context, req *cortex.WriteRequest) (*cort
 			}
 		}
 
+		if fewestLive < 0 || len(liveIngesters) < fewestLive {
+			fewestLive = len(liveIngesters)
+		}
+		if spare := len(liveIngesters) - minSuccess; fewestSpare < 0 || spare < fewestSpare {
+			fewestSpare = spare
+		}
+
 		// This is just a shortcut - if there are not minSuccess available ingesters,
 		// after filtering out dead ones, don't even bother trying.
 		if len(liveIngesters) < minSuccess {
@@ -352,39 +881,172 @@ func (d *Distributor) Push(ctx context.Context, req *cortex.WriteRequest) (*cort
 		}
 	}
 
+	// Each channel is sent to at most once, and may not be received from if
+	// the push fails to queue its sends, so they mustn't block.
 	pushTracker := pushTracker{
 		samplesPending: int32(len(samples)),
-		done:           make(chan struct{}),
-		err:            make(chan error),
+		sendsPending:   int32(len(samplesByIngester)),
+		done:           make(chan struct{}, 1),
+		err:            make(chan error, 1),
 	}
-	for ingester, samples := range samplesByIngester {
-		go func(ingester *ring.IngesterDesc, samples []*sampleTracker) {
-			d.sendSamples(ctx, ingester, samples, &pushTracker)
-		}(ingester, samples)
+	for ingester, ingesterSamples := range samplesByIngester {
+		ingester, ingesterSamples := ingester, ingesterSamples
+		send := func() {
+			d.sendSamples(ctx, ingester, ingesterSamples, req, &pushTracker)
+			if atomic.AddInt32(&pushTracker.sendsPending, -1) == 0 {
+				d.checkDegradedQuorum(samples, &pushTracker)
+			}
+		}
+		if d.sendPool == nil {
+			go send()
+			continue
+		}
+		// A push failing to queue its sends isn't checked, as those queued
+		// never all finish.
+		if err := d.sendPool.submit(ctx, send); err != nil {
+			return nil, err
+		}
 	}
+
+	sp, _ := util.StartSpanFromContext(ctx, "Distributor.Push[quorum-wait]")
+	sp.SetTag("ingesters", len(samplesByIngester))
+	defer sp.Finish()
+	defer d.observePushStage(quorumWaitStage, time.Now())
 	select {
 	case err := <-pushTracker.err:
 		return nil, err
 	case <-pushTracker.done:
-		return &cortex.WriteResponse{}, nil
+		return pushTracker.result(ctx, len(samples))
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// reject records that a sample was rejected by too many of its ingesters to
+// be written.
+func (p *pushTracker) reject(reason string, err error) {
+	p.rejectedMtx.Lock()
+	defer p.rejectedMtx.Unlock()
+	if p.rejected == nil {
+		p.rejected = map[string]int{}
+	}
+	p.rejected[reason]++
+	p.rejectedErr = err
+}
+
+// result returns the result of a push of the samples which has written all
+// those its ingesters didn't reject. It fails if any were rejected, unless the
+// push may partially succeed and some were written.
+func (p *pushTracker) result(ctx context.Context, samples int) (*cortex.WriteResponse, error) {
+	p.rejectedMtx.Lock()
+	defer p.rejectedMtx.Unlock()
+	rejected := 0
+	for _, n := range p.rejected {
+		rejected += n
+	}
+	if rejected > 0 && (rejected == samples || !rejectSamples(ctx, p.rejected, p.rejectedErr)) {
+		if limitErr, ok := p.rejectedErr.(*util.LimitError); ok {
+			return nil, limitErr.GRPCError()
+		}
+		return nil, p.rejectedErr
+	}
+	acceptSamples(ctx, samples-rejected)
+	return &cortex.WriteResponse{}, nil
+}
+
+// The stages of a push, timed by pushStageDuration.
+const (
+	validationStage    = "validation"
+	ringLookupStage    = "ring_lookup"
+	serializationStage = "serialization"
+	sendStage          = "send"
+	quorumWaitStage    = "quorum_wait"
+)
+
+func (d *Distributor) observePushStage(stage string, begin time.Time) {
+	d.pushStageDuration.WithLabelValues(stage).Observe(time.Since(begin).Seconds())
+}
+
+// checkDegradedQuorum counts a push whose sends have all finished as degraded
+// if it succeeded with a sample written to only its quorum of ingesters when
+// more were expected: one more failure would have failed it.
+func (d *Distributor) checkDegradedQuorum(samples []sampleTracker, pushTracker *pushTracker) {
+	if atomic.LoadInt32(&pushTracker.samplesFailed) > 0 {
+		return
+	}
+	for i := range samples {
+		if samples[i].maxFailures > 0 && int(atomic.LoadInt32(&samples[i].succeeded)) == samples[i].minSuccess {
+			d.degradedQuorumPushes.Inc()
+			return
+		}
 	}
 }
 
-func (d *Distributor) getOrCreateIngestLimiter(userID string) *rate.Limiter {
+// userIngestLimiter is a user's rate limiter, and the limits it was made
+// with.
+type userIngestLimiter struct {
+	ingestLimiter
+	limit float64
+	burst int
+}
+
+// getOrCreateIngestLimiter returns the limiter for the user and source of the
+// samples, and its rate limit, or nil if samples from that source are not
+// rate limited. The limiter is replaced if the user's limits have changed.
+func (d *Distributor) getOrCreateIngestLimiter(userID string, source cortex.SampleSource) (ingestLimiter, float64) {
+	limit, burst := d.limiter.IngestionRate(userID, source)
+	if limit <= 0 {
+		return nil, 0
+	}
+	limiters := d.ingestLimiters
+	if source == cortex.RULE {
+		limiters = d.ruleIngestLimiters
+	}
+
 	d.ingestLimitersMtx.Lock()
 	defer d.ingestLimitersMtx.Unlock()
 
-	if limiter, ok := d.ingestLimiters[userID]; ok {
-		return limiter
+	if limiter, ok := limiters[userID]; ok && limiter.limit == limit && limiter.burst == burst {
+		return limiter, limit
 	}
 
-	limiter := rate.NewLimiter(rate.Limit(d.cfg.IngestionRateLimit), d.cfg.IngestionBurstSize)
-	d.ingestLimiters[userID] = limiter
-	return limiter
+	// The strategy was checked in New.
+	limiter, _ := newIngestLimiter(d.cfg.IngestionRateStrategy, limit, burst, d.cfg.IngestionRateWindow)
+	limiters[userID] = userIngestLimiter{ingestLimiter: limiter, limit: limit, burst: burst}
+	return limiter, limit
 }
 
-func (d *Distributor) sendSamples(ctx context.Context, ingester *ring.IngesterDesc, sampleTrackers []*sampleTracker, pushTracker *pushTracker) {
-	err := d.sendSamplesErr(ctx, ingester, sampleTrackers)
+// sendSamples sends the samples of the push to the ingester, tracking the
+// push's progress.
+func (d *Distributor) sendSamples(ctx context.Context, ingester *ring.IngesterDesc, sampleTrackers []*sampleTracker, push *cortex.WriteRequest, pushTracker *pushTracker) {
+	err := d.sendSamplesErr(ctx, ingester, sampleTrackers, push)
+	succeeded, failed := sampleTrackers, []*sampleTracker(nil)
+	rejected, ok := util.RejectedSamplesErrorFromGRPC(err)
+	if ok {
+		// The ingester wrote the samples it didn't reject.
+		succeeded = make([]*sampleTracker, 0, len(sampleTrackers))
+		for j, s := range sampleTrackers {
+			reason, ok := rejected.Samples[j]
+			if !ok {
+				succeeded = append(succeeded, s)
+				continue
+			}
+			// A sample rejected by more ingesters than may fail is rejected
+			// alone, rather than failing the push.
+			if atomic.AddInt32(&s.failed, 1) != int32(s.maxFailures)+1 {
+				continue
+			}
+			pushTracker.reject(reason, rejected.Err)
+			if atomic.AddInt32(&pushTracker.samplesPending, -1) == 0 {
+				pushTracker.done <- struct{}{}
+			}
+		}
+	} else if err != nil {
+		succeeded, failed = nil, sampleTrackers
+		if d.cfg.ExtendFailedReplicas {
+			succeeded, failed = d.extendReplicas(ctx, sampleTrackers, push)
+		}
+	}
 
 	// If we succeed, decrement each sample's pending count by one.  If we reach
 	// the required number of successful puts on this sample, then decrement the
@@ -395,33 +1057,106 @@ func (d *Distributor) sendSamples(ctx context.Context, ingester *ring.IngesterDe
 	//
 	// The use of atomic increments here guarantees only a single sendSamples
 	// goroutine will write to either channel.
-	for i := range sampleTrackers {
-		if err != nil {
-			if atomic.AddInt32(&sampleTrackers[i].failed, 1) <= int32(sampleTrackers[i].maxFailures) {
-				continue
-			}
-			if atomic.AddInt32(&pushTracker.samplesFailed, 1) == 1 {
-				pushTracker.err <- err
-			}
-		} else {
-			if atomic.AddInt32(&sampleTrackers[i].succeeded, 1) != int32(sampleTrackers[i].minSuccess) {
-				continue
+	for _, s := range failed {
+		if atomic.AddInt32(&s.failed, 1) <= int32(s.maxFailures) {
+			continue
+		}
+		if atomic.AddInt32(&pushTracker.samplesFailed, 1) == 1 {
+			pushTracker.err <- err
+		}
+	}
+	for _, s := range succeeded {
+		if atomic.AddInt32(&s.succeeded, 1) != int32(s.minSuccess) {
+			continue
+		}
+		if atomic.AddInt32(&pushTracker.samplesPending, -1) == 0 {
+			pushTracker.done <- struct{}{}
+		}
+	}
+}
+
+// extendReplicas retries the samples an ingester failed to take on the next
+// ingester in the ring for each, beyond those they were sent to, within the
+// push's deadline. It returns the samples whose replica was saved, and those
+// which still failed.
+func (d *Distributor) extendReplicas(ctx context.Context, samples []*sampleTracker, push *cortex.WriteRequest) (succeeded, failed []*sampleTracker) {
+	pool, replicationFactor := d.poolFor(ctx), d.replicationFactorFor(ctx)
+	samplesByIngester := map[*ring.IngesterDesc][]*sampleTracker{}
+	for _, s := range samples {
+		ingester := d.extensionFor(pool, replicationFactor, s)
+		if ingester == nil {
+			failed = append(failed, s)
+			continue
+		}
+		samplesByIngester[ingester] = append(samplesByIngester[ingester], s)
+	}
+
+	var (
+		mtx sync.Mutex
+		wg  sync.WaitGroup
+	)
+	wg.Add(len(samplesByIngester))
+	for ingester, samples := range samplesByIngester {
+		go func(ingester *ring.IngesterDesc, samples []*sampleTracker) {
+			defer wg.Done()
+			err := d.sendSamplesErr(ctx, ingester, samples, push)
+			mtx.Lock()
+			defer mtx.Unlock()
+			if err != nil {
+				failed = append(failed, samples...)
+			} else {
+				succeeded = append(succeeded, samples...)
 			}
-			if atomic.AddInt32(&pushTracker.samplesPending, -1) == 0 {
-				pushTracker.done <- struct{}{}
+		}(ingester, samples)
+	}
+	wg.Wait()
+
+	d.extendedSamples.WithLabelValues("saved").Add(float64(len(succeeded)))
+	d.extendedSamples.WithLabelValues("failed").Add(float64(len(failed)))
+	return succeeded, failed
+}
+
+// extensionFor returns the live ingester to retry a sample on when one of its
+// replicas fails: the next in the ring beyond those it was sent to, a
+// different one for each failure, or nil if there are no more.
+func (d *Distributor) extensionFor(pool string, replicationFactor int, s *sampleTracker) *ring.IngesterDesc {
+	n := int(atomic.AddInt32(&s.extensions, 1))
+	ingesters, err := d.ring.GetInPool(pool, s.key, replicationFactor+n, ring.Write)
+	if err != nil {
+		return nil
+	}
+outer:
+	for _, ingester := range ingesters {
+		for _, replica := range s.replicas {
+			if replica.Addr == ingester.Addr {
+				continue outer
 			}
 		}
+		if n--; n > 0 {
+			continue
+		}
+		if time.Now().Sub(time.Unix(ingester.Timestamp, 0)) > d.cfg.HeartbeatTimeout {
+			return nil
+		}
+		return ingester
 	}
+	return nil
 }
 
-func (d *Distributor) sendSamplesErr(ctx context.Context, ingester *ring.IngesterDesc, samples []*sampleTracker) error {
+// sendSamplesErr sends the samples to the ingester in a request with the
+// source, idempotency key and priority of the push.
+func (d *Distributor) sendSamplesErr(ctx context.Context, ingester *ring.IngesterDesc, samples []*sampleTracker, push *cortex.WriteRequest) error {
 	client, err := d.getClientFor(ingester)
 	if err != nil {
 		return err
 	}
 
+	begin := time.Now()
 	req := &cortex.WriteRequest{
-		Timeseries: make([]cortex.TimeSeries, 0, len(samples)),
+		Timeseries:     make([]cortex.TimeSeries, 0, len(samples)),
+		Source:         push.Source,
+		IdempotencyKey: push.IdempotencyKey,
+		Priority:       push.Priority,
 	}
 	for _, s := range samples {
 		req.Timeseries = append(req.Timeseries, cortex.TimeSeries{
@@ -430,10 +1165,41 @@ func (d *Distributor) sendSamplesErr(ctx context.Context, ingester *ring.Ingeste
 		})
 	}
 
+	numSeries := len(req.Timeseries)
+	symbolized := d.cfg.SymbolizeRequests && d.acceptsSymbolized(ingester.Addr)
+	if symbolized {
+		util.SymbolizeWriteRequest(req)
+	}
+	d.observePushStage(serializationStage, begin)
+
+	begin = time.Now()
 	err = instrument.TimeRequestHistogram(ctx, "Distributor.sendSamples", d.sendDuration, func(ctx context.Context) error {
-		_, err := client.Push(ctx, req)
+		sp := opentracing.SpanFromContext(ctx)
+		util.TagSpanWithTenant(ctx, sp)
+		sp.SetTag("ingester", ingester.Addr)
+		sp.SetTag("samples", len(samples))
+		var header metadata.MD
+		_, err := client.Push(ctx, req, grpc.Header(&header))
+		if err != nil || !d.cfg.SymbolizeRequests {
+			return err
+		}
+		accepts := len(header[util.SymbolizedWritesMetadataKey]) > 0
+		d.setAcceptsSymbolized(ingester.Addr, accepts)
+
+		// An ingester which no longer accepts symbolized requests, eg after a
+		// rollback, ignored the series, so resend them. It may have recorded
+		// the idempotency key, so the retry goes without.
+		if symbolized && !accepts {
+			if err := util.DesymbolizeWriteRequest(req); err != nil {
+				return err
+			}
+			req.IdempotencyKey = ""
+			_, err = client.Push(ctx, req)
+		}
 		return err
 	})
+	d.observePushStage(sendStage, begin)
+	util.LogIfSlow(ctx, d.cfg.SlowIngesterRequestThreshold, begin, "Slow push to ingester", "ingester", ingester.Addr, "series", numSeries, "err", err)
 	d.ingesterAppends.WithLabelValues(ingester.Addr).Inc()
 	if err != nil {
 		d.ingesterAppendFailures.WithLabelValues(ingester.Addr).Inc()
@@ -441,14 +1207,57 @@ func (d *Distributor) sendSamplesErr(ctx context.Context, ingester *ring.Ingeste
 	return err
 }
 
+// acceptsSymbolized returns whether the ingester said it accepts symbolized
+// requests in its last response.
+func (d *Distributor) acceptsSymbolized(addr string) bool {
+	d.symbolizingMtx.RLock()
+	defer d.symbolizingMtx.RUnlock()
+	return d.symbolizing[addr]
+}
+
+// setAcceptsSymbolized records whether the ingester accepts symbolized
+// requests, as it says in the response to every push.
+func (d *Distributor) setAcceptsSymbolized(addr string, accepts bool) {
+	d.symbolizingMtx.Lock()
+	defer d.symbolizingMtx.Unlock()
+	d.symbolizing[addr] = accepts
+}
+
 // Query implements Querier.
 func (d *Distributor) Query(ctx context.Context, from, to model.Time, matchers ...*metric.LabelMatcher) (model.Matrix, error) {
-	var result model.Matrix
+	resps, err := d.queryResponses(ctx, from, to, matchers)
+	if err != nil {
+		return nil, err
+	}
+	return mergeResponses(resps)
+}
+
+// QueryIterators implements querier.IteratorQuerier. The iterators read the
+// samples straight from the ingesters' responses, rather than converting them
+// all to a matrix first. Each replica of a series has its own iterator; the
+// querier merges iterators over the same series as it reads them.
+func (d *Distributor) QueryIterators(ctx context.Context, from, to model.Time, matchers ...*metric.LabelMatcher) ([]local.SeriesIterator, error) {
+	resps, err := d.queryResponses(ctx, from, to, matchers)
+	if err != nil {
+		return nil, err
+	}
+	return responseIterators(resps)
+}
+
+// queryResponses returns the responses of the ingesters queried for the
+// series matching the matchers, which may each have some of them.
+func (d *Distributor) queryResponses(ctx context.Context, from, to model.Time, matchers []*metric.LabelMatcher) ([]*cortex.QueryResponse, error) {
+	var result []*cortex.QueryResponse
 	err := instrument.TimeRequestHistogram(ctx, "Distributor.Query", d.queryDuration, func(ctx context.Context) error {
 		userID, err := user.Extract(ctx)
 		if err != nil {
 			return err
 		}
+		util.TagSpanWithTenant(ctx, opentracing.SpanFromContext(ctx))
+
+		if err := d.checkJoining(ctx); err != nil {
+			return err
+		}
 
 		metricName, _, err := util.ExtractMetricNameFromMatchers(matchers)
 		if err != nil {
@@ -459,35 +1268,94 @@ func (d *Distributor) Query(ctx context.Context, from, to model.Time, matchers .
 		if err != nil {
 			return err
 		}
+		req.Columnar = d.cfg.ColumnarQueryResponses
 
-		ingesters, err := d.ring.Get(tokenFor(userID, []byte(metricName)), d.cfg.ReplicationFactor, ring.Read)
+		pool, replicationFactor := d.pool(userID), d.replicationFactor(userID)
+		ingesters, err := d.ring.GetInPool(pool, d.tokenFor(userID, []byte(metricName)), replicationFactor, ring.Read)
 		if err != nil {
 			return err
 		}
 
+		if d.migrateTokenFor != nil {
+			oldIngesters, err := d.ring.GetInPool(pool, d.migrateTokenFor(userID, []byte(metricName)), replicationFactor, ring.Read)
+			if err != nil {
+				return err
+			}
+			if !sameIngesters(ingesters, oldIngesters) {
+				result, err = d.queryMigratingIngesters(ctx, ingesters, oldIngesters, req)
+				return err
+			}
+		}
+
 		result, err = d.queryIngesters(ctx, ingesters, req)
 		return err
 	})
 	return result, err
 }
 
-// Query implements Querier.
-func (d *Distributor) queryIngesters(ctx context.Context, ingesters []*ring.IngesterDesc, req *cortex.QueryRequest) (model.Matrix, error) {
-	// We need a response from a quorum of ingesters, which is n/2 + 1.
-	minSuccess := (len(ingesters) / 2) + 1
-	maxErrs := len(ingesters) - minSuccess
-	if len(ingesters) < minSuccess {
-		return nil, fmt.Errorf("could only find %d ingesters for query. Need at least %d", len(ingesters), minSuccess)
+// queryMigratingIngesters queries both the ingesters series are now sent to,
+// and those they were sent to before migrating token hash.
+func (d *Distributor) queryMigratingIngesters(ctx context.Context, ingesters, oldIngesters []*ring.IngesterDesc, req *cortex.QueryRequest) ([]*cortex.QueryResponse, error) {
+	var (
+		oldResult []*cortex.QueryResponse
+		oldErr    error
+		done      = make(chan struct{})
+	)
+	go func() {
+		oldResult, oldErr = d.queryIngesters(ctx, oldIngesters, req)
+		close(done)
+	}()
+	result, err := d.queryIngesters(ctx, ingesters, req)
+	<-done
+	if err != nil {
+		return nil, err
+	}
+	if oldErr != nil {
+		return nil, oldErr
 	}
+	return append(result, oldResult...), nil
+}
+
+func sameIngesters(a, b []*ring.IngesterDesc) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	addrs := map[string]struct{}{}
+	for _, ing := range a {
+		addrs[ing.Addr] = struct{}{}
+	}
+	for _, ing := range b {
+		if _, ok := addrs[ing.Addr]; !ok {
+			return false
+		}
+	}
+	return true
+}
 
-	// Fetch samples from multiple ingesters
+// queryIngesters queries the ingesters, waiting for a quorum of them. With
+// zone-awareness, the quorum is of zones, each of which must answer from all
+// its ingesters, so the errors of whole zones are tolerated.
+func (d *Distributor) queryIngesters(ctx context.Context, ingesters []*ring.IngesterDesc, req *cortex.QueryRequest) ([]*cortex.QueryResponse, error) {
+	sp, ctx := util.StartSpanFromContext(ctx, "Distributor.queryIngesters")
+	defer sp.Finish()
+	sp.SetTag("ingesters", len(ingesters))
+
+	// We need a response from a quorum of groups, which is n/2 + 1.
+	groups := d.quorumGroups(ingesters)
+	minSuccess := (len(groups) / 2) + 1
+	maxErrs := len(groups) - minSuccess
+	if len(groups) < minSuccess {
+		return nil, fmt.Errorf("could only find %d ingesters for query. Need at least %d", len(groups), minSuccess)
+	}
+
+	// Fetch samples from multiple groups
 	var numErrs int32
 	errReceived := make(chan error)
-	results := make(chan model.Matrix, len(ingesters))
+	results := make(chan []*cortex.QueryResponse, len(groups))
 
-	for _, ing := range ingesters {
-		go func(ing *ring.IngesterDesc) {
-			result, err := d.queryIngester(ctx, ing, req)
+	for _, group := range groups {
+		go func(group []*ring.IngesterDesc) {
+			result, err := d.queryGroup(ctx, group, req)
 			if err != nil {
 				if atomic.AddInt32(&numErrs, 1) == int32(maxErrs+1) {
 					errReceived <- err
@@ -495,70 +1363,143 @@ func (d *Distributor) queryIngesters(ctx context.Context, ingesters []*ring.Inge
 			} else {
 				results <- result
 			}
-		}(ing)
+		}(group)
 	}
 
-	// Only wait for minSuccess ingesters (or an error), and accumulate the samples
-	// by fingerprint, merging them into any existing samples.
-	fpToSampleStream := map[model.Fingerprint]*model.SampleStream{}
+	// Only wait for minSuccess groups (or an error).
+	var result []*cortex.QueryResponse
 	for i := 0; i < minSuccess; i++ {
 		select {
 		case err := <-errReceived:
 			return nil, err
 
-		case result := <-results:
-			for _, ss := range result {
-				fp := ss.Metric.Fingerprint()
-				mss, ok := fpToSampleStream[fp]
-				if !ok {
-					mss = &model.SampleStream{
-						Metric: ss.Metric,
-					}
-					fpToSampleStream[fp] = mss
-				}
-				mss.Values = util.MergeSamples(mss.Values, ss.Values)
-			}
+		case resps := <-results:
+			result = append(result, resps...)
+		}
+	}
+
+	if failed := atomic.LoadInt32(&numErrs); failed > 0 {
+		util.AddWarning(ctx, "%d of %d replicas unavailable, results may be incomplete", failed, len(groups))
+	}
+	return result, nil
+}
+
+// queryGroup queries all the ingesters of a quorum group, failing if any of
+// them does.
+func (d *Distributor) queryGroup(ctx context.Context, group []*ring.IngesterDesc, req *cortex.QueryRequest) ([]*cortex.QueryResponse, error) {
+	if len(group) == 1 {
+		resp, err := d.queryIngester(ctx, group[0], req)
+		if err != nil {
+			return nil, err
 		}
+		return []*cortex.QueryResponse{resp}, nil
 	}
 
-	result := model.Matrix{}
-	for _, ss := range fpToSampleStream {
-		result = append(result, ss)
+	results, errs := make(chan *cortex.QueryResponse), make(chan error)
+	for _, ing := range group {
+		go func(ing *ring.IngesterDesc) {
+			result, err := d.queryIngester(ctx, ing, req)
+			if err != nil {
+				errs <- err
+			} else {
+				results <- result
+			}
+		}(ing)
+	}
+
+	var result []*cortex.QueryResponse
+	var lastErr error
+	for range group {
+		select {
+		case r := <-results:
+			result = append(result, r)
+		case lastErr = <-errs:
+		}
+	}
+	if lastErr != nil {
+		return nil, lastErr
 	}
 	return result, nil
 }
 
-func (d *Distributor) queryIngester(ctx context.Context, ing *ring.IngesterDesc, req *cortex.QueryRequest) (model.Matrix, error) {
+func (d *Distributor) queryIngester(ctx context.Context, ing *ring.IngesterDesc, req *cortex.QueryRequest) (*cortex.QueryResponse, error) {
 	client, err := d.getClientFor(ing)
 	if err != nil {
 		return nil, err
 	}
 
+	begin := time.Now()
 	resp, err := client.Query(ctx, req)
 	d.ingesterQueries.WithLabelValues(ing.Addr).Inc()
 	if err != nil {
+		util.LogIfSlow(ctx, d.cfg.SlowIngesterRequestThreshold, begin, "Slow query of ingester", "ingester", ing.Addr, "err", err)
 		d.ingesterQueryFailures.WithLabelValues(ing.Addr).Inc()
 		return nil, err
 	}
+	util.LogIfSlow(ctx, d.cfg.SlowIngesterRequestThreshold, begin, "Slow query of ingester", "ingester", ing.Addr, "series", len(resp.Timeseries)+len(resp.ColumnarTimeseries))
+	for _, warning := range resp.Warnings {
+		util.AddWarning(ctx, "%s", warning)
+	}
 
-	return util.FromQueryResponse(resp), nil
+	return resp, nil
 }
 
-// forAllIngesters runs f, in parallel, for all ingesters
-func (d *Distributor) forAllIngesters(f func(cortex.IngesterClient) (interface{}, error)) ([]interface{}, error) {
-	resps, errs := make(chan interface{}), make(chan error)
-	ingesters := d.ring.GetAll()
+// checkJoining fails queries while too many of the ingesters in the user's
+// pool are joining: those yet to recover their series aren't read from, so
+// after a restart of the cluster most series would be missing. Otherwise it
+// warns that any joining are.
+func (d *Distributor) checkJoining(ctx context.Context) error {
+	pool := d.poolFor(ctx)
+	joining, total := 0, 0
+	for _, ingester := range d.ring.GetAll() {
+		if ingester.Pool != pool {
+			continue
+		}
+		total++
+		if ingester.State == ring.JOINING {
+			joining++
+		}
+	}
+	if joining == 0 {
+		return nil
+	}
+	if d.cfg.QueryMaxJoiningFraction > 0 && float64(joining)/float64(total) >= d.cfg.QueryMaxJoiningFraction {
+		return fmt.Errorf("partial data: %d of %d ingesters are still joining, retry once they have recovered their series", joining, total)
+	}
+	util.AddWarning(ctx, "%d of %d ingesters are still joining, results may be incomplete", joining, total)
+	return nil
+}
+
+// forAllIngesters runs f, in parallel, for all ingesters in the user's pool.
+// It tolerates the errors of fewer than half the replicas of any series: with
+// zone-awareness, those of any number of ingesters in as many zones.
+func (d *Distributor) forAllIngesters(ctx context.Context, f func(cortex.IngesterClient) (interface{}, error)) ([]interface{}, error) {
+	type ingesterErr struct {
+		ingester *ring.IngesterDesc
+		err      error
+	}
+	if err := d.checkJoining(ctx); err != nil {
+		return nil, err
+	}
+	resps, errs := make(chan interface{}), make(chan ingesterErr)
+	pool := d.poolFor(ctx)
+	ingesters := []*ring.IngesterDesc{}
+	for _, ingester := range d.ring.GetAll() {
+		if ingester.Pool == pool && ingester.State != ring.JOINING {
+			ingesters = append(ingesters, ingester)
+		}
+	}
 	for _, ingester := range ingesters {
 		go func(ingester *ring.IngesterDesc) {
 			client, err := d.getClientFor(ingester)
 			if err != nil {
-				errs <- err
+				errs <- ingesterErr{ingester, err}
 				return
 			}
 
 			resp, err := f(client)
 			if err != nil {
-				errs <- err
+				errs <- ingesterErr{ingester, err}
 			} else {
 				resps <- resp
 			}
@@ -566,17 +1507,20 @@ func (d *Distributor) forAllIngesters(f func(cortex.IngesterClient) (interface{}
 	}
 
 	var lastErr error
-	result, numErrs := []interface{}{}, 0
+	result, failedGroups := []interface{}{}, map[string]struct{}{}
 	for range ingesters {
 		select {
 		case resp := <-resps:
 			result = append(result, resp)
-		case lastErr = <-errs:
-			numErrs++
+		case err := <-errs:
+			lastErr = err.err
+			failedGroups[d.quorumGroup(err.ingester)] = struct{}{}
 		}
 	}
-	if numErrs > d.cfg.ReplicationFactor/2 {
+	if len(failedGroups) > d.replicationFactorFor(ctx)/2 {
 		return nil, lastErr
+	} else if len(failedGroups) > 0 {
+		util.AddWarning(ctx, "%d ingesters unavailable, results may be incomplete: %v", len(failedGroups), lastErr)
 	}
 	return result, nil
 }
@@ -586,7 +1530,7 @@ func (d *Distributor) LabelValuesForLabelName(ctx context.Context, labelName mod
 	req := &cortex.LabelValuesRequest{
 		LabelName: string(labelName),
 	}
-	resps, err := d.forAllIngesters(func(client cortex.IngesterClient) (interface{}, error) {
+	resps, err := d.forAllIngesters(ctx, func(client cortex.IngesterClient) (interface{}, error) {
 		return client.LabelValues(ctx, req)
 	})
 	if err != nil {
@@ -614,7 +1558,7 @@ func (d *Distributor) MetricsForLabelMatchers(ctx context.Context, from, through
 		return nil, err
 	}
 
-	resps, err := d.forAllIngesters(func(client cortex.IngesterClient) (interface{}, error) {
+	resps, err := d.forAllIngesters(ctx, func(client cortex.IngesterClient) (interface{}, error) {
 		return client.MetricsForLabelMatchers(ctx, req)
 	})
 	if err != nil {
@@ -641,7 +1585,7 @@ func (d *Distributor) MetricsForLabelMatchers(ctx context.Context, from, through
 // UserStats returns statistics about the current user.
 func (d *Distributor) UserStats(ctx context.Context) (*UserStats, error) {
 	req := &cortex.UserStatsRequest{}
-	resps, err := d.forAllIngesters(func(client cortex.IngesterClient) (interface{}, error) {
+	resps, err := d.forAllIngesters(ctx, func(client cortex.IngesterClient) (interface{}, error) {
 		return client.UserStats(ctx, req)
 	})
 	if err != nil {
@@ -651,11 +1595,16 @@ func (d *Distributor) UserStats(ctx context.Context) (*UserStats, error) {
 	totalStats := &UserStats{}
 	for _, resp := range resps {
 		totalStats.IngestionRate += resp.(*cortex.UserStatsResponse).IngestionRate
+		totalStats.IngestionBytesRate += resp.(*cortex.UserStatsResponse).IngestionBytesRate
+		totalStats.DiscardedRate += resp.(*cortex.UserStatsResponse).DiscardedRate
 		totalStats.NumSeries += resp.(*cortex.UserStatsResponse).NumSeries
 	}
 
-	totalStats.IngestionRate /= float64(d.cfg.ReplicationFactor)
-	totalStats.NumSeries /= uint64(d.cfg.ReplicationFactor)
+	replicationFactor := d.replicationFactorFor(ctx)
+	totalStats.IngestionRate /= float64(replicationFactor)
+	totalStats.IngestionBytesRate /= float64(replicationFactor)
+	totalStats.DiscardedRate /= float64(replicationFactor)
+	totalStats.NumSeries /= uint64(replicationFactor)
 
 	return totalStats, nil
 }
@@ -664,25 +1613,51 @@ func (d *Distributor) UserStats(ctx context.Context) (*UserStats, error) {
 func (d *Distributor) Describe(ch chan<- *prometheus.Desc) {
 	d.queryDuration.Describe(ch)
 	ch <- d.receivedSamples.Desc()
+	d.receivedRuleSamples.Describe(ch)
+	d.rateLimitedSamples.Describe(ch)
+	d.shedPushes.Describe(ch)
+	d.discardedSamples.Describe(ch)
 	d.sendDuration.Describe(ch)
+	d.pushStageDuration.Describe(ch)
+	d.pushLiveReplicas.Describe(ch)
+	d.pushSpareReplicas.Describe(ch)
+	d.degradedQuorumPushes.Describe(ch)
+	d.sendPoolWaits.Describe(ch)
+	d.extendedSamples.Describe(ch)
 	d.ring.Describe(ch)
 	ch <- numClientsDesc
 	d.ingesterAppends.Describe(ch)
 	d.ingesterAppendFailures.Describe(ch)
 	d.ingesterQueries.Describe(ch)
 	d.ingesterQueryFailures.Describe(ch)
+	d.ingesterConnectionRequests.Describe(ch)
+	d.ingesterConnectionInflight.Describe(ch)
+	d.recycledClients.Describe(ch)
 }
 
 // Collect implements prometheus.Collector.
 func (d *Distributor) Collect(ch chan<- prometheus.Metric) {
 	d.queryDuration.Collect(ch)
 	ch <- d.receivedSamples
+	d.receivedRuleSamples.Collect(ch)
+	d.rateLimitedSamples.Collect(ch)
+	d.shedPushes.Collect(ch)
+	d.discardedSamples.Collect(ch)
 	d.sendDuration.Collect(ch)
+	d.pushStageDuration.Collect(ch)
+	d.pushLiveReplicas.Collect(ch)
+	d.pushSpareReplicas.Collect(ch)
+	d.degradedQuorumPushes.Collect(ch)
+	d.sendPoolWaits.Collect(ch)
+	d.extendedSamples.Collect(ch)
 	d.ring.Collect(ch)
 	d.ingesterAppends.Collect(ch)
 	d.ingesterAppendFailures.Collect(ch)
 	d.ingesterQueries.Collect(ch)
 	d.ingesterQueryFailures.Collect(ch)
+	d.ingesterConnectionRequests.Collect(ch)
+	d.ingesterConnectionInflight.Collect(ch)
+	d.recycledClients.Collect(ch)
 	d.clientsMtx.RLock()
 	defer d.clientsMtx.RUnlock()
 	ch <- prometheus.MustNewConstMetric(
@@ -1,36 +1,65 @@
 package distributor
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
 	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/storage/metric"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
 
+	"github.com/weaveworks/common/middleware"
 	"github.com/weaveworks/common/user"
 	"github.com/weaveworks/cortex"
 	"github.com/weaveworks/cortex/ring"
+	"github.com/weaveworks/cortex/util"
 )
 
-// mockRing doesn't do any consistent hashing, just returns same ingesters for every query.
+// mockRing doesn't do any consistent hashing, just returns same ingesters in
+// the pool for every query.
 type mockRing struct {
 	prometheus.Counter
 	ingesters []*ring.IngesterDesc
+	zoneAware bool
 }
 
-func (r mockRing) Get(key uint32, n int, op ring.Operation) ([]*ring.IngesterDesc, error) {
-	return r.ingesters[:n], nil
+func (r mockRing) inPool(pool string) []*ring.IngesterDesc {
+	result := []*ring.IngesterDesc{}
+	for _, ingester := range r.ingesters {
+		if ingester.Pool == pool {
+			result = append(result, ingester)
+		}
+	}
+	return result
+}
+
+func (r mockRing) GetInPool(pool string, key uint32, n int, op ring.Operation) ([]*ring.IngesterDesc, error) {
+	ingesters := r.inPool(pool)
+	if n > len(ingesters) {
+		n = len(ingesters)
+	}
+	return ingesters[:n], nil
 }
 
-func (r mockRing) BatchGet(keys []uint32, n int, op ring.Operation) ([][]*ring.IngesterDesc, error) {
+func (r mockRing) BatchGetInPool(pool string, keys []uint32, n int, op ring.Operation) ([][]*ring.IngesterDesc, error) {
 	result := [][]*ring.IngesterDesc{}
 	for i := 0; i < len(keys); i++ {
-		result = append(result, r.ingesters[:n])
+		result = append(result, r.inPool(pool)[:n])
 	}
 	return result, nil
 }
@@ -39,6 +68,10 @@ func (r mockRing) GetAll() []*ring.IngesterDesc {
 	return r.ingesters
 }
 
+func (r mockRing) ZoneAwarenessEnabled() bool {
+	return r.zoneAware
+}
+
 type mockIngester struct {
 	happy bool
 }
@@ -83,18 +116,38 @@ func (i mockIngester) LabelValues(ctx context.Context, in *cortex.LabelValuesReq
 }
 
 func (i mockIngester) UserStats(ctx context.Context, in *cortex.UserStatsRequest, opts ...grpc.CallOption) (*cortex.UserStatsResponse, error) {
-	return nil, nil
+	return &cortex.UserStatsResponse{
+		IngestionRate:      3,
+		IngestionBytesRate: 30,
+		DiscardedRate:      1,
+		NumSeries:          10,
+	}, nil
 }
 
 func (i mockIngester) MetricsForLabelMatchers(ctx context.Context, in *cortex.MetricsForLabelMatchersRequest, opts ...grpc.CallOption) (*cortex.MetricsForLabelMatchersResponse, error) {
 	return nil, nil
 }
 
+func (i mockIngester) Cardinality(ctx context.Context, in *cortex.CardinalityRequest, opts ...grpc.CallOption) (*cortex.CardinalityResponse, error) {
+	return &cortex.CardinalityResponse{
+		LabelNames: []cortex.CardinalityEntry{
+			{Name: "__name__", Count: 2},
+			{Name: "instance", Count: 30},
+			{Name: "job", Count: 5},
+		},
+		MetricNames: []cortex.CardinalityEntry{
+			{Name: "bar", Count: 3},
+			{Name: "foo", Count: 30},
+		},
+	}, nil
+}
+
 func TestDistributorPush(t *testing.T) {
 	ctx := user.Inject(context.Background(), "user")
 	for i, tc := range []struct {
 		ingesters        []mockIngester
 		samples          int
+		source           cortex.SampleSource
 		expectedResponse *cortex.WriteResponse
 		expectedError    error
 	}{
@@ -131,6 +184,27 @@ func TestDistributorPush(t *testing.T) {
 			ingesters:     []mockIngester{{}, {}, {}},
 			expectedError: fmt.Errorf("Fail"),
 		},
+
+		// A push over the rate limit should fail
+		{
+			samples:   10001,
+			ingesters: []mockIngester{{true}, {true}, {true}},
+			expectedError: &util.LimitError{
+				Limit:      util.IngestionRateLimit,
+				Configured: 10000,
+				Observed:   10001,
+				RetryAfter: 1.0001,
+				Message:    errIngestionRateLimitExceeded.Error(),
+			},
+		},
+
+		// A push from the ruler over the rate limit should succeed
+		{
+			samples:          10001,
+			source:           cortex.RULE,
+			ingesters:        []mockIngester{{true}, {true}, {true}},
+			expectedResponse: &cortex.WriteResponse{},
+		},
 	} {
 		t.Run(fmt.Sprintf("[%d]", i), func(t *testing.T) {
 			ingesterDescs := []*ring.IngesterDesc{}
@@ -168,7 +242,7 @@ func TestDistributorPush(t *testing.T) {
 			}
 			defer d.Stop()
 
-			request := &cortex.WriteRequest{}
+			request := &cortex.WriteRequest{Source: tc.source}
 			for i := 0; i < tc.samples; i++ {
 				ts := cortex.TimeSeries{
 					Labels: []cortex.LabelPair{
@@ -284,6 +358,483 @@ func TestDistributorQuery(t *testing.T) {
 			response, err := d.Query(ctx, 0, 10, matcher)
 			assert.Equal(t, tc.expectedResponse, response, "Wrong response")
 			assert.Equal(t, tc.expectedError, err, "Wrong error")
+
+			// Iterators read each replica's response.
+			its, err := d.QueryIterators(ctx, 0, 10, matcher)
+			assert.Equal(t, tc.expectedError, err, "Wrong error")
+			for _, it := range its {
+				assert.Equal(t, tc.expectedResponse[0].Metric, it.Metric().Metric)
+				assert.Equal(t, tc.expectedResponse[0].Values, it.RangeValues(metric.Interval{OldestInclusive: 0, NewestInclusive: 10}))
+			}
 		})
 	}
 }
+
+func TestDistributorExtendFailedReplicas(t *testing.T) {
+	ctx := user.Inject(context.Background(), "user")
+
+	// The second and third replicas fail, so with a quorum of two the push
+	// only succeeds if one of their samples is saved by the fourth ingester.
+	for _, extend := range []bool{false, true} {
+		ingesterDescs := []*ring.IngesterDesc{}
+		ingesters := map[string]mockIngester{}
+		for i, happy := range []bool{true, false, false, true} {
+			addr := fmt.Sprintf("%d", i)
+			ingesterDescs = append(ingesterDescs, &ring.IngesterDesc{
+				Addr:      addr,
+				Timestamp: time.Now().Unix(),
+			})
+			ingesters[addr] = mockIngester{happy}
+		}
+		d, err := New(Config{
+			ReplicationFactor:    3,
+			HeartbeatTimeout:     1 * time.Minute,
+			RemoteTimeout:        1 * time.Minute,
+			ClientCleanupPeriod:  1 * time.Minute,
+			ExtendFailedReplicas: extend,
+			ingesterClientFactory: func(addr string) cortex.IngesterClient {
+				return ingesters[addr]
+			},
+		}, mockRing{
+			Counter:   prometheus.NewCounter(prometheus.CounterOpts{Name: "foo"}),
+			ingesters: ingesterDescs,
+		})
+		require.NoError(t, err)
+
+		_, err = d.Push(ctx, makeWriteRequest(1, cortex.API))
+		assert.Equal(t, !extend, err != nil, "extend %v: %v", extend, err)
+		if extend {
+			assert.Equal(t, 1.0, counterValue(t, d.extendedSamples.WithLabelValues("saved")))
+		}
+		d.Stop()
+	}
+}
+
+func TestDistributorQueryJoiningIngesters(t *testing.T) {
+	ctx := user.Inject(context.Background(), "user")
+	matcher, err := metric.NewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo")
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		joining int
+		err     bool
+	}{
+		{0, false},
+		{1, false},
+		{2, true},
+	} {
+		d := newTestDistributor(t, Config{QueryMaxJoiningFraction: 0.5})
+		for _, ingester := range d.ring.GetAll()[:tc.joining] {
+			ingester.State = ring.JOINING
+		}
+
+		ctx := util.WithWarnings(ctx)
+		_, err := d.Query(ctx, 0, 10, matcher)
+		assert.Equal(t, tc.err, err != nil, "%d joining: %v", tc.joining, err)
+		assert.Equal(t, tc.joining == 1, len(util.Warnings(ctx)) == 1, "%d joining: %v", tc.joining, util.Warnings(ctx))
+		_, err = d.UserStats(ctx)
+		assert.Equal(t, tc.err, err != nil, "%d joining: %v", tc.joining, err)
+		d.Stop()
+	}
+}
+
+func newTestDistributor(t testing.TB, cfg Config) *Distributor {
+	ingesterDescs := []*ring.IngesterDesc{}
+	ingesters := map[string]mockIngester{}
+	for i := 0; i < 3; i++ {
+		addr := fmt.Sprintf("%d", i)
+		ingesterDescs = append(ingesterDescs, &ring.IngesterDesc{
+			Addr:      addr,
+			Timestamp: time.Now().Unix(),
+		})
+		ingesters[addr] = mockIngester{true}
+	}
+
+	cfg.ReplicationFactor = 3
+	cfg.HeartbeatTimeout = 1 * time.Minute
+	cfg.RemoteTimeout = 1 * time.Minute
+	cfg.ClientCleanupPeriod = 1 * time.Minute
+	cfg.ingesterClientFactory = func(addr string) cortex.IngesterClient {
+		return ingesters[addr]
+	}
+	d, err := New(cfg, mockRing{
+		Counter: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "foo",
+		}),
+		ingesters: ingesterDescs,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func makeWriteRequest(samples int, source cortex.SampleSource) *cortex.WriteRequest {
+	request := &cortex.WriteRequest{Source: source}
+	for i := 0; i < samples; i++ {
+		request.Timeseries = append(request.Timeseries, cortex.TimeSeries{
+			Labels: []cortex.LabelPair{
+				{Name: []byte("__name__"), Value: []byte("foo")},
+				{Name: []byte("sample"), Value: []byte(fmt.Sprintf("%d", i))},
+			},
+			Samples: []cortex.Sample{
+				{
+					Value:       float64(i),
+					TimestampMs: int64(i),
+				},
+			},
+		})
+	}
+	return request
+}
+
+func counterValue(t *testing.T, c prometheus.Counter) float64 {
+	var m dto.Metric
+	if err := c.Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetCounter().GetValue()
+}
+
+func TestDistributorPushRuleLimits(t *testing.T) {
+	ctx := user.Inject(context.Background(), "user")
+	d := newTestDistributor(t, Config{
+		IngestionRateLimit:     1,
+		IngestionBurstSize:     100,
+		RuleIngestionRateLimit: 1,
+		RuleIngestionBurstSize: 10,
+	})
+	defer d.Stop()
+
+	// Rule samples are limited by their own limiter...
+	_, err := d.Push(ctx, makeWriteRequest(10, cortex.RULE))
+	assert.NoError(t, err)
+	_, err = d.Push(ctx, makeWriteRequest(10, cortex.RULE))
+	assert.EqualError(t, err, errIngestionRateLimitExceeded.Error())
+
+	// ...which doesn't use up the API limit.
+	_, err = d.Push(ctx, makeWriteRequest(100, cortex.API))
+	assert.NoError(t, err)
+	_, err = d.Push(ctx, makeWriteRequest(10, cortex.API))
+	assert.EqualError(t, err, errIngestionRateLimitExceeded.Error())
+
+	assert.Equal(t, 20.0, counterValue(t, d.receivedRuleSamples.WithLabelValues("user")))
+	assert.Equal(t, 10.0, counterValue(t, d.rateLimitedSamples.WithLabelValues("user", "rule")))
+	assert.Equal(t, 10.0, counterValue(t, d.rateLimitedSamples.WithLabelValues("user", "api")))
+}
+
+func TestDistributorPushHandlerIgnoresSource(t *testing.T) {
+	d := newTestDistributor(t, Config{
+		IngestionRateLimit: 1,
+		IngestionBurstSize: 10,
+	})
+	defer d.Stop()
+
+	// Claiming samples came from the ruler mustn't bypass the rate limit.
+	data, err := proto.Marshal(makeWriteRequest(20, cortex.RULE))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	writer := snappy.NewWriter(&buf)
+	if _, err := writer.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("POST", "/api/prom/push", &buf)
+	req = req.WithContext(user.Inject(req.Context(), "user"))
+	recorder := httptest.NewRecorder()
+	d.PushHandler(recorder, req)
+
+	// The response details the limit, for clients to back off.
+	assert.Equal(t, http.StatusTooManyRequests, recorder.Code)
+	assert.Equal(t, "20", recorder.Header().Get("Retry-After"))
+	assert.JSONEq(t, `{"limit": "ingestion_rate", "configured": 1, "observed": 20, "retryAfterSeconds": 20, "message": "ingestion rate limit exceeded"}`, recorder.Body.String())
+	assert.Equal(t, 0.0, counterValue(t, d.receivedRuleSamples.WithLabelValues("user")))
+	assert.Equal(t, 20.0, counterValue(t, d.rateLimitedSamples.WithLabelValues("user", "api")))
+}
+
+func TestDistributorPushHandlerPriority(t *testing.T) {
+	d := newTestDistributor(t, Config{
+		IngestionRateLimit:   10000,
+		IngestionBurstSize:   10000,
+		MaxInflightPushes:    2,
+		BulkInflightFraction: 0.5,
+	})
+	defer d.Stop()
+
+	// Hold one of the two slots, leaving none for bulk pushes.
+	require.NoError(t, d.inflight.Acquire(cortex.REALTIME))
+	defer d.inflight.Release()
+
+	push := func(priority string) *httptest.ResponseRecorder {
+		data, err := proto.Marshal(makeWriteRequest(5, cortex.API))
+		require.NoError(t, err)
+		var buf bytes.Buffer
+		writer := snappy.NewWriter(&buf)
+		_, err = writer.Write(data)
+		require.NoError(t, err)
+		require.NoError(t, writer.Close())
+		req := httptest.NewRequest("POST", "/api/prom/push", &buf)
+		req = req.WithContext(user.Inject(req.Context(), "user"))
+		if priority != "" {
+			req.Header.Set(PriorityHeader, priority)
+		}
+		recorder := httptest.NewRecorder()
+		d.PushHandler(recorder, req)
+		return recorder
+	}
+
+	recorder := push("bulk")
+	assert.Equal(t, http.StatusTooManyRequests, recorder.Code)
+	assert.Equal(t, "1", recorder.Header().Get("Retry-After"))
+	assert.Equal(t, 1.0, counterValue(t, d.shedPushes.WithLabelValues("bulk")))
+
+	assert.Equal(t, http.StatusOK, push("").Code)
+	assert.Equal(t, http.StatusOK, push("Realtime").Code)
+	assert.Equal(t, http.StatusBadRequest, push("urgent").Code)
+}
+
+func TestDistributorUserLimitsHandler(t *testing.T) {
+	d := newTestDistributor(t, Config{
+		IngestionRateLimit: 100,
+		IngestionBurstSize: 200,
+	})
+	defer d.Stop()
+
+	req := httptest.NewRequest("GET", "/api/prom/api/v1/user_limits", nil)
+	req = req.WithContext(user.Inject(req.Context(), "user"))
+	recorder := httptest.NewRecorder()
+	d.UserLimitsHandler(recorder, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	// Each of the 3 ingesters has a replica of all the user's series.
+	var limits UserLimits
+	assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &limits))
+	assert.Equal(t, UserLimits{
+		UserStats: UserStats{
+			IngestionRate:      3,
+			IngestionBytesRate: 30,
+			DiscardedRate:      1,
+			NumSeries:          10,
+		},
+		IngestionRateLimit: 100,
+		IngestionBurstSize: 200,
+	}, limits)
+}
+
+func TestDistributorCardinalityHandler(t *testing.T) {
+	d := newTestDistributor(t, Config{})
+	defer d.Stop()
+
+	req := httptest.NewRequest("GET", "/api/prom/api/v1/cardinality?limit=2", nil)
+	req = req.WithContext(user.Inject(req.Context(), "user"))
+	recorder := httptest.NewRecorder()
+	d.CardinalityHandler(recorder, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	// Each of the 3 ingesters has a replica of all the user's series.
+	var cardinality Cardinality
+	assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &cardinality))
+	assert.Equal(t, Cardinality{
+		LabelNames: []LabelNameCardinality{
+			{Name: "instance", ValueCount: 30},
+			{Name: "job", ValueCount: 5},
+		},
+		MetricNames: []MetricNameCardinality{
+			{Name: "foo", SeriesCount: 30},
+			{Name: "bar", SeriesCount: 3},
+		},
+	}, cardinality)
+
+	req = httptest.NewRequest("GET", "/api/prom/api/v1/cardinality?limit=x", nil)
+	req = req.WithContext(user.Inject(req.Context(), "user"))
+	recorder = httptest.NewRecorder()
+	d.CardinalityHandler(recorder, req)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+}
+
+// symbolizingIngester is an ingester server recording whether each push it is
+// sent is symbolized, which says it accepts symbolized pushes if accepts is
+// set, and otherwise ignores their series.
+type symbolizingIngester struct {
+	cortex.IngesterServer
+	mtx        sync.Mutex
+	accepts    bool
+	symbolized []bool
+	series     int
+}
+
+func (i *symbolizingIngester) Push(ctx context.Context, req *cortex.WriteRequest) (*cortex.WriteResponse, error) {
+	i.mtx.Lock()
+	defer i.mtx.Unlock()
+	i.symbolized = append(i.symbolized, len(req.SymbolizedTimeseries) > 0)
+	if i.accepts {
+		grpc.SetHeader(ctx, metadata.Pairs(util.SymbolizedWritesMetadataKey, "true"))
+		if err := util.DesymbolizeWriteRequest(req); err != nil {
+			return nil, err
+		}
+	}
+	i.series += len(req.Timeseries)
+	return &cortex.WriteResponse{}, nil
+}
+
+func TestDistributorSymbolizedPushes(t *testing.T) {
+	listener, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	server := grpc.NewServer(grpc.UnaryInterceptor(middleware.ServerUserHeaderInterceptor))
+	ingester := &symbolizingIngester{accepts: true}
+	cortex.RegisterIngesterServer(server, ingester)
+	go server.Serve(listener)
+	defer server.Stop()
+
+	d, err := New(Config{
+		ReplicationFactor:   1,
+		HeartbeatTimeout:    time.Minute,
+		RemoteTimeout:       time.Minute,
+		ClientCleanupPeriod: time.Minute,
+		IngestionRateLimit:  10000,
+		IngestionBurstSize:  10000,
+		SymbolizeRequests:   true,
+	}, mockRing{
+		Counter: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "foo",
+		}),
+		ingesters: []*ring.IngesterDesc{{Addr: listener.Addr().String(), Timestamp: time.Now().Unix()}},
+	})
+	require.NoError(t, err)
+	defer d.Stop()
+
+	// Pushes are only symbolized once the ingester has said it accepts them...
+	ctx := user.Inject(context.Background(), "user")
+	for i := 0; i < 2; i++ {
+		_, err = d.Push(ctx, makeWriteRequest(10, cortex.API))
+		require.NoError(t, err)
+	}
+	assert.Equal(t, []bool{false, true}, ingester.symbolized)
+	assert.Equal(t, 20, ingester.series)
+
+	// ...and are resent unsymbolized if it stops accepting them.
+	ingester.accepts = false
+	for i := 0; i < 2; i++ {
+		_, err = d.Push(ctx, makeWriteRequest(10, cortex.API))
+		require.NoError(t, err)
+	}
+	assert.Equal(t, []bool{false, true, true, false, false}, ingester.symbolized)
+	assert.Equal(t, 40, ingester.series)
+}
+
+func TestDistributorReplicaSetHealth(t *testing.T) {
+	ctx := user.Inject(context.Background(), "user")
+	for i, tc := range []struct {
+		ingesters     []mockIngester
+		dead          int
+		expectedLive  float64
+		expectedSpare float64
+		degraded      bool
+	}{
+		{
+			ingesters:     []mockIngester{{true}, {true}, {true}},
+			expectedLive:  3,
+			expectedSpare: 1,
+		},
+		{
+			ingesters:     []mockIngester{{true}, {true}, {true}},
+			dead:          1,
+			expectedLive:  2,
+			expectedSpare: 0,
+			degraded:      true,
+		},
+		{
+			ingesters:     []mockIngester{{}, {true}, {true}},
+			expectedLive:  3,
+			expectedSpare: 1,
+			degraded:      true,
+		},
+	} {
+		t.Run(fmt.Sprintf("[%d]", i), func(t *testing.T) {
+			ingesterDescs := []*ring.IngesterDesc{}
+			ingesters := map[string]mockIngester{}
+			for i, ingester := range tc.ingesters {
+				addr := fmt.Sprintf("%d", i)
+				heartbeat := time.Now()
+				if i < tc.dead {
+					heartbeat = heartbeat.Add(-time.Hour)
+				}
+				ingesterDescs = append(ingesterDescs, &ring.IngesterDesc{
+					Addr:      addr,
+					Timestamp: heartbeat.Unix(),
+				})
+				ingesters[addr] = ingester
+			}
+
+			d, err := New(Config{
+				ReplicationFactor:   3,
+				HeartbeatTimeout:    1 * time.Minute,
+				RemoteTimeout:       1 * time.Minute,
+				ClientCleanupPeriod: 1 * time.Minute,
+				IngestionRateLimit:  10000,
+				IngestionBurstSize:  10000,
+
+				ingesterClientFactory: func(addr string) cortex.IngesterClient {
+					return ingesters[addr]
+				},
+			}, mockRing{
+				Counter: prometheus.NewCounter(prometheus.CounterOpts{
+					Name: "foo",
+				}),
+				ingesters: ingesterDescs,
+			})
+			require.NoError(t, err)
+			defer d.Stop()
+
+			_, err = d.Push(ctx, makeWriteRequest(10, cortex.API))
+			require.NoError(t, err)
+
+			var m dto.Metric
+			require.NoError(t, d.pushLiveReplicas.Write(&m))
+			assert.Equal(t, tc.expectedLive, m.GetHistogram().GetSampleSum())
+			require.NoError(t, d.pushSpareReplicas.Write(&m))
+			assert.Equal(t, tc.expectedSpare, m.GetHistogram().GetSampleSum())
+
+			// Degraded pushes are counted once all the sends have finished.
+			expectedDegraded := 0.
+			if tc.degraded {
+				expectedDegraded = 1
+			}
+			deadline := time.Now().Add(time.Second)
+			for counterValue(t, d.degradedQuorumPushes) != expectedDegraded && time.Now().Before(deadline) {
+				time.Sleep(time.Millisecond)
+			}
+			assert.Equal(t, expectedDegraded, counterValue(t, d.degradedQuorumPushes))
+		})
+	}
+}
+
+func TestDistributorPushStageDurations(t *testing.T) {
+	ctx := user.Inject(context.Background(), "user")
+	d := newTestDistributor(t, Config{
+		IngestionRateLimit: 10000,
+		IngestionBurstSize: 10000,
+	})
+	defer d.Stop()
+
+	_, err := d.Push(ctx, makeWriteRequest(10, cortex.API))
+	require.NoError(t, err)
+
+	count := func(stage string) uint64 {
+		var m dto.Metric
+		require.NoError(t, d.pushStageDuration.WithLabelValues(stage).(prometheus.Histogram).Write(&m))
+		return m.GetHistogram().GetSampleCount()
+	}
+	assert.Equal(t, uint64(1), count(validationStage))
+	assert.Equal(t, uint64(1), count(ringLookupStage))
+	assert.Equal(t, uint64(1), count(quorumWaitStage))
+	// Once per ingester, at least a quorum of which have been sent to.
+	for _, stage := range []string{serializationStage, sendStage} {
+		assert.True(t, count(stage) >= 2, "%s: %d", stage, count(stage))
+	}
+}
@@ -0,0 +1,236 @@
+package distributor
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex"
+	"github.com/weaveworks/cortex/ring"
+)
+
+var (
+	electedReplicaChanges = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cortex",
+		Name:      "ha_tracker_elected_replica_changes_total",
+		Help:      "The total number of times the elected replica of an HA cluster changed.",
+	}, []string{"user", "cluster"})
+	electedReplicaTimestamp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "cortex",
+		Name:      "ha_tracker_elected_replica_timestamp_seconds",
+		Help:      "When a push from the elected replica of an HA cluster was last recorded.",
+	}, []string{"user", "cluster"})
+	dedupedSamples = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cortex",
+		Name:      "distributor_deduped_samples_total",
+		Help:      "The total number of samples dropped as they came from a replica of an HA cluster which isn't elected.",
+	}, []string{"user", "cluster"})
+)
+
+func init() {
+	prometheus.MustRegister(electedReplicaChanges)
+	prometheus.MustRegister(electedReplicaTimestamp)
+	prometheus.MustRegister(dedupedSamples)
+}
+
+var errNotElected = fmt.Errorf("replica is not elected")
+
+// HATrackerConfig configures deduplicating the pushes of HA pairs, or larger
+// clusters, of Prometheus servers scraping the same targets.
+type HATrackerConfig struct {
+	Enabled         bool
+	ClusterLabel    string
+	ReplicaLabel    string
+	UpdateTimeout   time.Duration
+	FailoverTimeout time.Duration
+	ConsulPrefix    string
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet
+func (cfg *HATrackerConfig) RegisterFlags(f *flag.FlagSet) {
+	f.BoolVar(&cfg.Enabled, "distributor.ha-tracker.enable", false, "Only accept pushes from one replica of each HA cluster of Prometheus servers, identified by their cluster and replica labels, failing over to another if it stops pushing.")
+	f.StringVar(&cfg.ClusterLabel, "distributor.ha-tracker.cluster-label", "cluster", "Label of the HA cluster pushed series come from.")
+	f.StringVar(&cfg.ReplicaLabel, "distributor.ha-tracker.replica-label", "__replica__", "Label of the replica in its HA cluster pushed series come from, which is removed from accepted series.")
+	f.DurationVar(&cfg.UpdateTimeout, "distributor.ha-tracker.update-timeout", 15*time.Second, "How often to record in Consul that the elected replica is still pushing.")
+	f.DurationVar(&cfg.FailoverTimeout, "distributor.ha-tracker.failover-timeout", 30*time.Second, "How long after the elected replica's last push another replica of the cluster can be elected. Must be longer than the update timeout plus the scrape interval.")
+	f.StringVar(&cfg.ConsulPrefix, "distributor.ha-tracker.consul-prefix", "ha-tracker/", "Prefix for keys in Consul of the elected replicas.")
+}
+
+// HATracker is PushMiddleware accepting pushes from only the elected replica
+// of each tenant's HA clusters. The elected replicas are stored in the ring's
+// Consul, updated with CAS so all distributors agree on them, and watched so
+// each distributor has them at hand.
+type HATracker struct {
+	cfg        HATrackerConfig
+	consul     ring.ConsulClient
+	quit, done chan struct{}
+
+	// For tests.
+	now func() time.Time
+
+	mtx     sync.RWMutex
+	elected map[string]ReplicaDesc
+}
+
+// NewHATracker makes a new HATracker, keeping elected replicas in the Consul
+// of consulCfg under the tracker's prefix.
+func NewHATracker(cfg HATrackerConfig, consulCfg ring.ConsulConfig) (*HATracker, error) {
+	if cfg.FailoverTimeout <= cfg.UpdateTimeout {
+		return nil, fmt.Errorf("HA tracker failover timeout (%v) must be longer than its update timeout (%v)", cfg.FailoverTimeout, cfg.UpdateTimeout)
+	}
+	consulCfg.Prefix = cfg.ConsulPrefix
+	consul, err := ring.NewConsulClient(consulCfg, ring.ProtoCodec{Factory: func() proto.Message {
+		return &ReplicaDesc{}
+	}})
+	if err != nil {
+		return nil, err
+	}
+	t := &HATracker{
+		cfg:     cfg,
+		consul:  consul,
+		quit:    make(chan struct{}),
+		done:    make(chan struct{}),
+		now:     time.Now,
+		elected: map[string]ReplicaDesc{},
+	}
+	go t.loop()
+	return t, nil
+}
+
+// Stop the HATracker watching Consul.
+func (t *HATracker) Stop() {
+	close(t.quit)
+	<-t.done
+}
+
+func (t *HATracker) loop() {
+	defer close(t.done)
+	t.consul.WatchPrefix("", t.quit, func(key string, value interface{}) bool {
+		desc, ok := value.(*ReplicaDesc)
+		if !ok || desc == nil {
+			return true
+		}
+		t.mtx.Lock()
+		t.elected[strings.TrimPrefix(key, t.cfg.ConsulPrefix)] = *desc
+		t.mtx.Unlock()
+		return true
+	})
+}
+
+func replicaKey(userID, cluster string) string {
+	return userID + "/" + cluster
+}
+
+// WrapPush implements PushMiddleware. Pushes without both labels are passed on
+// as they are.
+func (t *HATracker) WrapPush(next Pusher) Pusher {
+	return PushFunc(func(ctx context.Context, req *cortex.WriteRequest) (*cortex.WriteResponse, error) {
+		cluster, replica := t.findLabels(req)
+		if cluster == "" || replica == "" {
+			return next.Push(ctx, req)
+		}
+		userID, err := user.Extract(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := t.checkReplica(userID, cluster, replica); err == errNotElected {
+			// Accept the push, so the replica doesn't retry it.
+			dedupedSamples.WithLabelValues(userID, cluster).Add(float64(countSamples(req)))
+			recordFates(ctx, req, fateDeduped, fmt.Sprintf("replica %q is not the elected replica of cluster %q", replica, cluster))
+			return &cortex.WriteResponse{}, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		t.removeReplicaLabel(req)
+		return next.Push(ctx, req)
+	})
+}
+
+// findLabels returns the cluster and replica of a push. Prometheus servers set
+// them as external labels, so only the first series is looked at.
+func (t *HATracker) findLabels(req *cortex.WriteRequest) (cluster, replica string) {
+	if len(req.Timeseries) == 0 {
+		return "", ""
+	}
+	for _, l := range req.Timeseries[0].Labels {
+		switch string(l.Name) {
+		case t.cfg.ClusterLabel:
+			cluster = string(l.Value)
+		case t.cfg.ReplicaLabel:
+			replica = string(l.Value)
+		}
+	}
+	return cluster, replica
+}
+
+func (t *HATracker) removeReplicaLabel(req *cortex.WriteRequest) {
+	for i, ts := range req.Timeseries {
+		labels := ts.Labels[:0]
+		for _, l := range ts.Labels {
+			if string(l.Name) != t.cfg.ReplicaLabel {
+				labels = append(labels, l)
+			}
+		}
+		req.Timeseries[i].Labels = labels
+	}
+}
+
+// checkReplica returns errNotElected unless the replica is the elected one of
+// its cluster, electing it if the elected replica hasn't pushed for the
+// failover timeout. Only the elected replica's pushes after the update timeout
+// go to Consul.
+func (t *HATracker) checkReplica(userID, cluster, replica string) error {
+	key := replicaKey(userID, cluster)
+	now := t.now()
+	t.mtx.RLock()
+	desc, ok := t.elected[key]
+	t.mtx.RUnlock()
+	if ok {
+		received := time.Unix(0, desc.ReceivedAt*int64(time.Millisecond))
+		if desc.Replica == replica && now.Sub(received) < t.cfg.UpdateTimeout {
+			return nil
+		}
+		if desc.Replica != replica && now.Sub(received) < t.cfg.FailoverTimeout {
+			return errNotElected
+		}
+	}
+
+	var elected ReplicaDesc
+	err := t.consul.CAS(key, func(in interface{}) (out interface{}, retry bool, err error) {
+		if current, ok := in.(*ReplicaDesc); ok && current != nil && current.Replica != replica {
+			received := time.Unix(0, current.ReceivedAt*int64(time.Millisecond))
+			if now.Sub(received) < t.cfg.FailoverTimeout {
+				// Another distributor elected it, or it has just pushed.
+				elected = *current
+				return nil, false, errNotElected
+			}
+			electedReplicaChanges.WithLabelValues(userID, cluster).Inc()
+			log.Infof("HA tracker: electing replica %s of cluster %s of user %s, as %s last pushed at %v", replica, cluster, userID, current.Replica, received)
+		}
+		elected = ReplicaDesc{
+			Replica:    replica,
+			ReceivedAt: now.UnixNano() / int64(time.Millisecond),
+		}
+		out = &elected
+		return out, true, nil
+	})
+	if err != nil && err != errNotElected {
+		return err
+	}
+
+	t.mtx.Lock()
+	t.elected[key] = elected
+	t.mtx.Unlock()
+	electedReplicaTimestamp.WithLabelValues(userID, cluster).Set(float64(elected.ReceivedAt) / 1000)
+	return err
+}
@@ -0,0 +1,97 @@
+package distributor
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex"
+	"github.com/weaveworks/cortex/ring"
+)
+
+func makeHAWriteRequest(replica string) *cortex.WriteRequest {
+	req := makeWriteRequest(2, cortex.API)
+	for i := range req.Timeseries {
+		req.Timeseries[i].Labels = append(req.Timeseries[i].Labels,
+			cortex.LabelPair{Name: []byte("cluster"), Value: []byte("c1")},
+			cortex.LabelPair{Name: []byte("__replica__"), Value: []byte(replica)},
+		)
+	}
+	return req
+}
+
+func TestHATracker(t *testing.T) {
+	cfg := HATrackerConfig{
+		Enabled:         true,
+		ClusterLabel:    "cluster",
+		ReplicaLabel:    "__replica__",
+		UpdateTimeout:   15 * time.Second,
+		FailoverTimeout: 30 * time.Second,
+		ConsulPrefix:    "ha-tracker-test/",
+	}
+	start := time.Now()
+	now := start
+
+	// Two distributors, sharing the elected replicas.
+	var trackers []*HATracker
+	for i := 0; i < 2; i++ {
+		tracker, err := NewHATracker(cfg, ring.ConsulConfig{Host: ring.InMemoryConsulHost})
+		require.NoError(t, err)
+		defer tracker.Stop()
+		tracker.now = func() time.Time { return now }
+		trackers = append(trackers, tracker)
+	}
+
+	var pushed []*cortex.WriteRequest
+	next := PushFunc(func(ctx context.Context, req *cortex.WriteRequest) (*cortex.WriteResponse, error) {
+		pushed = append(pushed, req)
+		return &cortex.WriteResponse{}, nil
+	})
+	ctx := user.Inject(context.Background(), "user")
+	changes := counterValue(t, electedReplicaChanges.WithLabelValues("user", "c1"))
+
+	for i, tc := range []struct {
+		after    time.Duration
+		tracker  int
+		replica  string
+		accepted bool
+	}{
+		{0, 0, "a", true},
+		{time.Second, 1, "b", false},
+		{5 * time.Second, 1, "a", true},
+		{20 * time.Second, 0, "b", false},
+		// a last pushed 5s in, but only the push 0s in was recorded.
+		{40 * time.Second, 0, "b", true},
+		{41 * time.Second, 1, "a", false},
+	} {
+		now = start.Add(tc.after)
+		pushed = nil
+		_, err := trackers[tc.tracker].WrapPush(next).Push(ctx, makeHAWriteRequest(tc.replica))
+		require.NoError(t, err, "%d", i)
+		if !tc.accepted {
+			assert.Empty(t, pushed, "%d", i)
+			continue
+		}
+		require.Len(t, pushed, 1, "%d", i)
+		for _, ts := range pushed[0].Timeseries {
+			assert.Len(t, ts.Labels, 3, "%d: replica label not removed", i)
+		}
+	}
+	assert.Equal(t, changes+1, counterValue(t, electedReplicaChanges.WithLabelValues("user", "c1")))
+}
+
+func TestHATrackerPassesOtherPushes(t *testing.T) {
+	tracker := &HATracker{cfg: HATrackerConfig{ClusterLabel: "cluster", ReplicaLabel: "__replica__"}}
+	pushes := 0
+	pusher := tracker.WrapPush(PushFunc(func(ctx context.Context, req *cortex.WriteRequest) (*cortex.WriteResponse, error) {
+		pushes++
+		return &cortex.WriteResponse{}, nil
+	}))
+	_, err := pusher.Push(user.Inject(context.Background(), "user"), makeWriteRequest(2, cortex.API))
+	require.NoError(t, err)
+	assert.Equal(t, 1, pushes)
+}
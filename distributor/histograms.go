@@ -0,0 +1,239 @@
+package distributor
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+
+	"github.com/prometheus/common/model"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex"
+)
+
+// What to do with native histograms pushed to the distributor.
+const (
+	convertNativeHistograms = "convert"
+	dropNativeHistograms    = "drop"
+	rejectNativeHistograms  = "reject"
+)
+
+var errNativeHistogramsRejected = errors.New("native histograms are not supported")
+
+func validNativeHistogramsMode(mode string) error {
+	switch mode {
+	case convertNativeHistograms, dropNativeHistograms, rejectNativeHistograms, "":
+		return nil
+	default:
+		return fmt.Errorf("unknown native histograms mode %q", mode)
+	}
+}
+
+// nativeHistograms converts, drops or rejects any native histograms, as
+// the ingesters only store float samples.
+func (d *Distributor) nativeHistograms(next Pusher) Pusher {
+	return PushFunc(func(ctx context.Context, req *cortex.WriteRequest) (*cortex.WriteResponse, error) {
+		hasHistograms := false
+		for _, ts := range req.Timeseries {
+			hasHistograms = hasHistograms || len(ts.Histograms) > 0
+		}
+		if !hasHistograms {
+			return next.Push(ctx, req)
+		}
+
+		switch d.cfg.NativeHistograms {
+		case rejectNativeHistograms:
+			return nil, errNativeHistogramsRejected
+		case dropNativeHistograms:
+			for i := range req.Timeseries {
+				req.Timeseries[i].Histograms = nil
+			}
+		default:
+			timeseries := make([]cortex.TimeSeries, 0, len(req.Timeseries))
+			for _, ts := range req.Timeseries {
+				if len(ts.Histograms) == 0 {
+					timeseries = append(timeseries, ts)
+					continue
+				}
+				converted, err := convertHistograms(ts)
+				if err != nil {
+					return nil, err
+				}
+				if len(ts.Samples) > 0 {
+					ts.Histograms = nil
+					timeseries = append(timeseries, ts)
+				}
+				timeseries = append(timeseries, converted...)
+			}
+			req.Timeseries = timeseries
+		}
+		return next.Push(ctx, req)
+	})
+}
+
+// convertHistograms converts the native histograms in a series into the
+// _bucket, _count and _sum series of a classic histogram.
+func convertHistograms(ts cortex.TimeSeries) ([]cortex.TimeSeries, error) {
+	var name string
+	for _, l := range ts.Labels {
+		if string(l.Name) == model.MetricNameLabel {
+			name = string(l.Value)
+		}
+	}
+	if name == "" {
+		return nil, fmt.Errorf("native histogram missing metric name")
+	}
+
+	var (
+		count   = cortex.TimeSeries{Labels: withName(ts.Labels, name+"_count", "")}
+		sum     = cortex.TimeSeries{Labels: withName(ts.Labels, name+"_sum", "")}
+		buckets = map[float64]*cortex.TimeSeries{}
+	)
+	for _, h := range ts.Histograms {
+		cumulative, err := classicBuckets(h)
+		if err != nil {
+			return nil, err
+		}
+		for _, b := range cumulative {
+			series, ok := buckets[b.le]
+			if !ok {
+				le := strconv.FormatFloat(b.le, 'f', -1, 64)
+				if math.IsInf(b.le, 1) {
+					le = "+Inf"
+				}
+				series = &cortex.TimeSeries{Labels: withName(ts.Labels, name+"_bucket", le)}
+				buckets[b.le] = series
+			}
+			series.Samples = append(series.Samples, cortex.Sample{Value: b.count, TimestampMs: h.TimestampMs})
+		}
+		count.Samples = append(count.Samples, cortex.Sample{Value: histogramCount(h), TimestampMs: h.TimestampMs})
+		sum.Samples = append(sum.Samples, cortex.Sample{Value: h.Sum, TimestampMs: h.TimestampMs})
+	}
+
+	les := make([]float64, 0, len(buckets))
+	for le := range buckets {
+		les = append(les, le)
+	}
+	sort.Float64s(les)
+	result := make([]cortex.TimeSeries, 0, len(buckets)+2)
+	for _, le := range les {
+		result = append(result, *buckets[le])
+	}
+	return append(result, count, sum), nil
+}
+
+// withName returns the labels with the metric name replaced, and an le label
+// added if it isn't empty.
+func withName(labels []cortex.LabelPair, name, le string) []cortex.LabelPair {
+	result := make([]cortex.LabelPair, 0, len(labels)+1)
+	for _, l := range labels {
+		if string(l.Name) == model.MetricNameLabel {
+			l.Value = []byte(name)
+		}
+		result = append(result, l)
+	}
+	if le != "" {
+		result = append(result, cortex.LabelPair{
+			Name:  []byte(model.BucketLabel),
+			Value: []byte(le),
+		})
+	}
+	return result
+}
+
+type classicBucket struct {
+	le    float64
+	count float64
+}
+
+// classicBuckets returns the cumulative counts of the histogram's buckets,
+// by upper bound, ending with +Inf.
+func classicBuckets(h cortex.Histogram) ([]classicBucket, error) {
+	negative, err := expandBuckets(h.NegativeSpans, h.NegativeDeltas, h.NegativeCounts)
+	if err != nil {
+		return nil, err
+	}
+	positive, err := expandBuckets(h.PositiveSpans, h.PositiveDeltas, h.PositiveCounts)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		result     = make([]classicBucket, 0, len(negative)+len(positive)+2)
+		cumulative float64
+	)
+	// Negative bucket i covers (-base^i, -base^(i-1)], so the highest index
+	// has the lowest upper bound.
+	for i := len(negative) - 1; i >= 0; i-- {
+		cumulative += negative[i].count
+		result = append(result, classicBucket{-upperBound(h.Schema, negative[i].index-1), cumulative})
+	}
+	cumulative += histogramZeroCount(h)
+	result = append(result, classicBucket{h.ZeroThreshold, cumulative})
+	for _, b := range positive {
+		cumulative += b.count
+		result = append(result, classicBucket{upperBound(h.Schema, b.index), cumulative})
+	}
+	return append(result, classicBucket{math.Inf(1), histogramCount(h)}), nil
+}
+
+// upperBound returns the upper bound of positive bucket index i, base^i,
+// where base = 2^(2^-schema).
+func upperBound(schema, i int32) float64 {
+	return math.Exp2(float64(i) * math.Exp2(-float64(schema)))
+}
+
+type nativeBucket struct {
+	index int32
+	count float64
+}
+
+// expandBuckets returns the populated buckets, in index order, from their
+// spans and either integer deltas or float counts.
+func expandBuckets(spans []cortex.BucketSpan, deltas []int64, counts []float64) ([]nativeBucket, error) {
+	var (
+		result  []nativeBucket
+		index   int32
+		current int64
+		j       int
+	)
+	for i, span := range spans {
+		if i == 0 {
+			index = span.Offset
+		} else {
+			index += span.Offset
+		}
+		for k := uint32(0); k < span.Length; k++ {
+			var count float64
+			switch {
+			case j < len(deltas):
+				current += deltas[j]
+				count = float64(current)
+			case j < len(counts):
+				count = counts[j]
+			default:
+				return nil, fmt.Errorf("native histogram has fewer bucket counts than its spans")
+			}
+			result = append(result, nativeBucket{index, count})
+			index++
+			j++
+		}
+	}
+	return result, nil
+}
+
+func histogramCount(h cortex.Histogram) float64 {
+	if c, ok := h.Count.(*cortex.Histogram_CountFloat); ok {
+		return c.CountFloat
+	}
+	return float64(h.GetCountInt())
+}
+
+func histogramZeroCount(h cortex.Histogram) float64 {
+	if c, ok := h.ZeroCount.(*cortex.Histogram_ZeroCountFloat); ok {
+		return c.ZeroCountFloat
+	}
+	return float64(h.GetZeroCountInt())
+}
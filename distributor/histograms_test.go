@@ -0,0 +1,96 @@
+package distributor
+
+import (
+	"math"
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex"
+)
+
+func TestClassicBuckets(t *testing.T) {
+	// Schema 0 has buckets of powers of two: (0.5, 1], (1, 2], (2, 4]...
+	h := cortex.Histogram{
+		Count:         &cortex.Histogram_CountInt{CountInt: 10},
+		Sum:           12,
+		ZeroThreshold: 0.001,
+		ZeroCount:     &cortex.Histogram_ZeroCountInt{ZeroCountInt: 1},
+		NegativeSpans: []cortex.BucketSpan{{Offset: 1, Length: 1}},
+		// (-2, -1]
+		NegativeDeltas: []int64{2},
+		// (0.5, 1], (1, 2], then (4, 8] after a gap.
+		PositiveSpans:  []cortex.BucketSpan{{Offset: 0, Length: 2}, {Offset: 1, Length: 1}},
+		PositiveDeltas: []int64{3, -2, 2},
+	}
+	buckets, err := classicBuckets(h)
+	require.NoError(t, err)
+	assert.Equal(t, []classicBucket{
+		{-1, 2},
+		{0.001, 3},
+		{1, 6},
+		{2, 7},
+		{8, 10},
+		{math.Inf(1), 10},
+	}, buckets)
+
+	h.PositiveDeltas = h.PositiveDeltas[:1]
+	_, err = classicBuckets(h)
+	assert.Error(t, err)
+}
+
+func TestDistributorNativeHistograms(t *testing.T) {
+	ts := cortex.TimeSeries{
+		Labels: []cortex.LabelPair{
+			{Name: []byte("__name__"), Value: []byte("rpc_duration_seconds")},
+			{Name: []byte("job"), Value: []byte("api")},
+		},
+		Histograms: []cortex.Histogram{{
+			Count:          &cortex.Histogram_CountFloat{CountFloat: 3},
+			Sum:            2.5,
+			PositiveSpans:  []cortex.BucketSpan{{Offset: 0, Length: 1}},
+			PositiveCounts: []float64{3},
+			TimestampMs:    1000,
+		}},
+	}
+
+	for _, tc := range []struct {
+		mode   string
+		err    error
+		series []string
+	}{
+		{convertNativeHistograms, nil, []string{
+			`rpc_duration_seconds_bucket{job="api", le="0"}`,
+			`rpc_duration_seconds_bucket{job="api", le="1"}`,
+			`rpc_duration_seconds_bucket{job="api", le="+Inf"}`,
+			`rpc_duration_seconds_count{job="api"}`,
+			`rpc_duration_seconds_sum{job="api"}`,
+		}},
+		{dropNativeHistograms, nil, nil},
+		{rejectNativeHistograms, errNativeHistogramsRejected, nil},
+	} {
+		var pushed []string
+		d := &Distributor{cfg: Config{NativeHistograms: tc.mode}}
+		next := PushFunc(func(ctx context.Context, req *cortex.WriteRequest) (*cortex.WriteResponse, error) {
+			for _, ts := range req.Timeseries {
+				if len(ts.Samples) > 0 {
+					m := model.Metric{}
+					for _, l := range ts.Labels {
+						m[model.LabelName(l.Name)] = model.LabelValue(l.Value)
+					}
+					pushed = append(pushed, m.String())
+				}
+			}
+			return &cortex.WriteResponse{}, nil
+		})
+		ctx := user.Inject(context.Background(), "1")
+		req := &cortex.WriteRequest{Timeseries: []cortex.TimeSeries{ts}}
+		_, err := d.nativeHistograms(next).Push(ctx, req)
+		assert.Equal(t, tc.err, err, tc.mode)
+		assert.Equal(t, tc.series, pushed, tc.mode)
+	}
+}
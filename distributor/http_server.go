@@ -6,14 +6,12 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"time"
 
 	"github.com/golang/protobuf/proto"
 	"github.com/golang/snappy"
 	"golang.org/x/net/context"
-	"google.golang.org/grpc"
-	"google.golang.org/grpc/codes"
 
-	"github.com/prometheus/common/log"
 	"github.com/prometheus/prometheus/promql"
 
 	"github.com/weaveworks/common/instrument"
@@ -21,43 +19,148 @@ import (
 	"github.com/weaveworks/cortex/util"
 )
 
-// PushHandler is a http.Handler which accepts WriteRequests.
+// IdempotencyKeyHeader is the HTTP header clients can set to identify a batch
+// of samples, so retries of it are ignored by ingesters which already have it.
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// PriorityHeader is the HTTP header clients can set to bulk, eg. for
+// backfills, to have their pushes shed before realtime ones under pressure.
+const PriorityHeader = "X-Cortex-Priority"
+
+// PushHandler is a http.Handler which accepts WriteRequests, and Prometheus
+// remote write 2.0 requests, negotiated by their Content-Type. Pushes are
+// traced if they fail or are slow, and otherwise at the user's sample rate.
 func (d *Distributor) PushHandler(w http.ResponseWriter, r *http.Request) {
-	var req cortex.WriteRequest
-	if err := ParseProtoRequest(r.Context(), w, r, &req, true); err != nil {
-		log.Errorf(err.Error())
+	sample := util.TraceSampler.Defer(r.Context())
+	start := time.Now()
+	sw := &statusWriter{ResponseWriter: w, code: http.StatusOK}
+	d.push(sw, r)
+	sample(d.samplePushTrace(r.Context(), sw.code, time.Since(start)))
+}
+
+// statusWriter records the status code of a response.
+type statusWriter struct {
+	http.ResponseWriter
+	code int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	w.code = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (d *Distributor) push(w http.ResponseWriter, r *http.Request) {
+	req, written, err := d.parseWriteRequest(w, r)
+	if err != nil {
+		util.WithRequestID(r.Context()).Error(err)
+		code := http.StatusBadRequest
+		if _, ok := err.(errUnsupportedMediaType); ok {
+			code = http.StatusUnsupportedMediaType
+		}
+		http.Error(w, err.Error(), code)
+		return
+	}
+
+	// Only the in-process ruler can push rule-generated samples; anything
+	// pushed over HTTP is subject to the normal ingestion limits.
+	req.Source = cortex.API
+	if key := r.Header.Get(IdempotencyKeyHeader); key != "" {
+		req.IdempotencyKey = key
+	}
+	priority, err := util.ParseWritePriority(r.Header.Get(PriorityHeader))
+	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	req.Priority = priority
 
-	if _, err := d.Push(r.Context(), &req); err != nil {
-		if grpc.Code(err) == codes.ResourceExhausted {
-			switch grpc.ErrorDesc(err) {
-			case util.ErrUserSeriesLimitExceeded.Error():
-				err = util.ErrUserSeriesLimitExceeded
-			case util.ErrMetricSeriesLimitExceeded.Error():
-				err = util.ErrMetricSeriesLimitExceeded
-			}
-		}
+	ctx := r.Context()
+	var partial *PartialSuccess
+	if d.cfg.PartialSuccess {
+		ctx, partial = withPartialSuccess(ctx)
+	}
+	if _, err := d.Push(ctx, req); err != nil {
+		writePushError(w, r, err)
+		return
+	}
+	if partial != nil && partial.RejectedDataPoints > 0 {
+		writePartialSuccess(w, partial, written)
+		return
+	}
 
-		var code int
-		switch err {
-		case errIngestionRateLimitExceeded:
-			code = http.StatusTooManyRequests
-		case util.ErrUserSeriesLimitExceeded, util.ErrMetricSeriesLimitExceeded:
+	for name, values := range written {
+		w.Header()[name] = values
+	}
+}
+
+// writePushError responds to a push which failed. Limits are enforced by both
+// the distributor and the ingesters; either way, the client gets the details
+// of the limit.
+func writePushError(w http.ResponseWriter, r *http.Request, err error) {
+	limitErr, ok := err.(*util.LimitError)
+	if !ok {
+		limitErr, ok = util.LimitErrorFromGRPC(err)
+	}
+	if ok {
+		code := http.StatusTooManyRequests
+		switch limitErr.Limit {
+		case util.MaxSeriesPerUserLimit, util.MaxSeriesPerMetricLimit:
 			code = http.StatusInsufficientStorage
-		default:
-			code = http.StatusInternalServerError
+		case util.MaxLabelNamesPerSeriesLimit, util.MaxLabelNameLengthLimit, util.MaxLabelValueLengthLimit:
+			// Retrying won't help; the series must be fixed.
+			code = http.StatusBadRequest
 		}
-		http.Error(w, err.Error(), code)
-		log.Errorf("append err: %v", err)
+		util.WriteLimitError(w, limitErr, code)
+		util.WithRequestID(r.Context()).Errorf("append err: %v", limitErr)
+		return
 	}
+
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+	util.WithRequestID(r.Context()).Errorf("append err: %v", err)
+}
+
+// parseWriteRequest parses the body of a push in the version of the remote
+// write protocol its headers give. For 2.0 requests, it also returns the
+// headers reporting what is written if the push succeeds.
+func (d *Distributor) parseWriteRequest(w http.ResponseWriter, r *http.Request) (*cortex.WriteRequest, http.Header, error) {
+	protoName, err := remoteWriteProto(r)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if protoName == remoteWriteV2Proto {
+		var v2 cortex.WriteV2Request
+		if err := ParseProtoRequest(r.Context(), w, r, &v2, true); err != nil {
+			return nil, nil, err
+		}
+		req, err := writeV2ToWriteRequest(&v2, d.cfg.IngestCreatedTimestamps)
+		if err != nil {
+			return nil, nil, err
+		}
+		return req, d.writtenHeaders(req), nil
+	}
+
+	var req cortex.WriteRequest
+	if err := ParseProtoRequest(r.Context(), w, r, &req, true); err != nil {
+		return nil, nil, err
+	}
+	return &req, nil, nil
 }
 
 // UserStats models ingestion statistics for one user.
 type UserStats struct {
-	IngestionRate float64 `json:"ingestionRate"`
-	NumSeries     uint64  `json:"numSeries"`
+	IngestionRate      float64 `json:"ingestionRate"`
+	IngestionBytesRate float64 `json:"ingestionBytesRate"`
+	DiscardedRate      float64 `json:"discardedRate"`
+	NumSeries          uint64  `json:"numSeries"`
+}
+
+// UserLimits models a user's ingestion statistics, along with the limits they
+// are subject to.
+type UserLimits struct {
+	UserStats
+	IngestionRateLimit float64 `json:"ingestionRateLimit"`
+	IngestionBurstSize int     `json:"ingestionBurstSize"`
 }
 
 // UserStatsHandler handles user stats to the Distributor.
@@ -71,6 +174,22 @@ func (d *Distributor) UserStatsHandler(w http.ResponseWriter, r *http.Request) {
 	WriteJSONResponse(w, stats)
 }
 
+// UserLimitsHandler returns the user's ingestion statistics and limits, so they
+// can see how close to the limits they are.
+func (d *Distributor) UserLimitsHandler(w http.ResponseWriter, r *http.Request) {
+	stats, err := d.UserStats(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	WriteJSONResponse(w, UserLimits{
+		UserStats:          *stats,
+		IngestionRateLimit: d.cfg.IngestionRateLimit,
+		IngestionBurstSize: d.cfg.IngestionBurstSize,
+	})
+}
+
 // ValidateExprHandler validates a PromQL expression.
 func (d *Distributor) ValidateExprHandler(w http.ResponseWriter, r *http.Request) {
 	_, err := promql.ParseExpr(r.FormValue("expr"))
@@ -0,0 +1,38 @@
+package distributor
+
+import (
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+
+	"github.com/weaveworks/cortex"
+)
+
+// inProcessIngesterClient is a cortex.IngesterClient which calls an ingester
+// running in the same process directly, skipping gRPC.
+type inProcessIngesterClient struct {
+	server cortex.IngesterServer
+}
+
+func (c inProcessIngesterClient) Push(ctx context.Context, in *cortex.WriteRequest, opts ...grpc.CallOption) (*cortex.WriteResponse, error) {
+	return c.server.Push(ctx, in)
+}
+
+func (c inProcessIngesterClient) Query(ctx context.Context, in *cortex.QueryRequest, opts ...grpc.CallOption) (*cortex.QueryResponse, error) {
+	return c.server.Query(ctx, in)
+}
+
+func (c inProcessIngesterClient) LabelValues(ctx context.Context, in *cortex.LabelValuesRequest, opts ...grpc.CallOption) (*cortex.LabelValuesResponse, error) {
+	return c.server.LabelValues(ctx, in)
+}
+
+func (c inProcessIngesterClient) UserStats(ctx context.Context, in *cortex.UserStatsRequest, opts ...grpc.CallOption) (*cortex.UserStatsResponse, error) {
+	return c.server.UserStats(ctx, in)
+}
+
+func (c inProcessIngesterClient) MetricsForLabelMatchers(ctx context.Context, in *cortex.MetricsForLabelMatchersRequest, opts ...grpc.CallOption) (*cortex.MetricsForLabelMatchersResponse, error) {
+	return c.server.MetricsForLabelMatchers(ctx, in)
+}
+
+func (c inProcessIngesterClient) Cardinality(ctx context.Context, in *cortex.CardinalityRequest, opts ...grpc.CallOption) (*cortex.CardinalityResponse, error) {
+	return c.server.Cardinality(ctx, in)
+}
@@ -0,0 +1,75 @@
+package distributor
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// The strategies for rate limiting ingestion.
+const (
+	tokenBucketRateStrategy   = "token-bucket"
+	slidingWindowRateStrategy = "sliding-window"
+)
+
+// ingestLimiter limits the rate samples are accepted at.
+type ingestLimiter interface {
+	AllowN(now time.Time, n int) bool
+}
+
+func newIngestLimiter(strategy string, limit float64, burst int, window time.Duration) (ingestLimiter, error) {
+	switch strategy {
+	case tokenBucketRateStrategy, "":
+		return rate.NewLimiter(rate.Limit(limit), burst), nil
+	case slidingWindowRateStrategy:
+		return newSlidingWindowLimiter(limit, window), nil
+	default:
+		return nil, fmt.Errorf("unknown ingestion rate strategy %q", strategy)
+	}
+}
+
+// slidingWindowLimiter allows up to limit*window samples in any window, so
+// clients sending large batches infrequently aren't limited as long as their
+// average rate over the window is under the limit. It approximates the window
+// by weighting the count from the previous fixed window by how much of it
+// still overlaps the sliding window.
+type slidingWindowLimiter struct {
+	limit  float64
+	window time.Duration
+
+	mtx         sync.Mutex
+	windowStart time.Time
+	current     float64
+	previous    float64
+}
+
+func newSlidingWindowLimiter(limit float64, window time.Duration) *slidingWindowLimiter {
+	return &slidingWindowLimiter{
+		limit:  limit,
+		window: window,
+	}
+}
+
+// AllowN implements ingestLimiter.
+func (l *slidingWindowLimiter) AllowN(now time.Time, n int) bool {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	if elapsed := now.Sub(l.windowStart); elapsed >= 2*l.window {
+		l.windowStart = now.Truncate(l.window)
+		l.previous, l.current = 0, 0
+	} else if elapsed >= l.window {
+		l.windowStart = l.windowStart.Add(l.window)
+		l.previous, l.current = l.current, 0
+	}
+
+	overlap := 1 - float64(now.Sub(l.windowStart))/float64(l.window)
+	count := l.previous*overlap + l.current
+	if count+float64(n) > l.limit*l.window.Seconds() {
+		return false
+	}
+	l.current += float64(n)
+	return true
+}
@@ -0,0 +1,81 @@
+package distributor
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/weaveworks/cortex"
+)
+
+func TestSlidingWindowLimiter(t *testing.T) {
+	l := newSlidingWindowLimiter(10, time.Minute)
+	start := time.Unix(0, 0)
+	for i, tc := range []struct {
+		offset  time.Duration
+		samples int
+		allowed bool
+	}{
+		// A whole window's worth of samples in one batch is allowed...
+		{0, 600, true},
+		// ...but nothing more in the same window.
+		{30 * time.Second, 1, false},
+		// Half way through the next window, half the previous window's
+		// samples still count.
+		{90 * time.Second, 301, false},
+		{90 * time.Second, 300, true},
+		// After two windows, everything has expired.
+		{300 * time.Second, 600, true},
+		{300 * time.Second, 1, false},
+	} {
+		assert.Equal(t, tc.allowed, l.AllowN(start.Add(tc.offset), tc.samples), "%d", i)
+	}
+}
+
+func TestNewIngestLimiter(t *testing.T) {
+	_, err := newIngestLimiter("unknown", 10, 10, time.Minute)
+	assert.Error(t, err)
+
+	// A token bucket only allows bursts up to its burst size.
+	l, err := newIngestLimiter(tokenBucketRateStrategy, 10, 100, time.Minute)
+	assert.NoError(t, err)
+	assert.False(t, l.AllowN(time.Now(), 600))
+
+	l, err = newIngestLimiter(slidingWindowRateStrategy, 10, 100, time.Minute)
+	assert.NoError(t, err)
+	assert.True(t, l.AllowN(time.Now(), 600))
+}
+
+// changingRateLimiter gives every user the same limits, which can change.
+type changingRateLimiter struct {
+	limit float64
+	burst int
+}
+
+func (l *changingRateLimiter) IngestionRate(string, cortex.SampleSource) (float64, int) {
+	return l.limit, l.burst
+}
+
+func TestIngestLimiterFollowsLimits(t *testing.T) {
+	d := newTestDistributor(t, Config{})
+	defer d.Stop()
+	limits := &changingRateLimiter{limit: 10, burst: 10}
+	d.limiter = limits
+	now := time.Now()
+
+	limiter, limit := d.getOrCreateIngestLimiter("user", cortex.API)
+	assert.Equal(t, 10.0, limit)
+	assert.False(t, limiter.AllowN(now, 20))
+
+	// Raised limits replace the user's limiter.
+	limits.limit, limits.burst = 100, 100
+	limiter, limit = d.getOrCreateIngestLimiter("user", cortex.API)
+	assert.Equal(t, 100.0, limit)
+	assert.True(t, limiter.AllowN(now, 20))
+
+	// No limit means no limiter.
+	limits.limit = 0
+	limiter, _ = d.getOrCreateIngestLimiter("user", cortex.API)
+	assert.Nil(t, limiter)
+}
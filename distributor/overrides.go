@@ -0,0 +1,88 @@
+package distributor
+
+import (
+	"math/rand"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex/ring"
+	"github.com/weaveworks/cortex/util"
+)
+
+// replicationFactor returns the number of ingesters the user's series are
+// written to and read from.
+func (d *Distributor) replicationFactor(userID string) int {
+	if o, ok := d.overrides[userID]; ok && o.ReplicationFactor > 0 {
+		return o.ReplicationFactor
+	}
+	return d.cfg.ReplicationFactor
+}
+
+// replicationFactorFor returns the replication factor for the user in the
+// context, or the default if there is none.
+func (d *Distributor) replicationFactorFor(ctx context.Context) int {
+	userID, err := user.Extract(ctx)
+	if err != nil {
+		return d.cfg.ReplicationFactor
+	}
+	return d.replicationFactor(userID)
+}
+
+// pool returns the pool of ingesters the user's series are written to and read
+// from.
+func (d *Distributor) pool(userID string) string {
+	if o, ok := d.overrides[userID]; ok && o.Pool != "" {
+		return o.Pool
+	}
+	return ring.DefaultPool
+}
+
+// poolFor returns the pool for the user in the context, or the default if
+// there is none.
+func (d *Distributor) poolFor(ctx context.Context) string {
+	userID, err := user.Extract(ctx)
+	if err != nil {
+		return ring.DefaultPool
+	}
+	return d.pool(userID)
+}
+
+// labelLimits returns the limits on the labels of the user's series.
+func (d *Distributor) labelLimits(userID string) util.LabelLimits {
+	limits := d.cfg.LabelLimits
+	if o, ok := d.overrides[userID]; ok {
+		if o.MaxLabelNamesPerSeries > 0 {
+			limits.MaxLabelNamesPerSeries = o.MaxLabelNamesPerSeries
+		}
+		if o.MaxLabelNameLength > 0 {
+			limits.MaxLabelNameLength = o.MaxLabelNameLength
+		}
+		if o.MaxLabelValueLength > 0 {
+			limits.MaxLabelValueLength = o.MaxLabelValueLength
+		}
+	}
+	return limits
+}
+
+// samplePushTrace returns whether to sample the trace of a push by the user in
+// the context: always if it failed, with a 5xx, or was slow, and otherwise at
+// the user's sample rate. Client errors, like those over limits, can come in
+// floods, so are sampled at the same rate as successes.
+func (d *Distributor) samplePushTrace(ctx context.Context, code int, duration time.Duration) bool {
+	if code >= http.StatusInternalServerError {
+		return true
+	}
+	if d.cfg.PushTraceSlowThreshold > 0 && duration > d.cfg.PushTraceSlowThreshold {
+		return true
+	}
+	rate := d.cfg.PushTraceSampleRate
+	if userID, err := user.Extract(ctx); err == nil {
+		if o, ok := d.overrides[userID]; ok && o.PushTraceSampleRate != nil {
+			rate = *o.PushTraceSampleRate
+		}
+	}
+	return rand.Float64() < rate
+}
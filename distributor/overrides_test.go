@@ -0,0 +1,249 @@
+package distributor
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+
+	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex"
+	"github.com/weaveworks/cortex/ring"
+	"github.com/weaveworks/cortex/util"
+)
+
+func writeOverrides(t *testing.T, contents string) string {
+	f, err := ioutil.TempFile("", "overrides")
+	require.NoError(t, err)
+	defer f.Close()
+	_, err = f.WriteString(contents)
+	require.NoError(t, err)
+	return f.Name()
+}
+
+func TestDistributorReplicationFactorOverrides(t *testing.T) {
+	filename := writeOverrides(t, `
+overrides:
+  dev:
+    replication_factor: 1
+`)
+	defer os.Remove(filename)
+
+	// Only the first ingester, which all RF=1 series go to, is happy, so
+	// pushes succeed for the dev tenant and fail for the rest.
+	ingesterDescs := []*ring.IngesterDesc{}
+	ingesters := map[string]mockIngester{}
+	for i, ingester := range []mockIngester{{true}, {}, {}} {
+		addr := fmt.Sprintf("%d", i)
+		ingesterDescs = append(ingesterDescs, &ring.IngesterDesc{
+			Addr:      addr,
+			Timestamp: time.Now().Unix(),
+		})
+		ingesters[addr] = ingester
+	}
+	d, err := New(Config{
+		ReplicationFactor:   3,
+		HeartbeatTimeout:    1 * time.Minute,
+		RemoteTimeout:       1 * time.Minute,
+		ClientCleanupPeriod: 1 * time.Minute,
+		IngestionRateLimit:  10000,
+		IngestionBurstSize:  10000,
+		OverridesFile:       filename,
+
+		ingesterClientFactory: func(addr string) cortex.IngesterClient {
+			return ingesters[addr]
+		},
+	}, mockRing{
+		Counter:   prometheus.NewCounter(prometheus.CounterOpts{Name: "foo"}),
+		ingesters: ingesterDescs,
+	})
+	require.NoError(t, err)
+	defer d.Stop()
+
+	request := func() *cortex.WriteRequest {
+		return &cortex.WriteRequest{
+			Timeseries: []cortex.TimeSeries{{
+				Labels:  []cortex.LabelPair{{Name: []byte("__name__"), Value: []byte("foo")}},
+				Samples: []cortex.Sample{{Value: 1, TimestampMs: 1}},
+			}},
+		}
+	}
+	_, err = d.Push(user.Inject(context.Background(), "dev"), request())
+	assert.NoError(t, err)
+	_, err = d.Push(user.Inject(context.Background(), "prod"), request())
+	assert.Error(t, err)
+
+	// Stats are summed over all the ingesters, and divided by the user's RF.
+	stats, err := d.UserStats(user.Inject(context.Background(), "dev"))
+	require.NoError(t, err)
+	assert.Equal(t, uint64(30), stats.NumSeries)
+	stats, err = d.UserStats(user.Inject(context.Background(), "prod"))
+	require.NoError(t, err)
+	assert.Equal(t, uint64(10), stats.NumSeries)
+}
+
+func TestDistributorPoolOverrides(t *testing.T) {
+	filename := writeOverrides(t, `
+overrides:
+  noisy:
+    pool: dedicated
+`)
+	defer os.Remove(filename)
+
+	// The default pool's ingesters are happy, the dedicated pool's aren't, so
+	// pushes fail for the noisy tenant only.
+	ingesterDescs := []*ring.IngesterDesc{}
+	ingesters := map[string]mockIngester{}
+	for i := 0; i < 6; i++ {
+		addr := fmt.Sprintf("%d", i)
+		desc := &ring.IngesterDesc{
+			Addr:      addr,
+			Timestamp: time.Now().Unix(),
+		}
+		if i >= 3 {
+			desc.Pool = "dedicated"
+		}
+		ingesterDescs = append(ingesterDescs, desc)
+		ingesters[addr] = mockIngester{happy: i < 3}
+	}
+	d, err := New(Config{
+		ReplicationFactor:   3,
+		HeartbeatTimeout:    1 * time.Minute,
+		RemoteTimeout:       1 * time.Minute,
+		ClientCleanupPeriod: 1 * time.Minute,
+		IngestionRateLimit:  10000,
+		IngestionBurstSize:  10000,
+		OverridesFile:       filename,
+
+		ingesterClientFactory: func(addr string) cortex.IngesterClient {
+			return ingesters[addr]
+		},
+	}, mockRing{
+		Counter:   prometheus.NewCounter(prometheus.CounterOpts{Name: "foo"}),
+		ingesters: ingesterDescs,
+	})
+	require.NoError(t, err)
+	defer d.Stop()
+
+	request := &cortex.WriteRequest{
+		Timeseries: []cortex.TimeSeries{{
+			Labels:  []cortex.LabelPair{{Name: []byte("__name__"), Value: []byte("foo")}},
+			Samples: []cortex.Sample{{Value: 1, TimestampMs: 1}},
+		}},
+	}
+	_, err = d.Push(user.Inject(context.Background(), "quiet"), request)
+	assert.NoError(t, err)
+	_, err = d.Push(user.Inject(context.Background(), "noisy"), request)
+	assert.Error(t, err)
+}
+
+// countingSeriesIngester counts the series pushed to it.
+type countingSeriesIngester struct {
+	mockIngester
+	series int
+}
+
+func (i *countingSeriesIngester) Push(ctx context.Context, req *cortex.WriteRequest, opts ...grpc.CallOption) (*cortex.WriteResponse, error) {
+	i.series += len(req.Timeseries)
+	return i.mockIngester.Push(ctx, req, opts...)
+}
+
+func TestDistributorLabelLimitOverrides(t *testing.T) {
+	filename := writeOverrides(t, `
+overrides:
+  verbose:
+    max_label_value_length: 20
+`)
+	defer os.Remove(filename)
+
+	ingester := &countingSeriesIngester{mockIngester: mockIngester{happy: true}}
+	d, err := New(Config{
+		ReplicationFactor:   1,
+		HeartbeatTimeout:    1 * time.Minute,
+		RemoteTimeout:       1 * time.Minute,
+		ClientCleanupPeriod: 1 * time.Minute,
+		IngestionRateLimit:  10000,
+		IngestionBurstSize:  10000,
+		LabelLimits: util.LabelLimits{
+			MaxLabelNamesPerSeries: 3,
+			MaxLabelNameLength:     10,
+			MaxLabelValueLength:    10,
+		},
+		OverridesFile: filename,
+
+		ingesterClientFactory: func(addr string) cortex.IngesterClient {
+			return ingester
+		},
+	}, mockRing{
+		Counter:   prometheus.NewCounter(prometheus.CounterOpts{Name: "foo"}),
+		ingesters: []*ring.IngesterDesc{{Addr: "0", Timestamp: time.Now().Unix()}},
+	})
+	require.NoError(t, err)
+	defer d.Stop()
+
+	series := func(labels ...string) cortex.TimeSeries {
+		ts := cortex.TimeSeries{Samples: []cortex.Sample{{Value: 1, TimestampMs: 1}}}
+		for i := 0; i < len(labels); i += 2 {
+			ts.Labels = append(ts.Labels, cortex.LabelPair{Name: []byte(labels[i]), Value: []byte(labels[i+1])})
+		}
+		return ts
+	}
+	for _, tc := range []struct {
+		userID   string
+		series   cortex.TimeSeries
+		expected string
+	}{
+		{"user", series("__name__", "foo", "a", "b"), ""},
+		{"user", series("__name__", "foo", "a", "b", "c", "d", "e", "f"), util.MaxLabelNamesPerSeriesLimit},
+		{"user", series("__name__", "foo", "a_long_label_name", "b"), util.MaxLabelNameLengthLimit},
+		{"user", series("__name__", "foo", "a", "a long label value"), util.MaxLabelValueLengthLimit},
+		{"verbose", series("__name__", "foo", "a", "a long label value"), ""},
+		{"verbose", series("__name__", "foo", "a", "an even longer label value"), util.MaxLabelValueLengthLimit},
+	} {
+		ingester.series = 0
+		// The valid series pushed along with the invalid one still make it
+		// to the ingesters.
+		_, err := d.Push(user.Inject(context.Background(), tc.userID), &cortex.WriteRequest{
+			Timeseries: []cortex.TimeSeries{tc.series, series("__name__", "bar")},
+		})
+		if tc.expected == "" {
+			assert.NoError(t, err)
+			assert.Equal(t, 2, ingester.series)
+			continue
+		}
+		limitErr, ok := err.(*util.LimitError)
+		require.True(t, ok, "%v", err)
+		assert.Equal(t, tc.expected, limitErr.Limit)
+		assert.Equal(t, 1, ingester.series)
+	}
+}
+
+func TestDistributorPushTraceSampling(t *testing.T) {
+	filename := writeOverrides(t, `
+overrides:
+  traced:
+    push_trace_sample_rate: 1
+`)
+	defer os.Remove(filename)
+
+	d := newTestDistributor(t, Config{
+		PushTraceSampleRate:    0,
+		PushTraceSlowThreshold: time.Second,
+		OverridesFile:          filename,
+	})
+	defer d.Stop()
+
+	ctx := user.Inject(context.Background(), "user")
+	assert.False(t, d.samplePushTrace(ctx, 200, time.Millisecond))
+	assert.False(t, d.samplePushTrace(ctx, 429, time.Millisecond))
+	assert.True(t, d.samplePushTrace(ctx, 500, time.Millisecond))
+	assert.True(t, d.samplePushTrace(ctx, 200, 2*time.Second))
+	assert.True(t, d.samplePushTrace(user.Inject(context.Background(), "traced"), 200, time.Millisecond))
+}
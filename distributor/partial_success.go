@@ -0,0 +1,86 @@
+package distributor
+
+import (
+	"net/http"
+	"strconv"
+
+	"golang.org/x/net/context"
+)
+
+// PartialSuccess is the body of the response to a push of which only some
+// samples were accepted, in the style of OTLP's partial success responses.
+// The samples are counted after native histograms are converted.
+type PartialSuccess struct {
+	AcceptedDataPoints int            `json:"acceptedDataPoints"`
+	RejectedDataPoints int            `json:"rejectedDataPoints"`
+	RejectedByReason   map[string]int `json:"rejectedByReason"`
+	ErrorMessage       string         `json:"errorMessage"`
+}
+
+type partialSuccessResponse struct {
+	PartialSuccess PartialSuccess `json:"partialSuccess"`
+}
+
+type partialSuccessKey struct{}
+
+// withPartialSuccess returns a context in which pushes of which only some
+// samples are rejected succeed, recording the rejections in the returned
+// PartialSuccess rather than failing.
+func withPartialSuccess(ctx context.Context) (context.Context, *PartialSuccess) {
+	p := &PartialSuccess{}
+	return context.WithValue(ctx, partialSuccessKey{}, p), p
+}
+
+// mayPartiallySucceed returns whether samples of the push may be rejected
+// without failing it.
+func mayPartiallySucceed(ctx context.Context) bool {
+	_, ok := ctx.Value(partialSuccessKey{}).(*PartialSuccess)
+	return ok
+}
+
+// rejectSamples records that the push rejected samples for the reasons given,
+// with the last rejection's error, if it may partially succeed. It returns
+// false if the push must fail instead.
+func rejectSamples(ctx context.Context, rejected map[string]int, err error) bool {
+	p, ok := ctx.Value(partialSuccessKey{}).(*PartialSuccess)
+	if !ok {
+		return false
+	}
+	if p.RejectedByReason == nil {
+		p.RejectedByReason = map[string]int{}
+	}
+	for reason, n := range rejected {
+		p.RejectedByReason[reason] += n
+		p.RejectedDataPoints += n
+	}
+	p.ErrorMessage = err.Error()
+	return true
+}
+
+// acceptSamples records that the push wrote samples to the ingesters, if it
+// may partially succeed.
+func acceptSamples(ctx context.Context, accepted int) {
+	if p, ok := ctx.Value(partialSuccessKey{}).(*PartialSuccess); ok {
+		p.AcceptedDataPoints += accepted
+	}
+}
+
+// writePartialSuccess responds to a push of which only some samples were
+// accepted. Remote write 2.0 senders learn how many samples were written from
+// the headers, so those rejected are taken off.
+func writePartialSuccess(w http.ResponseWriter, p *PartialSuccess, written http.Header) {
+	if values := written[samplesWrittenHeader]; len(values) == 1 {
+		samples, err := strconv.Atoi(values[0])
+		if err == nil {
+			samples -= p.RejectedDataPoints
+			if samples < 0 {
+				samples = 0
+			}
+			written[samplesWrittenHeader] = []string{strconv.Itoa(samples)}
+		}
+	}
+	for name, values := range written {
+		w.Header()[name] = values
+	}
+	WriteJSONResponse(w, partialSuccessResponse{PartialSuccess: *p})
+}
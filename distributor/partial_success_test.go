@@ -0,0 +1,171 @@
+package distributor
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+
+	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex"
+	"github.com/weaveworks/cortex/util"
+)
+
+// pushHTTP pushes the request to the distributor's push handler.
+func pushHTTP(t *testing.T, d *Distributor, req *cortex.WriteRequest) *httptest.ResponseRecorder {
+	data, err := proto.Marshal(req)
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	writer := snappy.NewWriter(&buf)
+	_, err = writer.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+	httpReq := httptest.NewRequest("POST", "/api/prom/push", &buf)
+	httpReq = httpReq.WithContext(user.Inject(httpReq.Context(), "user"))
+	recorder := httptest.NewRecorder()
+	d.PushHandler(recorder, httpReq)
+	return recorder
+}
+
+// rejectingIngester rejects the samples of the series whose sample label has
+// a value it has a reason for.
+type rejectingIngester struct {
+	mockIngester
+	reasons map[string]string
+}
+
+func (i rejectingIngester) Push(ctx context.Context, req *cortex.WriteRequest, opts ...grpc.CallOption) (*cortex.WriteResponse, error) {
+	rejected := &util.RejectedSamplesError{Samples: map[int]string{}}
+	for j, ts := range req.Timeseries {
+		for _, l := range ts.Labels {
+			if reason, ok := i.reasons[string(l.Value)]; ok && string(l.Name) == "sample" {
+				rejected.Samples[j] = reason
+				rejected.Err = fmt.Errorf("rejected for %s", reason)
+			}
+		}
+	}
+	if len(rejected.Samples) > 0 {
+		return &cortex.WriteResponse{}, rejected.GRPCError()
+	}
+	return i.mockIngester.Push(ctx, req, opts...)
+}
+
+func TestDistributorPartialSuccess(t *testing.T) {
+	push := func(partialSuccess bool, req *cortex.WriteRequest) *httptest.ResponseRecorder {
+		d := newTestDistributor(t, Config{
+			IngestionRateLimit: 10000,
+			IngestionBurstSize: 10000,
+			LabelLimits:        util.LabelLimits{MaxLabelNamesPerSeries: 2, MaxLabelValueLength: 10},
+			PartialSuccess:     partialSuccess,
+		})
+		defer d.Stop()
+		return pushHTTP(t, d, req)
+	}
+
+	// Three valid series, and three samples of series exceeding the limits.
+	makeRequest := func() *cortex.WriteRequest {
+		req := makeWriteRequest(3, cortex.API)
+		req.Timeseries = append(req.Timeseries,
+			cortex.TimeSeries{
+				Labels: []cortex.LabelPair{
+					{Name: []byte("__name__"), Value: []byte("foo")},
+					{Name: []byte("a"), Value: []byte("b")},
+					{Name: []byte("c"), Value: []byte("d")},
+				},
+				Samples: []cortex.Sample{{Value: 1, TimestampMs: 1}, {Value: 2, TimestampMs: 2}},
+			},
+			cortex.TimeSeries{
+				Labels: []cortex.LabelPair{
+					{Name: []byte("__name__"), Value: []byte("foo")},
+					{Name: []byte("a"), Value: []byte("a long label value")},
+				},
+				Samples: []cortex.Sample{{Value: 1, TimestampMs: 1}},
+			},
+		)
+		return req
+	}
+
+	recorder := push(false, makeRequest())
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+
+	recorder = push(true, makeRequest())
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.JSONEq(t, `{"partialSuccess": {
+		"acceptedDataPoints": 3,
+		"rejectedDataPoints": 3,
+		"rejectedByReason": {"max_label_names_per_series": 2, "max_label_value_length": 1},
+		"errorMessage": "label value too long: a=\"a long label value\""
+	}}`, recorder.Body.String())
+
+	// Pushes with nothing to accept still fail.
+	req := makeRequest()
+	req.Timeseries = req.Timeseries[3:]
+	recorder = push(true, req)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+}
+
+func TestDistributorPartialSuccessIngesterRejections(t *testing.T) {
+	push := func(partialSuccess bool) *httptest.ResponseRecorder {
+		// Samples 1 and 2 are rejected by all the ingesters, and sample 3
+		// only by one, so is still written.
+		d := newTestDistributor(t, Config{
+			IngestionRateLimit: 10000,
+			IngestionBurstSize: 10000,
+			PartialSuccess:     partialSuccess,
+		})
+		defer d.Stop()
+		d.cfg.ingesterClientFactory = func(addr string) cortex.IngesterClient {
+			reasons := map[string]string{"1": util.OutOfOrderReason, "2": util.MaxSeriesPerUserLimit}
+			if addr == "0" {
+				reasons["3"] = util.TooOldReason
+			}
+			return rejectingIngester{mockIngester: mockIngester{happy: true}, reasons: reasons}
+		}
+		return pushHTTP(t, d, makeWriteRequest(5, cortex.API))
+	}
+
+	recorder := push(false)
+	assert.Equal(t, http.StatusInternalServerError, recorder.Code)
+
+	recorder = push(true)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var resp partialSuccessResponse
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &resp))
+	assert.Equal(t, 3, resp.PartialSuccess.AcceptedDataPoints)
+	assert.Equal(t, 2, resp.PartialSuccess.RejectedDataPoints)
+	assert.Equal(t, map[string]int{util.OutOfOrderReason: 1, util.MaxSeriesPerUserLimit: 1}, resp.PartialSuccess.RejectedByReason)
+}
+
+func TestDistributorPartialSuccessRateLimited(t *testing.T) {
+	push := func(partialSuccess bool) *httptest.ResponseRecorder {
+		d := newTestDistributor(t, Config{
+			IngestionRateLimit: 1,
+			IngestionBurstSize: 4,
+			PartialSuccess:     partialSuccess,
+		})
+		defer d.Stop()
+		return pushHTTP(t, d, makeWriteRequest(10, cortex.API))
+	}
+
+	recorder := push(false)
+	assert.Equal(t, http.StatusTooManyRequests, recorder.Code)
+
+	// As many samples as the burst allows are accepted.
+	recorder = push(true)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.JSONEq(t, `{"partialSuccess": {
+		"acceptedDataPoints": 4,
+		"rejectedDataPoints": 6,
+		"rejectedByReason": {"ingestion_rate": 6},
+		"errorMessage": "ingestion rate limit exceeded"
+	}}`, recorder.Body.String())
+}
@@ -0,0 +1,47 @@
+package distributor
+
+import (
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex"
+)
+
+// A Pusher handles pushes of samples.
+type Pusher interface {
+	Push(context.Context, *cortex.WriteRequest) (*cortex.WriteResponse, error)
+}
+
+// PushFunc is to Pusher as http.HandlerFunc is to http.Handler.
+type PushFunc func(context.Context, *cortex.WriteRequest) (*cortex.WriteResponse, error)
+
+// Push implements Pusher.
+func (f PushFunc) Push(ctx context.Context, req *cortex.WriteRequest) (*cortex.WriteResponse, error) {
+	return f(ctx, req)
+}
+
+// PushMiddleware wraps a Pusher, to inspect, modify or reject pushes before
+// passing them on.
+type PushMiddleware interface {
+	WrapPush(next Pusher) Pusher
+}
+
+// PushMiddlewareFunc is to PushMiddleware as http.HandlerFunc is to
+// http.Handler.
+type PushMiddlewareFunc func(next Pusher) Pusher
+
+// WrapPush implements PushMiddleware.
+func (f PushMiddlewareFunc) WrapPush(next Pusher) Pusher {
+	return f(next)
+}
+
+// MergePushMiddleware produces a PushMiddleware that applies multiple
+// PushMiddleware in turn; ie MergePushMiddleware(f,g,h).WrapPush(p) ==
+// f.WrapPush(g.WrapPush(h.WrapPush(p))), so f sees pushes first.
+func MergePushMiddleware(middlewares ...PushMiddleware) PushMiddleware {
+	return PushMiddlewareFunc(func(next Pusher) Pusher {
+		for i := len(middlewares) - 1; i >= 0; i-- {
+			next = middlewares[i].WrapPush(next)
+		}
+		return next
+	})
+}
@@ -0,0 +1,67 @@
+package distributor
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex"
+)
+
+func TestMergePushMiddleware(t *testing.T) {
+	var calls []string
+	record := func(name string) PushMiddleware {
+		return PushMiddlewareFunc(func(next Pusher) Pusher {
+			return PushFunc(func(ctx context.Context, req *cortex.WriteRequest) (*cortex.WriteResponse, error) {
+				calls = append(calls, name)
+				return next.Push(ctx, req)
+			})
+		})
+	}
+
+	pusher := MergePushMiddleware(record("a"), MergePushMiddleware(record("b"), record("c"))).WrapPush(
+		PushFunc(func(ctx context.Context, req *cortex.WriteRequest) (*cortex.WriteResponse, error) {
+			calls = append(calls, "push")
+			return &cortex.WriteResponse{}, nil
+		}))
+	_, err := pusher.Push(context.Background(), &cortex.WriteRequest{})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "b", "c", "push"}, calls)
+}
+
+func TestDistributorPushMiddleware(t *testing.T) {
+	ctx := user.Inject(context.Background(), "user")
+	var seen []int
+	d := newTestDistributor(t, Config{
+		IngestionRateLimit: 1,
+		IngestionBurstSize: 20,
+		PushMiddleware: []PushMiddleware{
+			PushMiddlewareFunc(func(next Pusher) Pusher {
+				return PushFunc(func(ctx context.Context, req *cortex.WriteRequest) (*cortex.WriteResponse, error) {
+					seen = append(seen, len(req.Timeseries))
+					if len(req.Timeseries) == 5 {
+						return nil, fmt.Errorf("rejected")
+					}
+					return next.Push(ctx, req)
+				})
+			}),
+		},
+	})
+	defer d.Stop()
+
+	_, err := d.Push(ctx, makeWriteRequest(10, cortex.API))
+	assert.NoError(t, err)
+	_, err = d.Push(ctx, makeWriteRequest(5, cortex.API))
+	assert.EqualError(t, err, "rejected")
+
+	// Pushes rejected by the validation and limits don't reach the middleware.
+	_, err = d.Push(ctx, makeWriteRequest(0, cortex.API))
+	assert.NoError(t, err)
+	_, err = d.Push(ctx, makeWriteRequest(10, cortex.API))
+	assert.EqualError(t, err, errIngestionRateLimitExceeded.Error())
+
+	assert.Equal(t, []int{10, 5}, seen)
+}
@@ -0,0 +1,165 @@
+package distributor
+
+import (
+	"sort"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/local"
+	"github.com/prometheus/prometheus/storage/metric"
+
+	"github.com/weaveworks/cortex"
+	"github.com/weaveworks/cortex/util"
+)
+
+// mergeResponses merges the replicas of each series in the responses of
+// ingesters into a matrix.
+func mergeResponses(resps []*cortex.QueryResponse) (model.Matrix, error) {
+	type replicas struct {
+		metric model.Metric
+		values [][]model.SamplePair
+	}
+	fpToReplicas := map[model.Fingerprint]*replicas{}
+	for _, resp := range resps {
+		matrix, err := util.FromQueryResponse(resp)
+		if err != nil {
+			return nil, err
+		}
+		for _, ss := range matrix {
+			fp := ss.Metric.Fingerprint()
+			r, ok := fpToReplicas[fp]
+			if !ok {
+				r = &replicas{metric: ss.Metric}
+				fpToReplicas[fp] = r
+			}
+			r.values = append(r.values, ss.Values)
+		}
+	}
+
+	result := make(model.Matrix, 0, len(fpToReplicas))
+	for _, r := range fpToReplicas {
+		result = append(result, &model.SampleStream{
+			Metric: r.metric,
+			Values: util.MergeNSamples(r.values...),
+		})
+	}
+	return result, nil
+}
+
+// responseIterators returns an iterator over each series in the responses of
+// ingesters, reading the samples from the responses as they are asked for.
+func responseIterators(resps []*cortex.QueryResponse) ([]local.SeriesIterator, error) {
+	var result []local.SeriesIterator
+	for _, resp := range resps {
+		for i := range resp.Timeseries {
+			ts := &resp.Timeseries[i]
+			result = append(result, &timeSeriesIterator{
+				metric:  util.FromLabelPairs(ts.Labels),
+				samples: ts.Samples,
+			})
+		}
+		for i := range resp.ColumnarTimeseries {
+			ts := &resp.ColumnarTimeseries[i]
+			if err := util.ValidateColumnarTimeSeries(ts); err != nil {
+				return nil, err
+			}
+			result = append(result, &columnarSeriesIterator{
+				metric:     util.FromLabelPairs(ts.Labels),
+				timestamps: ts.TimestampsMs,
+				values:     ts.Values,
+			})
+		}
+	}
+	return result, nil
+}
+
+// timeSeriesIterator iterates over the samples of a series in a response.
+type timeSeriesIterator struct {
+	metric  model.Metric
+	samples []cortex.Sample
+}
+
+func (it *timeSeriesIterator) Metric() metric.Metric {
+	return metric.Metric{Metric: it.metric}
+}
+
+func (it *timeSeriesIterator) ValueAtOrBeforeTime(ts model.Time) model.SamplePair {
+	i := sort.Search(len(it.samples), func(n int) bool {
+		return it.samples[n].TimestampMs > int64(ts)
+	})
+	if i == 0 {
+		return model.ZeroSamplePair
+	}
+	return model.SamplePair{
+		Timestamp: model.Time(it.samples[i-1].TimestampMs),
+		Value:     model.SampleValue(it.samples[i-1].Value),
+	}
+}
+
+func (it *timeSeriesIterator) RangeValues(in metric.Interval) []model.SamplePair {
+	start := sort.Search(len(it.samples), func(n int) bool {
+		return it.samples[n].TimestampMs >= int64(in.OldestInclusive)
+	})
+	end := sort.Search(len(it.samples), func(n int) bool {
+		return it.samples[n].TimestampMs > int64(in.NewestInclusive)
+	})
+	if start >= end {
+		return nil
+	}
+	result := make([]model.SamplePair, 0, end-start)
+	for _, s := range it.samples[start:end] {
+		result = append(result, model.SamplePair{
+			Timestamp: model.Time(s.TimestampMs),
+			Value:     model.SampleValue(s.Value),
+		})
+	}
+	return result
+}
+
+func (it *timeSeriesIterator) Close() {}
+
+// columnarSeriesIterator iterates over the samples of a series in a columnar
+// response.
+type columnarSeriesIterator struct {
+	metric     model.Metric
+	timestamps []int64
+	values     []float64
+}
+
+func (it *columnarSeriesIterator) Metric() metric.Metric {
+	return metric.Metric{Metric: it.metric}
+}
+
+func (it *columnarSeriesIterator) ValueAtOrBeforeTime(ts model.Time) model.SamplePair {
+	i := sort.Search(len(it.timestamps), func(n int) bool {
+		return it.timestamps[n] > int64(ts)
+	})
+	if i == 0 {
+		return model.ZeroSamplePair
+	}
+	return model.SamplePair{
+		Timestamp: model.Time(it.timestamps[i-1]),
+		Value:     model.SampleValue(it.values[i-1]),
+	}
+}
+
+func (it *columnarSeriesIterator) RangeValues(in metric.Interval) []model.SamplePair {
+	start := sort.Search(len(it.timestamps), func(n int) bool {
+		return it.timestamps[n] >= int64(in.OldestInclusive)
+	})
+	end := sort.Search(len(it.timestamps), func(n int) bool {
+		return it.timestamps[n] > int64(in.NewestInclusive)
+	})
+	if start >= end {
+		return nil
+	}
+	result := make([]model.SamplePair, 0, end-start)
+	for i := start; i < end; i++ {
+		result = append(result, model.SamplePair{
+			Timestamp: model.Time(it.timestamps[i]),
+			Value:     model.SampleValue(it.values[i]),
+		})
+	}
+	return result
+}
+
+func (it *columnarSeriesIterator) Close() {}
@@ -0,0 +1,44 @@
+package distributor
+
+import (
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/weaveworks/cortex"
+	"github.com/weaveworks/cortex/util"
+)
+
+func TestResponseIterators(t *testing.T) {
+	matrix := model.Matrix{
+		{
+			Metric: model.Metric{model.MetricNameLabel: "foo"},
+			Values: []model.SamplePair{{Timestamp: 10, Value: 1}, {Timestamp: 20, Value: 2}, {Timestamp: 30, Value: 3}},
+		},
+	}
+	columnar := util.ToColumnarQueryResponse(matrix)
+	its, err := responseIterators([]*cortex.QueryResponse{
+		util.ToQueryResponse(matrix),
+		columnar,
+	})
+	require.NoError(t, err)
+	assert.Len(t, its, 2)
+	for _, it := range its {
+		assert.Equal(t, matrix[0].Metric, it.Metric().Metric)
+		assert.Equal(t, model.ZeroSamplePair, it.ValueAtOrBeforeTime(5))
+		assert.Equal(t, model.SamplePair{Timestamp: 20, Value: 2}, it.ValueAtOrBeforeTime(25))
+		assert.Equal(t, model.SamplePair{Timestamp: 30, Value: 3}, it.ValueAtOrBeforeTime(100))
+		assert.Equal(t, matrix[0].Values[1:], it.RangeValues(metric.Interval{OldestInclusive: 20, NewestInclusive: 100}))
+		assert.Empty(t, it.RangeValues(metric.Interval{OldestInclusive: 31, NewestInclusive: 100}))
+	}
+
+	// A columnar series missing values is an error, rather than being dropped.
+	columnar.ColumnarTimeseries[0].Values = columnar.ColumnarTimeseries[0].Values[1:]
+	_, err = responseIterators([]*cortex.QueryResponse{columnar})
+	assert.Error(t, err)
+	_, err = mergeResponses([]*cortex.QueryResponse{columnar})
+	assert.Error(t, err)
+}
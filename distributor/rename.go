@@ -0,0 +1,108 @@
+package distributor
+
+import (
+	"github.com/prometheus/common/model"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex"
+)
+
+// rename names series pushed without a metric name by the nameless series
+// label, if configured, and renames the metrics and labels of pushes as the
+// tenant's overrides say, before they are validated. A series with both a
+// label and its new name keeps the value of the new one.
+func (d *Distributor) rename(next Pusher) Pusher {
+	return PushFunc(func(ctx context.Context, req *cortex.WriteRequest) (*cortex.WriteResponse, error) {
+		if d.cfg.NamelessSeriesLabel != "" {
+			for i := range req.Timeseries {
+				req.Timeseries[i].Labels = nameSeries(req.Timeseries[i].Labels, d.cfg.NamelessSeriesLabel)
+			}
+		}
+
+		userID, err := user.Extract(ctx)
+		if err != nil {
+			return next.Push(ctx, req)
+		}
+		o := d.overrides[userID]
+		if len(o.MetricRenames) == 0 && len(o.LabelRenames) == 0 {
+			return next.Push(ctx, req)
+		}
+
+		for i := range req.Timeseries {
+			req.Timeseries[i].Labels = renameLabels(req.Timeseries[i].Labels, o.MetricRenames, o.LabelRenames)
+		}
+		return next.Push(ctx, req)
+	})
+}
+
+// nameSeries gives a series without a metric name one from the value of the
+// given label, which it keeps. The ingesters and chunk store key series by
+// their metric name, so it is what they are routed and indexed by.
+func nameSeries(labels []cortex.LabelPair, label string) []cortex.LabelPair {
+	var value []byte
+	for _, l := range labels {
+		if l.Name.Equal(labelNameBytes) {
+			return labels
+		}
+		if string(l.Name) == label {
+			value = l.Value
+		}
+	}
+	if len(value) == 0 {
+		return labels
+	}
+	return append(labels, cortex.LabelPair{Name: labelNameBytes, Value: sanitizeMetricName(value)})
+}
+
+// sanitizeMetricName replaces the characters not allowed in metric names,
+// such as the dots of OpenTelemetry metric names, with underscores.
+func sanitizeMetricName(name []byte) []byte {
+	result := make([]byte, len(name))
+	for i, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c == '_', c == ':':
+		case c >= '0' && c <= '9' && i > 0:
+		default:
+			c = '_'
+		}
+		result[i] = c
+	}
+	return result
+}
+
+func renameLabels(labels []cortex.LabelPair, metricRenames, labelRenames map[string]string) []cortex.LabelPair {
+	var renamed []bool
+	for i, l := range labels {
+		if string(l.Name) == model.MetricNameLabel {
+			if name, ok := metricRenames[string(l.Value)]; ok {
+				labels[i].Value = []byte(name)
+			}
+		} else if name, ok := labelRenames[string(l.Name)]; ok {
+			if renamed == nil {
+				renamed = make([]bool, len(labels))
+			}
+			labels[i].Name = []byte(name)
+			renamed[i] = true
+		}
+	}
+	if renamed == nil {
+		return labels
+	}
+
+	// Drop renamed labels clashing with a label already so named, or with an
+	// earlier label renamed to the same name.
+	result := make([]cortex.LabelPair, 0, len(labels))
+outer:
+	for i, l := range labels {
+		if renamed[i] {
+			for j, other := range labels {
+				if j != i && string(other.Name) == string(l.Name) && (!renamed[j] || j < i) {
+					continue outer
+				}
+			}
+		}
+		result = append(result, l)
+	}
+	return result
+}
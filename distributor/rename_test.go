@@ -0,0 +1,78 @@
+package distributor
+
+import (
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/weaveworks/cortex"
+	"github.com/weaveworks/cortex/util"
+)
+
+func TestRenameLabels(t *testing.T) {
+	metricRenames := map[string]string{"http_requests": "http_requests_total"}
+	labelRenames := map[string]string{"hostname": "instance", "host": "instance"}
+	for _, tc := range []struct {
+		labels, expected model.Metric
+	}{
+		{
+			model.Metric{"__name__": "http_requests", "hostname": "a"},
+			model.Metric{"__name__": "http_requests_total", "instance": "a"},
+		},
+		{
+			model.Metric{"__name__": "up", "job": "b"},
+			model.Metric{"__name__": "up", "job": "b"},
+		},
+		// The label already named so wins.
+		{
+			model.Metric{"__name__": "up", "hostname": "a", "instance": "b"},
+			model.Metric{"__name__": "up", "instance": "b"},
+		},
+	} {
+		labels := labelPairs(tc.labels)
+		assert.Equal(t, tc.expected, util.FromLabelPairs(renameLabels(labels, metricRenames, labelRenames)))
+	}
+
+	// Of two labels renamed to the same name, the first wins.
+	labels := []cortex.LabelPair{
+		{Name: []byte("host"), Value: []byte("a")},
+		{Name: []byte("hostname"), Value: []byte("b")},
+	}
+	assert.Equal(t, model.Metric{"instance": "a"}, util.FromLabelPairs(renameLabels(labels, metricRenames, labelRenames)))
+}
+
+func labelPairs(m model.Metric) []cortex.LabelPair {
+	labels := make([]cortex.LabelPair, 0, len(m))
+	for name, value := range m {
+		labels = append(labels, cortex.LabelPair{Name: []byte(name), Value: []byte(value)})
+	}
+	return labels
+}
+
+func TestNameSeries(t *testing.T) {
+	for _, tc := range []struct {
+		labels, expected model.Metric
+	}{
+		{
+			model.Metric{"otel_metric_name": "http.server.duration", "job": "a"},
+			model.Metric{"__name__": "http_server_duration", "otel_metric_name": "http.server.duration", "job": "a"},
+		},
+		// Series already named, or without the label, are left alone.
+		{
+			model.Metric{"__name__": "up", "otel_metric_name": "http.server.duration"},
+			model.Metric{"__name__": "up", "otel_metric_name": "http.server.duration"},
+		},
+		{
+			model.Metric{"job": "a"},
+			model.Metric{"job": "a"},
+		},
+		{
+			model.Metric{"otel_metric_name": "2xx-responses"},
+			model.Metric{"__name__": "_xx_responses", "otel_metric_name": "2xx-responses"},
+		},
+	} {
+		labels := labelPairs(tc.labels)
+		assert.Equal(t, tc.expected, util.FromLabelPairs(nameSeries(labels, "otel_metric_name")))
+	}
+}
@@ -0,0 +1,345 @@
+package distributor
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/storage/metric"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex"
+	"github.com/weaveworks/cortex/util"
+)
+
+const (
+	// The most debug sessions a tenant may have at once, and the most fates
+	// each remembers, the oldest being forgotten first.
+	maxDebugSessionsPerUser = 5
+	maxFatesPerDebugSession = 1000
+
+	fateAccepted = "accepted"
+	fateRejected = "rejected"
+	fateDeduped  = "deduped"
+)
+
+// SampleFate is what happened to a sample pushed by a tenant debugging their
+// ingestion.
+type SampleFate struct {
+	Time      time.Time    `json:"time"`
+	Metric    model.Metric `json:"metric"`
+	Timestamp model.Time   `json:"timestamp"`
+	Value     float64      `json:"value"`
+	Fate      string       `json:"fate"`
+	Reason    string       `json:"reason,omitempty"`
+}
+
+// DebugSession records the fates of a tenant's samples matching a selector,
+// until it expires.
+type DebugSession struct {
+	ID       int          `json:"id"`
+	Selector string       `json:"selector"`
+	Expires  time.Time    `json:"expires"`
+	Fates    []SampleFate `json:"fates"`
+
+	matchers metric.LabelMatchers
+}
+
+func (s *DebugSession) matches(m model.Metric) bool {
+	for _, matcher := range s.matchers {
+		if !matcher.Match(m[matcher.Name]) {
+			return false
+		}
+	}
+	return true
+}
+
+// sampleDebugger keeps tenants' debug sessions. Pushes by tenants without any
+// only cost a map lookup.
+type sampleDebugger struct {
+	maxDuration time.Duration
+
+	mtx      sync.RWMutex
+	nextID   int
+	sessions map[string][]*DebugSession
+}
+
+func newSampleDebugger(maxDuration time.Duration) *sampleDebugger {
+	return &sampleDebugger{
+		maxDuration: maxDuration,
+		sessions:    map[string][]*DebugSession{},
+	}
+}
+
+func (d *sampleDebugger) start(userID, selector string, duration time.Duration) (*DebugSession, error) {
+	if d.maxDuration <= 0 {
+		return nil, fmt.Errorf("debugging samples is disabled")
+	}
+	if duration <= 0 || duration > d.maxDuration {
+		duration = d.maxDuration
+	}
+	matchers, err := promql.ParseMetricSelector(selector)
+	if err != nil {
+		return nil, err
+	}
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	d.unlockedExpire(time.Now())
+	if len(d.sessions[userID]) >= maxDebugSessionsPerUser {
+		return nil, fmt.Errorf("at most %d debug sessions can run at once", maxDebugSessionsPerUser)
+	}
+	d.nextID++
+	session := &DebugSession{
+		ID:       d.nextID,
+		Selector: selector,
+		Expires:  time.Now().Add(duration),
+		Fates:    []SampleFate{},
+		matchers: matchers,
+	}
+	d.sessions[userID] = append(d.sessions[userID], session)
+	s := *session
+	return &s, nil
+}
+
+func (d *sampleDebugger) stop(userID string, id int) bool {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	sessions := d.sessions[userID]
+	for i, session := range sessions {
+		if session.ID == id {
+			d.sessions[userID] = append(sessions[:i:i], sessions[i+1:]...)
+			if len(d.sessions[userID]) == 0 {
+				delete(d.sessions, userID)
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// list returns copies of the tenant's sessions.
+func (d *sampleDebugger) list(userID string) []DebugSession {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	d.unlockedExpire(time.Now())
+	sessions := make([]DebugSession, 0, len(d.sessions[userID]))
+	for _, session := range d.sessions[userID] {
+		s := *session
+		s.Fates = append([]SampleFate{}, session.Fates...)
+		sessions = append(sessions, s)
+	}
+	return sessions
+}
+
+// expire removes the sessions past their expiry.
+func (d *sampleDebugger) expire(now time.Time) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	d.unlockedExpire(now)
+}
+
+func (d *sampleDebugger) unlockedExpire(now time.Time) {
+	for userID, sessions := range d.sessions {
+		live := sessions[:0]
+		for _, session := range sessions {
+			if now.Before(session.Expires) {
+				live = append(live, session)
+			}
+		}
+		if len(live) == 0 {
+			delete(d.sessions, userID)
+		} else {
+			d.sessions[userID] = live
+		}
+	}
+}
+
+func (d *sampleDebugger) active(userID string) bool {
+	d.mtx.RLock()
+	defer d.mtx.RUnlock()
+	return len(d.sessions[userID]) > 0
+}
+
+// trace starts tracing the samples of the push matching the tenant's sessions,
+// returning nil if none match.
+func (d *sampleDebugger) trace(userID string, req *cortex.WriteRequest) *pushTrace {
+	d.mtx.RLock()
+	defer d.mtx.RUnlock()
+	sessions := d.sessions[userID]
+	if len(sessions) == 0 {
+		return nil
+	}
+
+	var t *pushTrace
+	for _, ts := range req.Timeseries {
+		m := util.FromLabelPairs(ts.Labels)
+		var matching []*DebugSession
+		for _, session := range sessions {
+			if session.matches(m) {
+				matching = append(matching, session)
+			}
+		}
+		if len(matching) == 0 {
+			continue
+		}
+		if t == nil {
+			t = &pushTrace{debugger: d, series: map[model.Fingerprint]*tracedSeries{}}
+		}
+		t.series[m.Fingerprint()] = &tracedSeries{
+			metric:   m,
+			samples:  ts.Samples,
+			sessions: matching,
+		}
+	}
+	return t
+}
+
+// pushTrace collects the fates of the traced series of a push, as it passes
+// through the distributor.
+type pushTrace struct {
+	debugger *sampleDebugger
+
+	mtx    sync.Mutex
+	series map[model.Fingerprint]*tracedSeries
+}
+
+type tracedSeries struct {
+	metric   model.Metric
+	samples  []cortex.Sample
+	sessions []*DebugSession
+	fate     string
+	reason   string
+}
+
+type pushTraceKey struct{}
+
+// recordFate records the fate of a series of a push being traced, if it is
+// one of those traced and its fate isn't yet known.
+func recordFate(ctx context.Context, labels []cortex.LabelPair, fate, reason string) {
+	t, ok := ctx.Value(pushTraceKey{}).(*pushTrace)
+	if !ok {
+		return
+	}
+	t.record(util.FromLabelPairs(labels).Fingerprint(), fate, reason)
+}
+
+// recordFates records the fate of all the series of a push being traced.
+func recordFates(ctx context.Context, req *cortex.WriteRequest, fate, reason string) {
+	if _, ok := ctx.Value(pushTraceKey{}).(*pushTrace); !ok {
+		return
+	}
+	for _, ts := range req.Timeseries {
+		recordFate(ctx, ts.Labels, fate, reason)
+	}
+}
+
+func (t *pushTrace) record(fp model.Fingerprint, fate, reason string) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if s, ok := t.series[fp]; ok && s.fate == "" {
+		s.fate, s.reason = fate, reason
+	}
+}
+
+// finish records the fates of the push's traced samples in their sessions;
+// those of series without a fate are decided by the result of the push.
+func (t *pushTrace) finish(err error) {
+	now := time.Now()
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	t.debugger.mtx.Lock()
+	defer t.debugger.mtx.Unlock()
+	for _, s := range t.series {
+		fate, reason := s.fate, s.reason
+		if fate == "" {
+			fate = fateAccepted
+			if err != nil {
+				fate, reason = fateRejected, err.Error()
+			}
+		}
+		for _, session := range s.sessions {
+			for _, sample := range s.samples {
+				session.Fates = append(session.Fates, SampleFate{
+					Time:      now,
+					Metric:    s.metric,
+					Timestamp: model.Time(sample.TimestampMs),
+					Value:     sample.Value,
+					Fate:      fate,
+					Reason:    reason,
+				})
+			}
+			if over := len(session.Fates) - maxFatesPerDebugSession; over > 0 {
+				session.Fates = append(session.Fates[:0:0], session.Fates[over:]...)
+			}
+		}
+	}
+}
+
+// debugSamples traces the fates of the samples of pushes matching their
+// tenant's debug sessions. It comes first, so it sees the samples as they
+// were pushed.
+func (d *Distributor) debugSamples(next Pusher) Pusher {
+	return PushFunc(func(ctx context.Context, req *cortex.WriteRequest) (*cortex.WriteResponse, error) {
+		userID, err := user.Extract(ctx)
+		if err != nil || !d.sampleDebugger.active(userID) {
+			return next.Push(ctx, req)
+		}
+		t := d.sampleDebugger.trace(userID, req)
+		if t == nil {
+			return next.Push(ctx, req)
+		}
+		resp, err := next.Push(context.WithValue(ctx, pushTraceKey{}, t), req)
+		t.finish(err)
+		return resp, err
+	})
+}
+
+// SampleDebugHandler lets tenants debug their ingestion: POST with a match[]
+// selector, and optionally a duration, to record what happens to the matching
+// samples they push, GET to see those fates, and DELETE with an id to stop.
+func (d *Distributor) SampleDebugHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := user.Extract(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		WriteJSONResponse(w, d.sampleDebugger.list(userID))
+
+	case "POST":
+		var duration time.Duration
+		if s := r.FormValue("duration"); s != "" {
+			if duration, err = time.ParseDuration(s); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		session, err := d.sampleDebugger.start(userID, r.FormValue("match[]"), duration)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		WriteJSONResponse(w, session)
+
+	case "DELETE":
+		id, err := strconv.Atoi(r.FormValue("id"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !d.sampleDebugger.stop(userID, id) {
+			http.Error(w, fmt.Sprintf("no debug session %d", id), http.StatusNotFound)
+		}
+
+	default:
+		http.Error(w, "only GET, POST and DELETE are allowed", http.StatusMethodNotAllowed)
+	}
+}
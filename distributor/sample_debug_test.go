@@ -0,0 +1,78 @@
+package distributor
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex"
+	"github.com/weaveworks/cortex/util"
+)
+
+func TestSampleDebugHandler(t *testing.T) {
+	d := newTestDistributor(t, Config{
+		IngestionRateLimit:     10000,
+		IngestionBurstSize:     10000,
+		SampleDebugMaxDuration: time.Minute,
+		LabelLimits:            util.LabelLimits{MaxLabelValueLength: 10},
+	})
+	defer d.Stop()
+	ctx := user.Inject(context.Background(), "user")
+
+	do := func(method string, params url.Values) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/api/prom/debug/samples?"+params.Encode(), nil)
+		if method == "POST" {
+			r = httptest.NewRequest(method, "/api/prom/debug/samples", strings.NewReader(params.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+		r = r.WithContext(ctx)
+		rec := httptest.NewRecorder()
+		d.SampleDebugHandler(rec, r)
+		return rec
+	}
+	rec := do("POST", url.Values{"match[]": {"{__name__=~\"foo\"}"}})
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Equal(t, http.StatusBadRequest, do("POST", url.Values{"match[]": {"{"}}).Code)
+
+	series := func(name, value string) cortex.TimeSeries {
+		return cortex.TimeSeries{
+			Labels: []cortex.LabelPair{
+				{Name: []byte("__name__"), Value: []byte(name)},
+				{Name: []byte("pod"), Value: []byte(value)},
+			},
+			Samples: []cortex.Sample{{Value: 1, TimestampMs: 1000}},
+		}
+	}
+	_, err := d.Push(ctx, &cortex.WriteRequest{Timeseries: []cortex.TimeSeries{
+		series("foo", "short"),
+		series("foo", "much-too-long"),
+		series("bar", "short"),
+	}})
+	require.Error(t, err)
+
+	rec = do("GET", nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	var sessions []DebugSession
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&sessions))
+	require.Len(t, sessions, 1)
+	fates := map[string]string{}
+	for _, f := range sessions[0].Fates {
+		fates[string(f.Metric["pod"])] = f.Fate
+	}
+	assert.Equal(t, map[string]string{"short": fateAccepted, "much-too-long": fateRejected}, fates)
+
+	rec = do("DELETE", url.Values{"id": {"1"}})
+	assert.Equal(t, http.StatusOK, rec.Code)
+	rec = do("GET", nil)
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&sessions))
+	assert.Len(t, sessions, 0)
+}
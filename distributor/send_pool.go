@@ -0,0 +1,93 @@
+package distributor
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/context"
+)
+
+var errSendPoolStopped = fmt.Errorf("distributor stopped")
+
+// sendPool runs the sends of pushes to ingesters on a fixed set of workers,
+// rather than a goroutine each, so a busy distributor doesn't churn through
+// millions of short-lived goroutines. Each worker has its own queue; sends go
+// to the next worker with room, and wait for room if every queue is full.
+type sendPool struct {
+	queues []chan func()
+	next   uint32
+	quit   chan struct{}
+	wg     sync.WaitGroup
+	waits  prometheus.Counter
+
+	// Held to queue sends, so none are queued once the pool has stopped.
+	mtx     sync.RWMutex
+	stopped bool
+}
+
+func newSendPool(workers, queueSize int, waits prometheus.Counter) *sendPool {
+	p := &sendPool{
+		queues: make([]chan func(), workers),
+		quit:   make(chan struct{}),
+		waits:  waits,
+	}
+	p.wg.Add(workers)
+	for i := range p.queues {
+		p.queues[i] = make(chan func(), queueSize)
+		go p.work(p.queues[i])
+	}
+	return p
+}
+
+func (p *sendPool) work(queue chan func()) {
+	defer p.wg.Done()
+	for send := range queue {
+		send()
+	}
+}
+
+// submit queues the send on a worker, waiting until one has room, the
+// context is cancelled or the pool is stopped.
+func (p *sendPool) submit(ctx context.Context, send func()) error {
+	p.mtx.RLock()
+	defer p.mtx.RUnlock()
+	if p.stopped {
+		return errSendPoolStopped
+	}
+
+	n := uint32(len(p.queues))
+	start := atomic.AddUint32(&p.next, 1)
+	for i := uint32(0); i < n; i++ {
+		select {
+		case p.queues[(start+i)%n] <- send:
+			return nil
+		default:
+		}
+	}
+
+	p.waits.Inc()
+	select {
+	case p.queues[start%n] <- send:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-p.quit:
+		return errSendPoolStopped
+	}
+}
+
+// stop stops the workers once they have run the sends queued; sends waiting
+// for room fail.
+func (p *sendPool) stop() {
+	close(p.quit)
+	p.mtx.Lock()
+	p.stopped = true
+	p.mtx.Unlock()
+
+	for _, queue := range p.queues {
+		close(queue)
+	}
+	p.wg.Wait()
+}
@@ -0,0 +1,145 @@
+package distributor
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+
+	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex"
+)
+
+func TestSendPool(t *testing.T) {
+	waits := prometheus.NewCounter(prometheus.CounterOpts{Name: "waits"})
+	p := newSendPool(1, 1, waits)
+	defer p.stop()
+
+	// Block the worker, and fill its queue.
+	started, release := make(chan struct{}), make(chan struct{})
+	require.NoError(t, p.submit(context.Background(), func() {
+		close(started)
+		<-release
+	}))
+	<-started
+	ran := make(chan struct{})
+	require.NoError(t, p.submit(context.Background(), func() { close(ran) }))
+	assert.Equal(t, 0.0, counterValue(t, waits))
+
+	// Further sends wait for room, until their push is cancelled.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, context.Canceled, p.submit(ctx, func() {}))
+	assert.Equal(t, 1.0, counterValue(t, waits))
+
+	close(release)
+	<-ran
+}
+
+func TestSendPoolStop(t *testing.T) {
+	p := newSendPool(1, 1, prometheus.NewCounter(prometheus.CounterOpts{Name: "waits"}))
+
+	started, release := make(chan struct{}), make(chan struct{})
+	require.NoError(t, p.submit(context.Background(), func() {
+		close(started)
+		<-release
+	}))
+	<-started
+	ran := false
+	require.NoError(t, p.submit(context.Background(), func() { ran = true }))
+
+	// Sends waiting for room fail, but those queued are run.
+	waiting := make(chan error)
+	go func() {
+		waiting <- p.submit(context.Background(), func() {})
+	}()
+	stopped := make(chan struct{})
+	go func() {
+		p.stop()
+		close(stopped)
+	}()
+	assert.Equal(t, errSendPoolStopped, <-waiting)
+	close(release)
+	<-stopped
+	assert.True(t, ran)
+	assert.Equal(t, errSendPoolStopped, p.submit(context.Background(), func() {}))
+}
+
+// blockingIngester takes pushes until it is released, regardless of their
+// context.
+type blockingIngester struct {
+	mockIngester
+	release chan struct{}
+}
+
+func (i blockingIngester) Push(ctx context.Context, req *cortex.WriteRequest, opts ...grpc.CallOption) (*cortex.WriteResponse, error) {
+	<-i.release
+	return i.mockIngester.Push(ctx, req, opts...)
+}
+
+func TestDistributorPushCancelled(t *testing.T) {
+	d := newTestDistributor(t, Config{
+		IngestionRateLimit:  10000,
+		IngestionBurstSize:  10000,
+		PushWorkers:         2,
+		PushWorkerQueueSize: 10,
+	})
+	release := make(chan struct{})
+	d.cfg.ingesterClientFactory = func(addr string) cortex.IngesterClient {
+		return blockingIngester{mockIngester: mockIngester{happy: true}, release: release}
+	}
+	defer d.Stop()
+	defer close(release)
+
+	// The push returns once cancelled, though its sends are still waiting.
+	ctx, cancel := context.WithTimeout(user.Inject(context.Background(), "user"), 10*time.Millisecond)
+	defer cancel()
+	_, err := d.Push(ctx, makeWriteRequest(10, cortex.API))
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestDistributorPushWorkers(t *testing.T) {
+	ctx := user.Inject(context.Background(), "user")
+	d := newTestDistributor(t, Config{
+		IngestionRateLimit:  10000,
+		IngestionBurstSize:  10000,
+		PushWorkers:         2,
+		PushWorkerQueueSize: 1,
+	})
+	defer d.Stop()
+
+	for i := 0; i < 10; i++ {
+		_, err := d.Push(ctx, makeWriteRequest(10, cortex.API))
+		require.NoError(t, err)
+	}
+}
+
+func BenchmarkDistributorPush(b *testing.B) {
+	for _, workers := range []int{0, 16} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			d := newTestDistributor(b, Config{
+				IngestionRateLimit:  1e12,
+				IngestionBurstSize:  1e9,
+				PushWorkers:         workers,
+				PushWorkerQueueSize: 100,
+			})
+			defer d.Stop()
+			ctx := user.Inject(context.Background(), "user")
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if _, err := d.Push(ctx, makeWriteRequest(10, cortex.API)); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		})
+	}
+}
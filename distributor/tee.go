@@ -0,0 +1,74 @@
+package distributor
+
+import (
+	"flag"
+	"math/rand"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex"
+	"github.com/weaveworks/cortex/util"
+)
+
+var teedPushes = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "cortex",
+	Name:      "distributor_teed_pushes_total",
+	Help:      "The total number of pushes teed to the shadow ingesters.",
+}, []string{"status"})
+
+func init() {
+	prometheus.MustRegister(teedPushes)
+}
+
+// TeeConfig configures teeing a fraction of pushes to a shadow ring of
+// ingesters, eg to load test a new version against production traffic.
+type TeeConfig struct {
+	Fraction     float64
+	ConsulPrefix string
+	Timeout      time.Duration
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet
+func (cfg *TeeConfig) RegisterFlags(f *flag.FlagSet) {
+	f.Float64Var(&cfg.Fraction, "distributor.tee.fraction", 0, "Fraction of pushes to also send to the shadow ingesters, between 0 and 1. 0 to disable.")
+	f.StringVar(&cfg.ConsulPrefix, "distributor.tee.consul-prefix", "shadow/", "Prefix for keys in Consul of the shadow ingesters' ring.")
+	f.DurationVar(&cfg.Timeout, "distributor.tee.timeout", 2*time.Second, "Timeout for pushes to the shadow ingesters.")
+}
+
+// NewTee returns PushMiddleware which also sends a fraction of pushes to the
+// shadow Pusher. This happens in the background, and whether it succeeds has
+// no effect on the push. The shadow gets its own copy of the request, as
+// pushing may modify it.
+func NewTee(cfg TeeConfig, shadow Pusher) PushMiddleware {
+	return PushMiddlewareFunc(func(next Pusher) Pusher {
+		return PushFunc(func(ctx context.Context, req *cortex.WriteRequest) (*cortex.WriteResponse, error) {
+			if rand.Float64() < cfg.Fraction {
+				if userID, err := user.Extract(ctx); err == nil {
+					go teePush(cfg, shadow, userID, util.ExtractRequestID(ctx), proto.Clone(req).(*cortex.WriteRequest))
+				}
+			}
+			return next.Push(ctx, req)
+		})
+	})
+}
+
+func teePush(cfg TeeConfig, shadow Pusher, userID, requestID string, req *cortex.WriteRequest) {
+	// Don't inherit the push's context, which is cancelled when it returns,
+	// but do keep its request ID.
+	ctx := user.Inject(context.Background(), userID)
+	if requestID != "" {
+		ctx = util.InjectRequestID(ctx, requestID)
+	}
+	ctx, cancel := context.WithTimeout(ctx, cfg.Timeout)
+	defer cancel()
+	if _, err := shadow.Push(ctx, req); err != nil {
+		util.WithRequestID(ctx).Debugf("Error teeing push to shadow ingesters: %v", err)
+		teedPushes.WithLabelValues("error").Inc()
+		return
+	}
+	teedPushes.WithLabelValues("success").Inc()
+}
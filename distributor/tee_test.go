@@ -0,0 +1,102 @@
+package distributor
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex"
+	"github.com/weaveworks/cortex/util"
+)
+
+func TestTee(t *testing.T) {
+	for i, tc := range []struct {
+		fraction       float64
+		shadowErr      error
+		expectedShadow int
+	}{
+		{fraction: 0, expectedShadow: 0},
+		{fraction: 1, expectedShadow: 10},
+		// Errors from the shadow don't fail the push.
+		{fraction: 1, shadowErr: fmt.Errorf("fail"), expectedShadow: 10},
+	} {
+		t.Run(fmt.Sprintf("[%d]", i), func(t *testing.T) {
+			shadowed := make(chan string, 10)
+			shadow := PushFunc(func(ctx context.Context, req *cortex.WriteRequest) (*cortex.WriteResponse, error) {
+				userID, err := user.Extract(ctx)
+				assert.NoError(t, err)
+				assert.Equal(t, "request", util.ExtractRequestID(ctx))
+				shadowed <- userID
+				return &cortex.WriteResponse{}, tc.shadowErr
+			})
+			pushes := 0
+			pusher := NewTee(TeeConfig{Fraction: tc.fraction, Timeout: time.Second}, shadow).WrapPush(
+				PushFunc(func(ctx context.Context, req *cortex.WriteRequest) (*cortex.WriteResponse, error) {
+					pushes++
+					return &cortex.WriteResponse{}, nil
+				}))
+
+			ctx := util.InjectRequestID(user.Inject(context.Background(), "user"), "request")
+			for j := 0; j < 10; j++ {
+				_, err := pusher.Push(ctx, makeWriteRequest(1, cortex.API))
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, 10, pushes)
+
+			for j := 0; j < tc.expectedShadow; j++ {
+				select {
+				case userID := <-shadowed:
+					assert.Equal(t, "user", userID)
+				case <-time.After(time.Second):
+					t.Fatal("timed out waiting for teed push")
+				}
+			}
+			select {
+			case <-shadowed:
+				t.Fatal("unexpected teed push")
+			case <-time.After(10 * time.Millisecond):
+			}
+		})
+	}
+}
+
+// TestTeeCopiesRequest checks, when run with -race, that the shadow doesn't
+// share the request with the push, both of which modify it as distributors
+// do.
+func TestTeeCopiesRequest(t *testing.T) {
+	mutate := func(req *cortex.WriteRequest) {
+		for i := range req.Timeseries {
+			req.Timeseries[i].Labels[0].Value[0] = 'x'
+		}
+		req.Timeseries = req.Timeseries[:0]
+	}
+	done := make(chan *cortex.WriteRequest)
+	shadow := PushFunc(func(ctx context.Context, req *cortex.WriteRequest) (*cortex.WriteResponse, error) {
+		mutate(req)
+		done <- req
+		return &cortex.WriteResponse{}, nil
+	})
+	pusher := NewTee(TeeConfig{Fraction: 1, Timeout: time.Second}, shadow).WrapPush(
+		PushFunc(func(ctx context.Context, req *cortex.WriteRequest) (*cortex.WriteResponse, error) {
+			assert.Len(t, req.Timeseries, 10)
+			for _, ts := range req.Timeseries {
+				assert.Equal(t, "foo", string(ts.Labels[0].Value))
+			}
+			mutate(req)
+			return &cortex.WriteResponse{}, nil
+		}))
+
+	req := makeWriteRequest(10, cortex.API)
+	_, err := pusher.Push(user.Inject(context.Background(), "user"), req)
+	assert.NoError(t, err)
+	select {
+	case teed := <-done:
+		assert.Empty(t, teed.Timeseries)
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for teed push")
+	}
+}
@@ -0,0 +1,211 @@
+package distributor
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"math"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+
+	"github.com/weaveworks/cortex"
+	"github.com/weaveworks/cortex/util"
+)
+
+const openMetricsContentType = "application/openmetrics-text"
+
+// TextPushHandler is a http.Handler which accepts metrics in the Prometheus
+// text exposition format, or OpenMetrics, as batch jobs push them to a
+// Pushgateway. Its path is the grouping key, /metrics/job/<job> followed by
+// any more /<label>/<value> pairs, whose labels are set on every sample.
+// Samples without a timestamp get the time they are received.
+func (d *Distributor) TextPushHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodPut {
+		http.Error(w, "only POST and PUT are supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	groupingKey, err := parseGroupingKey(r.URL.Path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	samples, err := parseTextPush(r, model.Now())
+	if err != nil {
+		util.WithRequestID(r.Context()).Error(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	pushed := make([]model.Sample, 0, len(samples))
+	for _, s := range samples {
+		for name, value := range groupingKey {
+			s.Metric[name] = value
+		}
+		pushed = append(pushed, *s)
+	}
+	req := util.ToWriteRequest(pushed)
+	req.Source = cortex.API
+	if _, err := d.Push(r.Context(), req); err != nil {
+		writePushError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// parseGroupingKey parses the labels of a Pushgateway grouping key path. As
+// for the Pushgateway, label names suffixed with @base64 have URL-safe base64
+// encoded values, which can contain slashes.
+func parseGroupingKey(path string) (model.LabelSet, error) {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	if len(parts) < 3 || parts[0] != "metrics" || parts[1] != "job" {
+		return nil, fmt.Errorf("path %q is not /metrics/job/<job>{/<label>/<value>}", path)
+	}
+	parts = parts[1:]
+	if len(parts)%2 != 0 {
+		return nil, fmt.Errorf("odd number of grouping key path elements in %q", path)
+	}
+
+	labels := model.LabelSet{}
+	for i := 0; i < len(parts); i += 2 {
+		name, value := parts[i], parts[i+1]
+		if strings.HasSuffix(name, "@base64") {
+			name = strings.TrimSuffix(name, "@base64")
+			decoded, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+			if err != nil {
+				return nil, fmt.Errorf("invalid base64 value for grouping label %q: %v", name, err)
+			}
+			value = string(decoded)
+		}
+		if !model.LabelName(name).IsValid() || strings.HasPrefix(name, model.ReservedLabelPrefix) {
+			return nil, fmt.Errorf("invalid grouping label name %q", name)
+		}
+		if value == "" && name == "job" {
+			return nil, fmt.Errorf("empty job name")
+		}
+		labels[model.LabelName(name)] = model.LabelValue(value)
+	}
+	return labels, nil
+}
+
+// parseTextPush decodes the samples of a push, in the format of its
+// Content-Type: text, delimited protobuf, or OpenMetrics.
+func parseTextPush(r *http.Request, now model.Time) (model.Vector, error) {
+	body := io.Reader(r.Body)
+	format := expfmt.ResponseFormat(r.Header)
+	if mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err == nil && mediaType == openMetricsContentType {
+		text, err := openMetricsToText(r.Body)
+		if err != nil {
+			return nil, err
+		}
+		body, format = text, expfmt.FmtText
+	}
+
+	decoder := expfmt.SampleDecoder{
+		Dec:  expfmt.NewDecoder(body, format),
+		Opts: &expfmt.DecodeOptions{Timestamp: now},
+	}
+	var samples model.Vector
+	for {
+		var v model.Vector
+		if err := decoder.Decode(&v); err == io.EOF {
+			return samples, nil
+		} else if err != nil {
+			return nil, err
+		}
+		samples = append(samples, v...)
+	}
+}
+
+// openMetricsToText rewrites OpenMetrics as the text exposition format: types
+// it doesn't have become untyped, timestamps go from seconds to milliseconds,
+// and exemplars, units and the EOF marker are dropped.
+func openMetricsToText(r io.Reader) (io.Reader, error) {
+	var buf bytes.Buffer
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "# EOF" || strings.HasPrefix(line, "# UNIT "):
+			continue
+		case strings.HasPrefix(line, "# TYPE "):
+			fields := strings.Fields(line)
+			if len(fields) == 4 {
+				switch fields[3] {
+				case "counter", "gauge", "histogram", "summary":
+				default:
+					line = strings.Join(append(fields[:3], "untyped"), " ")
+				}
+			}
+		case strings.HasPrefix(line, "#") || line == "":
+		default:
+			var err error
+			if line, err = openMetricsSampleToText(line); err != nil {
+				return nil, err
+			}
+		}
+		buf.WriteString(line)
+		buf.WriteByte('\n')
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return &buf, nil
+}
+
+// openMetricsSampleToText rewrites a sample line of OpenMetrics for the text
+// exposition format.
+func openMetricsSampleToText(line string) (string, error) {
+	end, err := seriesEnd(line)
+	if err != nil {
+		return "", err
+	}
+	series, rest := line[:end], line[end:]
+	if i := strings.Index(rest, "#"); i >= 0 {
+		rest = rest[:i]
+	}
+	fields := strings.Fields(rest)
+	switch len(fields) {
+	case 1:
+		return series + " " + fields[0], nil
+	case 2:
+		seconds, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			return "", fmt.Errorf("invalid timestamp in %q: %v", line, err)
+		}
+		return series + " " + fields[0] + " " + strconv.FormatInt(int64(math.Floor(seconds*1000)), 10), nil
+	default:
+		return "", fmt.Errorf("invalid sample %q", line)
+	}
+}
+
+// seriesEnd returns the index of the end of the metric name and label set of a
+// sample line, whose quoted label values can hold spaces and hashes.
+func seriesEnd(line string) (int, error) {
+	end := strings.IndexAny(line, "{ ")
+	if end < 0 {
+		return 0, fmt.Errorf("sample %q has no value", line)
+	}
+	if line[end] == ' ' {
+		return end, nil
+	}
+	inQuotes := false
+	for end++; end < len(line); end++ {
+		switch c := line[end]; {
+		case c == '\\' && inQuotes:
+			end++
+		case c == '"':
+			inQuotes = !inQuotes
+		case c == '}' && !inQuotes:
+			return end + 1, nil
+		}
+	}
+	return 0, fmt.Errorf("unterminated label set in %q", line)
+}
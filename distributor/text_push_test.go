@@ -0,0 +1,96 @@
+package distributor
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/weaveworks/common/user"
+)
+
+func TestParseGroupingKey(t *testing.T) {
+	for _, tc := range []struct {
+		path     string
+		expected model.LabelSet
+	}{
+		{"/metrics/job/foo", model.LabelSet{"job": "foo"}},
+		{"/metrics/job/foo/instance/bar", model.LabelSet{"job": "foo", "instance": "bar"}},
+		{"/metrics/job/foo/path@base64/L3Zhci90bXA", model.LabelSet{"job": "foo", "path": "/var/tmp"}},
+		{"/metrics/job/foo/path@base64/L3Zhci90bXA=", model.LabelSet{"job": "foo", "path": "/var/tmp"}},
+		{"/metrics", nil},
+		{"/metrics/job/", nil},
+		{"/metrics/job/foo/instance", nil},
+		{"/metrics/job/foo/__name__/bar", nil},
+		{"/metrics/instance/foo", nil},
+	} {
+		labels, err := parseGroupingKey(tc.path)
+		if tc.expected == nil {
+			assert.Error(t, err, tc.path)
+			continue
+		}
+		require.NoError(t, err, tc.path)
+		assert.Equal(t, tc.expected, labels, tc.path)
+	}
+}
+
+func TestParseTextPush(t *testing.T) {
+	now := model.Time(5000)
+	for _, tc := range []struct {
+		contentType, body string
+		expected          model.Vector
+	}{
+		{
+			contentType: "text/plain; version=0.0.4",
+			body:        "# TYPE foo counter\nfoo{i=\"1\"} 1\nfoo{i=\"2\"} 2 1000\n",
+			expected: model.Vector{
+				{Metric: model.Metric{"__name__": "foo", "i": "1"}, Value: 1, Timestamp: now},
+				{Metric: model.Metric{"__name__": "foo", "i": "2"}, Value: 2, Timestamp: 1000},
+			},
+		},
+		{
+			contentType: "application/openmetrics-text; version=1.0.0",
+			body: "# TYPE foo info\n# UNIT bar seconds\nfoo{i=\"a # {b}\"} 1 1.5 # {trace_id=\"x\"} 1\n" +
+				"bar_total 3 # {trace_id=\"y\"} 1 2\n# EOF\n",
+			expected: model.Vector{
+				{Metric: model.Metric{"__name__": "foo", "i": "a # {b}"}, Value: 1, Timestamp: 1500},
+				{Metric: model.Metric{"__name__": "bar_total"}, Value: 3, Timestamp: now},
+			},
+		},
+	} {
+		r := httptest.NewRequest("POST", "/metrics/job/foo", strings.NewReader(tc.body))
+		r.Header.Set("Content-Type", tc.contentType)
+		samples, err := parseTextPush(r, now)
+		require.NoError(t, err, tc.contentType)
+		// Metric families are decoded in no particular order.
+		sort.Sort(samples)
+		sort.Sort(tc.expected)
+		assert.Equal(t, tc.expected, samples, tc.contentType)
+	}
+}
+
+func TestDistributorTextPushHandler(t *testing.T) {
+	d := newTestDistributor(t, Config{
+		IngestionRateLimit: 10000,
+		IngestionBurstSize: 10000,
+	})
+	defer d.Stop()
+
+	push := func(method, path, body string) int {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req = req.WithContext(user.Inject(req.Context(), "user"))
+		recorder := httptest.NewRecorder()
+		d.TextPushHandler(recorder, req)
+		return recorder.Code
+	}
+	assert.Equal(t, http.StatusAccepted, push("PUT", "/metrics/job/batch/instance/a", "foo 1\nbar{job=\"other\"} 2\n"))
+	assert.Equal(t, 2.0, counterValue(t, d.receivedSamples))
+	assert.Equal(t, http.StatusBadRequest, push("POST", "/metrics/job/batch", "foo{ 1\n"))
+	assert.Equal(t, http.StatusBadRequest, push("POST", "/metrics", "foo 1\n"))
+	assert.Equal(t, http.StatusMethodNotAllowed, push("DELETE", "/metrics/job/batch", ""))
+}
@@ -0,0 +1,53 @@
+package distributor
+
+import (
+	"fmt"
+	"hash/fnv"
+
+	"github.com/pierrec/xxHash/xxHash32"
+)
+
+// Names of the hash functions which can be used to pick the token for a
+// series, and so which ingesters it goes to.
+const (
+	tokenHashFNV32  = "fnv32"
+	tokenHashFNV32a = "fnv32a"
+	tokenHashXXHash = "xxhash"
+)
+
+// tokenHasher returns the token for a user's metric.
+type tokenHasher func(userID string, name []byte) uint32
+
+func newTokenHasher(name string) (tokenHasher, error) {
+	switch name {
+	case tokenHashFNV32:
+		return tokenFor, nil
+	case tokenHashFNV32a:
+		return tokenForFNV32a, nil
+	case tokenHashXXHash:
+		return tokenForXXHash, nil
+	default:
+		return nil, fmt.Errorf("unknown token hash %q, must be one of %s, %s or %s", name, tokenHashFNV32, tokenHashFNV32a, tokenHashXXHash)
+	}
+}
+
+func tokenFor(userID string, name []byte) uint32 {
+	h := fnv.New32()
+	h.Write([]byte(userID))
+	h.Write(name)
+	return h.Sum32()
+}
+
+func tokenForFNV32a(userID string, name []byte) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(userID))
+	h.Write(name)
+	return h.Sum32()
+}
+
+func tokenForXXHash(userID string, name []byte) uint32 {
+	h := xxHash32.New(0)
+	h.Write([]byte(userID))
+	h.Write(name)
+	return h.Sum32()
+}
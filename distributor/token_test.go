@@ -0,0 +1,112 @@
+package distributor
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex"
+	"github.com/weaveworks/cortex/ring"
+)
+
+func TestTokenHashers(t *testing.T) {
+	tokens := map[uint32]string{}
+	for _, name := range []string{tokenHashFNV32, tokenHashFNV32a, tokenHashXXHash} {
+		hasher, err := newTokenHasher(name)
+		require.NoError(t, err)
+		token := hasher("user", []byte("foo"))
+		assert.Equal(t, token, hasher("user", []byte("foo")), name)
+		assert.NotEqual(t, token, hasher("user", []byte("bar")), name)
+		assert.NotContains(t, tokens, token, name)
+		tokens[token] = name
+	}
+
+	_, err := newTokenHasher("md5")
+	assert.Error(t, err)
+}
+
+// tokenRing returns the first n ingesters for the given token, and the next n
+// for any other.
+type tokenRing struct {
+	mockRing
+	token uint32
+}
+
+func (r tokenRing) GetInPool(pool string, key uint32, n int, op ring.Operation) ([]*ring.IngesterDesc, error) {
+	if key == r.token {
+		return r.ingesters[:n], nil
+	}
+	return r.ingesters[n : 2*n], nil
+}
+
+func TestDistributorQueryMigratingTokenHash(t *testing.T) {
+	ctx := user.Inject(context.Background(), "user")
+	matcher, err := metric.NewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo")
+	require.NoError(t, err)
+
+	for i, tc := range []struct {
+		migrateFrom   string
+		oldHappy      bool
+		expectedError bool
+	}{
+		// Without migrating, the old ingesters aren't queried.
+		{oldHappy: false},
+		// While migrating they are, so must be available...
+		{migrateFrom: tokenHashFNV32, oldHappy: false, expectedError: true},
+		// ...and their results are merged with the new ingesters'.
+		{migrateFrom: tokenHashFNV32, oldHappy: true},
+	} {
+		t.Run(fmt.Sprintf("[%d]", i), func(t *testing.T) {
+			ingesterDescs := []*ring.IngesterDesc{}
+			ingesters := map[string]mockIngester{}
+			for j := 0; j < 6; j++ {
+				addr := fmt.Sprintf("%d", j)
+				ingesterDescs = append(ingesterDescs, &ring.IngesterDesc{
+					Addr:      addr,
+					Timestamp: time.Now().Unix(),
+				})
+				ingesters[addr] = mockIngester{happy: j < 3 || tc.oldHappy}
+			}
+
+			d, err := New(Config{
+				ReplicationFactor:    3,
+				HeartbeatTimeout:     1 * time.Minute,
+				RemoteTimeout:        1 * time.Minute,
+				ClientCleanupPeriod:  1 * time.Minute,
+				TokenHash:            tokenHashXXHash,
+				MigrateFromTokenHash: tc.migrateFrom,
+
+				ingesterClientFactory: func(addr string) cortex.IngesterClient {
+					return ingesters[addr]
+				},
+			}, tokenRing{
+				mockRing: mockRing{
+					Counter: prometheus.NewCounter(prometheus.CounterOpts{
+						Name: "foo",
+					}),
+					ingesters: ingesterDescs,
+				},
+				token: tokenForXXHash("user", []byte("foo")),
+			})
+			require.NoError(t, err)
+			defer d.Stop()
+
+			response, err := d.Query(ctx, 0, 10, matcher)
+			if tc.expectedError {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Len(t, response, 1)
+			assert.Equal(t, []model.SamplePair{{Timestamp: 0, Value: 0}, {Timestamp: 1, Value: 1}}, response[0].Values)
+		})
+	}
+}
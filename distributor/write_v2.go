@@ -0,0 +1,122 @@
+package distributor
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+
+	"github.com/weaveworks/cortex"
+	"github.com/weaveworks/cortex/util/wire"
+)
+
+// The media type of remote write requests, and the protobuf messages its
+// proto parameter names for each version of the protocol.
+const (
+	remoteWriteContentType = "application/x-protobuf"
+	remoteWriteV1Proto     = "prometheus.WriteRequest"
+	remoteWriteV2Proto     = "io.prometheus.write.v2.Request"
+)
+
+// The headers of responses to remote write 2.0 requests, telling the sender
+// how much of the request was written.
+const (
+	samplesWrittenHeader    = "X-Prometheus-Remote-Write-Samples-Written"
+	histogramsWrittenHeader = "X-Prometheus-Remote-Write-Histograms-Written"
+	exemplarsWrittenHeader  = "X-Prometheus-Remote-Write-Exemplars-Written"
+)
+
+// errUnsupportedMediaType is returned for remote write requests in formats we
+// don't accept, which senders can retry with another version of the protocol.
+type errUnsupportedMediaType string
+
+func (e errUnsupportedMediaType) Error() string {
+	return string(e)
+}
+
+// remoteWriteProto returns the protobuf message a remote write request's body
+// is, from its headers. Older senders don't set a Content-Type, or set others,
+// so anything but a protobuf naming another message is a 1.0 request.
+func remoteWriteProto(r *http.Request) (string, error) {
+	if encoding := r.Header.Get("Content-Encoding"); encoding != "" && encoding != "snappy" {
+		return "", errUnsupportedMediaType(fmt.Sprintf("unsupported content encoding %q", encoding))
+	}
+
+	mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != remoteWriteContentType {
+		return remoteWriteV1Proto, nil
+	}
+	switch proto := params["proto"]; proto {
+	case "", remoteWriteV1Proto:
+		return remoteWriteV1Proto, nil
+	case remoteWriteV2Proto:
+		return remoteWriteV2Proto, nil
+	default:
+		return "", errUnsupportedMediaType(fmt.Sprintf("unsupported remote write protobuf message %q", proto))
+	}
+}
+
+// writeV2ToWriteRequest converts a remote write 2.0 request to a WriteRequest,
+// whose labels share the bytes of its symbols. Exemplars and metadata are
+// dropped, as the ingesters don't store them. If ingestCreated is set, the
+// created timestamps of series are ingested as zero samples, so the increase
+// of counters from their creation to their first sample isn't lost.
+func writeV2ToWriteRequest(req *cortex.WriteV2Request, ingestCreated bool) (*cortex.WriteRequest, error) {
+	symbol := func(ref uint32) (wire.Bytes, error) {
+		if int(ref) >= len(req.Symbols) {
+			return nil, fmt.Errorf("symbol reference %d out of range of %d symbols", ref, len(req.Symbols))
+		}
+		return req.Symbols[ref], nil
+	}
+
+	result := &cortex.WriteRequest{
+		Timeseries: make([]cortex.TimeSeries, 0, len(req.Timeseries)),
+	}
+	for _, ts := range req.Timeseries {
+		if len(ts.LabelsRefs)%2 != 0 {
+			return nil, fmt.Errorf("odd number of label references: %d", len(ts.LabelsRefs))
+		}
+		labels := make([]cortex.LabelPair, 0, len(ts.LabelsRefs)/2)
+		for i := 0; i < len(ts.LabelsRefs); i += 2 {
+			name, err := symbol(ts.LabelsRefs[i])
+			if err != nil {
+				return nil, err
+			}
+			value, err := symbol(ts.LabelsRefs[i+1])
+			if err != nil {
+				return nil, err
+			}
+			labels = append(labels, cortex.LabelPair{Name: name, Value: value})
+		}
+
+		samples := ts.Samples
+		if ingestCreated && ts.CreatedTimestamp != 0 && len(samples) > 0 && ts.CreatedTimestamp < samples[0].TimestampMs {
+			samples = append([]cortex.Sample{{TimestampMs: ts.CreatedTimestamp}}, samples...)
+		}
+		result.Timeseries = append(result.Timeseries, cortex.TimeSeries{
+			Labels:     labels,
+			Samples:    samples,
+			Histograms: ts.Histograms,
+		})
+	}
+	return result, nil
+}
+
+// writtenHeaders returns the headers reporting how much of a remote write 2.0
+// request is written if it is pushed successfully. They must be counted
+// before the request is pushed, which may convert or drop its histograms.
+func (d *Distributor) writtenHeaders(req *cortex.WriteRequest) http.Header {
+	var samples, histograms int
+	for _, ts := range req.Timeseries {
+		samples += len(ts.Samples)
+		histograms += len(ts.Histograms)
+	}
+	if d.cfg.NativeHistograms == dropNativeHistograms {
+		histograms = 0
+	}
+	return http.Header{
+		samplesWrittenHeader:    {strconv.Itoa(samples)},
+		histogramsWrittenHeader: {strconv.Itoa(histograms)},
+		exemplarsWrittenHeader:  {"0"},
+	}
+}
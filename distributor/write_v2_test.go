@@ -0,0 +1,124 @@
+package distributor
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex"
+	"github.com/weaveworks/cortex/util/wire"
+)
+
+func TestRemoteWriteProto(t *testing.T) {
+	for _, tc := range []struct {
+		contentType, encoding string
+		proto                 string
+		unsupported           bool
+	}{
+		{proto: remoteWriteV1Proto},
+		{contentType: "application/octet-stream", proto: remoteWriteV1Proto},
+		{contentType: "application/x-protobuf", proto: remoteWriteV1Proto},
+		{contentType: "application/x-protobuf;proto=prometheus.WriteRequest", encoding: "snappy", proto: remoteWriteV1Proto},
+		{contentType: "application/x-protobuf;proto=io.prometheus.write.v2.Request", encoding: "snappy", proto: remoteWriteV2Proto},
+		{contentType: "application/x-protobuf;proto=io.prometheus.write.v3.Request", unsupported: true},
+		{contentType: "application/x-protobuf", encoding: "zstd", unsupported: true},
+	} {
+		r := httptest.NewRequest("POST", "/api/prom/push", nil)
+		r.Header.Set("Content-Type", tc.contentType)
+		r.Header.Set("Content-Encoding", tc.encoding)
+		protoName, err := remoteWriteProto(r)
+		if tc.unsupported {
+			assert.IsType(t, errUnsupportedMediaType(""), err, tc.contentType)
+			continue
+		}
+		require.NoError(t, err, tc.contentType)
+		assert.Equal(t, tc.proto, protoName, tc.contentType)
+	}
+}
+
+func TestWriteV2ToWriteRequest(t *testing.T) {
+	v2 := &cortex.WriteV2Request{
+		Symbols: []wire.Bytes{[]byte(""), []byte("__name__"), []byte("foo_total"), []byte("job"), []byte("bar"), []byte("A counter.")},
+		Timeseries: []cortex.WriteV2TimeSeries{{
+			LabelsRefs:       []uint32{1, 2, 3, 4},
+			Samples:          []cortex.Sample{{TimestampMs: 2000, Value: 5}},
+			Exemplars:        []cortex.WriteV2Exemplar{{LabelsRefs: []uint32{3, 4}, Value: 1, Timestamp: 2000}},
+			Metadata:         cortex.WriteV2Metadata{Type: cortex.METRIC_TYPE_COUNTER, HelpRef: 5},
+			CreatedTimestamp: 1000,
+		}},
+	}
+	labels := []cortex.LabelPair{
+		{Name: []byte("__name__"), Value: []byte("foo_total")},
+		{Name: []byte("job"), Value: []byte("bar")},
+	}
+
+	req, err := writeV2ToWriteRequest(v2, false)
+	require.NoError(t, err)
+	assert.Equal(t, []cortex.TimeSeries{{
+		Labels:  labels,
+		Samples: []cortex.Sample{{TimestampMs: 2000, Value: 5}},
+	}}, req.Timeseries)
+
+	// The created timestamp is a zero sample before the first.
+	req, err = writeV2ToWriteRequest(v2, true)
+	require.NoError(t, err)
+	assert.Equal(t, []cortex.TimeSeries{{
+		Labels:  labels,
+		Samples: []cortex.Sample{{TimestampMs: 1000}, {TimestampMs: 2000, Value: 5}},
+	}}, req.Timeseries)
+
+	for _, refs := range [][]uint32{{1, 2, 3}, {1, 6}} {
+		v2.Timeseries[0].LabelsRefs = refs
+		_, err := writeV2ToWriteRequest(v2, false)
+		assert.Error(t, err, "%v", refs)
+	}
+}
+
+func TestDistributorPushHandlerWriteV2(t *testing.T) {
+	d := newTestDistributor(t, Config{
+		IngestionRateLimit: 10000,
+		IngestionBurstSize: 10000,
+	})
+	defer d.Stop()
+
+	data, err := proto.Marshal(&cortex.WriteV2Request{
+		Symbols: []wire.Bytes{[]byte(""), []byte("__name__"), []byte("foo"), []byte("i"), []byte("1"), []byte("2")},
+		Timeseries: []cortex.WriteV2TimeSeries{
+			{LabelsRefs: []uint32{1, 2, 3, 4}, Samples: []cortex.Sample{{TimestampMs: 1000, Value: 1}, {TimestampMs: 2000, Value: 2}}},
+			{LabelsRefs: []uint32{1, 2, 3, 5}, Samples: []cortex.Sample{{TimestampMs: 1000, Value: 1}}},
+		},
+	})
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	writer := snappy.NewWriter(&buf)
+	_, err = writer.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+
+	req := httptest.NewRequest("POST", "/api/prom/push", &buf)
+	req.Header.Set("Content-Type", "application/x-protobuf;proto=io.prometheus.write.v2.Request")
+	req.Header.Set("Content-Encoding", "snappy")
+	req = req.WithContext(user.Inject(req.Context(), "user"))
+	recorder := httptest.NewRecorder()
+	d.PushHandler(recorder, req)
+
+	assert.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+	assert.Equal(t, "3", recorder.Header().Get(samplesWrittenHeader))
+	assert.Equal(t, "0", recorder.Header().Get(histogramsWrittenHeader))
+	assert.Equal(t, "0", recorder.Header().Get(exemplarsWrittenHeader))
+
+	// Unknown protobuf messages are refused, for the sender to fall back to
+	// another.
+	req = httptest.NewRequest("POST", "/api/prom/push", nil)
+	req.Header.Set("Content-Type", "application/x-protobuf;proto=io.prometheus.write.v3.Request")
+	recorder = httptest.NewRecorder()
+	d.PushHandler(recorder, req)
+	assert.Equal(t, http.StatusUnsupportedMediaType, recorder.Code)
+}
@@ -0,0 +1,33 @@
+package distributor
+
+import (
+	"github.com/weaveworks/cortex/ring"
+)
+
+// quorumGroup returns the group of ingesters whose results quorums count
+// together: with zone-awareness its zone, as the ring replicates each series
+// to one ingester per zone, and otherwise just the ingester.
+func (d *Distributor) quorumGroup(ingester *ring.IngesterDesc) string {
+	if d.ring.ZoneAwarenessEnabled() {
+		return ingester.Zone
+	}
+	return ingester.Addr
+}
+
+// quorumGroups splits the ingesters into their quorum groups, in the order
+// they are first seen. A zone-aware ring's replicas have more than one
+// ingester in a zone when one of them is leaving.
+func (d *Distributor) quorumGroups(ingesters []*ring.IngesterDesc) [][]*ring.IngesterDesc {
+	groups := make([][]*ring.IngesterDesc, 0, len(ingesters))
+	index := make(map[string]int, len(ingesters))
+	for _, ingester := range ingesters {
+		group := d.quorumGroup(ingester)
+		if i, ok := index[group]; ok {
+			groups[i] = append(groups[i], ingester)
+			continue
+		}
+		index[group] = len(groups)
+		groups = append(groups, []*ring.IngesterDesc{ingester})
+	}
+	return groups
+}
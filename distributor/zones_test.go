@@ -0,0 +1,78 @@
+package distributor
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex"
+	"github.com/weaveworks/cortex/ring"
+)
+
+func TestDistributorQueryZoneQuorum(t *testing.T) {
+	ctx := user.Inject(context.Background(), "user")
+
+	// Zone a has a leaving ingester and the one replacing it.
+	zones := []string{"a", "a", "b", "c"}
+	for i, tc := range []struct {
+		ingesters []mockIngester
+		zoneAware bool
+		err       bool
+	}{
+		// Losing a whole zone is tolerated.
+		{ingesters: []mockIngester{{}, {}, {true}, {true}}, zoneAware: true},
+		{ingesters: []mockIngester{{true}, {true}, {}, {true}}, zoneAware: true},
+		// Without zone-awareness, that's half the ingesters.
+		{ingesters: []mockIngester{{}, {}, {true}, {true}}, err: true},
+		// A zone fails with any of its ingesters.
+		{ingesters: []mockIngester{{true}, {}, {true}, {}}, zoneAware: true, err: true},
+	} {
+		t.Run(fmt.Sprintf("[%d]", i), func(t *testing.T) {
+			ingesterDescs := []*ring.IngesterDesc{}
+			ingesters := map[string]mockIngester{}
+			for i, ingester := range tc.ingesters {
+				addr := fmt.Sprintf("%d", i)
+				ingesterDescs = append(ingesterDescs, &ring.IngesterDesc{
+					Addr:      addr,
+					Timestamp: time.Now().Unix(),
+					Zone:      zones[i],
+				})
+				ingesters[addr] = ingester
+			}
+
+			d, err := New(Config{
+				ReplicationFactor:   3,
+				HeartbeatTimeout:    1 * time.Minute,
+				RemoteTimeout:       1 * time.Minute,
+				ClientCleanupPeriod: 1 * time.Minute,
+
+				ingesterClientFactory: func(addr string) cortex.IngesterClient {
+					return ingesters[addr]
+				},
+			}, mockRing{
+				Counter:   prometheus.NewCounter(prometheus.CounterOpts{Name: "foo"}),
+				ingesters: ingesterDescs,
+				zoneAware: tc.zoneAware,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer d.Stop()
+
+			resps, err := d.queryIngesters(ctx, ingesterDescs, &cortex.QueryRequest{})
+			if tc.err {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			matrix, err := mergeResponses(resps)
+			assert.NoError(t, err)
+			assert.Len(t, matrix, 1)
+		})
+	}
+}
@@ -0,0 +1,230 @@
+package gateway
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+	"gopkg.in/yaml.v2"
+
+	"github.com/weaveworks/cortex/configs"
+	"github.com/weaveworks/cortex/util"
+)
+
+// The scopes tokens can be limited to; tokens without one can do both.
+const (
+	ScopeWrite = "write"
+	ScopeRead  = "read"
+)
+
+const orgIDHeaderName = "X-Scope-OrgID"
+
+var authFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "cortex",
+	Name:      "gateway_auth_failures_total",
+	Help:      "The total number of requests the gateway refused, by reason.",
+}, []string{"reason"})
+
+func init() {
+	prometheus.MustRegister(authFailures)
+}
+
+// Config configures the Gateway.
+type Config struct {
+	TokensFile     string
+	ConfigsAPIURL  util.URLValue
+	PollInterval   time.Duration
+	ClientTimeout  time.Duration
+	DistributorURL util.URLValue
+	QuerierURL     util.URLValue
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet
+func (cfg *Config) RegisterFlags(f *flag.FlagSet) {
+	f.StringVar(&cfg.TokensFile, "gateway.tokens-file", "", "YAML file mapping tenants to their API tokens, reloaded every poll interval.")
+	f.Var(&cfg.ConfigsAPIURL, "gateway.configs.url", "URL of configs API server, whose configs' api_tokens are also accepted.")
+	f.DurationVar(&cfg.PollInterval, "gateway.poll-interval", 15*time.Second, "How frequently to reload the tokens file and poll the configs API.")
+	f.DurationVar(&cfg.ClientTimeout, "gateway.configs.client-timeout", 5*time.Second, "Timeout for requests to the configs API.")
+	f.Var(&cfg.DistributorURL, "gateway.distributor.url", "URL of the distributors, which pushes are sent to.")
+	f.Var(&cfg.QuerierURL, "gateway.querier.url", "URL of the queriers, which all other requests are sent to.")
+}
+
+// tokensFile is the format of the tokens file.
+type tokensFile struct {
+	Tenants map[string][]configs.APIToken `yaml:"tenants"`
+}
+
+type tenantToken struct {
+	tenant string
+	configs.APIToken
+}
+
+// Gateway authenticates requests with per-tenant bearer tokens, from a file
+// or the configs API, and proxies them to the distributors or queriers with
+// the tenant's X-Scope-OrgID header, so those needn't be exposed. Tenants can
+// have several tokens at once, for rotating them without downtime.
+type Gateway struct {
+	cfg         Config
+	configsAPI  *configs.API
+	distributor http.Handler
+	querier     http.Handler
+	quit, done  chan struct{}
+
+	// Only used by the loop.
+	fileTokens   map[string][]configs.APIToken
+	configTokens map[string][]configs.APIToken
+	latestConfig configs.ConfigID
+
+	mtx    sync.RWMutex
+	tokens map[string]tenantToken
+}
+
+// New makes a new Gateway, loading the tokens before returning.
+func New(cfg Config) (*Gateway, error) {
+	if cfg.DistributorURL.URL == nil || cfg.QuerierURL.URL == nil {
+		return nil, fmt.Errorf("the gateway needs both a distributor and a querier URL")
+	}
+	g := &Gateway{
+		cfg:          cfg,
+		distributor:  httputil.NewSingleHostReverseProxy(cfg.DistributorURL.URL),
+		querier:      httputil.NewSingleHostReverseProxy(cfg.QuerierURL.URL),
+		quit:         make(chan struct{}),
+		done:         make(chan struct{}),
+		configTokens: map[string][]configs.APIToken{},
+		tokens:       map[string]tenantToken{},
+	}
+	if cfg.ConfigsAPIURL.URL != nil {
+		g.configsAPI = &configs.API{
+			URL:     cfg.ConfigsAPIURL.URL,
+			Timeout: cfg.ClientTimeout,
+		}
+	}
+	if err := g.reload(); err != nil {
+		return nil, err
+	}
+	go g.loop()
+	return g, nil
+}
+
+// Stop the Gateway reloading tokens.
+func (g *Gateway) Stop() {
+	close(g.quit)
+	<-g.done
+}
+
+func (g *Gateway) loop() {
+	defer close(g.done)
+	ticker := time.NewTicker(g.cfg.PollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			// Keep the tokens we have if either source fails.
+			if err := g.reload(); err != nil {
+				log.Warnf("Gateway: error reloading tokens: %v", err)
+			}
+		case <-g.quit:
+			return
+		}
+	}
+}
+
+// reload reads the tokens file and any configs changed since the last poll,
+// and indexes the tokens by their hash.
+func (g *Gateway) reload() error {
+	if g.cfg.TokensFile != "" {
+		buf, err := ioutil.ReadFile(g.cfg.TokensFile)
+		if err != nil {
+			return err
+		}
+		var file tokensFile
+		if err := yaml.Unmarshal(buf, &file); err != nil {
+			return fmt.Errorf("error parsing %s: %v", g.cfg.TokensFile, err)
+		}
+		g.fileTokens = file.Tenants
+	}
+	if g.configsAPI != nil {
+		cfgs, err := g.configsAPI.GetOrgConfigs(g.latestConfig)
+		if err != nil {
+			return err
+		}
+		for tenant, view := range cfgs.Configs {
+			g.configTokens[tenant] = view.Config.APITokens
+		}
+		if latest := cfgs.GetLatestConfigID(); latest > g.latestConfig {
+			g.latestConfig = latest
+		}
+	}
+
+	tokens := map[string]tenantToken{}
+	for _, source := range []map[string][]configs.APIToken{g.fileTokens, g.configTokens} {
+		for tenant, tenantTokens := range source {
+			for _, token := range tenantTokens {
+				if token.Scope != "" && token.Scope != ScopeWrite && token.Scope != ScopeRead {
+					log.Warnf("Gateway: ignoring token of tenant %s with unknown scope %q", tenant, token.Scope)
+					continue
+				}
+				tokens[strings.ToLower(token.SHA256)] = tenantToken{tenant: tenant, APIToken: token}
+			}
+		}
+	}
+	g.mtx.Lock()
+	g.tokens = tokens
+	g.mtx.Unlock()
+	return nil
+}
+
+// ServeHTTP implements http.Handler.
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	const prefix = "Bearer "
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, prefix) {
+		authFailures.WithLabelValues("no_token").Inc()
+		http.Error(w, "no bearer token", http.StatusUnauthorized)
+		return
+	}
+	hash := sha256.Sum256([]byte(strings.TrimPrefix(auth, prefix)))
+
+	g.mtx.RLock()
+	token, ok := g.tokens[hex.EncodeToString(hash[:])]
+	g.mtx.RUnlock()
+	if !ok {
+		authFailures.WithLabelValues("unknown_token").Inc()
+		http.Error(w, "unknown token", http.StatusUnauthorized)
+		return
+	}
+	if !token.Expires.IsZero() && time.Now().After(token.Expires) {
+		authFailures.WithLabelValues("expired_token").Inc()
+		http.Error(w, "expired token", http.StatusUnauthorized)
+		return
+	}
+
+	write := isWrite(r)
+	if (write && token.Scope == ScopeRead) || (!write && token.Scope == ScopeWrite) {
+		authFailures.WithLabelValues("scope").Inc()
+		http.Error(w, fmt.Sprintf("token is %s-only", token.Scope), http.StatusForbidden)
+		return
+	}
+
+	r.Header.Del("Authorization")
+	r.Header.Set(orgIDHeaderName, token.tenant)
+	if write {
+		g.distributor.ServeHTTP(w, r)
+	} else {
+		g.querier.ServeHTTP(w, r)
+	}
+}
+
+// isWrite is true for the distributors' push endpoints.
+func isWrite(r *http.Request) bool {
+	return r.URL.Path == "/api/prom/push" || strings.HasPrefix(r.URL.Path, "/api/prom/pushgateway/")
+}
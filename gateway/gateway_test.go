@@ -0,0 +1,111 @@
+package gateway
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/weaveworks/cortex/util"
+)
+
+func hashToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+func upstream(t *testing.T, name string) (*httptest.Server, util.URLValue) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "" {
+			t.Errorf("%s got the token", name)
+		}
+		fmt.Fprintf(w, "%s %s", name, r.Header.Get(orgIDHeaderName))
+	}))
+	u, err := url.Parse(s.URL)
+	require.NoError(t, err)
+	return s, util.URLValue{URL: u}
+}
+
+func TestGateway(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gateway")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	tokensFile := filepath.Join(dir, "tokens.yaml")
+	writeTokens := func(tokens string) {
+		require.NoError(t, ioutil.WriteFile(tokensFile, []byte(tokens), 0644))
+	}
+	writeTokens(fmt.Sprintf(`tenants:
+  tenant-1:
+  - sha256: %s
+  - sha256: %s
+    scope: write
+  - sha256: %s
+    scope: read
+  - sha256: %s
+    expires: 2017-01-01T00:00:00Z
+`, hashToken("all"), hashToken("writer"), hashToken("reader"), hashToken("expired")))
+
+	distributor, distributorURL := upstream(t, "distributor")
+	defer distributor.Close()
+	querier, querierURL := upstream(t, "querier")
+	defer querier.Close()
+
+	g, err := New(Config{
+		TokensFile:     tokensFile,
+		PollInterval:   time.Hour,
+		DistributorURL: distributorURL,
+		QuerierURL:     querierURL,
+	})
+	require.NoError(t, err)
+	defer g.Stop()
+
+	request := func(token, path string) (int, string) {
+		r := httptest.NewRequest("POST", path, nil)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		r.Header.Set(orgIDHeaderName, "spoofed")
+		w := httptest.NewRecorder()
+		g.ServeHTTP(w, r)
+		return w.Code, w.Body.String()
+	}
+	for _, tc := range []struct {
+		token, path string
+		code        int
+		body        string
+	}{
+		{"all", "/api/prom/push", http.StatusOK, "distributor tenant-1"},
+		{"all", "/api/prom/api/v1/query", http.StatusOK, "querier tenant-1"},
+		{"writer", "/api/prom/pushgateway/metrics/job/foo", http.StatusOK, "distributor tenant-1"},
+		{"writer", "/api/prom/api/v1/query", http.StatusForbidden, ""},
+		{"reader", "/api/prom/api/v1/query", http.StatusOK, "querier tenant-1"},
+		{"reader", "/api/prom/push", http.StatusForbidden, ""},
+		{"expired", "/api/prom/push", http.StatusUnauthorized, ""},
+		{"unknown", "/api/prom/push", http.StatusUnauthorized, ""},
+		{"", "/api/prom/push", http.StatusUnauthorized, ""},
+	} {
+		code, body := request(tc.token, tc.path)
+		assert.Equal(t, tc.code, code, "%s %s", tc.token, tc.path)
+		if tc.body != "" {
+			assert.Equal(t, tc.body, body, "%s %s", tc.token, tc.path)
+		}
+	}
+
+	// Rotating the token takes effect on reload.
+	writeTokens(fmt.Sprintf("tenants:\n  tenant-1:\n  - sha256: %s\n", hashToken("rotated")))
+	require.NoError(t, g.reload())
+	code, _ := request("all", "/api/prom/push")
+	assert.Equal(t, http.StatusUnauthorized, code)
+	code, _ = request("rotated", "/api/prom/push")
+	assert.Equal(t, http.StatusOK, code)
+}
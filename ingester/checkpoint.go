@@ -0,0 +1,234 @@
+package ingester
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/gob"
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/local/chunk"
+
+	"github.com/weaveworks/cortex/util"
+)
+
+const checkpointFilename = "checkpoint"
+
+var (
+	checkpointDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "cortex_ingester_checkpoint_duration_seconds",
+		Help:    "Time taken to write a checkpoint of the series in memory.",
+		Buckets: prometheus.ExponentialBuckets(0.1, 2, 12),
+	})
+	checkpointFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "cortex_ingester_checkpoint_failures_total",
+		Help: "The total number of checkpoints which failed to be written.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(checkpointDuration)
+	prometheus.MustRegister(checkpointFailures)
+}
+
+// CheckpointConfig configures periodically writing the series in memory to
+// local disk, to be recovered from after a crash.
+type CheckpointConfig struct {
+	Dir      string
+	Interval time.Duration
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet
+func (cfg *CheckpointConfig) RegisterFlags(f *flag.FlagSet) {
+	f.StringVar(&cfg.Dir, "ingester.checkpoint.dir", "", "Directory to checkpoint the series in memory to, and recover them from on startup. If empty, series are not checkpointed.")
+	f.DurationVar(&cfg.Interval, "ingester.checkpoint.interval", 5*time.Minute, "Period with which to checkpoint the series in memory.")
+}
+
+// checkpointSeries is the state of a series written to a checkpoint.
+type checkpointSeries struct {
+	UserID string
+	Metric model.Metric
+	Chunks []checkpointChunk
+
+	HeadChunkClosed    bool
+	OutOfOrder         []model.SamplePair
+	LastSampleValueSet bool
+	LastTime           model.Time
+	LastSampleValue    model.SampleValue
+}
+
+type checkpointChunk struct {
+	FirstTime model.Time
+	LastTime  model.Time
+	Encoding  chunk.Encoding
+	Data      []byte
+}
+
+// checkpoint writes all the series in memory, including their head chunks, to
+// a new checkpoint, replacing the previous one once complete. Samples appended
+// after a checkpoint are lost if the ingester crashes before the next; there's
+// no WAL to replay on top of it, so the interval bounds how much is lost.
+func (i *Ingester) checkpoint() error {
+	defer func(begin time.Time) {
+		checkpointDuration.Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	tmp := filepath.Join(i.cfg.CheckpointConfig.Dir, checkpointFilename+".tmp")
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	defer f.Close()
+
+	buf := bufio.NewWriter(f)
+	enc := gob.NewEncoder(buf)
+	numSeries := 0
+	for userID, state := range i.userStates.cp() {
+		for pair := range state.fpToSeries.iter() {
+			// The series iterators must be drained, so keep iterating on error.
+			if err != nil {
+				continue
+			}
+			state.fpLocker.Lock(pair.fp)
+			var cs *checkpointSeries
+			cs, err = newCheckpointSeries(userID, pair.series)
+			state.fpLocker.Unlock(pair.fp)
+			if err != nil {
+				continue
+			}
+			err = enc.Encode(cs)
+			numSeries++
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := buf.Flush(); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(i.cfg.CheckpointConfig.Dir, checkpointFilename)); err != nil {
+		return err
+	}
+	log.Infof("Checkpointed %d series", numSeries)
+	return nil
+}
+
+// newCheckpointSeries copies the state of a series, reading back any spilled
+// chunks. The caller must have locked the fingerprint of the series.
+func newCheckpointSeries(userID string, series *memorySeries) (*checkpointSeries, error) {
+	cs := &checkpointSeries{
+		UserID:             userID,
+		Metric:             series.metric,
+		Chunks:             make([]checkpointChunk, 0, len(series.chunkDescs)),
+		HeadChunkClosed:    series.headChunkClosed,
+		OutOfOrder:         append([]model.SamplePair(nil), series.outOfOrder...),
+		LastSampleValueSet: series.lastSampleValueSet,
+		LastTime:           series.lastTime,
+		LastSampleValue:    series.lastSampleValue,
+	}
+	for _, d := range series.chunkDescs {
+		c, err := d.chunk()
+		if err != nil {
+			return nil, err
+		}
+		var buf bytes.Buffer
+		if err := c.Marshal(&buf); err != nil {
+			return nil, err
+		}
+		cs.Chunks = append(cs.Chunks, checkpointChunk{
+			FirstTime: d.FirstTime,
+			LastTime:  d.LastTime,
+			Encoding:  c.Encoding(),
+			Data:      buf.Bytes(),
+		})
+	}
+	return cs, nil
+}
+
+// recoverCheckpoint restores the series in the last checkpoint, if there is
+// one. It must be called before the ingester starts accepting samples.
+func (i *Ingester) recoverCheckpoint() error {
+	f, err := os.Open(filepath.Join(i.cfg.CheckpointConfig.Dir, checkpointFilename))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	dec := gob.NewDecoder(bufio.NewReader(f))
+	numSeries := 0
+	for {
+		var cs checkpointSeries
+		if err := dec.Decode(&cs); err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		if err := i.recoverSeries(&cs); err != nil {
+			// The limits may have been lowered since the checkpoint.
+			if _, ok := err.(*util.LimitError); ok {
+				continue
+			}
+			return err
+		}
+		numSeries++
+	}
+	log.Infof("Recovered %d series from checkpoint", numSeries)
+	return nil
+}
+
+func (i *Ingester) recoverSeries(cs *checkpointSeries) error {
+	chunkDescs := make([]*desc, 0, len(cs.Chunks))
+	for _, cc := range cs.Chunks {
+		c, err := chunk.NewForEncoding(cc.Encoding)
+		if err != nil {
+			return err
+		}
+		if err := c.UnmarshalFromBuf(cc.Data); err != nil {
+			return err
+		}
+		chunkDescs = append(chunkDescs, newDesc(c, cc.FirstTime, cc.LastTime))
+	}
+
+	i.userStates.mtx.Lock()
+	state := i.userStates.unlockedGetOrCreate(cs.UserID)
+	fp, series, err := state.unlockedGet(cs.Metric, i.userStates.limiter)
+	i.userStates.mtx.Unlock()
+	if err != nil {
+		return err
+	}
+	defer state.fpLocker.Unlock(fp)
+
+	series.chunkDescs = chunkDescs
+	series.headChunkClosed = cs.HeadChunkClosed
+	series.outOfOrder = cs.OutOfOrder
+	series.lastSampleValueSet = cs.LastSampleValueSet
+	series.lastTime = cs.LastTime
+	series.lastSampleValue = cs.LastSampleValue
+	i.memoryChunks.Add(float64(len(chunkDescs)))
+	return nil
+}
+
+// removeCheckpoint deletes the checkpoint once all the series in memory have
+// been flushed, so they aren't recovered and flushed again.
+func (i *Ingester) removeCheckpoint() {
+	err := os.Remove(filepath.Join(i.cfg.CheckpointConfig.Dir, checkpointFilename))
+	if err != nil && !os.IsNotExist(err) {
+		log.Errorf("Error removing checkpoint: %v", err)
+	}
+}
@@ -0,0 +1,130 @@
+package ingester
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex/chunk"
+	"github.com/weaveworks/cortex/util"
+)
+
+func TestIngesterCheckpoint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpoint")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	cfg := Config{
+		FlushCheckPeriod: 99999 * time.Hour,
+		MaxChunkIdle:     99999 * time.Hour,
+		CheckpointConfig: CheckpointConfig{
+			Dir:      dir,
+			Interval: 99999 * time.Hour,
+		},
+	}
+	ing, err := New(cfg, nil, nil)
+	require.NoError(t, err)
+
+	ctx := user.Inject(context.Background(), "1")
+	testData := buildTestMatrix(10, 1000, 0)
+	_, err = ing.Push(ctx, util.ToWriteRequest(matrixToSamples(testData)))
+	require.NoError(t, err)
+	require.NoError(t, ing.checkpoint())
+
+	// Samples after the checkpoint are lost, as if the ingester crashed.
+	_, err = ing.Push(ctx, util.ToWriteRequest(matrixToSamples(buildTestMatrix(10, 10, 1000))))
+	require.NoError(t, err)
+	ing.Stop()
+
+	store := &testStore{
+		chunks: map[string][]chunk.Chunk{},
+	}
+	ing, err = New(cfg, store, nil)
+	require.NoError(t, err)
+
+	matcher, err := metric.NewLabelMatcher(metric.RegexMatch, model.JobLabel, ".+")
+	require.NoError(t, err)
+	req, err := util.ToQueryRequest(model.Earliest, model.Latest, []*metric.LabelMatcher{matcher})
+	require.NoError(t, err)
+	resp, err := ing.Query(ctx, req)
+	require.NoError(t, err)
+	res, err := util.FromQueryResponse(resp)
+	require.NoError(t, err)
+	sort.Sort(res)
+	assert.Equal(t, testData, res)
+
+	// The recovered head chunks can still be appended to.
+	more := buildTestMatrix(10, 10, 1000)
+	_, err = ing.Push(ctx, util.ToWriteRequest(matrixToSamples(more)))
+	require.NoError(t, err)
+
+	// Once everything is flushed on shutdown, the checkpoint is removed.
+	ing.Stop()
+	res, err = chunk.ChunksToMatrix(store.chunks["1"])
+	require.NoError(t, err)
+	sort.Sort(res)
+	for i := range testData {
+		assert.Equal(t, append(testData[i].Values, more[i].Values...), res[i].Values)
+	}
+	_, err = os.Stat(filepath.Join(dir, checkpointFilename))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestIngesterShutdownWithoutFlush(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpoint")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	cfg := Config{
+		FlushCheckPeriod: 99999 * time.Hour,
+		MaxChunkIdle:     99999 * time.Hour,
+		CheckpointConfig: CheckpointConfig{
+			Dir:      dir,
+			Interval: 99999 * time.Hour,
+		},
+	}
+	store := &testStore{
+		chunks: map[string][]chunk.Chunk{},
+	}
+	ing, err := New(cfg, store, nil)
+	require.NoError(t, err)
+
+	ctx := user.Inject(context.Background(), "1")
+	_, err = ing.Push(ctx, util.ToWriteRequest(matrixToSamples(buildTestMatrix(10, 100, 0))))
+	require.NoError(t, err)
+
+	stops := 0
+	handler := ing.ShutdownHandler(func() { stops++ })
+	for _, tc := range []struct {
+		method, url string
+		code        int
+	}{
+		{"GET", "/shutdown?flush=false", http.StatusMethodNotAllowed},
+		{"POST", "/shutdown?flush=maybe", http.StatusBadRequest},
+		{"POST", "/shutdown?flush=false", http.StatusNoContent},
+		{"POST", "/shutdown?flush=false", http.StatusNoContent},
+	} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(tc.method, tc.url, nil))
+		assert.Equal(t, tc.code, rec.Code, tc.url)
+	}
+	assert.Equal(t, 1, stops)
+
+	// Nothing is flushed, but the series are checkpointed for the restart.
+	ing.Stop()
+	assert.Empty(t, store.chunks)
+	_, err = os.Stat(filepath.Join(dir, checkpointFilename))
+	assert.NoError(t, err)
+}
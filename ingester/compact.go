@@ -0,0 +1,57 @@
+package ingester
+
+import (
+	"github.com/prometheus/prometheus/storage/local/chunk"
+)
+
+// compactChunks merges runs of adjacent chunks whose utilization is below
+// threshold, as long as the merged samples still fit in a single chunk. This
+// reduces the number of objects and index entries written for series which
+// produce lots of small chunks. A threshold <= 0 disables compaction.
+func compactChunks(descs []*desc, threshold float64) ([]*desc, error) {
+	if threshold <= 0 || len(descs) < 2 {
+		return descs, nil
+	}
+
+	result := make([]*desc, 0, len(descs))
+	for _, d := range descs {
+		if len(result) > 0 {
+			last := result[len(result)-1]
+			if last.C.Utilization() < threshold && d.C.Utilization() < threshold && last.LastTime < d.FirstTime {
+				merged, err := mergeChunks(last, d)
+				if err != nil {
+					return nil, err
+				}
+				if merged != nil {
+					result[len(result)-1] = merged
+					continue
+				}
+			}
+		}
+		result = append(result, d)
+	}
+	return result, nil
+}
+
+// mergeChunks returns a single chunk containing the samples of a and b (which
+// must be in order and non-overlapping), or nil if they don't fit in one chunk.
+func mergeChunks(a, b *desc) (*desc, error) {
+	c := chunk.New()
+	for _, d := range []*desc{a, b} {
+		it := d.C.NewIterator()
+		for it.Scan() {
+			cs, err := c.Add(it.Value())
+			if err != nil {
+				return nil, err
+			}
+			if len(cs) > 1 {
+				return nil, nil
+			}
+			c = cs[0]
+		}
+		if err := it.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return newDesc(c, a.FirstTime, b.LastTime), nil
+}
@@ -0,0 +1,61 @@
+package ingester
+
+import (
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/local/chunk"
+	"github.com/prometheus/prometheus/storage/metric"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func makeDesc(t *testing.T, from, through int) *desc {
+	c := chunk.New()
+	for ts := from; ts < through; ts++ {
+		cs, err := c.Add(model.SamplePair{Timestamp: model.Time(ts), Value: model.SampleValue(ts)})
+		require.NoError(t, err)
+		require.Len(t, cs, 1)
+		c = cs[0]
+	}
+	return newDesc(c, model.Time(from), model.Time(through-1))
+}
+
+func descValues(t *testing.T, descs []*desc) []model.SamplePair {
+	var values []model.SamplePair
+	for _, d := range descs {
+		vs, err := chunk.RangeValues(d.C.NewIterator(), metric.Interval{
+			OldestInclusive: model.Earliest,
+			NewestInclusive: model.Latest,
+		})
+		require.NoError(t, err)
+		values = append(values, vs...)
+	}
+	return values
+}
+
+func TestCompactChunks(t *testing.T) {
+	descs := []*desc{
+		makeDesc(t, 0, 10),
+		makeDesc(t, 10, 20),
+		makeDesc(t, 20, 30),
+	}
+
+	// Disabled.
+	result, err := compactChunks(descs, 0)
+	require.NoError(t, err)
+	assert.Equal(t, descs, result)
+
+	// All small chunks are merged into one.
+	result, err = compactChunks(descs, 0.5)
+	require.NoError(t, err)
+	require.Len(t, result, 1)
+	assert.Equal(t, model.Time(0), result[0].FirstTime)
+	assert.Equal(t, model.Time(29), result[0].LastTime)
+	assert.Equal(t, descValues(t, descs), descValues(t, result))
+
+	// Chunks above the threshold are left alone.
+	result, err = compactChunks(descs, 0.0001)
+	require.NoError(t, err)
+	assert.Equal(t, descs, result)
+}
@@ -0,0 +1,107 @@
+package ingester
+
+import (
+	"flag"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+	"golang.org/x/net/context"
+
+	cortex_chunk "github.com/weaveworks/cortex/chunk"
+	"github.com/weaveworks/cortex/util"
+)
+
+var dualWriteChunks = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "cortex_ingester_dual_write_chunks_total",
+	Help: "The total number of chunks written to each of the chunk stores when dual-writing, by whether the write succeeded.",
+}, []string{"store", "status"})
+
+func init() {
+	prometheus.MustRegister(dualWriteChunks)
+}
+
+// DualWriteConfig configures writing flushed chunks to a secondary chunk store
+// as well, eg to migrate between storage backends without downtime. The
+// secondary store uses the same schema, caching and encryption as the
+// primary.
+type DualWriteConfig struct {
+	S3       util.URLValue
+	DynamoDB util.URLValue
+
+	// Whether a flush fails if the write to the secondary store does; if not,
+	// failures are only counted, and the secondary store may miss chunks.
+	RequireSecondary bool
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet
+func (cfg *DualWriteConfig) RegisterFlags(f *flag.FlagSet) {
+	f.Var(&cfg.S3, "ingester.dual-write.s3.url", "S3 endpoint URL of the secondary chunk store to also write flushed chunks to. Requires -ingester.dual-write.dynamodb.url.")
+	f.Var(&cfg.DynamoDB, "ingester.dual-write.dynamodb.url", "DynamoDB endpoint URL of the secondary chunk store to also write flushed chunks to. Requires -ingester.dual-write.s3.url.")
+	f.BoolVar(&cfg.RequireSecondary, "ingester.dual-write.require-secondary", false, "Fail flushes, so they are retried, if writing to the secondary chunk store fails.")
+}
+
+// Enabled returns whether a secondary chunk store is configured.
+func (cfg *DualWriteConfig) Enabled() bool {
+	return cfg.S3.URL != nil && cfg.DynamoDB.URL != nil
+}
+
+// SecondaryStoreConfig returns the config for the secondary chunk store, based
+// on that of the primary.
+func (cfg *DualWriteConfig) SecondaryStoreConfig(primary cortex_chunk.StoreConfig) cortex_chunk.StoreConfig {
+	secondary := primary
+	secondary.S3 = cfg.S3
+	secondary.DynamoDB = cfg.DynamoDB
+	return secondary
+}
+
+// dualWriteStore is a ChunkStore which writes chunks to two ChunkStores at
+// once, tracking the success of each independently.
+type dualWriteStore struct {
+	primary, secondary ChunkStore
+	requireSecondary   bool
+}
+
+// NewDualWriteStore returns a ChunkStore which writes chunks to both the
+// primary and secondary stores.
+func NewDualWriteStore(cfg DualWriteConfig, primary, secondary ChunkStore) ChunkStore {
+	return &dualWriteStore{
+		primary:          primary,
+		secondary:        secondary,
+		requireSecondary: cfg.RequireSecondary,
+	}
+}
+
+// Put implements ChunkStore.
+func (s *dualWriteStore) Put(ctx context.Context, chunks []cortex_chunk.Chunk) error {
+	secondaryErr := make(chan error)
+	go func() {
+		secondaryErr <- s.put(ctx, "secondary", s.secondary, chunks)
+	}()
+	err := s.put(ctx, "primary", s.primary, chunks)
+	if err2 := <-secondaryErr; err2 != nil {
+		util.WithRequestID(ctx).Warnf("Error writing %d chunks to secondary chunk store: %v", len(chunks), err2)
+		if err == nil && s.requireSecondary {
+			err = err2
+		}
+	}
+	return err
+}
+
+// PendingChunks returns the chunks the primary store can't serve yet.
+func (s *dualWriteStore) PendingChunks(ctx context.Context, from, through model.Time, matchers ...*metric.LabelMatcher) ([]cortex_chunk.Chunk, error) {
+	if store, ok := s.primary.(pendingChunkStore); ok {
+		return store.PendingChunks(ctx, from, through, matchers...)
+	}
+	return nil, nil
+}
+
+func (s *dualWriteStore) put(ctx context.Context, name string, store ChunkStore, chunks []cortex_chunk.Chunk) error {
+	err := store.Put(ctx, chunks)
+	status := "success"
+	if err != nil {
+		status = "failure"
+	}
+	dualWriteChunks.WithLabelValues(name, status).Add(float64(len(chunks)))
+	return err
+}
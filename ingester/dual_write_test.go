@@ -0,0 +1,56 @@
+package ingester
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex/chunk"
+)
+
+type failingStore struct{}
+
+func (failingStore) Put(ctx context.Context, chunks []chunk.Chunk) error {
+	return fmt.Errorf("fail")
+}
+
+func TestDualWriteStore(t *testing.T) {
+	ctx := user.Inject(context.Background(), "1")
+	chunks := []chunk.Chunk{{ID: "foo"}}
+
+	for i, tc := range []struct {
+		primaryFails, secondaryFails bool
+		requireSecondary             bool
+		expectedError                bool
+	}{
+		{},
+		{primaryFails: true, expectedError: true},
+		{secondaryFails: true},
+		{secondaryFails: true, requireSecondary: true, expectedError: true},
+	} {
+		primary := &testStore{chunks: map[string][]chunk.Chunk{}}
+		secondary := &testStore{chunks: map[string][]chunk.Chunk{}}
+		var primaryStore, secondaryStore ChunkStore = primary, secondary
+		if tc.primaryFails {
+			primaryStore = failingStore{}
+		}
+		if tc.secondaryFails {
+			secondaryStore = failingStore{}
+		}
+
+		store := NewDualWriteStore(DualWriteConfig{RequireSecondary: tc.requireSecondary}, primaryStore, secondaryStore)
+		err := store.Put(ctx, chunks)
+		assert.Equal(t, tc.expectedError, err != nil, "%d", i)
+
+		// Each store is written to regardless of whether the other fails.
+		if !tc.primaryFails {
+			assert.Equal(t, chunks, primary.chunks["1"], "%d", i)
+		}
+		if !tc.secondaryFails {
+			assert.Equal(t, chunks, secondary.chunks["1"], "%d", i)
+		}
+	}
+}
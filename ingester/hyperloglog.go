@@ -0,0 +1,77 @@
+package ingester
+
+import (
+	"hash/fnv"
+	"math"
+)
+
+// With 2^10 registers the standard error of estimates is about 3%.
+const (
+	hllPrecision = 10
+	hllRegisters = 1 << hllPrecision
+)
+
+// hyperLogLog estimates the number of distinct values added to it, in a fixed
+// 1KiB, without being able to remove them.
+type hyperLogLog struct {
+	registers [hllRegisters]uint8
+}
+
+func hllHash(value string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(value))
+	// FNV's high bits, used to pick the register, are poorly mixed, so finish
+	// with MurmurHash3's finalizer.
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+// position returns the register a hash updates, and the value it would set:
+// one more than the number of leading zeros after the register's bits.
+func (h *hyperLogLog) position(hash uint64) (uint64, uint8) {
+	idx := hash >> (64 - hllPrecision)
+	rank := uint8(1)
+	for rest := hash << hllPrecision; rest&(1<<63) == 0 && rank <= 64-hllPrecision; rest <<= 1 {
+		rank++
+	}
+	return idx, rank
+}
+
+// adds returns whether adding the hash would change the estimate; if not, the
+// value may already have been added.
+func (h *hyperLogLog) adds(hash uint64) bool {
+	idx, rank := h.position(hash)
+	return rank > h.registers[idx]
+}
+
+func (h *hyperLogLog) add(hash uint64) {
+	idx, rank := h.position(hash)
+	if rank > h.registers[idx] {
+		h.registers[idx] = rank
+	}
+}
+
+func (h *hyperLogLog) estimate() float64 {
+	var (
+		m     = float64(hllRegisters)
+		sum   float64
+		zeros int
+	)
+	for _, r := range h.registers {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+	estimate := 0.7213 / (1 + 1.079/m) * m * m / sum
+	// Use linear counting for small cardinalities, where it is more accurate.
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return estimate
+}
@@ -0,0 +1,20 @@
+package ingester
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHyperLogLog(t *testing.T) {
+	for _, n := range []int{0, 10, 100, 1000, 10000, 100000} {
+		var hll hyperLogLog
+		for i := 0; i < n; i++ {
+			hll.add(hllHash(fmt.Sprintf("value-%d", i)))
+			// Adding values again doesn't change the estimate.
+			assert.False(t, hll.adds(hllHash(fmt.Sprintf("value-%d", i/2))))
+		}
+		assert.InEpsilon(t, float64(n)+1, hll.estimate()+1, 0.1, "%d values", n)
+	}
+}
@@ -0,0 +1,70 @@
+package ingester
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// idempotencyCache remembers the idempotency keys of the batches each user
+// has pushed, or is pushing, in the last window, so retries of them, eg after
+// a timeout, are ignored rather than ingested twice.
+type idempotencyCache struct {
+	window time.Duration
+
+	mtx  sync.Mutex
+	keys map[idempotencyKey]time.Time
+
+	deduplicated prometheus.Counter
+}
+
+type idempotencyKey struct {
+	userID, key string
+}
+
+func newIdempotencyCache(window time.Duration) *idempotencyCache {
+	return &idempotencyCache{
+		window: window,
+		keys:   map[idempotencyKey]time.Time{},
+		deduplicated: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "cortex_ingester_deduplicated_pushes_total",
+			Help: "The total number of pushes ignored as a batch with the same idempotency key was already ingested.",
+		}),
+	}
+}
+
+// reserve records that the user is pushing a batch with the key, returning
+// false if they already pushed, or are still pushing, one within the window.
+// Checking and recording in one step stops concurrent retries both being
+// ingested.
+func (c *idempotencyCache) reserve(userID, key string, now time.Time) bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	k := idempotencyKey{userID, key}
+	if added, ok := c.keys[k]; ok && now.Sub(added) <= c.window {
+		c.deduplicated.Inc()
+		return false
+	}
+	c.keys[k] = now
+	return true
+}
+
+// release forgets the key of a batch which failed to be pushed, so a retry of
+// it is ingested.
+func (c *idempotencyCache) release(userID, key string) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	delete(c.keys, idempotencyKey{userID, key})
+}
+
+// expire forgets the keys older than the window.
+func (c *idempotencyCache) expire(now time.Time) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for k, added := range c.keys {
+		if now.Sub(added) > c.window {
+			delete(c.keys, k)
+		}
+	}
+}
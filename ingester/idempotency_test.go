@@ -0,0 +1,96 @@
+package ingester
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex/chunk"
+	"github.com/weaveworks/cortex/util"
+)
+
+func TestIdempotencyCache(t *testing.T) {
+	c := newIdempotencyCache(time.Minute)
+	now := time.Now()
+
+	assert.True(t, c.reserve("1", "a", now))
+	assert.False(t, c.reserve("1", "a", now.Add(time.Minute)))
+	assert.True(t, c.reserve("2", "a", now))
+
+	// A released key can be reserved again...
+	c.release("2", "a")
+	assert.True(t, c.reserve("2", "a", now))
+
+	// ...as can an expired one.
+	assert.True(t, c.reserve("1", "a", now.Add(2*time.Minute)))
+
+	c.expire(now.Add(4 * time.Minute))
+	assert.Empty(t, c.keys)
+}
+
+func TestIdempotencyCacheConcurrentReserve(t *testing.T) {
+	c := newIdempotencyCache(time.Minute)
+	now := time.Now()
+
+	var (
+		wg       sync.WaitGroup
+		reserved int32
+	)
+	for j := 0; j < 100; j++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if c.reserve("1", "a", now) {
+				atomic.AddInt32(&reserved, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), reserved)
+}
+
+func TestIngesterIdempotentPush(t *testing.T) {
+	for _, tc := range []struct {
+		window   time.Duration
+		ingested float64
+	}{
+		{0, 2},
+		{time.Minute, 1},
+	} {
+		cfg := Config{
+			FlushCheckPeriod:  99999 * time.Hour,
+			MaxChunkIdle:      99999 * time.Hour,
+			IdempotencyWindow: tc.window,
+		}
+		ing, err := New(cfg, &testStore{chunks: map[string][]chunk.Chunk{}}, nil)
+		require.NoError(t, err)
+
+		ctx := user.Inject(context.Background(), "1")
+		req := util.ToWriteRequest([]model.Sample{
+			{Metric: model.Metric{model.MetricNameLabel: "testmetric"}, Timestamp: 1, Value: 1},
+		})
+		req.IdempotencyKey = "a"
+
+		// Retry the push while it's still in flight, as the distributor
+		// would after a timeout.
+		var wg sync.WaitGroup
+		for j := 0; j < 2; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := ing.Push(ctx, req)
+				assert.NoError(t, err)
+			}()
+		}
+		wg.Wait()
+		assert.Equal(t, tc.ingested, counterValue(t, ing.ingestedSamples))
+		ing.Stop()
+	}
+}
@@ -1,66 +1,84 @@
 package ingester
 
 import (
+	"regexp"
 	"sort"
+	"strings"
 	"sync"
 
 	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/storage/metric"
 )
 
+// invertedIndex maps label names and values to the fingerprints of the series
+// with them. The names and values are interned in the ingester's symbol
+// table, and referred to by their IDs.
 type invertedIndex struct {
-	mtx sync.RWMutex
-	idx map[model.LabelName]map[model.LabelValue][]model.Fingerprint // entries are sorted in fp order?
+	mtx     sync.RWMutex
+	symbols *symbolTable
+	idx     map[uint32]map[uint32][]model.Fingerprint // entries are sorted in fp order
 }
 
-func newInvertedIndex() *invertedIndex {
+func newInvertedIndex(symbols *symbolTable) *invertedIndex {
 	return &invertedIndex{
-		idx: map[model.LabelName]map[model.LabelValue][]model.Fingerprint{},
+		symbols: symbols,
+		idx:     map[uint32]map[uint32][]model.Fingerprint{},
 	}
 }
 
-func (i *invertedIndex) add(metric model.Metric, fp model.Fingerprint) {
+// add the series to the index, returning a copy of its metric using the
+// interned strings, for the series to hold instead.
+func (i *invertedIndex) add(metric model.Metric, fp model.Fingerprint) model.Metric {
 	i.mtx.Lock()
 	defer i.mtx.Unlock()
 
+	interned := make(model.Metric, len(metric))
 	for name, value := range metric {
-		values, ok := i.idx[name]
+		nameID, internedName := i.symbols.intern(string(name))
+		valueID, internedValue := i.symbols.intern(string(value))
+		interned[model.LabelName(internedName)] = model.LabelValue(internedValue)
+
+		values, ok := i.idx[nameID]
 		if !ok {
-			values = map[model.LabelValue][]model.Fingerprint{}
+			values = map[uint32][]model.Fingerprint{}
 		}
-		fingerprints := values[value]
+		fingerprints := values[valueID]
 		j := sort.Search(len(fingerprints), func(i int) bool {
 			return fingerprints[i] >= fp
 		})
 		fingerprints = append(fingerprints, 0)
 		copy(fingerprints[j+1:], fingerprints[j:])
 		fingerprints[j] = fp
-		values[value] = fingerprints
-		i.idx[name] = values
+		values[valueID] = fingerprints
+		i.idx[nameID] = values
 	}
+	return interned
 }
 
 func (i *invertedIndex) lookup(matchers []*metric.LabelMatcher) []model.Fingerprint {
 	if len(matchers) == 0 {
 		return nil
 	}
+	// Start with the most selective matchers, so the intersection shrinks
+	// quickly and we can stop early.
+	matchers = append([]*metric.LabelMatcher{}, matchers...)
+	sort.Sort(metric.LabelMatchers(matchers))
+
 	i.mtx.RLock()
 	defer i.mtx.RUnlock()
 
 	// intersection is initially nil, which is a special case.
 	var intersection []model.Fingerprint
 	for _, matcher := range matchers {
-		values, ok := i.idx[matcher.Name]
+		nameID, ok := i.symbols.lookup(string(matcher.Name))
 		if !ok {
 			return nil
 		}
-		var toIntersect []model.Fingerprint
-		for value, fps := range values {
-			if matcher.Match(value) {
-				toIntersect = merge(toIntersect, fps)
-			}
+		values, ok := i.idx[nameID]
+		if !ok {
+			return nil
 		}
-		intersection = intersect(intersection, toIntersect)
+		intersection = intersect(intersection, i.postingsForMatcher(values, matcher))
 		if len(intersection) == 0 {
 			return nil
 		}
@@ -69,31 +87,115 @@ func (i *invertedIndex) lookup(matchers []*metric.LabelMatcher) []model.Fingerpr
 	return intersection
 }
 
+// postingsForMatcher returns the sorted fingerprints of the series with values
+// of a label matching the matcher. Equality matchers, and regex matchers which
+// are just a set of literals (eg "foo|bar"), look up the values directly,
+// rather than checking every value of the label.
+func (i *invertedIndex) postingsForMatcher(values map[uint32][]model.Fingerprint, matcher *metric.LabelMatcher) []model.Fingerprint {
+	var literals []model.LabelValue
+	switch matcher.Type {
+	case metric.Equal:
+		literals = []model.LabelValue{matcher.Value}
+	case metric.RegexMatch:
+		literals = regexLiterals(matcher.Value)
+	}
+
+	var result []model.Fingerprint
+	if literals != nil {
+		for _, value := range literals {
+			if valueID, ok := i.symbols.lookup(string(value)); ok {
+				result = merge(result, values[valueID])
+			}
+		}
+		return result
+	}
+
+	// Hold the symbol table's lock for the whole scan, rather than taking it
+	// for each value.
+	i.symbols.mtx.RLock()
+	defer i.symbols.mtx.RUnlock()
+	for valueID, fps := range values {
+		if matcher.Match(model.LabelValue(i.symbols.symbols[valueID])) {
+			result = merge(result, fps)
+		}
+	}
+	return result
+}
+
+// regexLiterals returns the distinct values matched by a regex consisting only
+// of literal alternatives, or nil if it is anything more complicated.
+func regexLiterals(re model.LabelValue) []model.LabelValue {
+	seen := map[model.LabelValue]struct{}{}
+	var literals []model.LabelValue
+	for _, literal := range strings.Split(string(re), "|") {
+		if literal == "" || regexp.QuoteMeta(literal) != literal {
+			return nil
+		}
+		if _, ok := seen[model.LabelValue(literal)]; ok {
+			continue
+		}
+		seen[model.LabelValue(literal)] = struct{}{}
+		literals = append(literals, model.LabelValue(literal))
+	}
+	return literals
+}
+
 func (i *invertedIndex) lookupLabelValues(name model.LabelName) model.LabelValues {
 	i.mtx.RLock()
 	defer i.mtx.RUnlock()
 
-	values, ok := i.idx[name]
+	nameID, ok := i.symbols.lookup(string(name))
+	if !ok {
+		return nil
+	}
+	values, ok := i.idx[nameID]
 	if !ok {
 		return nil
 	}
 	res := make(model.LabelValues, 0, len(values))
-	for val := range values {
-		res = append(res, val)
+	for valueID := range values {
+		res = append(res, model.LabelValue(i.symbols.symbol(valueID)))
 	}
 	return res
 }
 
+// cardinality returns the number of values of each label name, and the number
+// of series with each metric name.
+func (i *invertedIndex) cardinality() (labelNames, metricNames map[model.LabelName]int) {
+	i.mtx.RLock()
+	defer i.mtx.RUnlock()
+
+	labelNames = make(map[model.LabelName]int, len(i.idx))
+	for nameID, values := range i.idx {
+		labelNames[model.LabelName(i.symbols.symbol(nameID))] = len(values)
+	}
+	metricNames = map[model.LabelName]int{}
+	if nameID, ok := i.symbols.lookup(model.MetricNameLabel); ok {
+		for valueID, fps := range i.idx[nameID] {
+			metricNames[model.LabelName(i.symbols.symbol(valueID))] = len(fps)
+		}
+	}
+	return labelNames, metricNames
+}
+
 func (i *invertedIndex) delete(metric model.Metric, fp model.Fingerprint) {
 	i.mtx.Lock()
 	defer i.mtx.Unlock()
 
 	for name, value := range metric {
-		values, ok := i.idx[name]
+		nameID, ok := i.symbols.lookup(string(name))
+		if !ok {
+			continue
+		}
+		valueID, ok := i.symbols.lookup(string(value))
+		if !ok {
+			continue
+		}
+		values, ok := i.idx[nameID]
 		if !ok {
 			continue
 		}
-		fingerprints, ok := values[value]
+		fingerprints, ok := values[valueID]
 		if !ok {
 			continue
 		}
@@ -101,19 +203,27 @@ func (i *invertedIndex) delete(metric model.Metric, fp model.Fingerprint) {
 		j := sort.Search(len(fingerprints), func(i int) bool {
 			return fingerprints[i] >= fp
 		})
+		if j == len(fingerprints) || fingerprints[j] != fp {
+			// The series isn't in the index, so holds no references.
+			continue
+		}
 		fingerprints = fingerprints[:j+copy(fingerprints[j:], fingerprints[j+1:])]
 
 		if len(fingerprints) == 0 {
-			delete(values, value)
+			delete(values, valueID)
 		} else {
-			values[value] = fingerprints
+			values[valueID] = fingerprints
 		}
 
 		if len(values) == 0 {
-			delete(i.idx, name)
+			delete(i.idx, nameID)
 		} else {
-			i.idx[name] = values
+			i.idx[nameID] = values
 		}
+
+		// Release the references taken when the series was added.
+		i.symbols.release(nameID)
+		i.symbols.release(valueID)
 	}
 }
 
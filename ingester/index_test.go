@@ -0,0 +1,243 @@
+package ingester
+
+import (
+	"fmt"
+	"runtime"
+	"sort"
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type byFingerprint []model.Fingerprint
+
+func (fps byFingerprint) Len() int           { return len(fps) }
+func (fps byFingerprint) Swap(i, j int)      { fps[i], fps[j] = fps[j], fps[i] }
+func (fps byFingerprint) Less(i, j int) bool { return fps[i] < fps[j] }
+
+// makeIndex returns an index of names*jobs*instances series, and the metric for
+// each fingerprint.
+func makeIndex(names, jobs, instances int) (*invertedIndex, map[model.Fingerprint]model.Metric) {
+	metrics := make(map[model.Fingerprint]model.Metric, names*jobs*instances)
+	for n := 0; n < names; n++ {
+		for j := 0; j < jobs; j++ {
+			for i := 0; i < instances; i++ {
+				m := model.Metric{
+					model.MetricNameLabel: model.LabelValue(fmt.Sprintf("metric_%d", n)),
+					"job":                 model.LabelValue(fmt.Sprintf("job_%d", j)),
+					"instance":            model.LabelValue(fmt.Sprintf("instance_%d", i)),
+				}
+				metrics[m.Fingerprint()] = m
+			}
+		}
+	}
+
+	// Adding in fingerprint order is much quicker for large indexes.
+	fps := make([]model.Fingerprint, 0, len(metrics))
+	for fp := range metrics {
+		fps = append(fps, fp)
+	}
+	sort.Sort(byFingerprint(fps))
+	index := newInvertedIndex(newSymbolTable())
+	for _, fp := range fps {
+		index.add(metrics[fp], fp)
+	}
+	return index, metrics
+}
+
+func mustNewLabelMatcher(matchType metric.MatchType, name model.LabelName, value model.LabelValue) *metric.LabelMatcher {
+	matcher, err := metric.NewLabelMatcher(matchType, name, value)
+	if err != nil {
+		panic(err)
+	}
+	return matcher
+}
+
+func TestIndexLookup(t *testing.T) {
+	index, metrics := makeIndex(5, 3, 10)
+
+	for i, matchers := range [][]*metric.LabelMatcher{
+		{mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "metric_1")},
+		{mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "metric_1"), mustNewLabelMatcher(metric.Equal, "job", "job_2")},
+		{mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "metric_1"), mustNewLabelMatcher(metric.RegexMatch, "instance", "instance_1|instance_3|instance_1")},
+		{mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "metric_1"), mustNewLabelMatcher(metric.RegexMatch, "instance", "instance_[12]")},
+		{mustNewLabelMatcher(metric.RegexMatch, "job", "job_0|job_2"), mustNewLabelMatcher(metric.NotEqual, "instance", "instance_1")},
+		{mustNewLabelMatcher(metric.RegexMatch, "job", "job_.*"), mustNewLabelMatcher(metric.RegexNoMatch, model.MetricNameLabel, "metric_[0-3]")},
+		{mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "metric_1"), mustNewLabelMatcher(metric.Equal, "job", "nonexistent")},
+		{mustNewLabelMatcher(metric.Equal, "nonexistent", "foo")},
+	} {
+		t.Run(fmt.Sprintf("[%d]", i), func(t *testing.T) {
+			expected := []model.Fingerprint{}
+		outer:
+			for fp, m := range metrics {
+				for _, matcher := range matchers {
+					if !matcher.Match(m[matcher.Name]) {
+						continue outer
+					}
+				}
+				expected = append(expected, fp)
+			}
+			sort.Sort(byFingerprint(expected))
+
+			actual := index.lookup(matchers)
+			if len(expected) == 0 {
+				assert.Empty(t, actual)
+			} else {
+				assert.Equal(t, expected, actual)
+			}
+		})
+	}
+}
+
+func TestIndexCardinality(t *testing.T) {
+	index, _ := makeIndex(5, 3, 10)
+
+	labelNames, metricNames := index.cardinality()
+	assert.Equal(t, map[model.LabelName]int{
+		model.MetricNameLabel: 5,
+		"job":                 3,
+		"instance":            10,
+	}, labelNames)
+	assert.Len(t, metricNames, 5)
+	for name, count := range metricNames {
+		assert.Equal(t, 30, count, "metric %s", name)
+	}
+}
+
+func TestIndexDelete(t *testing.T) {
+	// Deleting a series which isn't in the index, but whose labels are,
+	// leaves the index and its symbols alone.
+	index, metrics := makeIndex(1, 1, 1)
+	for fp, m := range metrics {
+		index.delete(m, fp+1)
+	}
+	assert.Len(t, index.lookup([]*metric.LabelMatcher{mustNewLabelMatcher(metric.RegexMatch, "job", "job_.*")}), 1)
+	assert.Equal(t, 6, index.symbols.len())
+
+	index, metrics = makeIndex(5, 3, 10)
+	for fp, m := range metrics {
+		index.delete(m, fp)
+	}
+
+	// The index's symbols are released along with the series.
+	assert.Empty(t, index.lookup([]*metric.LabelMatcher{mustNewLabelMatcher(metric.RegexMatch, "job", "job_.*")}))
+	assert.Empty(t, index.idx)
+	assert.Equal(t, 0, index.symbols.len())
+}
+
+func TestRegexLiterals(t *testing.T) {
+	for i, tc := range []struct {
+		re       model.LabelValue
+		expected []model.LabelValue
+	}{
+		{"foo", []model.LabelValue{"foo"}},
+		{"foo|bar|foo", []model.LabelValue{"foo", "bar"}},
+		{"foo_bar-1:2", []model.LabelValue{"foo_bar-1:2"}},
+		{"foo|", nil},
+		{"foo.*", nil},
+		{"(foo|bar)", nil},
+		{"foo|ba[rz]", nil},
+	} {
+		t.Run(fmt.Sprintf("[%d]", i), func(t *testing.T) {
+			require.Equal(t, tc.expected, regexLiterals(tc.re))
+		})
+	}
+}
+
+// Benchmark lookups in an index of 1M series.
+var benchmarkIndex *invertedIndex
+
+func benchmarkLookup(b *testing.B, matchers ...*metric.LabelMatcher) {
+	if benchmarkIndex == nil {
+		benchmarkIndex, _ = makeIndex(100, 10, 1000)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		benchmarkIndex.lookup(matchers)
+	}
+}
+
+func BenchmarkIndexLookupEqual(b *testing.B) {
+	benchmarkLookup(b,
+		mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "metric_1"),
+		mustNewLabelMatcher(metric.Equal, "instance", "instance_1"))
+}
+
+func BenchmarkIndexLookupRegexLiterals(b *testing.B) {
+	benchmarkLookup(b,
+		mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "metric_1"),
+		mustNewLabelMatcher(metric.RegexMatch, "instance", "instance_1|instance_2|instance_3"))
+}
+
+func BenchmarkIndexLookupRegex(b *testing.B) {
+	benchmarkLookup(b,
+		mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "metric_1"),
+		mustNewLabelMatcher(metric.RegexMatch, "instance", "instance_[123]"))
+}
+
+func BenchmarkIndexLookupNotEqual(b *testing.B) {
+	benchmarkLookup(b,
+		mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "metric_1"),
+		mustNewLabelMatcher(metric.NotEqual, "job", "job_1"))
+}
+
+// BenchmarkIndexHeap reports the heap used by the index and series' metrics,
+// for series with freshly decoded labels, mostly sharing values. The baseline
+// is an index keyed by the strings themselves, with the series holding the
+// decoded metrics, as before interning.
+func BenchmarkIndexHeap(b *testing.B) {
+	b.Run("interned", func(b *testing.B) {
+		benchmarkIndexHeap(b, func(metrics []model.Metric) interface{} {
+			index := newInvertedIndex(newSymbolTable())
+			for i, m := range metrics {
+				metrics[i] = index.add(m, model.Fingerprint(i))
+			}
+			return index
+		})
+	})
+	b.Run("not interned", func(b *testing.B) {
+		benchmarkIndexHeap(b, func(metrics []model.Metric) interface{} {
+			index := map[model.LabelName]map[model.LabelValue][]model.Fingerprint{}
+			for i, m := range metrics {
+				for name, value := range m {
+					values, ok := index[name]
+					if !ok {
+						values = map[model.LabelValue][]model.Fingerprint{}
+						index[name] = values
+					}
+					values[value] = append(values[value], model.Fingerprint(i))
+				}
+			}
+			return index
+		})
+	})
+}
+
+func benchmarkIndexHeap(b *testing.B, buildIndex func([]model.Metric) interface{}) {
+	const numSeries = 100000
+	for n := 0; n < b.N; n++ {
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+
+		metrics := make([]model.Metric, 0, numSeries)
+		for i := 0; i < numSeries; i++ {
+			metrics = append(metrics, model.Metric{
+				model.MetricNameLabel: model.LabelValue(fmt.Sprintf("metric_%d", i%100)),
+				"job":                 model.LabelValue(fmt.Sprintf("job_%d", i%10)),
+				"instance":            model.LabelValue(fmt.Sprintf("instance_%d", i%1000)),
+				"series":              model.LabelValue(fmt.Sprintf("series_%d", i)),
+			})
+		}
+		index := buildIndex(metrics)
+
+		runtime.GC()
+		runtime.ReadMemStats(&after)
+		b.Logf("%d bytes per series", (after.HeapAlloc-before.HeapAlloc)/numSeries)
+		runtime.KeepAlive(index)
+		runtime.KeepAlive(metrics)
+	}
+}
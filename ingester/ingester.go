@@ -4,18 +4,23 @@ import (
 	"flag"
 	"fmt"
 	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"google.golang.org/grpc"
-	"google.golang.org/grpc/codes"
-
+	"github.com/opentracing/opentracing-go"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/log"
 	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/storage/local/chunk"
 	"github.com/prometheus/prometheus/storage/metric"
 	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
 
 	"github.com/weaveworks/common/user"
 	"github.com/weaveworks/cortex"
@@ -31,6 +36,7 @@ const (
 	// Reasons to discard samples.
 	outOfOrderTimestamp = "timestamp_out_of_order"
 	duplicateSample     = "multiple_values_for_timestamp"
+	sampleTooOld        = "sample_too_old"
 
 	// DefaultConcurrentFlush is the number of series to flush concurrently
 	DefaultConcurrentFlush = 50
@@ -53,6 +59,11 @@ var (
 		"The current number of users in memory.",
 		nil, nil,
 	)
+	memorySymbolsDesc = prometheus.NewDesc(
+		"cortex_ingester_memory_symbols",
+		"The current number of distinct label names and values interned in memory.",
+		nil, nil,
+	)
 	flushQueueLengthDesc = prometheus.NewDesc(
 		"cortex_ingester_flush_queue_length",
 		"The total number of series pending in the flush queue.",
@@ -67,6 +78,10 @@ var (
 	// different value. (Appending an identical sample is a no-op and does
 	// not cause an error.)
 	ErrDuplicateSampleForTimestamp = fmt.Errorf("sample with repeated timestamp but different value")
+	// ErrSampleTooOld is returned if out of order samples are accepted for
+	// the user, but a sample is further behind the latest timestamp in its
+	// series than allowed.
+	ErrSampleTooOld = fmt.Errorf("sample timestamp too old")
 )
 
 // Ingester deals with "in flight" chunks.
@@ -82,6 +97,11 @@ type Ingester struct {
 	quit     chan struct{}
 	done     sync.WaitGroup
 
+	// Whether to flush everything in memory when stopping, unless told not to
+	// by the ShutdownHandler.
+	flushOnShutdown bool
+	shutdownOnce    sync.Once
+
 	readyLock sync.Mutex
 	startTime time.Time
 	ready     bool
@@ -90,13 +110,35 @@ type Ingester struct {
 	// pick a queue.
 	flushQueues []*util.PriorityQueue
 
-	ingestedSamples  prometheus.Counter
-	chunkUtilization prometheus.Histogram
-	chunkLength      prometheus.Histogram
-	chunkAge         prometheus.Histogram
-	queries          prometheus.Counter
-	queriedSamples   prometheus.Counter
-	memoryChunks     prometheus.Gauge
+	// Queue of flushed chunks waiting to be written to the chunk store, if
+	// configured.
+	writeQueue *writeQueue
+
+	// Limits the queries run concurrently.
+	queryLimiter *queryLimiter
+
+	// Moves chunks waiting to be flushed to disk, if configured.
+	spiller *spiller
+
+	// The idempotency keys of recent pushes, if configured.
+	idempotencyCache *idempotencyCache
+
+	// Per-user settings, from the OverridesFile.
+	overrides map[string]util.Overrides
+
+	// Limits the pushes in flight, shedding bulk pushes first.
+	inflight *util.InflightLimiter
+
+	ingestedSamples     prometheus.Counter
+	ingestedRuleSamples prometheus.Counter
+	chunkUtilization    prometheus.Histogram
+	chunkLength         prometheus.Histogram
+	chunkAge            prometheus.Histogram
+	queries             prometheus.Counter
+	queriedSamples      prometheus.Counter
+	memoryChunks        prometheus.Gauge
+	compactedChunks     prometheus.Counter
+	shedPushes          *prometheus.CounterVec
 }
 
 // ChunkStore is the interface we need to store chunks
@@ -104,6 +146,13 @@ type ChunkStore interface {
 	Put(ctx context.Context, chunks []cortex_chunk.Chunk) error
 }
 
+// pendingChunkStore is a ChunkStore which holds on to chunks put to it for a
+// while before they can be queried from the store, and returns those matching
+// a query meanwhile, for the ingester to serve.
+type pendingChunkStore interface {
+	PendingChunks(ctx context.Context, from, through model.Time, matchers ...*metric.LabelMatcher) ([]cortex_chunk.Chunk, error)
+}
+
 // Config configures an Ingester.
 type Config struct {
 	FlushCheckPeriod  time.Duration
@@ -112,6 +161,36 @@ type Config struct {
 	ConcurrentFlushes int
 	ChunkEncoding     string
 	UserStatesConfig  UserStatesConfig
+	WriteQueueConfig  WriteQueueConfig
+	QueryLimitsConfig QueryLimitsConfig
+	SpillConfig       SpillConfig
+	CheckpointConfig  CheckpointConfig
+
+	// Adjacent chunks flushed together with a utilization below this are
+	// merged into a single chunk.
+	CompactChunksBelowUtilization float64
+
+	// Pushes and queries taking longer than this are logged; 0 to disable.
+	SlowRequestThreshold time.Duration
+
+	// How long to remember the idempotency keys of pushes for, ignoring
+	// pushes with the same key; 0 to disable.
+	IdempotencyWindow time.Duration
+
+	// How far behind the newest sample of a series a sample may be, and still
+	// be accepted; 0 to reject all out of order samples. Can be overridden per
+	// user in the OverridesFile.
+	OutOfOrderWindow time.Duration
+	OverridesFile    string
+
+	// The registered util.Limiter deciding the per-user series and label
+	// value limits.
+	Limiter string
+
+	// The most pushes in flight, of which bulk pushes may be the given
+	// fraction; 0 to not limit.
+	MaxInflightPushes    int
+	BulkInflightFraction float64
 }
 
 // RegisterFlags adds the flags required to config this to the given FlagSet
@@ -121,9 +200,21 @@ func (cfg *Config) RegisterFlags(f *flag.FlagSet) {
 	f.DurationVar(&cfg.MaxChunkAge, "ingester.max-chunk-age", 12*time.Hour, "Maximum chunk age time before flushing.")
 	f.IntVar(&cfg.ConcurrentFlushes, "ingester.concurrent-flushes", DefaultConcurrentFlush, "Number of concurrent goroutines flushing to dynamodb.")
 	f.StringVar(&cfg.ChunkEncoding, "ingester.chunk-encoding", "1", "Encoding version to use for chunks.")
+	f.Float64Var(&cfg.CompactChunksBelowUtilization, "ingester.compact-chunks-below-utilization", 0, "Merge adjacent chunks flushed together if their utilization is below this fraction (0 to disable).")
+	f.DurationVar(&cfg.IdempotencyWindow, "ingester.idempotency-window", 0, "How long to remember the idempotency keys of pushes, ignoring retried pushes with the same key. 0 to disable.")
+	f.DurationVar(&cfg.OutOfOrderWindow, "ingester.out-of-order-window", 0, "How far behind the newest sample of a series a sample may be and still be accepted. Older samples are rejected as too old. 0 to reject all out of order samples.")
+	f.StringVar(&cfg.OverridesFile, "ingester.overrides-file", "", "YAML file of per-tenant settings overriding the flags, currently out_of_order_window, max_series_per_user, max_series_per_metric and label_value_limits.")
+	f.StringVar(&cfg.Limiter, "ingester.limiter", util.OverridesLimiter, "How per-user series and label value limits are decided: overrides, the flags overridden by -ingester.overrides-file, local, the flags alone, or one registered by an embedder.")
+	f.DurationVar(&cfg.SlowRequestThreshold, "ingester.slow-request-threshold", 0, "Log pushes and queries taking longer than this, with the tenant and number of series. 0 to disable.")
+	f.IntVar(&cfg.MaxInflightPushes, "ingester.max-inflight-pushes", 0, "Reject pushes while this many are in flight, so the distributor retries them elsewhere. 0 to disable.")
+	f.Float64Var(&cfg.BulkInflightFraction, "ingester.bulk-inflight-fraction", 0.8, "Reject bulk priority pushes, eg. backfills, while this fraction of -ingester.max-inflight-pushes are in flight, keeping the rest for realtime pushes.")
 	f.DurationVar(&cfg.UserStatesConfig.RateUpdatePeriod, "ingester.rate-update-period", 15*time.Second, "Period with which to update the per-user ingestion rates.")
 	f.IntVar(&cfg.UserStatesConfig.MaxSeriesPerUser, "ingester.max-series-per-user", DefaultMaxSeriesPerUser, "Maximum number of active series per user.")
 	f.IntVar(&cfg.UserStatesConfig.MaxSeriesPerMetric, "ingester.max-series-per-metric", DefaultMaxSeriesPerMetric, "Maximum number of active series per metric name.")
+	cfg.WriteQueueConfig.RegisterFlags(f)
+	cfg.QueryLimitsConfig.RegisterFlags(f)
+	cfg.SpillConfig.RegisterFlags(f)
+	cfg.CheckpointConfig.RegisterFlags(f)
 }
 
 type flushOp struct {
@@ -169,21 +260,49 @@ func New(cfg Config, chunkStore ChunkStore, ring *ring.Ring) (*Ingester, error)
 		return nil, err
 	}
 
+	var overrides map[string]util.Overrides
+	if cfg.OverridesFile != "" {
+		var err error
+		overrides, err = util.LoadOverrides(cfg.OverridesFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Limiter == "" {
+		cfg.Limiter = util.OverridesLimiter
+	}
+	limiter, err := util.NewLimiter(cfg.Limiter, util.LimitDefaults{
+		MaxSeriesPerUser:   cfg.UserStatesConfig.MaxSeriesPerUser,
+		MaxSeriesPerMetric: cfg.UserStatesConfig.MaxSeriesPerMetric,
+	}, cfg.OverridesFile)
+	if err != nil {
+		return nil, err
+	}
+
 	i := &Ingester{
 		cfg:        cfg,
 		chunkStore: chunkStore,
 		quit:       make(chan struct{}),
 		ring:       ring,
 
+		flushOnShutdown: true,
+
 		startTime: time.Now(),
 
-		userStates:  newUserStates(&cfg.UserStatesConfig),
-		flushQueues: make([]*util.PriorityQueue, cfg.ConcurrentFlushes, cfg.ConcurrentFlushes),
+		overrides:    overrides,
+		userStates:   newUserStates(&cfg.UserStatesConfig, limiter),
+		flushQueues:  make([]*util.PriorityQueue, cfg.ConcurrentFlushes, cfg.ConcurrentFlushes),
+		queryLimiter: newQueryLimiter(cfg.QueryLimitsConfig),
+		inflight:     util.NewInflightLimiter(cfg.MaxInflightPushes, cfg.BulkInflightFraction),
 
 		ingestedSamples: prometheus.NewCounter(prometheus.CounterOpts{
 			Name: "cortex_ingester_ingested_samples_total",
 			Help: "The total number of samples ingested.",
 		}),
+		ingestedRuleSamples: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "cortex_ingester_ingested_rule_samples_total",
+			Help: "The total number of samples generated by the ruler ingested.",
+		}),
 		chunkUtilization: prometheus.NewHistogram(prometheus.HistogramOpts{
 			Name:    "cortex_ingester_chunk_utilization",
 			Help:    "Distribution of stored chunk utilization (when stored).",
@@ -203,6 +322,14 @@ func New(cfg Config, chunkStore ChunkStore, ring *ring.Ring) (*Ingester, error)
 			Name: "cortex_ingester_memory_chunks",
 			Help: "The total number of chunks in memory.",
 		}),
+		compactedChunks: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "cortex_ingester_compacted_chunks_total",
+			Help: "The total number of chunks merged into other chunks before being flushed.",
+		}),
+		shedPushes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "cortex_ingester_shed_pushes_total",
+			Help: "The total number of pushes rejected for too many in flight, by priority.",
+		}, []string{"priority"}),
 		queries: prometheus.NewCounter(prometheus.CounterOpts{
 			Name: "cortex_ingester_queries_total",
 			Help: "The total number of queries the ingester has handled.",
@@ -213,6 +340,37 @@ func New(cfg Config, chunkStore ChunkStore, ring *ring.Ring) (*Ingester, error)
 		}),
 	}
 
+	if chunkStore != nil && cfg.WriteQueueConfig.Size > 0 {
+		q, err := newWriteQueue(cfg.WriteQueueConfig, chunkStore)
+		if err != nil {
+			return nil, err
+		}
+		i.writeQueue = q
+		i.chunkStore = q
+	}
+
+	if cfg.IdempotencyWindow > 0 {
+		i.idempotencyCache = newIdempotencyCache(cfg.IdempotencyWindow)
+	}
+
+	if cfg.SpillConfig.Dir != "" && cfg.SpillConfig.MaxMemoryChunks > 0 {
+		s, err := newSpiller(cfg.SpillConfig)
+		if err != nil {
+			return nil, err
+		}
+		i.spiller = s
+	}
+
+	if cfg.CheckpointConfig.Dir != "" {
+		if err := os.MkdirAll(cfg.CheckpointConfig.Dir, 0777); err != nil {
+			return nil, err
+		}
+		// Carry on with whatever was recovered, rather than refuse to start.
+		if err := i.recoverCheckpoint(); err != nil {
+			log.Errorf("Error recovering from checkpoint: %v", err)
+		}
+	}
+
 	i.done.Add(cfg.ConcurrentFlushes)
 	for j := 0; j < cfg.ConcurrentFlushes; j++ {
 		i.flushQueues[j] = util.NewPriorityQueue()
@@ -235,6 +393,42 @@ func (i *Ingester) ReadinessHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// ShutdownHandler returns a handler which shuts the ingester down, as on
+// SIGTERM: it calls stop to unblock the server, after which the ingester
+// leaves the ring, flushes its chunks, unregisters and exits. This lets
+// autoscalers scale ingesters down cleanly. With flush=false the chunks are
+// checkpointed instead of flushed, to be recovered on restart. Returns 204
+// once the shutdown has begun.
+func (i *Ingester) ShutdownHandler(stop func()) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "shutdown must be POSTed", http.StatusMethodNotAllowed)
+			return
+		}
+		flush := true
+		if v := r.FormValue("flush"); v != "" {
+			var err error
+			if flush, err = strconv.ParseBool(v); err != nil {
+				http.Error(w, fmt.Sprintf("invalid flush %q", v), http.StatusBadRequest)
+				return
+			}
+		}
+		if !flush && i.cfg.CheckpointConfig.Dir == "" {
+			http.Error(w, "cannot shut down without flushing unless checkpointing", http.StatusBadRequest)
+			return
+		}
+
+		i.shutdownOnce.Do(func() {
+			log.Infof("Shutting down on request, flush=%v", flush)
+			i.stopLock.Lock()
+			i.flushOnShutdown = flush
+			i.stopLock.Unlock()
+			stop()
+		})
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
 func (i *Ingester) isReady() bool {
 	i.readyLock.Lock()
 	defer i.readyLock.Unlock()
@@ -254,26 +448,87 @@ func (i *Ingester) isReady() bool {
 }
 
 // Push implements cortex.IngesterServer
-func (i *Ingester) Push(ctx context.Context, req *cortex.WriteRequest) (*cortex.WriteResponse, error) {
-	var lastPartialErr error
+func (i *Ingester) Push(ctx context.Context, req *cortex.WriteRequest) (_ *cortex.WriteResponse, err error) {
+	// Tell the distributor it can send us symbolized requests. This fails,
+	// harmlessly, when we're called in-process rather than over gRPC.
+	grpc.SetHeader(ctx, metadata.Pairs(util.SymbolizedWritesMetadataKey, "true"))
+	if err := util.DesymbolizeWriteRequest(req); err != nil {
+		return nil, err
+	}
+
+	defer util.LogIfSlow(ctx, i.cfg.SlowRequestThreshold, time.Now(), "Slow push", "series", len(req.Timeseries))
+
+	if err := i.inflight.Acquire(req.Priority); err != nil {
+		i.shedPushes.WithLabelValues(strings.ToLower(req.Priority.String())).Inc()
+		return nil, err.(*util.LimitError).GRPCError()
+	}
+	defer i.inflight.Release()
+
+	state, err := i.userStates.getOrCreate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	state.ingestedBytes.add(int64(req.Size()))
+
+	if i.idempotencyCache != nil && req.IdempotencyKey != "" {
+		if !i.idempotencyCache.reserve(state.userID, req.IdempotencyKey, time.Now()) {
+			return &cortex.WriteResponse{}, nil
+		}
+		defer func() {
+			if err != nil {
+				i.idempotencyCache.release(state.userID, req.IdempotencyKey)
+			}
+		}()
+	}
+
+	// Samples rejected for exceeding a limit, or their series' order, are
+	// skipped, and the rest appended.
+	var rejected *util.RejectedSamplesError
 	samples := util.FromWriteRequest(req)
+	if sp := opentracing.SpanFromContext(ctx); sp != nil {
+		util.TagSpanWithTenant(ctx, sp)
+		sp.SetTag("samples", len(samples))
+	}
 	for j := range samples {
-		if err := i.append(ctx, &samples[j]); err != nil {
-			if err == util.ErrUserSeriesLimitExceeded || err == util.ErrMetricSeriesLimitExceeded {
-				lastPartialErr = grpc.Errorf(codes.ResourceExhausted, err.Error())
-				continue
+		if err := i.append(ctx, &samples[j], req.Source); err != nil {
+			state.discardedSamples.inc()
+			reason, ok := rejectionReason(err)
+			if !ok {
+				return nil, err
 			}
-			return nil, err
+			if rejected == nil {
+				rejected = &util.RejectedSamplesError{Samples: map[int]string{}}
+			}
+			rejected.Samples[j], rejected.Err = reason, err
 		}
 	}
+	if rejected != nil {
+		return &cortex.WriteResponse{}, rejected.GRPCError()
+	}
+	return &cortex.WriteResponse{}, nil
+}
 
-	return &cortex.WriteResponse{}, lastPartialErr
+// rejectionReason returns the reason a sample failing to be appended with the
+// error was rejected for, or false if the push must fail.
+func rejectionReason(err error) (string, bool) {
+	switch err {
+	case ErrOutOfOrderSample:
+		return util.OutOfOrderReason, true
+	case ErrDuplicateSampleForTimestamp:
+		return util.DuplicateTimestampReason, true
+	case ErrSampleTooOld:
+		return util.TooOldReason, true
+	}
+	if limitErr, ok := err.(*util.LimitError); ok {
+		return limitErr.Limit, true
+	}
+	return "", false
 }
 
-func (i *Ingester) append(ctx context.Context, sample *model.Sample) error {
+func (i *Ingester) append(ctx context.Context, sample *model.Sample, source cortex.SampleSource) error {
 	if err := util.ValidateSample(sample); err != nil {
 		userID, _ := user.Extract(ctx) // ignore err, userID will be empty string if err
-		log.Errorf("Error validating sample from user '%s': %v", userID, err)
+		util.WithRequestID(ctx).Errorf("Error validating sample from user '%s': %v", userID, err)
 		return nil
 	}
 
@@ -301,30 +556,69 @@ func (i *Ingester) append(ctx context.Context, sample *model.Sample) error {
 	if err := series.add(model.SamplePair{
 		Value:     sample.Value,
 		Timestamp: sample.Timestamp,
-	}); err != nil {
+	}, i.outOfOrderWindow(state.userID)); err != nil {
 		return err
 	}
 
 	i.memoryChunks.Add(float64(len(series.chunkDescs) - prevNumChunks))
 	i.ingestedSamples.Inc()
+	if source == cortex.RULE {
+		i.ingestedRuleSamples.Inc()
+	}
 	state.ingestedSamples.inc()
 
 	return err
 }
 
+// outOfOrderWindow returns how far behind the newest sample of a series the
+// user's samples may be.
+func (i *Ingester) outOfOrderWindow(userID string) time.Duration {
+	if o, ok := i.overrides[userID]; ok && o.OutOfOrderWindow > 0 {
+		return o.OutOfOrderWindow
+	}
+	return i.cfg.OutOfOrderWindow
+}
+
 // Query implements service.IngesterServer
-func (i *Ingester) Query(ctx context.Context, req *cortex.QueryRequest) (*cortex.QueryResponse, error) {
-	start, end, matchers, err := util.FromQueryRequest(req)
+func (i *Ingester) Query(ctx context.Context, req *cortex.QueryRequest) (_ *cortex.QueryResponse, err error) {
+	var (
+		begin    = time.Now()
+		matchers []*metric.LabelMatcher
+		matrix   model.Matrix
+	)
+	defer func() {
+		util.LogIfSlow(ctx, i.cfg.SlowRequestThreshold, begin, "Slow query", "matchers", matchers, "series", len(matrix), "err", err)
+	}()
+
+	if err := i.queryLimiter.acquire(ctx); err != nil {
+		return nil, err
+	}
+	defer i.queryLimiter.release()
+
+	var start, end model.Time
+	start, end, matchers, err = util.FromQueryRequest(req)
 	if err != nil {
 		return nil, err
 	}
 
-	matrix, err := i.query(ctx, start, end, matchers)
+	ctx = util.WithWarnings(ctx)
+	matrix, err = i.query(ctx, start, end, matchers)
 	if err != nil {
 		return nil, err
 	}
+	if sp := opentracing.SpanFromContext(ctx); sp != nil {
+		util.TagSpanWithTenant(ctx, sp)
+		sp.SetTag("series", len(matrix))
+	}
 
-	return util.ToQueryResponse(matrix), nil
+	var resp *cortex.QueryResponse
+	if req.Columnar {
+		resp = util.ToColumnarQueryResponse(matrix)
+	} else {
+		resp = util.ToQueryResponse(matrix)
+	}
+	resp.Warnings = util.Warnings(ctx)
+	return resp, nil
 }
 
 func (i *Ingester) query(ctx context.Context, from, through model.Time, matchers []*metric.LabelMatcher) (model.Matrix, error) {
@@ -335,9 +629,18 @@ func (i *Ingester) query(ctx context.Context, from, through model.Time, matchers
 		return nil, err
 	}
 
-	queriedSamples := 0
+	queriedSamples, reservedChunks := 0, 0
+	defer func() {
+		i.queryLimiter.releaseChunks(reservedChunks)
+	}()
 	result := model.Matrix{}
 	err = state.forSeriesMatching(matchers, func(_ model.Fingerprint, series *memorySeries) error {
+		n := series.chunksForRange(from, through)
+		if err := i.queryLimiter.reserveChunks(reservedChunks, n); err != nil {
+			return err
+		}
+		reservedChunks += n
+
 		values, err := series.samplesForRange(from, through)
 		if err != nil {
 			return err
@@ -350,12 +653,64 @@ func (i *Ingester) query(ctx context.Context, from, through model.Time, matchers
 		queriedSamples += len(values)
 		return nil
 	})
+	if err != nil {
+		return nil, err
+	}
+	if store, ok := i.chunkStore.(pendingChunkStore); ok {
+		if result, err = queryPending(ctx, store, from, through, matchers, result); err != nil {
+			return nil, err
+		}
+	}
 	i.queriedSamples.Add(float64(queriedSamples))
-	return result, err
+	if limitedAt := model.Time(atomic.LoadInt64(&state.seriesLimitedAt)); limitedAt != 0 && !limitedAt.Before(from) {
+		util.AddWarning(ctx, "results may be incomplete: new series were refused for exceeding the series limits at %v", limitedAt.Time().UTC().Format(time.RFC3339))
+	}
+	return result, nil
+}
+
+// queryPending merges the samples of the flushed chunks the chunk store can't
+// serve yet into the result.
+func queryPending(ctx context.Context, store pendingChunkStore, from, through model.Time, matchers []*metric.LabelMatcher, result model.Matrix) (model.Matrix, error) {
+	chunks, err := store.PendingChunks(ctx, from, through, matchers...)
+	if err != nil || len(chunks) == 0 {
+		return result, err
+	}
+	pending, err := cortex_chunk.ChunksToMatrix(chunks)
+	if err != nil {
+		return nil, err
+	}
+
+	fpToSampleStream := make(map[model.Fingerprint]*model.SampleStream, len(result))
+	for _, ss := range result {
+		fpToSampleStream[ss.Metric.Fingerprint()] = ss
+	}
+	for _, ss := range pending {
+		values := samplesInRange(ss.Values, from, through)
+		if len(values) == 0 {
+			continue
+		}
+		if mss, ok := fpToSampleStream[ss.Metric.Fingerprint()]; ok {
+			mss.Values = util.MergeSamples(values, mss.Values)
+		} else {
+			result = append(result, &model.SampleStream{Metric: ss.Metric, Values: values})
+		}
+	}
+	return result, nil
+}
+
+func samplesInRange(values []model.SamplePair, from, through model.Time) []model.SamplePair {
+	start := sort.Search(len(values), func(i int) bool { return !values[i].Timestamp.Before(from) })
+	end := sort.Search(len(values), func(i int) bool { return values[i].Timestamp.After(through) })
+	return values[start:end]
 }
 
 // LabelValues returns all label values that are associated with a given label name.
 func (i *Ingester) LabelValues(ctx context.Context, req *cortex.LabelValuesRequest) (*cortex.LabelValuesResponse, error) {
+	if err := i.queryLimiter.acquire(ctx); err != nil {
+		return nil, err
+	}
+	defer i.queryLimiter.release()
+
 	state, err := i.userStates.getOrCreate(ctx)
 	if err != nil {
 		return nil, err
@@ -371,6 +726,11 @@ func (i *Ingester) LabelValues(ctx context.Context, req *cortex.LabelValuesReque
 
 // MetricsForLabelMatchers returns all the metrics which match a set of matchers.
 func (i *Ingester) MetricsForLabelMatchers(ctx context.Context, req *cortex.MetricsForLabelMatchersRequest) (*cortex.MetricsForLabelMatchersResponse, error) {
+	if err := i.queryLimiter.acquire(ctx); err != nil {
+		return nil, err
+	}
+	defer i.queryLimiter.release()
+
 	state, err := i.userStates.getOrCreate(ctx)
 	if err != nil {
 		return nil, err
@@ -410,11 +770,40 @@ func (i *Ingester) UserStats(ctx context.Context, req *cortex.UserStatsRequest)
 	}
 
 	return &cortex.UserStatsResponse{
-		IngestionRate: state.ingestedSamples.rate(),
-		NumSeries:     uint64(state.fpToSeries.length()),
+		IngestionRate:      state.ingestedSamples.rate(),
+		IngestionBytesRate: state.ingestedBytes.rate(),
+		DiscardedRate:      state.discardedSamples.rate(),
+		NumSeries:          uint64(state.fpToSeries.length()),
 	}, nil
 }
 
+// Cardinality returns the number of values of each label name and the number
+// of series of each metric name for the current user.
+func (i *Ingester) Cardinality(ctx context.Context, req *cortex.CardinalityRequest) (*cortex.CardinalityResponse, error) {
+	if err := i.queryLimiter.acquire(ctx); err != nil {
+		return nil, err
+	}
+	defer i.queryLimiter.release()
+
+	state, err := i.userStates.getOrCreate(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	labelNames, metricNames := state.index.cardinality()
+	resp := &cortex.CardinalityResponse{
+		LabelNames:  make([]cortex.CardinalityEntry, 0, len(labelNames)),
+		MetricNames: make([]cortex.CardinalityEntry, 0, len(metricNames)),
+	}
+	for name, count := range labelNames {
+		resp.LabelNames = append(resp.LabelNames, cortex.CardinalityEntry{Name: string(name), Count: uint64(count)})
+	}
+	for name, count := range metricNames {
+		resp.MetricNames = append(resp.MetricNames, cortex.CardinalityEntry{Name: string(name), Count: uint64(count)})
+	}
+	return resp, nil
+}
+
 // Stop stops the Ingester.
 func (i *Ingester) Stop() {
 	i.stopLock.Lock()
@@ -426,11 +815,28 @@ func (i *Ingester) Stop() {
 	close(i.quit)
 
 	i.done.Wait()
+
+	if i.writeQueue != nil {
+		i.writeQueue.Stop()
+	}
+
+	// Everything in memory has been flushed.
+	if i.chunkStore != nil && i.cfg.CheckpointConfig.Dir != "" && i.flushOnShutdown {
+		i.removeCheckpoint()
+	}
 }
 
 func (i *Ingester) loop() {
 	defer func() {
-		i.sweepUsers(true)
+		i.stopLock.RLock()
+		flush := i.flushOnShutdown
+		i.stopLock.RUnlock()
+		if flush {
+			i.sweepUsers(true)
+		} else if err := i.checkpoint(); err != nil {
+			log.Errorf("Error writing checkpoint: %v", err)
+			checkpointFailures.Inc()
+		}
 
 		// We close flush queue here to ensure the flushLoops pick
 		// up all the flushes triggered by the last run
@@ -444,12 +850,24 @@ func (i *Ingester) loop() {
 
 	flushTick := time.Tick(i.cfg.FlushCheckPeriod)
 	rateUpdateTick := time.Tick(i.cfg.UserStatesConfig.RateUpdatePeriod)
+	var checkpointTick <-chan time.Time
+	if i.cfg.CheckpointConfig.Dir != "" && i.cfg.CheckpointConfig.Interval > 0 {
+		checkpointTick = time.Tick(i.cfg.CheckpointConfig.Interval)
+	}
 	for {
 		select {
 		case <-flushTick:
 			i.sweepUsers(false)
 		case <-rateUpdateTick:
 			i.userStates.updateRates()
+			if i.idempotencyCache != nil {
+				i.idempotencyCache.expire(time.Now())
+			}
+		case <-checkpointTick:
+			if err := i.checkpoint(); err != nil {
+				log.Errorf("Error writing checkpoint: %v", err)
+				checkpointFailures.Inc()
+			}
 		case <-i.quit:
 			return
 		}
@@ -463,11 +881,28 @@ func (i *Ingester) sweepUsers(immediate bool) {
 	}
 
 	for id, state := range i.userStates.cp() {
+		// Count the values of labels with limits afresh as we go, forgetting
+		// those of series which have gone. Series added meanwhile may be
+		// missed, which only lets a few more values in.
+		var labelValues map[labelValuesKey]*hyperLogLog
+		if len(state.labelValueLimits) > 0 {
+			labelValues = map[labelValuesKey]*hyperLogLog{}
+		}
 		for pair := range state.fpToSeries.iter() {
 			state.fpLocker.Lock(pair.fp)
 			i.sweepSeries(id, pair.fp, pair.series, immediate)
+			if labelValues != nil {
+				countLabelValues(labelValues, state.labelValueLimits, pair.series.metric[model.MetricNameLabel], pair.series.metric)
+			}
 			state.fpLocker.Unlock(pair.fp)
 		}
+		if labelValues != nil {
+			state.resetLabelValues(labelValues)
+		}
+	}
+
+	if i.spiller != nil && !immediate {
+		i.spillChunks()
 	}
 }
 
@@ -561,6 +996,10 @@ func (i *Ingester) flushUserSeries(userID string, fp model.Fingerprint, immediat
 		userState.fpLocker.Unlock(fp)
 		return nil
 	}
+	if err := i.mergeOutOfOrder(series); err != nil {
+		userState.fpLocker.Unlock(fp)
+		return err
+	}
 
 	// Assume we're going to flush everything, and maybe don't flush the head chunk if it doesn't need it.
 	chunks := series.chunkDescs
@@ -569,6 +1008,12 @@ func (i *Ingester) flushUserSeries(userID string, fp model.Fingerprint, immediat
 	} else {
 		chunks = chunks[:len(chunks)-1]
 	}
+	// Flush copies of the descs, as the originals may be spilled meanwhile.
+	toFlush := make([]*desc, 0, len(chunks))
+	for _, d := range chunks {
+		c := *d
+		toFlush = append(toFlush, &c)
+	}
 	userState.fpLocker.Unlock(fp)
 
 	if len(chunks) == 0 {
@@ -576,16 +1021,32 @@ func (i *Ingester) flushUserSeries(userID string, fp model.Fingerprint, immediat
 	}
 
 	// flush the chunks without locking the series, as we don't want to hold the series lock for the duration of the dynamo/s3 rpcs.
-	ctx := user.Inject(context.Background(), userID)
-	err := i.flushChunks(ctx, fp, series.metric, chunks)
+	// Each flush gets its own request ID, so the store's logs for it can be told apart.
+	ctx := util.InjectRequestID(user.Inject(context.Background(), userID), util.NewRequestID())
+	err := i.flushChunks(ctx, fp, series.metric, toFlush)
 	if err != nil {
 		return err
 	}
 
 	// now remove the chunks
 	userState.fpLocker.Lock(fp)
+	inMemory := 0
+	for _, d := range chunks {
+		if d.C != nil {
+			inMemory++
+		} else if i.spiller != nil {
+			i.spiller.remove(d)
+		}
+	}
 	series.chunkDescs = series.chunkDescs[len(chunks):]
-	i.memoryChunks.Sub(float64(len(chunks)))
+	i.memoryChunks.Sub(float64(inMemory))
+	if len(series.chunkDescs) == 0 {
+		// Keep any samples which arrived out of order during the flush.
+		if err := i.mergeOutOfOrder(series); err != nil {
+			userState.fpLocker.Unlock(fp)
+			return err
+		}
+	}
 	if len(series.chunkDescs) == 0 {
 		userState.removeSeries(fp, series.metric)
 	}
@@ -593,7 +1054,46 @@ func (i *Ingester) flushUserSeries(userID string, fp model.Fingerprint, immediat
 	return nil
 }
 
+// mergeOutOfOrder merges the series' out of order samples into its chunks,
+// so they are flushed together. The caller must have locked the fingerprint
+// of the series.
+func (i *Ingester) mergeOutOfOrder(series *memorySeries) error {
+	prevNumChunks := len(series.chunkDescs)
+	replaced, err := series.mergeOutOfOrder()
+	if err != nil {
+		return err
+	}
+	inMemory := 0
+	for _, d := range replaced {
+		if d.C != nil {
+			inMemory++
+		} else if i.spiller != nil {
+			i.spiller.remove(d)
+		}
+	}
+	i.memoryChunks.Add(float64(len(series.chunkDescs) - prevNumChunks + len(replaced) - inMemory))
+	return nil
+}
+
 func (i *Ingester) flushChunks(ctx context.Context, fp model.Fingerprint, metric model.Metric, chunkDescs []*desc) error {
+	for _, d := range chunkDescs {
+		if d.C != nil {
+			continue
+		}
+		c, err := d.chunk()
+		if err != nil {
+			return err
+		}
+		d.C = c
+	}
+
+	compacted, err := compactChunks(chunkDescs, i.cfg.CompactChunksBelowUtilization)
+	if err != nil {
+		return err
+	}
+	i.compactedChunks.Add(float64(len(chunkDescs) - len(compacted)))
+	chunkDescs = compacted
+
 	wireChunks := make([]cortex_chunk.Chunk, 0, len(chunkDescs))
 	for _, chunkDesc := range chunkDescs {
 		i.chunkUtilization.Observe(chunkDesc.C.Utilization())
@@ -608,14 +1108,28 @@ func (i *Ingester) flushChunks(ctx context.Context, fp model.Fingerprint, metric
 func (i *Ingester) Describe(ch chan<- *prometheus.Desc) {
 	ch <- memorySeriesDesc
 	ch <- memoryUsersDesc
+	ch <- memorySymbolsDesc
 	ch <- flushQueueLengthDesc
 	ch <- i.ingestedSamples.Desc()
+	ch <- i.ingestedRuleSamples.Desc()
 	ch <- i.chunkUtilization.Desc()
 	ch <- i.chunkLength.Desc()
 	ch <- i.chunkAge.Desc()
 	ch <- i.queries.Desc()
 	ch <- i.queriedSamples.Desc()
 	ch <- i.memoryChunks.Desc()
+	ch <- i.compactedChunks.Desc()
+	i.shedPushes.Describe(ch)
+	if i.writeQueue != nil {
+		i.writeQueue.Describe(ch)
+	}
+	i.queryLimiter.Describe(ch)
+	if i.spiller != nil {
+		i.spiller.Describe(ch)
+	}
+	if i.idempotencyCache != nil {
+		ch <- i.idempotencyCache.deduplicated.Desc()
+	}
 }
 
 // Collect implements prometheus.Collector.
@@ -633,6 +1147,11 @@ func (i *Ingester) Collect(ch chan<- prometheus.Metric) {
 		prometheus.GaugeValue,
 		float64(numUsers),
 	)
+	ch <- prometheus.MustNewConstMetric(
+		memorySymbolsDesc,
+		prometheus.GaugeValue,
+		float64(i.userStates.symbols.len()),
+	)
 
 	flushQueueLength := 0
 	for _, flushQueue := range i.flushQueues {
@@ -644,10 +1163,23 @@ func (i *Ingester) Collect(ch chan<- prometheus.Metric) {
 		float64(flushQueueLength),
 	)
 	ch <- i.ingestedSamples
+	ch <- i.ingestedRuleSamples
 	ch <- i.chunkUtilization
 	ch <- i.chunkLength
 	ch <- i.chunkAge
 	ch <- i.queries
 	ch <- i.queriedSamples
 	ch <- i.memoryChunks
+	ch <- i.compactedChunks
+	i.shedPushes.Collect(ch)
+	if i.writeQueue != nil {
+		i.writeQueue.Collect(ch)
+	}
+	i.queryLimiter.Collect(ch)
+	if i.spiller != nil {
+		i.spiller.Collect(ch)
+	}
+	if i.idempotencyCache != nil {
+		ch <- i.idempotencyCache.deduplicated
+	}
 }
@@ -2,19 +2,22 @@ package ingester
 
 import (
 	"fmt"
+	"io/ioutil"
+	"os"
 	"reflect"
 	"sort"
 	"sync"
 	"testing"
 	"time"
 
-	"google.golang.org/grpc"
-
 	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/storage/metric"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"golang.org/x/net/context"
 
 	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex"
 	"github.com/weaveworks/cortex/chunk"
 	"github.com/weaveworks/cortex/util"
 )
@@ -123,7 +126,10 @@ func TestIngesterAppend(t *testing.T) {
 			t.Fatal(err)
 		}
 
-		res := util.FromQueryResponse(resp)
+		res, err := util.FromQueryResponse(resp)
+		if err != nil {
+			t.Fatal(err)
+		}
 		sort.Sort(res)
 		if !reflect.DeepEqual(res, testData[userID]) {
 			t.Fatalf("unexpected query result\n\nwant:\n\n%v\n\ngot:\n\n%v\n\n", testData[userID], res)
@@ -145,6 +151,87 @@ func TestIngesterAppend(t *testing.T) {
 	}
 }
 
+func TestIngesterFlushOutOfOrder(t *testing.T) {
+	cfg := Config{
+		FlushCheckPeriod: 99999 * time.Hour,
+		MaxChunkIdle:     99999 * time.Hour,
+		OutOfOrderWindow: time.Minute,
+	}
+	store := &testStore{
+		chunks: map[string][]chunk.Chunk{},
+	}
+	ing, err := New(cfg, store, nil)
+	require.NoError(t, err)
+
+	ctx := user.Inject(context.Background(), "1")
+	m := model.Metric{model.MetricNameLabel: "testmetric"}
+	expected := model.Matrix{{Metric: m}}
+	for _, ts := range []model.Time{1000, 5000, 2000, 3000, 6000, 4000} {
+		_, err := ing.Push(ctx, util.ToWriteRequest([]model.Sample{{Metric: m, Timestamp: ts, Value: 1}}))
+		require.NoError(t, err)
+	}
+	for ts := model.Time(1000); ts <= 6000; ts += 1000 {
+		expected[0].Values = append(expected[0].Values, model.SamplePair{Timestamp: ts, Value: 1})
+	}
+
+	// The out of order samples are flushed in the same chunk as the others.
+	ing.Stop()
+	require.Len(t, store.chunks["1"], 1)
+	res, err := chunk.ChunksToMatrix(store.chunks["1"])
+	require.NoError(t, err)
+	assert.Equal(t, expected, res)
+}
+
+// pendingStore is a store whose chunks are all pending.
+type pendingStore struct {
+	testStore
+}
+
+func (s *pendingStore) PendingChunks(ctx context.Context, from, through model.Time, matchers ...*metric.LabelMatcher) ([]chunk.Chunk, error) {
+	userID, err := user.Extract(ctx)
+	if err != nil {
+		return nil, err
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.chunks[userID], nil
+}
+
+func TestIngesterQueryPendingChunks(t *testing.T) {
+	store := &pendingStore{testStore{chunks: map[string][]chunk.Chunk{}}}
+	ing, err := New(Config{
+		FlushCheckPeriod: 99999 * time.Hour,
+		MaxChunkIdle:     99999 * time.Hour,
+	}, store, nil)
+	require.NoError(t, err)
+
+	ctx := user.Inject(context.Background(), "1")
+	testData := buildTestMatrix(10, 100, 0)
+	_, err = ing.Push(ctx, util.ToWriteRequest(matrixToSamples(testData)))
+	require.NoError(t, err)
+
+	// Stopping flushes every series, so they are only in the store.
+	ing.Stop()
+	require.Equal(t, 0, ing.userStates.numSeries())
+
+	matcher, err := metric.NewLabelMatcher(metric.Equal, model.JobLabel, "testjob")
+	require.NoError(t, err)
+	req, err := util.ToQueryRequest(10, 50, []*metric.LabelMatcher{matcher})
+	require.NoError(t, err)
+	resp, err := ing.Query(ctx, req)
+	require.NoError(t, err)
+	res, err := util.FromQueryResponse(resp)
+	require.NoError(t, err)
+	sort.Sort(res)
+
+	require.Len(t, res, 10)
+	for i, ss := range res {
+		assert.Equal(t, testData[i].Metric, ss.Metric)
+		assert.Equal(t, model.Time(10), ss.Values[0].Timestamp)
+		assert.Equal(t, model.Time(50), ss.Values[len(ss.Values)-1].Timestamp)
+	}
+}
+
 func TestIngesterUserSeriesLimitExceeded(t *testing.T) {
 	cfg := Config{
 		FlushCheckPeriod: 99999 * time.Hour,
@@ -187,7 +274,13 @@ func TestIngesterUserSeriesLimitExceeded(t *testing.T) {
 
 	// Append to two series, expect series-exceeded error.
 	_, err = ing.Push(ctx, util.ToWriteRequest([]model.Sample{sample2, sample3}))
-	if grpc.ErrorDesc(err) != util.ErrUserSeriesLimitExceeded.Error() {
+	expectedErr := &util.LimitError{
+		Limit:      util.MaxSeriesPerUserLimit,
+		Configured: 1,
+		Observed:   1,
+		Message:    util.ErrUserSeriesLimitExceeded.Error(),
+	}
+	if limitErr, ok := util.LimitErrorFromGRPC(err); !ok || !reflect.DeepEqual(expectedErr, limitErr) {
 		t.Fatalf("expected error about exceeding metrics per user, got %v", err)
 	}
 
@@ -207,7 +300,10 @@ func TestIngesterUserSeriesLimitExceeded(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	res := util.FromQueryResponse(resp)
+	res, err := util.FromQueryResponse(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
 	sort.Sort(res)
 
 	expected := model.Matrix{
@@ -229,6 +325,10 @@ func TestIngesterUserSeriesLimitExceeded(t *testing.T) {
 	if !reflect.DeepEqual(res, expected) {
 		t.Fatalf("unexpected query result\n\nwant:\n\n%v\n\ngot:\n\n%v\n\n", expected, res)
 	}
+	// The query covers when the series was refused, so may be incomplete.
+	if len(resp.Warnings) != 1 {
+		t.Fatalf("expected a warning about the refused series, got %v", resp.Warnings)
+	}
 }
 
 func TestIngesterMetricSeriesLimitExceeded(t *testing.T) {
@@ -273,7 +373,13 @@ func TestIngesterMetricSeriesLimitExceeded(t *testing.T) {
 
 	// Append to two series, expect series-exceeded error.
 	_, err = ing.Push(ctx, util.ToWriteRequest([]model.Sample{sample2, sample3}))
-	if grpc.ErrorDesc(err) != util.ErrMetricSeriesLimitExceeded.Error() {
+	expectedErr := &util.LimitError{
+		Limit:      util.MaxSeriesPerMetricLimit,
+		Configured: 1,
+		Observed:   1,
+		Message:    util.ErrMetricSeriesLimitExceeded.Error(),
+	}
+	if limitErr, ok := util.LimitErrorFromGRPC(err); !ok || !reflect.DeepEqual(expectedErr, limitErr) {
 		t.Fatalf("expected error about exceeding series per metric, got %v", err)
 	}
 
@@ -293,7 +399,10 @@ func TestIngesterMetricSeriesLimitExceeded(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	res := util.FromQueryResponse(resp)
+	res, err := util.FromQueryResponse(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
 	sort.Sort(res)
 
 	expected := model.Matrix{
@@ -316,3 +425,146 @@ func TestIngesterMetricSeriesLimitExceeded(t *testing.T) {
 		t.Fatalf("unexpected query result\n\nwant:\n\n%v\n\ngot:\n\n%v\n\n", expected, res)
 	}
 }
+
+func TestIngesterUserStats(t *testing.T) {
+	cfg := Config{
+		FlushCheckPeriod: 99999 * time.Hour,
+		MaxChunkIdle:     99999 * time.Hour,
+		UserStatesConfig: UserStatesConfig{
+			RateUpdatePeriod: time.Hour,
+			MaxSeriesPerUser: 1,
+		},
+	}
+	store := &testStore{
+		chunks: map[string][]chunk.Chunk{},
+	}
+	ing, err := New(cfg, store, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Of the three samples, the one for a second series is discarded.
+	ctx := user.Inject(context.Background(), "1")
+	req := util.ToWriteRequest([]model.Sample{
+		{Metric: model.Metric{model.MetricNameLabel: "testmetric", "foo": "bar"}, Timestamp: 0, Value: 1},
+		{Metric: model.Metric{model.MetricNameLabel: "testmetric", "foo": "bar"}, Timestamp: 1, Value: 2},
+		{Metric: model.Metric{model.MetricNameLabel: "testmetric", "foo": "biz"}, Timestamp: 1, Value: 3},
+	})
+	_, err = ing.Push(ctx, req)
+	if limitErr, ok := util.LimitErrorFromGRPC(err); !ok || limitErr.Limit != util.MaxSeriesPerUserLimit {
+		t.Fatalf("expected error about exceeding metrics per user, got %v", err)
+	}
+	ing.userStates.updateRates()
+
+	stats, err := ing.UserStats(ctx, &cortex.UserStatsRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &cortex.UserStatsResponse{
+		IngestionRate:      2 / time.Hour.Seconds(),
+		IngestionBytesRate: float64(req.Size()) / time.Hour.Seconds(),
+		DiscardedRate:      1 / time.Hour.Seconds(),
+		NumSeries:          1,
+	}
+	if !reflect.DeepEqual(stats, expected) {
+		t.Fatalf("unexpected user stats\n\nwant:\n\n%v\n\ngot:\n\n%v\n\n", expected, stats)
+	}
+}
+
+func TestIngesterRejectedSamples(t *testing.T) {
+	ing, err := New(Config{
+		FlushCheckPeriod: 99999 * time.Hour,
+		MaxChunkIdle:     99999 * time.Hour,
+	}, nil, nil)
+	require.NoError(t, err)
+	defer ing.Stop()
+
+	ctx := user.Inject(context.Background(), "1")
+	a := model.Metric{model.MetricNameLabel: "testmetric", "foo": "a"}
+	b := model.Metric{model.MetricNameLabel: "testmetric", "foo": "b"}
+	_, err = ing.Push(ctx, util.ToWriteRequest([]model.Sample{{Metric: a, Timestamp: 10, Value: 1}}))
+	require.NoError(t, err)
+
+	// The out of order sample is rejected, and the rest appended.
+	_, err = ing.Push(ctx, util.ToWriteRequest([]model.Sample{
+		{Metric: a, Timestamp: 5, Value: 2},
+		{Metric: b, Timestamp: 5, Value: 3},
+		{Metric: a, Timestamp: 20, Value: 4},
+	}))
+	rejected, ok := util.RejectedSamplesErrorFromGRPC(err)
+	require.True(t, ok, "%v", err)
+	assert.Equal(t, map[int]string{0: util.OutOfOrderReason}, rejected.Samples)
+	assert.Equal(t, ErrOutOfOrderSample.Error(), rejected.Err.Error())
+
+	state, ok := ing.userStates.get("1")
+	require.True(t, ok)
+	assert.Equal(t, 2, state.fpToSeries.length())
+	_, err = ing.Push(ctx, util.ToWriteRequest([]model.Sample{{Metric: a, Timestamp: 15, Value: 5}}))
+	rejected, ok = util.RejectedSamplesErrorFromGRPC(err)
+	require.True(t, ok, "%v", err)
+	assert.Equal(t, map[int]string{0: util.OutOfOrderReason}, rejected.Samples)
+}
+
+func TestIngesterLabelValueLimitExceeded(t *testing.T) {
+	f, err := ioutil.TempFile("", "overrides")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(`
+overrides:
+  "1":
+    label_value_limits:
+      pod: 10
+  "3":
+    label_value_limits:
+      pod: 1000
+`)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	ing, err := New(Config{
+		FlushCheckPeriod: 99999 * time.Hour,
+		MaxChunkIdle:     99999 * time.Hour,
+		OverridesFile:    f.Name(),
+	}, nil, nil)
+	require.NoError(t, err)
+	defer ing.Stop()
+
+	push := func(userID, metricName, job, pod string) error {
+		_, err := ing.Push(user.Inject(context.Background(), userID), util.ToWriteRequest([]model.Sample{{
+			Metric: model.Metric{model.MetricNameLabel: model.LabelValue(metricName), "job": model.LabelValue(job), "pod": model.LabelValue(pod)},
+			Value:  1,
+		}}))
+		return err
+	}
+	for i := 0; i < 10; i++ {
+		require.NoError(t, push("1", "foo", "a", fmt.Sprint(i)))
+	}
+
+	// Another pod is rejected, but not new series with existing pods, other
+	// metrics, or other tenants.
+	err = push("1", "foo", "a", "10")
+	limitErr, ok := util.LimitErrorFromGRPC(err)
+	require.True(t, ok, "%v", err)
+	assert.Equal(t, util.MaxLabelValuesLimit, limitErr.Limit)
+	assert.Equal(t, 10., limitErr.Configured)
+	assert.NoError(t, push("1", "foo", "b", "0"))
+	assert.NoError(t, push("1", "bar", "a", "10"))
+	assert.NoError(t, push("2", "foo", "a", "10"))
+
+	// The rejected series' values aren't counted.
+	state, ok := ing.userStates.get("1")
+	require.True(t, ok)
+	assert.InDelta(t, 10, state.labelValues[labelValuesKey{"foo", "pod"}].estimate(), 0.5)
+	_, ok = state.labelValues[labelValuesKey{"foo", "job"}]
+	assert.False(t, ok)
+
+	// Of many more pods, about as many as the limit are accepted, though
+	// most values added once the estimate reaches it don't change it.
+	accepted := 0
+	for i := 0; i < 20000; i++ {
+		if push("3", "foo", "a", fmt.Sprint(i)) == nil {
+			accepted++
+		}
+	}
+	assert.InEpsilon(t, 1000, accepted, 0.1)
+}
@@ -0,0 +1,147 @@
+package ingester
+
+import (
+	"flag"
+	"sync"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+var (
+	errTooManyQueries = grpc.Errorf(codes.Unavailable, "too many concurrent queries")
+	errTooManyChunks  = grpc.Errorf(codes.Unavailable, "too many chunks being read by concurrent queries")
+)
+
+// QueryLimitsConfig configures the limits on queries run concurrently by the
+// ingester, so a storm of queries can't starve pushes.
+type QueryLimitsConfig struct {
+	MaxConcurrentQueries int
+	MaxQueuedQueries     int
+	MaxConcurrentChunks  int
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet
+func (cfg *QueryLimitsConfig) RegisterFlags(f *flag.FlagSet) {
+	f.IntVar(&cfg.MaxConcurrentQueries, "ingester.max-concurrent-queries", 0, "Maximum number of query RPCs to run concurrently. 0 to disable.")
+	f.IntVar(&cfg.MaxQueuedQueries, "ingester.max-queued-queries", 100, "Maximum number of query RPCs waiting to run once the concurrency limit is reached; past this, queries are rejected as Unavailable.")
+	f.IntVar(&cfg.MaxConcurrentChunks, "ingester.max-concurrent-query-chunks", 0, "Maximum number of chunks read by the queries running at once; queries reading more are rejected as Unavailable, unless they are the only one. 0 to disable.")
+}
+
+// queryLimiter limits the number of concurrent queries, queueing those over
+// the limit until the queue is full, and the number of chunks they read.
+type queryLimiter struct {
+	cfg   QueryLimitsConfig
+	slots chan struct{}
+
+	mtx    sync.Mutex
+	queued int
+
+	chunks int64 // being read by queries
+
+	queueLength prometheus.Gauge
+	rejected    prometheus.Counter
+}
+
+func newQueryLimiter(cfg QueryLimitsConfig) *queryLimiter {
+	l := &queryLimiter{
+		cfg: cfg,
+
+		queueLength: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "cortex_ingester_query_queue_length",
+			Help: "The number of queries waiting for the concurrent query limit.",
+		}),
+		rejected: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "cortex_ingester_rejected_queries_total",
+			Help: "The total number of queries rejected as the query queue was full, or for reading too many chunks.",
+		}),
+	}
+	if cfg.MaxConcurrentQueries > 0 {
+		l.slots = make(chan struct{}, cfg.MaxConcurrentQueries)
+	}
+	return l
+}
+
+// acquire waits for a query to be allowed to run, returning an error if the
+// queue is full or the context is cancelled first. If it returns nil, release
+// must be called when the query finishes.
+func (l *queryLimiter) acquire(ctx context.Context) error {
+	if l.slots == nil {
+		return nil
+	}
+
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	default:
+	}
+
+	l.mtx.Lock()
+	if l.queued >= l.cfg.MaxQueuedQueries {
+		l.mtx.Unlock()
+		l.rejected.Inc()
+		return errTooManyQueries
+	}
+	l.queued++
+	l.queueLength.Inc()
+	l.mtx.Unlock()
+
+	defer func() {
+		l.mtx.Lock()
+		l.queued--
+		l.queueLength.Dec()
+		l.mtx.Unlock()
+	}()
+
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return grpc.Errorf(codes.Unavailable, "query cancelled while queued: %v", ctx.Err())
+	}
+}
+
+func (l *queryLimiter) release() {
+	if l.slots != nil {
+		<-l.slots
+	}
+}
+
+// reserveChunks counts n more chunks as being read by a query which has
+// already reserved some, returning an error if that takes them over the limit.
+// A query reading more than the limit on its own may still run while no others
+// are reading chunks. If it returns nil, releaseChunks must be called once
+// they are read.
+func (l *queryLimiter) reserveChunks(reserved, n int) error {
+	if l.cfg.MaxConcurrentChunks <= 0 || n == 0 {
+		return nil
+	}
+	total := atomic.AddInt64(&l.chunks, int64(n))
+	if total > int64(l.cfg.MaxConcurrentChunks) && total != int64(reserved+n) {
+		atomic.AddInt64(&l.chunks, -int64(n))
+		l.rejected.Inc()
+		return errTooManyChunks
+	}
+	return nil
+}
+
+func (l *queryLimiter) releaseChunks(n int) {
+	if l.cfg.MaxConcurrentChunks > 0 {
+		atomic.AddInt64(&l.chunks, -int64(n))
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (l *queryLimiter) Describe(ch chan<- *prometheus.Desc) {
+	ch <- l.queueLength.Desc()
+	ch <- l.rejected.Desc()
+}
+
+// Collect implements prometheus.Collector.
+func (l *queryLimiter) Collect(ch chan<- prometheus.Metric) {
+	ch <- l.queueLength
+	ch <- l.rejected
+}
@@ -0,0 +1,121 @@
+package ingester
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+
+	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex"
+	"github.com/weaveworks/cortex/util"
+)
+
+func TestQueryLimiter(t *testing.T) {
+	l := newQueryLimiter(QueryLimitsConfig{
+		MaxConcurrentQueries: 1,
+		MaxQueuedQueries:     1,
+	})
+	ctx := context.Background()
+	require.NoError(t, l.acquire(ctx))
+
+	// The second query is queued until the first finishes.
+	acquired := make(chan error)
+	go func() {
+		acquired <- l.acquire(ctx)
+	}()
+	for {
+		l.mtx.Lock()
+		queued := l.queued
+		l.mtx.Unlock()
+		if queued == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// The third is rejected as the queue is full.
+	assert.Equal(t, errTooManyQueries, l.acquire(ctx))
+
+	l.release()
+	require.NoError(t, <-acquired)
+
+	// Queued queries give up when their context is cancelled, as
+	// unavailable so they are retried elsewhere.
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, codes.Unavailable, grpc.Code(l.acquire(ctx)))
+	l.release()
+	require.NoError(t, l.acquire(context.Background()))
+}
+
+func TestQueryLimiterDisabled(t *testing.T) {
+	l := newQueryLimiter(QueryLimitsConfig{})
+	for i := 0; i < 10; i++ {
+		require.NoError(t, l.acquire(context.Background()))
+	}
+}
+
+func TestQueryLimiterChunks(t *testing.T) {
+	l := newQueryLimiter(QueryLimitsConfig{MaxConcurrentChunks: 10})
+
+	// A query may read more chunks than the limit while it is the only one.
+	require.NoError(t, l.reserveChunks(0, 15))
+	require.NoError(t, l.reserveChunks(15, 5))
+	assert.Equal(t, errTooManyChunks, l.reserveChunks(0, 1))
+	l.releaseChunks(20)
+
+	require.NoError(t, l.reserveChunks(0, 6))
+	require.NoError(t, l.reserveChunks(0, 4))
+	assert.Equal(t, errTooManyChunks, l.reserveChunks(0, 1))
+	assert.Equal(t, errTooManyChunks, l.reserveChunks(4, 1))
+	assert.Equal(t, codes.Unavailable, grpc.Code(errTooManyChunks))
+	l.releaseChunks(4)
+	require.NoError(t, l.reserveChunks(0, 4))
+}
+
+func TestIngesterQueryLimits(t *testing.T) {
+	ing, err := New(Config{
+		FlushCheckPeriod: 99999 * time.Hour,
+		MaxChunkIdle:     99999 * time.Hour,
+		QueryLimitsConfig: QueryLimitsConfig{
+			MaxConcurrentQueries: 1,
+			MaxConcurrentChunks:  1,
+		},
+	}, nil, nil)
+	require.NoError(t, err)
+	defer ing.Stop()
+
+	ctx := user.Inject(context.Background(), "1")
+	_, err = ing.Push(ctx, util.ToWriteRequest(matrixToSamples(buildTestMatrix(3, 1, 0))))
+	require.NoError(t, err)
+	matcher, err := metric.NewLabelMatcher(metric.Equal, model.JobLabel, "testjob")
+	require.NoError(t, err)
+	req, err := util.ToQueryRequest(model.Earliest, model.Latest, []*metric.LabelMatcher{matcher})
+	require.NoError(t, err)
+
+	// Cardinality requests count towards the concurrent queries.
+	require.NoError(t, ing.queryLimiter.acquire(ctx))
+	_, err = ing.Cardinality(ctx, &cortex.CardinalityRequest{})
+	assert.Equal(t, errTooManyQueries, err)
+	ing.queryLimiter.release()
+	_, err = ing.Cardinality(ctx, &cortex.CardinalityRequest{})
+	assert.NoError(t, err)
+
+	// A query reading three chunks may run alone, but not alongside another
+	// reading a chunk.
+	resp, err := ing.Query(ctx, req)
+	require.NoError(t, err)
+	assert.Len(t, resp.Timeseries, 3)
+	require.NoError(t, ing.queryLimiter.reserveChunks(0, 1))
+	_, err = ing.Query(ctx, req)
+	assert.Equal(t, errTooManyChunks, err)
+	ing.queryLimiter.releaseChunks(1)
+	assert.Equal(t, int64(0), ing.queryLimiter.chunks)
+}
@@ -49,5 +49,10 @@ func (r *ewmaRate) tick() {
 
 // inc counts one event.
 func (r *ewmaRate) inc() {
-	atomic.AddInt64(&r.newEvents, 1)
+	r.add(1)
+}
+
+// add counts n events.
+func (r *ewmaRate) add(n int64) {
+	atomic.AddInt64(&r.newEvents, n)
 }
@@ -2,11 +2,14 @@ package ingester
 
 import (
 	"sort"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/storage/local/chunk"
 	"github.com/prometheus/prometheus/storage/metric"
+
+	"github.com/weaveworks/cortex/util"
 )
 
 var discardedSamples = prometheus.NewCounterVec(
@@ -24,14 +27,18 @@ func init() {
 type memorySeries struct {
 	metric model.Metric
 
-	// Sorted by start time, overlapping chunk ranges are forbidden.
+	// In order of start time, without overlapping.
 	chunkDescs []*desc
 
+	// Samples accepted out of order, in order of time, waiting to be merged
+	// into the chunks when they are flushed.
+	outOfOrder []model.SamplePair
+
 	// Whether the current head chunk has already been finished.  If true,
 	// the current head chunk must not be modified anymore.
 	headChunkClosed bool
 
-	// The timestamp & value of the last sample in this series. Needed to
+	// The timestamp & value of the newest sample in this series. Needed to
 	// ensure timestamp monotonicity during ingestion.
 	lastSampleValueSet bool
 	lastTime           model.Time
@@ -47,18 +54,20 @@ func newMemorySeries(m model.Metric) *memorySeries {
 	}
 }
 
-// add adds a sample pair to the series. It returns the number of newly
-// completed chunks (which are now eligible for persistence).
+// add adds a sample pair to the series. Samples older than the newest are
+// rejected, unless within outOfOrderWindow of it, in which case they are held
+// apart from the chunks until mergeOutOfOrder is called.
 //
 // The caller must have locked the fingerprint of the series.
-func (s *memorySeries) add(v model.SamplePair) error {
+func (s *memorySeries) add(v model.SamplePair, outOfOrderWindow time.Duration) error {
 	// Don't report "no-op appends", i.e. where timestamp and sample
 	// value are the same as for the last append, as they are a
 	// common occurrence when using client-side timestamps
-	// (e.g. Pushgateway or federation).
+	// (e.g. Pushgateway or federation). Staleness markers are only the same
+	// as other staleness markers, not other NaNs.
 	if s.lastSampleValueSet &&
 		v.Timestamp == s.lastTime &&
-		v.Value.Equal(s.lastSampleValue) {
+		util.SameValue(v.Value, s.lastSampleValue) {
 		return nil
 	}
 	if v.Timestamp == s.lastTime {
@@ -66,8 +75,15 @@ func (s *memorySeries) add(v model.SamplePair) error {
 		return ErrDuplicateSampleForTimestamp // Caused by the caller.
 	}
 	if v.Timestamp < s.lastTime {
-		discardedSamples.WithLabelValues(outOfOrderTimestamp).Inc()
-		return ErrOutOfOrderSample // Caused by the caller.
+		if outOfOrderWindow <= 0 {
+			discardedSamples.WithLabelValues(outOfOrderTimestamp).Inc()
+			return ErrOutOfOrderSample // Caused by the caller.
+		}
+		if s.lastTime.Sub(v.Timestamp) > outOfOrderWindow {
+			discardedSamples.WithLabelValues(sampleTooOld).Inc()
+			return ErrSampleTooOld // Caused by the caller.
+		}
+		return s.addOutOfOrder(v)
 	}
 
 	if len(s.chunkDescs) == 0 || s.headChunkClosed {
@@ -97,9 +113,123 @@ func (s *memorySeries) add(v model.SamplePair) error {
 		}
 	}
 
+	if v.Timestamp > s.lastTime {
+		s.lastTime = v.Timestamp
+		s.lastSampleValue = v.Value
+		s.lastSampleValueSet = true
+	}
 	return nil
 }
 
+// addOutOfOrder adds a sample older than the newest to the out of order
+// samples. Retries of samples already in the series are ignored, like no-op
+// appends.
+func (s *memorySeries) addOutOfOrder(v model.SamplePair) error {
+	existing, ok, err := s.valueAt(v.Timestamp)
+	if err != nil {
+		return err
+	}
+	if ok {
+		if util.SameValue(v.Value, existing) {
+			return nil
+		}
+		discardedSamples.WithLabelValues(duplicateSample).Inc()
+		return ErrDuplicateSampleForTimestamp // Caused by the caller.
+	}
+
+	i := sort.Search(len(s.outOfOrder), func(i int) bool {
+		return s.outOfOrder[i].Timestamp > v.Timestamp
+	})
+	s.outOfOrder = append(s.outOfOrder, model.SamplePair{})
+	copy(s.outOfOrder[i+1:], s.outOfOrder[i:])
+	s.outOfOrder[i] = v
+	return nil
+}
+
+// valueAt returns the value of the sample at exactly ts, if there is one.
+func (s *memorySeries) valueAt(ts model.Time) (model.SampleValue, bool, error) {
+	i := sort.Search(len(s.outOfOrder), func(i int) bool {
+		return s.outOfOrder[i].Timestamp >= ts
+	})
+	if i < len(s.outOfOrder) && s.outOfOrder[i].Timestamp == ts {
+		return s.outOfOrder[i].Value, true, nil
+	}
+	for _, d := range s.chunkDescs {
+		if ts < d.FirstTime || ts > d.LastTime {
+			continue
+		}
+		c, err := d.chunk()
+		if err != nil {
+			return 0, false, err
+		}
+		it := c.NewIterator()
+		if it.FindAtOrBefore(ts) && it.Value().Timestamp == ts {
+			return it.Value().Value, true, nil
+		}
+		if err := it.Err(); err != nil {
+			return 0, false, err
+		}
+	}
+	return 0, false, nil
+}
+
+// mergeOutOfOrder rewrites the chunks overlapping the out of order samples to
+// include them, returning the descs it replaced. The caller must have locked
+// the fingerprint of the series.
+func (s *memorySeries) mergeOutOfOrder() ([]*desc, error) {
+	if len(s.outOfOrder) == 0 {
+		return nil, nil
+	}
+
+	first := sort.Search(len(s.chunkDescs), func(i int) bool {
+		return s.chunkDescs[i].LastTime >= s.outOfOrder[0].Timestamp
+	})
+	samples := s.outOfOrder
+	for _, d := range s.chunkDescs[first:] {
+		c, err := d.chunk()
+		if err != nil {
+			return nil, err
+		}
+		values, err := chunk.RangeValues(c.NewIterator(), metric.Interval{
+			OldestInclusive: d.FirstTime,
+			NewestInclusive: d.LastTime,
+		})
+		if err != nil {
+			return nil, err
+		}
+		samples = util.MergeSamples(samples, values)
+	}
+
+	var merged []*desc
+	for _, v := range samples {
+		if len(merged) == 0 {
+			merged = append(merged, newDesc(chunk.New(), v.Timestamp, v.Timestamp))
+		}
+		last := merged[len(merged)-1]
+		cs, err := last.add(v)
+		if err != nil {
+			return nil, err
+		}
+		if len(cs) == 1 {
+			last.C = cs[0]
+			continue
+		}
+		merged = merged[:len(merged)-1]
+		for _, c := range cs {
+			lastTime, err := c.NewIterator().LastTimestamp()
+			if err != nil {
+				return nil, err
+			}
+			merged = append(merged, newDesc(c, c.FirstTime(), lastTime))
+		}
+	}
+
+	replaced := append([]*desc(nil), s.chunkDescs[first:]...)
+	s.chunkDescs = append(s.chunkDescs[:first], merged...)
+	s.outOfOrder = nil
+	return replaced, nil
+}
+
 func (s *memorySeries) closeHead() {
 	s.headChunkClosed = true
 }
@@ -111,6 +241,15 @@ func (s *memorySeries) firstTime() model.Time {
 	return s.chunkDescs[0].FirstTime
 }
 
+// closedChunks returns the chunk descriptors which can no longer be appended
+// to. The caller must have locked the fingerprint of the memorySeries.
+func (s *memorySeries) closedChunks() []*desc {
+	if s.headChunkClosed {
+		return s.chunkDescs
+	}
+	return s.chunkDescs[:len(s.chunkDescs)-1]
+}
+
 // head returns a pointer to the head chunk descriptor. The caller must have
 // locked the fingerprint of the memorySeries. This method will panic if this
 // series has no chunk descriptors.
@@ -118,49 +257,66 @@ func (s *memorySeries) head() *desc {
 	return s.chunkDescs[len(s.chunkDescs)-1]
 }
 
-func (s *memorySeries) samplesForRange(from, through model.Time) ([]model.SamplePair, error) {
-	// Find first chunk with start time after "from".
-	fromIdx := sort.Search(len(s.chunkDescs), func(i int) bool {
-		return s.chunkDescs[i].FirstTime.After(from)
-	})
-	// Find first chunk with start time after "through".
-	throughIdx := sort.Search(len(s.chunkDescs), func(i int) bool {
-		return s.chunkDescs[i].FirstTime.After(through)
-	})
-	if fromIdx == len(s.chunkDescs) {
-		// Even the last chunk starts before "from". Find out if the
-		// series ends before "from" and we don't need to do anything.
-		lt := s.chunkDescs[len(s.chunkDescs)-1].LastTime
-		if lt.Before(from) {
-			return nil, nil
+// chunksForRange returns the number of chunks with samples in the range.
+// The out of order samples count as one.
+func (s *memorySeries) chunksForRange(from, through model.Time) int {
+	n := 0
+	for _, d := range s.chunkDescs {
+		if !d.LastTime.Before(from) && !d.FirstTime.After(through) {
+			n++
 		}
 	}
-	if fromIdx > 0 {
-		fromIdx--
-	}
-	if throughIdx == len(s.chunkDescs) {
-		throughIdx--
+	if len(s.outOfOrder) > 0 {
+		n++
 	}
+	return n
+}
+
+func (s *memorySeries) samplesForRange(from, through model.Time) ([]model.SamplePair, error) {
 	var values []model.SamplePair
 	in := metric.Interval{
 		OldestInclusive: from,
 		NewestInclusive: through,
 	}
-	for idx := fromIdx; idx <= throughIdx; idx++ {
-		cd := s.chunkDescs[idx]
-		chValues, err := chunk.RangeValues(cd.C.NewIterator(), in)
+	for _, d := range s.chunkDescs {
+		if d.LastTime.Before(from) || d.FirstTime.After(through) {
+			continue
+		}
+		c, err := d.chunk()
+		if err != nil {
+			return nil, err
+		}
+		chValues, err := chunk.RangeValues(c.NewIterator(), in)
 		if err != nil {
 			return nil, err
 		}
-		values = append(values, chValues...)
+		// Chunks recovered from checkpoints taken before out of order
+		// samples were held apart may overlap.
+		if len(values) == 0 || len(chValues) == 0 || chValues[0].Timestamp > values[len(values)-1].Timestamp {
+			values = append(values, chValues...)
+		} else {
+			values = util.MergeSamples(values, chValues)
+		}
+	}
+
+	start := sort.Search(len(s.outOfOrder), func(i int) bool {
+		return s.outOfOrder[i].Timestamp >= from
+	})
+	end := sort.Search(len(s.outOfOrder), func(i int) bool {
+		return s.outOfOrder[i].Timestamp > through
+	})
+	if start < end {
+		values = util.MergeSamples(values, s.outOfOrder[start:end])
 	}
 	return values, nil
 }
 
 type desc struct {
-	C         chunk.Chunk // nil if chunk is evicted.
+	C         chunk.Chunk // nil if chunk is spilled.
 	FirstTime model.Time  // Populated at creation. Immutable.
 	LastTime  model.Time  // Populated at creation & on append.
+
+	spilled string // The file the chunk was spilled to, if any.
 }
 
 func newDesc(c chunk.Chunk, firstTime model.Time, lastTime model.Time) *desc {
@@ -171,6 +327,14 @@ func newDesc(c chunk.Chunk, firstTime model.Time, lastTime model.Time) *desc {
 	}
 }
 
+// chunk returns the chunk, reading it back from disk if it was spilled.
+func (d *desc) chunk() (chunk.Chunk, error) {
+	if d.C != nil {
+		return d.C, nil
+	}
+	return loadSpilledChunk(d.spilled)
+}
+
 // Add adds a sample pair to the underlying chunk. For safe concurrent access,
 // The chunk must be pinned, and the caller must have locked the fingerprint of
 // the series.
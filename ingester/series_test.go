@@ -0,0 +1,94 @@
+package ingester
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSeriesOutOfOrderWindow(t *testing.T) {
+	for _, tc := range []struct {
+		window   time.Duration
+		sample   model.Time
+		expected error
+	}{
+		{0, 8000, ErrOutOfOrderSample},
+		{0, 10000, ErrDuplicateSampleForTimestamp},
+		{5 * time.Second, 8000, nil},
+		{5 * time.Second, 4000, ErrSampleTooOld},
+	} {
+		s := newMemorySeries(model.Metric{model.MetricNameLabel: "foo"})
+		for _, ts := range []model.Time{5000, 10000} {
+			require.NoError(t, s.add(model.SamplePair{Timestamp: ts, Value: 1}, tc.window))
+		}
+		assert.Equal(t, tc.expected, s.add(model.SamplePair{Timestamp: tc.sample, Value: 2}, tc.window), "%v %v", tc.window, tc.sample)
+	}
+}
+
+func TestSeriesOutOfOrderSamples(t *testing.T) {
+	s := newMemorySeries(model.Metric{model.MetricNameLabel: "foo"})
+	for _, ts := range []model.Time{1000, 5000, 2000, 3000, 6000, 4000} {
+		require.NoError(t, s.add(model.SamplePair{Timestamp: ts, Value: model.SampleValue(ts)}, time.Minute))
+	}
+
+	// The out of order samples are held apart from the chunk, but are
+	// returned in order.
+	assert.Len(t, s.chunkDescs, 1)
+	assert.Len(t, s.outOfOrder, 3)
+	values, err := s.samplesForRange(0, 10000)
+	require.NoError(t, err)
+	expected := []model.SamplePair{}
+	for ts := model.Time(1000); ts <= 6000; ts += 1000 {
+		expected = append(expected, model.SamplePair{Timestamp: ts, Value: model.SampleValue(ts)})
+	}
+	assert.Equal(t, expected, values)
+
+	values, err = s.samplesForRange(2500, 4500)
+	require.NoError(t, err)
+	assert.Equal(t, expected[2:4], values)
+
+	// Retries of samples are ignored, wherever they are held, but other
+	// values at the same time are rejected.
+	for _, ts := range []model.Time{1000, 2000, 3000} {
+		require.NoError(t, s.add(model.SamplePair{Timestamp: ts, Value: model.SampleValue(ts)}, time.Minute))
+		assert.Equal(t, ErrDuplicateSampleForTimestamp, s.add(model.SamplePair{Timestamp: ts, Value: 1}, time.Minute))
+	}
+	assert.Len(t, s.outOfOrder, 3)
+
+	// Merging puts them all in one chunk.
+	replaced, err := s.mergeOutOfOrder()
+	require.NoError(t, err)
+	assert.Len(t, replaced, 1)
+	assert.Len(t, s.chunkDescs, 1)
+	assert.Empty(t, s.outOfOrder)
+	values, err = s.samplesForRange(0, 10000)
+	require.NoError(t, err)
+	assert.Equal(t, expected, values)
+
+	// And the head can still be appended to.
+	require.NoError(t, s.add(model.SamplePair{Timestamp: 7000, Value: 7000}, time.Minute))
+	values, err = s.samplesForRange(0, 10000)
+	require.NoError(t, err)
+	assert.Equal(t, append(expected, model.SamplePair{Timestamp: 7000, Value: 7000}), values)
+}
+
+func TestSeriesMergeOutOfOrderKeepsEarlierChunks(t *testing.T) {
+	s := newMemorySeries(model.Metric{model.MetricNameLabel: "foo"})
+	require.NoError(t, s.add(model.SamplePair{Timestamp: 1000, Value: 1}, time.Minute))
+	s.closeHead()
+	for _, ts := range []model.Time{5000, 6000, 4000} {
+		require.NoError(t, s.add(model.SamplePair{Timestamp: ts, Value: 1}, time.Minute))
+	}
+	first := s.chunkDescs[0]
+
+	replaced, err := s.mergeOutOfOrder()
+	require.NoError(t, err)
+	assert.Len(t, replaced, 1)
+	require.Len(t, s.chunkDescs, 2)
+	assert.True(t, first == s.chunkDescs[0])
+	assert.Equal(t, model.Time(4000), s.chunkDescs[1].FirstTime)
+	assert.Equal(t, model.Time(6000), s.chunkDescs[1].LastTime)
+}
@@ -0,0 +1,199 @@
+package ingester
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/prometheus/storage/local/chunk"
+)
+
+const spilledChunkSuffix = ".spill"
+
+var spilledChunkReads = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "cortex_ingester_spilled_chunk_reads_total",
+	Help: "The total number of spilled chunks read back from disk, for queries and flushes.",
+})
+
+func init() {
+	prometheus.MustRegister(spilledChunkReads)
+}
+
+// SpillConfig configures moving chunks out of memory onto local disk.
+type SpillConfig struct {
+	Dir             string
+	MaxMemoryChunks int
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet
+func (cfg *SpillConfig) RegisterFlags(f *flag.FlagSet) {
+	f.StringVar(&cfg.Dir, "ingester.spill.dir", "", "Directory to spill closed, unflushed chunks to when there are too many in memory. If empty, chunks are never spilled.")
+	f.IntVar(&cfg.MaxMemoryChunks, "ingester.spill.max-memory-chunks", 0, "Spill closed chunks to disk, until this many chunks are in memory. 0 to disable.")
+}
+
+// spiller moves closed chunks waiting to be flushed from memory to files on
+// local disk, so the ingester can survive a long chunk store outage at the
+// cost of reading them back for queries and flushes. Spilled chunks are not
+// recovered after a restart; the files are only there to save memory.
+type spiller struct {
+	cfg     SpillConfig
+	nextSeq uint64
+
+	spilledChunks prometheus.Gauge
+	spills        prometheus.Counter
+}
+
+func newSpiller(cfg SpillConfig) (*spiller, error) {
+	if err := os.MkdirAll(cfg.Dir, 0777); err != nil {
+		return nil, err
+	}
+
+	// Chunks spilled by a previous process are lost along with the rest of
+	// its memory.
+	files, err := ioutil.ReadDir(cfg.Dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		if strings.HasSuffix(file.Name(), spilledChunkSuffix) {
+			if err := os.Remove(filepath.Join(cfg.Dir, file.Name())); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return &spiller{
+		cfg:     cfg,
+		nextSeq: uint64(time.Now().UnixNano()),
+
+		spilledChunks: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "cortex_ingester_spilled_chunks",
+			Help: "The number of chunks spilled to disk waiting to be flushed.",
+		}),
+		spills: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "cortex_ingester_spilled_chunks_total",
+			Help: "The total number of chunks spilled to disk.",
+		}),
+	}, nil
+}
+
+// spill writes a chunk to disk and drops it from memory. The caller must have
+// locked the fingerprint of the series.
+func (s *spiller) spill(d *desc) error {
+	var buf bytes.Buffer
+	buf.WriteByte(byte(d.C.Encoding()))
+	if err := d.C.Marshal(&buf); err != nil {
+		return err
+	}
+
+	filename := filepath.Join(s.cfg.Dir, fmt.Sprintf("%020d%s", atomic.AddUint64(&s.nextSeq, 1), spilledChunkSuffix))
+	if err := ioutil.WriteFile(filename, buf.Bytes(), 0666); err != nil {
+		return err
+	}
+	d.C = nil
+	d.spilled = filename
+	s.spilledChunks.Inc()
+	s.spills.Inc()
+	return nil
+}
+
+// remove deletes the file of a spilled chunk once it has been flushed.
+func (s *spiller) remove(d *desc) {
+	if d.spilled == "" {
+		return
+	}
+	if err := os.Remove(d.spilled); err != nil {
+		log.Errorf("Error removing spilled chunk %s: %v", d.spilled, err)
+	}
+	d.spilled = ""
+	s.spilledChunks.Dec()
+}
+
+// loadSpilledChunk reads a chunk spilled to disk.
+func loadSpilledChunk(filename string) (chunk.Chunk, error) {
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) == 0 {
+		return nil, fmt.Errorf("empty spilled chunk %s", filename)
+	}
+	c, err := chunk.NewForEncoding(chunk.Encoding(buf[0]))
+	if err != nil {
+		return nil, err
+	}
+	if err := c.UnmarshalFromBuf(buf[1:]); err != nil {
+		return nil, err
+	}
+	spilledChunkReads.Inc()
+	return c, nil
+}
+
+// spillChunks spills closed chunks until no more than MaxMemoryChunks are in
+// memory, or there are no closed chunks left in memory.
+func (i *Ingester) spillChunks() {
+	inMemory := 0
+	for _, state := range i.userStates.cp() {
+		for pair := range state.fpToSeries.iter() {
+			state.fpLocker.Lock(pair.fp)
+			for _, d := range pair.series.chunkDescs {
+				if d.C != nil {
+					inMemory++
+				}
+			}
+			state.fpLocker.Unlock(pair.fp)
+		}
+	}
+
+	toSpill := inMemory - i.cfg.SpillConfig.MaxMemoryChunks
+	if toSpill <= 0 {
+		return
+	}
+	// The series iterators must be drained, so keep iterating once done.
+	spilled, failed := 0, false
+	for _, state := range i.userStates.cp() {
+		for pair := range state.fpToSeries.iter() {
+			if failed || spilled >= toSpill {
+				continue
+			}
+			state.fpLocker.Lock(pair.fp)
+			for _, d := range pair.series.closedChunks() {
+				if spilled >= toSpill {
+					break
+				}
+				if d.C == nil {
+					continue
+				}
+				if err := i.spiller.spill(d); err != nil {
+					log.Errorf("Error spilling chunk: %v", err)
+					failed = true
+					break
+				}
+				spilled++
+			}
+			state.fpLocker.Unlock(pair.fp)
+		}
+	}
+	i.memoryChunks.Sub(float64(spilled))
+	log.Infof("Spilled %d chunks to disk", spilled)
+}
+
+// Describe implements prometheus.Collector.
+func (s *spiller) Describe(ch chan<- *prometheus.Desc) {
+	ch <- s.spilledChunks.Desc()
+	ch <- s.spills.Desc()
+}
+
+// Collect implements prometheus.Collector.
+func (s *spiller) Collect(ch chan<- prometheus.Metric) {
+	ch <- s.spilledChunks
+	ch <- s.spills
+}
@@ -0,0 +1,80 @@
+package ingester
+
+import (
+	"io/ioutil"
+	"os"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex/chunk"
+	"github.com/weaveworks/cortex/util"
+)
+
+func TestIngesterSpill(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spill")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	cfg := Config{
+		FlushCheckPeriod: 99999 * time.Hour,
+		MaxChunkIdle:     99999 * time.Hour,
+		SpillConfig: SpillConfig{
+			Dir:             dir,
+			MaxMemoryChunks: 10,
+		},
+	}
+	store := &testStore{
+		chunks: map[string][]chunk.Chunk{},
+	}
+	ing, err := New(cfg, store, nil)
+	require.NoError(t, err)
+
+	ctx := user.Inject(context.Background(), "1")
+	testData := buildTestMatrix(10, 1000, 0)
+	_, err = ing.Push(ctx, util.ToWriteRequest(matrixToSamples(testData)))
+	require.NoError(t, err)
+
+	// Only closed chunks are spilled, so the 10 head chunks stay in memory.
+	ing.spillChunks()
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	require.NotEmpty(t, files)
+	state, ok := ing.userStates.get("1")
+	require.True(t, ok)
+	for pair := range state.fpToSeries.iter() {
+		for _, d := range pair.series.closedChunks() {
+			assert.Nil(t, d.C)
+		}
+		assert.NotNil(t, pair.series.head().C)
+	}
+
+	// Queries read the spilled chunks back.
+	matcher, err := metric.NewLabelMatcher(metric.RegexMatch, model.JobLabel, ".+")
+	require.NoError(t, err)
+	req, err := util.ToQueryRequest(model.Earliest, model.Latest, []*metric.LabelMatcher{matcher})
+	require.NoError(t, err)
+	resp, err := ing.Query(ctx, req)
+	require.NoError(t, err)
+	res, err := util.FromQueryResponse(resp)
+	require.NoError(t, err)
+	sort.Sort(res)
+	assert.Equal(t, testData, res)
+
+	// As do flushes, which remove the files.
+	ing.Stop()
+	res, err = chunk.ChunksToMatrix(store.chunks["1"])
+	require.NoError(t, err)
+	sort.Sort(res)
+	assert.Equal(t, testData, res)
+	files, err = ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Empty(t, files)
+}
@@ -0,0 +1,84 @@
+package ingester
+
+import (
+	"sync"
+)
+
+// symbolTable interns the label names and values of an ingester's series, so
+// each string shared by many series is held in memory once, and the indexes
+// can refer to it by a small ID. Symbols are reference counted, and their IDs
+// reused once no longer referenced.
+type symbolTable struct {
+	mtx     sync.RWMutex
+	ids     map[string]uint32
+	symbols []string
+	refs    []uint32
+	free    []uint32
+}
+
+func newSymbolTable() *symbolTable {
+	return &symbolTable{
+		ids: map[string]uint32{},
+	}
+}
+
+// intern returns the ID and canonical copy of s, adding a reference to it.
+func (t *symbolTable) intern(s string) (uint32, string) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	if id, ok := t.ids[s]; ok {
+		t.refs[id]++
+		return id, t.symbols[id]
+	}
+
+	var id uint32
+	if n := len(t.free); n > 0 {
+		id = t.free[n-1]
+		t.free = t.free[:n-1]
+		t.symbols[id] = s
+		t.refs[id] = 1
+	} else {
+		id = uint32(len(t.symbols))
+		t.symbols = append(t.symbols, s)
+		t.refs = append(t.refs, 1)
+	}
+	t.ids[s] = id
+	return id, s
+}
+
+// release removes a reference to the symbol with the given ID, forgetting it
+// when there are none left.
+func (t *symbolTable) release(id uint32) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	t.refs[id]--
+	if t.refs[id] == 0 {
+		delete(t.ids, t.symbols[id])
+		t.symbols[id] = ""
+		t.free = append(t.free, id)
+	}
+}
+
+// lookup returns the ID of s, if it is interned.
+func (t *symbolTable) lookup(s string) (uint32, bool) {
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+	id, ok := t.ids[s]
+	return id, ok
+}
+
+// symbol returns the string with the given ID.
+func (t *symbolTable) symbol(id uint32) string {
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+	return t.symbols[id]
+}
+
+// len returns the number of symbols interned.
+func (t *symbolTable) len() int {
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+	return len(t.ids)
+}
@@ -0,0 +1,36 @@
+package ingester
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSymbolTable(t *testing.T) {
+	symbols := newSymbolTable()
+
+	// Interning the same string twice returns the first copy.
+	foo := string([]byte("foo"))
+	fooID, interned := symbols.intern(foo)
+	otherFooID, otherInterned := symbols.intern(string([]byte("foo")))
+	assert.Equal(t, fooID, otherFooID)
+	assert.Equal(t, interned, otherInterned)
+	barID, _ := symbols.intern("bar")
+	assert.NotEqual(t, fooID, barID)
+	assert.Equal(t, "foo", symbols.symbol(fooID))
+	assert.Equal(t, 2, symbols.len())
+
+	// Symbols are kept until all their references are released...
+	symbols.release(fooID)
+	id, ok := symbols.lookup("foo")
+	assert.True(t, ok)
+	assert.Equal(t, fooID, id)
+
+	// ...after which their IDs are reused.
+	symbols.release(fooID)
+	_, ok = symbols.lookup("foo")
+	assert.False(t, ok)
+	assert.Equal(t, 1, symbols.len())
+	bazID, _ := symbols.intern("baz")
+	assert.Equal(t, fooID, bazID)
+}
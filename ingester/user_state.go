@@ -2,7 +2,9 @@ package ingester
 
 import (
 	"fmt"
+	"math"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/prometheus/common/model"
@@ -14,21 +16,40 @@ import (
 )
 
 type userStates struct {
-	mtx    sync.RWMutex
-	states map[string]*userState
-	cfg    *UserStatesConfig
+	mtx     sync.RWMutex
+	states  map[string]*userState
+	cfg     *UserStatesConfig
+	limiter util.Limiter
+	symbols *symbolTable
 }
 
 type userState struct {
-	userID          string
-	fpLocker        *fingerprintLocker
-	fpToSeries      *seriesMap
-	mapper          *fpMapper
-	index           *invertedIndex
-	ingestedSamples *ewmaRate
+	userID           string
+	fpLocker         *fingerprintLocker
+	fpToSeries       *seriesMap
+	mapper           *fpMapper
+	index            *invertedIndex
+	ingestedSamples  *ewmaRate
+	ingestedBytes    *ewmaRate
+	discardedSamples *ewmaRate
 
 	seriesInMetricMtx sync.Mutex
 	seriesInMetric    map[model.LabelValue]int
+
+	// Estimates of the distinct values of each label with a limit, per
+	// metric.
+	labelValueLimits map[model.LabelName]int
+	labelValuesMtx   sync.Mutex
+	labelValues      map[labelValuesKey]*hyperLogLog
+
+	// When a new series was last refused for exceeding a series limit, as a
+	// model.Time, accessed atomically.
+	seriesLimitedAt int64
+}
+
+type labelValuesKey struct {
+	metricName model.LabelValue
+	labelName  model.LabelName
 }
 
 // UserStatesConfig configures userStates properties.
@@ -38,10 +59,12 @@ type UserStatesConfig struct {
 	MaxSeriesPerMetric int
 }
 
-func newUserStates(cfg *UserStatesConfig) *userStates {
+func newUserStates(cfg *UserStatesConfig, limiter util.Limiter) *userStates {
 	return &userStates{
-		states: map[string]*userState{},
-		cfg:    cfg,
+		states:  map[string]*userState{},
+		cfg:     cfg,
+		limiter: limiter,
+		symbols: newSymbolTable(),
 	}
 }
 
@@ -72,6 +95,8 @@ func (us *userStates) updateRates() {
 
 	for _, state := range us.states {
 		state.ingestedSamples.tick()
+		state.ingestedBytes.tick()
+		state.discardedSamples.tick()
 	}
 }
 
@@ -134,7 +159,7 @@ func (us *userStates) getOrCreateSeries(ctx context.Context, metric model.Metric
 	us.mtx.RLock()
 	state, ok = us.states[userID]
 	if ok {
-		fp, series, err = state.unlockedGet(metric, us.cfg)
+		fp, series, err = state.unlockedGet(metric, us.limiter)
 		if err != nil {
 			us.mtx.RUnlock()
 			return nil, fp, nil, err
@@ -148,7 +173,7 @@ func (us *userStates) getOrCreateSeries(ctx context.Context, metric model.Metric
 	us.mtx.Lock()
 	defer us.mtx.Unlock()
 	state = us.unlockedGetOrCreate(userID)
-	fp, series, err = state.unlockedGet(metric, us.cfg)
+	fp, series, err = state.unlockedGet(metric, us.limiter)
 	return state, fp, series, err
 }
 
@@ -156,12 +181,21 @@ func (us *userStates) unlockedGetOrCreate(userID string) *userState {
 	state, ok := us.states[userID]
 	if !ok {
 		state = &userState{
-			userID:          userID,
-			fpToSeries:      newSeriesMap(),
-			fpLocker:        newFingerprintLocker(16),
-			index:           newInvertedIndex(),
-			ingestedSamples: newEWMARate(0.2, us.cfg.RateUpdatePeriod),
-			seriesInMetric:  map[model.LabelValue]int{},
+			userID:           userID,
+			fpToSeries:       newSeriesMap(),
+			fpLocker:         newFingerprintLocker(16),
+			index:            newInvertedIndex(us.symbols),
+			ingestedSamples:  newEWMARate(0.2, us.cfg.RateUpdatePeriod),
+			ingestedBytes:    newEWMARate(0.2, us.cfg.RateUpdatePeriod),
+			discardedSamples: newEWMARate(0.2, us.cfg.RateUpdatePeriod),
+			seriesInMetric:   map[model.LabelValue]int{},
+			labelValueLimits: map[model.LabelName]int{},
+			labelValues:      map[labelValuesKey]*hyperLogLog{},
+		}
+		for name, limit := range us.limiter.LabelValueLimits(userID) {
+			if limit > 0 {
+				state.labelValueLimits[model.LabelName(name)] = limit
+			}
 		}
 		state.mapper = newFPMapper(state.fpToSeries)
 		us.states[userID] = state
@@ -169,7 +203,7 @@ func (us *userStates) unlockedGetOrCreate(userID string) *userState {
 	return state
 }
 
-func (u *userState) unlockedGet(metric model.Metric, cfg *UserStatesConfig) (model.Fingerprint, *memorySeries, error) {
+func (u *userState) unlockedGet(metric model.Metric, limiter util.SeriesLimiter) (model.Fingerprint, *memorySeries, error) {
 	rawFP := metric.FastFingerprint()
 	u.fpLocker.Lock(rawFP)
 	fp := u.mapper.mapFP(rawFP, metric)
@@ -188,9 +222,15 @@ func (u *userState) unlockedGet(metric model.Metric, cfg *UserStatesConfig) (mod
 	// all proceed to add a new series. This is likely not worth addressing,
 	// as this should happen rarely (all samples from one push are added
 	// serially), and the overshoot in allowed series would be minimal.
-	if u.fpToSeries.length() >= cfg.MaxSeriesPerUser {
+	if maxSeries, numSeries := limiter.MaxSeriesPerUser(u.userID), u.fpToSeries.length(); numSeries >= maxSeries {
 		u.fpLocker.Unlock(fp)
-		return fp, nil, util.ErrUserSeriesLimitExceeded
+		atomic.StoreInt64(&u.seriesLimitedAt, int64(model.Now()))
+		return fp, nil, &util.LimitError{
+			Limit:      util.MaxSeriesPerUserLimit,
+			Configured: float64(maxSeries),
+			Observed:   float64(numSeries),
+			Message:    util.ErrUserSeriesLimitExceeded.Error(),
+		}
 	}
 
 	metricName, err := util.ExtractMetricNameFromMetric(metric)
@@ -199,26 +239,43 @@ func (u *userState) unlockedGet(metric model.Metric, cfg *UserStatesConfig) (mod
 		return fp, nil, err
 	}
 
-	if !u.canAddSeriesFor(metricName, cfg) {
+	maxSeries := limiter.MaxSeriesPerMetric(u.userID)
+	if numSeries, ok := u.canAddSeriesFor(metricName, maxSeries); !ok {
+		u.fpLocker.Unlock(fp)
+		atomic.StoreInt64(&u.seriesLimitedAt, int64(model.Now()))
+		return fp, nil, &util.LimitError{
+			Limit:      util.MaxSeriesPerMetricLimit,
+			Configured: float64(maxSeries),
+			Observed:   float64(numSeries),
+			Message:    util.ErrMetricSeriesLimitExceeded.Error(),
+		}
+	}
+
+	if err := u.addLabelValues(metricName, metric); err != nil {
+		u.removeSeriesFor(metricName)
 		u.fpLocker.Unlock(fp)
-		return fp, nil, util.ErrMetricSeriesLimitExceeded
+		return fp, nil, err
 	}
 
-	series = newMemorySeries(metric)
+	// The series holds the metric with the interned strings, so the decoded
+	// ones can be freed.
+	series = newMemorySeries(u.index.add(metric, fp))
 	u.fpToSeries.put(fp, series)
-	u.index.add(metric, fp)
 	return fp, series, nil
 }
 
-func (u *userState) canAddSeriesFor(metric model.LabelValue, cfg *UserStatesConfig) bool {
+// canAddSeriesFor returns the number of series the metric already has, and
+// whether another can be added without exceeding maxSeries.
+func (u *userState) canAddSeriesFor(metric model.LabelValue, maxSeries int) (int, bool) {
 	u.seriesInMetricMtx.Lock()
 	defer u.seriesInMetricMtx.Unlock()
 
-	if u.seriesInMetric[metric] >= cfg.MaxSeriesPerMetric {
-		return false
+	numSeries := u.seriesInMetric[metric]
+	if numSeries >= maxSeries {
+		return numSeries, false
 	}
 	u.seriesInMetric[metric]++
-	return true
+	return numSeries, true
 }
 
 func (u *userState) removeSeries(fp model.Fingerprint, metric model.Metric) {
@@ -232,6 +289,10 @@ func (u *userState) removeSeries(fp model.Fingerprint, metric model.Metric) {
 		panic(err)
 	}
 
+	u.removeSeriesFor(metricName)
+}
+
+func (u *userState) removeSeriesFor(metricName model.LabelValue) {
 	u.seriesInMetricMtx.Lock()
 	defer u.seriesInMetricMtx.Unlock()
 
@@ -241,15 +302,94 @@ func (u *userState) removeSeries(fp model.Fingerprint, metric model.Metric) {
 	}
 }
 
+// addLabelValues counts the values of the labels of a new series which have
+// limits, unless a label already has as many values in the metric as its
+// limit allows, and no series in memory has this one.
+func (u *userState) addLabelValues(metricName model.LabelValue, metric model.Metric) error {
+	if len(u.labelValueLimits) == 0 {
+		return nil
+	}
+
+	u.labelValuesMtx.Lock()
+	defer u.labelValuesMtx.Unlock()
+
+	// Check all the limits before counting any values, so the values of a
+	// rejected series aren't counted.
+	for name, limit := range u.labelValueLimits {
+		value, ok := metric[name]
+		if !ok {
+			continue
+		}
+		hll, ok := u.labelValues[labelValuesKey{metricName, name}]
+		if !ok {
+			continue
+		}
+		// A value which would change the estimate is new, but one which
+		// wouldn't may be too, so is looked up.
+		if numValues := hll.estimate(); numValues >= float64(limit) && (hll.adds(hllHash(string(value))) || !u.hasLabelValue(metricName, name, value)) {
+			return &util.LimitError{
+				Limit:      util.MaxLabelValuesLimit,
+				Configured: float64(limit),
+				Observed:   math.Floor(numValues),
+				Message:    fmt.Sprintf("%v: %s has too many values of label %s", util.ErrLabelValueLimitExceeded, metricName, name),
+			}
+		}
+	}
+	countLabelValues(u.labelValues, u.labelValueLimits, metricName, metric)
+	return nil
+}
+
+// hasLabelValue returns whether a series of the metric in memory has the
+// label value.
+func (u *userState) hasLabelValue(metricName model.LabelValue, name model.LabelName, value model.LabelValue) bool {
+	return len(u.index.lookup([]*metric.LabelMatcher{
+		{Type: metric.Equal, Name: model.MetricNameLabel, Value: metricName},
+		{Type: metric.Equal, Name: name, Value: value},
+	})) > 0
+}
+
+// resetLabelValues replaces the estimates of the labels' values, which can't
+// forget the values of series which have gone, with ones counted afresh.
+func (u *userState) resetLabelValues(labelValues map[labelValuesKey]*hyperLogLog) {
+	u.labelValuesMtx.Lock()
+	defer u.labelValuesMtx.Unlock()
+	u.labelValues = labelValues
+}
+
+// countLabelValues adds the values of the labels of a series which have limits
+// to the estimates.
+func countLabelValues(labelValues map[labelValuesKey]*hyperLogLog, limits map[model.LabelName]int, metricName model.LabelValue, metric model.Metric) {
+	for name := range limits {
+		value, ok := metric[name]
+		if !ok {
+			continue
+		}
+		key := labelValuesKey{metricName, name}
+		hll, ok := labelValues[key]
+		if !ok {
+			hll = &hyperLogLog{}
+			labelValues[key] = hll
+		}
+		hll.add(hllHash(string(value)))
+	}
+}
+
 // forSeriesMatching passes all series matching the given matchers to the provided callback.
-// Deals with locking and the quirks of zero-length matcher values.
+// Deals with locking, query shards and the quirks of zero-length matcher values.
 func (u *userState) forSeriesMatching(allMatchers []*metric.LabelMatcher, callback func(model.Fingerprint, *memorySeries) error) error {
+	shard, allMatchers, err := util.ExtractQueryShard(allMatchers)
+	if err != nil {
+		return err
+	}
 	filters, matchers := util.SplitFiltersAndMatchers(allMatchers)
 	fps := u.index.lookup(matchers)
 
 	// fps is sorted, lock them in order to prevent deadlocks
 outer:
 	for _, fp := range fps {
+		if shard != nil && !shard.Contains(fp) {
+			continue
+		}
 		u.fpLocker.Lock(fp)
 		series, ok := u.fpToSeries.get(fp)
 		if !ok {
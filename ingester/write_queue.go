@@ -0,0 +1,461 @@
+package ingester
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/user"
+	cortex_chunk "github.com/weaveworks/cortex/chunk"
+	"github.com/weaveworks/cortex/util"
+)
+
+const queuedChunkSuffix = ".chunk"
+
+var (
+	writeQueueLengthDesc = prometheus.NewDesc(
+		"cortex_ingester_write_queue_length",
+		"The number of chunks waiting to be written to the chunk store.",
+		nil, nil,
+	)
+	writeQueueOldestDesc = prometheus.NewDesc(
+		"cortex_ingester_write_queue_oldest_age_seconds",
+		"How long the oldest chunk in the write queue has been waiting to be written.",
+		nil, nil,
+	)
+
+	errWriteQueueFull = fmt.Errorf("chunk store write queue full")
+)
+
+// WriteQueueConfig configures the queue of chunks waiting to be written to the
+// chunk store.
+type WriteQueueConfig struct {
+	Size        int
+	Dir         string
+	Concurrency int
+	MinBackoff  time.Duration
+	MaxBackoff  time.Duration
+	StopTimeout time.Duration
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet
+func (cfg *WriteQueueConfig) RegisterFlags(f *flag.FlagSet) {
+	f.IntVar(&cfg.Size, "ingester.write-queue.size", 0, "Maximum number of flushed chunks waiting to be written to the chunk store; flushes fail when this is reached. 0 to write chunks as they are flushed.")
+	f.StringVar(&cfg.Dir, "ingester.write-queue.dir", "", "Directory in which to persist queued chunks, so they survive restarts. If empty, they are only kept in memory.")
+	f.IntVar(&cfg.Concurrency, "ingester.write-queue.concurrency", 20, "Number of concurrent goroutines writing queued chunks to the chunk store.")
+	f.DurationVar(&cfg.MinBackoff, "ingester.write-queue.min-backoff", 100*time.Millisecond, "Minimum delay before retrying a failed chunk write.")
+	f.DurationVar(&cfg.MaxBackoff, "ingester.write-queue.max-backoff", 10*time.Second, "Maximum delay before retrying a failed chunk write.")
+	f.DurationVar(&cfg.StopTimeout, "ingester.write-queue.stop-timeout", 5*time.Minute, "How long to keep trying to write queued chunks when stopping, if they aren't persisted to -ingester.write-queue.dir. Those still queued after this are lost.")
+}
+
+// writeQueue is a ChunkStore which queues chunks to be written to another
+// ChunkStore in the background, retrying each chunk with backoff until it is
+// written. This decouples flushing from the chunk store, so a slow or
+// throttled store doesn't hold up the flush goroutines, and bounds the memory
+// used by chunks waiting to be written.
+//
+// Queued chunks are no longer in the ingester's series, so it serves them to
+// queries from PendingChunks until they are written.
+type writeQueue struct {
+	cfg   WriteQueueConfig
+	store ChunkStore
+
+	mtx       sync.Mutex
+	cond      *sync.Cond
+	items     []*queuedChunk
+	writing   map[*queuedChunk]struct{}
+	reserved  int // chunks being persisted, not yet queued
+	closing   bool
+	abandoned bool // stopped without writing the remaining chunks
+	nextSeq   uint64
+
+	done sync.WaitGroup
+
+	writes  prometheus.Counter
+	retries prometheus.Counter
+	full    prometheus.Counter
+}
+
+type queuedChunk struct {
+	userID    string
+	chunk     cortex_chunk.Chunk
+	queued    time.Time
+	retries   int
+	notBefore time.Time
+	filename  string
+}
+
+type byQueued []*queuedChunk
+
+func (a byQueued) Len() int           { return len(a) }
+func (a byQueued) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byQueued) Less(i, j int) bool { return a[i].queued.Before(a[j].queued) }
+
+// queuedChunkFile is the format of queued chunks persisted to disk.
+type queuedChunkFile struct {
+	UserID string    `json:"userID"`
+	ID     string    `json:"id"`
+	Queued time.Time `json:"queued"`
+	Data   []byte    `json:"data"`
+}
+
+func newWriteQueue(cfg WriteQueueConfig, store ChunkStore) (*writeQueue, error) {
+	if cfg.Concurrency <= 0 {
+		cfg.Concurrency = 1
+	}
+	q := &writeQueue{
+		cfg:     cfg,
+		store:   store,
+		writing: map[*queuedChunk]struct{}{},
+
+		writes: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "cortex_ingester_write_queue_writes_total",
+			Help: "The total number of queued chunks written to the chunk store.",
+		}),
+		retries: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "cortex_ingester_write_queue_retries_total",
+			Help: "The total number of failed writes of queued chunks, which will be retried.",
+		}),
+		full: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "cortex_ingester_write_queue_full_total",
+			Help: "The total number of flushes which failed as the write queue was full.",
+		}),
+	}
+	q.cond = sync.NewCond(&q.mtx)
+
+	if cfg.Dir != "" {
+		if err := os.MkdirAll(cfg.Dir, 0777); err != nil {
+			return nil, err
+		}
+		if err := q.recover(); err != nil {
+			return nil, err
+		}
+	}
+
+	q.done.Add(cfg.Concurrency)
+	for j := 0; j < cfg.Concurrency; j++ {
+		go q.loop()
+	}
+	return q, nil
+}
+
+// recover queues the chunks persisted by a previous process.
+func (q *writeQueue) recover() error {
+	files, err := ioutil.ReadDir(q.cfg.Dir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), queuedChunkSuffix) {
+			continue
+		}
+		filename := filepath.Join(q.cfg.Dir, file.Name())
+		buf, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return err
+		}
+		var f queuedChunkFile
+		if err := json.Unmarshal(buf, &f); err != nil {
+			log.Errorf("Ignoring corrupt queued chunk %s: %v", filename, err)
+			continue
+		}
+		c := cortex_chunk.Chunk{ID: f.ID}
+		if err := c.Decode(f.Data); err != nil {
+			log.Errorf("Ignoring corrupt queued chunk %s: %v", filename, err)
+			continue
+		}
+		q.items = append(q.items, &queuedChunk{
+			userID:   f.UserID,
+			chunk:    c,
+			queued:   f.Queued,
+			filename: filename,
+		})
+	}
+	sort.Sort(byQueued(q.items))
+	q.nextSeq = uint64(time.Now().UnixNano())
+	if len(q.items) > 0 {
+		log.Infof("Recovered %d queued chunks from %s", len(q.items), q.cfg.Dir)
+	}
+	return nil
+}
+
+// Put implements ChunkStore. The chunks are either all queued, or if the queue
+// doesn't have space for them all, none are.
+func (q *writeQueue) Put(ctx context.Context, chunks []cortex_chunk.Chunk) error {
+	userID, err := user.Extract(ctx)
+	if err != nil {
+		return err
+	}
+
+	q.mtx.Lock()
+	if q.closing {
+		q.mtx.Unlock()
+		return fmt.Errorf("chunk store write queue closed")
+	}
+	// Always accept a batch into an empty queue, so larger batches can't get
+	// stuck.
+	queued := len(q.items) + q.reserved
+	if queued > 0 && queued+len(chunks) > q.cfg.Size {
+		q.mtx.Unlock()
+		q.full.Inc()
+		return errWriteQueueFull
+	}
+	// Reserve room for the chunks while they are persisted, without holding
+	// up other puts.
+	q.reserved += len(chunks)
+	q.mtx.Unlock()
+
+	now := time.Now()
+	items := make([]*queuedChunk, 0, len(chunks))
+	for _, c := range chunks {
+		item := &queuedChunk{
+			userID: userID,
+			chunk:  c,
+			queued: now,
+		}
+		if q.cfg.Dir != "" {
+			if err = q.persist(item); err != nil {
+				for _, item := range items {
+					os.Remove(item.filename)
+				}
+				break
+			}
+		}
+		items = append(items, item)
+	}
+
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	q.reserved -= len(chunks)
+	if err != nil {
+		return err
+	}
+	q.items = append(q.items, items...)
+	q.cond.Broadcast()
+	return nil
+}
+
+// PendingChunks returns the queued chunks matching the matchers, and those the
+// store they are written to can't serve yet.
+func (q *writeQueue) PendingChunks(ctx context.Context, from, through model.Time, matchers ...*metric.LabelMatcher) ([]cortex_chunk.Chunk, error) {
+	userID, err := user.Extract(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var chunks []cortex_chunk.Chunk
+	q.mtx.Lock()
+	for _, item := range q.items {
+		if item.userID == userID {
+			chunks = append(chunks, item.chunk)
+		}
+	}
+	for item := range q.writing {
+		if item.userID == userID {
+			chunks = append(chunks, item.chunk)
+		}
+	}
+	q.mtx.Unlock()
+
+	result, err := cortex_chunk.FilterChunks(chunks, from, through, matchers...)
+	if err != nil {
+		return nil, err
+	}
+	if store, ok := q.store.(pendingChunkStore); ok {
+		pending, err := store.PendingChunks(ctx, from, through, matchers...)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, pending...)
+	}
+	return result, nil
+}
+
+func (q *writeQueue) persist(item *queuedChunk) error {
+	data, err := item.chunk.Encode()
+	if err != nil {
+		return err
+	}
+	buf, err := json.Marshal(queuedChunkFile{
+		UserID: item.userID,
+		ID:     item.chunk.ID,
+		Queued: item.queued,
+		Data:   data,
+	})
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file and rename, so recovery never sees a partial
+	// chunk.
+	seq := atomic.AddUint64(&q.nextSeq, 1)
+	filename := filepath.Join(q.cfg.Dir, fmt.Sprintf("%020d%s", seq, queuedChunkSuffix))
+	if err := ioutil.WriteFile(filename+".tmp", buf, 0666); err != nil {
+		return err
+	}
+	if err := os.Rename(filename+".tmp", filename); err != nil {
+		return err
+	}
+	item.filename = filename
+	return nil
+}
+
+func (q *writeQueue) dequeue() *queuedChunk {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	for len(q.items) == 0 || q.stopNow() {
+		if q.closing {
+			return nil
+		}
+		q.cond.Wait()
+	}
+	item := q.items[0]
+	q.items = q.items[1:]
+	q.writing[item] = struct{}{}
+	return item
+}
+
+func (q *writeQueue) loop() {
+	defer q.done.Done()
+
+	for {
+		item := q.dequeue()
+		if item == nil {
+			return
+		}
+
+		// Failed chunks go to the back of the queue, so by the time they
+		// reach the front again they've usually waited long enough.
+		if wait := item.notBefore.Sub(time.Now()); wait > 0 {
+			time.Sleep(wait)
+		}
+
+		ctx := util.InjectRequestID(user.Inject(context.Background(), item.userID), util.NewRequestID())
+		if err := q.store.Put(ctx, []cortex_chunk.Chunk{item.chunk}); err != nil {
+			util.WithRequestID(ctx).Errorf("Failed to write chunk %s for user %s, will retry: %v", item.chunk.ID, item.userID, err)
+			q.retries.Inc()
+			item.retries++
+			item.notBefore = time.Now().Add(q.backoff(item.retries))
+			q.mtx.Lock()
+			delete(q.writing, item)
+			if !q.stopNow() {
+				q.items = append(q.items, item)
+			}
+			q.mtx.Unlock()
+			continue
+		}
+
+		q.mtx.Lock()
+		delete(q.writing, item)
+		q.mtx.Unlock()
+		q.writes.Inc()
+		if item.filename != "" {
+			if err := os.Remove(item.filename); err != nil {
+				log.Warnf("Failed to remove written chunk %s: %v", item.filename, err)
+			}
+		}
+	}
+}
+
+// stopNow returns true if the queue is stopping and doesn't need to be drained,
+// as the queued chunks are on disk, or has given up draining. Must be called
+// with mtx held.
+func (q *writeQueue) stopNow() bool {
+	return q.closing && (q.cfg.Dir != "" || q.abandoned)
+}
+
+func (q *writeQueue) backoff(retries int) time.Duration {
+	backoff := q.cfg.MinBackoff
+	for j := 1; j < retries && backoff < q.cfg.MaxBackoff; j++ {
+		backoff *= 2
+	}
+	if backoff > q.cfg.MaxBackoff {
+		backoff = q.cfg.MaxBackoff
+	}
+	return backoff
+}
+
+// Stop waits for all queued chunks to be written, for up to StopTimeout. If
+// they are persisted to disk, it returns straight away, leaving them to be
+// written after restart.
+func (q *writeQueue) Stop() {
+	q.mtx.Lock()
+	q.closing = true
+	q.cond.Broadcast()
+	q.mtx.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		q.done.Wait()
+		close(done)
+	}()
+	var timeout <-chan time.Time
+	if q.cfg.Dir == "" && q.cfg.StopTimeout > 0 {
+		timeout = time.After(q.cfg.StopTimeout)
+	}
+	select {
+	case <-done:
+	case <-timeout:
+		// Writes in progress are left to finish or fail on their own.
+		q.mtx.Lock()
+		q.abandoned = true
+		lost := len(q.items) + len(q.writing)
+		q.items = nil
+		q.cond.Broadcast()
+		q.mtx.Unlock()
+		log.Errorf("Gave up writing %d queued chunks to the chunk store after %v", lost, q.cfg.StopTimeout)
+	}
+}
+
+func (q *writeQueue) lengthAndOldest() (int, time.Duration) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	var oldest time.Duration
+	for _, item := range q.items {
+		if age := time.Since(item.queued); age > oldest {
+			oldest = age
+		}
+	}
+	return len(q.items), oldest
+}
+
+// Describe implements prometheus.Collector.
+func (q *writeQueue) Describe(ch chan<- *prometheus.Desc) {
+	ch <- writeQueueLengthDesc
+	ch <- writeQueueOldestDesc
+	ch <- q.writes.Desc()
+	ch <- q.retries.Desc()
+	ch <- q.full.Desc()
+}
+
+// Collect implements prometheus.Collector.
+func (q *writeQueue) Collect(ch chan<- prometheus.Metric) {
+	length, oldest := q.lengthAndOldest()
+	ch <- prometheus.MustNewConstMetric(
+		writeQueueLengthDesc,
+		prometheus.GaugeValue,
+		float64(length),
+	)
+	ch <- prometheus.MustNewConstMetric(
+		writeQueueOldestDesc,
+		prometheus.GaugeValue,
+		oldest.Seconds(),
+	)
+	ch <- q.writes
+	ch <- q.retries
+	ch <- q.full
+}
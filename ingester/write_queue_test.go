@@ -0,0 +1,262 @@
+package ingester
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/local/chunk"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/user"
+	cortex_chunk "github.com/weaveworks/cortex/chunk"
+)
+
+// flakyStore fails the first failures writes, and blocks writes until
+// unblocked if block is set.
+type flakyStore struct {
+	testStore
+	failures int
+	block    chan struct{}
+}
+
+func (s *flakyStore) Put(ctx context.Context, chunks []cortex_chunk.Chunk) error {
+	if s.block != nil {
+		<-s.block
+	}
+	s.mtx.Lock()
+	if s.failures != 0 {
+		s.failures--
+		s.mtx.Unlock()
+		return fmt.Errorf("throttled")
+	}
+	s.mtx.Unlock()
+	return s.testStore.Put(ctx, chunks)
+}
+
+func newFlakyStore(failures int) *flakyStore {
+	return &flakyStore{
+		testStore: testStore{chunks: map[string][]cortex_chunk.Chunk{}},
+		failures:  failures,
+	}
+}
+
+func makeTestChunks(n int) []cortex_chunk.Chunk {
+	var chunks []cortex_chunk.Chunk
+	for i := 0; i < n; i++ {
+		cs, err := chunk.New().Add(model.SamplePair{Timestamp: model.Time(i), Value: model.SampleValue(i)})
+		if err != nil {
+			panic(err)
+		}
+		metric := model.Metric{model.MetricNameLabel: model.LabelValue(fmt.Sprintf("foo%d", i))}
+		chunks = append(chunks, cortex_chunk.NewChunk(model.Fingerprint(i), metric, cs[0], model.Time(i), model.Time(i)))
+	}
+	return chunks
+}
+
+func storedChunkIDs(s *flakyStore, userID string) []string {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	var ids []string
+	for _, c := range s.chunks[userID] {
+		ids = append(ids, c.ID)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func chunkIDs(chunks []cortex_chunk.Chunk) []string {
+	var ids []string
+	for _, c := range chunks {
+		ids = append(ids, c.ID)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func TestWriteQueueRetries(t *testing.T) {
+	store := newFlakyStore(5)
+	q, err := newWriteQueue(WriteQueueConfig{
+		Size:        10,
+		Concurrency: 2,
+		MinBackoff:  time.Millisecond,
+		MaxBackoff:  2 * time.Millisecond,
+	}, store)
+	require.NoError(t, err)
+
+	chunks := makeTestChunks(3)
+	require.NoError(t, q.Put(user.Inject(context.Background(), "1"), chunks))
+
+	// Stopping waits for the chunks to be written.
+	q.Stop()
+	assert.Equal(t, chunkIDs(chunks), storedChunkIDs(store, "1"))
+	assert.Equal(t, 5.0, counterValue(t, q.retries))
+	assert.Equal(t, 3.0, counterValue(t, q.writes))
+}
+
+func TestWriteQueueFull(t *testing.T) {
+	store := newFlakyStore(0)
+	store.block = make(chan struct{})
+	q, err := newWriteQueue(WriteQueueConfig{
+		Size:        2,
+		Concurrency: 1,
+	}, store)
+	require.NoError(t, err)
+
+	ctx := user.Inject(context.Background(), "1")
+	chunks := makeTestChunks(5)
+	require.NoError(t, q.Put(ctx, chunks[:2]))
+
+	// At most one chunk can be being written, so there's no room for 3 more.
+	assert.Equal(t, errWriteQueueFull, q.Put(ctx, chunks[2:]))
+	assert.Equal(t, 1.0, counterValue(t, q.full))
+
+	close(store.block)
+	q.Stop()
+	assert.Equal(t, chunkIDs(chunks[:2]), storedChunkIDs(store, "1"))
+}
+
+func TestWriteQueuePersistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "write-queue")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	cfg := WriteQueueConfig{
+		Size:        10,
+		Dir:         dir,
+		Concurrency: 1,
+		MinBackoff:  time.Millisecond,
+		MaxBackoff:  time.Millisecond,
+	}
+
+	// Queued chunks which can't be written are left on disk when stopping.
+	store := newFlakyStore(-1)
+	q, err := newWriteQueue(cfg, store)
+	require.NoError(t, err)
+	chunks := makeTestChunks(3)
+	require.NoError(t, q.Put(user.Inject(context.Background(), "1"), chunks[:2]))
+	require.NoError(t, q.Put(user.Inject(context.Background(), "2"), chunks[2:]))
+	q.Stop()
+	assert.Empty(t, storedChunkIDs(store, "1"))
+
+	// And are written by the next queue.
+	store = newFlakyStore(0)
+	q, err = newWriteQueue(cfg, store)
+	require.NoError(t, err)
+	for i := 0; i < 100; i++ {
+		if length, _ := q.lengthAndOldest(); length == 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	q.Stop()
+	assert.Equal(t, chunkIDs(chunks[:2]), storedChunkIDs(store, "1"))
+	assert.Equal(t, chunkIDs(chunks[2:]), storedChunkIDs(store, "2"))
+
+	store.mtx.Lock()
+	defer store.mtx.Unlock()
+	assert.Equal(t, chunks[2].Metric, store.chunks["2"][0].Metric)
+
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Empty(t, files)
+}
+
+func TestWriteQueueConcurrentPuts(t *testing.T) {
+	store := newFlakyStore(0)
+	q, err := newWriteQueue(WriteQueueConfig{
+		Size:        1000,
+		Concurrency: 4,
+	}, store)
+	require.NoError(t, err)
+
+	chunks := makeTestChunks(100)
+	var wg sync.WaitGroup
+	for i := range chunks {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			assert.NoError(t, q.Put(user.Inject(context.Background(), "1"), chunks[i:i+1]))
+		}(i)
+	}
+	wg.Wait()
+	q.Stop()
+	assert.Equal(t, chunkIDs(chunks), storedChunkIDs(store, "1"))
+}
+
+func TestWriteQueuePendingChunks(t *testing.T) {
+	store := newFlakyStore(0)
+	store.block = make(chan struct{})
+	q, err := newWriteQueue(WriteQueueConfig{
+		Size:        10,
+		Concurrency: 1,
+	}, store)
+	require.NoError(t, err)
+
+	ctx := user.Inject(context.Background(), "1")
+	chunks := makeTestChunks(3)
+	require.NoError(t, q.Put(ctx, chunks))
+	require.NoError(t, q.Put(user.Inject(context.Background(), "2"), makeTestChunks(1)))
+
+	// Chunks are pending whether queued or being written.
+	pending, err := q.PendingChunks(ctx, 0, 10)
+	require.NoError(t, err)
+	assert.Equal(t, chunkIDs(chunks), sortedChunkIDs(pending))
+	pending, err = q.PendingChunks(ctx, 1, 1)
+	require.NoError(t, err)
+	assert.Equal(t, chunkIDs(chunks[1:2]), chunkIDs(pending))
+
+	close(store.block)
+	q.Stop()
+	pending, err = q.PendingChunks(ctx, 0, 10)
+	require.NoError(t, err)
+	assert.Empty(t, pending)
+}
+
+func TestWriteQueueStopTimeout(t *testing.T) {
+	store := newFlakyStore(-1)
+	q, err := newWriteQueue(WriteQueueConfig{
+		Size:        10,
+		Concurrency: 2,
+		MinBackoff:  time.Millisecond,
+		MaxBackoff:  time.Millisecond,
+		StopTimeout: 50 * time.Millisecond,
+	}, store)
+	require.NoError(t, err)
+	require.NoError(t, q.Put(user.Inject(context.Background(), "1"), makeTestChunks(3)))
+
+	// Chunks which can never be written don't hold up stopping for ever.
+	stopped := make(chan struct{})
+	go func() {
+		q.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stopping the write queue timed out")
+	}
+	assert.Empty(t, storedChunkIDs(store, "1"))
+}
+
+func sortedChunkIDs(chunks []cortex_chunk.Chunk) []string {
+	ids := chunkIDs(chunks)
+	sort.Strings(ids)
+	return ids
+}
+
+func counterValue(t *testing.T, c prometheus.Counter) float64 {
+	var m dto.Metric
+	if err := c.Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetCounter().GetValue()
+}
@@ -0,0 +1,214 @@
+package querier
+
+import (
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/local"
+	"github.com/prometheus/prometheus/storage/metric"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex/util"
+)
+
+// NewAliasingQueryable makes queries of the old names of the metrics and
+// labels tenants' overrides have the distributor rename also read the renamed
+// series, under their old names, so dashboards keep working while they are
+// migrated. Only queries with an equality matcher on an old metric name, or
+// any matcher on an old label name, are aliased.
+func NewAliasingQueryable(queryable Queryable, overridesFile string) (Queryable, error) {
+	if overridesFile == "" {
+		return queryable, nil
+	}
+	overrides, err := util.LoadOverrides(overridesFile)
+	if err != nil {
+		return queryable, err
+	}
+	renames := map[string]util.Overrides{}
+	for userID, o := range overrides {
+		if len(o.MetricRenames) > 0 || len(o.LabelRenames) > 0 {
+			renames[userID] = o
+		}
+	}
+	if len(renames) > 0 {
+		queryable.Q = aliasQuerier{Querier: queryable.Q, renames: renames}
+	}
+	return queryable, nil
+}
+
+type aliasQuerier struct {
+	local.Querier
+	renames map[string]util.Overrides
+}
+
+// alias is how the matchers of a query of old names are rewritten to match
+// the renamed series, and how to give those series back their old names.
+type alias struct {
+	matchers      []*metric.LabelMatcher
+	metricName    model.LabelValue
+	renamedMetric model.LabelValue
+	renamedLabels map[model.LabelName]model.LabelName
+}
+
+func (q aliasQuerier) aliasFor(ctx context.Context, matchers []*metric.LabelMatcher) (alias, bool) {
+	userID, err := user.Extract(ctx)
+	if err != nil {
+		return alias{}, false
+	}
+	o, ok := q.renames[userID]
+	if !ok {
+		return alias{}, false
+	}
+
+	// The distributor renames all the labels of a series, so a renamed series
+	// gets all its old label names back.
+	a := alias{
+		matchers:      make([]*metric.LabelMatcher, 0, len(matchers)),
+		renamedLabels: make(map[model.LabelName]model.LabelName, len(o.LabelRenames)),
+	}
+	for old, renamed := range o.LabelRenames {
+		a.renamedLabels[model.LabelName(renamed)] = model.LabelName(old)
+	}
+	aliased := false
+	for _, m := range matchers {
+		name, value := m.Name, m.Value
+		if name == model.MetricNameLabel && m.Type == metric.Equal {
+			if renamed, ok := o.MetricRenames[string(value)]; ok {
+				a.metricName, a.renamedMetric = value, model.LabelValue(renamed)
+				value = a.renamedMetric
+			}
+		} else if renamed, ok := o.LabelRenames[string(name)]; ok {
+			name = model.LabelName(renamed)
+		}
+		if name == m.Name && value == m.Value {
+			a.matchers = append(a.matchers, m)
+			continue
+		}
+		matcher, err := metric.NewLabelMatcher(m.Type, name, value)
+		if err != nil {
+			// The value is unchanged for all but equality matchers.
+			return alias{}, false
+		}
+		a.matchers = append(a.matchers, matcher)
+		aliased = true
+	}
+	return a, aliased
+}
+
+// unalias gives a renamed series its old names.
+func (a alias) unalias(m model.Metric) model.Metric {
+	result := make(model.Metric, len(m))
+	for name, value := range m {
+		if name == model.MetricNameLabel && a.renamedMetric != "" && value == a.renamedMetric {
+			value = a.metricName
+		} else if old, ok := a.renamedLabels[name]; ok {
+			name = old
+		}
+		result[name] = value
+	}
+	return result
+}
+
+// merge adds the renamed series, under their old names, to those of the old
+// names, merging any which are then the same series.
+func (a alias) merge(iterators, renamed []local.SeriesIterator) []local.SeriesIterator {
+	fpToIts := map[model.Fingerprint][]local.SeriesIterator{}
+	var fps []model.Fingerprint
+	add := func(it local.SeriesIterator) {
+		fp := it.Metric().Metric.Fingerprint()
+		if _, ok := fpToIts[fp]; !ok {
+			fps = append(fps, fp)
+		}
+		fpToIts[fp] = append(fpToIts[fp], it)
+	}
+	for _, it := range iterators {
+		add(it)
+	}
+	for _, it := range renamed {
+		add(aliasedIterator{SeriesIterator: it, metric: a.unalias(it.Metric().Metric)})
+	}
+
+	result := make([]local.SeriesIterator, 0, len(fps))
+	for _, fp := range fps {
+		if its := fpToIts[fp]; len(its) == 1 {
+			result = append(result, its[0])
+		} else {
+			result = append(result, mergeIterator{its: its})
+		}
+	}
+	return result
+}
+
+func (q aliasQuerier) QueryRange(ctx context.Context, from, through model.Time, matchers ...*metric.LabelMatcher) ([]local.SeriesIterator, error) {
+	a, ok := q.aliasFor(ctx, matchers)
+	if !ok {
+		return q.Querier.QueryRange(ctx, from, through, matchers...)
+	}
+	iterators, err := q.Querier.QueryRange(ctx, from, through, matchers...)
+	if err != nil {
+		return nil, err
+	}
+	renamed, err := q.Querier.QueryRange(ctx, from, through, a.matchers...)
+	if err != nil {
+		return nil, err
+	}
+	return a.merge(iterators, renamed), nil
+}
+
+func (q aliasQuerier) QueryInstant(ctx context.Context, ts model.Time, stalenessDelta time.Duration, matchers ...*metric.LabelMatcher) ([]local.SeriesIterator, error) {
+	a, ok := q.aliasFor(ctx, matchers)
+	if !ok {
+		return q.Querier.QueryInstant(ctx, ts, stalenessDelta, matchers...)
+	}
+	iterators, err := q.Querier.QueryInstant(ctx, ts, stalenessDelta, matchers...)
+	if err != nil {
+		return nil, err
+	}
+	renamed, err := q.Querier.QueryInstant(ctx, ts, stalenessDelta, a.matchers...)
+	if err != nil {
+		return nil, err
+	}
+	return a.merge(iterators, renamed), nil
+}
+
+func (q aliasQuerier) MetricsForLabelMatchers(ctx context.Context, from, through model.Time, matcherSets ...metric.LabelMatchers) ([]metric.Metric, error) {
+	metrics, err := q.Querier.MetricsForLabelMatchers(ctx, from, through, matcherSets...)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := map[model.Fingerprint]struct{}{}
+	for _, m := range metrics {
+		seen[m.Metric.Fingerprint()] = struct{}{}
+	}
+	for _, matchers := range matcherSets {
+		a, ok := q.aliasFor(ctx, matchers)
+		if !ok {
+			continue
+		}
+		renamed, err := q.Querier.MetricsForLabelMatchers(ctx, from, through, a.matchers)
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range renamed {
+			old := a.unalias(m.Metric)
+			if _, ok := seen[old.Fingerprint()]; ok {
+				continue
+			}
+			seen[old.Fingerprint()] = struct{}{}
+			metrics = append(metrics, metric.Metric{Metric: old})
+		}
+	}
+	return metrics, nil
+}
+
+// aliasedIterator is a renamed series under its old names.
+type aliasedIterator struct {
+	local.SeriesIterator
+	metric model.Metric
+}
+
+func (it aliasedIterator) Metric() metric.Metric {
+	return metric.Metric{Metric: it.metric}
+}
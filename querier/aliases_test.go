@@ -0,0 +1,107 @@
+package querier
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/user"
+)
+
+// matchingQuerier returns the series of its matrix matching the matchers.
+type matchingQuerier struct {
+	matrixQuerier
+}
+
+func (q matchingQuerier) Query(ctx context.Context, from, to model.Time, matchers ...*metric.LabelMatcher) (model.Matrix, error) {
+	result := model.Matrix{}
+outer:
+	for _, ss := range q.matrix {
+		for _, m := range matchers {
+			if !m.Match(ss.Metric[m.Name]) {
+				continue outer
+			}
+		}
+		result = append(result, ss)
+	}
+	return result, nil
+}
+
+func (q matchingQuerier) MetricsForLabelMatchers(ctx context.Context, from, through model.Time, matcherSets ...metric.LabelMatchers) ([]metric.Metric, error) {
+	var result []metric.Metric
+	for _, matchers := range matcherSets {
+		matrix, _ := q.Query(ctx, from, through, matchers...)
+		for _, ss := range matrix {
+			result = append(result, metric.Metric{Metric: ss.Metric})
+		}
+	}
+	return result, nil
+}
+
+func TestAliasingQueryable(t *testing.T) {
+	f, err := ioutil.TempFile("", "overrides")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(`
+overrides:
+  migrating:
+    metric_renames:
+      http_requests: http_requests_total
+    label_renames:
+      hostname: instance
+`)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	// The series' samples before the rename are under the old names, and
+	// those after under the new.
+	q := matchingQuerier{matrixQuerier{model.Matrix{
+		{Metric: model.Metric{"__name__": "http_requests", "hostname": "a"}, Values: makeSamples(0, 10, 1)},
+		{Metric: model.Metric{"__name__": "http_requests_total", "instance": "a"}, Values: makeSamples(11, 20, 1)},
+	}}}
+	queryable, err := NewAliasingQueryable(Queryable{Q: MergeQuerier{Queriers: []Querier{q}}}, f.Name())
+	require.NoError(t, err)
+	querier, err := queryable.Querier()
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		user     string
+		name     model.LabelValue
+		expected []model.Metric
+		samples  int
+	}{
+		// The old names read both, under the old names.
+		{"migrating", "http_requests", []model.Metric{{"__name__": "http_requests", "hostname": "a"}}, 21},
+		{"migrating", "http_requests_total", []model.Metric{{"__name__": "http_requests_total", "instance": "a"}}, 10},
+		{"other", "http_requests", []model.Metric{{"__name__": "http_requests", "hostname": "a"}}, 11},
+	} {
+		ctx := user.Inject(context.Background(), tc.user)
+		matcher, err := metric.NewLabelMatcher(metric.Equal, model.MetricNameLabel, tc.name)
+		require.NoError(t, err)
+		iterators, err := querier.QueryRange(ctx, 0, 20, matcher)
+		require.NoError(t, err)
+
+		metrics := []model.Metric{}
+		samples := 0
+		for _, it := range iterators {
+			metrics = append(metrics, it.Metric().Metric)
+			samples += len(it.RangeValues(metric.Interval{OldestInclusive: 0, NewestInclusive: 20}))
+		}
+		assert.Equal(t, tc.expected, metrics, "%s: %s", tc.user, tc.name)
+		assert.Equal(t, tc.samples, samples, "%s: %s", tc.user, tc.name)
+	}
+
+	// As do the old label names, of any metric.
+	ctx := user.Inject(context.Background(), "migrating")
+	matcher, err := metric.NewLabelMatcher(metric.Equal, "hostname", "a")
+	require.NoError(t, err)
+	series, err := querier.MetricsForLabelMatchers(ctx, 0, 20, metric.LabelMatchers{matcher})
+	require.NoError(t, err)
+	assert.Len(t, series, 2)
+}
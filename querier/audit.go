@@ -0,0 +1,289 @@
+package querier
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log/syslog"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql"
+
+	"github.com/weaveworks/common/user"
+)
+
+const redacted = "<redacted>"
+
+var auditFailures = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: "cortex",
+	Name:      "querier_audit_failures_total",
+	Help:      "The total number of queries which failed to be recorded in the audit log.",
+})
+
+func init() {
+	prometheus.MustRegister(auditFailures)
+}
+
+// AuditConfig configures the audit log of queries.
+type AuditConfig struct {
+	Sink       string
+	File       string
+	SyslogTag  string
+	UserHeader string
+	Redactions regexps
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet
+func (cfg *AuditConfig) RegisterFlags(f *flag.FlagSet) {
+	f.StringVar(&cfg.Sink, "querier.audit.sink", "", "Where to record every query for auditing: file or syslog. Empty to disable.")
+	f.StringVar(&cfg.File, "querier.audit.file", "audit.log", "File the audit sink appends queries to, one JSON object per line.")
+	f.StringVar(&cfg.SyslogTag, "querier.audit.syslog-tag", "cortex-querier", "Tag of the queries the syslog audit sink sends.")
+	f.StringVar(&cfg.UserHeader, "querier.audit.user-header", "X-Scope-User", "Header of the end user making the query, as set by the auth proxy, to record.")
+	f.Var(&cfg.Redactions, "querier.audit.redact", "Regular expression of sensitive parts of label values in recorded queries, which are replaced with "+redacted+" (may be repeated).")
+}
+
+// regexps is a flag.Value of repeated regular expressions.
+type regexps []*regexp.Regexp
+
+// String implements flag.Value
+func (r regexps) String() string {
+	strs := make([]string, 0, len(r))
+	for _, re := range r {
+		strs = append(strs, re.String())
+	}
+	return strings.Join(strs, ",")
+}
+
+// Set implements flag.Value
+func (r *regexps) Set(s string) error {
+	re, err := regexp.Compile(s)
+	if err != nil {
+		return err
+	}
+	*r = append(*r, re)
+	return nil
+}
+
+// AuditRecord is the record of one query.
+type AuditRecord struct {
+	Time     time.Time `json:"time"`
+	Tenant   string    `json:"tenant"`
+	User     string    `json:"user,omitempty"`
+	Path     string    `json:"path"`
+	Query    string    `json:"query"`
+	Start    string    `json:"start,omitempty"`
+	End      string    `json:"end,omitempty"`
+	Step     string    `json:"step,omitempty"`
+	Status   int       `json:"status"`
+	Series   int       `json:"series"`
+	Duration float64   `json:"duration_seconds"`
+	// Fingerprint is a hash of the response, so the result a tenant got can
+	// later be checked without recording it.
+	Fingerprint string `json:"fingerprint"`
+}
+
+// AuditSink records queries. Programs embedding the querier can provide
+// their own, eg. to send them to Kafka.
+type AuditSink interface {
+	Record(AuditRecord) error
+}
+
+// Audit is HTTP middleware recording every query, instant, range or series,
+// to a sink. It must be used after the user has been authenticated.
+type Audit struct {
+	sink       AuditSink
+	userHeader string
+	redactions []*regexp.Regexp
+}
+
+// NewAudit makes a new Audit with the configured sink, which does nothing if
+// there is none.
+func NewAudit(cfg AuditConfig) (*Audit, error) {
+	var sink AuditSink
+	switch cfg.Sink {
+	case "":
+	case "file":
+		f, err := os.OpenFile(cfg.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return nil, err
+		}
+		sink = &writerSink{w: f}
+	case "syslog":
+		w, err := syslog.New(syslog.LOG_INFO|syslog.LOG_AUTH, cfg.SyslogTag)
+		if err != nil {
+			return nil, err
+		}
+		sink = &writerSink{w: w}
+	default:
+		return nil, fmt.Errorf("unknown audit sink %q", cfg.Sink)
+	}
+	return NewAuditWithSink(sink, cfg), nil
+}
+
+// NewAuditWithSink makes a new Audit recording queries to the sink.
+func NewAuditWithSink(sink AuditSink, cfg AuditConfig) *Audit {
+	return &Audit{
+		sink:       sink,
+		userHeader: cfg.UserHeader,
+		redactions: cfg.Redactions,
+	}
+}
+
+// Wrap implements middleware.Interface.
+func (a *Audit) Wrap(next http.Handler) http.Handler {
+	if a.sink == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var query string
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/api/v1/query"), strings.HasSuffix(r.URL.Path, "/api/v1/query_range"):
+			query = a.redact(r.FormValue("query"))
+		case strings.HasSuffix(r.URL.Path, "/api/v1/series"):
+			r.ParseForm()
+			matches := make([]string, 0, len(r.Form["match[]"]))
+			for _, match := range r.Form["match[]"] {
+				matches = append(matches, a.redact(match))
+			}
+			query = strings.Join(matches, ", ")
+		default:
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		start := time.Now()
+		rw := &recordingWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rw, r)
+
+		userID, _ := user.Extract(r.Context())
+		hash := fnv.New64a()
+		hash.Write(rw.body.Bytes())
+		record := AuditRecord{
+			Time:        start,
+			Tenant:      userID,
+			User:        r.Header.Get(a.userHeader),
+			Path:        r.URL.Path,
+			Query:       query,
+			Start:       r.FormValue("start"),
+			End:         r.FormValue("end"),
+			Step:        r.FormValue("step"),
+			Status:      rw.status,
+			Series:      countSeries(rw.body.Bytes()),
+			Duration:    time.Since(start).Seconds(),
+			Fingerprint: hex.EncodeToString(hash.Sum(nil)),
+		}
+		if record.Start == "" {
+			record.Start = r.FormValue("time")
+		}
+		if err := a.sink.Record(record); err != nil {
+			auditFailures.Inc()
+		}
+	})
+}
+
+// redact replaces the sensitive parts of the label values of a query's
+// selectors. Queries which don't parse are redacted as a whole.
+func (a *Audit) redact(query string) string {
+	if len(a.redactions) == 0 {
+		return query
+	}
+	expr, err := promql.ParseExpr(query)
+	if err != nil {
+		return a.redactValue(query)
+	}
+	promql.Inspect(expr, func(node promql.Node) bool {
+		switch n := node.(type) {
+		case *promql.VectorSelector:
+			for _, m := range n.LabelMatchers {
+				m.Value = model.LabelValue(a.redactValue(string(m.Value)))
+			}
+		case *promql.MatrixSelector:
+			for _, m := range n.LabelMatchers {
+				m.Value = model.LabelValue(a.redactValue(string(m.Value)))
+			}
+		}
+		return true
+	})
+	return expr.String()
+}
+
+func (a *Audit) redactValue(value string) string {
+	for _, re := range a.redactions {
+		value = re.ReplaceAllString(value, redacted)
+	}
+	return value
+}
+
+// countSeries returns the number of series in a response of the Prometheus
+// API, or 0 if it isn't one.
+func countSeries(body []byte) int {
+	var resp struct {
+		Data json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return 0
+	}
+	var series []json.RawMessage
+	if err := json.Unmarshal(resp.Data, &series); err == nil {
+		return len(series)
+	}
+	var result struct {
+		ResultType string            `json:"resultType"`
+		Result     []json.RawMessage `json:"result"`
+	}
+	if err := json.Unmarshal(resp.Data, &result); err != nil {
+		return 0
+	}
+	switch result.ResultType {
+	case "vector", "matrix":
+		return len(result.Result)
+	default:
+		// Scalars and strings are single values.
+		return 0
+	}
+}
+
+// recordingWriter records the status and body of a response.
+type recordingWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *recordingWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+// writerSink writes records as lines of JSON.
+type writerSink struct {
+	mtx sync.Mutex
+	w   io.Writer
+}
+
+func (s *writerSink) Record(record AuditRecord) error {
+	buf, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	_, err = s.w.Write(append(buf, '\n'))
+	return err
+}
@@ -0,0 +1,61 @@
+package querier
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/weaveworks/common/user"
+)
+
+type memorySink []AuditRecord
+
+func (s *memorySink) Record(record AuditRecord) error {
+	*s = append(*s, record)
+	return nil
+}
+
+func TestAudit(t *testing.T) {
+	var sink memorySink
+	audit := NewAuditWithSink(&sink, AuditConfig{
+		UserHeader: "X-Scope-User",
+		Redactions: regexps{regexp.MustCompile(`[a-z]+@example\.com`)},
+	})
+	handler := audit.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"status":"success","data":{"resultType":"vector","result":[{"metric":{},"value":[1,"1"]},{"metric":{},"value":[1,"2"]}]}}`)
+	}))
+
+	r := httptest.NewRequest("GET", `/api/prom/api/v1/query?query=sum(foo{email="bob@example.com"})&time=10`, nil)
+	r.Header.Set("X-Scope-User", "alice")
+	r = r.WithContext(user.Inject(r.Context(), "tenant"))
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+
+	// Other requests aren't recorded.
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/prom/api/v1/label/foo/values", nil))
+
+	require.Len(t, sink, 1)
+	record := sink[0]
+	assert.Equal(t, "tenant", record.Tenant)
+	assert.Equal(t, "alice", record.User)
+	assert.Equal(t, `sum(foo{email="<redacted>"})`, record.Query)
+	assert.Equal(t, "10", record.Start)
+	assert.Equal(t, http.StatusOK, record.Status)
+	assert.Equal(t, 2, record.Series)
+	assert.Len(t, record.Fingerprint, 16)
+}
+
+func TestCountSeries(t *testing.T) {
+	for body, expected := range map[string]int{
+		`{"data":{"resultType":"matrix","result":[{},{},{}]}}`: 3,
+		`{"data":{"resultType":"scalar","result":[1,"1"]}}`:    0,
+		`{"data":[{"__name__":"foo"}]}`:                        1,
+		`not json`:                                             0,
+	} {
+		assert.Equal(t, expected, countSeries([]byte(body)), body)
+	}
+}
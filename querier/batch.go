@@ -0,0 +1,229 @@
+package querier
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/local"
+	"github.com/prometheus/prometheus/storage/metric"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex/chunk"
+	"github.com/weaveworks/cortex/util"
+)
+
+// batchStore is a ChunkStore which can look up the chunks matching some
+// matchers separately from fetching them, so they can be fetched as their
+// series are read.
+type batchStore interface {
+	LookupChunks(ctx context.Context, from, through model.Time, matchers ...*metric.LabelMatcher) ([]chunk.Chunk, error)
+	FetchChunks(ctx context.Context, chunks []chunk.Chunk) ([]chunk.Chunk, error)
+}
+
+// fingerprintedIterator is a SeriesIterator which knows the fingerprint of its
+// series without loading it.
+type fingerprintedIterator interface {
+	Fingerprint() model.Fingerprint
+}
+
+// seriesFingerprint returns the fingerprint iterators over the same series
+// are merged by. It is the fast fingerprint, as that is what chunk IDs have.
+func seriesFingerprint(it local.SeriesIterator) model.Fingerprint {
+	if f, ok := it.(fingerprintedIterator); ok {
+		return f.Fingerprint()
+	}
+	return it.Metric().Metric.FastFingerprint()
+}
+
+// queryBatches returns iterators over the series matching the matchers,
+// ordered by fingerprint, whose chunks are only fetched when the first series
+// of their batch is read, and released once every series of the batch has
+// been read up to the end of the query. As the engine reads series in order,
+// instant queries have at most a batch of them loaded at once; range queries
+// read every series at each step, so still load them all.
+//
+// The series are identified by the fingerprints in their chunks' IDs, so a
+// series whose fingerprint the ingesters remapped after a collision isn't
+// merged with its samples still in the ingesters.
+func (q *ChunkQuerier) queryBatches(ctx context.Context, store batchStore, from, to model.Time, matchers ...*metric.LabelMatcher) ([]local.SeriesIterator, error) {
+	_, allMatchers, err := util.ExtractQueryShard(matchers)
+	if err != nil {
+		return nil, err
+	}
+	filters, _ := util.SplitFiltersAndMatchers(allMatchers)
+
+	chunks, err := store.LookupChunks(ctx, from, to, matchers...)
+	if err != nil {
+		return nil, err
+	}
+
+	fpToChunks := map[model.Fingerprint][]chunk.Chunk{}
+	for _, c := range chunks {
+		fp, err := c.Fingerprint()
+		if err != nil {
+			return nil, err
+		}
+		fpToChunks[fp] = append(fpToChunks[fp], c)
+	}
+	fps := make(model.Fingerprints, 0, len(fpToChunks))
+	for fp := range fpToChunks {
+		fps = append(fps, fp)
+	}
+	sort.Sort(fps)
+
+	iterators := make([]local.SeriesIterator, 0, len(fps))
+	for i := 0; i < len(fps); i += q.SeriesBatchSize {
+		end := i + q.SeriesBatchSize
+		if end > len(fps) {
+			end = len(fps)
+		}
+		batch := &seriesBatch{
+			ctx:     ctx,
+			store:   store,
+			filters: filters,
+			to:      to,
+		}
+		for _, fp := range fps[i:end] {
+			it := &batchIterator{batch: batch, fp: fp, refs: fpToChunks[fp]}
+			batch.series = append(batch.series, it)
+			iterators = append(iterators, it)
+		}
+		batch.unread = len(batch.series)
+	}
+	return iterators, nil
+}
+
+// seriesBatch fetches the chunks of several series at once.
+type seriesBatch struct {
+	ctx     context.Context
+	store   batchStore
+	filters []*metric.LabelMatcher
+	to      model.Time
+
+	mtx      sync.Mutex
+	series   []*batchIterator
+	loaded   bool
+	released bool
+	keep     bool // never release the chunks again
+	unread   int  // series not read up to the end of the query yet
+}
+
+// load fetches the batch's chunks, if they aren't already. It must be called
+// with mtx held.
+func (b *seriesBatch) load() {
+	if b.loaded {
+		return
+	}
+	if b.released {
+		// Read again after the end of the query, as when the store is only
+		// queried for older samples; refetching at every step would be
+		// worse than keeping the chunks.
+		b.keep = true
+	}
+	var refs []chunk.Chunk
+	for _, it := range b.series {
+		refs = append(refs, it.refs...)
+	}
+	chunks, err := b.store.FetchChunks(b.ctx, refs)
+	if err != nil {
+		// The engine turns errors it panics with into the query's error; the
+		// iterators have no other way to fail.
+		panic(fmt.Errorf("error fetching chunks: %v", err))
+	}
+
+	fpToChunks := map[model.Fingerprint][]chunk.Chunk{}
+	for _, c := range chunks {
+		fp, err := c.Fingerprint()
+		if err != nil {
+			panic(err)
+		}
+		fpToChunks[fp] = append(fpToChunks[fp], c)
+	}
+	for _, it := range b.series {
+		cs := fpToChunks[it.fp]
+		if len(cs) == 0 {
+			continue
+		}
+		it.metric = cs[0].Metric
+		// Series not matching the filters have no samples.
+		if util.MatchesFilters(it.metric, b.filters) {
+			it.chunks = newChunkIterator(cs)
+		}
+	}
+	b.loaded = true
+}
+
+// read records that the series has been read at ts, releasing the batch's
+// chunks once all its series have been read up to the end of the query. It
+// must be called with mtx held.
+func (b *seriesBatch) read(it *batchIterator, ts model.Time) {
+	if b.keep || it.done || ts.Before(b.to) {
+		return
+	}
+	it.done = true
+	b.unread--
+	if b.unread > 0 {
+		return
+	}
+	for _, it := range b.series {
+		it.chunks = nil
+	}
+	b.loaded, b.released = false, true
+}
+
+// batchIterator iterates over a series whose chunks are fetched with those of
+// the rest of its batch.
+type batchIterator struct {
+	batch *seriesBatch
+	fp    model.Fingerprint
+	refs  []chunk.Chunk // without their data
+
+	// Set once the batch is loaded; chunks is nil for a series without
+	// samples, and while the batch is released.
+	metric model.Metric
+	chunks *chunkIterator
+	done   bool // read up to the end of the query
+}
+
+func (it *batchIterator) Fingerprint() model.Fingerprint {
+	return it.fp
+}
+
+func (it *batchIterator) Metric() metric.Metric {
+	it.batch.mtx.Lock()
+	defer it.batch.mtx.Unlock()
+	// The engine asks for the metric after reading a sample, so a released
+	// batch's series keep theirs.
+	if !it.batch.released {
+		it.batch.load()
+	}
+	return metric.Metric{Metric: it.metric}
+}
+
+func (it *batchIterator) ValueAtOrBeforeTime(ts model.Time) model.SamplePair {
+	it.batch.mtx.Lock()
+	defer it.batch.mtx.Unlock()
+	it.batch.load()
+	result := model.ZeroSamplePair
+	if it.chunks != nil {
+		result = it.chunks.ValueAtOrBeforeTime(ts)
+	}
+	it.batch.read(it, ts)
+	return result
+}
+
+func (it *batchIterator) RangeValues(in metric.Interval) []model.SamplePair {
+	it.batch.mtx.Lock()
+	defer it.batch.mtx.Unlock()
+	it.batch.load()
+	var result []model.SamplePair
+	if it.chunks != nil {
+		result = it.chunks.RangeValues(in)
+	}
+	it.batch.read(it, in.NewestInclusive)
+	return result
+}
+
+func (it *batchIterator) Close() {}
@@ -0,0 +1,143 @@
+package querier
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/prometheus/common/model"
+	prom_chunk "github.com/prometheus/prometheus/storage/local/chunk"
+	"github.com/prometheus/prometheus/storage/metric"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex/chunk"
+)
+
+// fetchingStore is a batchStore which records the chunks fetched.
+type fetchingStore struct {
+	chunks  []chunk.Chunk
+	fetches [][]string
+}
+
+func (s *fetchingStore) Get(ctx context.Context, from, through model.Time, matchers ...*metric.LabelMatcher) ([]chunk.Chunk, error) {
+	return s.chunks, nil
+}
+
+func (s *fetchingStore) LookupChunks(ctx context.Context, from, through model.Time, matchers ...*metric.LabelMatcher) ([]chunk.Chunk, error) {
+	refs := make([]chunk.Chunk, 0, len(s.chunks))
+	for _, c := range s.chunks {
+		refs = append(refs, chunk.Chunk{ID: c.ID})
+	}
+	return refs, nil
+}
+
+func (s *fetchingStore) FetchChunks(ctx context.Context, refs []chunk.Chunk) ([]chunk.Chunk, error) {
+	var ids []string
+	var result []chunk.Chunk
+	for _, ref := range refs {
+		ids = append(ids, ref.ID)
+		for _, c := range s.chunks {
+			if c.ID == ref.ID {
+				result = append(result, c)
+			}
+		}
+	}
+	s.fetches = append(s.fetches, ids)
+	return result, nil
+}
+
+// seriesChunk returns a chunk of the series with a sample every 10 from 0 to
+// 100, identified by its fast fingerprint as the ingesters do.
+func seriesChunk(t *testing.T, m model.Metric) chunk.Chunk {
+	var (
+		cs  = []prom_chunk.Chunk{prom_chunk.New()}
+		err error
+	)
+	for ts := model.Time(0); ts <= 100; ts += 10 {
+		cs, err = cs[0].Add(model.SamplePair{Timestamp: ts, Value: model.SampleValue(ts)})
+		require.NoError(t, err)
+	}
+	return chunk.NewChunk(m.FastFingerprint(), m, cs[0], 0, 100)
+}
+
+func TestQueryBatches(t *testing.T) {
+	store := &fetchingStore{}
+	for i := 0; i < 5; i++ {
+		m := model.Metric{model.MetricNameLabel: "foo", "i": model.LabelValue(fmt.Sprint(i))}
+		store.chunks = append(store.chunks, seriesChunk(t, m))
+	}
+	q := &ChunkQuerier{Store: store, SeriesBatchSize: 2}
+	its, err := q.QueryIterators(context.Background(), 0, 100)
+	require.NoError(t, err)
+	require.Len(t, its, 5)
+	assert.Empty(t, store.fetches)
+
+	// The series are in order of fingerprint, and the first read of each
+	// batch fetches all its chunks.
+	for i, it := range its {
+		fp := it.(*batchIterator).Fingerprint()
+		if i > 0 {
+			assert.True(t, seriesFingerprint(its[i-1]) < fp)
+		}
+		assert.Equal(t, model.SamplePair{Timestamp: 50, Value: 50}, it.ValueAtOrBeforeTime(55))
+		assert.Len(t, store.fetches, i/2+1)
+	}
+	assert.Len(t, store.fetches[0], 2)
+	assert.Len(t, store.fetches[2], 1)
+
+	// Reading both series of a batch at the end of the query releases its
+	// chunks, but not their metrics.
+	m := its[0].Metric().Metric
+	assert.Equal(t, model.SamplePair{Timestamp: 100, Value: 100}, its[0].ValueAtOrBeforeTime(100))
+	assert.NotNil(t, its[0].(*batchIterator).chunks)
+	assert.Len(t, its[1].RangeValues(metric.Interval{OldestInclusive: 90, NewestInclusive: 200}), 2)
+	assert.Nil(t, its[0].(*batchIterator).chunks)
+	assert.Nil(t, its[1].(*batchIterator).chunks)
+	assert.Equal(t, m, its[0].Metric().Metric)
+	assert.Equal(t, its[0].(*batchIterator).Fingerprint(), m.FastFingerprint())
+	assert.Len(t, store.fetches, 3)
+
+	// A batch read again is fetched again, and then kept.
+	assert.Equal(t, model.SamplePair{Timestamp: 100, Value: 100}, its[0].ValueAtOrBeforeTime(150))
+	assert.Equal(t, model.SamplePair{Timestamp: 100, Value: 100}, its[1].ValueAtOrBeforeTime(150))
+	assert.Len(t, store.fetches, 4)
+	assert.NotNil(t, its[0].(*batchIterator).chunks)
+}
+
+func TestQueryBatchesFilters(t *testing.T) {
+	m1 := model.Metric{model.MetricNameLabel: "foo", "bar": "baz"}
+	m2 := model.Metric{model.MetricNameLabel: "foo"}
+	store := &fetchingStore{chunks: []chunk.Chunk{seriesChunk(t, m1), seriesChunk(t, m2)}}
+	filter, err := metric.NewLabelMatcher(metric.Equal, "bar", "")
+	require.NoError(t, err)
+
+	q := &ChunkQuerier{Store: store, SeriesBatchSize: 10}
+	its, err := q.QueryIterators(context.Background(), 0, 100, filter)
+	require.NoError(t, err)
+	require.Len(t, its, 2)
+	for _, it := range its {
+		values := it.RangeValues(metric.Interval{OldestInclusive: 0, NewestInclusive: 100})
+		if it.Metric().Metric.Equal(m1) {
+			assert.Empty(t, values)
+		} else {
+			assert.Len(t, values, 11)
+		}
+	}
+}
+
+func TestMergeQuerierBatches(t *testing.T) {
+	store := &fetchingStore{chunks: []chunk.Chunk{seriesChunk(t, testMetric)}}
+	q := MergeQuerier{
+		Queriers: []Querier{
+			matrixQuerier{model.Matrix{{Metric: testMetric, Values: makeSamples(80, 200, 10)}}},
+			&ChunkQuerier{Store: store, SeriesBatchSize: 10},
+		},
+	}
+	its, err := q.QueryRange(context.Background(), 0, 200)
+	require.NoError(t, err)
+	require.Len(t, its, 1)
+	assert.Empty(t, store.fetches)
+	assert.Equal(t, makeSamples(0, 200, 10), its[0].RangeValues(metric.Interval{OldestInclusive: 0, NewestInclusive: 200}))
+	assert.Len(t, store.fetches, 1)
+}
@@ -0,0 +1,197 @@
+package querier
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql"
+
+	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex/util"
+)
+
+const (
+	tooOld  = "too_old"
+	blocked = "blocked"
+)
+
+var outOfBoundsQueries = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "cortex",
+	Name:      "querier_out_of_bounds_queries_total",
+	Help:      "The total number of queries rejected for reading further back than the user may, or matching one of their query blockers.",
+}, []string{"user", "reason"})
+
+func init() {
+	prometheus.MustRegister(outOfBoundsQueries)
+}
+
+// BoundariesConfig configures how far back users may query, and which of
+// their queries are blocked.
+type BoundariesConfig struct {
+	MaxQueryLookback time.Duration
+	OverridesFile    string
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet
+func (cfg *BoundariesConfig) RegisterFlags(f *flag.FlagSet) {
+	f.DurationVar(&cfg.MaxQueryLookback, "querier.max-query-lookback", 0, "How far back users' queries may read. 0 to disable.")
+	f.StringVar(&cfg.OverridesFile, "querier.overrides-file", "", "YAML file of per-tenant settings overriding the flags: max_query_lookback, query_blockers, default_subquery_resolution, and metric_renames and label_renames, whose old names queries also read the renamed series for.")
+}
+
+// Boundaries rejects queries, instant, range or series, reading further back
+// than the user's max query lookback, or matching one of their query
+// blockers, with 400 Bad Request in the format of the Prometheus API. It must
+// be used after the user has been authenticated.
+type Boundaries struct {
+	cfg       BoundariesConfig
+	overrides map[string]util.Overrides
+	blockers  map[string][]*regexp.Regexp
+
+	// For tests.
+	now func() time.Time
+}
+
+// NewBoundaries makes a new Boundaries, loading any overrides file.
+func NewBoundaries(cfg BoundariesConfig) (*Boundaries, error) {
+	var overrides map[string]util.Overrides
+	if cfg.OverridesFile != "" {
+		var err error
+		overrides, err = util.LoadOverrides(cfg.OverridesFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	blockers := map[string][]*regexp.Regexp{}
+	for userID, o := range overrides {
+		for _, blocker := range o.QueryBlockers {
+			// Validated by LoadOverrides.
+			blockers[userID] = append(blockers[userID], regexp.MustCompile(blocker))
+		}
+	}
+	return &Boundaries{
+		cfg:       cfg,
+		overrides: overrides,
+		blockers:  blockers,
+		now:       time.Now,
+	}, nil
+}
+
+func (b *Boundaries) maxQueryLookback(userID string) time.Duration {
+	if lookback := b.overrides[userID].MaxQueryLookback; lookback > 0 {
+		return lookback
+	}
+	return b.cfg.MaxQueryLookback
+}
+
+// Wrap implements middleware.Interface.
+func (b *Boundaries) Wrap(next http.Handler) http.Handler {
+	if b.cfg.MaxQueryLookback == 0 && len(b.overrides) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID, err := user.Extract(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		var (
+			queries []string
+			series  bool
+		)
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/api/v1/query"), strings.HasSuffix(r.URL.Path, "/api/v1/query_range"):
+			queries = []string{r.FormValue("query")}
+		case strings.HasSuffix(r.URL.Path, "/api/v1/series"):
+			r.ParseForm()
+			queries = r.Form["match[]"]
+			series = true
+		default:
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		for _, query := range queries {
+			for _, re := range b.blockers[userID] {
+				if re.MatchString(query) {
+					outOfBoundsQueries.WithLabelValues(userID, blocked).Inc()
+					writeBadData(w, fmt.Sprintf("query %q is blocked for this tenant by %q", query, re.String()))
+					return
+				}
+			}
+		}
+
+		if lookback := b.maxQueryLookback(userID); lookback > 0 {
+			boundary := model.TimeFromUnixNano(b.now().Add(-lookback).UnixNano())
+			if series && r.Form.Get("start") == "" {
+				// Series requests default to all time; limit them to the
+				// boundary instead.
+				r.Form.Set("start", strconv.FormatFloat(float64(boundary)/1000, 'f', -1, 64))
+			}
+			if earliest, ok := b.earliestTime(r, queries, series); ok && earliest.Before(boundary) {
+				outOfBoundsQueries.WithLabelValues(userID, tooOld).Inc()
+				writeBadData(w, fmt.Sprintf("the query reads data from %v, but this tenant can only query data since %v, %v ago", earliest.Time().UTC(), boundary.Time().UTC(), lookback))
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// earliestTime returns the earliest time the request reads samples from: its
+// start, less the longest range and offset of the query's selectors. It
+// returns false for requests the API will reject.
+func (b *Boundaries) earliestTime(r *http.Request, queries []string, series bool) (model.Time, bool) {
+	param := "start"
+	if strings.HasSuffix(r.URL.Path, "/api/v1/query") {
+		param = "time"
+	}
+	start := model.TimeFromUnixNano(b.now().UnixNano())
+	if s := r.FormValue(param); s != "" {
+		var err error
+		if start, err = parseTime(s); err != nil {
+			return 0, false
+		}
+	}
+	if series {
+		// Series selectors have no ranges or offsets.
+		return start, true
+	}
+
+	var lookbehind time.Duration
+	for _, query := range queries {
+		expr, err := promql.ParseExpr(query)
+		if err != nil {
+			return 0, false
+		}
+		promql.Inspect(expr, func(node promql.Node) bool {
+			var d time.Duration
+			switch n := node.(type) {
+			case *promql.VectorSelector:
+				d = n.Offset
+			case *promql.MatrixSelector:
+				d = n.Range + n.Offset
+			}
+			if d > lookbehind {
+				lookbehind = d
+			}
+			return true
+		})
+	}
+	return start.Add(-lookbehind), true
+}
+
+// writeBadData writes the error as the Prometheus API would for a bad request.
+func writeBadData(w http.ResponseWriter, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(queryResponse{Status: "error", ErrorType: "bad_data", Error: msg})
+}
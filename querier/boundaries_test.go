@@ -0,0 +1,70 @@
+package querier
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex/util"
+)
+
+func TestBoundaries(t *testing.T) {
+	now := time.Unix(100000, 0)
+	b := &Boundaries{
+		cfg: BoundariesConfig{MaxQueryLookback: time.Hour},
+		overrides: map[string]util.Overrides{
+			"compliance": {MaxQueryLookback: 10 * time.Minute},
+		},
+		blockers: map[string][]*regexp.Regexp{
+			"compliance": {regexp.MustCompile(`secret_.*`)},
+		},
+		now: func() time.Time { return now },
+	}
+	var start string
+	handler := b.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start = r.FormValue("start")
+	}))
+
+	for i, tc := range []struct {
+		user     string
+		path     string
+		params   url.Values
+		expected int
+	}{
+		{"user", "/api/v1/query", url.Values{"query": {"foo"}, "time": {"97000"}}, http.StatusOK},
+		{"user", "/api/v1/query", url.Values{"query": {"foo"}, "time": {"96000"}}, http.StatusBadRequest},
+		// Ranges and offsets read further back.
+		{"user", "/api/v1/query", url.Values{"query": {"rate(foo[30m])"}}, http.StatusOK},
+		{"user", "/api/v1/query", url.Values{"query": {"rate(foo[30m] offset 1h)"}}, http.StatusBadRequest},
+		{"user", "/api/v1/query_range", url.Values{"query": {"foo"}, "start": {"96000"}, "end": {"100000"}, "step": {"60"}}, http.StatusBadRequest},
+		{"user", "/api/v1/series", url.Values{"match[]": {"foo"}, "start": {"90000"}}, http.StatusBadRequest},
+		{"user", "/api/v1/series", url.Values{"match[]": {"foo"}}, http.StatusOK},
+		// The per-tenant lookback overrides the flag.
+		{"compliance", "/api/v1/query", url.Values{"query": {"foo"}, "time": {"99000"}}, http.StatusBadRequest},
+		{"compliance", "/api/v1/query", url.Values{"query": {"secret_foo"}}, http.StatusBadRequest},
+		{"compliance", "/api/v1/series", url.Values{"match[]": {"foo", "secret_bar"}}, http.StatusBadRequest},
+		// Other requests are passed on as they are.
+		{"compliance", "/api/v1/label/secret_foo/values", nil, http.StatusOK},
+	} {
+		r := httptest.NewRequest("GET", "/api/prom"+tc.path+"?"+tc.params.Encode(), nil)
+		r = r.WithContext(user.Inject(r.Context(), tc.user))
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, r)
+		assert.Equal(t, tc.expected, rec.Code, "%d", i)
+		if rec.Code == http.StatusBadRequest {
+			assert.Contains(t, rec.Body.String(), `"errorType":"bad_data"`, "%d", i)
+		}
+	}
+
+	// Series requests without a start are limited to the boundary.
+	r := httptest.NewRequest("GET", "/api/prom/api/v1/series?match[]=foo", nil)
+	r = r.WithContext(user.Inject(r.Context(), "user"))
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+	assert.Equal(t, "96400", start)
+}
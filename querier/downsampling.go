@@ -0,0 +1,200 @@
+package querier
+
+import (
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/storage/local"
+	"github.com/prometheus/prometheus/storage/metric"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex/chunk"
+)
+
+type contextKey int
+
+const resolutionContextKey contextKey = 0
+
+// WithResolution returns a context in which queries older than the
+// downsampling threshold read the series downsampled to the resolution.
+func WithResolution(ctx context.Context, resolution time.Duration) context.Context {
+	return context.WithValue(ctx, resolutionContextKey, resolution)
+}
+
+// ResolutionFromContext returns the resolution of downsampled series queries
+// in the context read, and false if they read the raw series.
+func ResolutionFromContext(ctx context.Context) (time.Duration, bool) {
+	resolution, ok := ctx.Value(resolutionContextKey).(time.Duration)
+	return resolution, ok
+}
+
+// Downsampling makes range queries whose step is at least one of the
+// downsampled resolutions read the largest such resolution, for the samples
+// older than the downsampling threshold, unless the ranges their functions
+// read, eg. for rate or increase, are too short for it. Other queries are
+// passed on as they are.
+type Downsampling struct {
+	enabled bool
+}
+
+// NewDownsampling makes a new Downsampling, which does nothing unless the
+// querier reads downsampled series older than after.
+func NewDownsampling(after time.Duration) *Downsampling {
+	return &Downsampling{
+		enabled: after > 0,
+	}
+}
+
+// Wrap implements middleware.Interface.
+func (d *Downsampling) Wrap(next http.Handler) http.Handler {
+	if !d.enabled {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/api/v1/query_range") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		step, err := parseDuration(r.FormValue("step"))
+		if err != nil {
+			// Leave the API to reject it.
+			next.ServeHTTP(w, r)
+			return
+		}
+		expr, err := promql.ParseExpr(r.FormValue("query"))
+		if err != nil {
+			// Leave the API to reject it, or Subqueries to evaluate it from
+			// the raw series.
+			next.ServeHTTP(w, r)
+			return
+		}
+		if resolution, ok := resolutionForQuery(expr, step); ok {
+			r = r.WithContext(WithResolution(r.Context(), resolution))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// resolutionForQuery returns the largest downsampled resolution no longer than
+// the step, so each step reads at least one aggregated sample, and no longer
+// than half of the shortest range the query's functions read, so each range
+// reads at least two, as eg. rate and increase need.
+func resolutionForQuery(expr promql.Expr, step time.Duration) (time.Duration, bool) {
+	shortestRange := time.Duration(math.MaxInt64)
+	promql.Inspect(expr, func(node promql.Node) bool {
+		if n, ok := node.(*promql.MatrixSelector); ok && n.Range < shortestRange {
+			shortestRange = n.Range
+		}
+		return true
+	})
+
+	var (
+		result time.Duration
+		found  bool
+	)
+	for _, resolution := range chunk.DownsampleResolutions {
+		if resolution <= step && resolution <= shortestRange/2 && resolution > result {
+			result, found = resolution, true
+		}
+	}
+	return result, found
+}
+
+// downsampledQuerier queries the averages of the series downsampled to the
+// context's resolution for the days older than the threshold, and the raw
+// series for the rest. Without a resolution in the context, all of the range
+// is queried raw. The downsampled series are only returned as iterators; the
+// matrices of Query are always raw.
+type downsampledQuerier struct {
+	Querier
+	after time.Duration
+}
+
+// boundary returns the start of the first day not downsampled yet.
+func (q downsampledQuerier) boundary() model.Time {
+	const day = model.Time(24 * time.Hour / time.Millisecond)
+	boundary := model.Now().Add(-q.after)
+	return boundary - boundary%day
+}
+
+// QueryIterators implements IteratorQuerier.
+func (q downsampledQuerier) QueryIterators(ctx context.Context, from, to model.Time, matchers ...*metric.LabelMatcher) ([]local.SeriesIterator, error) {
+	resolution, ok := ResolutionFromContext(ctx)
+	boundary := q.boundary()
+	if !ok || !from.Before(boundary) {
+		return queryIterators(ctx, q.Querier, from, to, matchers...)
+	}
+
+	userID, err := user.Extract(ctx)
+	if err != nil {
+		return nil, err
+	}
+	aggregate, err := metric.NewLabelMatcher(metric.Equal, chunk.AggregateLabel, chunk.AggregateAvg)
+	if err != nil {
+		return nil, err
+	}
+	downsampledMatchers := make([]*metric.LabelMatcher, 0, len(matchers)+1)
+	downsampledMatchers = append(downsampledMatchers, matchers...)
+	downsampledMatchers = append(downsampledMatchers, aggregate)
+
+	// Each aggregated sample is timestamped at the end of its interval, so
+	// reach back an interval further for the one covering from.
+	through := boundary - 1
+	if to.Before(through) {
+		through = to
+	}
+	downsampledCtx := user.Inject(ctx, chunk.DownsampledUserID(userID, resolution))
+	downsampled, err := queryIterators(downsampledCtx, q.Querier, from.Add(-resolution), through, downsampledMatchers...)
+	if err != nil {
+		return nil, err
+	}
+
+	iterators := make([]local.SeriesIterator, 0, len(downsampled))
+	for _, it := range downsampled {
+		m := it.Metric().Metric.Clone()
+		delete(m, chunk.AggregateLabel)
+		iterators = append(iterators, downsampledIterator{
+			SeriesIterator: it,
+			metric:         metric.Metric{Metric: m},
+			resolution:     resolution,
+			boundary:       boundary,
+		})
+	}
+	if to.Before(boundary) {
+		return iterators, nil
+	}
+
+	raw, err := queryIterators(ctx, q.Querier, boundary, to, matchers...)
+	if err != nil {
+		return nil, err
+	}
+	return append(iterators, raw...), nil
+}
+
+// downsampledIterator presents a downsampled series as the raw one it was
+// made from. The engine ignores samples older than its staleness delta, which
+// may be shorter than the resolution, so an aggregated sample of the previous
+// interval is returned as if it were at the time asked for.
+type downsampledIterator struct {
+	local.SeriesIterator
+	metric     metric.Metric
+	resolution time.Duration
+	boundary   model.Time
+}
+
+func (it downsampledIterator) Metric() metric.Metric {
+	return it.metric
+}
+
+func (it downsampledIterator) ValueAtOrBeforeTime(ts model.Time) model.SamplePair {
+	v := it.SeriesIterator.ValueAtOrBeforeTime(ts)
+	if ts.Before(it.boundary) && v != model.ZeroSamplePair && !v.Timestamp.Before(ts.Add(-it.resolution)) {
+		v.Timestamp = ts
+	}
+	return v
+}
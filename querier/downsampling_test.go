@@ -0,0 +1,138 @@
+package querier
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/storage/metric"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex/chunk"
+)
+
+// userMatrixQuerier returns the series of each user's matrix matching the
+// matchers.
+type userMatrixQuerier struct {
+	matrixQuerier
+	matrices map[string]model.Matrix
+}
+
+func (q userMatrixQuerier) Query(ctx context.Context, from, to model.Time, matchers ...*metric.LabelMatcher) (model.Matrix, error) {
+	userID, err := user.Extract(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var result model.Matrix
+outer:
+	for _, ss := range q.matrices[userID] {
+		for _, m := range matchers {
+			if !m.Match(ss.Metric[m.Name]) {
+				continue outer
+			}
+		}
+		var values []model.SamplePair
+		for _, v := range ss.Values {
+			if !v.Timestamp.Before(from) && !v.Timestamp.After(to) {
+				values = append(values, v)
+			}
+		}
+		result = append(result, &model.SampleStream{Metric: ss.Metric, Values: values})
+	}
+	return result, nil
+}
+
+func TestDownsampledQuerier(t *testing.T) {
+	const after = 48 * time.Hour
+	q := downsampledQuerier{after: after}
+	boundary := q.boundary()
+
+	// The raw series has a sample every 15s of value 1, the downsampled one
+	// an average of 2 at the end of each hour before the boundary.
+	var raw, downsampled []model.SamplePair
+	for ts := boundary.Add(-6 * time.Hour); ts.Before(boundary.Add(6 * time.Hour)); ts = ts.Add(15 * time.Second) {
+		raw = append(raw, model.SamplePair{Timestamp: ts, Value: 1})
+	}
+	for ts := boundary.Add(-5*time.Hour) - 1; ts.Before(boundary); ts = ts.Add(time.Hour) {
+		downsampled = append(downsampled, model.SamplePair{Timestamp: ts, Value: 2})
+	}
+	m := model.Metric{model.MetricNameLabel: "foo"}
+	q.Querier = userMatrixQuerier{matrices: map[string]model.Matrix{
+		"1": {{Metric: m, Values: raw}},
+		chunk.DownsampledUserID("1", time.Hour): {{
+			Metric: model.Metric{model.MetricNameLabel: "foo", chunk.AggregateLabel: chunk.AggregateAvg},
+			Values: downsampled,
+		}},
+	}}
+	engine := promql.NewEngine(Queryable{Q: MergeQuerier{Queriers: []Querier{q}}}, nil)
+
+	query := func(ctx context.Context) model.Matrix {
+		qry, err := engine.NewRangeQuery("foo", boundary.Add(-4*time.Hour), boundary.Add(4*time.Hour), time.Hour)
+		require.NoError(t, err)
+		matrix, err := qry.Exec(ctx).Matrix()
+		require.NoError(t, err)
+		return matrix
+	}
+
+	// Without a resolution, the raw series is read throughout.
+	ctx := user.Inject(context.Background(), "1")
+	matrix := query(ctx)
+	require.Len(t, matrix, 1)
+	require.Len(t, matrix[0].Values, 9)
+	for _, v := range matrix[0].Values {
+		assert.Equal(t, model.SampleValue(1), v.Value, v.Timestamp.String())
+	}
+
+	// With one, the downsampled series is read before the boundary, under the
+	// raw series' labels.
+	matrix = query(WithResolution(ctx, time.Hour))
+	require.Len(t, matrix, 1)
+	assert.Equal(t, m, matrix[0].Metric)
+	require.Len(t, matrix[0].Values, 9)
+	for _, v := range matrix[0].Values {
+		expected := model.SampleValue(1)
+		if v.Timestamp.Before(boundary) {
+			expected = 2
+		}
+		assert.Equal(t, expected, v.Value, v.Timestamp.String())
+	}
+}
+
+func TestDownsampling(t *testing.T) {
+	var (
+		resolution time.Duration
+		ok         bool
+	)
+	handler := NewDownsampling(48 * time.Hour).Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		resolution, ok = ResolutionFromContext(r.Context())
+	}))
+
+	for _, tc := range []struct {
+		path       string
+		resolution time.Duration
+	}{
+		{path: "/api/prom/api/v1/query_range?query=foo&start=0&end=86400&step=60"},
+		{path: "/api/prom/api/v1/query_range?query=foo&start=0&end=86400&step=600", resolution: 5 * time.Minute},
+		{path: "/api/prom/api/v1/query_range?query=foo&start=0&end=86400&step=1h", resolution: time.Hour},
+		{path: "/api/prom/api/v1/query_range?query=foo&start=0&end=86400&step=1d", resolution: time.Hour},
+		{path: "/api/prom/api/v1/query?query=foo&time=86400"},
+
+		// The ranges of rate and the like are read at resolutions giving at
+		// least two samples of each, or raw if none do.
+		{path: "/api/prom/api/v1/query_range?query=rate(foo[5m])&start=0&end=86400&step=1h"},
+		{path: "/api/prom/api/v1/query_range?query=rate(foo[10m])&start=0&end=86400&step=1h", resolution: 5 * time.Minute},
+		{path: "/api/prom/api/v1/query_range?query=sum(increase(foo[2h]))/rate(bar[1h])&start=0&end=86400&step=1h", resolution: 5 * time.Minute},
+		{path: "/api/prom/api/v1/query_range?query=increase(foo[2h])&start=0&end=86400&step=1h", resolution: time.Hour},
+		{path: "/api/prom/api/v1/query_range?query=max_over_time(rate(foo[2h])[1d:1h])&start=0&end=86400&step=1h"},
+	} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", tc.path, nil))
+		assert.Equal(t, tc.resolution != 0, ok, tc.path)
+		assert.Equal(t, tc.resolution, resolution, tc.path)
+	}
+}
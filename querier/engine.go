@@ -0,0 +1,93 @@
+package querier
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/storage/local"
+	"github.com/prometheus/prometheus/storage/metric"
+	"golang.org/x/net/context"
+)
+
+// NewEngine creates a new promql.Engine for cortex.
+func NewEngine(cfg Config, distributor Querier, chunkStore ChunkStore) *promql.Engine {
+	return NewQueryableEngine(cfg, NewQueryable(cfg, distributor, chunkStore))
+}
+
+// NewQueryableEngine creates the promql.Engine a querier's queries share,
+// which runs at most cfg.MaxConcurrent of them at once, queueing the rest,
+// and times them out after cfg.Timeout. Either left unset takes the engine's
+// default. Its queries can read the results of subqueries evaluated by
+// Subqueries.
+func NewQueryableEngine(cfg Config, queryable Queryable) *promql.Engine {
+	queryable.Q = subqueryQuerier{Querier: queryable.Q}
+	opts := *promql.DefaultEngineOptions
+	if cfg.MaxConcurrent > 0 {
+		opts.MaxConcurrentQueries = cfg.MaxConcurrent
+	}
+	if cfg.Timeout > 0 {
+		opts.Timeout = cfg.Timeout
+	}
+	return promql.NewEngine(queryable, &opts)
+}
+
+// sampleLimit counts the samples one query reads, failing it when they exceed
+// the maximum.
+type sampleLimit struct {
+	max   int64
+	count int64
+}
+
+func (l *sampleLimit) add(n int) {
+	if atomic.AddInt64(&l.count, int64(n)) > l.max {
+		// The engine turns errors it panics with into the query's error; the
+		// iterators have no other way to fail.
+		panic(fmt.Errorf("query read more than %d samples, narrow its matchers or time range", l.max))
+	}
+}
+
+// sampleLimitQuerier is a local.Querier for one query, whose iterators count
+// the samples read.
+type sampleLimitQuerier struct {
+	local.Querier
+	limit *sampleLimit
+}
+
+func (q sampleLimitQuerier) QueryRange(ctx context.Context, from, through model.Time, matchers ...*metric.LabelMatcher) ([]local.SeriesIterator, error) {
+	iterators, err := q.Querier.QueryRange(ctx, from, through, matchers...)
+	return q.wrap(iterators), err
+}
+
+func (q sampleLimitQuerier) QueryInstant(ctx context.Context, ts model.Time, stalenessDelta time.Duration, matchers ...*metric.LabelMatcher) ([]local.SeriesIterator, error) {
+	iterators, err := q.Querier.QueryInstant(ctx, ts, stalenessDelta, matchers...)
+	return q.wrap(iterators), err
+}
+
+func (q sampleLimitQuerier) wrap(iterators []local.SeriesIterator) []local.SeriesIterator {
+	for i, it := range iterators {
+		iterators[i] = sampleLimitIterator{SeriesIterator: it, limit: q.limit}
+	}
+	return iterators
+}
+
+type sampleLimitIterator struct {
+	local.SeriesIterator
+	limit *sampleLimit
+}
+
+func (it sampleLimitIterator) ValueAtOrBeforeTime(t model.Time) model.SamplePair {
+	sample := it.SeriesIterator.ValueAtOrBeforeTime(t)
+	if sample != model.ZeroSamplePair {
+		it.limit.add(1)
+	}
+	return sample
+}
+
+func (it sampleLimitIterator) RangeValues(in metric.Interval) []model.SamplePair {
+	values := it.SeriesIterator.RangeValues(in)
+	it.limit.add(len(values))
+	return values
+}
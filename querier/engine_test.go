@@ -0,0 +1,35 @@
+package querier
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestEngineMaxSamples(t *testing.T) {
+	// 61 samples, one a second.
+	q := matrixQuerier{model.Matrix{{Metric: testMetric, Values: makeSamples(0, 60*1000, 1000)}}}
+	for _, tc := range []struct {
+		query      string
+		maxSamples int
+		err        bool
+	}{
+		{"sum_over_time(foo[1m])", 0, false},
+		{"sum_over_time(foo[1m])", 100, false},
+		{"sum_over_time(foo[1m])", 10, true},
+		{"foo", 1, false},
+	} {
+		engine := NewQueryableEngine(Config{MaxConcurrent: 1, Timeout: time.Minute}, Queryable{
+			Q:          MergeQuerier{Queriers: []Querier{q}},
+			MaxSamples: tc.maxSamples,
+		})
+		query, err := engine.NewInstantQuery(tc.query, 60*1000)
+		require.NoError(t, err)
+		res := query.Exec(context.Background())
+		assert.Equal(t, tc.err, res.Err != nil, "%s with at most %d samples: %v", tc.query, tc.maxSamples, res.Err)
+	}
+}
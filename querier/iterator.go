@@ -3,8 +3,14 @@ package querier
 import (
 	"sort"
 
+	"github.com/prometheus/common/log"
 	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/local"
+	prom_chunk "github.com/prometheus/prometheus/storage/local/chunk"
 	"github.com/prometheus/prometheus/storage/metric"
+
+	"github.com/weaveworks/cortex/chunk"
+	"github.com/weaveworks/cortex/util"
 )
 
 // This is a struct and not just a renamed type because otherwise the Metric
@@ -49,3 +55,130 @@ func (it sampleStreamIterator) RangeValues(in metric.Interval) []model.SamplePai
 }
 
 func (it sampleStreamIterator) Close() {}
+
+// chunkIterator is a lazy iterator over the chunks of a single series. Rather
+// than decoding every chunk up front, it only decodes the chunks covering the
+// samples asked for. Chunks may overlap, for instance when each replica of a
+// series was flushed separately.
+type chunkIterator struct {
+	metric model.Metric
+	chunks []chunk.Chunk // sorted by From
+}
+
+type byFrom []chunk.Chunk
+
+func (cs byFrom) Len() int           { return len(cs) }
+func (cs byFrom) Swap(i, j int)      { cs[i], cs[j] = cs[j], cs[i] }
+func (cs byFrom) Less(i, j int) bool { return cs[i].From < cs[j].From }
+
+func newChunkIterator(chunks []chunk.Chunk) *chunkIterator {
+	sort.Sort(byFrom(chunks))
+	return &chunkIterator{
+		metric: chunks[0].Metric,
+		chunks: chunks,
+	}
+}
+
+func (it *chunkIterator) Metric() metric.Metric {
+	return metric.Metric{Metric: it.metric}
+}
+
+func (it *chunkIterator) ValueAtOrBeforeTime(ts model.Time) model.SamplePair {
+	result := model.SamplePair{Timestamp: model.Earliest}
+	for _, c := range it.chunks {
+		if c.From.After(ts) {
+			break
+		}
+		// This chunk can't contain anything later than what we already have.
+		if c.Through.Before(result.Timestamp) {
+			continue
+		}
+		iter := c.Data.NewIterator()
+		if iter.FindAtOrBefore(ts) && iter.Value().Timestamp.After(result.Timestamp) {
+			result = iter.Value()
+		}
+	}
+	return result
+}
+
+func (it *chunkIterator) RangeValues(in metric.Interval) []model.SamplePair {
+	var result []model.SamplePair
+	for _, c := range it.chunks {
+		if c.From.After(in.NewestInclusive) {
+			break
+		}
+		if c.Through.Before(in.OldestInclusive) {
+			continue
+		}
+		values, err := prom_chunk.RangeValues(c.Data.NewIterator(), in)
+		if err != nil {
+			log.Errorf("Error decoding chunk %s: %v", c.ID, err)
+			continue
+		}
+		result = util.MergeSamples(result, values)
+	}
+	return result
+}
+
+func (it *chunkIterator) Close() {}
+
+// mergeIterator merges the samples of iterators over the same series on
+// demand, instead of merging all their samples up front.
+type mergeIterator struct {
+	its []local.SeriesIterator
+}
+
+func (it mergeIterator) Metric() metric.Metric {
+	return it.its[0].Metric()
+}
+
+func (it mergeIterator) ValueAtOrBeforeTime(ts model.Time) model.SamplePair {
+	result := model.SamplePair{Timestamp: model.Earliest}
+	for _, i := range it.its {
+		v := i.ValueAtOrBeforeTime(ts)
+		if v.Timestamp.After(result.Timestamp) || (v.Timestamp == result.Timestamp && util.IsStaleNaN(result.Value)) {
+			result = v
+		}
+	}
+	return result
+}
+
+func (it mergeIterator) RangeValues(in metric.Interval) []model.SamplePair {
+	var result []model.SamplePair
+	for _, i := range it.its {
+		result = util.MergeSamples(result, i.RangeValues(in))
+	}
+	return result
+}
+
+func (it mergeIterator) Close() {
+	for _, i := range it.its {
+		i.Close()
+	}
+}
+
+// staleIterator hides staleness markers from the query engine: a series whose
+// latest sample is a staleness marker has no value, and the markers aren't
+// returned in ranges.
+type staleIterator struct {
+	local.SeriesIterator
+}
+
+func (it staleIterator) ValueAtOrBeforeTime(ts model.Time) model.SamplePair {
+	v := it.SeriesIterator.ValueAtOrBeforeTime(ts)
+	if util.IsStaleNaN(v.Value) {
+		return model.ZeroSamplePair
+	}
+	return v
+}
+
+func (it staleIterator) RangeValues(in metric.Interval) []model.SamplePair {
+	values := it.SeriesIterator.RangeValues(in)
+	result := make([]model.SamplePair, 0, len(values))
+	for _, v := range values {
+		if !util.IsStaleNaN(v.Value) {
+			result = append(result, v)
+		}
+	}
+	return result
+}
@@ -0,0 +1,123 @@
+package querier
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/local"
+	prom_chunk "github.com/prometheus/prometheus/storage/local/chunk"
+	"github.com/prometheus/prometheus/storage/metric"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/weaveworks/cortex/chunk"
+	"github.com/weaveworks/cortex/util"
+)
+
+var testMetric = model.Metric{
+	model.MetricNameLabel: "foo",
+	"bar":                 "baz",
+}
+
+// makeChunk returns a chunk with a sample every step from from to through.
+func makeChunk(t *testing.T, from, through, step model.Time) chunk.Chunk {
+	var (
+		cs  = []prom_chunk.Chunk{prom_chunk.New()}
+		err error
+	)
+	for ts := from; ts <= through; ts += step {
+		cs, err = cs[0].Add(model.SamplePair{Timestamp: ts, Value: model.SampleValue(ts)})
+		require.NoError(t, err)
+		require.Len(t, cs, 1)
+	}
+	return chunk.NewChunk(testMetric.Fingerprint(), testMetric, cs[0], from, through)
+}
+
+func makeSamples(from, through, step model.Time) []model.SamplePair {
+	var samples []model.SamplePair
+	for ts := from; ts <= through; ts += step {
+		samples = append(samples, model.SamplePair{Timestamp: ts, Value: model.SampleValue(ts)})
+	}
+	return samples
+}
+
+func TestLazyIterators(t *testing.T) {
+	// Overlapping chunks, as if flushed by different replicas, with some
+	// samples also still in the ingesters.
+	chunks := []chunk.Chunk{
+		makeChunk(t, 50, 150, 10),
+		makeChunk(t, 0, 100, 10),
+		makeChunk(t, 200, 300, 10),
+	}
+	ingesterSamples := makeSamples(280, 400, 10)
+
+	chunkSamples := append(makeSamples(0, 150, 10), makeSamples(200, 300, 10)...)
+	allSamples := append(makeSamples(0, 150, 10), makeSamples(200, 400, 10)...)
+
+	for i, tc := range []struct {
+		it       local.SeriesIterator
+		expected []model.SamplePair
+	}{
+		{
+			it:       newChunkIterator(chunks),
+			expected: chunkSamples,
+		},
+		{
+			it: mergeIterator{its: []local.SeriesIterator{
+				newChunkIterator(chunks),
+				sampleStreamIterator{ss: &model.SampleStream{Metric: testMetric, Values: ingesterSamples}},
+			}},
+			expected: allSamples,
+		},
+	} {
+		t.Run(fmt.Sprintf("[%d]", i), func(t *testing.T) {
+			expected := sampleStreamIterator{ss: &model.SampleStream{Metric: testMetric, Values: tc.expected}}
+			assert.Equal(t, expected.Metric(), tc.it.Metric())
+
+			for _, ts := range []model.Time{-10, 0, 5, 75, 150, 175, 300, 305, 400, 500} {
+				assert.Equal(t, expected.ValueAtOrBeforeTime(ts), tc.it.ValueAtOrBeforeTime(ts), "at %v", ts)
+			}
+
+			for _, in := range []metric.Interval{
+				{OldestInclusive: 0, NewestInclusive: 400},
+				{OldestInclusive: 45, NewestInclusive: 125},
+				{OldestInclusive: 290, NewestInclusive: 310},
+			} {
+				assert.Equal(t, expected.RangeValues(in), tc.it.RangeValues(in), "in %v", in)
+			}
+			assert.Empty(t, tc.it.RangeValues(metric.Interval{OldestInclusive: -100, NewestInclusive: -10}))
+			assert.Empty(t, tc.it.RangeValues(metric.Interval{OldestInclusive: 155, NewestInclusive: 195}))
+		})
+	}
+}
+
+func TestStaleIterator(t *testing.T) {
+	// Staleness markers go through chunk encoding intact.
+	var (
+		cs  = []prom_chunk.Chunk{prom_chunk.New()}
+		err error
+	)
+	for _, s := range []model.SamplePair{{Timestamp: 10, Value: 1}, {Timestamp: 20, Value: util.StaleNaN}, {Timestamp: 30, Value: 3}, {Timestamp: 40, Value: util.StaleNaN}} {
+		cs, err = cs[0].Add(s)
+		require.NoError(t, err)
+		require.Len(t, cs, 1)
+	}
+	it := staleIterator{newChunkIterator([]chunk.Chunk{
+		chunk.NewChunk(testMetric.Fingerprint(), testMetric, cs[0], 10, 40),
+	})}
+
+	assert.Equal(t, model.SamplePair{Timestamp: 10, Value: 1}, it.ValueAtOrBeforeTime(15))
+	assert.Equal(t, model.ZeroSamplePair, it.ValueAtOrBeforeTime(25))
+	assert.Equal(t, model.SamplePair{Timestamp: 30, Value: 3}, it.ValueAtOrBeforeTime(35))
+	assert.Equal(t, model.ZeroSamplePair, it.ValueAtOrBeforeTime(45))
+	assert.Equal(t, []model.SamplePair{{Timestamp: 10, Value: 1}, {Timestamp: 30, Value: 3}}, it.RangeValues(metric.Interval{OldestInclusive: 0, NewestInclusive: 50}))
+
+	// A replica's real value wins over another's staleness marker.
+	merged := mergeIterator{its: []local.SeriesIterator{
+		sampleStreamIterator{&model.SampleStream{Metric: testMetric, Values: []model.SamplePair{{Timestamp: 20, Value: util.StaleNaN}}}},
+		sampleStreamIterator{&model.SampleStream{Metric: testMetric, Values: []model.SamplePair{{Timestamp: 20, Value: 2}}}},
+	}}
+	assert.Equal(t, model.SamplePair{Timestamp: 20, Value: 2}, merged.ValueAtOrBeforeTime(25))
+	assert.Equal(t, []model.SamplePair{{Timestamp: 20, Value: 2}}, merged.RangeValues(metric.Interval{OldestInclusive: 0, NewestInclusive: 50}))
+}
@@ -0,0 +1,135 @@
+package querier
+
+import (
+	"flag"
+	"net/http"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/time/rate"
+
+	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex/util"
+)
+
+const (
+	rateLimited        = "rate_limited"
+	concurrencyLimited = "concurrency_limited"
+)
+
+var rejectedQueries = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "cortex",
+	Name:      "querier_rejected_queries_total",
+	Help:      "The total number of queries rejected by per-user limits.",
+}, []string{"user", "reason"})
+
+func init() {
+	prometheus.MustRegister(rejectedQueries)
+}
+
+// LimitsConfig configures per-user query limits.
+type LimitsConfig struct {
+	QueryRateLimit       float64
+	QueryBurstSize       int
+	MaxConcurrentQueries int
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet
+func (cfg *LimitsConfig) RegisterFlags(f *flag.FlagSet) {
+	f.Float64Var(&cfg.QueryRateLimit, "querier.query-rate-limit", 0, "Per-user query rate limit in queries per second. 0 to disable.")
+	f.IntVar(&cfg.QueryBurstSize, "querier.query-burst-size", 50, "Per-user allowed query burst size (in number of queries).")
+	f.IntVar(&cfg.MaxConcurrentQueries, "querier.max-concurrent-queries", 0, "Maximum number of queries each user can run concurrently. 0 to disable.")
+}
+
+// Limits enforces per-user query limits on HTTP requests, rejecting those over
+// the limits with 429 Too Many Requests. It must be used after the user has
+// been authenticated.
+type Limits struct {
+	cfg LimitsConfig
+
+	mtx      sync.Mutex
+	limiters map[string]*rate.Limiter
+	inflight map[string]int
+}
+
+// NewLimits makes a new Limits.
+func NewLimits(cfg LimitsConfig) *Limits {
+	return &Limits{
+		cfg:      cfg,
+		limiters: map[string]*rate.Limiter{},
+		inflight: map[string]int{},
+	}
+}
+
+// Wrap implements middleware.Interface.
+func (l *Limits) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID, err := user.Extract(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		if limitErr := l.acquire(userID); limitErr != nil {
+			reason := rateLimited
+			if limitErr.Limit == util.MaxConcurrentQueriesLimit {
+				reason = concurrencyLimited
+			}
+			rejectedQueries.WithLabelValues(userID, reason).Inc()
+			util.WriteLimitError(w, limitErr, http.StatusTooManyRequests)
+			return
+		}
+		defer l.release(userID)
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// acquire returns the limit the user's query must be rejected by, or nil if it
+// may run, in which case release must be called when it finishes.
+func (l *Limits) acquire(userID string) *util.LimitError {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	if l.cfg.MaxConcurrentQueries > 0 && l.inflight[userID] >= l.cfg.MaxConcurrentQueries {
+		return &util.LimitError{
+			Limit:      util.MaxConcurrentQueriesLimit,
+			Configured: float64(l.cfg.MaxConcurrentQueries),
+			Observed:   float64(l.inflight[userID]),
+			Message:    "too many concurrent queries",
+		}
+	}
+
+	if l.cfg.QueryRateLimit > 0 {
+		limiter, ok := l.limiters[userID]
+		if !ok {
+			limiter = rate.NewLimiter(rate.Limit(l.cfg.QueryRateLimit), l.cfg.QueryBurstSize)
+			l.limiters[userID] = limiter
+		}
+		reservation := limiter.Reserve()
+		if delay := reservation.Delay(); delay > 0 {
+			reservation.Cancel()
+			limitErr := &util.LimitError{
+				Limit:      util.QueryRateLimit,
+				Configured: l.cfg.QueryRateLimit,
+				Message:    "query rate limit exceeded",
+			}
+			if reservation.OK() {
+				limitErr.RetryAfter = delay.Seconds()
+			}
+			return limitErr
+		}
+	}
+
+	l.inflight[userID]++
+	return nil
+}
+
+func (l *Limits) release(userID string) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.inflight[userID]--
+	if l.inflight[userID] <= 0 {
+		delete(l.inflight, userID)
+	}
+}
@@ -0,0 +1,74 @@
+package querier
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/weaveworks/common/middleware"
+	"github.com/weaveworks/common/user"
+)
+
+func TestLimits(t *testing.T) {
+	for i, tc := range []struct {
+		cfg      LimitsConfig
+		inflight int
+		requests int
+		expected []int
+	}{
+		// No limits.
+		{
+			cfg:      LimitsConfig{},
+			requests: 3,
+			expected: []int{http.StatusOK, http.StatusOK, http.StatusOK},
+		},
+
+		// Rate limited after the burst.
+		{
+			cfg:      LimitsConfig{QueryRateLimit: 0.001, QueryBurstSize: 2},
+			requests: 3,
+			expected: []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests},
+		},
+
+		// Concurrency limited while other queries are running.
+		{
+			cfg:      LimitsConfig{MaxConcurrentQueries: 2},
+			inflight: 2,
+			requests: 1,
+			expected: []int{http.StatusTooManyRequests},
+		},
+		{
+			cfg:      LimitsConfig{MaxConcurrentQueries: 2},
+			inflight: 1,
+			requests: 2,
+			expected: []int{http.StatusOK, http.StatusOK},
+		},
+	} {
+		t.Run(fmt.Sprintf("[%d]", i), func(t *testing.T) {
+			limits := NewLimits(tc.cfg)
+			for j := 0; j < tc.inflight; j++ {
+				assert.Nil(t, limits.acquire("user"))
+			}
+			handler := middleware.Merge(middleware.AuthenticateUser, limits).Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+			for j := 0; j < tc.requests; j++ {
+				req := httptest.NewRequest("GET", "/api/v1/query", nil)
+				err := user.InjectIntoHTTPRequest(user.Inject(req.Context(), "user"), req)
+				assert.NoError(t, err)
+				rec := httptest.NewRecorder()
+				handler.ServeHTTP(rec, req)
+				assert.Equal(t, tc.expected[j], rec.Code, "request %d", j)
+				if rec.Code == http.StatusTooManyRequests {
+					assert.Contains(t, rec.Body.String(), `"limit":`, "request %d", j)
+				}
+			}
+
+			// Other users are unaffected, and finished queries are released.
+			assert.Nil(t, limits.acquire("other"))
+			assert.Equal(t, tc.inflight, limits.inflight["user"])
+		})
+	}
+}
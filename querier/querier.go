@@ -1,12 +1,13 @@
 package querier
 
 import (
+	"flag"
 	"fmt"
+	"sort"
 	"time"
 
-	"github.com/prometheus/common/log"
+	"github.com/opentracing/opentracing-go/ext"
 	"github.com/prometheus/common/model"
-	"github.com/prometheus/prometheus/promql"
 	"github.com/prometheus/prometheus/storage/local"
 	"github.com/prometheus/prometheus/storage/metric"
 	"golang.org/x/net/context"
@@ -20,23 +21,89 @@ type ChunkStore interface {
 	Get(ctx context.Context, from, through model.Time, matchers ...*metric.LabelMatcher) ([]chunk.Chunk, error)
 }
 
-// NewEngine creates a new promql.Engine for cortex.
-func NewEngine(distributor Querier, chunkStore ChunkStore) *promql.Engine {
-	queryable := NewQueryable(distributor, chunkStore)
-	return promql.NewEngine(queryable, nil)
+// seriesStore is a ChunkStore which can look up the series matching some
+// matchers without fetching all their chunks.
+type seriesStore interface {
+	GetSeries(ctx context.Context, from, through model.Time, matchers ...*metric.LabelMatcher) ([]model.Metric, error)
+}
+
+// Config contains the configuration require to create a querier
+type Config struct {
+	// Only query the ingesters for samples newer than this, as older samples
+	// will have been flushed to the chunk store.
+	QueryIngestersWithin time.Duration
+
+	// Only query the chunk store for samples older than this, as newer
+	// samples are still in the ingesters.
+	QueryStoreAfter time.Duration
+
+	// The maximum number of series returned when listing series. 0 for no
+	// limit.
+	MaxSeries int
+
+	// The number of shards of the series to split shardable aggregations
+	// into, executed in parallel. 0 or 1 to disable.
+	QueryShards int
+
+	// Read the series downsampled by the downsampler for the days older than
+	// this, for range queries with long enough steps. 0 to disable.
+	DownsampledAfter time.Duration
+
+	// The resolution of subqueries which don't have one, unless overridden
+	// for the tenant.
+	DefaultSubqueryResolution time.Duration
+
+	// The queries the engine runs at once, how long they may run, and the
+	// most samples each may read; 0 for no limit.
+	MaxConcurrent int
+	Timeout       time.Duration
+	MaxSamples    int
+
+	// Fetch the chunks of series from the chunk store in batches of this many
+	// series as the engine reads them. 0 to fetch them all up front.
+	SeriesBatchSize int
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet
+func (cfg *Config) RegisterFlags(f *flag.FlagSet) {
+	f.DurationVar(&cfg.QueryIngestersWithin, "querier.query-ingesters-within", 0, "Maximum lookback beyond which queries are not sent to the ingesters. 0 means all queries are sent to the ingesters. "+
+		"Should be longer than chunks take to be flushed, see -ingester.max-chunk-age.")
+	f.DurationVar(&cfg.QueryStoreAfter, "querier.query-store-after", 0, "The time after which a sample is only queried from the chunk store, not from the ingesters. 0 means all queries are sent to the chunk store. "+
+		"Should be shorter than -querier.query-ingesters-within, so the ranges overlap.")
+	f.IntVar(&cfg.MaxSeries, "querier.max-series", 0, "Maximum number of series the series endpoint returns; requests matching more fail. 0 for no limit.")
+	f.IntVar(&cfg.QueryShards, "querier.query-shards", 0, "Split queries aggregating with sum, count, min or max into this many queries over shards of the series, executed in parallel and merged. 0 to disable.")
+	f.DurationVar(&cfg.DefaultSubqueryResolution, "querier.default-subquery-resolution", time.Minute, "The resolution of subqueries which don't have one, eg. max_over_time(rate(foo[1m])[1h:]). Overridden per tenant by default_subquery_resolution in -querier.overrides-file.")
+	f.IntVar(&cfg.MaxConcurrent, "querier.max-concurrent", 20, "The maximum number of queries executed at once; others queue until one finishes.")
+	f.DurationVar(&cfg.Timeout, "querier.timeout", 2*time.Minute, "The timeout for executing a query, including any time it queues.")
+	f.IntVar(&cfg.MaxSamples, "querier.max-samples", 0, "The maximum number of samples a query may read; queries reading more fail. 0 for no limit.")
+	f.IntVar(&cfg.SeriesBatchSize, "querier.series-batch-size", 0, "Fetch the chunks of series from the chunk store in batches of this many series as the query reads them, releasing each batch once read, rather than all up front. Bounds the memory of instant queries matching many series. 0 to disable.")
 }
 
 // NewQueryable creates a new Queryable for cortex.
-func NewQueryable(distributor Querier, chunkStore ChunkStore) Queryable {
+func NewQueryable(cfg Config, distributor Querier, chunkStore ChunkStore) Queryable {
+	ingesterQuerier := distributor
+	var storeQuerier Querier = &ChunkQuerier{
+		Store:           chunkStore,
+		SeriesBatchSize: cfg.SeriesBatchSize,
+	}
+	if cfg.QueryIngestersWithin > 0 {
+		ingesterQuerier = timeRangeQuerier{Querier: ingesterQuerier, maxAge: cfg.QueryIngestersWithin}
+	}
+	if cfg.QueryStoreAfter > 0 {
+		storeQuerier = timeRangeQuerier{Querier: storeQuerier, minAge: cfg.QueryStoreAfter}
+	}
+	if cfg.DownsampledAfter > 0 {
+		storeQuerier = downsampledQuerier{Querier: storeQuerier, after: cfg.DownsampledAfter}
+	}
 	return Queryable{
 		Q: MergeQuerier{
 			Queriers: []Querier{
-				distributor,
-				&ChunkQuerier{
-					Store: chunkStore,
-				},
+				ingesterQuerier,
+				storeQuerier,
 			},
+			MaxSeries: cfg.MaxSeries,
 		},
+		MaxSamples: cfg.MaxSamples,
 	}
 }
 
@@ -48,9 +115,19 @@ type Querier interface {
 	MetricsForLabelMatchers(ctx context.Context, from, through model.Time, matcherSets ...metric.LabelMatchers) ([]metric.Metric, error)
 }
 
+// An IteratorQuerier is a Querier which can return lazy iterators over the
+// matching series, so their samples need not all be materialized at once.
+type IteratorQuerier interface {
+	QueryIterators(ctx context.Context, from, to model.Time, matchers ...*metric.LabelMatcher) ([]local.SeriesIterator, error)
+}
+
 // A ChunkQuerier is a Querier that fetches samples from a ChunkStore.
 type ChunkQuerier struct {
 	Store ChunkStore
+
+	// The number of series whose chunks are fetched at once as they are read,
+	// if the store supports it, or 0 to fetch all their chunks up front.
+	SeriesBatchSize int
 }
 
 // Query implements Querier and transforms a list of chunks into sample
@@ -65,24 +142,157 @@ func (q *ChunkQuerier) Query(ctx context.Context, from, to model.Time, matchers
 	return chunk.ChunksToMatrix(chunks)
 }
 
+// QueryIterators implements IteratorQuerier, returning iterators which only
+// decode chunks as their samples are needed.
+func (q *ChunkQuerier) QueryIterators(ctx context.Context, from, to model.Time, matchers ...*metric.LabelMatcher) ([]local.SeriesIterator, error) {
+	if store, ok := q.Store.(batchStore); ok && q.SeriesBatchSize > 0 {
+		return q.queryBatches(ctx, store, from, to, matchers...)
+	}
+
+	chunks, err := q.Store.Get(ctx, from, to, matchers...)
+	if err != nil {
+		return nil, err
+	}
+
+	fpToChunks := map[model.Fingerprint][]chunk.Chunk{}
+	for _, c := range chunks {
+		fp := c.Metric.Fingerprint()
+		fpToChunks[fp] = append(fpToChunks[fp], c)
+	}
+
+	iterators := make([]local.SeriesIterator, 0, len(fpToChunks))
+	for _, cs := range fpToChunks {
+		iterators = append(iterators, newChunkIterator(cs))
+	}
+	return iterators, nil
+}
+
 // LabelValuesForLabelName returns all of the label values that are associated with a given label name.
 func (q *ChunkQuerier) LabelValuesForLabelName(ctx context.Context, ln model.LabelName) (model.LabelValues, error) {
 	// TODO: Support querying historical label values at some point?
 	return nil, nil
 }
 
-// MetricsForLabelMatchers is a noop for chunk querier.
+// MetricsForLabelMatchers implements Querier, looking up each set of matchers
+// in parallel.
 func (q *ChunkQuerier) MetricsForLabelMatchers(ctx context.Context, from, through model.Time, matcherSets ...metric.LabelMatchers) ([]metric.Metric, error) {
-	return nil, nil
+	results := make(chan []model.Metric)
+	errors := make(chan error)
+	for _, matchers := range matcherSets {
+		go func(matchers metric.LabelMatchers) {
+			metrics, err := q.getSeries(ctx, from, through, matchers...)
+			if err != nil {
+				errors <- err
+			} else {
+				results <- metrics
+			}
+		}(matchers)
+	}
+
+	fpToMetric := map[model.Fingerprint]model.Metric{}
+	var lastErr error
+	for range matcherSets {
+		select {
+		case err := <-errors:
+			lastErr = err
+		case metrics := <-results:
+			for _, m := range metrics {
+				fpToMetric[m.Fingerprint()] = m
+			}
+		}
+	}
+	if lastErr != nil {
+		return nil, lastErr
+	}
+
+	result := make([]metric.Metric, 0, len(fpToMetric))
+	for _, m := range fpToMetric {
+		result = append(result, metric.Metric{Metric: m})
+	}
+	return result, nil
+}
+
+func (q *ChunkQuerier) getSeries(ctx context.Context, from, through model.Time, matchers ...*metric.LabelMatcher) ([]model.Metric, error) {
+	if store, ok := q.Store.(seriesStore); ok {
+		return store.GetSeries(ctx, from, through, matchers...)
+	}
+
+	chunks, err := q.Store.Get(ctx, from, through, matchers...)
+	if err != nil {
+		return nil, err
+	}
+	metrics := make([]model.Metric, 0, len(chunks))
+	for _, c := range chunks {
+		metrics = append(metrics, c.Metric)
+	}
+	return metrics, nil
+}
+
+// timeRangeQuerier is a Querier which only queries the underlying Querier for
+// samples between maxAge and minAge old, where zero means unbounded. Any
+// overlap with the other queriers is deduplicated when the results are merged.
+type timeRangeQuerier struct {
+	Querier
+	maxAge, minAge time.Duration
+}
+
+// clamp returns the part of the range [from, to] to query, and false if there
+// is none.
+func (q timeRangeQuerier) clamp(from, to model.Time) (model.Time, model.Time, bool) {
+	now := model.Now()
+	if q.maxAge > 0 {
+		if earliest := now.Add(-q.maxAge); from.Before(earliest) {
+			from = earliest
+		}
+	}
+	if q.minAge > 0 {
+		if latest := now.Add(-q.minAge); to.After(latest) {
+			to = latest
+		}
+	}
+	return from, to, !from.After(to)
+}
+
+// Query implements Querier.
+func (q timeRangeQuerier) Query(ctx context.Context, from, to model.Time, matchers ...*metric.LabelMatcher) (model.Matrix, error) {
+	from, to, ok := q.clamp(from, to)
+	if !ok {
+		return nil, nil
+	}
+	return q.Querier.Query(ctx, from, to, matchers...)
+}
+
+// QueryIterators implements IteratorQuerier.
+func (q timeRangeQuerier) QueryIterators(ctx context.Context, from, to model.Time, matchers ...*metric.LabelMatcher) ([]local.SeriesIterator, error) {
+	from, to, ok := q.clamp(from, to)
+	if !ok {
+		return nil, nil
+	}
+	return queryIterators(ctx, q.Querier, from, to, matchers...)
+}
+
+// MetricsForLabelMatchers implements Querier.
+func (q timeRangeQuerier) MetricsForLabelMatchers(ctx context.Context, from, through model.Time, matcherSets ...metric.LabelMatchers) ([]metric.Metric, error) {
+	from, through, ok := q.clamp(from, through)
+	if !ok {
+		return nil, nil
+	}
+	return q.Querier.MetricsForLabelMatchers(ctx, from, through, matcherSets...)
 }
 
 // Queryable is an adapter between Prometheus' Queryable and Querier.
 type Queryable struct {
 	Q local.Querier
+
+	// The maximum number of samples each query may read, or 0 for no limit.
+	MaxSamples int
 }
 
-// Querier implements Queryable
+// Querier implements Queryable. The engine gets a querier for each query.
 func (q Queryable) Querier() (local.Querier, error) {
+	if q.MaxSamples > 0 {
+		return sampleLimitQuerier{Querier: q.Q, limit: &sampleLimit{max: int64(q.MaxSamples)}}, nil
+	}
 	return q.Q, nil
 }
 
@@ -90,57 +300,88 @@ func (q Queryable) Querier() (local.Querier, error) {
 // cortex.Queriers for the same query.
 type MergeQuerier struct {
 	Queriers []Querier
+
+	// The maximum number of series MetricsForLabelMatchers returns, or 0 for
+	// no limit.
+	MaxSeries int
 }
 
 // QueryRange fetches series for a given time range and label matchers from multiple
 // promql.Queriers and returns the merged results as a map of series iterators.
 func (qm MergeQuerier) QueryRange(ctx context.Context, from, to model.Time, matchers ...*metric.LabelMatcher) ([]local.SeriesIterator, error) {
-	// Fetch samples from all queriers in parallel
-	matrices := make(chan model.Matrix)
+	sp, ctx := util.StartSpanFromContext(ctx, "MergeQuerier.QueryRange")
+	defer sp.Finish()
+
+	// Fetch series from all queriers in parallel. Queriers which support it
+	// return lazy iterators; the others' matrices are wrapped in iterators.
+	results := make(chan []local.SeriesIterator)
 	errors := make(chan error)
 	for _, q := range qm.Queriers {
 		go func(q Querier) {
-			matrix, err := q.Query(ctx, from, to, matchers...)
+			iterators, err := queryIterators(ctx, q, from, to, matchers...)
 			if err != nil {
 				errors <- err
 			} else {
-				matrices <- matrix
+				results <- iterators
 			}
 		}(q)
 	}
 
-	// Group them by fingerprint (unsorted and with overlap).
-	fpToIt := map[model.Fingerprint]local.SeriesIterator{}
+	// Group them by fingerprint (with overlap), without loading the series of
+	// iterators which know theirs.
+	fpToIts := map[model.Fingerprint][]local.SeriesIterator{}
 	var lastErr error
 	for i := 0; i < len(qm.Queriers); i++ {
 		select {
 		case err := <-errors:
 			lastErr = err
 
-		case matrix := <-matrices:
-			for _, ss := range matrix {
-				fp := ss.Metric.Fingerprint()
-				if it, ok := fpToIt[fp]; !ok {
-					fpToIt[fp] = sampleStreamIterator{
-						ss: ss,
-					}
-				} else {
-					ssIt := it.(sampleStreamIterator)
-					ssIt.ss.Values = util.MergeSamples(ssIt.ss.Values, ss.Values)
-				}
+		case iterators := <-results:
+			for _, it := range iterators {
+				fp := seriesFingerprint(it)
+				fpToIts[fp] = append(fpToIts[fp], it)
 			}
 		}
 	}
 	if lastErr != nil {
-		log.Errorf("Error in MergeQuerier.QueryRange: %v", lastErr)
+		util.WithRequestID(ctx).Errorf("Error in MergeQuerier.QueryRange: %v", lastErr)
+		ext.Error.Set(sp, true)
 		return nil, lastErr
 	}
+	sp.SetTag("series", len(fpToIts))
+
+	// Series from several queriers are only merged as the engine reads them,
+	// in order of fingerprint, so in the order batches of series are fetched.
+	fps := make(model.Fingerprints, 0, len(fpToIts))
+	for fp := range fpToIts {
+		fps = append(fps, fp)
+	}
+	sort.Sort(fps)
+	iterators := make([]local.SeriesIterator, 0, len(fps))
+	for _, fp := range fps {
+		if its := fpToIts[fp]; len(its) == 1 {
+			iterators = append(iterators, staleIterator{its[0]})
+		} else {
+			iterators = append(iterators, staleIterator{mergeIterator{its: its}})
+		}
+	}
+
+	return iterators, nil
+}
 
-	iterators := make([]local.SeriesIterator, 0, len(fpToIt))
-	for _, it := range fpToIt {
-		iterators = append(iterators, it)
+func queryIterators(ctx context.Context, q Querier, from, to model.Time, matchers ...*metric.LabelMatcher) ([]local.SeriesIterator, error) {
+	if iq, ok := q.(IteratorQuerier); ok {
+		return iq.QueryIterators(ctx, from, to, matchers...)
 	}
 
+	matrix, err := q.Query(ctx, from, to, matchers...)
+	if err != nil {
+		return nil, err
+	}
+	iterators := make([]local.SeriesIterator, 0, len(matrix))
+	for _, ss := range matrix {
+		iterators = append(iterators, sampleStreamIterator{ss: ss})
+	}
 	return iterators, nil
 }
 
@@ -154,19 +395,42 @@ func (qm MergeQuerier) QueryInstant(ctx context.Context, ts model.Time, stalenes
 
 // MetricsForLabelMatchers Implements local.Querier.
 func (qm MergeQuerier) MetricsForLabelMatchers(ctx context.Context, from, through model.Time, matcherSets ...metric.LabelMatchers) ([]metric.Metric, error) {
-	// NB we don't do this in parallel, as in practice we only have 2 queriers,
-	// one of which is the chunk store which doesn't implement this.
+	sp, ctx := util.StartSpanFromContext(ctx, "MergeQuerier.MetricsForLabelMatchers")
+	defer sp.Finish()
 
-	metrics := map[model.Fingerprint]metric.Metric{}
+	results := make(chan []metric.Metric)
+	errors := make(chan error)
 	for _, q := range qm.Queriers {
-		ms, err := q.MetricsForLabelMatchers(ctx, from, through, matcherSets...)
-		if err != nil {
-			return nil, err
-		}
-		for _, m := range ms {
-			metrics[m.Metric.Fingerprint()] = m
+		go func(q Querier) {
+			ms, err := q.MetricsForLabelMatchers(ctx, from, through, matcherSets...)
+			if err != nil {
+				errors <- err
+			} else {
+				results <- ms
+			}
+		}(q)
+	}
+
+	metrics := map[model.Fingerprint]metric.Metric{}
+	var lastErr error
+	for range qm.Queriers {
+		select {
+		case err := <-errors:
+			lastErr = err
+		case ms := <-results:
+			for _, m := range ms {
+				metrics[m.Metric.Fingerprint()] = m
+			}
 		}
 	}
+	if lastErr != nil {
+		ext.Error.Set(sp, true)
+		return nil, lastErr
+	}
+	sp.SetTag("series", len(metrics))
+	if qm.MaxSeries > 0 && len(metrics) > qm.MaxSeries {
+		return nil, fmt.Errorf("series limit of %d exceeded, narrow the matchers or time range", qm.MaxSeries)
+	}
 
 	result := make([]metric.Metric, 0, len(metrics))
 	for _, m := range metrics {
@@ -0,0 +1,182 @@
+package querier
+
+import (
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	prom_chunk "github.com/prometheus/prometheus/storage/local/chunk"
+	"github.com/prometheus/prometheus/storage/metric"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex/chunk"
+)
+
+// recordingQuerier records the time range it was queried for.
+type recordingQuerier struct {
+	called   bool
+	from, to model.Time
+}
+
+func (q *recordingQuerier) Query(ctx context.Context, from, to model.Time, matchers ...*metric.LabelMatcher) (model.Matrix, error) {
+	q.called, q.from, q.to = true, from, to
+	return model.Matrix{}, nil
+}
+
+func (q *recordingQuerier) LabelValuesForLabelName(context.Context, model.LabelName) (model.LabelValues, error) {
+	return nil, nil
+}
+
+func (q *recordingQuerier) MetricsForLabelMatchers(ctx context.Context, from, through model.Time, matcherSets ...metric.LabelMatchers) ([]metric.Metric, error) {
+	return nil, nil
+}
+
+func TestTimeRangeQuerier(t *testing.T) {
+	now := model.Now()
+	for i, tc := range []struct {
+		maxAge, minAge     time.Duration
+		from, to           model.Time
+		expectedFrom       model.Time
+		expectedTo         model.Time
+		expectedNotQueried bool
+	}{
+		// Unbounded.
+		{
+			from:         now.Add(-48 * time.Hour),
+			to:           now,
+			expectedFrom: now.Add(-48 * time.Hour),
+			expectedTo:   now,
+		},
+		// Ingesters are only queried for recent samples.
+		{
+			maxAge:       12 * time.Hour,
+			from:         now.Add(-48 * time.Hour),
+			to:           now,
+			expectedFrom: now.Add(-12 * time.Hour),
+			expectedTo:   now,
+		},
+		{
+			maxAge:             12 * time.Hour,
+			from:               now.Add(-48 * time.Hour),
+			to:                 now.Add(-24 * time.Hour),
+			expectedNotQueried: true,
+		},
+		// The store is only queried for older samples.
+		{
+			minAge:       time.Hour,
+			from:         now.Add(-48 * time.Hour),
+			to:           now,
+			expectedFrom: now.Add(-48 * time.Hour),
+			expectedTo:   now.Add(-time.Hour),
+		},
+		{
+			minAge:             time.Hour,
+			from:               now.Add(-30 * time.Minute),
+			to:                 now,
+			expectedNotQueried: true,
+		},
+	} {
+		t.Run(fmt.Sprintf("[%d]", i), func(t *testing.T) {
+			inner := &recordingQuerier{}
+			q := timeRangeQuerier{Querier: inner, maxAge: tc.maxAge, minAge: tc.minAge}
+			_, err := q.QueryIterators(context.Background(), tc.from, tc.to)
+			require.NoError(t, err)
+			if tc.expectedNotQueried {
+				assert.False(t, inner.called)
+				return
+			}
+			require.True(t, inner.called)
+			// The querier uses the current time, which may have moved on.
+			assert.InDelta(t, int64(tc.expectedFrom), int64(inner.from), float64(time.Second/time.Millisecond))
+			assert.InDelta(t, int64(tc.expectedTo), int64(inner.to), float64(time.Second/time.Millisecond))
+		})
+	}
+}
+
+func TestMergeQuerierDedupesOverlap(t *testing.T) {
+	ingesterSamples := makeSamples(80, 200, 10)
+	chunkSamples := makeSamples(0, 100, 10)
+	q := MergeQuerier{
+		Queriers: []Querier{
+			matrixQuerier{model.Matrix{{Metric: testMetric, Values: ingesterSamples}}},
+			matrixQuerier{model.Matrix{{Metric: testMetric, Values: chunkSamples}}},
+		},
+	}
+	its, err := q.QueryRange(context.Background(), 0, 200)
+	require.NoError(t, err)
+	require.Len(t, its, 1)
+	assert.Equal(t, makeSamples(0, 200, 10), its[0].RangeValues(metric.Interval{OldestInclusive: 0, NewestInclusive: 200}))
+}
+
+type matrixQuerier struct {
+	matrix model.Matrix
+}
+
+func (q matrixQuerier) Query(ctx context.Context, from, to model.Time, matchers ...*metric.LabelMatcher) (model.Matrix, error) {
+	return q.matrix, nil
+}
+
+func (q matrixQuerier) LabelValuesForLabelName(context.Context, model.LabelName) (model.LabelValues, error) {
+	return nil, nil
+}
+
+func (q matrixQuerier) MetricsForLabelMatchers(ctx context.Context, from, through model.Time, matcherSets ...metric.LabelMatchers) ([]metric.Metric, error) {
+	var result []metric.Metric
+	for _, ss := range q.matrix {
+		result = append(result, metric.Metric{Metric: ss.Metric})
+	}
+	return result, nil
+}
+
+type chunksStore []chunk.Chunk
+
+func (s chunksStore) Get(ctx context.Context, from, through model.Time, matchers ...*metric.LabelMatcher) ([]chunk.Chunk, error) {
+	return s, nil
+}
+
+func TestMergeQuerierMetricsForLabelMatchers(t *testing.T) {
+	var (
+		m1 = model.Metric{model.MetricNameLabel: "foo", "i": "1"}
+		m2 = model.Metric{model.MetricNameLabel: "foo", "i": "2"}
+		m3 = model.Metric{model.MetricNameLabel: "foo", "i": "3"}
+	)
+	makeChunk := func(m model.Metric) chunk.Chunk {
+		return chunk.NewChunk(m.Fingerprint(), m, prom_chunk.New(), 0, 100)
+	}
+	matchers, err := metric.NewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo")
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		maxSeries int
+		expected  []model.Metric
+	}{
+		{0, []model.Metric{m1, m2, m3}},
+		{3, []model.Metric{m1, m2, m3}},
+		{2, nil},
+	} {
+		q := MergeQuerier{
+			Queriers: []Querier{
+				matrixQuerier{model.Matrix{{Metric: m1}, {Metric: m2}}},
+				&ChunkQuerier{Store: chunksStore{makeChunk(m2), makeChunk(m3), makeChunk(m3)}},
+			},
+			MaxSeries: tc.maxSeries,
+		}
+		ms, err := q.MetricsForLabelMatchers(context.Background(), 0, 100, metric.LabelMatchers{matchers})
+		if tc.expected == nil {
+			assert.Error(t, err)
+			continue
+		}
+		require.NoError(t, err)
+		actual := make([]model.Metric, len(ms))
+		for _, m := range ms {
+			i, err := strconv.Atoi(string(m.Metric["i"]))
+			require.NoError(t, err)
+			actual[i-1] = m.Metric
+		}
+		assert.Equal(t, tc.expected, actual)
+	}
+}
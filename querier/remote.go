@@ -0,0 +1,129 @@
+package querier
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"golang.org/x/net/context"
+	"golang.org/x/net/context/ctxhttp"
+
+	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex/util"
+)
+
+// maxErrorBodySize is how much of a failed response body is included in the
+// returned error.
+const maxErrorBodySize = 1024
+
+// A RemoteQuerier evaluates PromQL expressions by sending them as instant
+// queries to a remote Prometheus v1 HTTP API. This is intended to be the
+// Cortex query path - either the querier's /api/prom API, or any caching and
+// splitting query frontend deployed in front of it - so that evaluations are
+// subject to its caching and limits.
+type RemoteQuerier struct {
+	// URL is the prefix of the Prometheus API, ie the URL up to but not
+	// including "/api/v1/query".
+	URL    *url.URL
+	Client *http.Client
+}
+
+// NewRemoteQuerier makes a new RemoteQuerier.
+func NewRemoteQuerier(u *url.URL, timeout time.Duration) *RemoteQuerier {
+	return &RemoteQuerier{
+		URL: u,
+		Client: &http.Client{
+			Timeout: timeout,
+		},
+	}
+}
+
+type remoteResponse struct {
+	Status    string          `json:"status"`
+	Data      json.RawMessage `json:"data"`
+	ErrorType string          `json:"errorType"`
+	Error     string          `json:"error"`
+}
+
+type remoteQueryData struct {
+	ResultType model.ValueType `json:"resultType"`
+	Result     json.RawMessage `json:"result"`
+}
+
+// Query evaluates expr at ts, for the user in ctx. Scalar results are
+// returned as a single sample with an empty metric.
+func (q *RemoteQuerier) Query(ctx context.Context, expr string, ts model.Time) (model.Vector, error) {
+	u := *q.URL
+	u.Path = path.Join(u.Path, "/api/v1/query")
+	values := url.Values{}
+	values.Set("query", expr)
+	values.Set("time", ts.String())
+	u.RawQuery = values.Encode()
+
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := user.InjectIntoHTTPRequest(ctx, req); err != nil {
+		return nil, err
+	}
+	if requestID := util.ExtractRequestID(ctx); requestID != "" {
+		req.Header.Set(util.RequestIDHeader, requestID)
+	}
+
+	resp, err := ctxhttp.Do(ctx, q.Client, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	// Failed queries usually have a JSON error body, but may not if the error
+	// came from eg a proxy, in which case report the body as is.
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorBodySize))
+		var result remoteResponse
+		if err := json.Unmarshal(body, &result); err == nil && result.Error != "" {
+			return nil, fmt.Errorf("remote query failed: %s: %s: %s", resp.Status, result.ErrorType, result.Error)
+		}
+		return nil, fmt.Errorf("remote query failed: %s: %s", resp.Status, body)
+	}
+
+	var result remoteResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("error decoding remote query response: %v", err)
+	}
+	if result.Status != "success" {
+		return nil, fmt.Errorf("remote query failed: %s: %s: %s", resp.Status, result.ErrorType, result.Error)
+	}
+
+	var data remoteQueryData
+	if err := json.Unmarshal(result.Data, &data); err != nil {
+		return nil, err
+	}
+	switch data.ResultType {
+	case model.ValVector:
+		var vector model.Vector
+		if err := json.Unmarshal(data.Result, &vector); err != nil {
+			return nil, err
+		}
+		return vector, nil
+	case model.ValScalar:
+		var scalar model.Scalar
+		if err := json.Unmarshal(data.Result, &scalar); err != nil {
+			return nil, err
+		}
+		return model.Vector{&model.Sample{
+			Metric:    model.Metric{},
+			Value:     scalar.Value,
+			Timestamp: scalar.Timestamp,
+		}}, nil
+	default:
+		return nil, fmt.Errorf("remote query result is not a vector or scalar: %s", data.ResultType)
+	}
+}
@@ -0,0 +1,116 @@
+package querier
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/user"
+)
+
+func TestRemoteQuerier(t *testing.T) {
+	for i, tc := range []struct {
+		prefix         string
+		status         int
+		body           string
+		expectedResult model.Vector
+		expectedError  string
+	}{
+		{
+			status: http.StatusOK,
+			body:   `{"status":"success","data":{"resultType":"vector","result":[{"metric":{"__name__":"foo","bar":"baz"},"value":[1.5,"2"]}]}}`,
+			expectedResult: model.Vector{
+				&model.Sample{
+					Metric:    model.Metric{"__name__": "foo", "bar": "baz"},
+					Value:     2,
+					Timestamp: 1500,
+				},
+			},
+		},
+
+		// A trailing slash on the configured URL shouldn't matter.
+		{
+			prefix:         "/",
+			status:         http.StatusOK,
+			body:           `{"status":"success","data":{"resultType":"vector","result":[]}}`,
+			expectedResult: model.Vector{},
+		},
+
+		// Scalars are converted to a single sample with no labels.
+		{
+			status: http.StatusOK,
+			body:   `{"status":"success","data":{"resultType":"scalar","result":[1.5,"3"]}}`,
+			expectedResult: model.Vector{
+				&model.Sample{
+					Metric:    model.Metric{},
+					Value:     3,
+					Timestamp: 1500,
+				},
+			},
+		},
+
+		{
+			status:        http.StatusOK,
+			body:          `{"status":"success","data":{"resultType":"matrix","result":[]}}`,
+			expectedError: "remote query result is not a vector or scalar: matrix",
+		},
+
+		{
+			status:        http.StatusBadRequest,
+			body:          `{"status":"error","errorType":"bad_data","error":"parse error"}`,
+			expectedError: "remote query failed: 400 Bad Request: bad_data: parse error",
+		},
+
+		// Non-JSON errors, eg from a proxy, are reported with the status.
+		{
+			status:        http.StatusBadGateway,
+			body:          "<html>Bad Gateway</html>",
+			expectedError: "remote query failed: 502 Bad Gateway: <html>Bad Gateway</html>",
+		},
+	} {
+		t.Run(fmt.Sprintf("[%d]", i), func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				assert.Equal(t, "/api/prom/api/v1/query", r.URL.Path)
+				assert.Equal(t, "up", r.URL.Query().Get("query"))
+				assert.Equal(t, "1.5", r.URL.Query().Get("time"))
+				userID, _, err := user.ExtractFromHTTPRequest(r)
+				assert.NoError(t, err)
+				assert.Equal(t, "user", userID)
+
+				w.WriteHeader(tc.status)
+				w.Write([]byte(tc.body))
+			}))
+			defer server.Close()
+
+			u, err := url.Parse(server.URL + "/api/prom" + tc.prefix)
+			require.NoError(t, err)
+			q := NewRemoteQuerier(u, time.Second)
+
+			ctx := user.Inject(context.Background(), "user")
+			result, err := q.Query(ctx, "up", 1500)
+			if tc.expectedError != "" {
+				assert.EqualError(t, err, tc.expectedError)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedResult, result)
+		})
+	}
+}
+
+func TestRemoteQuerierNoUser(t *testing.T) {
+	u, err := url.Parse("http://localhost/api/prom")
+	require.NoError(t, err)
+	q := NewRemoteQuerier(u, time.Second)
+
+	_, err = q.Query(context.Background(), "up", 1500)
+	assert.Error(t, err)
+}
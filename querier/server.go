@@ -0,0 +1,153 @@
+package querier
+
+import (
+	"sort"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/local"
+	"github.com/prometheus/prometheus/storage/metric"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+
+	"github.com/weaveworks/cortex"
+	"github.com/weaveworks/cortex/util"
+)
+
+// Server implements cortex.QuerierServer, serving the series the PromQL engine
+// reads to tools which want them raw. It must be used after the user has been
+// authenticated.
+type Server struct {
+	querier local.Querier
+}
+
+// NewServer makes a new Server, serving the series of the querier, eg. the Q
+// of a Queryable.
+func NewServer(querier local.Querier) *Server {
+	return &Server{querier: querier}
+}
+
+// Select implements cortex.QuerierServer, returning the samples of the
+// series matching the matchers, without staleness markers.
+func (s *Server) Select(ctx context.Context, req *cortex.QueryRequest) (*cortex.QueryResponse, error) {
+	from, to, matchers, err := util.FromQueryRequest(req)
+	if err != nil {
+		return nil, grpc.Errorf(codes.InvalidArgument, "%v", err)
+	}
+	iterators, err := s.querier.QueryRange(ctx, from, to, matchers...)
+	if err != nil {
+		return nil, err
+	}
+
+	matrix := make(model.Matrix, 0, len(iterators))
+	for _, it := range iterators {
+		values := it.RangeValues(metric.Interval{OldestInclusive: from, NewestInclusive: to})
+		it.Close()
+		if len(values) == 0 {
+			continue
+		}
+		matrix = append(matrix, &model.SampleStream{
+			Metric: it.Metric().Metric,
+			Values: values,
+		})
+	}
+	if req.Columnar {
+		return util.ToColumnarQueryResponse(matrix), nil
+	}
+	return util.ToQueryResponse(matrix), nil
+}
+
+// Series implements cortex.QuerierServer, returning the series matching any
+// of the sets of matchers.
+func (s *Server) Series(ctx context.Context, req *cortex.MetricsForLabelMatchersRequest) (*cortex.MetricsForLabelMatchersResponse, error) {
+	metrics, err := s.series(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	return util.ToMetricsForLabelMatchersResponse(metrics), nil
+}
+
+// LabelNames implements cortex.QuerierServer, returning the names of the
+// labels of the series matching any of the sets of matchers, which are
+// required as the chunk store has no index of label names.
+func (s *Server) LabelNames(ctx context.Context, req *cortex.MetricsForLabelMatchersRequest) (*cortex.LabelNamesResponse, error) {
+	if len(req.MatchersSet) == 0 {
+		return nil, grpc.Errorf(codes.InvalidArgument, "no matchers given")
+	}
+	metrics, err := s.series(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	names := map[model.LabelName]struct{}{}
+	for _, m := range metrics {
+		for name := range m {
+			names[name] = struct{}{}
+		}
+	}
+	resp := &cortex.LabelNamesResponse{LabelNames: make([]string, 0, len(names))}
+	for name := range names {
+		resp.LabelNames = append(resp.LabelNames, string(name))
+	}
+	sort.Strings(resp.LabelNames)
+	return resp, nil
+}
+
+// LabelValues implements cortex.QuerierServer, returning the values of the
+// label of the series matching any of the sets of matchers. Without any, it
+// returns the values the ingesters have, as the PromQL API does.
+func (s *Server) LabelValues(ctx context.Context, req *cortex.SeriesLabelValuesRequest) (*cortex.LabelValuesResponse, error) {
+	name := model.LabelName(req.LabelName)
+	if !name.IsValid() {
+		return nil, grpc.Errorf(codes.InvalidArgument, "invalid label name %q", req.LabelName)
+	}
+
+	var values model.LabelValues
+	if len(req.MatchersSet) == 0 {
+		var err error
+		if values, err = s.querier.LabelValuesForLabelName(ctx, name); err != nil {
+			return nil, err
+		}
+	} else {
+		metrics, err := s.series(ctx, &cortex.MetricsForLabelMatchersRequest{
+			StartTimestampMs: req.StartTimestampMs,
+			EndTimestampMs:   req.EndTimestampMs,
+			MatchersSet:      req.MatchersSet,
+		})
+		if err != nil {
+			return nil, err
+		}
+		seen := map[model.LabelValue]struct{}{}
+		for _, m := range metrics {
+			if value, ok := m[name]; ok {
+				if _, ok := seen[value]; !ok {
+					seen[value] = struct{}{}
+					values = append(values, value)
+				}
+			}
+		}
+	}
+
+	sort.Sort(values)
+	resp := &cortex.LabelValuesResponse{LabelValues: make([]string, 0, len(values))}
+	for _, value := range values {
+		resp.LabelValues = append(resp.LabelValues, string(value))
+	}
+	return resp, nil
+}
+
+func (s *Server) series(ctx context.Context, req *cortex.MetricsForLabelMatchersRequest) ([]model.Metric, error) {
+	from, to, matchersSet, err := util.FromMetricsForLabelMatchersRequest(req)
+	if err != nil {
+		return nil, grpc.Errorf(codes.InvalidArgument, "%v", err)
+	}
+	ms, err := s.querier.MetricsForLabelMatchers(ctx, from, to, matchersSet...)
+	if err != nil {
+		return nil, err
+	}
+	metrics := make([]model.Metric, 0, len(ms))
+	for _, m := range ms {
+		metrics = append(metrics, m.Metric)
+	}
+	return metrics, nil
+}
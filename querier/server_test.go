@@ -0,0 +1,65 @@
+package querier
+
+import (
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+
+	"github.com/weaveworks/cortex"
+	"github.com/weaveworks/cortex/util"
+)
+
+func TestServer(t *testing.T) {
+	var (
+		foo1 = model.Metric{model.MetricNameLabel: "foo", "i": "1"}
+		foo2 = model.Metric{model.MetricNameLabel: "foo", "i": "2", "job": "a"}
+		bar  = model.Metric{model.MetricNameLabel: "bar"}
+	)
+	matrix := model.Matrix{
+		{Metric: foo1, Values: makeSamples(0, 100, 10)},
+		{Metric: foo2, Values: makeSamples(50, 100, 10)},
+		{Metric: bar, Values: makeSamples(0, 100, 10)},
+	}
+	s := NewServer(MergeQuerier{Queriers: []Querier{&shardingQuerier{matrixQuerier: matrixQuerier{matrix}}}})
+	ctx := context.Background()
+
+	matchers, err := metric.NewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo")
+	require.NoError(t, err)
+	req, err := util.ToQueryRequest(0, 40, []*metric.LabelMatcher{matchers})
+	require.NoError(t, err)
+	resp, err := s.Select(ctx, req)
+	require.NoError(t, err)
+	selected, err := util.FromQueryResponse(resp)
+	require.NoError(t, err)
+	// foo2 has no samples in the range.
+	assert.Equal(t, model.Matrix{{Metric: foo1, Values: makeSamples(0, 40, 10)}}, selected)
+
+	seriesReq, err := util.ToMetricsForLabelMatchersRequest(0, 100, []metric.LabelMatchers{{matchers}})
+	require.NoError(t, err)
+	series, err := s.Series(ctx, seriesReq)
+	require.NoError(t, err)
+	assert.Len(t, series.Metric, 3)
+
+	names, err := s.LabelNames(ctx, seriesReq)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"__name__", "i", "job"}, names.LabelNames)
+
+	values, err := s.LabelValues(ctx, &cortex.SeriesLabelValuesRequest{
+		LabelName:   "i",
+		MatchersSet: seriesReq.MatchersSet,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"1", "2"}, values.LabelValues)
+
+	// The chunk store has no index of label names, so they need matchers.
+	_, err = s.LabelNames(ctx, &cortex.MetricsForLabelMatchersRequest{})
+	assert.Equal(t, codes.InvalidArgument, grpc.Code(err))
+	_, err = s.LabelValues(ctx, &cortex.SeriesLabelValuesRequest{LabelName: "0"})
+	assert.Equal(t, codes.InvalidArgument, grpc.Code(err))
+}
@@ -0,0 +1,417 @@
+package querier
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex/util"
+)
+
+// maxPointsPerSeries matches the Prometheus API's limit on the resolution of
+// range queries; requests over it are left to the API to reject.
+const maxPointsPerSeries = 11000
+
+var shardedQueries = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: "cortex",
+	Name:      "querier_sharded_queries_total",
+	Help:      "The total number of queries split into shards executed in parallel.",
+})
+
+func init() {
+	prometheus.MustRegister(shardedQueries)
+}
+
+// Aggregations whose results can be computed by aggregating the results of
+// the same aggregation over disjoint sets of series. Counts of the shards are
+// summed.
+var shardableAggregations = map[string]func(a, b model.SampleValue) model.SampleValue{
+	"sum":   func(a, b model.SampleValue) model.SampleValue { return a + b },
+	"count": func(a, b model.SampleValue) model.SampleValue { return a + b },
+	"min": func(a, b model.SampleValue) model.SampleValue {
+		if b < a || math.IsNaN(float64(a)) {
+			return b
+		}
+		return a
+	},
+	"max": func(a, b model.SampleValue) model.SampleValue {
+		if b > a || math.IsNaN(float64(a)) {
+			return b
+		}
+		return a
+	},
+}
+
+// Functions whose results for a series depend on other series, or which
+// return series without any being selected.
+var unshardableFunctions = map[string]bool{
+	"absent":             true,
+	"count_scalar":       true,
+	"drop_common_labels": true,
+	"histogram_quantile": true,
+	"scalar":             true,
+	"time":               true,
+	"vector":             true,
+}
+
+// QuerySharding splits queries whose outermost operation is a sum, count, min
+// or max aggregation into one query per shard of the series, executes them
+// in parallel, and merges their results. Other queries are passed on. It must
+// be used after the user has been authenticated.
+type QuerySharding struct {
+	shards int
+	engine *promql.Engine
+}
+
+// NewQuerySharding makes a new QuerySharding, splitting queries into the
+// given number of shards, or none if less than 2.
+func NewQuerySharding(shards int, engine *promql.Engine) *QuerySharding {
+	return &QuerySharding{
+		shards: shards,
+		engine: engine,
+	}
+}
+
+// Wrap implements middleware.Interface.
+func (s *QuerySharding) Wrap(next http.Handler) http.Handler {
+	if s.shards < 2 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var (
+			result model.Value
+			err    error
+			ok     bool
+		)
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/api/v1/query"):
+			result, ok, err = s.instantQuery(r)
+		case strings.HasSuffix(r.URL.Path, "/api/v1/query_range"):
+			result, ok, err = s.rangeQuery(r)
+		}
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		shardedQueries.Inc()
+		writeQueryResponse(w, result, err)
+	})
+}
+
+// instantQuery executes the request's instant query in shards, returning
+// false if it can't be.
+func (s *QuerySharding) instantQuery(r *http.Request) (model.Value, bool, error) {
+	ts := model.Now()
+	if t := r.FormValue("time"); t != "" {
+		var err error
+		if ts, err = parseTime(t); err != nil {
+			return nil, false, nil
+		}
+	}
+	queries, merge, ok := s.shardQuery(r.FormValue("query"))
+	if !ok {
+		return nil, false, nil
+	}
+
+	results, err := s.execShards(r.Context(), queries, func(q string) (promql.Query, error) {
+		return s.engine.NewInstantQuery(q, ts)
+	})
+	if err != nil {
+		return nil, true, err
+	}
+	vectors := make([]model.Vector, 0, len(results))
+	for _, res := range results {
+		v, err := res.Vector()
+		if err != nil {
+			return nil, true, err
+		}
+		vectors = append(vectors, v)
+	}
+	return mergeVectors(vectors, merge), true, nil
+}
+
+// rangeQuery executes the request's range query in shards, returning false
+// if it can't be.
+func (s *QuerySharding) rangeQuery(r *http.Request) (model.Value, bool, error) {
+	start, err := parseTime(r.FormValue("start"))
+	if err != nil {
+		return nil, false, nil
+	}
+	end, err := parseTime(r.FormValue("end"))
+	if err != nil || end.Before(start) {
+		return nil, false, nil
+	}
+	step, err := parseDuration(r.FormValue("step"))
+	if err != nil || step <= 0 || end.Sub(start)/step > maxPointsPerSeries {
+		return nil, false, nil
+	}
+	queries, merge, ok := s.shardQuery(r.FormValue("query"))
+	if !ok {
+		return nil, false, nil
+	}
+
+	results, err := s.execShards(r.Context(), queries, func(q string) (promql.Query, error) {
+		return s.engine.NewRangeQuery(q, start, end, step)
+	})
+	if err != nil {
+		return nil, true, err
+	}
+	matrices := make([]model.Matrix, 0, len(results))
+	for _, res := range results {
+		m, err := res.Matrix()
+		if err != nil {
+			return nil, true, err
+		}
+		matrices = append(matrices, m)
+	}
+	return mergeMatrices(matrices, merge), true, nil
+}
+
+// shardQuery returns the query for each shard of the series, and how to merge
+// their results, or false if the query can't be sharded.
+func (s *QuerySharding) shardQuery(query string) ([]string, func(a, b model.SampleValue) model.SampleValue, bool) {
+	expr, err := promql.ParseExpr(query)
+	if err != nil {
+		return nil, nil, false
+	}
+	aggr, ok := shardableAggregation(expr)
+	if !ok {
+		return nil, nil, false
+	}
+	merge := shardableAggregations[aggr.Op.String()]
+
+	queries := make([]string, 0, s.shards)
+	for i := 0; i < s.shards; i++ {
+		matcher := util.QueryShard{Index: uint64(i), Count: uint64(s.shards)}.Matcher()
+		// Each shard's query is parsed again to modify its own copy of the
+		// selectors.
+		shardAggr, _ := shardableAggregation(mustParseExpr(query))
+		promql.Inspect(shardAggr.Expr, func(node promql.Node) bool {
+			switch n := node.(type) {
+			case *promql.VectorSelector:
+				n.LabelMatchers = append(n.LabelMatchers, matcher)
+			case *promql.MatrixSelector:
+				n.LabelMatchers = append(n.LabelMatchers, matcher)
+			}
+			return true
+		})
+		queries = append(queries, shardAggr.String())
+	}
+	return queries, merge, true
+}
+
+func mustParseExpr(query string) promql.Expr {
+	expr, err := promql.ParseExpr(query)
+	if err != nil {
+		panic(err)
+	}
+	return expr
+}
+
+// shardableAggregation returns the outermost aggregation of the expression,
+// if it can be computed from the aggregations of shards of the series. That
+// is the case for sum, count, min and max, if the result for each series
+// aggregated only depends on that series.
+func shardableAggregation(expr promql.Expr) (*promql.AggregateExpr, bool) {
+	for {
+		paren, ok := expr.(*promql.ParenExpr)
+		if !ok {
+			break
+		}
+		expr = paren.Expr
+	}
+	aggr, ok := expr.(*promql.AggregateExpr)
+	if !ok || aggr.KeepCommonLabels {
+		return nil, false
+	}
+	if _, ok := shardableAggregations[aggr.Op.String()]; !ok {
+		return nil, false
+	}
+
+	shardable, selectors := true, 0
+	promql.Inspect(aggr.Expr, func(node promql.Node) bool {
+		switch n := node.(type) {
+		case *promql.AggregateExpr:
+			shardable = false
+		case *promql.BinaryExpr:
+			// Series matched on either side may be in different shards.
+			if n.LHS.Type() == model.ValVector && n.RHS.Type() == model.ValVector {
+				shardable = false
+			}
+		case *promql.Call:
+			if unshardableFunctions[n.Func.Name] {
+				shardable = false
+			}
+		case *promql.VectorSelector, *promql.MatrixSelector:
+			selectors++
+		}
+		return shardable
+	})
+	return aggr, shardable && selectors > 0
+}
+
+// execShards executes the queries in parallel.
+func (s *QuerySharding) execShards(ctx context.Context, queries []string, newQuery func(string) (promql.Query, error)) ([]*promql.Result, error) {
+	type result struct {
+		res *promql.Result
+		err error
+	}
+	results := make(chan result)
+	for _, q := range queries {
+		go func(q string) {
+			qry, err := newQuery(q)
+			if err != nil {
+				results <- result{err: err}
+				return
+			}
+			res := qry.Exec(ctx)
+			results <- result{res: res, err: res.Err}
+		}(q)
+	}
+
+	var (
+		all     = make([]*promql.Result, 0, len(queries))
+		lastErr error
+	)
+	for range queries {
+		r := <-results
+		if r.err != nil {
+			lastErr = r.err
+		} else {
+			all = append(all, r.res)
+		}
+	}
+	return all, lastErr
+}
+
+func mergeVectors(vectors []model.Vector, merge func(a, b model.SampleValue) model.SampleValue) model.Vector {
+	samples := map[model.Fingerprint]*model.Sample{}
+	for _, v := range vectors {
+		for _, s := range v {
+			fp := s.Metric.Fingerprint()
+			if existing, ok := samples[fp]; ok {
+				existing.Value = merge(existing.Value, s.Value)
+			} else {
+				samples[fp] = s
+			}
+		}
+	}
+
+	result := make(model.Vector, 0, len(samples))
+	for _, s := range samples {
+		result = append(result, s)
+	}
+	sort.Sort(result)
+	return result
+}
+
+func mergeMatrices(matrices []model.Matrix, merge func(a, b model.SampleValue) model.SampleValue) model.Matrix {
+	metrics := map[model.Fingerprint]model.Metric{}
+	values := map[model.Fingerprint]map[model.Time]model.SampleValue{}
+	for _, m := range matrices {
+		for _, ss := range m {
+			fp := ss.Metric.Fingerprint()
+			if _, ok := metrics[fp]; !ok {
+				metrics[fp] = ss.Metric
+				values[fp] = map[model.Time]model.SampleValue{}
+			}
+			for _, sp := range ss.Values {
+				if v, ok := values[fp][sp.Timestamp]; ok {
+					values[fp][sp.Timestamp] = merge(v, sp.Value)
+				} else {
+					values[fp][sp.Timestamp] = sp.Value
+				}
+			}
+		}
+	}
+
+	result := make(model.Matrix, 0, len(metrics))
+	for fp, metric := range metrics {
+		ss := &model.SampleStream{
+			Metric: metric,
+			Values: make([]model.SamplePair, 0, len(values[fp])),
+		}
+		for ts, v := range values[fp] {
+			ss.Values = append(ss.Values, model.SamplePair{Timestamp: ts, Value: v})
+		}
+		sort.Slice(ss.Values, func(i, j int) bool {
+			return ss.Values[i].Timestamp < ss.Values[j].Timestamp
+		})
+		result = append(result, ss)
+	}
+	sort.Sort(result)
+	return result
+}
+
+type queryResponse struct {
+	Status    string     `json:"status"`
+	Data      *queryData `json:"data,omitempty"`
+	ErrorType string     `json:"errorType,omitempty"`
+	Error     string     `json:"error,omitempty"`
+}
+
+type queryData struct {
+	ResultType model.ValueType `json:"resultType"`
+	Result     model.Value     `json:"result"`
+}
+
+// writeQueryResponse writes the result or error as the Prometheus API would.
+func writeQueryResponse(w http.ResponseWriter, result model.Value, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		resp := queryResponse{Status: "error", ErrorType: "execution", Error: err.Error()}
+		code := 422
+		switch err.(type) {
+		case *promql.ParseErr:
+			resp.ErrorType, code = "bad_data", http.StatusBadRequest
+		case promql.ErrQueryCanceled:
+			resp.ErrorType, code = "canceled", http.StatusServiceUnavailable
+		case promql.ErrQueryTimeout:
+			resp.ErrorType, code = "timeout", http.StatusServiceUnavailable
+		}
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(queryResponse{
+		Status: "success",
+		Data: &queryData{
+			ResultType: result.Type(),
+			Result:     result,
+		},
+	})
+}
+
+// parseTime parses a timestamp as the Prometheus API does.
+func parseTime(s string) (model.Time, error) {
+	if t, err := strconv.ParseFloat(s, 64); err == nil {
+		return model.TimeFromUnixNano(int64(t * float64(time.Second))), nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return model.TimeFromUnixNano(t.UnixNano()), nil
+	}
+	return 0, fmt.Errorf("cannot parse %q to a valid timestamp", s)
+}
+
+// parseDuration parses a duration as the Prometheus API does.
+func parseDuration(s string) (time.Duration, error) {
+	if d, err := strconv.ParseFloat(s, 64); err == nil {
+		return time.Duration(d * float64(time.Second)), nil
+	}
+	if d, err := model.ParseDuration(s); err == nil {
+		return time.Duration(d), nil
+	}
+	return 0, fmt.Errorf("cannot parse %q to a valid duration", s)
+}
@@ -0,0 +1,183 @@
+package querier
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/storage/metric"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex/util"
+)
+
+// shardingQuerier returns the series of its matrix matching the matchers,
+// including any query shard, recording the shards queried.
+type shardingQuerier struct {
+	matrixQuerier
+
+	mtx    sync.Mutex
+	shards []util.QueryShard
+}
+
+func (q *shardingQuerier) Query(ctx context.Context, from, to model.Time, matchers ...*metric.LabelMatcher) (model.Matrix, error) {
+	shard, matchers, err := util.ExtractQueryShard(matchers)
+	if err != nil {
+		return nil, err
+	}
+	if shard != nil {
+		q.mtx.Lock()
+		q.shards = append(q.shards, *shard)
+		q.mtx.Unlock()
+	}
+
+	var result model.Matrix
+outer:
+	for _, ss := range q.matrix {
+		if shard != nil && !shard.Contains(ss.Metric.FastFingerprint()) {
+			continue
+		}
+		for _, m := range matchers {
+			if !m.Match(ss.Metric[m.Name]) {
+				continue outer
+			}
+		}
+		result = append(result, ss)
+	}
+	return result, nil
+}
+
+type queryResult struct {
+	Status string `json:"status"`
+	Data   struct {
+		ResultType model.ValueType `json:"resultType"`
+		Result     json.RawMessage `json:"result"`
+	} `json:"data"`
+}
+
+func TestQuerySharding(t *testing.T) {
+	var matrix model.Matrix
+	for i := 0; i < 20; i++ {
+		values := make([]model.SamplePair, 0, 31)
+		for ts := model.Time(0); ts <= 300*1000; ts += 10 * 1000 {
+			values = append(values, model.SamplePair{Timestamp: ts, Value: model.SampleValue(int64(ts) * int64(i+1) / 1000)})
+		}
+		matrix = append(matrix, &model.SampleStream{
+			Metric: model.Metric{
+				model.MetricNameLabel: "foo",
+				"job":                 model.LabelValue(fmt.Sprintf("job%d", i%3)),
+				"i":                   model.LabelValue(fmt.Sprint(i)),
+			},
+			Values: values,
+		})
+	}
+	q := &shardingQuerier{matrixQuerier: matrixQuerier{matrix}}
+	engine := promql.NewEngine(Queryable{Q: MergeQuerier{Queriers: []Querier{q}}}, nil)
+
+	var passedOn bool
+	handler := NewQuerySharding(4, engine).Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		passedOn = true
+	}))
+
+	for _, tc := range []struct {
+		query   string
+		instant bool
+		sharded bool
+	}{
+		{query: "sum by (job) (foo)", sharded: true},
+		{query: "(count without (i) (foo))", sharded: true},
+		{query: "max(rate(foo[1m]))", sharded: true},
+		{query: "min by (job) (foo * 2)", sharded: true},
+		{query: "sum(foo)", instant: true, sharded: true},
+		{query: "count by (job) (foo)", instant: true, sharded: true},
+
+		{query: "avg(foo)"},
+		{query: "sum(foo / on(i) foo)"},
+		{query: "sum(absent(foo))"},
+		{query: "sum(sum by (i) (foo))"},
+		{query: "sum(foo) * 2"},
+		{query: "foo"},
+	} {
+		passedOn = false
+		q.shards = nil
+
+		var (
+			path   = "/api/prom/api/v1/query_range"
+			params = url.Values{"query": {tc.query}, "start": {"60"}, "end": {"300"}, "step": {"30"}}
+		)
+		if tc.instant {
+			path = "/api/prom/api/v1/query"
+			params = url.Values{"query": {tc.query}, "time": {"300"}}
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", path+"?"+params.Encode(), nil))
+		if !tc.sharded {
+			assert.True(t, passedOn, tc.query)
+			continue
+		}
+		require.False(t, passedOn, tc.query)
+		require.Equal(t, http.StatusOK, rec.Code, tc.query)
+		assert.Len(t, q.shards, 4, tc.query)
+
+		var resp queryResult
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+		assert.Equal(t, "success", resp.Status)
+
+		// The merged results are the same as the unsharded query's.
+		if tc.instant {
+			qry, err := engine.NewInstantQuery(tc.query, model.TimeFromUnix(300))
+			require.NoError(t, err)
+			expected, err := qry.Exec(context.Background()).Vector()
+			require.NoError(t, err)
+			sort.Sort(expected)
+			var actual model.Vector
+			require.NoError(t, json.Unmarshal(resp.Data.Result, &actual))
+			assert.Equal(t, model.ValVector, resp.Data.ResultType)
+			assert.Equal(t, expected, actual, tc.query)
+		} else {
+			qry, err := engine.NewRangeQuery(tc.query, model.TimeFromUnix(60), model.TimeFromUnix(300), 30*time.Second)
+			require.NoError(t, err)
+			expected, err := qry.Exec(context.Background()).Matrix()
+			require.NoError(t, err)
+			sort.Sort(expected)
+			var actual model.Matrix
+			require.NoError(t, json.Unmarshal(resp.Data.Result, &actual))
+			assert.Equal(t, model.ValMatrix, resp.Data.ResultType)
+			assert.Equal(t, expected, actual, tc.query)
+		}
+	}
+}
+
+func TestQueryShardingUnsupportedSyntax(t *testing.T) {
+	engine := promql.NewEngine(Queryable{Q: MergeQuerier{}}, nil)
+	var passedOn bool
+	handler := NewQuerySharding(4, engine).Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		passedOn = true
+	}))
+
+	// Our version of PromQL has neither subqueries nor the @ modifier, so
+	// such queries are left to Subqueries to evaluate, or the API to reject
+	// as bad data.
+	for _, query := range []string{
+		"sum(max_over_time(rate(foo[1m])[10m:1m]))",
+		"sum(foo @ 300)",
+	} {
+		_, err := promql.ParseExpr(query)
+		require.Error(t, err, query)
+
+		passedOn = false
+		params := url.Values{"query": {query}, "time": {"300"}}
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/prom/api/v1/query?"+params.Encode(), nil))
+		assert.True(t, passedOn, query)
+	}
+}
@@ -0,0 +1,489 @@
+package querier
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/storage/local"
+	"github.com/prometheus/prometheus/storage/metric"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex/util"
+)
+
+// subqueryPrefix names the placeholder series a subquery's results are read
+// from by the query it is replaced in.
+const subqueryPrefix = "__subquery_"
+
+const subqueryResultsKey contextKey = 1
+
+// Operators which may precede a parenthesised expression without being the
+// name of a function or aggregation called with it.
+var binaryKeywords = map[string]bool{
+	"and":         true,
+	"or":          true,
+	"unless":      true,
+	"bool":        true,
+	"on":          true,
+	"ignoring":    true,
+	"group_left":  true,
+	"group_right": true,
+	"offset":      true,
+}
+
+// Subqueries evaluates the subqueries, eg. max_over_time(rate(foo[1m])[1h:5m]),
+// which our version of PromQL can't parse, in instant and range queries. Each
+// subquery's expression is executed as a range query at its resolution,
+// aligned to multiples of it, and the subquery replaced with a range selector
+// of the results. Subqueries without a resolution, eg. [1h:], take the user's
+// default. Other queries are passed on. It must be used after the user has
+// been authenticated, and with an engine made by NewQueryableEngine.
+type Subqueries struct {
+	defaultResolution time.Duration
+	overrides         map[string]util.Overrides
+	engine            *promql.Engine
+}
+
+// NewSubqueries makes a new Subqueries, loading any overrides file.
+func NewSubqueries(cfg Config, overridesFile string, engine *promql.Engine) (*Subqueries, error) {
+	var overrides map[string]util.Overrides
+	if overridesFile != "" {
+		var err error
+		overrides, err = util.LoadOverrides(overridesFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &Subqueries{
+		defaultResolution: cfg.DefaultSubqueryResolution,
+		overrides:         overrides,
+		engine:            engine,
+	}, nil
+}
+
+// Wrap implements middleware.Interface.
+func (s *Subqueries) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var (
+			result model.Value
+			err    error
+			ok     bool
+		)
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/api/v1/query"):
+			result, ok, err = s.instantQuery(r)
+		case strings.HasSuffix(r.URL.Path, "/api/v1/query_range"):
+			result, ok, err = s.rangeQuery(r)
+		}
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		writeQueryResponse(w, result, err)
+	})
+}
+
+// instantQuery executes the request's instant query, returning false if it
+// has no subqueries.
+func (s *Subqueries) instantQuery(r *http.Request) (model.Value, bool, error) {
+	query := r.FormValue("query")
+	if subqueries, err := findSubqueries(query); err != nil || len(subqueries) == 0 {
+		return nil, false, nil
+	}
+	ts := model.Now()
+	if t := r.FormValue("time"); t != "" {
+		var err error
+		if ts, err = parseTime(t); err != nil {
+			return nil, false, nil
+		}
+	}
+	userID, err := user.Extract(r.Context())
+	if err != nil {
+		return nil, false, nil
+	}
+
+	ctx, results := withSubqueryResults(r.Context())
+	query, err = s.replaceSubqueries(ctx, userID, results, query, ts, ts)
+	if err != nil {
+		return nil, true, err
+	}
+	qry, err := s.engine.NewInstantQuery(query, ts)
+	if err != nil {
+		return nil, true, err
+	}
+	res := qry.Exec(ctx)
+	return res.Value, true, res.Err
+}
+
+// rangeQuery executes the request's range query, returning false if it has
+// no subqueries.
+func (s *Subqueries) rangeQuery(r *http.Request) (model.Value, bool, error) {
+	query := r.FormValue("query")
+	if subqueries, err := findSubqueries(query); err != nil || len(subqueries) == 0 {
+		return nil, false, nil
+	}
+	start, err := parseTime(r.FormValue("start"))
+	if err != nil {
+		return nil, false, nil
+	}
+	end, err := parseTime(r.FormValue("end"))
+	if err != nil || end.Before(start) {
+		return nil, false, nil
+	}
+	step, err := parseDuration(r.FormValue("step"))
+	if err != nil || step <= 0 || end.Sub(start)/step > maxPointsPerSeries {
+		return nil, false, nil
+	}
+	userID, err := user.Extract(r.Context())
+	if err != nil {
+		return nil, false, nil
+	}
+
+	ctx, results := withSubqueryResults(r.Context())
+	m, err := s.evalRange(ctx, userID, results, query, start, end, step)
+	return m, true, err
+}
+
+// evalRange executes the query, after replacing its subqueries, as a range
+// query.
+func (s *Subqueries) evalRange(ctx context.Context, userID string, results map[string]model.Matrix, query string, start, end model.Time, step time.Duration) (model.Matrix, error) {
+	query, err := s.replaceSubqueries(ctx, userID, results, query, start, end)
+	if err != nil {
+		return nil, err
+	}
+	qry, err := s.engine.NewRangeQuery(query, start, end, step)
+	if err != nil {
+		return nil, err
+	}
+	res := qry.Exec(ctx)
+	if res.Err != nil {
+		return nil, res.Err
+	}
+	return res.Matrix()
+}
+
+// replaceSubqueries evaluates the outermost subqueries of the query, for it to
+// be evaluated between start and end, returning the query with each replaced
+// by a range selector of its results.
+func (s *Subqueries) replaceSubqueries(ctx context.Context, userID string, results map[string]model.Matrix, query string, start, end model.Time) (string, error) {
+	subqueries, err := findSubqueries(query)
+	if err != nil {
+		return "", err
+	}
+
+	var (
+		replaced = make([]string, 0, 2*len(subqueries)+1)
+		last     = 0
+	)
+	for _, sq := range subqueries {
+		rng, err := model.ParseDuration(sq.rng)
+		if err != nil {
+			return "", fmt.Errorf("invalid subquery range %q: %v", sq.rng, err)
+		}
+		step := s.resolution(userID)
+		if sq.step != "" {
+			d, err := model.ParseDuration(sq.step)
+			if err != nil || d <= 0 {
+				return "", fmt.Errorf("invalid subquery resolution %q", sq.step)
+			}
+			step = time.Duration(d)
+		}
+		var offset model.Duration
+		if sq.offset != "" {
+			if offset, err = model.ParseDuration(sq.offset); err != nil {
+				return "", fmt.Errorf("invalid subquery offset %q: %v", sq.offset, err)
+			}
+		}
+
+		// The range selector replacing the subquery reads the points between
+		// start and end, less the offset and range, so the expression is
+		// evaluated at each multiple of the resolution between them.
+		stepMs := int64(step / time.Millisecond)
+		if stepMs <= 0 {
+			return "", fmt.Errorf("invalid subquery resolution %v", step)
+		}
+		from := start.Add(-time.Duration(offset) - time.Duration(rng))
+		from = model.Time((int64(from) + stepMs - 1) / stepMs * stepMs)
+		through := end.Add(-time.Duration(offset))
+		through = model.Time(int64(through) / stepMs * stepMs)
+
+		var m model.Matrix
+		if !from.After(through) {
+			if int64(through.Sub(from)/step) > maxPointsPerSeries {
+				return "", fmt.Errorf("subquery %s evaluated at too many points, use a lower resolution", query[sq.start:sq.end])
+			}
+			if m, err = s.evalRange(ctx, userID, results, sq.expr, from, through, step); err != nil {
+				return "", err
+			}
+		}
+
+		name := fmt.Sprintf("%s%d__", subqueryPrefix, len(results))
+		results[name] = m
+		selector := name + "[" + sq.rng + "]"
+		if sq.offset != "" {
+			selector += " offset " + sq.offset
+		}
+		replaced = append(replaced, query[last:sq.start], selector)
+		last = sq.end
+	}
+	replaced = append(replaced, query[last:])
+	return strings.Join(replaced, ""), nil
+}
+
+// resolution returns the resolution of the user's subqueries which don't have
+// one.
+func (s *Subqueries) resolution(userID string) time.Duration {
+	if r := s.overrides[userID].DefaultSubqueryResolution; r > 0 {
+		return r
+	}
+	return s.defaultResolution
+}
+
+func withSubqueryResults(ctx context.Context) (context.Context, map[string]model.Matrix) {
+	results := map[string]model.Matrix{}
+	return context.WithValue(ctx, subqueryResultsKey, results), results
+}
+
+// subqueryQuerier serves the results of subqueries, stored in the context,
+// for the placeholder series replacing them.
+type subqueryQuerier struct {
+	local.Querier
+}
+
+func (q subqueryQuerier) QueryRange(ctx context.Context, from, through model.Time, matchers ...*metric.LabelMatcher) ([]local.SeriesIterator, error) {
+	if iterators, ok := subqueryIterators(ctx, matchers); ok {
+		return iterators, nil
+	}
+	return q.Querier.QueryRange(ctx, from, through, matchers...)
+}
+
+func (q subqueryQuerier) QueryInstant(ctx context.Context, ts model.Time, stalenessDelta time.Duration, matchers ...*metric.LabelMatcher) ([]local.SeriesIterator, error) {
+	if iterators, ok := subqueryIterators(ctx, matchers); ok {
+		return iterators, nil
+	}
+	return q.Querier.QueryInstant(ctx, ts, stalenessDelta, matchers...)
+}
+
+func subqueryIterators(ctx context.Context, matchers []*metric.LabelMatcher) ([]local.SeriesIterator, bool) {
+	results, ok := ctx.Value(subqueryResultsKey).(map[string]model.Matrix)
+	if !ok {
+		return nil, false
+	}
+	for _, m := range matchers {
+		if m.Name != model.MetricNameLabel || m.Type != metric.Equal || !strings.HasPrefix(string(m.Value), subqueryPrefix) {
+			continue
+		}
+		matrix, ok := results[string(m.Value)]
+		if !ok {
+			return nil, false
+		}
+		iterators := make([]local.SeriesIterator, 0, len(matrix))
+		for _, ss := range matrix {
+			iterators = append(iterators, sampleStreamIterator{ss: ss})
+		}
+		return iterators, true
+	}
+	return nil, false
+}
+
+// subquery is a subquery in a query, as written.
+type subquery struct {
+	start, end int // The span of the query it is written in.
+	expr       string
+	rng, step  string
+	offset     string
+}
+
+// findSubqueries returns the outermost subqueries of the query, in order.
+func findSubqueries(query string) ([]subquery, error) {
+	quoted := quotedChars(query)
+	var all []subquery
+	for i := 0; i < len(query); i++ {
+		if quoted[i] || query[i] != '[' {
+			continue
+		}
+		j := strings.IndexByte(query[i:], ']')
+		if j < 0 {
+			return nil, fmt.Errorf("unclosed [ at char %d", i)
+		}
+		j += i
+		colon := strings.IndexByte(query[i:j], ':')
+		if colon < 0 {
+			continue
+		}
+		colon += i
+
+		start, err := exprStart(query, quoted, i)
+		if err != nil {
+			return nil, err
+		}
+		sq := subquery{
+			start: start,
+			end:   j + 1,
+			expr:  query[start:i],
+			rng:   strings.TrimSpace(query[i+1 : colon]),
+			step:  strings.TrimSpace(query[colon+1 : j]),
+		}
+		// Any offset applies to the subquery as a whole.
+		rest := strings.TrimLeft(query[sq.end:], " \t\n")
+		if strings.HasPrefix(rest, "offset") && len(rest) > len("offset") && isSpace(rest[len("offset")]) {
+			d := strings.TrimLeft(rest[len("offset"):], " \t\n")
+			n := 0
+			for n < len(d) && isIdentChar(d[n]) {
+				n++
+			}
+			sq.offset = d[:n]
+			sq.end = len(query) - len(d) + n
+		}
+		all = append(all, sq)
+		i = j
+	}
+
+	outermost := all[:0]
+	for _, sq := range all {
+		// Subqueries nested in this one were found before it.
+		for len(outermost) > 0 && outermost[len(outermost)-1].start >= sq.start {
+			outermost = outermost[:len(outermost)-1]
+		}
+		outermost = append(outermost, sq)
+	}
+	return outermost, nil
+}
+
+// exprStart returns where the expression ending before the query's char i
+// starts: a parenthesised expression, with the function or aggregation it's
+// the parameters of, a selector, or a metric name.
+func exprStart(query string, quoted []bool, i int) (int, error) {
+	k := skipSpaceBack(query, i-1)
+	switch {
+	case k < 0:
+	case query[k] == ')':
+		if o := matchBack(query, quoted, k); o >= 0 {
+			return callStart(query, quoted, o), nil
+		}
+	case query[k] == '}':
+		if o := matchBack(query, quoted, k); o >= 0 {
+			if n := skipSpaceBack(query, o-1); n >= 0 && isIdentChar(query[n]) {
+				return identStart(query, n), nil
+			}
+			return o, nil
+		}
+	case isIdentChar(query[k]):
+		return identStart(query, k), nil
+	}
+	return 0, fmt.Errorf("subquery at char %d has no expression", i)
+}
+
+// callStart returns where the call, if any, of the parenthesised expression
+// starting at the query's char s starts, including an aggregation's grouping
+// clause, eg. sum by (job) (foo) or sum(foo) by (job).
+func callStart(query string, quoted []bool, s int) int {
+	for {
+		k := skipSpaceBack(query, s-1)
+		if k < 0 {
+			return s
+		}
+		if isIdentChar(query[k]) {
+			n := identStart(query, k)
+			switch id := query[n : k+1]; {
+			case id == "by" || id == "without":
+				s = n
+				if p := skipSpaceBack(query, s-1); p >= 0 && query[p] == ')' && !quoted[p] {
+					if o := matchBack(query, quoted, p); o >= 0 {
+						s = o
+					}
+				}
+				continue
+			case binaryKeywords[id]:
+				return s
+			}
+			return n
+		}
+		if query[k] == ')' && !quoted[k] {
+			if o := matchBack(query, quoted, k); o >= 0 {
+				if n := skipSpaceBack(query, o-1); n >= 0 && isIdentChar(query[n]) {
+					if id := query[identStart(query, n) : n+1]; id == "by" || id == "without" {
+						s = identStart(query, n)
+						continue
+					}
+				}
+			}
+		}
+		return s
+	}
+}
+
+// quotedChars returns which of the query's chars are in strings or comments.
+func quotedChars(query string) []bool {
+	quoted := make([]bool, len(query))
+	for i := 0; i < len(query); i++ {
+		switch c := query[i]; c {
+		case '"', '\'', '`':
+			quoted[i] = true
+			for i++; i < len(query); i++ {
+				quoted[i] = true
+				if query[i] == '\\' && c != '`' && i+1 < len(query) {
+					i++
+					quoted[i] = true
+				} else if query[i] == c {
+					break
+				}
+			}
+		case '#':
+			for ; i < len(query) && query[i] != '\n'; i++ {
+				quoted[i] = true
+			}
+		}
+	}
+	return quoted
+}
+
+// matchBack returns the index of the bracket opening the one closed at the
+// query's char k, or -1.
+func matchBack(query string, quoted []bool, k int) int {
+	closing := query[k]
+	opening := map[byte]byte{')': '(', '}': '{', ']': '['}[closing]
+	depth := 0
+	for ; k >= 0; k-- {
+		if quoted[k] {
+			continue
+		}
+		switch query[k] {
+		case closing:
+			depth++
+		case opening:
+			depth--
+			if depth == 0 {
+				return k
+			}
+		}
+	}
+	return -1
+}
+
+func skipSpaceBack(query string, k int) int {
+	for k >= 0 && isSpace(query[k]) {
+		k--
+	}
+	return k
+}
+
+func identStart(query string, k int) int {
+	for k > 0 && isIdentChar(query[k-1]) {
+		k--
+	}
+	return k
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+func isIdentChar(c byte) bool {
+	return c == '_' || c == ':' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
@@ -0,0 +1,173 @@
+package querier
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/weaveworks/common/user"
+)
+
+func TestFindSubqueries(t *testing.T) {
+	for _, tc := range []struct {
+		query    string
+		expected []subquery
+	}{
+		{query: "rate(foo[5m])"},
+		{query: `foo{job="a[1m:1m]"}`},
+		{
+			query:    "max_over_time(rate(foo[1m])[10m:1m])",
+			expected: []subquery{{start: 14, end: 35, expr: "rate(foo[1m])", rng: "10m", step: "1m"}},
+		},
+		{
+			query:    "foo[5m:]",
+			expected: []subquery{{start: 0, end: 8, expr: "foo", rng: "5m"}},
+		},
+		{
+			query:    `max_over_time(foo{job="a[1m:1m]"}[5m:30s] offset 1m)`,
+			expected: []subquery{{start: 14, end: 51, expr: `foo{job="a[1m:1m]"}`, rng: "5m", step: "30s", offset: "1m"}},
+		},
+		{
+			query:    "sum by (job) (foo)[5m:1m]",
+			expected: []subquery{{start: 0, end: 25, expr: "sum by (job) (foo)", rng: "5m", step: "1m"}},
+		},
+		{
+			query:    "sum(foo) without (i)[5m:1m]",
+			expected: []subquery{{start: 0, end: 27, expr: "sum(foo) without (i)", rng: "5m", step: "1m"}},
+		},
+		{
+			query:    "a and (b)[5m:1m]",
+			expected: []subquery{{start: 6, end: 16, expr: "(b)", rng: "5m", step: "1m"}},
+		},
+		{
+			query:    "max_over_time(max_over_time(foo[5m:1m])[1h:5m])",
+			expected: []subquery{{start: 14, end: 46, expr: "max_over_time(foo[5m:1m])", rng: "1h", step: "5m"}},
+		},
+		{
+			query: "foo[5m:1m] + bar[5m:1m]",
+			expected: []subquery{
+				{start: 0, end: 10, expr: "foo", rng: "5m", step: "1m"},
+				{start: 13, end: 23, expr: "bar", rng: "5m", step: "1m"},
+			},
+		},
+	} {
+		subqueries, err := findSubqueries(tc.query)
+		require.NoError(t, err, tc.query)
+		assert.Equal(t, tc.expected, subqueries, tc.query)
+	}
+}
+
+func TestSubqueries(t *testing.T) {
+	f, err := ioutil.TempFile("", "overrides")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(`
+overrides:
+  coarse:
+    default_subquery_resolution: 30s
+`)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	// Two counters, increasing by 1 and 2 a second, sampled every 10s.
+	var matrix model.Matrix
+	for i := 1; i <= 2; i++ {
+		values := make([]model.SamplePair, 0, 31)
+		for ts := model.Time(0); ts <= 300*1000; ts += 10 * 1000 {
+			values = append(values, model.SamplePair{Timestamp: ts, Value: model.SampleValue(int64(ts) * int64(i) / 1000)})
+		}
+		matrix = append(matrix, &model.SampleStream{
+			Metric: model.Metric{model.MetricNameLabel: "foo", "i": model.LabelValue(fmt.Sprint(i))},
+			Values: values,
+		})
+	}
+	cfg := Config{DefaultSubqueryResolution: 20 * time.Second}
+	engine := NewQueryableEngine(cfg, Queryable{Q: MergeQuerier{Queriers: []Querier{matrixQuerier{matrix}}}})
+	subqueries, err := NewSubqueries(cfg, f.Name(), engine)
+	require.NoError(t, err)
+
+	var passedOn bool
+	handler := subqueries.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		passedOn = true
+	}))
+	query := func(userID, path string, params url.Values) *httptest.ResponseRecorder {
+		passedOn = false
+		req := httptest.NewRequest("GET", path+"?"+params.Encode(), nil)
+		req = req.WithContext(user.Inject(req.Context(), userID))
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for _, tc := range []struct {
+		query    string
+		userID   string
+		expected [2]model.SampleValue
+	}{
+		// Evaluated at 240, 270 and 300.
+		{query: "max_over_time(foo[1m:30s])", expected: [2]model.SampleValue{300, 600}},
+		{query: "min_over_time(foo[1m:30s])", expected: [2]model.SampleValue{240, 480}},
+		{query: "count_over_time(foo[1m:30s])", expected: [2]model.SampleValue{3, 3}},
+		{query: "max_over_time(foo[1m:30s] offset 1m)", expected: [2]model.SampleValue{240, 480}},
+		{query: "max_over_time(rate(foo[1m])[2m:30s])", expected: [2]model.SampleValue{1, 2}},
+		{query: "min_over_time(max_over_time(foo[1m:30s])[2m:1m])", expected: [2]model.SampleValue{180, 360}},
+		{query: "max_over_time(sum by (i) (foo)[1m:30s])", expected: [2]model.SampleValue{300, 600}},
+
+		// Evaluated at 240, 260, 280 and 300 by default, and at 240, 270 and
+		// 300 for the user whose default is coarser.
+		{query: "count_over_time(foo[1m:])", expected: [2]model.SampleValue{4, 4}},
+		{query: "count_over_time(foo[1m:])", userID: "coarse", expected: [2]model.SampleValue{3, 3}},
+	} {
+		userID := tc.userID
+		if userID == "" {
+			userID = "1"
+		}
+		rec := query(userID, "/api/prom/api/v1/query", url.Values{"query": {tc.query}, "time": {"300"}})
+		require.False(t, passedOn, tc.query)
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+		var resp queryResult
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+		var actual model.Vector
+		require.NoError(t, json.Unmarshal(resp.Data.Result, &actual))
+		require.Len(t, actual, 2, tc.query)
+		for _, s := range actual {
+			assert.Equal(t, tc.expected[s.Metric["i"][0]-'1'], s.Value, tc.query)
+		}
+	}
+
+	// Range queries evaluate the subquery over the whole range.
+	rec := query("1", "/api/prom/api/v1/query_range", url.Values{"query": {"max_over_time(foo[1m:30s])"}, "start": {"120"}, "end": {"300"}, "step": {"60"}})
+	require.False(t, passedOn)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var resp queryResult
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	var actual model.Matrix
+	require.NoError(t, json.Unmarshal(resp.Data.Result, &actual))
+	require.Len(t, actual, 2)
+	for _, ss := range actual {
+		i := model.SampleValue(ss.Metric["i"][0] - '0')
+		require.Len(t, ss.Values, 4)
+		for _, sp := range ss.Values {
+			assert.Equal(t, model.SampleValue(sp.Timestamp.Unix())*i, sp.Value)
+		}
+	}
+
+	// Queries without subqueries are passed on, and invalid subqueries
+	// rejected.
+	query("1", "/api/prom/api/v1/query", url.Values{"query": {"max_over_time(foo[1m])"}, "time": {"300"}})
+	assert.True(t, passedOn)
+	rec = query("1", "/api/prom/api/v1/query", url.Values{"query": {"max_over_time(foo[1m:0s])"}, "time": {"300"}})
+	assert.False(t, passedOn)
+	assert.NotEqual(t, http.StatusOK, rec.Code)
+}
@@ -13,6 +13,10 @@ import (
 
 const (
 	longPollDuration = 10 * time.Second
+
+	// InMemoryConsulHost is the Consul hostname which keeps the ring in
+	// memory instead, for when all of Cortex runs in one process.
+	InMemoryConsulHost = "inmemory"
 )
 
 // ConsulConfig to create a ConsulClient
@@ -25,7 +29,7 @@ type ConsulConfig struct {
 
 // RegisterFlags adds the flags required to config this to the given FlagSet
 func (cfg *ConsulConfig) RegisterFlags(f *flag.FlagSet) {
-	f.StringVar(&cfg.Host, "consul.hostname", "localhost:8500", "Hostname and port of Consul.")
+	f.StringVar(&cfg.Host, "consul.hostname", "localhost:8500", "Hostname and port of Consul, or \""+InMemoryConsulHost+"\" to keep the ring in memory when running all components in one process.")
 	f.StringVar(&cfg.Prefix, "consul.prefix", "collectors/", "Prefix for keys in Consul.")
 }
 
@@ -66,16 +70,24 @@ func NewConsulClient(cfg ConsulConfig, codec Codec) (ConsulClient, error) {
 		return cfg.mock, nil
 	}
 
-	client, err := consul.NewClient(&consul.Config{
-		Address: cfg.Host,
-		Scheme:  "http",
-	})
-	if err != nil {
-		return nil, err
-	}
-	var c ConsulClient = &consulClient{
-		kv:    client.KV(),
-		codec: codec,
+	var c ConsulClient
+	if cfg.Host == InMemoryConsulHost {
+		c = &consulClient{
+			kv:    sharedInMemoryKV(),
+			codec: codec,
+		}
+	} else {
+		client, err := consul.NewClient(&consul.Config{
+			Address: cfg.Host,
+			Scheme:  "http",
+		})
+		if err != nil {
+			return nil, err
+		}
+		c = &consulClient{
+			kv:    client.KV(),
+			codec: codec,
+		}
 	}
 	if cfg.Prefix != "" {
 		c = PrefixClient(c, cfg.Prefix)
@@ -8,6 +8,8 @@ import (
 	"github.com/prometheus/common/log"
 )
 
+// mockKV is an in-memory implementation of the Consul KV API, for tests and
+// for running all of Cortex in one process.
 type mockKV struct {
 	mtx     sync.Mutex
 	cond    *sync.Cond
@@ -15,18 +17,36 @@ type mockKV struct {
 	current uint64 // the current 'index in the log'
 }
 
-func newMockConsulClient() ConsulClient {
-	m := mockKV{
+func newMockKV() *mockKV {
+	m := &mockKV{
 		kvps: map[string]*consul.KVPair{},
 	}
 	m.cond = sync.NewCond(&m.mtx)
 	go m.loop()
+	return m
+}
+
+func newMockConsulClient() ConsulClient {
 	return &consulClient{
-		kv:    &m,
+		kv:    newMockKV(),
 		codec: ProtoCodec{Factory: ProtoDescFactory},
 	}
 }
 
+var (
+	inMemoryKVOnce sync.Once
+	inMemoryKV     *mockKV
+)
+
+// sharedInMemoryKV returns the in-memory KV store shared by everything in
+// this process using InMemoryConsulHost.
+func sharedInMemoryKV() *mockKV {
+	inMemoryKVOnce.Do(func() {
+		inMemoryKV = newMockKV()
+	})
+	return inMemoryKV
+}
+
 func copyKVPair(in *consul.KVPair) *consul.KVPair {
 	out := *in
 	out.Value = make([]byte, len(in.Value))
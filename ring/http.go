@@ -28,6 +28,9 @@ const tpl = `
 					<tr>
 						<th>Ingester</th>
 						<th>State</th>
+						<th>Mode</th>
+						<th>Pool</th>
+						<th>Zone</th>
 						<th>Address</th>
 						<th>Last Heartbeat</th>
 						<th>Tokens</th>
@@ -40,6 +43,9 @@ const tpl = `
 					<tr>
 						<td>{{ .ID }}</td>
 						<td>{{ .State }}</td>
+						<td>{{ .Mode }}</td>
+						<td>{{ .Pool }}</td>
+						<td>{{ .Zone }}</td>
 						<td>{{ .Address }}</td>
 						<td>{{ .Timestamp }}</td>
 						<td>{{ .Tokens }}</td>
@@ -109,12 +115,15 @@ func (r *Ring) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		}
 
 		ingesters = append(ingesters, struct {
-			ID, State, Address, Timestamp string
-			Tokens                        uint32
-			Ownership                     float64
+			ID, State, Mode, Pool, Zone, Address, Timestamp string
+			Tokens                                          uint32
+			Ownership                                       float64
 		}{
 			ID:        id,
 			State:     state,
+			Mode:      ing.Mode.String(),
+			Pool:      ing.Pool,
+			Zone:      ing.Zone,
 			Address:   ing.Addr,
 			Timestamp: timestamp.String(),
 			Tokens:    tokens[id],
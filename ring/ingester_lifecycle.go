@@ -7,8 +7,11 @@ import (
 	"fmt"
 	"math/rand"
 	"net"
+	"net/http"
 	"os"
 	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -18,6 +21,7 @@ import (
 
 const (
 	infName           = "eth0"
+	unixScheme        = "unix://"
 	consulKey         = "ring"
 	heartbeatInterval = 5 * time.Second
 )
@@ -37,11 +41,19 @@ func init() {
 type IngesterRegistrationConfig struct {
 	Config
 
-	ListenPort *int
-	NumTokens  int
+	ListenPort   *int
+	ListenSocket *string
+	NumTokens    int
+	Pool         string
+	Zone         string
+	Mode         string
+	Addr         string
+
+	// Whether the ingester registers as JOINING, so it isn't read from until
+	// it changes state to ACTIVE, once it has recovered its series.
+	Joining bool
 
 	// For testing
-	Addr           string
 	Hostname       string
 	skipUnregister bool
 	mock           *Ring
@@ -51,6 +63,20 @@ type IngesterRegistrationConfig struct {
 func (cfg *IngesterRegistrationConfig) RegisterFlags(f *flag.FlagSet) {
 	cfg.Config.RegisterFlags(f)
 	f.IntVar(&cfg.NumTokens, "ingester.num-tokens", 128, "Number of tokens for each ingester.")
+	f.StringVar(&cfg.Pool, "ingester.pool", DefaultPool, "The pool of ingesters this one belongs to. Only tenants pinned to the pool with the distributor's overrides are sent to it; empty for the default pool.")
+	f.StringVar(&cfg.Zone, "ingester.availability-zone", "", "The availability zone this ingester runs in, for rings with -ring.zone-awareness-enabled.")
+	f.StringVar(&cfg.Addr, "ingester.addr", "", "Address distributors connect to this ingester at, registered in the ring with the gRPC port: an IPv4 or IPv6 address, or a DNS name, eg. of a pod behind a headless service, which distributors resolve afresh whenever they reconnect. Defaults to the first IP address of "+infName+", preferring IPv4.")
+	f.StringVar(&cfg.Mode, "ingester.mode", "read-write", "Which operations distributors use this ingester for: read-write, read-only (eg. while it is drained) or write-only (eg. while its chunks are backfilled). Can be changed with a POST to /mode.")
+}
+
+// ParseIngesterMode parses an ingester mode as in -ingester.mode, eg.
+// read-only.
+func ParseIngesterMode(s string) (IngesterMode, error) {
+	mode, ok := IngesterMode_value[strings.ToUpper(strings.Replace(s, "-", "_", -1))]
+	if !ok {
+		return READ_WRITE, fmt.Errorf("unknown ingester mode %q", s)
+	}
+	return IngesterMode(mode), nil
 }
 
 // IngesterRegistration manages the connection between the ingester and Consul.
@@ -63,6 +89,8 @@ type IngesterRegistration struct {
 
 	id   string
 	addr string
+	pool string
+	zone string
 	quit chan struct{}
 	wait sync.WaitGroup
 
@@ -70,10 +98,21 @@ type IngesterRegistration struct {
 	// back empty.  Channel is used to tell the actor to update consul on state changes.
 	state       IngesterState
 	stateChange chan IngesterState
+	mode        IngesterMode
+	modeChange  chan IngesterMode
 }
 
 // RegisterIngester registers an ingester with Consul.
 func RegisterIngester(cfg IngesterRegistrationConfig) (*IngesterRegistration, error) {
+	mode := READ_WRITE
+	if cfg.Mode != "" {
+		var err error
+		mode, err = ParseIngesterMode(cfg.Mode)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	ring := cfg.mock
 	if ring == nil {
 		var err error
@@ -83,6 +122,11 @@ func RegisterIngester(cfg IngesterRegistrationConfig) (*IngesterRegistration, er
 		}
 	}
 
+	state := ACTIVE
+	if cfg.Joining {
+		state = JOINING
+	}
+
 	hostname := cfg.Hostname
 	if hostname == "" {
 		var err error
@@ -92,13 +136,22 @@ func RegisterIngester(cfg IngesterRegistrationConfig) (*IngesterRegistration, er
 		}
 	}
 
-	addr := cfg.Addr
-	if addr == "" {
-		var err error
-		addr, err = getFirstAddressOf(infName)
-		if err != nil {
-			return nil, err
+	// addr is the ip+port of this instance, written to consul so the
+	// distributors know where to connect; or its unix socket, for
+	// distributors on the same host.
+	var addr string
+	if cfg.ListenSocket != nil && *cfg.ListenSocket != "" {
+		addr = unixScheme + *cfg.ListenSocket
+	} else {
+		host := cfg.Addr
+		if host == "" {
+			var err error
+			host, err = getFirstAddressOf(infName)
+			if err != nil {
+				return nil, err
+			}
 		}
+		addr = net.JoinHostPort(host, strconv.Itoa(*cfg.ListenPort))
 	}
 
 	r := &IngesterRegistration{
@@ -108,15 +161,17 @@ func RegisterIngester(cfg IngesterRegistrationConfig) (*IngesterRegistration, er
 		numTokens:      cfg.NumTokens,
 		skipUnregister: cfg.skipUnregister,
 
-		id: hostname,
-		// hostname is the ip+port of this instance, written to consul so
-		// the distributors know where to connect.
-		addr: fmt.Sprintf("%s:%d", addr, *cfg.ListenPort),
+		id:   hostname,
+		addr: addr,
+		pool: cfg.Pool,
+		zone: cfg.Zone,
 		quit: make(chan struct{}),
 
 		// Only read/written on actor goroutine.
-		state:       ACTIVE,
+		state:       state,
 		stateChange: make(chan IngesterState),
+		mode:        mode,
+		modeChange:  make(chan IngesterMode),
 	}
 
 	r.wait.Add(1)
@@ -124,12 +179,39 @@ func RegisterIngester(cfg IngesterRegistrationConfig) (*IngesterRegistration, er
 	return r, nil
 }
 
+// Addr returns the address this ingester registered in the ring.
+func (r *IngesterRegistration) Addr() string {
+	return r.addr
+}
+
 // ChangeState changes the state of an ingester in the ring.
 func (r *IngesterRegistration) ChangeState(state IngesterState) {
 	log.Infof("Changing ingester state to %v", state)
 	r.stateChange <- state
 }
 
+// ChangeMode changes which operations the ingester is used for.
+func (r *IngesterRegistration) ChangeMode(mode IngesterMode) {
+	log.Infof("Changing ingester mode to %v", mode)
+	r.modeChange <- mode
+}
+
+// ModeHandler changes the mode of the ingester to that POSTed as the mode
+// parameter, eg. read-only.
+func (r *IngesterRegistration) ModeHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	mode, err := ParseIngesterMode(req.FormValue("mode"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	r.ChangeMode(mode)
+	fmt.Fprintf(w, "Ingester mode changed to %v\n", mode)
+}
+
 // Unregister removes ingester config from Consul; will block
 // until we'll successfully unregistered.
 func (r *IngesterRegistration) Unregister() {
@@ -178,6 +260,8 @@ func (r *IngesterRegistration) pickTokens() ([]uint32, error) {
 
 		newTokens := generateTokens(r.numTokens-len(myTokens), takenTokens)
 		ringDesc.addIngester(r.id, r.addr, newTokens, r.state)
+		ringDesc.Ingesters[r.id].Pool = r.pool
+		ringDesc.Ingesters[r.id].Zone = r.zone
 
 		tokens := append(myTokens, newTokens...)
 		sort.Sort(sortableUint32(tokens))
@@ -205,10 +289,16 @@ func (r *IngesterRegistration) heartbeat(tokens []uint32) {
 			// consul must have restarted
 			log.Infof("Found empty ring, inserting tokens!")
 			ringDesc.addIngester(r.id, r.addr, tokens, r.state)
+			ringDesc.Ingesters[r.id].Pool = r.pool
+			ringDesc.Ingesters[r.id].Zone = r.zone
+			ringDesc.Ingesters[r.id].Mode = r.mode
 		} else {
 			ingesterDesc.Timestamp = time.Now().Unix()
 			ingesterDesc.State = r.state
 			ingesterDesc.Addr = r.addr
+			ingesterDesc.Pool = r.pool
+			ingesterDesc.Zone = r.zone
+			ingesterDesc.Mode = r.mode
 
 			// Set ProtoRing back to true for the case where an existing ingester that didn't understand this field removed it whilst updating the ring.
 			ingesterDesc.ProtoRing = true
@@ -226,6 +316,10 @@ func (r *IngesterRegistration) heartbeat(tokens []uint32) {
 			if err := r.consul.CAS(consulKey, updateConsul); err != nil {
 				log.Errorf("Failed to write to consul, sleeping: %v", err)
 			}
+		case r.mode = <-r.modeChange:
+			if err := r.consul.CAS(consulKey, updateConsul); err != nil {
+				log.Errorf("Failed to write to consul, sleeping: %v", err)
+			}
 		case <-ticker.C:
 			consulHeartbeats.Inc()
 			if err := r.consul.CAS(consulKey, updateConsul); err != nil {
@@ -278,7 +372,9 @@ func generateTokens(numTokens int, takenTokens []uint32) []uint32 {
 	return tokens
 }
 
-// getFirstAddressOf returns the first IPv4 address of the supplied interface name.
+// getFirstAddressOf returns the first IPv4 address of the supplied interface
+// name, or its first global IPv6 address if it has no IPv4 one, eg. in an
+// IPv6-only cluster.
 func getFirstAddressOf(name string) (string, error) {
 	inf, err := net.InterfaceByName(name)
 	if err != nil {
@@ -293,14 +389,21 @@ func getFirstAddressOf(name string) (string, error) {
 		return "", fmt.Errorf("No address found for %s", name)
 	}
 
+	var ipv6 net.IP
 	for _, addr := range addrs {
 		switch v := addr.(type) {
 		case *net.IPNet:
 			if ip := v.IP.To4(); ip != nil {
 				return v.IP.String(), nil
 			}
+			if ipv6 == nil && v.IP.IsGlobalUnicast() {
+				ipv6 = v.IP
+			}
 		}
 	}
+	if ipv6 != nil {
+		return ipv6.String(), nil
+	}
 
 	return "", fmt.Errorf("No address found for %s", name)
 }
@@ -91,3 +91,41 @@ func poll(t *testing.T, d time.Duration, want interface{}, have func() interface
 		t.Fatalf("%s:%d: %v != %v", file, line, want, h)
 	}
 }
+
+func TestIngesterRegistrationAddr(t *testing.T) {
+	consul := newMockConsulClient()
+	ring, err := New(Config{
+		ConsulConfig: ConsulConfig{
+			mock: consul,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ring.Stop()
+
+	for _, tc := range []struct {
+		addr, expected string
+	}{
+		{"10.0.0.1", "10.0.0.1:9095"},
+		{"fd00::1", "[fd00::1]:9095"},
+		{"ingester-0.ingester.cortex.svc.cluster.local", "ingester-0.ingester.cortex.svc.cluster.local:9095"},
+	} {
+		registra, err := RegisterIngester(IngesterRegistrationConfig{
+			mock:           ring,
+			skipUnregister: true,
+
+			NumTokens:  1,
+			ListenPort: func(i int) *int { return &i }(9095),
+			Addr:       tc.addr,
+			Hostname:   "ingester",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if registra.Addr() != tc.expected {
+			t.Errorf("expected %s, got %s", tc.expected, registra.Addr())
+		}
+		registra.Unregister()
+	}
+}
@@ -0,0 +1,143 @@
+package ring
+
+import (
+	"sort"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// How many changes a subscriber can fall behind by before it is dropped.
+const subscriberBufferSize = 1024
+
+var errWatchEnded = grpc.Errorf(codes.Unavailable, "ring watch ended; resubscribe")
+
+// Subscribe returns a channel of changes to the ring, starting with an ADDED
+// change for every ingester currently in it, and a function to cancel the
+// subscription. The channel is closed when the subscription is cancelled,
+// when the ring is stopped, or if the subscriber falls too far behind, in
+// which case it should subscribe again.
+func (r *Ring) Subscribe() (<-chan *RingChange, func()) {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+
+	changes := diff(&Desc{}, r.ringDesc)
+	ch := make(chan *RingChange, len(changes)+subscriberBufferSize)
+	for _, change := range changes {
+		ch <- change
+	}
+
+	r.subscribersMtx.Lock()
+	defer r.subscribersMtx.Unlock()
+	if r.subscribers == nil {
+		close(ch)
+		return ch, func() {}
+	}
+	r.subscribers[ch] = struct{}{}
+
+	return ch, func() {
+		r.subscribersMtx.Lock()
+		defer r.subscribersMtx.Unlock()
+		if _, ok := r.subscribers[ch]; ok {
+			delete(r.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// notify sends the changes between two descs to the subscribers. It must be
+// called with r.mtx held, so subscribers see changes in order.
+func (r *Ring) notify(old, new *Desc) {
+	changes := diff(old, new)
+	if len(changes) == 0 {
+		return
+	}
+
+	r.subscribersMtx.Lock()
+	defer r.subscribersMtx.Unlock()
+	for ch := range r.subscribers {
+		if !sendAll(ch, changes) {
+			delete(r.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// sendAll sends the changes without blocking, returning false if the channel
+// is full.
+func sendAll(ch chan<- *RingChange, changes []*RingChange) bool {
+	for _, change := range changes {
+		select {
+		case ch <- change:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// closeSubscribers closes all the subscriptions, and stops new ones.
+func (r *Ring) closeSubscribers() {
+	r.subscribersMtx.Lock()
+	defer r.subscribersMtx.Unlock()
+	for ch := range r.subscribers {
+		close(ch)
+	}
+	r.subscribers = nil
+}
+
+// diff returns the ingesters added to, removed from, or which changed state
+// between two descs, ordered by ingester.
+func diff(old, new *Desc) []*RingChange {
+	if old == nil {
+		old = &Desc{}
+	}
+	if new == nil {
+		new = &Desc{}
+	}
+
+	ids := make([]string, 0, len(old.Ingesters)+len(new.Ingesters))
+	for id := range old.Ingesters {
+		ids = append(ids, id)
+	}
+	for id := range new.Ingesters {
+		if _, ok := old.Ingesters[id]; !ok {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+
+	var changes []*RingChange
+	for _, id := range ids {
+		before, after := old.Ingesters[id], new.Ingesters[id]
+		switch {
+		case before == nil:
+			changes = append(changes, &RingChange{Type: ADDED, Ingester: id, Desc: after})
+		case after == nil:
+			changes = append(changes, &RingChange{Type: REMOVED, Ingester: id, Desc: before})
+		case before.State != after.State:
+			changes = append(changes, &RingChange{Type: STATE_CHANGED, Ingester: id, Desc: after})
+		}
+	}
+	return changes
+}
+
+// Watch implements RingObserverServer.
+func (r *Ring) Watch(_ *WatchRequest, stream RingObserver_WatchServer) error {
+	changes, cancel := r.Subscribe()
+	defer cancel()
+
+	for {
+		select {
+		case change, ok := <-changes:
+			if !ok {
+				return errWatchEnded
+			}
+			if err := stream.Send(change); err != nil {
+				return err
+			}
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		}
+	}
+}
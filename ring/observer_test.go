@@ -0,0 +1,99 @@
+package ring
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func putDesc(t *testing.T, consul ConsulClient, desc *Desc) {
+	buf, err := ProtoCodec{}.Encode(desc)
+	require.NoError(t, err)
+	require.NoError(t, consul.PutBytes(consulKey, buf))
+}
+
+func nextChange(t *testing.T, changes <-chan *RingChange) (ChangeType, string) {
+	select {
+	case change, ok := <-changes:
+		require.True(t, ok, "subscription closed")
+		return change.Type, change.Ingester
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for ring change")
+		return 0, ""
+	}
+}
+
+func TestRingSubscribe(t *testing.T) {
+	consul := newMockConsulClient()
+	desc := newDesc()
+	desc.addIngester("a", "a:9095", []uint32{1}, ACTIVE)
+	putDesc(t, consul, desc)
+
+	r, err := New(Config{
+		ConsulConfig: ConsulConfig{
+			mock: consul,
+		},
+	})
+	require.NoError(t, err)
+	poll(t, time.Second, 1, func() interface{} {
+		return r.numTokens("a")
+	})
+
+	changes, cancel := r.Subscribe()
+	typ, id := nextChange(t, changes)
+	assert.Equal(t, ADDED, typ)
+	assert.Equal(t, "a", id)
+
+	desc.addIngester("b", "b:9095", []uint32{2}, ACTIVE)
+	putDesc(t, consul, desc)
+	typ, id = nextChange(t, changes)
+	assert.Equal(t, ADDED, typ)
+	assert.Equal(t, "b", id)
+
+	desc.Ingesters["a"].State = LEAVING
+	putDesc(t, consul, desc)
+	typ, id = nextChange(t, changes)
+	assert.Equal(t, STATE_CHANGED, typ)
+	assert.Equal(t, "a", id)
+
+	desc.removeIngester("b")
+	putDesc(t, consul, desc)
+	typ, id = nextChange(t, changes)
+	assert.Equal(t, REMOVED, typ)
+	assert.Equal(t, "b", id)
+
+	cancel()
+	_, ok := <-changes
+	assert.False(t, ok)
+
+	// Stopping the ring ends any remaining subscriptions.
+	changes, _ = r.Subscribe()
+	nextChange(t, changes)
+	r.Stop()
+	_, ok = <-changes
+	assert.False(t, ok)
+}
+
+func TestRingSubscribeSlowSubscriber(t *testing.T) {
+	r := &Ring{
+		ringDesc:    newDesc(),
+		subscribers: map[chan *RingChange]struct{}{},
+	}
+	changes, cancel := r.Subscribe()
+	defer cancel()
+
+	// The subscriber is dropped once it is too far behind.
+	for i := 0; i <= subscriberBufferSize; i++ {
+		desc := newDesc()
+		desc.addIngester("a", "a:9095", []uint32{1}, IngesterState(i%2))
+		r.notify(r.ringDesc, desc)
+		r.ringDesc = desc
+	}
+	received := 0
+	for range changes {
+		received++
+	}
+	assert.Equal(t, subscriberBufferSize, received)
+}
@@ -0,0 +1,112 @@
+package ring
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+// The size of the hash keyspace.
+const keyspaceSize = float64(1 << 32)
+
+// defaultOwnershipReplicationFactor is the replication factor assumed when
+// none is given, matching the distributor's default.
+const defaultOwnershipReplicationFactor = 3
+
+// IngesterOwnership is how much of the ring an ingester owns with its
+// current tokens.
+type IngesterOwnership struct {
+	ID     string `json:"id"`
+	Pool   string `json:"pool"`
+	Tokens int    `json:"tokens"`
+
+	// The fraction of the keyspace for which the ingester is the first of its
+	// pool.
+	Ownership float64 `json:"ownership"`
+
+	// The fraction of the pool's series, including replicas, expected to be
+	// written to the ingester.
+	SeriesShare float64 `json:"seriesShare"`
+
+	// The ingester's ownership relative to an equal share of its pool; 1 for
+	// a perfectly balanced ring.
+	OwnershipRatio float64 `json:"ownershipRatio"`
+}
+
+// ownership returns the ownership of each ingester with tokens, by ID, a
+// range of keys between adjacent tokens at a time. The caller must hold
+// r.mtx.
+func (r *Ring) ownership(replicationFactor int) map[string]*IngesterOwnership {
+	result := map[string]*IngesterOwnership{}
+	pools := map[string]int{}
+	for _, token := range r.ringDesc.Tokens {
+		o, ok := result[token.Ingester]
+		if !ok {
+			pool := r.ringDesc.Ingesters[token.Ingester].Pool
+			o = &IngesterOwnership{ID: token.Ingester, Pool: pool}
+			result[token.Ingester] = o
+			pools[pool]++
+		}
+		o.Tokens++
+	}
+
+	tokens := r.ringDesc.Tokens
+	for i, token := range tokens {
+		// The keys from the previous token up to this one are owned starting
+		// at this token; the subtraction wraps around the ring for the first.
+		prev := tokens[(i+len(tokens)-1)%len(tokens)].Token
+		width := float64(token.Token-prev) / keyspaceSize
+		if len(tokens) == 1 {
+			width = 1
+		}
+		for pool := range pools {
+			if owners := r.replicas(pool, i, 1, Read); len(owners) > 0 {
+				result[owners[0]].Ownership += width
+			}
+			replicas := r.replicas(pool, i, replicationFactor, Write)
+			for _, id := range replicas {
+				result[id].SeriesShare += width / float64(len(replicas))
+			}
+		}
+	}
+
+	for _, o := range result {
+		o.OwnershipRatio = o.Ownership * float64(pools[o.Pool])
+	}
+	return result
+}
+
+// OwnershipHandler serves the ownership of each ingester with tokens as JSON.
+// The expected series shares assume the replication_factor parameter, or the
+// distributor's default.
+func (r *Ring) OwnershipHandler(w http.ResponseWriter, req *http.Request) {
+	replicationFactor := defaultOwnershipReplicationFactor
+	if s := req.FormValue("replication_factor"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			http.Error(w, "invalid replication_factor", http.StatusBadRequest)
+			return
+		}
+		replicationFactor = n
+	}
+
+	r.mtx.RLock()
+	owned := r.ownership(replicationFactor)
+	r.mtx.RUnlock()
+
+	ids := make([]string, 0, len(owned))
+	for id := range owned {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	result := make([]*IngesterOwnership, 0, len(ids))
+	for _, id := range ids {
+		result = append(result, owned[id])
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -27,6 +27,13 @@ const (
 	Write
 )
 
+func (op Operation) String() string {
+	if op == Read {
+		return "read"
+	}
+	return "write"
+}
+
 type uint32s []uint32
 
 func (x uint32s) Len() int           { return len(x) }
@@ -36,11 +43,16 @@ func (x uint32s) Swap(i, j int)      { x[i], x[j] = x[j], x[i] }
 // ErrEmptyRing is the error returned when trying to get an element when nothing has been added to hash.
 var ErrEmptyRing = errors.New("empty circle")
 
+// DefaultPool is the pool of ingesters which aren't configured with one, used
+// by all tenants not pinned to another pool.
+const DefaultPool = ""
+
 // Config for a Ring
 type Config struct {
 	ConsulConfig
 
-	HeartbeatTimeout time.Duration
+	HeartbeatTimeout     time.Duration
+	ZoneAwarenessEnabled bool
 }
 
 // RegisterFlags adds the flags required to config this to the given FlagSet
@@ -48,6 +60,7 @@ func (cfg *Config) RegisterFlags(f *flag.FlagSet) {
 	cfg.ConsulConfig.RegisterFlags(f)
 
 	f.DurationVar(&cfg.HeartbeatTimeout, "ring.heartbeat-timeout", time.Minute, "The heartbeat timeout after which ingesters are skipped for reads/writes.")
+	f.BoolVar(&cfg.ZoneAwarenessEnabled, "ring.zone-awareness-enabled", false, "Replicate series across ingesters in different availability zones, and count quorums in zones, so a whole zone can be lost.")
 }
 
 // Ring holds the information about the members of the consistent hash circle.
@@ -55,13 +68,23 @@ type Ring struct {
 	consul           ConsulClient
 	quit, done       chan struct{}
 	heartbeatTimeout time.Duration
+	zoneAwareness    bool
 
 	mtx      sync.RWMutex
 	ringDesc *Desc
 
+	subscribersMtx sync.Mutex
+	subscribers    map[chan *RingChange]struct{}
+
 	ingesterOwnershipDesc *prometheus.Desc
+	tokenOwnershipDesc    *prometheus.Desc
 	numIngestersDesc      *prometheus.Desc
 	numTokensDesc         *prometheus.Desc
+
+	// Unset in tests constructing a Ring directly.
+	lookupDuration  *prometheus.HistogramVec
+	lookupBatchSize prometheus.Histogram
+	healthyReplicas *prometheus.HistogramVec
 }
 
 // New creates a new Ring
@@ -74,14 +97,21 @@ func New(cfg Config) (*Ring, error) {
 	r := &Ring{
 		consul:           consul,
 		heartbeatTimeout: cfg.HeartbeatTimeout,
+		zoneAwareness:    cfg.ZoneAwarenessEnabled,
 		quit:             make(chan struct{}),
 		done:             make(chan struct{}),
 		ringDesc:         &Desc{},
+		subscribers:      map[chan *RingChange]struct{}{},
 		ingesterOwnershipDesc: prometheus.NewDesc(
 			"cortex_ring_ingester_ownership_percent",
 			"The percent ownership of the ring by ingester",
 			[]string{"ingester"}, nil,
 		),
+		tokenOwnershipDesc: prometheus.NewDesc(
+			"cortex_ring_token_ownership_ratio",
+			"The ownership of the ring by ingester, relative to an equal share of its pool",
+			[]string{"ingester"}, nil,
+		),
 		numIngestersDesc: prometheus.NewDesc(
 			"cortex_ring_ingesters",
 			"Number of ingesters in the ring",
@@ -92,6 +122,21 @@ func New(cfg Config) (*Ring, error) {
 			"Number of tokens in the ring",
 			nil, nil,
 		),
+		lookupDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "cortex_ring_lookup_duration_seconds",
+			Help:    "Time spent looking up the ingesters for keys, by method, get or batch_get, and operation.",
+			Buckets: prometheus.ExponentialBuckets(.00001, 4, 8),
+		}, []string{"method", "operation"}),
+		lookupBatchSize: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "cortex_ring_lookup_batch_size",
+			Help:    "The number of keys looked up in each batch.",
+			Buckets: prometheus.ExponentialBuckets(1, 4, 8),
+		}),
+		healthyReplicas: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "cortex_ring_lookup_healthy_replicas",
+			Help:    "The number of active ingesters with a recent heartbeat in each replica set looked up, by operation.",
+			Buckets: prometheus.LinearBuckets(0, 1, 6),
+		}, []string{"operation"}),
 	}
 	go r.loop()
 	return r, nil
@@ -105,6 +150,7 @@ func (r *Ring) Stop() {
 
 func (r *Ring) loop() {
 	defer close(r.done)
+	defer r.closeSubscribers()
 	r.consul.WatchKey(consulKey, r.quit, func(value interface{}) bool {
 		if value == nil {
 			log.Infof("Ring doesn't exist in consul yet.")
@@ -114,6 +160,7 @@ func (r *Ring) loop() {
 		ringDesc := value.(*Desc)
 		r.mtx.Lock()
 		defer r.mtx.Unlock()
+		r.notify(r.ringDesc, ringDesc)
 		r.ringDesc = ringDesc
 		return true
 	})
@@ -121,20 +168,38 @@ func (r *Ring) loop() {
 
 // Get returns n (or more) ingesters which form the replicas for the given key.
 func (r *Ring) Get(key uint32, n int, op Operation) ([]*IngesterDesc, error) {
+	return r.GetInPool(DefaultPool, key, n, op)
+}
+
+// GetInPool returns n (or more) ingesters in the given pool which form the
+// replicas for the given key.
+func (r *Ring) GetInPool(pool string, key uint32, n int, op Operation) ([]*IngesterDesc, error) {
+	defer r.observeLookup("get", op, time.Now())
 	r.mtx.RLock()
 	defer r.mtx.RUnlock()
-	return r.getInternal(key, n, op)
+	return r.getInternal(pool, key, n, op, r.healthyReplicasHistogram(op))
 }
 
 // BatchGet returns n (or more) ingesters which form the replicas for the given key.
 // The order of the result matches the order of the input.
 func (r *Ring) BatchGet(keys []uint32, n int, op Operation) ([][]*IngesterDesc, error) {
+	return r.BatchGetInPool(DefaultPool, keys, n, op)
+}
+
+// BatchGetInPool returns n (or more) ingesters in the given pool which form
+// the replicas for each of the given keys.
+func (r *Ring) BatchGetInPool(pool string, keys []uint32, n int, op Operation) ([][]*IngesterDesc, error) {
+	defer r.observeLookup("batch_get", op, time.Now())
+	if r.lookupBatchSize != nil {
+		r.lookupBatchSize.Observe(float64(len(keys)))
+	}
 	r.mtx.RLock()
 	defer r.mtx.RUnlock()
 
+	healthy := r.healthyReplicasHistogram(op)
 	result := make([][]*IngesterDesc, len(keys), len(keys))
 	for i, key := range keys {
-		ingesters, err := r.getInternal(key, n, op)
+		ingesters, err := r.getInternal(pool, key, n, op, healthy)
 		if err != nil {
 			return nil, err
 		}
@@ -143,44 +208,152 @@ func (r *Ring) BatchGet(keys []uint32, n int, op Operation) ([][]*IngesterDesc,
 	return result, nil
 }
 
-func (r *Ring) getInternal(key uint32, n int, op Operation) ([]*IngesterDesc, error) {
+// getInternal looks up the replicas of a key, observing how many are healthy
+// in the histogram, if any.
+func (r *Ring) getInternal(pool string, key uint32, n int, op Operation, healthyReplicas prometheus.Histogram) ([]*IngesterDesc, error) {
 	if r.ringDesc == nil || len(r.ringDesc.Tokens) == 0 {
 		return nil, ErrEmptyRing
 	}
 
-	ingesters := make([]*IngesterDesc, 0, n)
+	ids := r.replicas(pool, r.search(key), n, op)
+	ingesters := make([]*IngesterDesc, 0, len(ids))
+	for _, id := range ids {
+		ingesters = append(ingesters, r.ringDesc.Ingesters[id])
+	}
+	if healthyReplicas != nil {
+		healthy, now := 0, time.Now()
+		for _, ingester := range ingesters {
+			if ingester.State == ACTIVE && now.Sub(time.Unix(ingester.Timestamp, 0)) <= r.heartbeatTimeout {
+				healthy++
+			}
+		}
+		healthyReplicas.Observe(float64(healthy))
+	}
+	return ingesters, nil
+}
+
+func (r *Ring) healthyReplicasHistogram(op Operation) prometheus.Histogram {
+	if r.healthyReplicas == nil {
+		return nil
+	}
+	return r.healthyReplicas.WithLabelValues(op.String())
+}
+
+func (r *Ring) observeLookup(method string, op Operation, begin time.Time) {
+	if r.lookupDuration != nil {
+		r.lookupDuration.WithLabelValues(method, op.String()).Observe(time.Since(begin).Seconds())
+	}
+}
+
+// ZoneAwarenessEnabled is true if the replicas of a key are in distinct zones.
+func (r *Ring) ZoneAwarenessEnabled() bool {
+	return r.zoneAwareness
+}
+
+// replicas returns the IDs of n (or more) ingesters in the given pool, walking
+// the ring from the token at index start.
+func (r *Ring) replicas(pool string, start int, n int, op Operation) []string {
+	if r.zoneAwareness {
+		return r.zoneReplicas(pool, start, n, op)
+	}
+
+	ids := make([]string, 0, n)
 	distinctHosts := map[string]struct{}{}
-	start := r.search(key)
 	iterations := 0
 	for i := start; len(distinctHosts) < n && iterations < len(r.ringDesc.Tokens); i++ {
 		iterations++
 		// Wrap i around in the ring.
 		i %= len(r.ringDesc.Tokens)
 
-		// We want n *distinct* ingesters.
+		// We want n *distinct* ingesters, from the pool.
 		token := r.ringDesc.Tokens[i]
 		if _, ok := distinctHosts[token.Ingester]; ok {
 			continue
 		}
-		distinctHosts[token.Ingester] = struct{}{}
 		ingester := r.ringDesc.Ingesters[token.Ingester]
+		if ingester.Pool != pool {
+			continue
+		}
+		distinctHosts[token.Ingester] = struct{}{}
 
 		// Ingesters that are Leaving do not count to the replication limit. We do
 		// not want to Write to them because they are about to go away, but we do
 		// want to write the extra replica somewhere.  So we increase the size of the
 		// set of replicas for the key.  This means we have to also increase the
 		// size of the replica set for read, but we can read from Leaving ingesters,
-		// so don't skip it in this case.
-		if ingester.State == LEAVING {
+		// so don't skip it in this case. Read-only and write-only ingesters are
+		// extra replicas in the same way, used for only one operation.
+		if !ingester.fullReplica() {
 			n++
-			if op == Write {
+			if !ingester.serves(op) {
 				continue
 			}
 		}
 
-		ingesters = append(ingesters, ingester)
+		ids = append(ids, token.Ingester)
 	}
-	return ingesters, nil
+	return ids
+}
+
+// zoneReplicas returns the IDs of ingesters in n distinct zones of the given
+// pool, walking the ring from the token at index start, so losing a zone loses
+// at most one replica of each key.
+func (r *Ring) zoneReplicas(pool string, start int, n int, op Operation) []string {
+	ids := make([]string, 0, n)
+	distinctHosts := map[string]struct{}{}
+	distinctZones := map[string]struct{}{}
+	iterations := 0
+	for i := start; len(distinctZones) < n && iterations < len(r.ringDesc.Tokens); i++ {
+		iterations++
+		// Wrap i around in the ring.
+		i %= len(r.ringDesc.Tokens)
+
+		token := r.ringDesc.Tokens[i]
+		if _, ok := distinctHosts[token.Ingester]; ok {
+			continue
+		}
+		ingester := r.ringDesc.Ingesters[token.Ingester]
+		if ingester.Pool != pool {
+			continue
+		}
+		if _, ok := distinctZones[ingester.Zone]; ok {
+			continue
+		}
+		distinctHosts[token.Ingester] = struct{}{}
+
+		// As in replicas, Leaving ingesters don't count to the replication limit:
+		// their zone's replica is the next ingester in it, and they are read
+		// from alongside it. Likewise for read-only and write-only ingesters.
+		if !ingester.fullReplica() {
+			if ingester.serves(op) {
+				ids = append(ids, token.Ingester)
+			}
+			continue
+		}
+
+		distinctZones[ingester.Zone] = struct{}{}
+		ids = append(ids, token.Ingester)
+	}
+	return ids
+}
+
+// fullReplica is true if the ingester counts to the replication limit, being
+// both read from and written to.
+func (i *IngesterDesc) fullReplica() bool {
+	return i.State == ACTIVE && i.Mode == READ_WRITE
+}
+
+// serves is true if the ingester can be used for op: Leaving and read-only
+// ingesters aren't written to, and joining and write-only ones, which may not
+// have all their series' samples, aren't read from.
+func (i *IngesterDesc) serves(op Operation) bool {
+	switch op {
+	case Write:
+		return i.State != LEAVING && i.Mode != READ_ONLY
+	case Read:
+		return i.State != JOINING && i.Mode != WRITE_ONLY
+	}
+	return false
 }
 
 // GetAll returns all available ingesters in the circle.
@@ -235,8 +408,12 @@ func (r *Ring) search(key uint32) int {
 // Describe implements prometheus.Collector.
 func (r *Ring) Describe(ch chan<- *prometheus.Desc) {
 	ch <- r.ingesterOwnershipDesc
+	ch <- r.tokenOwnershipDesc
 	ch <- r.numIngestersDesc
 	ch <- r.numTokensDesc
+	r.lookupDuration.Describe(ch)
+	r.lookupBatchSize.Describe(ch)
+	r.healthyReplicas.Describe(ch)
 }
 
 func countTokens(tokens []*TokenDesc) (map[string]uint32, map[string]uint32) {
@@ -270,11 +447,21 @@ func (r *Ring) Collect(ch chan<- prometheus.Metric) {
 		)
 	}
 
+	for id, o := range r.ownership(defaultOwnershipReplicationFactor) {
+		ch <- prometheus.MustNewConstMetric(
+			r.tokenOwnershipDesc,
+			prometheus.GaugeValue,
+			o.OwnershipRatio,
+			id,
+		)
+	}
+
 	// Initialised to zero so we emit zero-metrics (instead of not emitting anything)
 	byState := map[string]int{
 		unhealthy:        0,
 		ACTIVE.String():  0,
 		LEAVING.String(): 0,
+		JOINING.String(): 0,
 	}
 	for _, ingester := range r.ringDesc.Ingesters {
 		if time.Now().Sub(time.Unix(ingester.Timestamp, 0)) > r.heartbeatTimeout {
@@ -297,4 +484,7 @@ func (r *Ring) Collect(ch chan<- prometheus.Metric) {
 		prometheus.GaugeValue,
 		float64(len(r.ringDesc.Tokens)),
 	)
+	r.lookupDuration.Collect(ch)
+	r.lookupBatchSize.Collect(ch)
+	r.healthyReplicas.Collect(ch)
 }
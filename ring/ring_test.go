@@ -2,7 +2,13 @@ package ring
 
 import (
 	"fmt"
+	"reflect"
 	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 const (
@@ -43,3 +49,211 @@ func BenchmarkRing(b *testing.B) {
 		r.BatchGet(keys, 3, Write)
 	}
 }
+
+func TestRingGetInPool(t *testing.T) {
+	desc := newDesc()
+	for i := 0; i < 6; i++ {
+		id := fmt.Sprintf("%d", i)
+		desc.addIngester(id, id, []uint32{uint32(i)}, ACTIVE)
+		if i%2 == 1 {
+			desc.Ingesters[id].Pool = "dedicated"
+		}
+	}
+	r := Ring{ringDesc: desc}
+
+	for _, tc := range []struct {
+		pool     string
+		expected []string
+	}{
+		{DefaultPool, []string{"2", "4"}},
+		{"dedicated", []string{"3", "5"}},
+		{"unknown", []string{}},
+	} {
+		ingesters, err := r.GetInPool(tc.pool, 1, 2, Write)
+		if err != nil {
+			t.Fatal(err)
+		}
+		addrs := []string{}
+		for _, ingester := range ingesters {
+			addrs = append(addrs, ingester.Addr)
+		}
+		if !reflect.DeepEqual(tc.expected, addrs) {
+			t.Errorf("pool %q: expected %v, got %v", tc.pool, tc.expected, addrs)
+		}
+	}
+}
+
+func TestRingOwnership(t *testing.T) {
+	desc := newDesc()
+	desc.addIngester("0", "0", []uint32{1 << 30}, ACTIVE)
+	desc.addIngester("1", "1", []uint32{1 << 31}, ACTIVE)
+	desc.addIngester("2", "2", []uint32{3 << 30}, ACTIVE)
+	desc.Ingesters["2"].Pool = "dedicated"
+	r := Ring{ringDesc: desc}
+
+	// Ingester 0 owns the keys up to its token, and those up to the dedicated
+	// pool's token too. With two replicas, both default pool ingesters hold
+	// every series.
+	expected := map[string]*IngesterOwnership{
+		"0": {ID: "0", Tokens: 1, Ownership: 0.75, SeriesShare: 0.5, OwnershipRatio: 1.5},
+		"1": {ID: "1", Tokens: 1, Ownership: 0.25, SeriesShare: 0.5, OwnershipRatio: 0.5},
+		"2": {ID: "2", Pool: "dedicated", Tokens: 1, Ownership: 1, SeriesShare: 1, OwnershipRatio: 1},
+	}
+	if actual := r.ownership(2); !reflect.DeepEqual(expected, actual) {
+		t.Errorf("expected %v, got %v", expected, actual)
+	}
+}
+
+func TestRingZoneAwareness(t *testing.T) {
+	desc := newDesc()
+	zones := []string{"a", "a", "b", "b", "c", "c"}
+	for i, zone := range zones {
+		id := fmt.Sprintf("%d", i)
+		state := ACTIVE
+		if i == 4 {
+			state = LEAVING
+		}
+		desc.addIngester(id, id, []uint32{uint32(i)}, state)
+		desc.Ingesters[id].Zone = zone
+	}
+
+	for _, tc := range []struct {
+		zoneAware bool
+		op        Operation
+		expected  []string
+	}{
+		// Without zone-awareness, two replicas are in zone b.
+		{false, Write, []string{"1", "2", "3"}},
+		{true, Write, []string{"1", "2", "5"}},
+		// The leaving ingester is read from as well as its zone's replica.
+		{true, Read, []string{"1", "2", "4", "5"}},
+	} {
+		r := Ring{ringDesc: desc, zoneAwareness: tc.zoneAware}
+		ingesters, err := r.Get(0, 3, tc.op)
+		if err != nil {
+			t.Fatal(err)
+		}
+		addrs := []string{}
+		for _, ingester := range ingesters {
+			addrs = append(addrs, ingester.Addr)
+		}
+		if !reflect.DeepEqual(tc.expected, addrs) {
+			t.Errorf("zone-aware %v, op %v: expected %v, got %v", tc.zoneAware, tc.op, tc.expected, addrs)
+		}
+	}
+}
+
+func TestRingModes(t *testing.T) {
+	desc := newDesc()
+	modes := []IngesterMode{READ_WRITE, READ_ONLY, READ_WRITE, WRITE_ONLY, READ_WRITE, READ_WRITE}
+	for i, mode := range modes {
+		id := fmt.Sprintf("%d", i)
+		desc.addIngester(id, id, []uint32{uint32(i)}, ACTIVE)
+		desc.Ingesters[id].Mode = mode
+	}
+
+	for _, tc := range []struct {
+		op       Operation
+		expected []string
+	}{
+		// The read-only and write-only ingesters are extra replicas, each
+		// used for only one operation.
+		{Write, []string{"2", "3", "4", "5"}},
+		{Read, []string{"1", "2", "4", "5"}},
+	} {
+		r := Ring{ringDesc: desc}
+		ingesters, err := r.Get(0, 3, tc.op)
+		if err != nil {
+			t.Fatal(err)
+		}
+		addrs := []string{}
+		for _, ingester := range ingesters {
+			addrs = append(addrs, ingester.Addr)
+		}
+		if !reflect.DeepEqual(tc.expected, addrs) {
+			t.Errorf("op %v: expected %v, got %v", tc.op, tc.expected, addrs)
+		}
+	}
+}
+
+func TestRingJoiningIngesters(t *testing.T) {
+	desc := newDesc()
+	states := []IngesterState{ACTIVE, JOINING, ACTIVE, ACTIVE}
+	for i, state := range states {
+		id := fmt.Sprintf("%d", i)
+		desc.addIngester(id, id, []uint32{uint32(i)}, state)
+	}
+
+	for _, tc := range []struct {
+		op       Operation
+		expected []string
+	}{
+		// The joining ingester is written to as an extra replica, but not
+		// read from until it has recovered its series.
+		{Write, []string{"1", "2", "3", "0"}},
+		{Read, []string{"2", "3", "0"}},
+	} {
+		r := Ring{ringDesc: desc}
+		ingesters, err := r.Get(0, 3, tc.op)
+		require.NoError(t, err)
+		addrs := []string{}
+		for _, ingester := range ingesters {
+			addrs = append(addrs, ingester.Addr)
+		}
+		assert.Equal(t, tc.expected, addrs, "op %v", tc.op)
+	}
+}
+
+func TestParseIngesterMode(t *testing.T) {
+	for s, expected := range map[string]IngesterMode{
+		"read-write": READ_WRITE,
+		"read-only":  READ_ONLY,
+		"write-only": WRITE_ONLY,
+	} {
+		mode, err := ParseIngesterMode(s)
+		if err != nil || mode != expected {
+			t.Errorf("%s: expected %v, got %v (%v)", s, expected, mode, err)
+		}
+	}
+	if _, err := ParseIngesterMode("read"); err == nil {
+		t.Error("expected an error for an unknown mode")
+	}
+}
+
+func TestRingLookupMetrics(t *testing.T) {
+	desc := newDesc()
+	desc.addIngester("0", "0", []uint32{1 << 30}, ACTIVE)
+	desc.addIngester("1", "1", []uint32{1 << 31}, ACTIVE)
+	desc.addIngester("2", "2", []uint32{3 << 30}, LEAVING)
+	consul := newMockConsulClient()
+	ringBytes, err := ProtoCodec{}.Encode(desc)
+	require.NoError(t, err)
+	consul.PutBytes(consulKey, ringBytes)
+
+	r, err := New(Config{
+		ConsulConfig:     ConsulConfig{mock: consul},
+		HeartbeatTimeout: time.Minute,
+	})
+	require.NoError(t, err)
+	defer r.Stop()
+	for deadline := time.Now().Add(time.Second); !r.Ready() && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+
+	_, err = r.BatchGet([]uint32{1, 2, 3, 4}, 3, Write)
+	require.NoError(t, err)
+	_, err = r.Get(1, 3, Read)
+	require.NoError(t, err)
+
+	var m dto.Metric
+	require.NoError(t, r.lookupDuration.WithLabelValues("batch_get", "write").Write(&m))
+	assert.Equal(t, uint64(1), m.GetHistogram().GetSampleCount())
+	require.NoError(t, r.lookupDuration.WithLabelValues("get", "read").Write(&m))
+	assert.Equal(t, uint64(1), m.GetHistogram().GetSampleCount())
+	require.NoError(t, r.lookupBatchSize.Write(&m))
+	assert.Equal(t, 4., m.GetHistogram().GetSampleSum())
+	// Every replica set has the two active ingesters, not the leaving one.
+	require.NoError(t, r.healthyReplicas.WithLabelValues("write").Write(&m))
+	assert.Equal(t, uint64(4), m.GetHistogram().GetSampleCount())
+	assert.Equal(t, 8., m.GetHistogram().GetSampleSum())
+}
@@ -25,7 +25,9 @@ type appenderAdapter struct {
 }
 
 func (a appenderAdapter) Append(sample *model.Sample) error {
-	_, err := a.pusher.Push(a.ctx, util.ToWriteRequest([]model.Sample{*sample}))
+	req := util.ToWriteRequest([]model.Sample{*sample})
+	req.Source = cortex.RULE
+	_, err := a.pusher.Push(a.ctx, req)
 	return err
 }
 
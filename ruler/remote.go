@@ -0,0 +1,284 @@
+package ruler
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/rules"
+	"github.com/prometheus/prometheus/template"
+	"github.com/prometheus/prometheus/util/strutil"
+	"golang.org/x/net/context"
+)
+
+const (
+	// resolvedRetention is the duration for which a resolved alert instance
+	// is kept and repeatedly sent to the Alertmanager, as in Prometheus.
+	resolvedRetention = 15 * time.Minute
+
+	alertMetricName model.LabelValue = "ALERTS"
+	alertStateLabel model.LabelName  = "alertstate"
+)
+
+// remoteEvaluator evaluates rules by sending their expressions as instant
+// queries to a remote query API (see querier.RemoteQuerier), instead of using
+// an embedded engine as Prometheus' rules do, or to an embedded engine at
+// times other than now.
+//
+// Prometheus' rules only evaluate against an embedded engine, at the current
+// time, so we parse the statement back out of each rule and keep alert state
+// here ourselves.
+type remoteEvaluator struct {
+	querier instantQuerier
+
+	// Per-user, per-rule alert state.
+	// TODO: Remove state for stale users and rules.
+	alertsMtx sync.Mutex
+	alerts    map[string]*remoteAlertingRule
+}
+
+// instantQuerier runs instant queries; see querier.RemoteQuerier.
+type instantQuerier interface {
+	Query(ctx context.Context, expr string, ts model.Time) (model.Vector, error)
+}
+
+func newRemoteEvaluator(q instantQuerier) *remoteEvaluator {
+	return &remoteEvaluator{
+		querier: q,
+		alerts:  map[string]*remoteAlertingRule{},
+	}
+}
+
+// eval evaluates a single rule at ts, returning the samples to be appended and
+// the alerts to be sent.
+func (e *remoteEvaluator) eval(ctx context.Context, userID string, rule rules.Rule, ts model.Time, externalURL string) (model.Vector, model.Alerts, error) {
+	stmts, err := promql.ParseStmts(rule.String())
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(stmts) != 1 {
+		return nil, nil, fmt.Errorf("expected 1 statement for rule %q, got %d", rule.Name(), len(stmts))
+	}
+
+	switch stmt := stmts[0].(type) {
+	case *promql.RecordStmt:
+		vector, err := e.querier.Query(ctx, stmt.Expr.String(), ts)
+		if err != nil {
+			return nil, nil, err
+		}
+		// Override the metric name and labels, as rules.RecordingRule does.
+		for _, sample := range vector {
+			sample.Metric[model.MetricNameLabel] = model.LabelValue(stmt.Name)
+			for label, value := range stmt.Labels {
+				if value == "" {
+					delete(sample.Metric, label)
+				} else {
+					sample.Metric[label] = value
+				}
+			}
+		}
+		return vector, nil, nil
+
+	case *promql.AlertStmt:
+		vector, err := e.querier.Query(ctx, stmt.Expr.String(), ts)
+		if err != nil {
+			return nil, nil, err
+		}
+		ar := e.getOrCreateAlertingRule(userID, rule.String(), stmt)
+		return ar.eval(ctx, vector, ts), ar.alerts(externalURL), nil
+
+	default:
+		return nil, nil, fmt.Errorf("unknown statement type %T", stmt)
+	}
+}
+
+func (e *remoteEvaluator) getOrCreateAlertingRule(userID, key string, stmt *promql.AlertStmt) *remoteAlertingRule {
+	e.alertsMtx.Lock()
+	defer e.alertsMtx.Unlock()
+
+	key = userID + "/" + key
+	ar, ok := e.alerts[key]
+	if !ok {
+		ar = &remoteAlertingRule{
+			stmt:   stmt,
+			active: map[model.Fingerprint]*rules.Alert{},
+		}
+		e.alerts[key] = ar
+	}
+	return ar
+}
+
+// remoteAlertingRule tracks the state of an alerting rule whose expression is
+// evaluated remotely. It mirrors rules.AlertingRule, except that template
+// expansion has no engine, so the query functions can't be used in labels and
+// annotations.
+type remoteAlertingRule struct {
+	stmt *promql.AlertStmt
+
+	mtx    sync.Mutex
+	active map[model.Fingerprint]*rules.Alert
+}
+
+func (r *remoteAlertingRule) eval(ctx context.Context, res model.Vector, ts model.Time) model.Vector {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	// Create pending alerts for any new vector elements in the alert expression
+	// or update the expression value for existing elements.
+	resultFPs := map[model.Fingerprint]struct{}{}
+	for _, smpl := range res {
+		l := make(map[string]string, len(smpl.Metric))
+		for k, v := range smpl.Metric {
+			l[string(k)] = string(v)
+		}
+		tmplData := struct {
+			Labels map[string]string
+			Value  float64
+		}{
+			Labels: l,
+			Value:  float64(smpl.Value),
+		}
+		defs := "{{$labels := .Labels}}{{$value := .Value}}"
+		expand := func(text model.LabelValue) model.LabelValue {
+			tmpl := template.NewTemplateExpander(ctx, defs+string(text), "__alert_"+r.stmt.Name, tmplData, ts, nil, "")
+			result, err := tmpl.Expand()
+			if err != nil {
+				result = fmt.Sprintf("<error expanding template: %s>", err)
+				log.Warnf("Error expanding alert template %v with data '%v': %s", r.stmt.Name, tmplData, err)
+			}
+			return model.LabelValue(result)
+		}
+
+		delete(smpl.Metric, model.MetricNameLabel)
+		labels := make(model.LabelSet, len(smpl.Metric)+len(r.stmt.Labels)+1)
+		for ln, lv := range smpl.Metric {
+			labels[ln] = lv
+		}
+		for ln, lv := range r.stmt.Labels {
+			labels[ln] = expand(lv)
+		}
+		labels[model.AlertNameLabel] = model.LabelValue(r.stmt.Name)
+
+		annotations := make(model.LabelSet, len(r.stmt.Annotations))
+		for an, av := range r.stmt.Annotations {
+			annotations[an] = expand(av)
+		}
+		fp := smpl.Metric.Fingerprint()
+		resultFPs[fp] = struct{}{}
+
+		if alert, ok := r.active[fp]; ok && alert.State != rules.StateInactive {
+			alert.Value = smpl.Value
+			alert.Annotations = annotations
+			continue
+		}
+		r.active[fp] = &rules.Alert{
+			Labels:      labels,
+			Annotations: annotations,
+			ActiveAt:    ts,
+			State:       rules.StatePending,
+			Value:       smpl.Value,
+		}
+	}
+
+	// Check if any pending alerts should be removed or fire now, and write out
+	// the ALERTS timeseries.
+	var vec model.Vector
+	for fp, a := range r.active {
+		if _, ok := resultFPs[fp]; !ok {
+			if a.State != rules.StateInactive {
+				vec = append(vec, r.sample(a, ts, false))
+			}
+			if a.State == rules.StatePending || (a.ResolvedAt != 0 && ts.Sub(a.ResolvedAt) > resolvedRetention) {
+				delete(r.active, fp)
+			}
+			if a.State != rules.StateInactive {
+				a.State = rules.StateInactive
+				a.ResolvedAt = ts
+			}
+			continue
+		}
+
+		if a.State == rules.StatePending && ts.Sub(a.ActiveAt) >= r.stmt.Duration {
+			vec = append(vec, r.sample(a, ts, false))
+			a.State = rules.StateFiring
+		}
+		vec = append(vec, r.sample(a, ts, true))
+	}
+	return vec
+}
+
+func (r *remoteAlertingRule) sample(alert *rules.Alert, ts model.Time, set bool) *model.Sample {
+	metric := model.Metric(r.stmt.Labels.Clone())
+	for ln, lv := range alert.Labels {
+		metric[ln] = lv
+	}
+	metric[model.MetricNameLabel] = alertMetricName
+	metric[model.AlertNameLabel] = model.LabelValue(r.stmt.Name)
+	metric[alertStateLabel] = model.LabelValue(alert.State.String())
+
+	s := &model.Sample{
+		Metric:    metric,
+		Timestamp: ts,
+	}
+	if set {
+		s.Value = 1
+	}
+	return s
+}
+
+// alerts returns the firing and recently resolved alerts to send to the
+// Alertmanager.
+func (r *remoteAlertingRule) alerts(externalURL string) model.Alerts {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	var alerts model.Alerts
+	for _, alert := range r.active {
+		if alert.State == rules.StatePending {
+			continue
+		}
+		a := &model.Alert{
+			StartsAt:     alert.ActiveAt.Add(r.stmt.Duration).Time(),
+			Labels:       alert.Labels,
+			Annotations:  alert.Annotations,
+			GeneratorURL: externalURL + strutil.GraphLinkForExpression(r.stmt.Expr.String()),
+		}
+		if alert.ResolvedAt != 0 {
+			a.EndsAt = alert.ResolvedAt.Time()
+		}
+		alerts = append(alerts, a)
+	}
+	return alerts
+}
+
+// engineQuerier runs instant queries with an embedded engine, for evaluating
+// rules at other times than now.
+type engineQuerier struct {
+	engine *promql.Engine
+}
+
+func (q engineQuerier) Query(ctx context.Context, expr string, ts model.Time) (model.Vector, error) {
+	query, err := q.engine.NewInstantQuery(expr, ts)
+	if err != nil {
+		return nil, err
+	}
+	result := query.Exec(ctx)
+	if result.Err != nil {
+		return nil, result.Err
+	}
+	switch v := result.Value.(type) {
+	case model.Vector:
+		return v, nil
+	case *model.Scalar:
+		return model.Vector{&model.Sample{
+			Metric:    model.Metric{},
+			Value:     v.Value,
+			Timestamp: v.Timestamp,
+		}}, nil
+	default:
+		return nil, fmt.Errorf("query result is not a vector or scalar: %s", result.Value.Type())
+	}
+}
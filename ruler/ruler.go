@@ -67,56 +67,146 @@ type Config struct {
 	EvaluationInterval time.Duration
 	NumWorkers         int
 
+	// How far behind now rules are evaluated by default, and whether their
+	// evaluation timestamps are aligned to multiples of the interval.
+	EvaluationDelay  time.Duration
+	AlignEvaluations bool
+
+	// A YAML file of per-tenant util.Overrides.
+	OverridesFile string
+
 	// URL of the Alertmanager to send notifications to.
 	AlertmanagerURL string
 	// Capacity of the queue for notifications to be sent to the Alertmanager.
 	NotificationQueueCapacity int
 	// HTTP timeout duration when sending notifications to the Alertmanager.
 	NotificationTimeout time.Duration
+
+	// URL of the Prometheus API of the Cortex query path (the querier, or a
+	// query frontend in front of it). If set, rule expressions are sent there
+	// to be evaluated rather than to an embedded engine.
+	FrontendURL util.URLValue
+	// HTTP timeout duration for queries sent to the query-frontend.
+	FrontendTimeout time.Duration
+
+	// Configures the embedded engine, when not using the frontend.
+	QuerierConfig querier.Config
 }
 
 // RegisterFlags adds the flags required to config this to the given FlagSet
 func (cfg *Config) RegisterFlags(f *flag.FlagSet) {
+	cfg.QuerierConfig.RegisterFlags(f)
+
 	cfg.ExternalURL.URL, _ = url.Parse("") // Must be non-nil
 	f.Var(&cfg.ConfigsAPIURL, "ruler.configs.url", "URL of configs API server.")
 	f.Var(&cfg.ExternalURL, "ruler.external.url", "URL of alerts return path.")
 	f.DurationVar(&cfg.EvaluationInterval, "ruler.evaluation-interval", 15*time.Second, "How frequently to evaluate rules")
 	f.DurationVar(&cfg.ClientTimeout, "ruler.client-timeout", 5*time.Second, "Timeout for requests to Weave Cloud configs service.")
 	f.IntVar(&cfg.NumWorkers, "ruler.num-workers", 1, "Number of rule evaluator worker routines in this process")
+	f.DurationVar(&cfg.EvaluationDelay, "ruler.evaluation-delay", 0, "How far behind now to evaluate rules, so samples pushed late are included rather than alerts flapping.")
+	f.BoolVar(&cfg.AlignEvaluations, "ruler.align-evaluations", false, "Align the timestamps rules are evaluated at to multiples of the evaluation interval.")
+	f.StringVar(&cfg.OverridesFile, "ruler.overrides-file", "", "YAML file of per-tenant settings overriding the flags: ruler_evaluation_delay, ruler_evaluation_interval and ruler_align_evaluations.")
 	f.StringVar(&cfg.AlertmanagerURL, "ruler.alertmanager-url", "", "URL of the Alertmanager to send notifications to.")
 	f.IntVar(&cfg.NotificationQueueCapacity, "ruler.notification-queue-capacity", 10000, "Capacity of the queue for notifications to be sent to the Alertmanager.")
 	f.DurationVar(&cfg.NotificationTimeout, "ruler.notification-timeout", 10*time.Second, "HTTP timeout duration when sending notifications to the Alertmanager.")
+	f.Var(&cfg.FrontendURL, "ruler.frontend.url", "URL of the Prometheus API of the query path to evaluate rule expressions against, eg http://querier/api/prom or a query frontend in front of it. If not set, rules are evaluated against the distributor and chunk store.")
+	f.DurationVar(&cfg.FrontendTimeout, "ruler.frontend.timeout", 30*time.Second, "HTTP timeout duration for queries sent to -ruler.frontend.url.")
 }
 
 // Ruler evaluates rules.
 type Ruler struct {
 	engine        *promql.Engine
+	remote        *remoteEvaluator
+	delayed       *remoteEvaluator
 	pusher        Pusher
 	alertURL      *url.URL
 	notifierCfg   *config.Config
 	queueCapacity int
 
+	evaluationInterval time.Duration
+	evaluationDelay    time.Duration
+	alignEvaluations   bool
+	overrides          map[string]util.Overrides
+
 	// Per-user notifiers with separate queues.
 	notifiersMtx sync.Mutex
 	notifiers    map[string]*notifier.Notifier
 }
 
-// NewRuler creates a new ruler from a distributor and chunk store.
+// NewRuler creates a new ruler from a distributor and chunk store. If
+// cfg.FrontendURL is set, rules are evaluated remotely and the chunk store is
+// not used, so may be nil.
 func NewRuler(cfg Config, d *distributor.Distributor, c *chunk.Store) (*Ruler, error) {
 	ncfg, err := buildNotifierConfig(&cfg)
 	if err != nil {
 		return nil, err
 	}
+	var overrides map[string]util.Overrides
+	if cfg.OverridesFile != "" {
+		overrides, err = util.LoadOverrides(cfg.OverridesFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var (
+		engine          *promql.Engine
+		remote, delayed *remoteEvaluator
+	)
+	if cfg.FrontendURL.URL != nil {
+		log.Infof("Evaluating rules against %s", cfg.FrontendURL.URL)
+		remote = newRemoteEvaluator(querier.NewRemoteQuerier(cfg.FrontendURL.URL, cfg.FrontendTimeout))
+	} else {
+		engine = querier.NewEngine(cfg.QuerierConfig, d, c)
+		// Prometheus' rule groups always evaluate rules at the current time.
+		delayed = newRemoteEvaluator(engineQuerier{engine: engine})
+	}
 	return &Ruler{
-		engine:        querier.NewEngine(d, c),
-		pusher:        d,
-		alertURL:      cfg.ExternalURL.URL,
-		notifierCfg:   ncfg,
-		queueCapacity: cfg.NotificationQueueCapacity,
-		notifiers:     map[string]*notifier.Notifier{},
+		engine:             engine,
+		remote:             remote,
+		delayed:            delayed,
+		pusher:             d,
+		alertURL:           cfg.ExternalURL.URL,
+		notifierCfg:        ncfg,
+		queueCapacity:      cfg.NotificationQueueCapacity,
+		evaluationInterval: cfg.EvaluationInterval,
+		evaluationDelay:    cfg.EvaluationDelay,
+		alignEvaluations:   cfg.AlignEvaluations,
+		overrides:          overrides,
+		notifiers:          map[string]*notifier.Notifier{},
 	}, nil
 }
 
+// EvaluationInterval returns how often the user's rules are evaluated.
+func (r *Ruler) EvaluationInterval(userID string) time.Duration {
+	if interval := r.overrides[userID].RulerEvaluationInterval; interval > 0 {
+		return interval
+	}
+	return r.evaluationInterval
+}
+
+func (r *Ruler) evaluationDelayFor(userID string) time.Duration {
+	if delay := r.overrides[userID].RulerEvaluationDelay; delay > 0 {
+		return delay
+	}
+	return r.evaluationDelay
+}
+
+func (r *Ruler) alignEvaluationsFor(userID string) bool {
+	if align := r.overrides[userID].RulerAlignEvaluations; align != nil {
+		return *align
+	}
+	return r.alignEvaluations
+}
+
+// evaluationTime returns the timestamp to evaluate the user's rules at, when
+// they are evaluated at now.
+func (r *Ruler) evaluationTime(userID string, now time.Time) time.Time {
+	if r.alignEvaluationsFor(userID) {
+		now = now.Truncate(r.EvaluationInterval(userID))
+	}
+	return now.Add(-r.evaluationDelayFor(userID))
+}
+
 // Builds a Prometheus config.Config from a ruler.Config with just the required
 // options to configure notifications to Alertmanager.
 func buildNotifierConfig(rulerConfig *Config) (*config.Config, error) {
@@ -221,11 +311,29 @@ func (r *Ruler) getOrCreateNotifier(userID string) (*notifier.Notifier, error) {
 func (r *Ruler) Evaluate(ctx context.Context, rs []rules.Rule) {
 	log.Debugf("Evaluating %d rules...", len(rs))
 	start := time.Now()
-	g, err := r.newGroup(ctx, rs)
+	userID, err := user.Extract(ctx)
 	if err != nil {
-		log.Errorf("Failed to create rule group: %v", err)
+		log.Errorf("Failed to evaluate rules: %v", err)
+		return
+	}
+	ts := model.TimeFromUnixNano(r.evaluationTime(userID, start).UnixNano())
+	if r.remote != nil {
+		if err := r.evaluateRemote(ctx, r.remote, rs, ts); err != nil {
+			log.Errorf("Failed to evaluate rules: %v", err)
+		}
+	} else if ts != model.TimeFromUnixNano(start.UnixNano()) {
+		// Alert templates of delayed or aligned rules can't use query
+		// functions, as when evaluating remotely.
+		if err := r.evaluateRemote(ctx, r.delayed, rs, ts); err != nil {
+			log.Errorf("Failed to evaluate rules: %v", err)
+		}
 	} else {
-		g.Eval()
+		g, err := r.newGroup(ctx, rs)
+		if err != nil {
+			log.Errorf("Failed to create rule group: %v", err)
+		} else {
+			g.Eval()
+		}
 	}
 	// The prometheus routines we're calling have their own instrumentation
 	// but, a) it's rule-based, not group-based, b) it's a summary, not a
@@ -234,6 +342,43 @@ func (r *Ruler) Evaluate(ctx context.Context, rs []rules.Rule) {
 	rulesProcessed.Add(float64(len(rs)))
 }
 
+// evaluateRemote evaluates rules at ts using a remoteEvaluator, appending and
+// notifying the results as a rules.Group would.
+func (r *Ruler) evaluateRemote(ctx context.Context, evaluator *remoteEvaluator, rs []rules.Rule, now model.Time) error {
+	userID, err := user.Extract(ctx)
+	if err != nil {
+		return err
+	}
+	notifier, err := r.getOrCreateNotifier(userID)
+	if err != nil {
+		return err
+	}
+	appender := appenderAdapter{pusher: r.pusher, ctx: ctx}
+
+	var wg sync.WaitGroup
+	for _, rule := range rs {
+		wg.Add(1)
+		go func(rule rules.Rule) {
+			defer wg.Done()
+			vector, alerts, err := evaluator.eval(ctx, userID, rule, now, r.alertURL.String())
+			if err != nil {
+				log.Warnf("Error while evaluating rule %q: %s", rule.Name(), err)
+				return
+			}
+			if len(alerts) > 0 {
+				notifier.Send(alerts...)
+			}
+			for _, s := range vector {
+				if err := appender.Append(s); err != nil {
+					log.With("sample", s).With("error", err).Warn("Rule evaluation result discarded")
+				}
+			}
+		}(rule)
+	}
+	wg.Wait()
+	return nil
+}
+
 // Stop stops the Ruler.
 func (r *Ruler) Stop() {
 	r.notifiersMtx.Lock()
@@ -257,7 +402,7 @@ func NewServer(cfg Config, ruler *Ruler) (*Server, error) {
 		Timeout: cfg.ClientTimeout,
 	}
 	// TODO: Separate configuration for polling interval.
-	s := newScheduler(c, cfg.EvaluationInterval, cfg.EvaluationInterval)
+	s := newScheduler(c, ruler.EvaluationInterval, cfg.EvaluationInterval)
 	if cfg.NumWorkers <= 0 {
 		return nil, fmt.Errorf("must have at least 1 worker, got %d", cfg.NumWorkers)
 	}
@@ -0,0 +1,39 @@
+package ruler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/weaveworks/cortex/util"
+)
+
+func TestEvaluationTime(t *testing.T) {
+	aligned, unaligned := true, false
+	r := &Ruler{
+		evaluationInterval: 15 * time.Second,
+		evaluationDelay:    10 * time.Second,
+		overrides: map[string]util.Overrides{
+			"lagging": {RulerEvaluationDelay: time.Minute, RulerEvaluationInterval: time.Minute, RulerAlignEvaluations: &aligned},
+			"prompt":  {RulerAlignEvaluations: &unaligned},
+		},
+	}
+	now := time.Date(2017, 6, 1, 12, 0, 47, 0, time.UTC)
+
+	for _, tc := range []struct {
+		userID   string
+		align    bool
+		interval time.Duration
+		expected time.Time
+	}{
+		{"user", false, 15 * time.Second, now.Add(-10 * time.Second)},
+		{"user", true, 15 * time.Second, time.Date(2017, 6, 1, 12, 0, 35, 0, time.UTC)},
+		{"lagging", false, time.Minute, time.Date(2017, 6, 1, 11, 59, 0, 0, time.UTC)},
+		{"prompt", true, 15 * time.Second, now.Add(-10 * time.Second)},
+	} {
+		r.alignEvaluations = tc.align
+		assert.Equal(t, tc.interval, r.EvaluationInterval(tc.userID), tc.userID)
+		assert.Equal(t, tc.expected, r.evaluationTime(tc.userID, now), tc.userID)
+	}
+}
@@ -63,7 +63,7 @@ func (w workItem) Defer(interval time.Duration) workItem {
 
 type scheduler struct {
 	configsAPI         configs.API // XXX: Maybe make this an interface ConfigSource or similar.
-	evaluationInterval time.Duration
+	evaluationInterval func(userID string) time.Duration
 	q                  *SchedulingQueue
 
 	// All the configurations that we have. Only used for instrumentation.
@@ -78,8 +78,9 @@ type scheduler struct {
 	done chan struct{}
 }
 
-// newScheduler makes a new scheduler.
-func newScheduler(configsAPI configs.API, evaluationInterval, pollInterval time.Duration) scheduler {
+// newScheduler makes a new scheduler, evaluating each user's rules at the
+// interval evaluationInterval returns for them.
+func newScheduler(configsAPI configs.API, evaluationInterval func(userID string) time.Duration, pollInterval time.Duration) scheduler {
 	return scheduler{
 		configsAPI:         configsAPI,
 		evaluationInterval: evaluationInterval,
@@ -213,7 +214,7 @@ func (s *scheduler) nextWorkItem() *workItem {
 
 // workItemDone marks the given item as being ready to be rescheduled.
 func (s *scheduler) workItemDone(i workItem) {
-	next := i.Defer(s.evaluationInterval)
+	next := i.Defer(s.evaluationInterval(i.userID))
 	log.Debugf("Scheduler: work item %v rescheduled for %v", i, next.scheduled.Format("2006-01-02 15:04:05"))
 	s.addWorkItem(next)
 }
@@ -0,0 +1,241 @@
+package scraper
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/config"
+	"github.com/prometheus/prometheus/retrieval"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex"
+	"github.com/weaveworks/cortex/util"
+)
+
+// Config configures the scraper.
+type Config struct {
+	ConfigsDir   string
+	PollInterval time.Duration
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet
+func (cfg *Config) RegisterFlags(f *flag.FlagSet) {
+	f.StringVar(&cfg.ConfigsDir, "scraper.configs-dir", "", "Directory of per-tenant Prometheus config files, named <tenant>.yml, whose scrape configs are scraped on the tenant's behalf.")
+	f.DurationVar(&cfg.PollInterval, "scraper.poll-interval", time.Minute, "How frequently to reload the per-tenant config files.")
+}
+
+// Pusher is an ingester server that accepts pushes.
+type Pusher interface {
+	Push(context.Context, *cortex.WriteRequest) (*cortex.WriteResponse, error)
+}
+
+// lastReportMetricName is the name of the last sample appended for each
+// scrape, reporting how many samples were kept after relabeling. It is
+// appended even if the scrape fails.
+const lastReportMetricName = "scrape_samples_post_metric_relabeling"
+
+// appenderAdapter adapts a Pusher to prometheus.SampleAppender, pushing the
+// scraped samples as the tenant. The retrieval package has no notion of
+// committing a scrape, so the samples are buffered until the last one a scrape
+// reports about itself, then pushed in one request. All the tenant's targets
+// share the buffer, so a push may also carry samples of other scrapes in
+// progress.
+type appenderAdapter struct {
+	pusher Pusher
+	ctx    context.Context
+
+	mtx     sync.Mutex
+	samples []model.Sample
+}
+
+func (a *appenderAdapter) Append(sample *model.Sample) error {
+	a.mtx.Lock()
+	a.samples = append(a.samples, *sample)
+	if sample.Metric[model.MetricNameLabel] != lastReportMetricName {
+		a.mtx.Unlock()
+		return nil
+	}
+	samples := a.samples
+	a.samples = nil
+	a.mtx.Unlock()
+
+	_, err := a.pusher.Push(a.ctx, util.ToWriteRequest(samples))
+	return err
+}
+
+func (a *appenderAdapter) NeedsThrottling() bool {
+	return false
+}
+
+// tenantScraper scrapes the targets of one tenant's config.
+type tenantScraper struct {
+	manager *retrieval.TargetManager
+	config  string
+}
+
+// Scraper scrapes the targets in each tenant's Prometheus config, static or
+// discovered, pushing the samples to the distributor. This lets tenants send
+// metrics to Cortex without running a Prometheus of their own.
+type Scraper struct {
+	cfg    Config
+	pusher Pusher
+	quit   chan struct{}
+	done   chan struct{}
+
+	mtx     sync.Mutex
+	tenants map[string]*tenantScraper
+}
+
+// New makes a new Scraper, loading the tenants' configs.
+func New(cfg Config, pusher Pusher) *Scraper {
+	s := &Scraper{
+		cfg:     cfg,
+		pusher:  pusher,
+		quit:    make(chan struct{}),
+		done:    make(chan struct{}),
+		tenants: map[string]*tenantScraper{},
+	}
+	s.loadConfigs()
+	go s.loop()
+	return s
+}
+
+// Stop the Scraper, waiting for in-flight scrapes to be pushed.
+func (s *Scraper) Stop() {
+	close(s.quit)
+	<-s.done
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for userID, tenant := range s.tenants {
+		tenant.manager.Stop()
+		delete(s.tenants, userID)
+	}
+}
+
+func (s *Scraper) loop() {
+	defer close(s.done)
+	ticker := time.NewTicker(s.cfg.PollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.loadConfigs()
+		case <-s.quit:
+			return
+		}
+	}
+}
+
+// loadConfigs starts scraping the targets of new tenants' configs, updates
+// those of changed configs, and stops scraping for tenants whose configs
+// have gone. A config which fails to load leaves the tenant's targets as
+// they were.
+func (s *Scraper) loadConfigs() {
+	files, err := ioutil.ReadDir(s.cfg.ConfigsDir)
+	if err != nil {
+		log.Errorf("Error reading scrape configs: %v", err)
+		return
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	seen := map[string]struct{}{}
+	for _, file := range files {
+		ext := filepath.Ext(file.Name())
+		if file.IsDir() || (ext != ".yml" && ext != ".yaml") {
+			continue
+		}
+		userID := strings.TrimSuffix(file.Name(), ext)
+		seen[userID] = struct{}{}
+
+		cfg, err := config.LoadFile(filepath.Join(s.cfg.ConfigsDir, file.Name()))
+		if err != nil {
+			log.Errorf("Error loading scrape config for %s: %v", userID, err)
+			continue
+		}
+		tenant, ok := s.tenants[userID]
+		if ok && tenant.config == cfg.String() {
+			continue
+		}
+		if !ok {
+			tenant = &tenantScraper{
+				manager: retrieval.NewTargetManager(&appenderAdapter{
+					pusher: s.pusher,
+					ctx:    user.Inject(context.Background(), userID),
+				}),
+			}
+		}
+		if err := tenant.manager.ApplyConfig(cfg); err != nil {
+			log.Errorf("Error applying scrape config for %s: %v", userID, err)
+			continue
+		}
+		tenant.config = cfg.String()
+		if !ok {
+			s.tenants[userID] = tenant
+			go tenant.manager.Run()
+		}
+		log.Infof("Loaded scrape config for %s with %d scrape configs", userID, len(cfg.ScrapeConfigs))
+	}
+
+	for userID, tenant := range s.tenants {
+		if _, ok := seen[userID]; !ok {
+			log.Infof("Scrape config for %s removed, stopping scraping", userID)
+			tenant.manager.Stop()
+			delete(s.tenants, userID)
+		}
+	}
+}
+
+// target is the JSON representation of a scraped target.
+type target struct {
+	Labels     model.LabelSet `json:"labels"`
+	ScrapeURL  string         `json:"scrapeUrl"`
+	Health     string         `json:"health"`
+	LastError  string         `json:"lastError"`
+	LastScrape time.Time      `json:"lastScrape"`
+}
+
+// ServeHTTP serves the targets scraped for the tenant as JSON.
+func (s *Scraper) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	userID, err := user.Extract(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	targets := []target{}
+	s.mtx.Lock()
+	tenant, ok := s.tenants[userID]
+	s.mtx.Unlock()
+	if ok {
+		for _, t := range tenant.manager.Targets() {
+			lastError := ""
+			if err := t.LastError(); err != nil {
+				lastError = err.Error()
+			}
+			targets = append(targets, target{
+				Labels:     t.Labels(),
+				ScrapeURL:  t.URL().String(),
+				Health:     string(t.Health()),
+				LastError:  lastError,
+				LastScrape: t.LastScrape(),
+			})
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(targets); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
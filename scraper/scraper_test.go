@@ -0,0 +1,111 @@
+package scraper
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex"
+	"github.com/weaveworks/cortex/util"
+)
+
+type testPusher struct {
+	mtx     sync.Mutex
+	samples map[string][]model.Sample
+	pushes  int
+}
+
+func (p *testPusher) Push(ctx context.Context, req *cortex.WriteRequest) (*cortex.WriteResponse, error) {
+	userID, err := user.Extract(ctx)
+	if err != nil {
+		return nil, err
+	}
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.samples[userID] = append(p.samples[userID], util.FromWriteRequest(req)...)
+	p.pushes++
+	return &cortex.WriteResponse{}, nil
+}
+
+func (p *testPusher) metricNames(userID string) map[model.LabelValue]bool {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	names := map[model.LabelValue]bool{}
+	for _, sample := range p.samples[userID] {
+		names[sample.Metric[model.MetricNameLabel]] = true
+	}
+	return names
+}
+
+func writeScrapeConfig(t *testing.T, dir, userID, job string, target *url.URL) {
+	config := fmt.Sprintf(`
+scrape_configs:
+- job_name: %s
+  scrape_interval: 10ms
+  scrape_timeout: 10ms
+  static_configs:
+  - targets: ['%s']
+`, job, target.Host)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, userID+".yml"), []byte(config), 0644))
+}
+
+func TestScraper(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "foo 1")
+	}))
+	defer server.Close()
+	serverURL, err := url.Parse(server.URL)
+	require.NoError(t, err)
+
+	dir, err := ioutil.TempDir("", "scraper")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	writeScrapeConfig(t, dir, "1", "app", serverURL)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "README"), []byte("ignored"), 0644))
+
+	pusher := &testPusher{samples: map[string][]model.Sample{}}
+	scraper := New(Config{ConfigsDir: dir, PollInterval: time.Hour}, pusher)
+	defer scraper.Stop()
+
+	// The samples scraped, along with the synthetic ones, are pushed as the
+	// tenant whose config it is.
+	for i := 0; i < 100 && !pusher.metricNames("1")["foo"]; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	names := pusher.metricNames("1")
+	assert.True(t, names["foo"])
+	assert.True(t, names["up"])
+	assert.Empty(t, pusher.metricNames("2"))
+
+	// Each scrape's sample and the four reporting on it are pushed together.
+	pusher.mtx.Lock()
+	assert.Equal(t, 5*pusher.pushes, len(pusher.samples["1"]))
+	pusher.mtx.Unlock()
+
+	req := httptest.NewRequest("GET", "/api/prom/scraper/targets", nil)
+	req = req.WithContext(user.Inject(req.Context(), "1"))
+	rec := httptest.NewRecorder()
+	scraper.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), server.URL+"/metrics")
+
+	// Removing the config stops the tenant's targets being scraped.
+	require.NoError(t, os.Remove(filepath.Join(dir, "1.yml")))
+	scraper.loadConfigs()
+	scraper.mtx.Lock()
+	assert.Empty(t, scraper.tenants)
+	scraper.mtx.Unlock()
+}
@@ -0,0 +1,187 @@
+package server
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	runtime_pprof "runtime/pprof"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+)
+
+// How often /debug/fgprof samples the goroutines' stacks.
+const fgprofSampleRate = 99
+
+// DebugConfig configures the profiling and debugging every server offers.
+type DebugConfig struct {
+	Fgprof               bool
+	MutexProfileFraction int
+	BlockProfileRate     int
+	GoroutineDumpDir     string
+}
+
+func (cfg *DebugConfig) registerFlags(f *flag.FlagSet) {
+	f.BoolVar(&cfg.Fgprof, "server.debug.fgprof", false, "Serve /debug/fgprof, a wall-clock profile sampling all goroutines, on or off CPU, in the folded format of fgprof.")
+	f.IntVar(&cfg.MutexProfileFraction, "server.debug.mutex-profile-fraction", 0, "Report 1 in this many mutex contention events in /debug/pprof/mutex. 0 to disable.")
+	f.IntVar(&cfg.BlockProfileRate, "server.debug.block-profile-rate", 0, "Report a blocking event per this many nanoseconds blocked in /debug/pprof/block. 0 to disable.")
+	f.StringVar(&cfg.GoroutineDumpDir, "server.debug.goroutine-dump-dir", "", "Directory SIGUSR1 writes dumps of all goroutines' stacks to. If empty, they are written to stderr.")
+}
+
+// registerDebug mounts the pprof and, if enabled, the fgprof handlers, and
+// sets the rates of the runtime's mutex and block profiles.
+func registerDebug(cfg DebugConfig, router *mux.Router) {
+	runtime.SetMutexProfileFraction(cfg.MutexProfileFraction)
+	runtime.SetBlockProfileRate(cfg.BlockProfileRate)
+
+	router.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	router.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	router.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	router.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	router.PathPrefix("/debug/pprof").HandlerFunc(pprof.Index)
+	if cfg.Fgprof {
+		router.HandleFunc("/debug/fgprof", fgprofHandler)
+	}
+}
+
+// fgprofHandler samples the stacks of all goroutines for the seconds asked
+// for, 30 by default, like /debug/pprof/profile, but including those blocked
+// on I/O, locks and channels, so it shows where requests spend their time.
+func fgprofHandler(w http.ResponseWriter, r *http.Request) {
+	seconds := 30
+	if s := r.FormValue("seconds"); s != "" {
+		var err error
+		if seconds, err = strconv.Atoi(s); err != nil || seconds <= 0 {
+			http.Error(w, fmt.Sprintf("invalid seconds %q", s), http.StatusBadRequest)
+			return
+		}
+	}
+
+	stacks := sampleStacks(r.Context().Done(), time.Duration(seconds)*time.Second)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	writeFolded(w, stacks)
+}
+
+// sampleStacks counts the stacks of all goroutines, other than its own,
+// sampled fgprofSampleRate times a second for the duration, or until done is
+// closed.
+func sampleStacks(done <-chan struct{}, duration time.Duration) map[string]int {
+	stacks := map[string]int{}
+	ticker := time.NewTicker(time.Second / fgprofSampleRate)
+	defer ticker.Stop()
+	timeout := time.After(duration)
+
+	pc, _, _, _ := runtime.Caller(0)
+	self := runtime.FuncForPC(pc).Name()
+
+	var records []runtime.StackRecord
+	for {
+		// The profile can grow between sizing and taking it, so retry with
+		// room to spare.
+		n, ok := runtime.GoroutineProfile(records)
+		for !ok {
+			records = make([]runtime.StackRecord, n+n/10+10)
+			n, ok = runtime.GoroutineProfile(records)
+		}
+		for _, record := range records[:n] {
+			if stack := foldStack(record.Stack()); !strings.Contains(stack, self) {
+				stacks[stack]++
+			}
+		}
+
+		select {
+		case <-done:
+			return stacks
+		case <-timeout:
+			return stacks
+		case <-ticker.C:
+		}
+	}
+}
+
+// foldStack formats a stack outermost function first, separated by
+// semicolons.
+func foldStack(stack []uintptr) string {
+	var names []string
+	frames := runtime.CallersFrames(stack)
+	for {
+		frame, more := frames.Next()
+		if frame.Function != "" {
+			names = append(names, frame.Function)
+		}
+		if !more {
+			break
+		}
+	}
+	var buf bytes.Buffer
+	for i := len(names) - 1; i >= 0; i-- {
+		buf.WriteString(names[i])
+		if i > 0 {
+			buf.WriteByte(';')
+		}
+	}
+	return buf.String()
+}
+
+// writeFolded writes each stack and its count on a line, as flame graph tools
+// read.
+func writeFolded(w io.Writer, stacks map[string]int) {
+	folded := make([]string, 0, len(stacks))
+	for stack := range stacks {
+		folded = append(folded, stack)
+	}
+	sort.Strings(folded)
+	for _, stack := range folded {
+		fmt.Fprintf(w, "%s %d\n", stack, stacks[stack])
+	}
+}
+
+// dumpGoroutinesOnSignal writes the stacks of all goroutines whenever the
+// process gets a SIGUSR1, until quit is closed. Unlike on SIGQUIT, the dump
+// isn't truncated.
+func dumpGoroutinesOnSignal(dir string, quit <-chan struct{}) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGUSR1)
+	defer signal.Stop(sigs)
+	for {
+		select {
+		case <-quit:
+			return
+		case <-sigs:
+			if err := dumpGoroutines(dir, time.Now()); err != nil {
+				log.Errorf("Error dumping goroutines: %v", err)
+			}
+		}
+	}
+}
+
+// dumpGoroutines writes the stacks of all goroutines to a file named for the
+// time in the directory, or to stderr if it's empty.
+func dumpGoroutines(dir string, now time.Time) error {
+	if dir == "" {
+		return runtime_pprof.Lookup("goroutine").WriteTo(os.Stderr, 2)
+	}
+	filename := filepath.Join(dir, fmt.Sprintf("goroutines-%s.txt", now.UTC().Format("20060102T150405.000")))
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	if err := runtime_pprof.Lookup("goroutine").WriteTo(f, 2); err != nil {
+		f.Close()
+		return err
+	}
+	log.Infof("Dumped goroutines to %s", filename)
+	return f.Close()
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func blockedOnChannel(c chan struct{}) {
+	<-c
+}
+
+func TestFgprof(t *testing.T) {
+	router := mux.NewRouter()
+	registerDebug(DebugConfig{Fgprof: true}, router)
+
+	// Goroutines off CPU are sampled too.
+	c := make(chan struct{})
+	defer close(c)
+	go blockedOnChannel(c)
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest("GET", "/debug/fgprof?seconds=1", nil))
+	require.Equal(t, http.StatusOK, recorder.Code)
+
+	var found bool
+	for _, line := range strings.Split(strings.TrimSpace(recorder.Body.String()), "\n") {
+		assert.NotContains(t, line, "sampleStacks")
+		if strings.Contains(line, "server.blockedOnChannel;") {
+			found = true
+		}
+	}
+	assert.True(t, found, recorder.Body.String())
+
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest("GET", "/debug/fgprof?seconds=-1", nil))
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+
+	// It is only served if enabled, unlike pprof.
+	router = mux.NewRouter()
+	registerDebug(DebugConfig{}, router)
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest("GET", "/debug/fgprof", nil))
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest("GET", "/debug/pprof/goroutine?debug=1", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), "goroutine profile")
+}
+
+func TestDumpGoroutines(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goroutines")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	require.NoError(t, dumpGoroutines(dir, time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)))
+	dump, err := ioutil.ReadFile(filepath.Join(dir, "goroutines-20170601T120000.000.txt"))
+	require.NoError(t, err)
+	assert.Contains(t, string(dump), "TestDumpGoroutines")
+}
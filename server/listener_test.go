@@ -0,0 +1,62 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLimitListener(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	l := newLimitListener(inner, 1)
+	defer l.Close()
+
+	accepted := make(chan net.Conn, 2)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- c
+		}
+	}()
+
+	for i := 0; i < 2; i++ {
+		c, err := net.Dial("tcp", inner.Addr().String())
+		require.NoError(t, err)
+		defer c.Close()
+	}
+
+	// Only the first connection is accepted until it is closed.
+	first := <-accepted
+	select {
+	case <-accepted:
+		t.Fatal("accepted a connection over the limit")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	require.NoError(t, first.Close())
+	// Closing twice mustn't release the limit twice.
+	first.Close()
+	select {
+	case c := <-accepted:
+		c.Close()
+	case <-time.After(time.Second):
+		t.Fatal("connection not accepted after another was closed")
+	}
+	assert.Len(t, accepted, 0)
+}
+
+func TestTLSConfigDisabled(t *testing.T) {
+	tlsConfig, err := TLSConfig{}.TLS()
+	require.NoError(t, err)
+	assert.Nil(t, tlsConfig)
+
+	_, err = TLSConfig{CertPath: "/nonexistent/cert.pem", KeyPath: "/nonexistent/key.pem"}.TLS()
+	assert.Error(t, err)
+}
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+
+	"github.com/weaveworks/cortex/util"
+)
+
+// logRequests is HTTP middleware which logs each request's method, path,
+// response code, duration and request ID, like the weaveworks/common Log
+// middleware.
+type logRequests struct{}
+
+// Wrap implements middleware.Interface.
+func (logRequests) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		begin := time.Now()
+		uri := r.RequestURI // capture the URI before running next, as it may get rewritten
+		i := &interceptor{ResponseWriter: w, statusCode: http.StatusOK}
+		next.ServeHTTP(i, r)
+		entry := log.WithField("request_id", util.ExtractRequestID(r.Context()))
+		if 100 <= i.statusCode && i.statusCode < 400 {
+			entry.Debugf("%s %s (%d) %s", r.Method, uri, i.statusCode, time.Since(begin))
+		} else {
+			entry.Warnf("%s %s (%d) %s", r.Method, uri, i.statusCode, time.Since(begin))
+		}
+	})
+}
+
+// interceptor records the status code written, and lets handlers hijack the
+// connection for websockets.
+type interceptor struct {
+	http.ResponseWriter
+	statusCode int
+	recorded   bool
+}
+
+func (i *interceptor) WriteHeader(code int) {
+	if !i.recorded {
+		i.statusCode = code
+		i.recorded = true
+	}
+	i.ResponseWriter.WriteHeader(code)
+}
+
+func (i *interceptor) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := i.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("interceptor: can't cast parent ResponseWriter to Hijacker")
+	}
+	return hj.Hijack()
+}
+
+// serverLoggingInterceptor logs gRPC requests, errors, latency and request ID.
+func serverLoggingInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	begin := time.Now()
+	resp, err := handler(ctx, req)
+	entry := log.WithField("request_id", util.ExtractRequestID(ctx))
+	if err != nil {
+		entry.Debugf("gRPC %s (%v) %s", info.FullMethod, err, time.Since(begin))
+	} else {
+		entry.Infof("gRPC %s (success) %s", info.FullMethod, time.Since(begin))
+	}
+	return resp, err
+}
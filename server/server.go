@@ -0,0 +1,315 @@
+package server
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+	"github.com/grpc-ecosystem/grpc-opentracing/go/otgrpc"
+	"github.com/mwitkow/go-grpc-middleware"
+	"github.com/opentracing-contrib/go-stdlib/nethttp"
+	"github.com/opentracing/opentracing-go"
+	"github.com/openzipkin/zipkin-go-opentracing"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/version"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+
+	"github.com/weaveworks-experiments/loki/pkg/client"
+	"github.com/weaveworks/common/httpgrpc"
+	"github.com/weaveworks/common/middleware"
+	"github.com/weaveworks/common/signals"
+	"github.com/weaveworks/cortex/util"
+)
+
+// The traces served on /traces; enough for a service doing 100 QPS with a
+// 15s scrape interval.
+var traceCollector = loki.NewCollector(15 * 100)
+
+func init() {
+	hostname, err := os.Hostname()
+	if err != nil {
+		panic(fmt.Sprintf("Failed to create tracer: %v", err))
+	}
+	// Sampling of some traces, eg. pushes, is deferred until it's known
+	// whether they failed or were slow.
+	util.TraceSampler = util.NewDeferredSampler(zipkintracer.NewRecorder(traceCollector, false, hostname, ""))
+	tracer, err := zipkintracer.NewTracer(util.TraceSampler)
+	if err != nil {
+		panic(fmt.Sprintf("Failed to create tracer: %v", err))
+	}
+	opentracing.InitGlobalTracer(tracer)
+}
+
+// Config for a Server. It is a superset of the weaveworks/common server's
+// config, with the same flags, adding TLS and connection limits for each of
+// the HTTP and gRPC listeners.
+type Config struct {
+	MetricsNamespace string
+	HTTPListenPort   int
+	GRPCListenPort   int
+	GRPCListenSocket string
+
+	ServerGracefulShutdownTimeout time.Duration
+	HTTPServerReadTimeout         time.Duration
+	HTTPServerWriteTimeout        time.Duration
+	HTTPServerIdleTimeout         time.Duration
+
+	HTTPTLSConfig TLSConfig
+	GRPCTLSConfig TLSConfig
+
+	HTTPConnLimit            int
+	GRPCConnLimit            int
+	GRPCMaxConcurrentStreams uint
+	GRPCMaxMsgSize           int
+
+	Debug DebugConfig
+
+	GRPCMiddleware []grpc.UnaryServerInterceptor
+	HTTPMiddleware []middleware.Interface
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet
+func (cfg *Config) RegisterFlags(f *flag.FlagSet) {
+	f.IntVar(&cfg.HTTPListenPort, "server.http-listen-port", 80, "HTTP server listen port.")
+	f.IntVar(&cfg.GRPCListenPort, "server.grpc-listen-port", 9095, "gRPC server listen port.")
+	f.StringVar(&cfg.GRPCListenSocket, "server.grpc-listen-socket", "", "Path of a unix socket the gRPC server also listens on, eg. for distributors on the same host. Ingesters register it in the ring instead of their IP and port.")
+	f.DurationVar(&cfg.ServerGracefulShutdownTimeout, "server.graceful-shutdown-timeout", 5*time.Second, "Timeout for graceful shutdowns")
+	f.DurationVar(&cfg.HTTPServerReadTimeout, "server.http-read-timeout", 5*time.Second, "Read timeout for HTTP server")
+	f.DurationVar(&cfg.HTTPServerWriteTimeout, "server.http-write-timeout", 5*time.Second, "Write timeout for HTTP server")
+	f.DurationVar(&cfg.HTTPServerIdleTimeout, "server.http-idle-timeout", 120*time.Second, "Idle timeout for HTTP server")
+	cfg.HTTPTLSConfig.registerFlags(f, "server.http-tls")
+	cfg.GRPCTLSConfig.registerFlags(f, "server.grpc-tls")
+	f.IntVar(&cfg.HTTPConnLimit, "server.http-conn-limit", 0, "Maximum number of simultaneous HTTP connections. 0 for no limit.")
+	f.IntVar(&cfg.GRPCConnLimit, "server.grpc-conn-limit", 0, "Maximum number of simultaneous gRPC connections. 0 for no limit.")
+	f.UintVar(&cfg.GRPCMaxConcurrentStreams, "server.grpc-max-concurrent-streams", 0, "Maximum number of concurrent streams on each gRPC connection. 0 for gRPC's default.")
+	f.IntVar(&cfg.GRPCMaxMsgSize, "server.grpc-max-msg-size", 0, "Maximum size in bytes of gRPC messages the server will receive. 0 for gRPC's default.")
+	cfg.Debug.registerFlags(f)
+}
+
+// TLSConfig configures TLS for a listener.
+type TLSConfig struct {
+	CertPath     string
+	KeyPath      string
+	ClientCAPath string
+	TenantFrom   string
+}
+
+func (cfg *TLSConfig) registerFlags(f *flag.FlagSet, prefix string) {
+	f.StringVar(&cfg.CertPath, prefix+"-cert-path", "", "Path to the server certificate, to serve TLS. Plaintext if empty.")
+	f.StringVar(&cfg.KeyPath, prefix+"-key-path", "", "Path to the server certificate's private key.")
+	f.StringVar(&cfg.ClientCAPath, prefix+"-client-ca-path", "", "Path to the CA certificates clients must present certificates signed by. If empty, client certificates aren't required.")
+	f.StringVar(&cfg.TenantFrom, prefix+"-tenant-from", tenantFromHeader, "Take the tenant of requests from their client certificate's first DNS subject alternative name (san) or organizational unit (ou), instead of the X-Scope-OrgID header. Requires client certificates.")
+}
+
+// TLS returns the crypto/tls config, or nil if TLS isn't configured.
+func (cfg TLSConfig) TLS() (*tls.Config, error) {
+	if cfg.CertPath == "" {
+		if cfg.TenantFrom != tenantFromHeader {
+			return nil, fmt.Errorf("the tenant can only be taken from client certificates with TLS")
+		}
+		return nil, nil
+	}
+	if err := validateTenantFrom(cfg); err != nil {
+		return nil, err
+	}
+	cert, err := tls.LoadX509KeyPair(cfg.CertPath, cfg.KeyPath)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	}
+	if cfg.ClientCAPath != "" {
+		pool, err := loadCertPool(cfg.ClientCAPath)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
+
+// Server wraps a HTTP and gRPC server, and some common initialization.
+//
+// Servers will be automatically instrumented for Prometheus metrics
+// and Loki tracing.  HTTP over gRPC
+type Server struct {
+	cfg          Config
+	handler      *signals.Handler
+	httpListener net.Listener
+	grpcListener net.Listener
+	unixListener net.Listener
+	httpServer   *http.Server
+	quit         chan struct{}
+
+	HTTP *mux.Router
+	GRPC *grpc.Server
+}
+
+// New makes a new Server
+func New(cfg Config) (*Server, error) {
+	httpTLS, err := cfg.HTTPTLSConfig.TLS()
+	if err != nil {
+		return nil, fmt.Errorf("error loading HTTP TLS config: %v", err)
+	}
+	grpcTLS, err := cfg.GRPCTLSConfig.TLS()
+	if err != nil {
+		return nil, fmt.Errorf("error loading gRPC TLS config: %v", err)
+	}
+
+	// Setup listeners first, so we can fail early if the port is in use.
+	httpListener, err := net.Listen("tcp", fmt.Sprintf(":%d", cfg.HTTPListenPort))
+	if err != nil {
+		return nil, err
+	}
+	if cfg.HTTPConnLimit > 0 {
+		httpListener = newLimitListener(httpListener, cfg.HTTPConnLimit)
+	}
+	if httpTLS != nil {
+		httpListener = tls.NewListener(httpListener, httpTLS)
+	}
+
+	grpcListener, err := net.Listen("tcp", fmt.Sprintf(":%d", cfg.GRPCListenPort))
+	if err != nil {
+		httpListener.Close()
+		return nil, err
+	}
+	if cfg.GRPCConnLimit > 0 {
+		grpcListener = newLimitListener(grpcListener, cfg.GRPCConnLimit)
+	}
+
+	var unixListener net.Listener
+	if cfg.GRPCListenSocket != "" {
+		// A socket left behind by a previous run would fail the listen.
+		os.Remove(cfg.GRPCListenSocket)
+		unixListener, err = net.Listen("unix", cfg.GRPCListenSocket)
+		if err != nil {
+			httpListener.Close()
+			grpcListener.Close()
+			return nil, err
+		}
+	}
+
+	// Prometheus histograms for requests.
+	requestDuration := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: cfg.MetricsNamespace,
+		Name:      "request_duration_seconds",
+		Help:      "Time (in seconds) spent serving HTTP requests.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route", "status_code", "ws"})
+	prometheus.MustRegister(requestDuration)
+	prometheus.MustRegister(version.NewCollector(cfg.MetricsNamespace))
+	prometheus.MustRegister(util.NewFeatureCollector(flag.CommandLine))
+
+	// Setup gRPC server
+	grpcMiddleware := []grpc.UnaryServerInterceptor{
+		util.ServerRequestIDInterceptor,
+		serverLoggingInterceptor,
+		middleware.ServerInstrumentInterceptor(requestDuration),
+		otgrpc.OpenTracingServerInterceptor(opentracing.GlobalTracer()),
+	}
+	if cfg.GRPCTLSConfig.TenantFrom != tenantFromHeader {
+		grpcMiddleware = append(grpcMiddleware, certTenantInterceptor(cfg.GRPCTLSConfig.TenantFrom))
+	}
+	grpcMiddleware = append(grpcMiddleware, cfg.GRPCMiddleware...)
+	grpcOptions := []grpc.ServerOption{
+		grpc.UnaryInterceptor(grpc_middleware.ChainUnaryServer(
+			grpcMiddleware...,
+		)),
+	}
+	if grpcTLS != nil {
+		grpcOptions = append(grpcOptions, grpc.Creds(credentials.NewTLS(grpcTLS)))
+	}
+	if cfg.GRPCMaxConcurrentStreams > 0 {
+		grpcOptions = append(grpcOptions, grpc.MaxConcurrentStreams(uint32(cfg.GRPCMaxConcurrentStreams)))
+	}
+	if cfg.GRPCMaxMsgSize > 0 {
+		grpcOptions = append(grpcOptions, grpc.MaxMsgSize(cfg.GRPCMaxMsgSize))
+	}
+	grpcServer := grpc.NewServer(grpcOptions...)
+
+	// Setup HTTP server
+	router := mux.NewRouter()
+	router.Handle("/metrics", prometheus.Handler())
+	router.Handle("/traces", traceCollector)
+	router.Handle("/config", util.ConfigHandler(flag.CommandLine))
+	router.HandleFunc("/build_info", util.BuildInfoHandler)
+	registerDebug(cfg.Debug, router)
+	httpMiddleware := []middleware.Interface{
+		util.RequestID{},
+		logRequests{},
+		middleware.Instrument{
+			Duration:     requestDuration,
+			RouteMatcher: router,
+		},
+		middleware.Func(func(handler http.Handler) http.Handler {
+			return nethttp.Middleware(opentracing.GlobalTracer(), handler)
+		}),
+	}
+	if cfg.HTTPTLSConfig.TenantFrom != tenantFromHeader {
+		httpMiddleware = append(httpMiddleware, certTenant{from: cfg.HTTPTLSConfig.TenantFrom})
+	}
+	httpMiddleware = append(httpMiddleware, cfg.HTTPMiddleware...)
+	httpServer := &http.Server{
+		ReadTimeout:  cfg.HTTPServerReadTimeout,
+		WriteTimeout: cfg.HTTPServerWriteTimeout,
+		IdleTimeout:  cfg.HTTPServerIdleTimeout,
+		Handler:      middleware.Merge(httpMiddleware...).Wrap(router),
+	}
+
+	return &Server{
+		cfg:          cfg,
+		httpListener: httpListener,
+		grpcListener: grpcListener,
+		unixListener: unixListener,
+		httpServer:   httpServer,
+		handler:      signals.NewHandler(log.StandardLogger()),
+		quit:         make(chan struct{}),
+
+		HTTP: router,
+		GRPC: grpcServer,
+	}, nil
+}
+
+// Run the server; blocks until SIGTERM is received.
+func (s *Server) Run() {
+	go s.httpServer.Serve(s.httpListener)
+
+	// Setup gRPC server
+	// for HTTP over gRPC, ensure we don't double-count the middleware
+	httpgrpc.RegisterHTTPServer(s.GRPC, httpgrpc.NewServer(s.HTTP))
+	go s.GRPC.Serve(s.grpcListener)
+	if s.unixListener != nil {
+		go s.GRPC.Serve(s.unixListener)
+	}
+	defer s.GRPC.GracefulStop()
+
+	go dumpGoroutinesOnSignal(s.cfg.Debug.GoroutineDumpDir, s.quit)
+	defer close(s.quit)
+
+	// Wait for a signal
+	s.handler.Loop()
+}
+
+// Stop unblocks Run().
+func (s *Server) Stop() {
+	s.handler.Stop()
+}
+
+// Shutdown the server, gracefully.  Should be defered after New().
+func (s *Server) Shutdown() {
+	ctx, cancel := context.WithTimeout(context.Background(), s.cfg.ServerGracefulShutdownTimeout)
+	defer cancel() // releases resources if httpServer.Shutdown completes before timeout elapses
+
+	s.httpServer.Shutdown(ctx)
+	s.GRPC.Stop()
+}
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net/http"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+
+	"github.com/weaveworks/common/httpgrpc"
+)
+
+// The header the tenant is read from, which is set from client certificates
+// on listeners configured to take the tenant from them.
+const (
+	orgIDHeaderName      = "X-Scope-OrgID"
+	lowerOrgIDHeaderName = "x-scope-orgid"
+)
+
+// Where the tenant of requests on a listener comes from.
+const (
+	tenantFromHeader = ""
+	tenantFromSAN    = "san"
+	tenantFromOU     = "ou"
+)
+
+func validateTenantFrom(cfg TLSConfig) error {
+	switch cfg.TenantFrom {
+	case tenantFromHeader:
+		return nil
+	case tenantFromSAN, tenantFromOU:
+		if cfg.ClientCAPath == "" {
+			return fmt.Errorf("the tenant can only be taken from client certificates when they are required")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown tenant source %q", cfg.TenantFrom)
+	}
+}
+
+// tenantFromCert returns the tenant of a client certificate: its first DNS
+// subject alternative name, or its first organizational unit.
+func tenantFromCert(cert *x509.Certificate, from string) (string, error) {
+	switch from {
+	case tenantFromSAN:
+		if len(cert.DNSNames) > 0 {
+			return cert.DNSNames[0], nil
+		}
+	case tenantFromOU:
+		if len(cert.Subject.OrganizationalUnit) > 0 {
+			return cert.Subject.OrganizationalUnit[0], nil
+		}
+	}
+	return "", fmt.Errorf("client certificate %q has no tenant in its %s", cert.Subject.CommonName, from)
+}
+
+// certTenant is HTTP middleware setting the tenant header of requests from
+// their client certificate, replacing any the client sent.
+type certTenant struct {
+	from string
+}
+
+// Wrap implements middleware.Interface.
+func (c certTenant) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+			http.Error(w, "no client certificate", http.StatusUnauthorized)
+			return
+		}
+		tenant, err := tenantFromCert(r.TLS.PeerCertificates[0], c.from)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		r.Header.Set(orgIDHeaderName, tenant)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// certTenantInterceptor returns a gRPC interceptor setting the tenant metadata
+// of requests from their client certificate, replacing any the client sent,
+// as well as the tenant header of HTTP requests sent over gRPC.
+func certTenantInterceptor(from string) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		p, ok := peer.FromContext(ctx)
+		if !ok {
+			return nil, grpc.Errorf(codes.Unauthenticated, "no client certificate")
+		}
+		tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
+		if !ok || len(tlsInfo.State.PeerCertificates) == 0 {
+			return nil, grpc.Errorf(codes.Unauthenticated, "no client certificate")
+		}
+		tenant, err := tenantFromCert(tlsInfo.State.PeerCertificates[0], from)
+		if err != nil {
+			return nil, grpc.Errorf(codes.Unauthenticated, "%v", err)
+		}
+
+		md, ok := metadata.FromContext(ctx)
+		if ok {
+			md = md.Copy()
+		} else {
+			md = metadata.MD{}
+		}
+		md[lowerOrgIDHeaderName] = []string{tenant}
+		ctx = metadata.NewContext(ctx, md)
+
+		if httpReq, ok := req.(*httpgrpc.HTTPRequest); ok {
+			headers := []*httpgrpc.Header{{Key: orgIDHeaderName, Values: []string{tenant}}}
+			for _, h := range httpReq.Headers {
+				if http.CanonicalHeaderKey(h.Key) != http.CanonicalHeaderKey(orgIDHeaderName) {
+					headers = append(headers, h)
+				}
+			}
+			httpReq.Headers = headers
+		}
+		return handler(ctx, req)
+	}
+}
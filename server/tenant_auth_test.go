@@ -0,0 +1,94 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+
+	"github.com/weaveworks/common/httpgrpc"
+	"github.com/weaveworks/common/user"
+)
+
+var tenantCert = &x509.Certificate{
+	Subject:  pkix.Name{CommonName: "client", OrganizationalUnit: []string{"team-a"}},
+	DNSNames: []string{"tenant-1.example.com"},
+}
+
+func TestTenantFromCert(t *testing.T) {
+	tenant, err := tenantFromCert(tenantCert, tenantFromSAN)
+	require.NoError(t, err)
+	assert.Equal(t, "tenant-1.example.com", tenant)
+
+	tenant, err = tenantFromCert(tenantCert, tenantFromOU)
+	require.NoError(t, err)
+	assert.Equal(t, "team-a", tenant)
+
+	_, err = tenantFromCert(&x509.Certificate{}, tenantFromOU)
+	assert.Error(t, err)
+
+	assert.Error(t, validateTenantFrom(TLSConfig{TenantFrom: tenantFromSAN}))
+	assert.Error(t, validateTenantFrom(TLSConfig{TenantFrom: "cn", ClientCAPath: "ca.pem"}))
+	assert.NoError(t, validateTenantFrom(TLSConfig{TenantFrom: tenantFromOU, ClientCAPath: "ca.pem"}))
+}
+
+func TestCertTenant(t *testing.T) {
+	var tenant string
+	handler := certTenant{from: tenantFromOU}.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tenant = r.Header.Get(orgIDHeaderName)
+	}))
+
+	// The client's header is replaced with the certificate's tenant.
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set(orgIDHeaderName, "spoofed")
+	r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{tenantCert}}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "team-a", tenant)
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestCertTenantInterceptor(t *testing.T) {
+	interceptor := certTenantInterceptor(tenantFromSAN)
+	ctx := metadata.NewContext(context.Background(), metadata.MD{lowerOrgIDHeaderName: []string{"spoofed"}})
+	req := &httpgrpc.HTTPRequest{Headers: []*httpgrpc.Header{
+		{Key: "X-Scope-Orgid", Values: []string{"spoofed"}},
+		{Key: "Accept", Values: []string{"*/*"}},
+	}}
+
+	_, err := interceptor(ctx, req, nil, func(context.Context, interface{}) (interface{}, error) {
+		t.Fatal("handler called without a client certificate")
+		return nil, nil
+	})
+	assert.Equal(t, codes.Unauthenticated, grpc.Code(err))
+
+	ctx = peer.NewContext(ctx, &peer.Peer{AuthInfo: credentials.TLSInfo{
+		State: tls.ConnectionState{PeerCertificates: []*x509.Certificate{tenantCert}},
+	}})
+	_, err = interceptor(ctx, req, nil, func(ctx context.Context, req interface{}) (interface{}, error) {
+		userID, _, err := user.ExtractFromGRPCRequest(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, "tenant-1.example.com", userID)
+		return nil, nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []*httpgrpc.Header{
+		{Key: orgIDHeaderName, Values: []string{"tenant-1.example.com"}},
+		{Key: "Accept", Values: []string{"*/*"}},
+	}, req.Headers)
+}
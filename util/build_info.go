@@ -0,0 +1,118 @@
+package util
+
+import (
+	"encoding/json"
+	"flag"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/version"
+	"gopkg.in/yaml.v2"
+)
+
+const redactedValue = "<redacted>"
+
+// ConfigHandler serves the values of the flags of fs, after loading any config
+// file, as YAML in the format of -print-config. The values of flags named as
+// passwords or secrets, and the passwords of URLs, are redacted.
+func ConfigHandler(fs *flag.FlagSet) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		values := flagValues(fs)
+		for name, value := range values {
+			values[name] = redactFlagValue(name, value)
+		}
+		buf, err := yaml.Marshal(values)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/yaml")
+		w.Write(buf)
+	})
+}
+
+func redactFlagValue(name, value string) string {
+	if value == "" {
+		return value
+	}
+	lower := strings.ToLower(name)
+	if strings.Contains(lower, "password") || strings.Contains(lower, "secret") {
+		return redactedValue
+	}
+	// Eg. the S3 URLs of the chunk store hold their credentials.
+	if u, err := url.Parse(value); err == nil && u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), redactedValue)
+			return u.String()
+		}
+	}
+	return value
+}
+
+// BuildInfo is the version of the running binary, as served on /build_info.
+type BuildInfo struct {
+	Version   string `json:"version"`
+	Revision  string `json:"revision"`
+	Branch    string `json:"branch"`
+	BuildUser string `json:"buildUser"`
+	BuildDate string `json:"buildDate"`
+	GoVersion string `json:"goVersion"`
+}
+
+// BuildInfoHandler serves the version the binary was built with, as JSON.
+func BuildInfoHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(BuildInfo{
+		Version:   version.Version,
+		Revision:  version.Revision,
+		Branch:    version.Branch,
+		BuildUser: version.BuildUser,
+		BuildDate: version.BuildDate,
+		GoVersion: version.GoVersion,
+	})
+}
+
+var featureEnabledDesc = prometheus.NewDesc(
+	"cortex_feature_enabled",
+	"Whether each boolean flag, enabling a feature, is set: 1 if it is, 0 if not.",
+	[]string{"feature"}, nil,
+)
+
+// featureCollector exports the boolean flags of a FlagSet as
+// cortex_feature_enabled, so which features each process has enabled can be
+// compared in Prometheus.
+type featureCollector struct {
+	fs *flag.FlagSet
+}
+
+// NewFeatureCollector makes a prometheus.Collector of the boolean flags of fs.
+func NewFeatureCollector(fs *flag.FlagSet) prometheus.Collector {
+	return featureCollector{fs: fs}
+}
+
+// Describe implements prometheus.Collector.
+func (c featureCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- featureEnabledDesc
+}
+
+// Collect implements prometheus.Collector.
+func (c featureCollector) Collect(ch chan<- prometheus.Metric) {
+	c.fs.VisitAll(func(f *flag.Flag) {
+		switch f.Name {
+		case configFileFlag, printConfigFlag, validateConfigFlag:
+			return
+		}
+		if b, ok := f.Value.(interface {
+			IsBoolFlag() bool
+		}); !ok || !b.IsBoolFlag() {
+			return
+		}
+		var enabled float64
+		if f.Value.String() == "true" {
+			enabled = 1
+		}
+		ch <- prometheus.MustNewConstMetric(featureEnabledDesc, prometheus.GaugeValue, enabled, f.Name)
+	})
+}
@@ -0,0 +1,65 @@
+package util
+
+import (
+	"flag"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v2"
+)
+
+func TestConfigHandler(t *testing.T) {
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	fs.String("s3.url", "s3://key:secret@eu-west-1/bucket", "")
+	fs.String("memcached.hostname", "memcached", "")
+	fs.String("alertmanager.web.password", "hunter2", "")
+	fs.String("consul.secret", "", "")
+
+	rec := httptest.NewRecorder()
+	ConfigHandler(fs).ServeHTTP(rec, httptest.NewRequest("GET", "/config", nil))
+
+	var config map[string]string
+	require.NoError(t, yaml.Unmarshal(rec.Body.Bytes(), &config))
+	assert.Equal(t, map[string]string{
+		"s3.url":                    "s3://key:%3Credacted%3E@eu-west-1/bucket",
+		"memcached.hostname":        "memcached",
+		"alertmanager.web.password": redactedValue,
+		"consul.secret":             "",
+	}, config)
+}
+
+func TestFeatureCollector(t *testing.T) {
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	fs.Bool("ingester.spread-flushes", false, "")
+	fs.Bool("distributor.zone-awareness-enabled", false, "")
+	fs.Int("distributor.replication-factor", 3, "")
+	require.NoError(t, fs.Parse([]string{"-distributor.zone-awareness-enabled"}))
+
+	reg := prometheus.NewRegistry()
+	require.NoError(t, reg.Register(NewFeatureCollector(fs)))
+	families, err := reg.Gather()
+	require.NoError(t, err)
+	require.Len(t, families, 1)
+
+	enabled := map[string]float64{}
+	for _, m := range families[0].Metric {
+		enabled[labelValue(m, "feature")] = m.GetGauge().GetValue()
+	}
+	assert.Equal(t, map[string]float64{
+		"ingester.spread-flushes":            0,
+		"distributor.zone-awareness-enabled": 1,
+	}, enabled)
+}
+
+func labelValue(m *dto.Metric, name string) string {
+	for _, l := range m.Label {
+		if l.GetName() == name {
+			return l.GetValue()
+		}
+	}
+	return ""
+}
@@ -16,7 +16,7 @@ func FromWriteRequest(req *cortex.WriteRequest) []model.Sample {
 	for _, ts := range req.Timeseries {
 		for _, s := range ts.Samples {
 			samples = append(samples, model.Sample{
-				Metric:    fromLabelPairs(ts.Labels),
+				Metric:    FromLabelPairs(ts.Labels),
 				Value:     model.SampleValue(s.Value),
 				Timestamp: model.Time(s.TimestampMs),
 			})
@@ -91,12 +91,60 @@ func ToQueryResponse(matrix model.Matrix) *cortex.QueryResponse {
 	return resp
 }
 
-// FromQueryResponse unpacks a QueryResponse proto.
-func FromQueryResponse(resp *cortex.QueryResponse) model.Matrix {
-	m := make(model.Matrix, 0, len(resp.Timeseries))
+// ToColumnarQueryResponse builds a QueryResponse proto with the series in
+// columnar form.
+func ToColumnarQueryResponse(matrix model.Matrix) *cortex.QueryResponse {
+	resp := &cortex.QueryResponse{
+		ColumnarTimeseries: make([]cortex.ColumnarTimeSeries, 0, len(matrix)),
+	}
+	for _, ss := range matrix {
+		ts := cortex.ColumnarTimeSeries{
+			Labels:       toLabelPairs(ss.Metric),
+			TimestampsMs: make([]int64, 0, len(ss.Values)),
+			Values:       make([]float64, 0, len(ss.Values)),
+		}
+		for _, s := range ss.Values {
+			ts.TimestampsMs = append(ts.TimestampsMs, int64(s.Timestamp))
+			ts.Values = append(ts.Values, float64(s.Value))
+		}
+		resp.ColumnarTimeseries = append(resp.ColumnarTimeseries, ts)
+	}
+	return resp
+}
+
+// ValidateColumnarTimeSeries returns an error if a columnar series doesn't
+// have a value for each timestamp, in which case there is no way to tell which
+// are missing.
+func ValidateColumnarTimeSeries(ts *cortex.ColumnarTimeSeries) error {
+	if len(ts.TimestampsMs) != len(ts.Values) {
+		return fmt.Errorf("malformed series %v: %d timestamps but %d values", FromLabelPairs(ts.Labels), len(ts.TimestampsMs), len(ts.Values))
+	}
+	return nil
+}
+
+// FromQueryResponse unpacks a QueryResponse proto, with the series in either
+// form.
+func FromQueryResponse(resp *cortex.QueryResponse) (model.Matrix, error) {
+	m := make(model.Matrix, 0, len(resp.Timeseries)+len(resp.ColumnarTimeseries))
+	for _, ts := range resp.ColumnarTimeseries {
+		if err := ValidateColumnarTimeSeries(&ts); err != nil {
+			return nil, err
+		}
+		ss := model.SampleStream{
+			Metric: FromLabelPairs(ts.Labels),
+			Values: make([]model.SamplePair, len(ts.TimestampsMs)),
+		}
+		for i, t := range ts.TimestampsMs {
+			ss.Values[i] = model.SamplePair{
+				Timestamp: model.Time(t),
+				Value:     model.SampleValue(ts.Values[i]),
+			}
+		}
+		m = append(m, &ss)
+	}
 	for _, ts := range resp.Timeseries {
 		var ss model.SampleStream
-		ss.Metric = fromLabelPairs(ts.Labels)
+		ss.Metric = FromLabelPairs(ts.Labels)
 		ss.Values = make([]model.SamplePair, 0, len(ts.Samples))
 		for _, s := range ts.Samples {
 			ss.Values = append(ss.Values, model.SamplePair{
@@ -107,7 +155,7 @@ func FromQueryResponse(resp *cortex.QueryResponse) model.Matrix {
 		m = append(m, &ss)
 	}
 
-	return m
+	return m, nil
 }
 
 // ToMetricsForLabelMatchersRequest builds a MetricsForLabelMatchersRequest proto
@@ -162,7 +210,7 @@ func ToMetricsForLabelMatchersResponse(metrics []model.Metric) *cortex.MetricsFo
 func FromMetricsForLabelMatchersResponse(resp *cortex.MetricsForLabelMatchersResponse) []model.Metric {
 	metrics := []model.Metric{}
 	for _, m := range resp.Metric {
-		metrics = append(metrics, fromLabelPairs(m.Labels))
+		metrics = append(metrics, FromLabelPairs(m.Labels))
 	}
 	return metrics
 }
@@ -228,7 +276,8 @@ func toLabelPairs(metric model.Metric) []cortex.LabelPair {
 	return labelPairs
 }
 
-func fromLabelPairs(labelPairs []cortex.LabelPair) model.Metric {
+// FromLabelPairs converts the labels of a series to a model.Metric.
+func FromLabelPairs(labelPairs []cortex.LabelPair) model.Metric {
 	metric := make(model.Metric, len(labelPairs))
 	for _, l := range labelPairs {
 		metric[model.LabelName(l.Name)] = model.LabelValue(l.Value)
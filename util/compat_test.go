@@ -9,6 +9,8 @@ import (
 	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/storage/metric"
 	"github.com/weaveworks/common/test"
+
+	"github.com/weaveworks/cortex"
 )
 
 func TestWriteRequest(t *testing.T) {
@@ -103,9 +105,62 @@ func buildTestMatrix(numSeries int, samplesPerSeries int, offset int) model.Matr
 
 func TestQueryResponse(t *testing.T) {
 	want := buildTestMatrix(10, 10, 10)
-	have := FromQueryResponse(ToQueryResponse(want))
+	have, err := FromQueryResponse(ToQueryResponse(want))
+	if err != nil {
+		t.Fatal(err)
+	}
 	if !reflect.DeepEqual(have, want) {
 		t.Fatalf("Bad FromQueryResponse(ToQueryResponse) round trip")
 	}
 
 }
+
+func TestColumnarQueryResponse(t *testing.T) {
+	want := buildTestMatrix(10, 10, 10)
+	buf, err := ToColumnarQueryResponse(want).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resp cortex.QueryResponse
+	if err := resp.Unmarshal(buf); err != nil {
+		t.Fatal(err)
+	}
+	have, err := FromQueryResponse(&resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(have, want) {
+		t.Fatalf("Bad FromQueryResponse(ToColumnarQueryResponse) round trip")
+	}
+
+	resp.ColumnarTimeseries[0].Values = resp.ColumnarTimeseries[0].Values[1:]
+	if _, err := FromQueryResponse(&resp); err == nil {
+		t.Fatalf("Expected an error for a series with fewer values than timestamps")
+	}
+}
+
+func benchmarkQueryResponse(b *testing.B, toQueryResponse func(model.Matrix) *cortex.QueryResponse) {
+	matrix := buildTestMatrix(100, 1000, 0)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf, err := toQueryResponse(matrix).Marshal()
+		if err != nil {
+			b.Fatal(err)
+		}
+		var resp cortex.QueryResponse
+		if err := resp.Unmarshal(buf); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := FromQueryResponse(&resp); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkQueryResponse(b *testing.B) {
+	benchmarkQueryResponse(b, ToQueryResponse)
+}
+
+func BenchmarkColumnarQueryResponse(b *testing.B) {
+	benchmarkQueryResponse(b, ToColumnarQueryResponse)
+}
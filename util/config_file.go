@@ -0,0 +1,153 @@
+package util
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/common/log"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	configFileFlag     = "config.file"
+	printConfigFlag    = "print-config"
+	validateConfigFlag = "validate-config"
+)
+
+// ParseFlags parses the command line flags, as flag.Parse does, after loading
+// the YAML config file given by -config.file, if any. The file sets flags by
+// name, optionally nested by their dotted prefixes, eg:
+//
+//	distributor:
+//	  replication-factor: 3
+//	  remote-timeout: 5s
+//	consul.hostname: consul:8500
+//
+// Flags given on the command line take precedence over the file. With
+// -print-config, the resulting config is written to stdout as YAML, and with
+// -validate-config the config is only checked; both then exit.
+func ParseFlags() {
+	exit, err := parseFlags(flag.CommandLine, os.Args[1:], os.Stdout)
+	if err != nil {
+		log.Fatalf("Error loading config: %v", err)
+	}
+	if exit {
+		os.Exit(0)
+	}
+}
+
+func parseFlags(fs *flag.FlagSet, args []string, out io.Writer) (bool, error) {
+	var (
+		configFile     string
+		printConfig    bool
+		validateConfig bool
+	)
+	fs.StringVar(&configFile, configFileFlag, "", "YAML file to load config from; flags on the command line take precedence.")
+	fs.BoolVar(&printConfig, printConfigFlag, false, "Print the config, after loading the config file and flags, and exit.")
+	fs.BoolVar(&validateConfig, validateConfigFlag, false, "Validate the config file and flags, and exit.")
+	if err := fs.Parse(args); err != nil {
+		return false, err
+	}
+
+	if configFile != "" {
+		values, err := loadConfigFile(configFile)
+		if err != nil {
+			return false, err
+		}
+		set := map[string]bool{}
+		fs.Visit(func(f *flag.Flag) {
+			set[f.Name] = true
+		})
+		for _, name := range sortedKeys(values) {
+			if fs.Lookup(name) == nil {
+				return false, fmt.Errorf("unknown flag %q in config file %s", name, configFile)
+			}
+			if set[name] {
+				continue
+			}
+			if err := fs.Set(name, values[name]); err != nil {
+				return false, fmt.Errorf("invalid value %q for %s in config file %s: %v", values[name], name, configFile, err)
+			}
+		}
+	}
+
+	if printConfig {
+		buf, err := yaml.Marshal(flagValues(fs))
+		if err != nil {
+			return false, err
+		}
+		if _, err := out.Write(buf); err != nil {
+			return false, err
+		}
+	}
+	return printConfig || validateConfig, nil
+}
+
+// flagValues returns the values of the flags of fs, except those of the config
+// file itself.
+func flagValues(fs *flag.FlagSet) map[string]string {
+	values := map[string]string{}
+	fs.VisitAll(func(f *flag.Flag) {
+		switch f.Name {
+		case configFileFlag, printConfigFlag, validateConfigFlag:
+		default:
+			values[f.Name] = f.Value.String()
+		}
+	})
+	return values
+}
+
+// loadConfigFile returns the flag values set in the given config file.
+func loadConfigFile(filename string) (map[string]string, error) {
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var file map[string]interface{}
+	if err := yaml.Unmarshal(buf, &file); err != nil {
+		return nil, fmt.Errorf("error parsing config file %s: %v", filename, err)
+	}
+	values := map[string]string{}
+	for key, value := range file {
+		if err := flattenConfig(values, key, value); err != nil {
+			return nil, fmt.Errorf("error parsing config file %s: %v", filename, err)
+		}
+	}
+	return values, nil
+}
+
+func flattenConfig(values map[string]string, name string, value interface{}) error {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		for key, value := range v {
+			if err := flattenConfig(values, fmt.Sprintf("%s.%v", name, key), value); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		parts := make([]string, 0, len(v))
+		for _, part := range v {
+			parts = append(parts, fmt.Sprint(part))
+		}
+		values[name] = strings.Join(parts, ",")
+	case nil:
+		values[name] = ""
+	default:
+		values[name] = fmt.Sprint(v)
+	}
+	return nil
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,85 @@
+package util
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseFlagsConfigFile(t *testing.T) {
+	file, err := ioutil.TempFile("", "config")
+	require.NoError(t, err)
+	defer os.Remove(file.Name())
+	_, err = file.WriteString(`
+distributor:
+  replication-factor: 3
+  remote-timeout: 5s
+consul.hostname: consul:8500
+`)
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	for i, tc := range []struct {
+		args              []string
+		replicationFactor int
+		remoteTimeout     time.Duration
+		consulHostname    string
+	}{
+		{[]string{"-config.file=" + file.Name()}, 3, 5 * time.Second, "consul:8500"},
+		// Flags take precedence over the file.
+		{[]string{"-config.file=" + file.Name(), "-distributor.replication-factor=1"}, 1, 5 * time.Second, "consul:8500"},
+		{[]string{"-distributor.replication-factor=1"}, 1, time.Second, "localhost:8500"},
+	} {
+		var (
+			replicationFactor int
+			remoteTimeout     time.Duration
+			consulHostname    string
+		)
+		fs := flag.NewFlagSet("", flag.ContinueOnError)
+		fs.IntVar(&replicationFactor, "distributor.replication-factor", 2, "")
+		fs.DurationVar(&remoteTimeout, "distributor.remote-timeout", time.Second, "")
+		fs.StringVar(&consulHostname, "consul.hostname", "localhost:8500", "")
+
+		exit, err := parseFlags(fs, tc.args, ioutil.Discard)
+		require.NoError(t, err, "%d", i)
+		assert.False(t, exit, "%d", i)
+		assert.Equal(t, tc.replicationFactor, replicationFactor, "%d", i)
+		assert.Equal(t, tc.remoteTimeout, remoteTimeout, "%d", i)
+		assert.Equal(t, tc.consulHostname, consulHostname, "%d", i)
+	}
+}
+
+func TestParseFlagsPrintAndValidateConfig(t *testing.T) {
+	file, err := ioutil.TempFile("", "config")
+	require.NoError(t, err)
+	defer os.Remove(file.Name())
+	_, err = file.WriteString("unknown.flag: 1\n")
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	newFlagSet := func() *flag.FlagSet {
+		fs := flag.NewFlagSet("", flag.ContinueOnError)
+		fs.Int("distributor.replication-factor", 3, "")
+		fs.String("consul.hostname", "localhost:8500", "")
+		return fs
+	}
+
+	var out bytes.Buffer
+	exit, err := parseFlags(newFlagSet(), []string{"-print-config", "-consul.hostname=consul:8500"}, &out)
+	require.NoError(t, err)
+	assert.True(t, exit)
+	assert.Equal(t, "consul.hostname: consul:8500\ndistributor.replication-factor: \"3\"\n", out.String())
+
+	exit, err = parseFlags(newFlagSet(), []string{"-validate-config"}, ioutil.Discard)
+	require.NoError(t, err)
+	assert.True(t, exit)
+
+	_, err = parseFlags(newFlagSet(), []string{"-validate-config", "-config.file=" + file.Name()}, ioutil.Discard)
+	assert.Error(t, err)
+}
@@ -9,4 +9,8 @@ const (
 	ErrInvalidLabel              = errors.Error("sample invalid label")
 	ErrUserSeriesLimitExceeded   = errors.Error("per-user series limit exceeded")
 	ErrMetricSeriesLimitExceeded = errors.Error("per-metric series limit exceeded")
+	ErrLabelValueLimitExceeded   = errors.Error("per-metric label value limit exceeded")
+	ErrTooManyLabelNames         = errors.Error("series has too many label names")
+	ErrLabelNameTooLong          = errors.Error("label name too long")
+	ErrLabelValueTooLong         = errors.Error("label value too long")
 )
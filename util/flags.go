@@ -22,6 +22,62 @@ func RegisterFlags(rs ...Registerer) {
 	}
 }
 
+// RegisterSharedFlags registers flags with the provided Registerers, allowing
+// more than one of them to register the same flag, in which case setting it
+// sets it in all of them. This lets several components with overlapping
+// configs run in one process.
+func RegisterSharedFlags(rs ...Registerer) {
+	registerSharedFlags(flag.CommandLine, rs...)
+}
+
+func registerSharedFlags(fs *flag.FlagSet, rs ...Registerer) {
+	for _, r := range rs {
+		own := flag.NewFlagSet("", flag.ContinueOnError)
+		r.RegisterFlags(own)
+		own.VisitAll(func(f *flag.Flag) {
+			existing := fs.Lookup(f.Name)
+			if existing == nil {
+				fs.Var(f.Value, f.Name, f.Usage)
+				return
+			}
+			if shared, ok := existing.Value.(sharedValue); ok {
+				existing.Value = append(shared, f.Value)
+			} else {
+				existing.Value = sharedValue{existing.Value, f.Value}
+			}
+		})
+	}
+}
+
+// sharedValue is a flag.Value which sets all the underlying values.
+type sharedValue []flag.Value
+
+// String implements flag.Value
+func (v sharedValue) String() string {
+	if len(v) == 0 {
+		return ""
+	}
+	return v[0].String()
+}
+
+// Set implements flag.Value
+func (v sharedValue) Set(s string) error {
+	for _, value := range v {
+		if err := value.Set(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// IsBoolFlag lets shared boolean flags be set without a value.
+func (v sharedValue) IsBoolFlag() bool {
+	b, ok := v[0].(interface {
+		IsBoolFlag() bool
+	})
+	return ok && b.IsBoolFlag()
+}
+
 // DayValue is a model.Time that can be used as a flag.
 // NB it only parses days!
 type DayValue struct {
@@ -58,6 +114,15 @@ func (v *DayValue) IsSet() bool {
 	return v.set
 }
 
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (v *DayValue) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	return v.Set(s)
+}
+
 // URLValue is a url.URL that can be used as a flag.
 type URLValue struct {
 	*url.URL
@@ -0,0 +1,49 @@
+package util
+
+import (
+	"flag"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fooConfig struct {
+	Timeout time.Duration
+	Enabled bool
+	Foo     string
+}
+
+func (cfg *fooConfig) RegisterFlags(f *flag.FlagSet) {
+	f.DurationVar(&cfg.Timeout, "timeout", time.Second, "")
+	f.BoolVar(&cfg.Enabled, "enabled", false, "")
+	f.StringVar(&cfg.Foo, "foo", "foo", "")
+}
+
+type barConfig struct {
+	Timeout time.Duration
+	Enabled bool
+	Bar     string
+}
+
+func (cfg *barConfig) RegisterFlags(f *flag.FlagSet) {
+	f.DurationVar(&cfg.Timeout, "timeout", time.Second, "")
+	f.BoolVar(&cfg.Enabled, "enabled", false, "")
+	f.StringVar(&cfg.Bar, "bar", "bar", "")
+}
+
+func TestRegisterSharedFlags(t *testing.T) {
+	var (
+		foo, bar fooConfig
+		baz      barConfig
+	)
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	registerSharedFlags(fs, &foo, &bar, &baz)
+	require.NoError(t, fs.Parse([]string{"-timeout=5s", "-enabled", "-foo=x", "-bar=y"}))
+
+	for _, cfg := range []fooConfig{foo, bar} {
+		assert.Equal(t, fooConfig{Timeout: 5 * time.Second, Enabled: true, Foo: "x"}, cfg)
+	}
+	assert.Equal(t, barConfig{Timeout: 5 * time.Second, Enabled: true, Bar: "y"}, baz)
+}
@@ -0,0 +1,31 @@
+package util
+
+import (
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/reflection"
+)
+
+// RegisterGRPCHealthAndReflection registers the standard gRPC health checking
+// and server reflection services, so the server can be probed with tools like
+// grpc_health_probe and grpcurl. It must be called after the server's other
+// services are registered, which are all reported as serving; use the returned
+// health server to change that, eg when shutting down.
+func RegisterGRPCHealthAndReflection(s *grpc.Server) *health.Server {
+	healthServer := health.NewServer()
+	for service := range s.GetServiceInfo() {
+		healthServer.SetServingStatus(service, healthpb.HealthCheckResponse_SERVING)
+	}
+	healthpb.RegisterHealthServer(s, healthServer)
+	reflection.Register(s)
+	return healthServer
+}
+
+// SetGRPCNotServing marks all the services registered on the server as no
+// longer serving.
+func SetGRPCNotServing(s *grpc.Server, healthServer *health.Server) {
+	for service := range s.GetServiceInfo() {
+		healthServer.SetServingStatus(service, healthpb.HealthCheckResponse_NOT_SERVING)
+	}
+}
@@ -0,0 +1,48 @@
+package util
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+
+	"github.com/weaveworks/cortex"
+)
+
+type stubIngester struct {
+	cortex.IngesterServer
+}
+
+func TestRegisterGRPCHealthAndReflection(t *testing.T) {
+	server := grpc.NewServer()
+	cortex.RegisterIngesterServer(server, stubIngester{})
+	healthServer := RegisterGRPCHealthAndReflection(server)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go server.Serve(listener)
+	defer server.Stop()
+
+	conn, err := grpc.Dial(listener.Addr().String(), grpc.WithInsecure())
+	require.NoError(t, err)
+	defer conn.Close()
+	client := healthpb.NewHealthClient(conn)
+
+	check := func(service string) healthpb.HealthCheckResponse_ServingStatus {
+		resp, err := client.Check(context.Background(), &healthpb.HealthCheckRequest{Service: service})
+		require.NoError(t, err)
+		return resp.Status
+	}
+	assert.Equal(t, healthpb.HealthCheckResponse_SERVING, check(""))
+	assert.Equal(t, healthpb.HealthCheckResponse_SERVING, check("cortex.Ingester"))
+
+	SetGRPCNotServing(server, healthServer)
+	assert.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, check("cortex.Ingester"))
+
+	_, err = client.Check(context.Background(), &healthpb.HealthCheckRequest{Service: "unknown"})
+	assert.Error(t, err)
+}
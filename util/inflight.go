@@ -0,0 +1,74 @@
+package util
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"github.com/weaveworks/cortex"
+)
+
+// InflightLimiter limits the pushes in flight, shedding bulk pushes first:
+// they are rejected once the pushes in flight reach a fraction of the limit,
+// leaving the rest for realtime pushes. A nil InflightLimiter doesn't limit.
+type InflightLimiter struct {
+	max, maxBulk int64
+	inflight     int64
+}
+
+// NewInflightLimiter makes an InflightLimiter allowing max pushes in flight,
+// of which bulk pushes may be the given fraction, or nil if max isn't
+// positive.
+func NewInflightLimiter(max int, bulkFraction float64) *InflightLimiter {
+	if max <= 0 {
+		return nil
+	}
+	return &InflightLimiter{
+		max:     int64(max),
+		maxBulk: int64(float64(max) * bulkFraction),
+	}
+}
+
+// Acquire admits a push of the given priority, returning a LimitError if it
+// must be shed. If it returns nil, Release must be called when the push
+// finishes.
+func (l *InflightLimiter) Acquire(priority cortex.WritePriority) error {
+	if l == nil {
+		return nil
+	}
+	max := l.max
+	if priority == cortex.BULK {
+		max = l.maxBulk
+	}
+	if inflight := atomic.AddInt64(&l.inflight, 1); inflight > max {
+		atomic.AddInt64(&l.inflight, -1)
+		return &LimitError{
+			Limit:      MaxInflightPushesLimit,
+			Configured: float64(max),
+			Observed:   float64(inflight),
+			RetryAfter: 1,
+			Message:    fmt.Sprintf("too many %v pushes in flight, the limit is %d", priority, max),
+		}
+	}
+	return nil
+}
+
+// Release marks an admitted push as finished.
+func (l *InflightLimiter) Release() {
+	if l != nil {
+		atomic.AddInt64(&l.inflight, -1)
+	}
+}
+
+// ParseWritePriority parses a write priority, eg. "bulk", as in the priority
+// header; empty is realtime.
+func ParseWritePriority(s string) (cortex.WritePriority, error) {
+	if s == "" {
+		return cortex.REALTIME, nil
+	}
+	priority, ok := cortex.WritePriority_value[strings.ToUpper(s)]
+	if !ok {
+		return cortex.REALTIME, fmt.Errorf("unknown write priority %q, want realtime or bulk", s)
+	}
+	return cortex.WritePriority(priority), nil
+}
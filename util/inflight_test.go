@@ -0,0 +1,64 @@
+package util
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/weaveworks/cortex"
+)
+
+func TestInflightLimiter(t *testing.T) {
+	l := NewInflightLimiter(4, 0.5)
+
+	// Bulk pushes are shed once half the slots are taken.
+	require.NoError(t, l.Acquire(cortex.BULK))
+	require.NoError(t, l.Acquire(cortex.REALTIME))
+	err := l.Acquire(cortex.BULK)
+	require.IsType(t, &LimitError{}, err)
+	assert.Equal(t, MaxInflightPushesLimit, err.(*LimitError).Limit)
+	assert.Equal(t, 2.0, err.(*LimitError).Configured)
+
+	// Realtime pushes may take the rest.
+	require.NoError(t, l.Acquire(cortex.REALTIME))
+	require.NoError(t, l.Acquire(cortex.REALTIME))
+	assert.Error(t, l.Acquire(cortex.REALTIME))
+
+	l.Release()
+	require.NoError(t, l.Acquire(cortex.REALTIME))
+	for i := 0; i < 3; i++ {
+		l.Release()
+	}
+	require.NoError(t, l.Acquire(cortex.BULK))
+
+	// A nil limiter doesn't limit.
+	unlimited := NewInflightLimiter(0, 0.5)
+	assert.Nil(t, unlimited)
+	for i := 0; i < 10; i++ {
+		require.NoError(t, unlimited.Acquire(cortex.BULK))
+	}
+	unlimited.Release()
+}
+
+func TestParseWritePriority(t *testing.T) {
+	for _, tc := range []struct {
+		in       string
+		expected cortex.WritePriority
+		err      bool
+	}{
+		{in: "", expected: cortex.REALTIME},
+		{in: "realtime", expected: cortex.REALTIME},
+		{in: "BULK", expected: cortex.BULK},
+		{in: "Bulk", expected: cortex.BULK},
+		{in: "urgent", err: true},
+	} {
+		priority, err := ParseWritePriority(tc.in)
+		if tc.err {
+			assert.Error(t, err, tc.in)
+			continue
+		}
+		require.NoError(t, err, tc.in)
+		assert.Equal(t, tc.expected, priority, tc.in)
+	}
+}
@@ -0,0 +1,82 @@
+package util
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// Names of the limits LimitErrors are returned for.
+const (
+	IngestionRateLimit          = "ingestion_rate"
+	MaxSeriesPerUserLimit       = "max_series_per_user"
+	MaxSeriesPerMetricLimit     = "max_series_per_metric"
+	MaxLabelValuesLimit         = "max_label_values_per_metric"
+	MaxLabelNamesPerSeriesLimit = "max_label_names_per_series"
+	MaxLabelNameLengthLimit     = "max_label_name_length"
+	MaxLabelValueLengthLimit    = "max_label_value_length"
+	QueryRateLimit              = "query_rate"
+	MaxConcurrentQueriesLimit   = "max_concurrent_queries"
+	MaxInflightPushesLimit      = "max_inflight_pushes"
+)
+
+// LimitError is returned when a request is rejected by one of the per-user
+// limits, with the details clients need to back off, or to ask for the limit
+// to be raised.
+type LimitError struct {
+	Limit      string  `json:"limit"`
+	Configured float64 `json:"configured"`
+
+	// The value which would have exceeded the limit, if known, eg. the number
+	// of series, or of samples in the rejected push.
+	Observed float64 `json:"observed,omitempty"`
+
+	// Roughly how many seconds to wait before retrying; not set when retrying
+	// won't succeed until the limit is raised or usage drops.
+	RetryAfter float64 `json:"retryAfterSeconds,omitempty"`
+
+	Message string `json:"message"`
+}
+
+func (e *LimitError) Error() string {
+	return e.Message
+}
+
+// GRPCError returns the error as a ResourceExhausted gRPC error. The version
+// of gRPC we use doesn't support status details, so the error's description
+// is its JSON encoding.
+func (e *LimitError) GRPCError() error {
+	buf, err := json.Marshal(e)
+	if err != nil {
+		return grpc.Errorf(codes.ResourceExhausted, "%s", e.Message)
+	}
+	return grpc.Errorf(codes.ResourceExhausted, "%s", buf)
+}
+
+// LimitErrorFromGRPC returns the LimitError a gRPC error was made from with
+// GRPCError, if it was.
+func LimitErrorFromGRPC(err error) (*LimitError, bool) {
+	if grpc.Code(err) != codes.ResourceExhausted {
+		return nil, false
+	}
+	var limitErr LimitError
+	if err := json.Unmarshal([]byte(grpc.ErrorDesc(err)), &limitErr); err != nil || limitErr.Limit == "" {
+		return nil, false
+	}
+	return &limitErr, true
+}
+
+// WriteLimitError writes the error to the response as JSON, with the given
+// status code and any Retry-After header.
+func WriteLimitError(w http.ResponseWriter, err *LimitError, code int) {
+	if err.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(err.RetryAfter))))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(err)
+}
@@ -0,0 +1,47 @@
+package util
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+func TestLimitErrorGRPC(t *testing.T) {
+	err := &LimitError{
+		Limit:      MaxSeriesPerUserLimit,
+		Configured: 10,
+		Observed:   10,
+		Message:    ErrUserSeriesLimitExceeded.Error(),
+	}
+	limitErr, ok := LimitErrorFromGRPC(err.GRPCError())
+	assert.True(t, ok)
+	assert.Equal(t, err, limitErr)
+
+	for _, err := range []error{
+		fmt.Errorf("fail"),
+		grpc.Errorf(codes.Unavailable, "fail"),
+		grpc.Errorf(codes.ResourceExhausted, "fail"),
+	} {
+		_, ok := LimitErrorFromGRPC(err)
+		assert.False(t, ok, "%v", err)
+	}
+}
+
+func TestWriteLimitError(t *testing.T) {
+	rec := httptest.NewRecorder()
+	WriteLimitError(rec, &LimitError{
+		Limit:      QueryRateLimit,
+		Configured: 1,
+		RetryAfter: 0.2,
+		Message:    "query rate limit exceeded",
+	}, http.StatusTooManyRequests)
+
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.Equal(t, "1", rec.Header().Get("Retry-After"))
+	assert.JSONEq(t, `{"limit": "query_rate", "configured": 1, "retryAfterSeconds": 0.2, "message": "query rate limit exceeded"}`, rec.Body.String())
+}
@@ -0,0 +1,181 @@
+package util
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/weaveworks/cortex"
+)
+
+// RateLimiter decides how fast a tenant may push samples.
+type RateLimiter interface {
+	// IngestionRate returns the samples per second, and burst size, the
+	// tenant may push from the source. A rate of 0 or less is unlimited.
+	IngestionRate(userID string, source cortex.SampleSource) (float64, int)
+}
+
+// SeriesLimiter decides how many active series a tenant may have in an
+// ingester.
+type SeriesLimiter interface {
+	MaxSeriesPerUser(userID string) int
+	MaxSeriesPerMetric(userID string) int
+}
+
+// CardinalityLimiter decides how many distinct values each label of a
+// tenant's metrics may have, by label name. Labels not in the map are
+// unlimited.
+type CardinalityLimiter interface {
+	LabelValueLimits(userID string) map[string]int
+}
+
+// Limiter makes all the decisions on tenants' limits. Components only depend
+// on the part they enforce, so embedders can supply their own, eg. one asking
+// a quota service, with RegisterLimiter.
+type Limiter interface {
+	RateLimiter
+	SeriesLimiter
+	CardinalityLimiter
+}
+
+// LimitDefaults are the limits of tenants without their own, as set by the
+// components' flags.
+type LimitDefaults struct {
+	IngestionRate          float64
+	IngestionBurstSize     int
+	RuleIngestionRate      float64
+	RuleIngestionBurstSize int
+	MaxSeriesPerUser       int
+	MaxSeriesPerMetric     int
+}
+
+// LimiterFactory makes a Limiter from the defaults and a component's overrides
+// file, which may be empty.
+type LimiterFactory func(defaults LimitDefaults, overridesFile string) (Limiter, error)
+
+// The built in Limiters.
+const (
+	LocalLimiter     = "local"
+	OverridesLimiter = "overrides"
+)
+
+var (
+	limitersMtx sync.RWMutex
+	limiters    = map[string]LimiterFactory{
+		LocalLimiter:     newLocalLimiter,
+		OverridesLimiter: newOverridesLimiter,
+	}
+)
+
+// RegisterLimiter makes a Limiter available by name to NewLimiter, and so to
+// the components' -<component>.limiter flags. It panics if the name is taken,
+// so should be called from init.
+func RegisterLimiter(name string, factory LimiterFactory) {
+	limitersMtx.Lock()
+	defer limitersMtx.Unlock()
+	if _, ok := limiters[name]; ok {
+		panic(fmt.Sprintf("limiter %q registered twice", name))
+	}
+	limiters[name] = factory
+}
+
+// NewLimiter makes the registered Limiter with the given name.
+func NewLimiter(name string, defaults LimitDefaults, overridesFile string) (Limiter, error) {
+	limitersMtx.RLock()
+	factory, ok := limiters[name]
+	limitersMtx.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown limiter %q, registered limiters are %v", name, limiterNames())
+	}
+	return factory(defaults, overridesFile)
+}
+
+func limiterNames() []string {
+	limitersMtx.RLock()
+	defer limitersMtx.RUnlock()
+	names := make([]string, 0, len(limiters))
+	for name := range limiters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// localLimiter gives every tenant the defaults.
+type localLimiter struct {
+	defaults LimitDefaults
+}
+
+func newLocalLimiter(defaults LimitDefaults, _ string) (Limiter, error) {
+	return localLimiter{defaults: defaults}, nil
+}
+
+func (l localLimiter) IngestionRate(_ string, source cortex.SampleSource) (float64, int) {
+	if source == cortex.RULE {
+		return l.defaults.RuleIngestionRate, l.defaults.RuleIngestionBurstSize
+	}
+	return l.defaults.IngestionRate, l.defaults.IngestionBurstSize
+}
+
+func (l localLimiter) MaxSeriesPerUser(string) int {
+	return l.defaults.MaxSeriesPerUser
+}
+
+func (l localLimiter) MaxSeriesPerMetric(string) int {
+	return l.defaults.MaxSeriesPerMetric
+}
+
+func (l localLimiter) LabelValueLimits(string) map[string]int {
+	return nil
+}
+
+// overridesLimiter gives tenants the limits in the overrides file, and the
+// defaults for those they don't override.
+type overridesLimiter struct {
+	localLimiter
+	overrides map[string]Overrides
+}
+
+func newOverridesLimiter(defaults LimitDefaults, overridesFile string) (Limiter, error) {
+	l := overridesLimiter{localLimiter: localLimiter{defaults: defaults}}
+	if overridesFile != "" {
+		var err error
+		if l.overrides, err = LoadOverrides(overridesFile); err != nil {
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+func (l overridesLimiter) IngestionRate(userID string, source cortex.SampleSource) (float64, int) {
+	rate, burst := l.localLimiter.IngestionRate(userID, source)
+	if source == cortex.RULE {
+		return rate, burst
+	}
+	o := l.overrides[userID]
+	if o.IngestionRate > 0 {
+		rate = o.IngestionRate
+	}
+	if o.IngestionBurstSize > 0 {
+		burst = o.IngestionBurstSize
+	}
+	return rate, burst
+}
+
+func (l overridesLimiter) MaxSeriesPerUser(userID string) int {
+	if o := l.overrides[userID]; o.MaxSeriesPerUser > 0 {
+		return o.MaxSeriesPerUser
+	}
+	return l.defaults.MaxSeriesPerUser
+}
+
+func (l overridesLimiter) MaxSeriesPerMetric(userID string) int {
+	if o := l.overrides[userID]; o.MaxSeriesPerMetric > 0 {
+		return o.MaxSeriesPerMetric
+	}
+	return l.defaults.MaxSeriesPerMetric
+}
+
+func (l overridesLimiter) LabelValueLimits(userID string) map[string]int {
+	return l.overrides[userID].LabelValueLimits
+}
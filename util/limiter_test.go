@@ -0,0 +1,91 @@
+package util
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/weaveworks/cortex"
+)
+
+var testDefaults = LimitDefaults{
+	IngestionRate:          100,
+	IngestionBurstSize:     200,
+	RuleIngestionRate:      10,
+	RuleIngestionBurstSize: 20,
+	MaxSeriesPerUser:       1000,
+	MaxSeriesPerMetric:     100,
+}
+
+func TestLimiters(t *testing.T) {
+	f, err := ioutil.TempFile("", "overrides")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(`
+overrides:
+  big:
+    ingestion_rate: 1000
+    max_series_per_user: 5000
+    label_value_limits:
+      pod: 10
+`)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	local, err := NewLimiter(LocalLimiter, testDefaults, f.Name())
+	require.NoError(t, err)
+	overrides, err := NewLimiter(OverridesLimiter, testDefaults, f.Name())
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		limiter            Limiter
+		user               string
+		rate               float64
+		burst              int
+		ruleRate           float64
+		maxSeriesPerUser   int
+		maxSeriesPerMetric int
+		labelValueLimits   map[string]int
+	}{
+		{local, "big", 100, 200, 10, 1000, 100, nil},
+		{overrides, "small", 100, 200, 10, 1000, 100, nil},
+		{overrides, "big", 1000, 200, 10, 5000, 100, map[string]int{"pod": 10}},
+	} {
+		rate, burst := tc.limiter.IngestionRate(tc.user, cortex.API)
+		assert.Equal(t, tc.rate, rate)
+		assert.Equal(t, tc.burst, burst)
+		ruleRate, _ := tc.limiter.IngestionRate(tc.user, cortex.RULE)
+		assert.Equal(t, tc.ruleRate, ruleRate)
+		assert.Equal(t, tc.maxSeriesPerUser, tc.limiter.MaxSeriesPerUser(tc.user))
+		assert.Equal(t, tc.maxSeriesPerMetric, tc.limiter.MaxSeriesPerMetric(tc.user))
+		assert.Equal(t, tc.labelValueLimits, tc.limiter.LabelValueLimits(tc.user))
+	}
+}
+
+type fixedLimiter struct {
+	localLimiter
+}
+
+func (fixedLimiter) MaxSeriesPerUser(string) int {
+	return 1
+}
+
+func TestRegisterLimiter(t *testing.T) {
+	_, err := NewLimiter("fixed", testDefaults, "")
+	assert.Error(t, err)
+
+	RegisterLimiter("fixed", func(defaults LimitDefaults, _ string) (Limiter, error) {
+		return fixedLimiter{localLimiter{defaults}}, nil
+	})
+	limiter, err := NewLimiter("fixed", testDefaults, "")
+	require.NoError(t, err)
+	assert.Equal(t, 1, limiter.MaxSeriesPerUser("user"))
+	assert.Equal(t, 100, limiter.MaxSeriesPerMetric("user"))
+
+	assert.Panics(t, func() {
+		RegisterLimiter(LocalLimiter, newLocalLimiter)
+	})
+}
@@ -19,6 +19,17 @@ func SplitFiltersAndMatchers(allMatchers []*metric.LabelMatcher) (filters, match
 	return
 }
 
+// MatchesFilters returns whether the metric matches all the matchers, eg. the
+// filters split off by SplitFiltersAndMatchers.
+func MatchesFilters(m model.Metric, filters []*metric.LabelMatcher) bool {
+	for _, filter := range filters {
+		if !filter.Match(m[filter.Name]) {
+			return false
+		}
+	}
+	return true
+}
+
 // ExtractMetricNameFromMetric extract the metric name from a model.Metric
 func ExtractMetricNameFromMetric(m model.Metric) (model.LabelValue, error) {
 	for name, value := range m {
@@ -0,0 +1,145 @@
+package util
+
+import (
+	"github.com/prometheus/common/model"
+)
+
+// SampleIterator iterates over sample pairs sorted by timestamp.
+type SampleIterator interface {
+	// Next advances the iterator, returning false when there are no more
+	// samples.
+	Next() bool
+	// At returns the current sample.
+	At() model.SamplePair
+}
+
+type sliceIterator struct {
+	samples []model.SamplePair
+	i       int
+}
+
+// NewSliceIterator makes a SampleIterator over an already sorted slice,
+// without copying it.
+func NewSliceIterator(samples []model.SamplePair) SampleIterator {
+	return &sliceIterator{samples: samples, i: -1}
+}
+
+func (it *sliceIterator) Next() bool {
+	it.i++
+	return it.i < len(it.samples)
+}
+
+func (it *sliceIterator) At() model.SamplePair {
+	return it.samples[it.i]
+}
+
+// mergeIterator keeps its iterators in a heap ordered by the timestamp of
+// their current sample, which is cached to save calls to At.
+type mergeIterator struct {
+	heap []heapEntry
+	curr model.SamplePair
+}
+
+type heapEntry struct {
+	it     SampleIterator
+	sample model.SamplePair
+}
+
+// NewMergeIterator makes a SampleIterator merging and deduping sorted
+// iterators, with the same semantics as MergeSamples: of samples at the same
+// time, a real value is preferred to a staleness marker. Merging n iterators
+// costs O(log n) per sample and nothing is copied.
+func NewMergeIterator(its ...SampleIterator) SampleIterator {
+	h := make([]heapEntry, 0, len(its))
+	for _, it := range its {
+		if it.Next() {
+			h = append(h, heapEntry{it: it, sample: it.At()})
+		}
+	}
+	m := &mergeIterator{heap: h}
+	for i := len(h)/2 - 1; i >= 0; i-- {
+		m.down(i)
+	}
+	return m
+}
+
+func (m *mergeIterator) Next() bool {
+	if len(m.heap) == 0 {
+		return false
+	}
+	m.curr = m.pop()
+	for len(m.heap) > 0 && m.heap[0].sample.Timestamp == m.curr.Timestamp {
+		next := m.pop()
+		if IsStaleNaN(m.curr.Value) && !IsStaleNaN(next.Value) {
+			m.curr = next
+		}
+	}
+	return true
+}
+
+func (m *mergeIterator) At() model.SamplePair {
+	return m.curr
+}
+
+// pop returns the earliest sample, advancing its iterator.
+func (m *mergeIterator) pop() model.SamplePair {
+	top := &m.heap[0]
+	sample := top.sample
+	if top.it.Next() {
+		top.sample = top.it.At()
+	} else {
+		last := len(m.heap) - 1
+		m.heap[0] = m.heap[last]
+		m.heap = m.heap[:last]
+	}
+	m.down(0)
+	return sample
+}
+
+func (m *mergeIterator) down(i int) {
+	n := len(m.heap)
+	for {
+		min := i
+		if l := 2*i + 1; l < n && m.heap[l].sample.Timestamp < m.heap[min].sample.Timestamp {
+			min = l
+		}
+		if r := 2*i + 2; r < n && m.heap[r].sample.Timestamp < m.heap[min].sample.Timestamp {
+			min = r
+		}
+		if min == i {
+			return
+		}
+		m.heap[i], m.heap[min] = m.heap[min], m.heap[i]
+		i = min
+	}
+}
+
+// MergeNSamples merges and dedupes any number of already sorted sets of sample
+// pairs, eg. the replicas of a series from several ingesters, allocating only
+// the result. A single set is returned as it is.
+func MergeNSamples(sets ...[]model.SamplePair) []model.SamplePair {
+	switch len(sets) {
+	case 0:
+		return nil
+	case 1:
+		return sets[0]
+	case 2:
+		return MergeSamples(sets[0], sets[1])
+	}
+
+	// Replicas mostly hold the same samples, so the longest is a good guess of
+	// the size of the result.
+	its := make([]SampleIterator, 0, len(sets))
+	size := 0
+	for _, set := range sets {
+		its = append(its, NewSliceIterator(set))
+		if len(set) > size {
+			size = len(set)
+		}
+	}
+	result := make([]model.SamplePair, 0, size)
+	for it := NewMergeIterator(its...); it.Next(); {
+		result = append(result, it.At())
+	}
+	return result
+}
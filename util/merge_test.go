@@ -0,0 +1,102 @@
+package util
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMergeNSamples(t *testing.T) {
+	for i, tc := range []struct {
+		sets     [][]model.SamplePair
+		expected []model.SamplePair
+	}{
+		{
+			sets:     nil,
+			expected: nil,
+		},
+		{
+			sets:     [][]model.SamplePair{{{Timestamp: 1, Value: 1}}},
+			expected: []model.SamplePair{{Timestamp: 1, Value: 1}},
+		},
+		{
+			sets: [][]model.SamplePair{
+				{{Timestamp: 1, Value: 1}, {Timestamp: 3, Value: 3}},
+				{{Timestamp: 2, Value: 2}, {Timestamp: 3, Value: 3}},
+				{},
+				{{Timestamp: 1, Value: 1}, {Timestamp: 4, Value: 4}},
+			},
+			expected: []model.SamplePair{
+				{Timestamp: 1, Value: 1},
+				{Timestamp: 2, Value: 2},
+				{Timestamp: 3, Value: 3},
+				{Timestamp: 4, Value: 4},
+			},
+		},
+	} {
+		assert.Equal(t, tc.expected, MergeNSamples(tc.sets...), "test case %d", i)
+	}
+}
+
+func TestMergeNSamplesStaleness(t *testing.T) {
+	merged := MergeNSamples(
+		[]model.SamplePair{{Timestamp: 1, Value: StaleNaN}, {Timestamp: 2, Value: StaleNaN}},
+		[]model.SamplePair{{Timestamp: 1, Value: StaleNaN}},
+		[]model.SamplePair{{Timestamp: 1, Value: 1}, {Timestamp: 3, Value: StaleNaN}},
+	)
+	assert.Len(t, merged, 3)
+	assert.Equal(t, model.SamplePair{Timestamp: 1, Value: 1}, merged[0])
+	assert.True(t, IsStaleNaN(merged[1].Value))
+	assert.True(t, IsStaleNaN(merged[2].Value))
+}
+
+// TestMergeNSamplesMatchesMergeSamples checks the heap merge agrees with
+// merging pairwise.
+func TestMergeNSamplesMatchesMergeSamples(t *testing.T) {
+	sets := makeReplicas(7, 100)
+	var pairwise []model.SamplePair
+	for _, set := range sets {
+		pairwise = MergeSamples(pairwise, set)
+	}
+	assert.Equal(t, pairwise, MergeNSamples(sets...))
+}
+
+// makeReplicas makes n replicas of a series, each missing a different few of
+// its samples.
+func makeReplicas(n, samples int) [][]model.SamplePair {
+	sets := make([][]model.SamplePair, 0, n)
+	for i := 0; i < n; i++ {
+		set := make([]model.SamplePair, 0, samples)
+		for j := 0; j < samples; j++ {
+			if j%n == i {
+				continue
+			}
+			set = append(set, model.SamplePair{Timestamp: model.Time(j), Value: model.SampleValue(j)})
+		}
+		sets = append(sets, set)
+	}
+	return sets
+}
+
+func BenchmarkMergeSamples(b *testing.B) {
+	for _, replicas := range []int{3, 10, 50} {
+		sets := makeReplicas(replicas, 1000)
+		b.Run(fmt.Sprintf("pairwise-%d", replicas), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				var result []model.SamplePair
+				for _, set := range sets {
+					result = MergeSamples(result, set)
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("heap-%d", replicas), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				MergeNSamples(sets...)
+			}
+		})
+	}
+}
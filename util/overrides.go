@@ -0,0 +1,168 @@
+package util
+
+import (
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v2"
+)
+
+// Overrides are the settings which can be set per tenant, taking precedence
+// over the components' flags. Zero values aren't overridden.
+type Overrides struct {
+	// The number of ingesters the tenant's series are written to and read
+	// from.
+	ReplicationFactor int `yaml:"replication_factor"`
+
+	// The pool of ingesters, as set with -ingester.pool, the tenant's series
+	// are sent to, so noisy tenants can be isolated on dedicated ingesters.
+	Pool string `yaml:"pool"`
+
+	// How far behind the newest sample of a series a sample may be and still
+	// be accepted, for tenants pushing batches which lag.
+	OutOfOrderWindow time.Duration `yaml:"out_of_order_window"`
+
+	// How fast the tenant may push samples, not counting those generated by
+	// rules, and how many active series they may have in each ingester.
+	IngestionRate      float64 `yaml:"ingestion_rate"`
+	IngestionBurstSize int     `yaml:"ingestion_burst_size"`
+	MaxSeriesPerUser   int     `yaml:"max_series_per_user"`
+	MaxSeriesPerMetric int     `yaml:"max_series_per_metric"`
+
+	// The most distinct values each of the named labels may have in a metric,
+	// to catch a single bad label exploding the tenant's series. Counted
+	// approximately, per ingester.
+	LabelValueLimits map[string]int `yaml:"label_value_limits"`
+
+	// Limits on the labels of each series pushed.
+	MaxLabelNamesPerSeries int `yaml:"max_label_names_per_series"`
+	MaxLabelNameLength     int `yaml:"max_label_name_length"`
+	MaxLabelValueLength    int `yaml:"max_label_value_length"`
+
+	// The fraction of the tenant's successful pushes traced. Unlike the other
+	// settings, 0 overrides, to only trace failed or slow pushes.
+	PushTraceSampleRate *float64 `yaml:"push_trace_sample_rate"`
+
+	// How far behind now the tenant's rules are evaluated, to tolerate their
+	// pushes lagging, and how often. Whether evaluation timestamps are aligned
+	// to multiples of the interval; unlike the other settings, false overrides.
+	RulerEvaluationDelay    time.Duration `yaml:"ruler_evaluation_delay"`
+	RulerEvaluationInterval time.Duration `yaml:"ruler_evaluation_interval"`
+	RulerAlignEvaluations   *bool         `yaml:"ruler_align_evaluations"`
+
+	// How far back the tenant's queries may read, eg. to keep to a retention
+	// policy shorter than the chunk store's, and regular expressions of
+	// queries the querier rejects.
+	MaxQueryLookback time.Duration `yaml:"max_query_lookback"`
+	QueryBlockers    []string      `yaml:"query_blockers"`
+
+	// The resolution of the tenant's subqueries which don't have one.
+	DefaultSubqueryResolution time.Duration `yaml:"default_subquery_resolution"`
+
+	// New names for the tenant's metrics and labels, old name to new, which
+	// the distributor renames them to as they are pushed, eg. while migrating
+	// to a naming convention. Queries of the old names read the renamed
+	// series too, as if they had kept their old names.
+	MetricRenames map[string]string `yaml:"metric_renames"`
+	LabelRenames  map[string]string `yaml:"label_renames"`
+}
+
+// overridesFile is the format of the overrides file, eg:
+//
+//	overrides:
+//	  dev-tenant:
+//	    replication_factor: 1
+//	  noisy-tenant:
+//	    pool: dedicated
+//	  big-tenant:
+//	    ingestion_rate: 100000
+//	    ingestion_burst_size: 200000
+//	    max_series_per_user: 10000000
+//	  batch-tenant:
+//	    out_of_order_window: 5m
+//	  k8s-tenant:
+//	    label_value_limits:
+//	      pod: 1000
+//	    max_label_value_length: 4096
+//	  busy-tenant:
+//	    push_trace_sample_rate: 0.001
+//	  lagging-tenant:
+//	    ruler_evaluation_delay: 1m
+//	    ruler_evaluation_interval: 1m
+//	    ruler_align_evaluations: true
+//	  compliance-tenant:
+//	    max_query_lookback: 720h
+//	    query_blockers:
+//	    - 'secret_.*'
+//	  dashboard-tenant:
+//	    default_subquery_resolution: 5m
+//	  migrating-tenant:
+//	    metric_renames:
+//	      http_requests: http_requests_total
+//	    label_renames:
+//	      hostname: instance
+type overridesFile struct {
+	Overrides map[string]Overrides `yaml:"overrides"`
+}
+
+// LoadOverrides returns the per-tenant overrides in the given file.
+func LoadOverrides(filename string) (map[string]Overrides, error) {
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var file overridesFile
+	if err := yaml.Unmarshal(buf, &file); err != nil {
+		return nil, fmt.Errorf("error parsing overrides file %s: %v", filename, err)
+	}
+	for userID, o := range file.Overrides {
+		if o.ReplicationFactor < 0 {
+			return nil, fmt.Errorf("replication_factor for %s must not be negative: %d", userID, o.ReplicationFactor)
+		}
+		if o.OutOfOrderWindow < 0 {
+			return nil, fmt.Errorf("out_of_order_window for %s must not be negative: %v", userID, o.OutOfOrderWindow)
+		}
+		if o.IngestionRate < 0 || o.IngestionBurstSize < 0 || o.MaxSeriesPerUser < 0 || o.MaxSeriesPerMetric < 0 {
+			return nil, fmt.Errorf("ingestion and series limits for %s must not be negative", userID)
+		}
+		if o.MaxLabelNamesPerSeries < 0 || o.MaxLabelNameLength < 0 || o.MaxLabelValueLength < 0 {
+			return nil, fmt.Errorf("label limits for %s must not be negative", userID)
+		}
+		if o.RulerEvaluationDelay < 0 || o.RulerEvaluationInterval < 0 {
+			return nil, fmt.Errorf("ruler evaluation delay and interval for %s must not be negative", userID)
+		}
+		if o.MaxQueryLookback < 0 {
+			return nil, fmt.Errorf("max_query_lookback for %s must not be negative: %v", userID, o.MaxQueryLookback)
+		}
+		if o.DefaultSubqueryResolution < 0 {
+			return nil, fmt.Errorf("default_subquery_resolution for %s must not be negative: %v", userID, o.DefaultSubqueryResolution)
+		}
+		for _, blocker := range o.QueryBlockers {
+			if _, err := regexp.Compile(blocker); err != nil {
+				return nil, fmt.Errorf("query_blockers for %s must be regular expressions: %v", userID, err)
+			}
+		}
+		if r := o.PushTraceSampleRate; r != nil && (*r < 0 || *r > 1) {
+			return nil, fmt.Errorf("push_trace_sample_rate for %s must be between 0 and 1: %v", userID, *r)
+		}
+		for old, new := range o.MetricRenames {
+			if !model.IsValidMetricName(model.LabelValue(old)) || !model.IsValidMetricName(model.LabelValue(new)) || old == new {
+				return nil, fmt.Errorf("metric_renames for %s must rename valid metric names to others: %s: %s", userID, old, new)
+			}
+		}
+		for old, new := range o.LabelRenames {
+			if !model.LabelName(old).IsValid() || !model.LabelName(new).IsValid() || old == new || old == model.MetricNameLabel || new == model.MetricNameLabel {
+				return nil, fmt.Errorf("label_renames for %s must rename valid label names, other than %s, to others: %s: %s", userID, model.MetricNameLabel, old, new)
+			}
+		}
+		for name, limit := range o.LabelValueLimits {
+			if limit < 0 {
+				return nil, fmt.Errorf("label_value_limits for %s must not be negative: %s: %d", userID, name, limit)
+			}
+		}
+	}
+	return file.Overrides, nil
+}
@@ -0,0 +1,141 @@
+package util
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadOverrides(t *testing.T) {
+	for i, tc := range []struct {
+		contents string
+		expected map[string]Overrides
+		err      bool
+	}{
+		{
+			contents: `
+overrides:
+  dev:
+    replication_factor: 1
+  prod:
+    replication_factor: 5
+    pool: dedicated
+  batch:
+    out_of_order_window: 5m
+  k8s:
+    label_value_limits:
+      pod: 1000
+  compliance:
+    max_query_lookback: 720h
+    query_blockers:
+    - 'secret_.*'
+  migrating:
+    metric_renames:
+      http_requests: http_requests_total
+    label_renames:
+      hostname: instance
+`,
+			expected: map[string]Overrides{
+				"dev":   {ReplicationFactor: 1},
+				"prod":  {ReplicationFactor: 5, Pool: "dedicated"},
+				"batch": {OutOfOrderWindow: 5 * time.Minute},
+				"k8s":   {LabelValueLimits: map[string]int{"pod": 1000}},
+				"compliance": {
+					MaxQueryLookback: 720 * time.Hour,
+					QueryBlockers:    []string{"secret_.*"},
+				},
+				"migrating": {
+					MetricRenames: map[string]string{"http_requests": "http_requests_total"},
+					LabelRenames:  map[string]string{"hostname": "instance"},
+				},
+			},
+		},
+		{
+			contents: `
+overrides:
+  dev:
+    replication_factor: -1
+`,
+			err: true,
+		},
+		{
+			contents: `
+overrides:
+  dev:
+    metric_renames:
+      http_requests: http-requests
+`,
+			err: true,
+		},
+		{
+			contents: `
+overrides:
+  dev:
+    label_renames:
+      __name__: name
+`,
+			err: true,
+		},
+		{
+			contents: `
+overrides:
+  dev:
+    out_of_order_window: -1m
+`,
+			err: true,
+		},
+		{
+			contents: `
+overrides:
+  dev:
+    ruler_evaluation_delay: -1m
+`,
+			err: true,
+		},
+		{
+			contents: `
+overrides:
+  dev:
+    label_value_limits:
+      pod: -1
+`,
+			err: true,
+		},
+		{
+			contents: `
+overrides:
+  dev:
+    push_trace_sample_rate: 1.5
+`,
+			err: true,
+		},
+		{
+			contents: `
+overrides:
+  dev:
+    query_blockers:
+    - '('
+`,
+			err: true,
+		},
+	} {
+		f, err := ioutil.TempFile("", "overrides")
+		require.NoError(t, err)
+		_, err = f.WriteString(tc.contents)
+		require.NoError(t, err)
+		f.Close()
+
+		overrides, err := LoadOverrides(f.Name())
+		os.Remove(f.Name())
+		if tc.err {
+			assert.Error(t, err, "%d", i)
+			continue
+		}
+		require.NoError(t, err)
+		assert.Equal(t, tc.expected, overrides, "%d", i)
+	}
+}
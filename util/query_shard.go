@@ -0,0 +1,55 @@
+package util
+
+import (
+	"fmt"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+)
+
+// QueryShardLabel is the name of the pseudo-label whose matcher restricts a
+// query to one shard of the series, eg. __query_shard__="3_of_16". Ingesters
+// and chunk stores only return the series in the shard.
+const QueryShardLabel = "__query_shard__"
+
+// QueryShard is one of Count shards series are split into by fingerprint.
+type QueryShard struct {
+	Index, Count uint64
+}
+
+// Matcher returns the matcher restricting a query to the shard.
+func (s QueryShard) Matcher() *metric.LabelMatcher {
+	return &metric.LabelMatcher{
+		Type:  metric.Equal,
+		Name:  QueryShardLabel,
+		Value: model.LabelValue(fmt.Sprintf("%d_of_%d", s.Index, s.Count)),
+	}
+}
+
+// Contains returns whether the series with the given fingerprint is in the
+// shard.
+func (s QueryShard) Contains(fp model.Fingerprint) bool {
+	return uint64(fp)%s.Count == s.Index
+}
+
+// ExtractQueryShard removes the query shard matcher from a set of matchers,
+// returning the shard, or nil if there wasn't one.
+func ExtractQueryShard(matchers []*metric.LabelMatcher) (*QueryShard, []*metric.LabelMatcher, error) {
+	for i, matcher := range matchers {
+		if matcher.Name != QueryShardLabel {
+			continue
+		}
+		if matcher.Type != metric.Equal {
+			return nil, nil, fmt.Errorf("must have equality matcher for %s", QueryShardLabel)
+		}
+		var shard QueryShard
+		if _, err := fmt.Sscanf(string(matcher.Value), "%d_of_%d", &shard.Index, &shard.Count); err != nil || shard.Index >= shard.Count {
+			return nil, nil, fmt.Errorf("invalid %s %q", QueryShardLabel, matcher.Value)
+		}
+		rest := make([]*metric.LabelMatcher, 0, len(matchers)-1)
+		rest = append(rest, matchers[:i]...)
+		rest = append(rest, matchers[i+1:]...)
+		return &shard, rest, nil
+	}
+	return nil, matchers, nil
+}
@@ -0,0 +1,33 @@
+package util
+
+import (
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExtractQueryShard(t *testing.T) {
+	name, err := metric.NewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo")
+	require.NoError(t, err)
+	shard := QueryShard{Index: 3, Count: 16}
+
+	actual, matchers, err := ExtractQueryShard([]*metric.LabelMatcher{shard.Matcher(), name})
+	require.NoError(t, err)
+	assert.Equal(t, &shard, actual)
+	assert.Equal(t, []*metric.LabelMatcher{name}, matchers)
+
+	actual, matchers, err = ExtractQueryShard([]*metric.LabelMatcher{name})
+	require.NoError(t, err)
+	assert.Nil(t, actual)
+	assert.Equal(t, []*metric.LabelMatcher{name}, matchers)
+
+	for _, value := range []model.LabelValue{"", "3", "16_of_16", "a_of_b"} {
+		invalid, err := metric.NewLabelMatcher(metric.Equal, QueryShardLabel, value)
+		require.NoError(t, err)
+		_, _, err = ExtractQueryShard([]*metric.LabelMatcher{invalid, name})
+		assert.Error(t, err, string(value))
+	}
+}
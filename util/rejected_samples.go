@@ -0,0 +1,82 @@
+package util
+
+import (
+	"encoding/json"
+	"errors"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// Reasons samples are rejected for other than the limits, which are rejected
+// for the name of the limit.
+const (
+	OutOfOrderReason         = "out_of_order"
+	DuplicateTimestampReason = "duplicate_timestamp"
+	TooOldReason             = "too_old"
+)
+
+// RejectedSamplesError is returned by ingesters for pushes of which they
+// rejected some samples, having appended the rest, so the distributor can
+// tell which were written.
+type RejectedSamplesError struct {
+	// The reason each sample was rejected for, by its index in the push,
+	// counting the samples of each series in turn.
+	Samples map[int]string
+
+	// The last rejection's error, a *LimitError if it exceeded a limit.
+	Err error
+}
+
+func (e *RejectedSamplesError) Error() string {
+	return e.Err.Error()
+}
+
+// GRPCError returns the error as a gRPC error whose description is its JSON
+// encoding: a ResourceExhausted one, extending the LimitError's encoding, if
+// the last rejection exceeded a limit, so LimitErrorFromGRPC still reads it,
+// and an InvalidArgument one otherwise.
+func (e *RejectedSamplesError) GRPCError() error {
+	code := codes.InvalidArgument
+	fields := map[string]interface{}{}
+	if limitErr, ok := e.Err.(*LimitError); ok {
+		code = codes.ResourceExhausted
+		buf, err := json.Marshal(limitErr)
+		if err != nil {
+			return limitErr.GRPCError()
+		}
+		if err := json.Unmarshal(buf, &fields); err != nil {
+			return limitErr.GRPCError()
+		}
+	} else {
+		fields["message"] = e.Err.Error()
+	}
+	fields["rejectedSamples"] = e.Samples
+
+	buf, err := json.Marshal(fields)
+	if err != nil {
+		return grpc.Errorf(code, "%s", e.Err.Error())
+	}
+	return grpc.Errorf(code, "%s", buf)
+}
+
+// RejectedSamplesErrorFromGRPC returns the RejectedSamplesError a gRPC error
+// was made from with GRPCError, if it was.
+func RejectedSamplesErrorFromGRPC(err error) (*RejectedSamplesError, bool) {
+	if code := grpc.Code(err); code != codes.ResourceExhausted && code != codes.InvalidArgument {
+		return nil, false
+	}
+	var decoded struct {
+		Samples map[int]string `json:"rejectedSamples"`
+		Message string         `json:"message"`
+	}
+	desc := []byte(grpc.ErrorDesc(err))
+	if err := json.Unmarshal(desc, &decoded); err != nil || len(decoded.Samples) == 0 {
+		return nil, false
+	}
+	rejected := &RejectedSamplesError{Samples: decoded.Samples, Err: errors.New(decoded.Message)}
+	if limitErr, ok := LimitErrorFromGRPC(err); ok {
+		rejected.Err = limitErr
+	}
+	return rejected, true
+}
@@ -0,0 +1,44 @@
+package util
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+func TestRejectedSamplesErrorGRPC(t *testing.T) {
+	limitErr := &LimitError{
+		Limit:      MaxSeriesPerUserLimit,
+		Configured: 10,
+		Observed:   10,
+		Message:    ErrUserSeriesLimitExceeded.Error(),
+	}
+	for _, err := range []*RejectedSamplesError{
+		{Samples: map[int]string{1: OutOfOrderReason, 3: MaxSeriesPerUserLimit}, Err: limitErr},
+		{Samples: map[int]string{0: TooOldReason}, Err: fmt.Errorf("sample timestamp too old")},
+	} {
+		rejected, ok := RejectedSamplesErrorFromGRPC(err.GRPCError())
+		require.True(t, ok)
+		assert.Equal(t, err.Samples, rejected.Samples)
+		assert.Equal(t, err.Err.Error(), rejected.Err.Error())
+	}
+
+	// Limit errors still read as such.
+	rejected := &RejectedSamplesError{Samples: map[int]string{0: MaxSeriesPerUserLimit}, Err: limitErr}
+	decoded, ok := LimitErrorFromGRPC(rejected.GRPCError())
+	require.True(t, ok)
+	assert.Equal(t, limitErr, decoded)
+
+	for _, err := range []error{
+		fmt.Errorf("fail"),
+		grpc.Errorf(codes.InvalidArgument, "fail"),
+		limitErr.GRPCError(),
+	} {
+		_, ok := RejectedSamplesErrorFromGRPC(err)
+		assert.False(t, ok, "%v", err)
+	}
+}
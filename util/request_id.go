@@ -0,0 +1,157 @@
+package util
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/prometheus/common/log"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// RequestIDHeader is the HTTP header carrying the request ID. gRPC metadata
+// keys are lower case.
+const (
+	RequestIDHeader      = "X-Request-ID"
+	lowerRequestIDHeader = "x-request-id"
+)
+
+type contextKey int
+
+const requestIDContextKey contextKey = 0
+
+// NewRequestID returns a random request ID.
+func NewRequestID() string {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(buf)
+}
+
+// InjectRequestID returns a derived context containing the request ID.
+func InjectRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, requestIDContextKey, requestID)
+}
+
+// ExtractRequestID returns the request ID from the context, or "" if there
+// isn't one.
+func ExtractRequestID(ctx context.Context) string {
+	requestID, _ := ctx.Value(requestIDContextKey).(string)
+	return requestID
+}
+
+// WithRequestID returns a logger which adds the request ID in the context, if
+// any, to everything it logs.
+func WithRequestID(ctx context.Context) log.Logger {
+	return withRequestID(log.Base(), ctx)
+}
+
+func withRequestID(logger log.Logger, ctx context.Context) log.Logger {
+	if requestID := ExtractRequestID(ctx); requestID != "" {
+		return logger.With("request_id", requestID)
+	}
+	return logger
+}
+
+// RequestID is HTTP middleware which assigns each request an ID, unless the
+// client already sent one, and returns it in the response's headers and at the
+// end of plain text error responses.
+type RequestID struct{}
+
+// Wrap implements middleware.Interface.
+func (RequestID) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get(RequestIDHeader)
+		if requestID == "" {
+			requestID = NewRequestID()
+		}
+		w.Header().Set(RequestIDHeader, requestID)
+		i := &requestIDInterceptor{ResponseWriter: w}
+		next.ServeHTTP(i, r.WithContext(InjectRequestID(r.Context(), requestID)))
+		if i.textError && !i.hijacked {
+			fmt.Fprintf(w, "request ID: %s\n", requestID)
+		}
+	})
+}
+
+// requestIDInterceptor records whether the response is a plain text error, as
+// written by http.Error.
+type requestIDInterceptor struct {
+	http.ResponseWriter
+	wroteHeader bool
+	textError   bool
+	hijacked    bool
+}
+
+func (i *requestIDInterceptor) WriteHeader(code int) {
+	if !i.wroteHeader {
+		i.wroteHeader = true
+		i.textError = code >= 400 && strings.HasPrefix(i.Header().Get("Content-Type"), "text/plain")
+	}
+	i.ResponseWriter.WriteHeader(code)
+}
+
+func (i *requestIDInterceptor) Write(b []byte) (int, error) {
+	if !i.wroteHeader {
+		i.WriteHeader(http.StatusOK)
+	}
+	return i.ResponseWriter.Write(b)
+}
+
+func (i *requestIDInterceptor) Flush() {
+	if f, ok := i.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (i *requestIDInterceptor) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := i.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("requestIDInterceptor: can't cast parent ResponseWriter to Hijacker")
+	}
+	i.hijacked = true
+	return hj.Hijack()
+}
+
+// ClientRequestIDInterceptor propagates the request ID from the context to gRPC
+// metadata.
+func ClientRequestIDInterceptor(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	if requestID := ExtractRequestID(ctx); requestID != "" {
+		md, ok := metadata.FromContext(ctx)
+		if !ok {
+			md = metadata.New(map[string]string{})
+		} else {
+			md = md.Copy()
+		}
+		md[lowerRequestIDHeader] = []string{requestID}
+		ctx = metadata.NewContext(ctx, md)
+	}
+	return invoker(ctx, method, req, reply, cc, opts...)
+}
+
+// ServerRequestIDInterceptor propagates the request ID from gRPC metadata to
+// the context, assigning one if the client didn't send one, and returns it in
+// the trailer of error responses. The error itself is left alone, as some
+// carry JSON which clients decode.
+func ServerRequestIDInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	requestID := ""
+	if md, ok := metadata.FromContext(ctx); ok && len(md[lowerRequestIDHeader]) == 1 {
+		requestID = md[lowerRequestIDHeader][0]
+	}
+	if requestID == "" {
+		requestID = NewRequestID()
+	}
+	resp, err := handler(InjectRequestID(ctx, requestID), req)
+	if err != nil {
+		// SetTrailer only fails outside a gRPC server, eg in tests.
+		_ = grpc.SetTrailer(ctx, metadata.Pairs(lowerRequestIDHeader, requestID))
+	}
+	return resp, err
+}
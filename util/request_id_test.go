@@ -0,0 +1,88 @@
+package util
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+)
+
+func TestRequestIDMiddleware(t *testing.T) {
+	var got string
+	handler := RequestID{}.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = ExtractRequestID(r.Context())
+	}))
+
+	// A request ID is assigned if there isn't one...
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+	assert.Len(t, got, 16)
+	assert.Equal(t, got, recorder.Header().Get(RequestIDHeader))
+
+	// ...and the client's is used if there is.
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set(RequestIDHeader, "foo")
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, "foo", got)
+	assert.Equal(t, "foo", recorder.Header().Get(RequestIDHeader))
+}
+
+func TestRequestIDInErrors(t *testing.T) {
+	for _, tc := range []struct {
+		handler  http.HandlerFunc
+		expected string
+	}{
+		{
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, "broken", http.StatusInternalServerError)
+			},
+			expected: "broken\nrequest ID: foo\n",
+		},
+		// Successful and non-text responses are left alone.
+		{
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("ok"))
+			},
+			expected: "ok",
+		},
+		{
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"status":"error"}`))
+			},
+			expected: `{"status":"error"}`,
+		},
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set(RequestIDHeader, "foo")
+		recorder := httptest.NewRecorder()
+		RequestID{}.Wrap(tc.handler).ServeHTTP(recorder, req)
+		assert.Equal(t, tc.expected, recorder.Body.String())
+	}
+}
+
+func TestRequestIDInterceptors(t *testing.T) {
+	var got string
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		got = ExtractRequestID(ctx)
+		return nil, nil
+	}
+	// Metadata sent by the client arrives in the server's context.
+	invoker := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		_, err := ServerRequestIDInterceptor(ctx, req, &grpc.UnaryServerInfo{}, handler)
+		return err
+	}
+
+	ctx := InjectRequestID(context.Background(), "foo")
+	require.NoError(t, ClientRequestIDInterceptor(ctx, "method", nil, nil, nil, invoker))
+	assert.Equal(t, "foo", got)
+
+	require.NoError(t, ClientRequestIDInterceptor(context.Background(), "method", nil, nil, nil, invoker))
+	assert.Len(t, got, 16)
+}
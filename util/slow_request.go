@@ -0,0 +1,39 @@
+package util
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/prometheus/common/log"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/user"
+)
+
+// LogIfSlow logs msg as a warning, along with the tenant, request ID, duration
+// and the given key-value pairs, if more than threshold has passed since begin.
+// A threshold <= 0 disables it.
+func LogIfSlow(ctx context.Context, threshold time.Duration, begin time.Time, msg string, keyvals ...interface{}) {
+	logIfSlow(log.Base(), ctx, threshold, begin, msg, keyvals...)
+}
+
+func logIfSlow(logger log.Logger, ctx context.Context, threshold time.Duration, begin time.Time, msg string, keyvals ...interface{}) {
+	duration := time.Since(begin)
+	if threshold <= 0 || duration < threshold {
+		return
+	}
+
+	logger = withRequestID(logger, ctx)
+	if userID, err := user.Extract(ctx); err == nil {
+		logger = logger.With("tenant", userID)
+	}
+	for i := 0; i < len(keyvals); i += 2 {
+		// Keys needn't be strings, and the last one may be missing its value.
+		var value interface{} = "(MISSING)"
+		if i+1 < len(keyvals) {
+			value = keyvals[i+1]
+		}
+		logger = logger.With(fmt.Sprint(keyvals[i]), value)
+	}
+	logger.With("duration", duration).Warn(msg)
+}
@@ -0,0 +1,51 @@
+package util
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/log"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/user"
+)
+
+func TestLogIfSlow(t *testing.T) {
+	ctx := InjectRequestID(user.Inject(context.Background(), "user"), "foo")
+	slow := time.Now().Add(-time.Minute)
+
+	for _, tc := range []struct {
+		threshold time.Duration
+		begin     time.Time
+		keyvals   []interface{}
+		expected  []string
+	}{
+		// Fast and disabled requests aren't logged.
+		{threshold: time.Hour, begin: slow},
+		{threshold: 0, begin: slow},
+		{
+			threshold: time.Second,
+			begin:     slow,
+			keyvals:   []interface{}{"series", 3},
+			expected:  []string{"Slow request", "request_id=foo", "tenant=user", "series=3", "duration=1m"},
+		},
+		// Non-string keys and odd numbers of arguments don't panic.
+		{
+			threshold: time.Second,
+			begin:     slow,
+			keyvals:   []interface{}{1, 2, "err"},
+			expected:  []string{"1=2", "err=\"(MISSING)\""},
+		},
+	} {
+		var buf bytes.Buffer
+		logIfSlow(log.NewLogger(&buf), ctx, tc.threshold, tc.begin, "Slow request", tc.keyvals...)
+		if tc.expected == nil {
+			assert.Empty(t, buf.String())
+		}
+		for _, expected := range tc.expected {
+			assert.Contains(t, buf.String(), expected)
+		}
+	}
+}
@@ -0,0 +1,28 @@
+package util
+
+import (
+	"math"
+
+	"github.com/prometheus/common/model"
+)
+
+// staleNaNBits is the bit pattern of the NaN Prometheus 2.x writes to mark a
+// series as stale, distinct from any NaN a sample can have as its value.
+const staleNaNBits uint64 = 0x7ff0000000000002
+
+// StaleNaN is the value of a staleness marker.
+var StaleNaN = model.SampleValue(math.Float64frombits(staleNaNBits))
+
+// IsStaleNaN returns true if the value is a staleness marker.
+func IsStaleNaN(v model.SampleValue) bool {
+	return math.Float64bits(float64(v)) == staleNaNBits
+}
+
+// SameValue returns true if two sample values are the same, distinguishing
+// staleness markers from other NaNs.
+func SameValue(a, b model.SampleValue) bool {
+	if IsStaleNaN(a) || IsStaleNaN(b) {
+		return IsStaleNaN(a) && IsStaleNaN(b)
+	}
+	return a.Equal(b)
+}
@@ -0,0 +1,30 @@
+package util
+
+import (
+	"math"
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSameValue(t *testing.T) {
+	nan := model.SampleValue(math.NaN())
+	assert.True(t, SameValue(1, 1))
+	assert.False(t, SameValue(1, 2))
+	assert.True(t, SameValue(nan, nan))
+	assert.True(t, SameValue(StaleNaN, StaleNaN))
+	assert.False(t, SameValue(StaleNaN, nan))
+	assert.False(t, SameValue(nan, StaleNaN))
+	assert.True(t, IsStaleNaN(StaleNaN))
+	assert.False(t, IsStaleNaN(nan))
+}
+
+func TestMergeSamplesStaleness(t *testing.T) {
+	a := []model.SamplePair{{Timestamp: 1, Value: 1}, {Timestamp: 2, Value: StaleNaN}}
+	b := []model.SamplePair{{Timestamp: 2, Value: 2}, {Timestamp: 3, Value: StaleNaN}}
+	merged := MergeSamples(a, b)
+	assert.Equal(t, []model.SamplePair{{Timestamp: 1, Value: 1}, {Timestamp: 2, Value: 2}}, merged[:2])
+	assert.True(t, IsStaleNaN(merged[2].Value))
+	assert.Len(t, merged, 3)
+}
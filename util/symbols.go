@@ -0,0 +1,73 @@
+package util
+
+import (
+	"fmt"
+
+	"github.com/weaveworks/cortex"
+	"github.com/weaveworks/cortex/util/wire"
+)
+
+// SymbolizedWritesMetadataKey is the gRPC metadata key ingesters set in their
+// response headers to tell distributors they accept symbolized WriteRequests.
+const SymbolizedWritesMetadataKey = "cortex-symbolized-writes"
+
+// SymbolizeWriteRequest replaces the request's timeseries with symbolized
+// ones, whose labels refer to a table of the distinct label names and values,
+// shrinking requests with many series sharing labels.
+func SymbolizeWriteRequest(req *cortex.WriteRequest) {
+	refs := map[string]uint32{}
+	ref := func(b wire.Bytes) uint32 {
+		if r, ok := refs[string(b)]; ok {
+			return r
+		}
+		r := uint32(len(req.Symbols))
+		refs[string(b)] = r
+		req.Symbols = append(req.Symbols, b)
+		return r
+	}
+
+	req.SymbolizedTimeseries = make([]cortex.SymbolizedTimeSeries, 0, len(req.Timeseries))
+	for _, ts := range req.Timeseries {
+		labelRefs := make([]uint32, 0, 2*len(ts.Labels))
+		for _, l := range ts.Labels {
+			labelRefs = append(labelRefs, ref(l.Name), ref(l.Value))
+		}
+		req.SymbolizedTimeseries = append(req.SymbolizedTimeseries, cortex.SymbolizedTimeSeries{
+			LabelRefs: labelRefs,
+			Samples:   ts.Samples,
+		})
+	}
+	req.Timeseries = nil
+}
+
+// DesymbolizeWriteRequest replaces any symbolized timeseries in the request
+// with plain ones, sharing the symbols' bytes.
+func DesymbolizeWriteRequest(req *cortex.WriteRequest) error {
+	if len(req.SymbolizedTimeseries) == 0 {
+		return nil
+	}
+
+	for _, ts := range req.SymbolizedTimeseries {
+		if len(ts.LabelRefs)%2 != 0 {
+			return fmt.Errorf("odd number of label references: %d", len(ts.LabelRefs))
+		}
+		labels := make([]cortex.LabelPair, 0, len(ts.LabelRefs)/2)
+		for i := 0; i < len(ts.LabelRefs); i += 2 {
+			name, value := ts.LabelRefs[i], ts.LabelRefs[i+1]
+			if int(name) >= len(req.Symbols) || int(value) >= len(req.Symbols) {
+				return fmt.Errorf("label reference out of range of %d symbols", len(req.Symbols))
+			}
+			labels = append(labels, cortex.LabelPair{
+				Name:  req.Symbols[name],
+				Value: req.Symbols[value],
+			})
+		}
+		req.Timeseries = append(req.Timeseries, cortex.TimeSeries{
+			Labels:  labels,
+			Samples: ts.Samples,
+		})
+	}
+	req.Symbols = nil
+	req.SymbolizedTimeseries = nil
+	return nil
+}
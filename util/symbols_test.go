@@ -0,0 +1,45 @@
+package util
+
+import (
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/weaveworks/cortex"
+	"github.com/weaveworks/cortex/util/wire"
+)
+
+func TestSymbolizeWriteRequest(t *testing.T) {
+	samples := []model.Sample{
+		{Metric: model.Metric{model.MetricNameLabel: "foo", "job": "a"}, Value: 1, Timestamp: 1},
+		{Metric: model.Metric{model.MetricNameLabel: "foo", "job": "b"}, Value: 2, Timestamp: 2},
+		{Metric: model.Metric{model.MetricNameLabel: "bar", "job": "a"}, Value: 3, Timestamp: 3},
+	}
+	req := ToWriteRequest(samples)
+
+	SymbolizeWriteRequest(req)
+	assert.Empty(t, req.Timeseries)
+	assert.Len(t, req.SymbolizedTimeseries, len(samples))
+	// __name__, foo, job, a, b, bar.
+	assert.Len(t, req.Symbols, 6)
+
+	require.NoError(t, DesymbolizeWriteRequest(req))
+	assert.Empty(t, req.Symbols)
+	assert.Empty(t, req.SymbolizedTimeseries)
+	assert.Equal(t, samples, FromWriteRequest(req))
+}
+
+func TestDesymbolizeWriteRequestErrors(t *testing.T) {
+	for _, refs := range [][]uint32{
+		{0},
+		{0, 2},
+	} {
+		req := &cortex.WriteRequest{
+			Symbols:              []wire.Bytes{wire.Bytes("__name__"), wire.Bytes("foo")},
+			SymbolizedTimeseries: []cortex.SymbolizedTimeSeries{{LabelRefs: refs}},
+		}
+		assert.Error(t, DesymbolizeWriteRequest(req), "%v", refs)
+	}
+}
@@ -0,0 +1,35 @@
+package util
+
+import (
+	"github.com/opentracing/opentracing-go"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/user"
+)
+
+// tenantBaggageKey is the baggage item carrying the tenant ID, which
+// propagates it to spans in downstream services.
+const tenantBaggageKey = "tenant"
+
+// StartSpanFromContext starts a span as a child of the span in the context, if
+// any, tagged with the tenant ID; see TagSpanWithTenant.
+func StartSpanFromContext(ctx context.Context, operationName string) (opentracing.Span, context.Context) {
+	sp, ctx := opentracing.StartSpanFromContext(ctx, operationName)
+	TagSpanWithTenant(ctx, sp)
+	return sp, ctx
+}
+
+// TagSpanWithTenant tags the span with the tenant ID from the context or, if
+// there isn't one, from the trace's baggage. The tenant ID is added to the
+// baggage, so spans in downstream services can be tagged too.
+func TagSpanWithTenant(ctx context.Context, sp opentracing.Span) {
+	userID, err := user.Extract(ctx)
+	if err != nil {
+		userID = sp.BaggageItem(tenantBaggageKey)
+	} else if sp.BaggageItem(tenantBaggageKey) != userID {
+		sp.SetBaggageItem(tenantBaggageKey, userID)
+	}
+	if userID != "" {
+		sp.SetTag(tenantBaggageKey, userID)
+	}
+}
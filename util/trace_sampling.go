@@ -0,0 +1,100 @@
+package util
+
+import (
+	"sync"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/openzipkin/zipkin-go-opentracing"
+	"golang.org/x/net/context"
+)
+
+// How many traces' sampling decisions are remembered, for their spans which
+// finish after the decision, eg. pushes to ingesters after the quorum.
+const decidedTraces = 10000
+
+// DeferredSampler is a span recorder which can hold back the spans of traces
+// until whether to sample them is decided, eg. once a request is known to have
+// failed or been slow. The spans of other traces are recorded as they were
+// sampled when started.
+type DeferredSampler struct {
+	next zipkintracer.SpanRecorder
+
+	mtx     sync.Mutex
+	pending map[uint64][]zipkintracer.RawSpan
+	decided map[uint64]bool
+	order   []uint64
+}
+
+// NewDeferredSampler makes a new DeferredSampler, passing the spans it records
+// on to next.
+func NewDeferredSampler(next zipkintracer.SpanRecorder) *DeferredSampler {
+	return &DeferredSampler{
+		next:    next,
+		pending: map[uint64][]zipkintracer.RawSpan{},
+		decided: map[uint64]bool{},
+	}
+}
+
+// TraceSampler is the DeferredSampler of the global tracer, if it has one.
+var TraceSampler *DeferredSampler
+
+// RecordSpan implements zipkintracer.SpanRecorder.
+func (s *DeferredSampler) RecordSpan(span zipkintracer.RawSpan) {
+	s.mtx.Lock()
+	id := span.Context.TraceID.Low
+	if spans, ok := s.pending[id]; ok {
+		s.pending[id] = append(spans, span)
+		s.mtx.Unlock()
+		return
+	}
+	if sampled, ok := s.decided[id]; ok {
+		span.Context.Sampled = sampled
+	}
+	s.mtx.Unlock()
+
+	s.next.RecordSpan(span)
+}
+
+// Defer holds back the spans of the trace of the span in the context until the
+// returned function is called with whether to sample them. It does nothing if
+// the context has no span of this sampler's tracer.
+func (s *DeferredSampler) Defer(ctx context.Context) func(sample bool) {
+	if s == nil {
+		return func(bool) {}
+	}
+	sp := opentracing.SpanFromContext(ctx)
+	if sp == nil {
+		return func(bool) {}
+	}
+	spanContext, ok := sp.Context().(zipkintracer.SpanContext)
+	if !ok {
+		return func(bool) {}
+	}
+	id := spanContext.TraceID.Low
+
+	s.mtx.Lock()
+	if _, ok := s.pending[id]; !ok {
+		s.pending[id] = nil
+	}
+	s.mtx.Unlock()
+
+	return func(sample bool) {
+		s.mtx.Lock()
+		spans := s.pending[id]
+		delete(s.pending, id)
+		if _, ok := s.decided[id]; !ok {
+			if len(s.order) >= decidedTraces {
+				delete(s.decided, s.order[0])
+				s.order = s.order[1:]
+			}
+			s.order = append(s.order, id)
+		}
+		s.decided[id] = sample
+		s.mtx.Unlock()
+
+		for _, span := range spans {
+			span.Context.Sampled = sample
+			s.next.RecordSpan(span)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package util
+
+import (
+	"testing"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/openzipkin/zipkin-go-opentracing"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func sampledOperations(recorder *zipkintracer.InMemorySpanRecorder) []string {
+	var operations []string
+	for _, span := range recorder.GetSampledSpans() {
+		operations = append(operations, span.Operation)
+	}
+	recorder.Reset()
+	return operations
+}
+
+func TestDeferredSampler(t *testing.T) {
+	recorder := zipkintracer.NewInMemoryRecorder()
+	sampler := NewDeferredSampler(recorder)
+	tracer, err := zipkintracer.NewTracer(sampler)
+	require.NoError(t, err)
+
+	for _, sample := range []bool{true, false} {
+		root := tracer.StartSpan("push")
+		ctx := opentracing.ContextWithSpan(context.Background(), root)
+		decide := sampler.Defer(ctx)
+
+		// The trace's spans are held back until the decision...
+		tracer.StartSpan("child", opentracing.ChildOf(root.Context())).Finish()
+		assert.Empty(t, recorder.GetSpans())
+
+		// ...and those finishing after it follow it.
+		decide(sample)
+		root.Finish()
+		tracer.StartSpan("late", opentracing.ChildOf(root.Context())).Finish()
+		if sample {
+			assert.Equal(t, []string{"child", "push", "late"}, sampledOperations(recorder))
+		} else {
+			assert.Empty(t, sampledOperations(recorder))
+		}
+	}
+
+	// Other traces are recorded as they were sampled when started.
+	tracer.StartSpan("other").Finish()
+	assert.Equal(t, []string{"other"}, sampledOperations(recorder))
+
+	// Without a span, or a sampler, there is nothing to defer.
+	sampler.Defer(context.Background())(false)
+	(*DeferredSampler)(nil).Defer(context.Background())(false)
+}
@@ -0,0 +1,36 @@
+package util
+
+import (
+	"testing"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/user"
+)
+
+func TestStartSpanFromContext(t *testing.T) {
+	tracer := mocktracer.New()
+	defer opentracing.InitGlobalTracer(opentracing.GlobalTracer())
+	opentracing.InitGlobalTracer(tracer)
+	root := tracer.StartSpan("root")
+	ctx := opentracing.ContextWithSpan(context.Background(), root)
+
+	// The tenant comes from the context, and goes into the baggage...
+	sp, _ := StartSpanFromContext(user.Inject(ctx, "1"), "child")
+	assert.Equal(t, "1", sp.(*mocktracer.MockSpan).Tag("tenant"))
+	assert.Equal(t, "1", sp.BaggageItem("tenant"))
+
+	// ...so spans without it in their context, eg in other services, get it
+	// from there.
+	grandchild := tracer.StartSpan("grandchild", opentracing.ChildOf(sp.Context()))
+	TagSpanWithTenant(context.Background(), grandchild)
+	assert.Equal(t, "1", grandchild.(*mocktracer.MockSpan).Tag("tenant"))
+
+	// Without either, the span isn't tagged.
+	untagged := tracer.StartSpan("untagged")
+	TagSpanWithTenant(context.Background(), untagged)
+	assert.Nil(t, untagged.(*mocktracer.MockSpan).Tag("tenant"))
+}
@@ -14,7 +14,12 @@ func MergeSamples(a, b []model.SamplePair) []model.SamplePair {
 			result = append(result, b[j])
 			j++
 		} else {
-			result = append(result, a[i])
+			// Prefer a real value to a staleness marker at the same time.
+			if IsStaleNaN(a[i].Value) && !IsStaleNaN(b[j].Value) {
+				result = append(result, b[j])
+			} else {
+				result = append(result, a[i])
+			}
 			i++
 			j++
 		}
@@ -1,9 +1,12 @@
 package util
 
 import (
+	"fmt"
 	"regexp"
 
 	"github.com/prometheus/common/model"
+
+	"github.com/weaveworks/cortex"
 )
 
 var (
@@ -29,3 +32,53 @@ func ValidateSample(s *model.Sample) error {
 	}
 	return nil
 }
+
+// LabelLimits are the limits on the labels of a series; zero limits aren't
+// enforced.
+type LabelLimits struct {
+	MaxLabelNamesPerSeries int
+	MaxLabelNameLength     int
+	MaxLabelValueLength    int
+}
+
+// ValidateLabels returns a LimitError if the labels of a series exceed the
+// limits.
+func ValidateLabels(limits LabelLimits, labels []cortex.LabelPair) error {
+	if limits.MaxLabelNamesPerSeries > 0 && len(labels) > limits.MaxLabelNamesPerSeries {
+		return &LimitError{
+			Limit:      MaxLabelNamesPerSeriesLimit,
+			Configured: float64(limits.MaxLabelNamesPerSeries),
+			Observed:   float64(len(labels)),
+			Message:    fmt.Sprintf("%v: %s", ErrTooManyLabelNames, formatLabels(labels)),
+		}
+	}
+	for _, l := range labels {
+		if limits.MaxLabelNameLength > 0 && len(l.Name) > limits.MaxLabelNameLength {
+			return &LimitError{
+				Limit:      MaxLabelNameLengthLimit,
+				Configured: float64(limits.MaxLabelNameLength),
+				Observed:   float64(len(l.Name)),
+				Message:    fmt.Sprintf("%v: %.200q", ErrLabelNameTooLong, l.Name),
+			}
+		}
+		if limits.MaxLabelValueLength > 0 && len(l.Value) > limits.MaxLabelValueLength {
+			return &LimitError{
+				Limit:      MaxLabelValueLengthLimit,
+				Configured: float64(limits.MaxLabelValueLength),
+				Observed:   float64(len(l.Value)),
+				Message:    fmt.Sprintf("%v: %s=%.200q", ErrLabelValueTooLong, l.Name, l.Value),
+			}
+		}
+	}
+	return nil
+}
+
+// formatLabels returns the series' metric name, or its labels if it has none,
+// to identify it in errors.
+func formatLabels(labels []cortex.LabelPair) string {
+	m := FromLabelPairs(labels)
+	if name, ok := m[model.MetricNameLabel]; ok {
+		return string(name)
+	}
+	return m.String()
+}
@@ -5,6 +5,8 @@ import (
 
 	"github.com/prometheus/common/model"
 	"github.com/stretchr/testify/assert"
+
+	"github.com/weaveworks/cortex"
 )
 
 func TestValidate(t *testing.T) {
@@ -23,3 +25,32 @@ func TestValidate(t *testing.T) {
 		assert.Equal(t, c.err, err, "wrong error")
 	}
 }
+
+func TestValidateLabels(t *testing.T) {
+	limits := LabelLimits{
+		MaxLabelNamesPerSeries: 2,
+		MaxLabelNameLength:     10,
+		MaxLabelValueLength:    5,
+	}
+	for _, c := range []struct {
+		labels []cortex.LabelPair
+		limits LabelLimits
+		err    string
+	}{
+		{labels: toLabelPairs(model.Metric{"__name__": "foo", "a": "b"}), limits: limits},
+		{labels: toLabelPairs(model.Metric{"__name__": "foo", "a": "b", "c": "d"}), limits: limits, err: MaxLabelNamesPerSeriesLimit},
+		{labels: toLabelPairs(model.Metric{"__name__": "foo", "abcdefghijk": "b"}), limits: limits, err: MaxLabelNameLengthLimit},
+		{labels: toLabelPairs(model.Metric{"__name__": "foo", "a": "bcdefg"}), limits: limits, err: MaxLabelValueLengthLimit},
+		{labels: toLabelPairs(model.Metric{"__name__": "foo", "abcdef": "bcdefg", "c": "d"})},
+	} {
+		err := ValidateLabels(c.limits, c.labels)
+		if c.err == "" {
+			assert.NoError(t, err)
+			continue
+		}
+		limitErr, ok := err.(*LimitError)
+		if assert.True(t, ok, "%v", err) {
+			assert.Equal(t, c.err, limitErr.Limit)
+		}
+	}
+}
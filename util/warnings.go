@@ -0,0 +1,115 @@
+package util
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+const warningsContextKey contextKey = 1
+
+// warnings collects the warnings of one request, from however many
+// goroutines serve it.
+type warnings struct {
+	mtx      sync.Mutex
+	warnings []string
+}
+
+// WithWarnings returns a derived context collecting the warnings added to it,
+// eg. that a query's results may be incomplete.
+func WithWarnings(ctx context.Context) context.Context {
+	return context.WithValue(ctx, warningsContextKey, &warnings{})
+}
+
+// AddWarning adds a warning to those collected by the context, if it collects
+// them, ignoring any already added.
+func AddWarning(ctx context.Context, format string, args ...interface{}) {
+	w, ok := ctx.Value(warningsContextKey).(*warnings)
+	if !ok {
+		return
+	}
+	warning := fmt.Sprintf(format, args...)
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	for _, existing := range w.warnings {
+		if existing == warning {
+			return
+		}
+	}
+	w.warnings = append(w.warnings, warning)
+}
+
+// Warnings returns the warnings collected by the context.
+func Warnings(ctx context.Context) []string {
+	w, ok := ctx.Value(warningsContextKey).(*warnings)
+	if !ok {
+		return nil
+	}
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	return append([]string(nil), w.warnings...)
+}
+
+// QueryWarnings is HTTP middleware which collects the warnings of the
+// Prometheus API requests it wraps, adding them to the responses' warnings
+// array, as Prometheus does, so they are shown to users eg. by Grafana.
+type QueryWarnings struct{}
+
+// Wrap implements middleware.Interface.
+func (QueryWarnings) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := WithWarnings(r.Context())
+		buf := &bufferedResponse{header: http.Header{}, code: http.StatusOK}
+		next.ServeHTTP(buf, r.WithContext(ctx))
+
+		body := buf.body.Bytes()
+		if warnings := Warnings(ctx); len(warnings) > 0 && strings.HasPrefix(buf.header.Get("Content-Type"), "application/json") {
+			if withWarnings, err := addWarnings(body, warnings); err == nil {
+				body = withWarnings
+			}
+		}
+		for k, v := range buf.header {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(buf.code)
+		w.Write(body)
+	})
+}
+
+// addWarnings adds the warnings to a JSON API response.
+func addWarnings(body []byte, warnings []string) ([]byte, error) {
+	var resp map[string]json.RawMessage
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, err
+	}
+	encoded, err := json.Marshal(warnings)
+	if err != nil {
+		return nil, err
+	}
+	resp["warnings"] = encoded
+	return json.Marshal(resp)
+}
+
+// bufferedResponse holds a response until the warnings are known.
+type bufferedResponse struct {
+	header http.Header
+	code   int
+	body   bytes.Buffer
+}
+
+func (b *bufferedResponse) Header() http.Header {
+	return b.header
+}
+
+func (b *bufferedResponse) WriteHeader(code int) {
+	b.code = code
+}
+
+func (b *bufferedResponse) Write(p []byte) (int, error) {
+	return b.body.Write(p)
+}
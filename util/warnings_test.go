@@ -0,0 +1,46 @@
+package util
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func TestWarnings(t *testing.T) {
+	// Contexts not collecting warnings ignore them.
+	AddWarning(context.Background(), "ignored")
+	assert.Nil(t, Warnings(context.Background()))
+
+	ctx := WithWarnings(context.Background())
+	AddWarning(ctx, "%d of %d replicas unavailable", 1, 3)
+	AddWarning(ctx, "%d of %d replicas unavailable", 1, 3)
+	AddWarning(ctx, "joining")
+	assert.Equal(t, []string{"1 of 3 replicas unavailable", "joining"}, Warnings(ctx))
+}
+
+func TestQueryWarningsMiddleware(t *testing.T) {
+	for _, tc := range []struct {
+		warning  string
+		expected string
+	}{
+		{"", `{"status":"success","data":{}}`},
+		{"partial", `{"data":{},"status":"success","warnings":["partial"]}`},
+	} {
+		handler := QueryWarnings{}.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if tc.warning != "" {
+				AddWarning(r.Context(), "%s", tc.warning)
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(`{"status":"success","data":{}}`))
+		}))
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/api/v1/query", nil))
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Equal(t, "application/json", recorder.Header().Get("Content-Type"))
+		assert.Equal(t, tc.expected, recorder.Body.String())
+	}
+}